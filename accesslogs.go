@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyAccessLogs enables stage access logs at provision time, and
+	// envKeyAccessLogRetention overrides the days they're kept
+	envKeyAccessLogs           = "ACCESS_LOGS"
+	envKeyAccessLogRetention   = "ACCESS_LOG_RETENTION_DAYS"
+	defaultAccessLogRetention  = 14
+	accessLogGroupResourceName = "AccessLogGroup"
+)
+
+// accessLogFormat is the JSON access log entry. Each value is an API Gateway
+// $context variable.
+var accessLogFormat = map[string]string{
+	"requestId":          "$context.requestId",
+	"requestTime":        "$context.requestTimeEpoch",
+	"connectionId":       "$context.connectionId",
+	"routeKey":           "$context.routeKey",
+	"eventType":          "$context.eventType",
+	"messageId":          "$context.messageId",
+	"status":             "$context.status",
+	"sourceIp":           "$context.identity.sourceIp",
+	"integrationLatency": "$context.integrationLatency",
+	"error":              "$context.error.message",
+	"authorizerError":    "$context.authorizer.error",
+}
+
+// accessLogsEnabled returns true if the stage logs every message to the
+// access log group
+func accessLogsEnabled() bool {
+	return os.Getenv(envKeyAccessLogs) == "true"
+}
+
+// accessLogRetention returns the days the access logs are kept
+func accessLogRetention() (int64, error) {
+	value := os.Getenv(envKeyAccessLogRetention)
+	if value == "" {
+		return defaultAccessLogRetention, nil
+	}
+	retention, retentionErr := strconv.ParseInt(value, 10, 64)
+	if retentionErr != nil || retention < 1 {
+		return 0, fmt.Errorf("%s %q isn't a number of days", envKeyAccessLogRetention, value)
+	}
+	return retention, nil
+}
+
+// accessLogsDecorator provisions the access log group and sends the stage's
+// access logs to it. API Gateway writes the logs with the account's
+// CloudWatch Logs role, which must be configured in the API Gateway account
+// settings.
+func accessLogsDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	retention, retentionErr := accessLogRetention()
+	if retentionErr != nil {
+		return retentionErr
+	}
+	format, formatErr := json.Marshal(accessLogFormat)
+	if formatErr != nil {
+		return formatErr
+	}
+	stage, stageErr := stageResource(template)
+	if stageErr != nil {
+		return stageErr
+	}
+	template.AddResource(accessLogGroupResourceName, &gocf.LogsLogGroup{
+		RetentionInDays: gocf.Integer(retention),
+	})
+	stage.AccessLogSettings = &gocf.APIGatewayV2StageAccessLogSettings{
+		DestinationARN: gocf.GetAtt(accessLogGroupResourceName, "Arn").String(),
+		Format:         gocf.String(string(format)),
+	}
+	return nil
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	apigwManagement "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyAdminAPI provisions the IAM authenticated admin HTTP API
+	envKeyAdminAPI                 = "ADMIN_API"
+	adminAPIResourceName           = "AdminAPI"
+	adminAPIIntegrationName        = "AdminAPIIntegration"
+	adminAPIStageName              = "AdminAPIStage"
+	adminAPIPermissionName         = "AdminAPIPermission"
+	outputAdminAPIURL              = "AdminAPIURL"
+	adminRouteBroadcast            = "POST /broadcast"
+	adminRouteListConnections      = "GET /connections"
+	adminRouteKickConnection       = "DELETE /connections/{connectionId}"
+	adminRouteConnectionStatus     = "GET /connections/{connectionId}"
+	maxAdminBroadcastConnectionIDs = 100
+	// Connections are listed in pages of the limit query parameter
+	defaultAdminConnectionsLimit = 50
+	maxAdminConnectionsLimit     = 100
+)
+
+// adminHandler handles one admin API route. It returns the response status
+// code and the body, which is marshaled as JSON.
+type adminHandler func(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayProxyRequest,
+	logger *logrus.Logger) (int, interface{})
+
+// adminRoutes are the admin API's handlers, by route key
+var adminRoutes = map[string]adminHandler{
+	adminRouteBroadcast:        adminBroadcast,
+	adminRouteListConnections:  adminListConnections,
+	adminRouteKickConnection:   adminKickConnection,
+	adminRouteConnectionStatus: adminConnectionStatus,
+}
+
+// adminError is the body of an admin API error response
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// adminBroadcastRequest is the POST /broadcast body. The data is broadcast
+// to every connection, unless ConnectionIDs or Room selects the recipients.
+type adminBroadcastRequest struct {
+	Data          json.RawMessage `json:"data"`
+	ConnectionIDs []string        `json:"connectionIds,omitempty"`
+	Room          string          `json:"room,omitempty"`
+}
+
+// adminBroadcastResponse is the POST /broadcast response. Missing lists the
+// selected connections that don't exist. Broadcasts to every connection that
+// are delivered asynchronously have empty stats.
+type adminBroadcastResponse struct {
+	RequestID string        `json:"requestId"`
+	Stats     deliveryStats `json:"stats"`
+	Missing   []string      `json:"missing,omitempty"`
+}
+
+// adminConnection is a connection in the GET /connections response
+type adminConnection struct {
+	ConnectionID   string `json:"connectionId"`
+	UserID         string `json:"userId,omitempty"`
+	IdentitySource string `json:"identitySource,omitempty"`
+	Authenticated  bool   `json:"authenticated"`
+	ConnectedAt    string `json:"connectedAt,omitempty"`
+}
+
+// adminConnectionsResponse is the GET /connections response. NextToken is
+// set if there are more connections, and is passed as the nextToken query
+// parameter to list them.
+type adminConnectionsResponse struct {
+	Connections []*adminConnection `json:"connections"`
+	NextToken   string             `json:"nextToken,omitempty"`
+}
+
+// adminStatusResponse is the GET /connections/{connectionId} response.
+// Connection is the stored record, if there is one, and Liveness is API
+// Gateway's view of the connection.
+type adminStatusResponse struct {
+	ConnectionID string              `json:"connectionId"`
+	Connection   *adminConnection    `json:"connection,omitempty"`
+	Liveness     *connectionLiveness `json:"liveness"`
+	Ghost        bool                `json:"ghost"`
+}
+
+// adminKickResponse is the DELETE /connections/{connectionId} response.
+// Disconnected is false if API Gateway had already closed the connection.
+type adminKickResponse struct {
+	ConnectionID string `json:"connectionId"`
+	Disconnected bool   `json:"disconnected"`
+}
+
+// adminAPIEnabled returns true if the stack provisions the admin API
+func adminAPIEnabled() bool {
+	return os.Getenv(envKeyAdminAPI) == "true"
+}
+
+// adminRouteKeys returns the admin API's route keys in a stable order
+func adminRouteKeys() []string {
+	routeKeys := make([]string, 0, len(adminRoutes))
+	for eachRouteKey := range adminRoutes {
+		routeKeys = append(routeKeys, eachRouteKey)
+	}
+	sort.Strings(routeKeys)
+	return routeKeys
+}
+
+// adminResponse returns the JSON response for the handler's result
+func adminResponse(statusCode int, body interface{}) awsEvents.APIGatewayProxyResponse {
+	responseBody, marshalErr := json.Marshal(body)
+	if marshalErr != nil {
+		statusCode = http.StatusInternalServerError
+		responseBody, _ = json.Marshal(&adminError{Error: marshalErr.Error()})
+	}
+	return awsEvents.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}
+}
+
+// adminAPI is the admin API's integration. Requests are signed with SigV4,
+// so only principals that are allowed to execute-api:Invoke the API reach
+// the handlers.
+func adminAPI(ctx context.Context,
+	request awsEvents.APIGatewayProxyRequest) (_ awsEvents.APIGatewayProxyResponse, err error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	logger = correlatedLogger(logger, request.RequestContext.RequestID)
+	sess := newAWSSession(logger)
+	routeKey := request.HTTPMethod + " " + request.Resource
+	ctx, finishInvocation := startInvocation(ctx, "AdminAPI")
+	defer func() {
+		finishInvocation(err)
+	}()
+
+	// Operation
+	handler, handlerExists := adminRoutes[routeKey]
+	if !handlerExists {
+		return adminResponse(http.StatusNotFound, &adminError{
+			Error: fmt.Sprintf("no route for %s", routeKey),
+		}), nil
+	}
+	statusCode, body := handler(ctx, sess, request, logger)
+	logger.WithFields(logrus.Fields{
+		"Route":      routeKey,
+		"StatusCode": statusCode,
+		"Principal":  request.RequestContext.Identity.UserArn,
+	}).Info("Admin request complete")
+	return adminResponse(statusCode, body), nil
+}
+
+// adminBroadcast delivers the request data to every connection, the members
+// of a room, or the selected connections
+func adminBroadcast(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayProxyRequest,
+	logger *logrus.Logger) (int, interface{}) {
+	var broadcast adminBroadcastRequest
+	unmarshalErr := json.Unmarshal([]byte(request.Body), &broadcast)
+	if unmarshalErr != nil {
+		return http.StatusBadRequest, &adminError{Error: unmarshalErr.Error()}
+	}
+	if len(broadcast.Data) == 0 {
+		return http.StatusBadRequest, &adminError{Error: "data is required"}
+	}
+	if len(broadcast.ConnectionIDs) != 0 && broadcast.Room != "" {
+		return http.StatusBadRequest, &adminError{Error: "connectionIds and room are exclusive"}
+	}
+	if len(broadcast.ConnectionIDs) > maxAdminBroadcastConnectionIDs {
+		return http.StatusBadRequest, &adminError{
+			Error: fmt.Sprintf("connectionIds exceeds %d connections", maxAdminBroadcastConnectionIDs),
+		}
+	}
+	endpointURL := os.Getenv(envKeyManagementEndpoint)
+	requestID := request.RequestContext.RequestID
+	response := &adminBroadcastResponse{
+		RequestID: requestID,
+	}
+	var deliverErr error
+	switch {
+	case broadcast.Room != "":
+		response.Stats, deliverErr = deliverRoom(ctx,
+			sess,
+			endpointURL,
+			requestID,
+			&roomFrame{
+				Room: broadcast.Room,
+				Data: broadcast.Data,
+			},
+			logger)
+	case len(broadcast.ConnectionIDs) != 0:
+		dynamoClient := newConnectionsClient(sess)
+		var items []map[string]*dynamodb.AttributeValue
+		for _, eachConnectionID := range broadcast.ConnectionIDs {
+			item, itemErr := getConnectionItem(eachConnectionID, dynamoClient)
+			if itemErr != nil {
+				return http.StatusInternalServerError, &adminError{Error: itemErr.Error()}
+			}
+			if len(item) == 0 {
+				response.Missing = append(response.Missing, eachConnectionID)
+				continue
+			}
+			items = append(items, item)
+		}
+		bcast := newBroadcaster(ctx,
+			sess,
+			endpointURL,
+			requestID,
+			broadcastMessage,
+			broadcast.Data,
+			logger)
+		bcast.deliverItems(ctx, items)
+		response.Stats = bcast.finish(ctx)
+	default:
+		response.Stats, deliverErr = deliverBroadcast(ctx,
+			sess,
+			endpointURL,
+			requestID,
+			broadcast.Data,
+			false,
+			"",
+			"",
+			logger)
+	}
+	if deliverErr != nil {
+		return http.StatusBadGateway, &adminError{Error: deliverErr.Error()}
+	}
+	return http.StatusOK, response
+}
+
+// newAdminConnection returns the admin view of the connection item
+func newAdminConnection(item map[string]*dynamodb.AttributeValue) *adminConnection {
+	record := newConnectionRecord(item)
+	connection := &adminConnection{
+		ConnectionID:   record.ConnectionID,
+		UserID:         record.UserID,
+		IdentitySource: record.IdentitySource,
+		Authenticated:  itemAuthenticated(item),
+	}
+	if !record.ConnectedAt.IsZero() {
+		connection.ConnectedAt = record.ConnectedAt.UTC().Format(time.RFC3339)
+	}
+	return connection
+}
+
+// adminListConnections returns a page of the stored connections. Pages are
+// table scans, so a page may have fewer connections than the limit even if
+// there are more.
+func adminListConnections(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayProxyRequest,
+	logger *logrus.Logger) (int, interface{}) {
+	limit := defaultAdminConnectionsLimit
+	if value := request.QueryStringParameters["limit"]; value != "" {
+		parsedLimit, parseErr := strconv.Atoi(value)
+		if parseErr != nil || parsedLimit < 1 || parsedLimit > maxAdminConnectionsLimit {
+			return http.StatusBadRequest, &adminError{
+				Error: fmt.Sprintf("limit must be between 1 and %d", maxAdminConnectionsLimit),
+			}
+		}
+		limit = parsedLimit
+	}
+	scanInput := &dynamodb.ScanInput{
+		TableName: aws.String(os.Getenv(envKeyTableName)),
+		Limit:     aws.Int64(int64(limit)),
+	}
+	// The token is the last listed connection ID, which is the table key
+	if token := request.QueryStringParameters["nextToken"]; token != "" {
+		startConnectionID, decodeErr := base64.RawURLEncoding.DecodeString(token)
+		if decodeErr != nil || len(startConnectionID) == 0 {
+			return http.StatusBadRequest, &adminError{Error: "nextToken is malformed"}
+		}
+		scanInput.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			ddbAttributeConnectionID: &dynamodb.AttributeValue{
+				S: aws.String(string(startConnectionID)),
+			},
+		}
+	}
+	scanOutput, scanErr := newConnectionsClient(sess).ScanWithContext(ctx, scanInput)
+	if scanErr != nil {
+		return http.StatusInternalServerError, &adminError{Error: scanErr.Error()}
+	}
+	response := &adminConnectionsResponse{
+		Connections: make([]*adminConnection, 0, len(scanOutput.Items)),
+	}
+	for _, eachItem := range scanOutput.Items {
+		response.Connections = append(response.Connections, newAdminConnection(eachItem))
+	}
+	if lastKey := itemString(scanOutput.LastEvaluatedKey, ddbAttributeConnectionID); lastKey != "" {
+		response.NextToken = base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+	}
+	return http.StatusOK, response
+}
+
+// adminConnectionStatus reports whether the connection is stored and whether
+// it's still live. A stored connection that isn't live is a ghost.
+func adminConnectionStatus(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayProxyRequest,
+	logger *logrus.Logger) (int, interface{}) {
+	connectionID := request.PathParameters["connectionId"]
+	if connectionID == "" {
+		return http.StatusBadRequest, &adminError{Error: "connectionId is required"}
+	}
+	item, itemErr := getConnectionItem(connectionID, newConnectionsClient(sess))
+	if itemErr != nil {
+		return http.StatusInternalServerError, &adminError{Error: itemErr.Error()}
+	}
+	liveness, livenessErr := getConnectionLiveness(ctx, itemManagementClient(sess, item), connectionID)
+	if livenessErr != nil {
+		return http.StatusBadGateway, &adminError{Error: livenessErr.Error()}
+	}
+	if len(item) == 0 && !liveness.Live {
+		return http.StatusNotFound, &adminError{
+			Error: fmt.Sprintf("connection %s doesn't exist", connectionID),
+		}
+	}
+	response := &adminStatusResponse{
+		ConnectionID: connectionID,
+		Liveness:     liveness,
+		Ghost:        len(item) != 0 && !liveness.Live,
+	}
+	if len(item) != 0 {
+		response.Connection = newAdminConnection(item)
+	}
+	return http.StatusOK, response
+}
+
+// adminKickConnection force disconnects the connection and deletes its
+// record and room memberships, so that it isn't delivered to before its
+// $disconnect completes
+func adminKickConnection(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayProxyRequest,
+	logger *logrus.Logger) (int, interface{}) {
+	connectionID := request.PathParameters["connectionId"]
+	if connectionID == "" {
+		return http.StatusBadRequest, &adminError{Error: "connectionId is required"}
+	}
+	dynamoClient := newConnectionsClient(sess)
+	item, itemErr := getConnectionItem(connectionID, dynamoClient)
+	if itemErr != nil {
+		return http.StatusInternalServerError, &adminError{Error: itemErr.Error()}
+	}
+	apigwMgmtClient := itemManagementClient(sess, item)
+	response := &adminKickResponse{
+		ConnectionID: connectionID,
+		Disconnected: true,
+	}
+	_, deleteErr := apigwMgmtClient.DeleteConnectionWithContext(ctx,
+		&apigwManagement.DeleteConnectionInput{
+			ConnectionId: aws.String(connectionID),
+		})
+	if deleteErr != nil {
+		if !strings.Contains(deleteErr.Error(), apigwManagement.ErrCodeGoneException) {
+			return http.StatusBadGateway, &adminError{Error: deleteErr.Error()}
+		}
+		if len(item) == 0 {
+			return http.StatusNotFound, &adminError{
+				Error: fmt.Sprintf("connection %s doesn't exist", connectionID),
+			}
+		}
+		response.Disconnected = false
+	}
+	event := &auditEvent{
+		Action:       auditActionKick,
+		ConnectionID: connectionID,
+		Success:      true,
+	}
+	delItemErr := deleteConnection(ctx, connectionID, dynamoClient)
+	if delItemErr != nil {
+		event.Success = false
+		event.Error = delItemErr.Error()
+	}
+	auditErr := newAuditLog(request.RequestContext.RequestID).record(event)
+	if auditErr != nil {
+		logger.WithField("Error", auditErr).Warn("Failed to record audit event")
+	}
+	if delItemErr != nil {
+		return http.StatusInternalServerError, &adminError{Error: delItemErr.Error()}
+	}
+	releaseConnection(ctx, connectionID, newDynamoClient(sess), logger)
+	return http.StatusOK, response
+}
+
+// adminAPIDecorator provisions the admin HTTP API, whose IAM authorized
+// routes are integrated with the lambda, and publishes its URL as a stack
+// output
+func adminAPIDecorator(lambdaFn *sparta.LambdaAWSInfo) sparta.ServiceDecoratorHookHandler {
+	return sparta.ServiceDecoratorHookFunc(func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		lambdaARN := gocf.GetAtt(lambdaFn.LogicalResourceName(), "Arn")
+		apiID := gocf.Ref(adminAPIResourceName).String()
+		template.AddResource(adminAPIResourceName, &gocf.APIGatewayV2API{
+			Name:         gocf.String(serviceName + "-admin"),
+			ProtocolType: gocf.String("HTTP"),
+			Description:  gocf.String("Server-side administration of " + serviceName),
+		})
+		template.AddResource(adminAPIIntegrationName, &gocf.APIGatewayV2Integration{
+			APIID:                apiID,
+			IntegrationType:      gocf.String("AWS_PROXY"),
+			IntegrationURI:       lambdaARN.String(),
+			PayloadFormatVersion: gocf.String("1.0"),
+		})
+		for _, eachRouteKey := range adminRouteKeys() {
+			template.AddResource(sparta.CloudFormationResourceName("AdminRoute", eachRouteKey),
+				&gocf.APIGatewayV2Route{
+					APIID:             apiID,
+					RouteKey:          gocf.String(eachRouteKey),
+					AuthorizationType: gocf.String("AWS_IAM"),
+					Target: gocf.Join("",
+						gocf.String("integrations/"),
+						gocf.Ref(adminAPIIntegrationName)),
+				})
+		}
+		template.AddResource(adminAPIStageName, &gocf.APIGatewayV2Stage{
+			APIID:      apiID,
+			StageName:  gocf.String("$default"),
+			AutoDeploy: gocf.Bool(true),
+		})
+		template.AddResource(adminAPIPermissionName, &gocf.LambdaPermission{
+			Action:       gocf.String("lambda:InvokeFunction"),
+			FunctionName: lambdaARN.String(),
+			Principal:    gocf.String("apigateway.amazonaws.com"),
+			SourceArn: gocf.Join("",
+				gocf.String("arn:"),
+				gocf.Ref("AWS::Partition"),
+				gocf.String(":execute-api:"),
+				gocf.Ref("AWS::Region"),
+				gocf.String(":"),
+				gocf.Ref("AWS::AccountId"),
+				gocf.String(":"),
+				gocf.Ref(adminAPIResourceName),
+				gocf.String("/*")),
+		})
+		template.Outputs[outputAdminAPIURL] = &gocf.Output{
+			Description: "IAM authenticated admin API endpoint",
+			Value: gocf.Join("",
+				gocf.String("https://"),
+				gocf.Ref(adminAPIResourceName),
+				gocf.String(".execute-api."),
+				gocf.Ref("AWS::Region"),
+				gocf.String("."),
+				gocf.Ref("AWS::URLSuffix")),
+			Export: stackExport(outputAdminAPIURL),
+		}
+		return nil
+	})
+}
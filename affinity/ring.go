@@ -0,0 +1,66 @@
+// Package affinity assigns keys (connections, rooms, games) to named worker
+// shards with a consistent hash ring. Adding or removing a shard only moves
+// the keys adjacent to it on the ring, so stateful workers keep handling the
+// same keys across deployments.
+package affinity
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// DefaultReplicas is the number of virtual nodes per shard
+const DefaultReplicas = 64
+
+// Ring is an immutable consistent hash ring. It's safe for concurrent use.
+type Ring struct {
+	hashes []uint64
+	shards map[uint64]string
+}
+
+// NewRing returns a Ring for the shards with the given number of virtual
+// nodes per shard. Values less than 1 use DefaultReplicas.
+func NewRing(shards []string, replicas int) (*Ring, error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("affinity: at least one shard is required")
+	}
+	if replicas < 1 {
+		replicas = DefaultReplicas
+	}
+	ring := &Ring{
+		shards: make(map[uint64]string, len(shards)*replicas),
+	}
+	for _, eachShard := range shards {
+		for replica := 0; replica < replicas; replica++ {
+			hash := hashKey(fmt.Sprintf("%s#%d", eachShard, replica))
+			if _, collision := ring.shards[hash]; collision {
+				continue
+			}
+			ring.shards[hash] = eachShard
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool {
+		return ring.hashes[i] < ring.hashes[j]
+	})
+	return ring, nil
+}
+
+// Shard returns the shard that owns the key
+func (ring *Ring) Shard(key string) string {
+	hash := hashKey(key)
+	index := sort.Search(len(ring.hashes), func(i int) bool {
+		return ring.hashes[i] >= hash
+	})
+	if index == len(ring.hashes) {
+		index = 0
+	}
+	return ring.shards[ring.hashes[index]]
+}
+
+func hashKey(key string) uint64 {
+	sum := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
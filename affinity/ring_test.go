@@ -0,0 +1,69 @@
+package affinity
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNewRing(t *testing.T) {
+	if _, ringErr := NewRing(nil, DefaultReplicas); ringErr == nil {
+		t.Errorf("NewRing(nil) succeeded, want an error")
+	}
+	ring, ringErr := NewRing([]string{"shard-0"}, 0)
+	if ringErr != nil {
+		t.Fatalf("NewRing failed: %s", ringErr)
+	}
+	if len(ring.hashes) != DefaultReplicas {
+		t.Errorf("Virtual nodes = %d, want %d", len(ring.hashes), DefaultReplicas)
+	}
+}
+
+func TestShard(t *testing.T) {
+	shards := []string{"shard-0", "shard-1", "shard-2", "shard-3"}
+	ring, ringErr := NewRing(shards, DefaultReplicas)
+	if ringErr != nil {
+		t.Fatalf("NewRing failed: %s", ringErr)
+	}
+	reordered, reorderedErr := NewRing([]string{"shard-3", "shard-2", "shard-1", "shard-0"},
+		DefaultReplicas)
+	if reorderedErr != nil {
+		t.Fatalf("NewRing failed: %s", reorderedErr)
+	}
+	grown, grownErr := NewRing(append(shards, "shard-4"), DefaultReplicas)
+	if grownErr != nil {
+		t.Fatalf("NewRing failed: %s", grownErr)
+	}
+	const keyCount = 10000
+	counts := make(map[string]int)
+	moved := 0
+	for eachIndex := 0; eachIndex < keyCount; eachIndex++ {
+		key := fmt.Sprintf("conn-%d", eachIndex)
+		shard := ring.Shard(key)
+		counts[shard]++
+		if reorderedShard := reordered.Shard(key); reorderedShard != shard {
+			t.Fatalf("Shard(%q) = %q, want %q regardless of the shard order", key, reorderedShard, shard)
+		}
+		// Adding a shard only moves keys to the new shard
+		if grownShard := grown.Shard(key); grownShard != shard {
+			if grownShard != "shard-4" {
+				t.Fatalf("Shard(%q) moved from %q to %q, want shard-4", key, shard, grownShard)
+			}
+			moved++
+		}
+	}
+	for _, eachShard := range shards {
+		if counts[eachShard] < keyCount/len(shards)/2 {
+			t.Errorf("%s owns %d of %d keys, want about %d",
+				eachShard,
+				counts[eachShard],
+				keyCount,
+				keyCount/len(shards))
+		}
+	}
+	if moved == 0 || moved > keyCount/3 {
+		t.Errorf("Adding a fifth shard moved %d of %d keys, want about %d",
+			moved,
+			keyCount,
+			keyCount/5)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyAlarms provisions the stack's alarms, envKeyAlarmEmail subscribes
+	// an address to their notifications, and envKeyAlarmErrorRate overrides
+	// the error rate percentage that triggers them
+	envKeyAlarms                     = "ALARMS"
+	envKeyAlarmEmail                 = "ALARM_EMAIL"
+	envKeyAlarmErrorRate             = "ALARM_ERROR_RATE"
+	defaultAlarmErrorRate            = 5
+	alarmPeriod                      = 300
+	alarmTopicResourceName           = "AlarmTopic"
+	alarmSubscriptionResourceName    = "AlarmEmailSubscription"
+	integrationErrorAlarmName        = "IntegrationErrorRateAlarm"
+	connectionTableThrottleAlarmName = "ConnectionTableThrottleAlarm"
+)
+
+// alarmsEnabled returns true if the stack provisions alarms
+func alarmsEnabled() bool {
+	return os.Getenv(envKeyAlarms) == "true"
+}
+
+// alarmErrorRate returns the error rate percentage that triggers the rate
+// alarms
+func alarmErrorRate() (int64, error) {
+	value := os.Getenv(envKeyAlarmErrorRate)
+	if value == "" {
+		return defaultAlarmErrorRate, nil
+	}
+	rate, rateErr := strconv.ParseInt(value, 10, 64)
+	if rateErr != nil || rate < 1 || rate > 100 {
+		return 0, fmt.Errorf("%s %q isn't a percentage", envKeyAlarmErrorRate, value)
+	}
+	return rate, nil
+}
+
+// alarmMetric returns the query for the metric's sum over the alarm period
+func alarmMetric(id string,
+	namespace string,
+	metricName string,
+	dimensions gocf.CloudWatchAlarmDimensionList) gocf.CloudWatchAlarmMetricDataQuery {
+	return gocf.CloudWatchAlarmMetricDataQuery{
+		ID: gocf.String(id),
+		MetricStat: &gocf.CloudWatchAlarmMetricStat{
+			Metric: &gocf.CloudWatchAlarmMetric{
+				Namespace:  gocf.String(namespace),
+				MetricName: gocf.String(metricName),
+				Dimensions: &dimensions,
+			},
+			Period: gocf.Integer(alarmPeriod),
+			Stat:   gocf.String("Sum"),
+		},
+		ReturnData: gocf.Bool(false),
+	}
+}
+
+// functionDimensions returns the dimensions of the lambda's metrics
+func functionDimensions(lambdaFn *sparta.LambdaAWSInfo) gocf.CloudWatchAlarmDimensionList {
+	return gocf.CloudWatchAlarmDimensionList{
+		{
+			Name:  gocf.String("FunctionName"),
+			Value: gocf.Ref(lambdaFn.LogicalResourceName()).String(),
+		},
+	}
+}
+
+// alarm returns an alarm that's triggered when the expression of the metrics
+// exceeds the threshold. Periods without data, such as when a lambda isn't
+// invoked, aren't breaching.
+func alarm(description string,
+	threshold int64,
+	expression string,
+	metrics ...gocf.CloudWatchAlarmMetricDataQuery) *gocf.CloudWatchAlarm {
+	queries := gocf.CloudWatchAlarmMetricDataQueryList(append(metrics,
+		gocf.CloudWatchAlarmMetricDataQuery{
+			ID:         gocf.String("result"),
+			Expression: gocf.String(expression),
+			Label:      gocf.String(description),
+			ReturnData: gocf.Bool(true),
+		}))
+	return &gocf.CloudWatchAlarm{
+		AlarmDescription:   gocf.String(description),
+		ComparisonOperator: gocf.String("GreaterThanThreshold"),
+		EvaluationPeriods:  gocf.Integer(1),
+		Threshold:          gocf.Integer(threshold),
+		TreatMissingData:   gocf.String("notBreaching"),
+		Metrics:            &queries,
+	}
+}
+
+// errorRateAlarmName returns the logical name of the lambda's error rate
+// alarm
+func errorRateAlarmName(lambdaFn *sparta.LambdaAWSInfo) string {
+	return lambdaFn.LogicalResourceName() + "ErrorRateAlarm"
+}
+
+// alarmsDecorator provisions alarms on each lambda's error rate, each
+// broadcaster's delivery failure rate, the gateway's integration error rate,
+// and connection table throttles. If ALARM_EMAIL is set the alarms notify an
+// SNS topic that the address is subscribed to.
+func alarmsDecorator(apiGateway *sparta.APIV2,
+	lambdaFns []*sparta.LambdaAWSInfo,
+	broadcasters []*sparta.LambdaAWSInfo,
+	tableName *gocf.StringExpr) sparta.ServiceDecoratorHookHandler {
+	return sparta.ServiceDecoratorHookFunc(func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		errorRate, errorRateErr := alarmErrorRate()
+		if errorRateErr != nil {
+			return errorRateErr
+		}
+		alarms := make(map[string]*gocf.CloudWatchAlarm)
+		for _, eachLambda := range lambdaFns {
+			functionName := functionDimensions(eachLambda)
+			alarms[errorRateAlarmName(eachLambda)] = alarm(
+				fmt.Sprintf("%s error rate", eachLambda.LogicalResourceName()),
+				errorRate,
+				"100 * errors / invocations",
+				alarmMetric("errors", "AWS/Lambda", "Errors", functionName),
+				alarmMetric("invocations", "AWS/Lambda", "Invocations", functionName))
+		}
+		for _, eachLambda := range broadcasters {
+			functionName := functionDimensions(eachLambda)
+			alarms[eachLambda.LogicalResourceName()+"DeliveryFailureRateAlarm"] = alarm(
+				fmt.Sprintf("%s delivery failure rate", eachLambda.LogicalResourceName()),
+				errorRate,
+				"100 * failures / (sent + failures)",
+				alarmMetric("failures", metricsNamespace, metricDeliveryFailures, functionName),
+				alarmMetric("sent", metricsNamespace, metricMessagesSent, functionName))
+		}
+		stage := gocf.CloudWatchAlarmDimensionList{
+			{
+				Name:  gocf.String("ApiId"),
+				Value: gocf.Ref(apiGateway.LogicalResourceName()).String(),
+			},
+			{
+				Name:  gocf.String("Stage"),
+				Value: gocf.String(apiStageName),
+			},
+		}
+		alarms[integrationErrorAlarmName] = alarm("Integration error rate",
+			errorRate,
+			"100 * errors / (messages + connects)",
+			alarmMetric("errors", "AWS/ApiGateway", "IntegrationError", stage),
+			alarmMetric("messages", "AWS/ApiGateway", "MessageCount", stage),
+			alarmMetric("connects", "AWS/ApiGateway", "ConnectCount", stage))
+		table := gocf.CloudWatchAlarmDimensionList{
+			{
+				Name:  gocf.String("TableName"),
+				Value: tableName,
+			},
+		}
+		alarms[connectionTableThrottleAlarmName] = alarm("Connection table throttles",
+			0,
+			"reads + writes",
+			alarmMetric("reads", "AWS/DynamoDB", "ReadThrottleEvents", table),
+			alarmMetric("writes", "AWS/DynamoDB", "WriteThrottleEvents", table))
+
+		alarmEmail := os.Getenv(envKeyAlarmEmail)
+		if alarmEmail != "" {
+			template.AddResource(alarmTopicResourceName, &gocf.SNSTopic{})
+			template.AddResource(alarmSubscriptionResourceName, &gocf.SNSSubscription{
+				Endpoint: gocf.String(alarmEmail),
+				Protocol: gocf.String("email"),
+				TopicArn: gocf.Ref(alarmTopicResourceName).String(),
+			})
+		}
+		for eachName, eachAlarm := range alarms {
+			if alarmEmail != "" {
+				eachAlarm.AlarmActions = gocf.StringList(gocf.Ref(alarmTopicResourceName))
+				eachAlarm.OKActions = gocf.StringList(gocf.Ref(alarmTopicResourceName))
+			}
+			template.AddResource(eachName, eachAlarm)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+)
+
+const (
+	// ddbAttributeAttributes is the connection item's map of client
+	// attributes that broadcast filters match against
+	ddbAttributeAttributes = "attributes"
+	// attributeQueryPrefix prefixes the $connect query string parameters
+	// that set connection attributes, eg ?attr.region=eu
+	attributeQueryPrefix = "attr."
+	// maxConnectionAttributes bounds the attributes per connection, since
+	// connection items are read by every broadcast
+	maxConnectionAttributes     = 16
+	maxConnectionAttributeValue = 256
+)
+
+// attributeNamePattern matches valid connection attribute names
+var attributeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// attributesSchema is the update route's request data schema. A null value
+// removes the attribute.
+var attributesSchema = newRequestSchema(`{
+	"type": "object",
+	"required": ["attributes"],
+	"properties": {
+		"attributes": {
+			"type": "object",
+			"maxProperties": 16,
+			"propertyNames": {"pattern": "^[A-Za-z0-9_-]{1,64}$"},
+			"additionalProperties": {"type": ["string", "null"], "maxLength": 256}
+		}
+	}
+}`)
+
+// attributesRequest is the data of an update frame
+type attributesRequest struct {
+	Attributes map[string]*string `json:"attributes"`
+}
+
+// attributesResponse is the update route response body
+type attributesResponse struct {
+	Attributes map[string]string `json:"attributes"`
+}
+
+// validAttribute returns true if the attribute can be stored with the
+// connection
+func validAttribute(name string, value string) bool {
+	return attributeNamePattern.MatchString(name) && len(value) <= maxConnectionAttributeValue
+}
+
+// handshakeAttributes returns the connection attributes set by the $connect
+// query string. Invalid attributes, and those beyond the limit in name
+// order, are ignored.
+func handshakeAttributes(request awsEvents.APIGatewayWebsocketProxyRequest) map[string]*dynamodb.AttributeValue {
+	// Query parameters are sorted so that the same attributes are kept
+	// beyond the limit
+	parameters := make([]string, 0, len(request.QueryStringParameters))
+	for eachName := range request.QueryStringParameters {
+		if strings.HasPrefix(eachName, attributeQueryPrefix) {
+			parameters = append(parameters, eachName)
+		}
+	}
+	sort.Strings(parameters)
+	attributes := make(map[string]*dynamodb.AttributeValue)
+	for _, eachName := range parameters {
+		eachValue := request.QueryStringParameters[eachName]
+		name := strings.TrimPrefix(eachName, attributeQueryPrefix)
+		if !validAttribute(name, eachValue) || len(attributes) == maxConnectionAttributes {
+			continue
+		}
+		attributes[name] = &dynamodb.AttributeValue{
+			S: aws.String(eachValue),
+		}
+	}
+	if len(attributes) == 0 {
+		return nil
+	}
+	return map[string]*dynamodb.AttributeValue{
+		ddbAttributeAttributes: &dynamodb.AttributeValue{
+			M: attributes,
+		},
+	}
+}
+
+// updateAttributes sets or, for null values, removes the sender's
+// connection attributes and responds with the connection's attributes. Each
+// attribute is updated individually, and the limit is a condition of the
+// update, so that concurrent updates neither undo each other nor exceed it.
+func updateAttributes(ctx context.Context,
+	call *wsCall[attributesRequest]) (*attributesResponse, error) {
+	// Preconditions
+	attributes := itemStringMap(call.senderItem, ddbAttributeAttributes)
+	names := make([]string, 0, len(call.data.Attributes))
+	merged := len(attributes)
+	for eachName, eachValue := range call.data.Attributes {
+		if eachValue != nil && !validAttribute(eachName, *eachValue) {
+			return nil, call.fail(errorCodeMalformedRequest, catalog.InvalidAttribute, maxConnectionAttributes)
+		}
+		_, exists := attributes[eachName]
+		if eachValue != nil && !exists {
+			merged++
+		} else if eachValue == nil && exists {
+			merged--
+		}
+		names = append(names, eachName)
+	}
+	sort.Strings(names)
+	if merged > maxConnectionAttributes {
+		return nil, call.fail(errorCodeMalformedRequest, catalog.InvalidAttribute, maxConnectionAttributes)
+	}
+
+	// Operation
+	connectionKey := map[string]*dynamodb.AttributeValue{
+		ddbAttributeConnectionID: &dynamodb.AttributeValue{
+			S: aws.String(call.request.RequestContext.ConnectionID),
+		},
+	}
+	if call.senderItem[ddbAttributeAttributes] == nil || call.senderItem[ddbAttributeAttributes].M == nil {
+		// Attribute paths can only be set in an existing map
+		_, createErr := call.dynamoClient.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(os.Getenv(envKeyTableName)),
+			Key:                 connectionKey,
+			ConditionExpression: aws.String("attribute_exists(#connectionID)"),
+			UpdateExpression:    aws.String("SET #attributes = if_not_exists(#attributes, :attributes)"),
+			ExpressionAttributeNames: map[string]*string{
+				"#connectionID": aws.String(ddbAttributeConnectionID),
+				"#attributes":   aws.String(ddbAttributeAttributes),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":attributes": &dynamodb.AttributeValue{
+					M: map[string]*dynamodb.AttributeValue{},
+				},
+			},
+		})
+		if createErr != nil {
+			return nil, createErr
+		}
+	}
+	expressionNames := map[string]*string{
+		"#connectionID": aws.String(ddbAttributeConnectionID),
+		"#attributes":   aws.String(ddbAttributeAttributes),
+	}
+	expressionValues := map[string]*dynamodb.AttributeValue{}
+	var setPaths []string
+	var removePaths []string
+	var existing []string
+	for index, eachName := range names {
+		placeholder := fmt.Sprintf("a%d", index)
+		expressionNames["#"+placeholder] = aws.String(eachName)
+		path := "#attributes.#" + placeholder
+		eachValue := call.data.Attributes[eachName]
+		if eachValue == nil {
+			removePaths = append(removePaths, path)
+			continue
+		}
+		expressionValues[":"+placeholder] = &dynamodb.AttributeValue{
+			S: aws.String(*eachValue),
+		}
+		setPaths = append(setPaths, path+" = :"+placeholder)
+		existing = append(existing, "attribute_exists("+path+")")
+	}
+	condition := "attribute_exists(#connectionID)"
+	if len(setPaths) != 0 {
+		// The update fits if the map has room for every set attribute, or
+		// if every set attribute already exists
+		expressionValues[":headroom"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.Itoa(maxConnectionAttributes - len(setPaths))),
+		}
+		condition += fmt.Sprintf(" AND (size(#attributes) <= :headroom OR (%s))",
+			strings.Join(existing, " AND "))
+	}
+	var updateExpression []string
+	if len(setPaths) != 0 {
+		updateExpression = append(updateExpression, "SET "+strings.Join(setPaths, ", "))
+	}
+	if len(removePaths) != 0 {
+		updateExpression = append(updateExpression, "REMOVE "+strings.Join(removePaths, ", "))
+	}
+	if len(updateExpression) == 0 {
+		return &attributesResponse{
+			Attributes: nonNilStringMap(attributes),
+		}, nil
+	}
+	updateInput := &dynamodb.UpdateItemInput{
+		TableName:                aws.String(os.Getenv(envKeyTableName)),
+		Key:                      connectionKey,
+		ConditionExpression:      aws.String(condition),
+		UpdateExpression:         aws.String(strings.Join(updateExpression, " ")),
+		ExpressionAttributeNames: expressionNames,
+		ReturnValues:             aws.String(dynamodb.ReturnValueAllNew),
+	}
+	if len(expressionValues) != 0 {
+		updateInput.ExpressionAttributeValues = expressionValues
+	}
+	updateOutput, updateErr := call.dynamoClient.UpdateItemWithContext(ctx, updateInput)
+	if conditionalCheckFailed(updateErr) {
+		// A concurrent update filled the map
+		return nil, call.fail(errorCodeMalformedRequest, catalog.InvalidAttribute, maxConnectionAttributes)
+	}
+	if updateErr != nil {
+		return nil, updateErr
+	}
+	attributes = itemStringMap(updateOutput.Attributes, ddbAttributeAttributes)
+	// Keep the Redis connection store's copy current for broadcast filters
+	indexErr := reindexConnection(ctx, call.request.RequestContext.ConnectionID, updateOutput.Attributes)
+	if indexErr != nil {
+		call.logger.WithField("Error", indexErr).Warn("Failed to index connection attributes")
+	}
+	markConnectionsChanged(ctx, newDynamoClient(call.sess), call.logger)
+	call.logger.WithField("Attributes", attributes).Debug("Updated connection attributes")
+	return &attributesResponse{
+		Attributes: nonNilStringMap(attributes),
+	}, nil
+}
+
+// nonNilStringMap returns the map, or an empty map for nil, so that the
+// response lists no attributes rather than null
+func nonNilStringMap(values map[string]string) map[string]string {
+	if values == nil {
+		return map[string]string{}
+	}
+	return values
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Audit actions
+	auditActionGoneCleanup = "goneCleanup"
+	auditActionReap        = "reap"
+	auditActionKick        = "kick"
+	auditActionModerate    = "moderate"
+)
+
+// auditEvent is a single record in the audit stream
+type auditEvent struct {
+	Action       string `json:"action"`
+	ConnectionID string `json:"connectionId"`
+	RequestID    string `json:"requestId,omitempty"`
+	Success      bool   `json:"success"`
+	Error        string `json:"error,omitempty"`
+	// Verdict and Reasons are the moderation verdict of a moderate event
+	Verdict   string    `json:"verdict,omitempty"`
+	Reasons   []string  `json:"reasons,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// auditRecord is the log line wrapper that lets a subscription filter
+// (eg, `{ $.audit.action = * }`) route audit events to their own destination
+type auditRecord struct {
+	Audit *auditEvent `json:"audit"`
+}
+
+// auditLog writes audit events as JSON lines to the function log. It's safe
+// for concurrent use.
+type auditLog struct {
+	writer    io.Writer
+	requestID string
+	mutex     sync.Mutex
+}
+
+func newAuditLog(requestID string) *auditLog {
+	return &auditLog{
+		writer:    os.Stdout,
+		requestID: requestID,
+	}
+}
+
+// record writes the event, stamping the request ID and time
+func (log *auditLog) record(event *auditEvent) error {
+	event.RequestID = log.requestID
+	event.Timestamp = time.Now().UTC()
+	recordJSON, recordJSONErr := json.Marshal(&auditRecord{Audit: event})
+	if recordJSONErr != nil {
+		return recordJSONErr
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	_, writeErr := fmt.Fprintln(log.writer, string(recordJSON))
+	return writeErr
+}
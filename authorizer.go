@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/authorizer"
+	gocf "github.com/mweagle/go-cloudformation"
+)
+
+const (
+	// Provision-time environment variables that enable the $connect
+	// authorizer. COGNITO_USER_POOL_ID (eg, us-east-1_AbCdEf123) is shorthand
+	// for the user pool's JWT_ISSUER. JWT_AUDIENCE is the app client ID.
+	// JWT_TOKEN_USE is the required token_use claim, access or id, which
+	// defaults to access for user pools.
+	envKeyJWTIssuer         = "JWT_ISSUER"
+	envKeyJWTAudience       = "JWT_AUDIENCE"
+	envKeyJWTTokenUse       = "JWT_TOKEN_USE"
+	envKeyCognitoUserPoolID = "COGNITO_USER_POOL_ID"
+	cognitoTokenUseAccess   = "access"
+)
+
+// customConnectValidator validates $connect requests in place of the JWT
+// validator. Assign it in an init function so that it's set both when
+// provisioning and in the lambda. connectIdentitySources are the request
+// values the validator reads; API Gateway rejects a handshake that's missing
+// any of them.
+var (
+	customConnectValidator authorizer.Validator
+	connectIdentitySources = []string{authorizer.QueryStringSource(authorizer.QueryParamToken)}
+)
+
+// jwtIssuer returns the configured token issuer
+func jwtIssuer() string {
+	if issuer := os.Getenv(envKeyJWTIssuer); issuer != "" {
+		return strings.TrimSuffix(issuer, "/")
+	}
+	userPoolID := os.Getenv(envKeyCognitoUserPoolID)
+	if userPoolID == "" {
+		return ""
+	}
+	region := strings.SplitN(userPoolID, "_", 2)[0]
+	return fmt.Sprintf("https://cognito-idp.%s.amazonaws.com/%s", region, userPoolID)
+}
+
+// jwtTokenUse returns the required token_use claim, or the empty string if
+// tokens of any use are accepted
+func jwtTokenUse() string {
+	if tokenUse := os.Getenv(envKeyJWTTokenUse); tokenUse != "" {
+		return tokenUse
+	}
+	if os.Getenv(envKeyJWTIssuer) == "" && os.Getenv(envKeyCognitoUserPoolID) != "" {
+		return cognitoTokenUseAccess
+	}
+	return ""
+}
+
+// connectValidator returns the $connect validator, or nil if connecting
+// doesn't require authorization
+func connectValidator() authorizer.Validator {
+	if customConnectValidator != nil {
+		return customConnectValidator
+	}
+	if issuer := jwtIssuer(); issuer != "" {
+		return authorizer.NewJWTValidator(issuer, os.Getenv(envKeyJWTAudience), jwtTokenUse())
+	}
+	return nil
+}
+
+// annotateConnectAuthorizer publishes the provision-time issuer, audience,
+// and token use in the authorizer lambda environment
+func annotateConnectAuthorizer(lambdaFn *sparta.LambdaAWSInfo) {
+	if customConnectValidator != nil {
+		return
+	}
+	setEnvironment(lambdaFn, envKeyJWTIssuer, gocf.String(jwtIssuer()))
+	setEnvironment(lambdaFn, envKeyJWTAudience, gocf.String(os.Getenv(envKeyJWTAudience)))
+	setEnvironment(lambdaFn, envKeyJWTTokenUse, gocf.String(jwtTokenUse()))
+}
@@ -0,0 +1,96 @@
+// Package authorizer runs and provisions a REQUEST Lambda authorizer for the
+// websocket $connect route. Token validation is supplied as a Validator, so
+// it lives alongside the other handlers rather than in an externally managed
+// authorizer.
+package authorizer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrUnauthorized is the authorizer error that API Gateway maps to a 401
+var ErrUnauthorized = errors.New("Unauthorized")
+
+// Identity is a validated caller
+type Identity struct {
+	// PrincipalID identifies the caller (eg, the sub claim)
+	PrincipalID string
+	// Context is passed to the route handlers in the request context's
+	// authorizer object. Values must be strings, numbers, or booleans.
+	Context map[string]interface{}
+}
+
+// Validator validates the $connect request
+type Validator interface {
+	Validate(ctx context.Context,
+		request awsEvents.APIGatewayCustomAuthorizerRequestTypeRequest) (*Identity, error)
+}
+
+// ValidatorFunc adapts a function to a Validator
+type ValidatorFunc func(ctx context.Context,
+	request awsEvents.APIGatewayCustomAuthorizerRequestTypeRequest) (*Identity, error)
+
+// Validate calls the function
+func (validatorFn ValidatorFunc) Validate(ctx context.Context,
+	request awsEvents.APIGatewayCustomAuthorizerRequestTypeRequest) (*Identity, error) {
+	return validatorFn(ctx, request)
+}
+
+// Handler is the authorizer lambda function signature
+type Handler func(ctx context.Context,
+	request awsEvents.APIGatewayCustomAuthorizerRequestTypeRequest) (awsEvents.APIGatewayCustomAuthorizerResponse, error)
+
+// NewHandler returns an authorizer lambda function that allows the
+// connection if the validator returns an identity. Validation errors are
+// logged and rejected with ErrUnauthorized.
+func NewHandler(validator Validator) Handler {
+	return func(ctx context.Context,
+		request awsEvents.APIGatewayCustomAuthorizerRequestTypeRequest) (awsEvents.APIGatewayCustomAuthorizerResponse, error) {
+		identity, validateErr := validator.Validate(ctx, request)
+		if validateErr != nil || identity == nil {
+			if logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger); logger != nil {
+				logger.WithField("Error", validateErr).Info("Rejected $connect request")
+			}
+			return awsEvents.APIGatewayCustomAuthorizerResponse{}, ErrUnauthorized
+		}
+		return awsEvents.APIGatewayCustomAuthorizerResponse{
+			PrincipalID: identity.PrincipalID,
+			PolicyDocument: awsEvents.APIGatewayCustomAuthorizerPolicy{
+				Version: "2012-10-17",
+				Statement: []awsEvents.IAMPolicyStatement{
+					{
+						Action:   []string{"execute-api:Invoke"},
+						Effect:   "Allow",
+						Resource: []string{request.MethodArn},
+					},
+				},
+			},
+			Context: identity.Context,
+		}, nil
+	}
+}
+
+// FlattenContext converts the values to ones the authorizer context
+// supports. Strings, numbers, and booleans are unchanged; other values (eg,
+// arrays of groups) are JSON encoded.
+func FlattenContext(values map[string]interface{}) map[string]interface{} {
+	authContext := make(map[string]interface{}, len(values))
+	for eachName, eachValue := range values {
+		switch eachValue.(type) {
+		case string, float64, bool:
+			authContext[eachName] = eachValue
+		default:
+			valueJSON, valueJSONErr := json.Marshal(eachValue)
+			if valueJSONErr == nil {
+				authContext[eachName] = string(valueJSON)
+			}
+		}
+	}
+	return authContext
+}
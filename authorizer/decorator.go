@@ -0,0 +1,97 @@
+package authorizer
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ResourceName is the template resource name of the authorizer
+	ResourceName   = "ConnectAuthorizer"
+	permissionName = "ConnectAuthorizerPermission"
+	connectRoute   = "$connect"
+)
+
+// QueryStringSource returns the identity source for the query parameter
+func QueryStringSource(name string) string {
+	return "route.request.querystring." + name
+}
+
+// HeaderSource returns the identity source for the request header
+func HeaderSource(name string) string {
+	return "route.request.header." + name
+}
+
+// NewDecorator returns a service decorator that provisions the lambda as the
+// REQUEST authorizer of the API's $connect route. API Gateway rejects the
+// handshake without invoking the authorizer if any identity source is
+// missing; at least one is required. Sparta's route AuthorizerID only
+// accepts a literal ID, so the route resource is updated in the template to
+// reference the authorizer provisioned alongside it.
+func NewDecorator(apiGateway *sparta.APIV2,
+	authorizerFn *sparta.LambdaAWSInfo,
+	identitySources ...string) (sparta.ServiceDecoratorHookHandler, error) {
+	if len(identitySources) == 0 {
+		return nil, fmt.Errorf("authorizer requires at least one identity source")
+	}
+	return sparta.ServiceDecoratorHookFunc(func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		authorizerARN := gocf.GetAtt(authorizerFn.LogicalResourceName(), "Arn")
+		sources := make([]gocf.Stringable, 0, len(identitySources))
+		for _, eachSource := range identitySources {
+			sources = append(sources, gocf.String(eachSource))
+		}
+		template.AddResource(ResourceName, &gocf.APIGatewayV2Authorizer{
+			APIID:          gocf.Ref(apiGateway.LogicalResourceName()).String(),
+			AuthorizerType: gocf.String("REQUEST"),
+			AuthorizerURI: gocf.Join("",
+				gocf.String("arn:"),
+				gocf.Ref("AWS::Partition"),
+				gocf.String(":apigateway:"),
+				gocf.Ref("AWS::Region"),
+				gocf.String(":lambda:path/2015-03-31/functions/"),
+				authorizerARN,
+				gocf.String("/invocations")),
+			IdentitySource: gocf.StringList(sources...),
+			Name:           gocf.String(ResourceName),
+		})
+		template.AddResource(permissionName, &gocf.LambdaPermission{
+			Action:       gocf.String("lambda:InvokeFunction"),
+			FunctionName: authorizerARN.String(),
+			Principal:    gocf.String("apigateway.amazonaws.com"),
+			SourceArn: gocf.Join("",
+				gocf.String("arn:"),
+				gocf.Ref("AWS::Partition"),
+				gocf.String(":execute-api:"),
+				gocf.Ref("AWS::Region"),
+				gocf.String(":"),
+				gocf.Ref("AWS::AccountId"),
+				gocf.String(":"),
+				gocf.Ref(apiGateway.LogicalResourceName()),
+				gocf.String("/authorizers/"),
+				gocf.Ref(ResourceName)),
+		})
+		for _, eachResource := range template.Resources {
+			route, isRoute := eachResource.Properties.(*gocf.APIGatewayV2Route)
+			if !isRoute || route.RouteKey == nil || route.RouteKey.Literal != connectRoute {
+				continue
+			}
+			route.AuthorizationType = gocf.String("CUSTOM")
+			route.AuthorizerID = gocf.Ref(ResourceName).String()
+			return nil
+		}
+		// Don't provision an unauthenticated $connect route
+		return fmt.Errorf("failed to find the %s route to authorize", connectRoute)
+	}), nil
+}
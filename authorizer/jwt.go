@@ -0,0 +1,251 @@
+package authorizer
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// QueryParamToken carries the JWT since browsers can't set headers on the
+	// WebSocket handshake
+	QueryParamToken     = "token"
+	headerAuthorization = "Authorization"
+	// Signing keys are refetched hourly, or when a token names an unknown
+	// key, at most once a minute
+	jwksRefreshInterval = time.Hour
+	jwksRetryInterval   = time.Minute
+	jwksFetchTimeout    = 5 * time.Second
+	// jwtClockSkew is the tolerance for the exp and nbf claims
+	jwtClockSkew = 30 * time.Second
+)
+
+// jwtHeader is the JOSE header
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jsonWebKey is an RSA key in the issuer's key set
+type jsonWebKey struct {
+	KeyID    string `json:"kid"`
+	KeyType  string `json:"kty"`
+	Modulus  string `json:"n"`
+	Exponent string `json:"e"`
+}
+
+// jwksCache caches the issuer's signing keys for the life of the warm
+// container. It's safe for concurrent use.
+type jwksCache struct {
+	mutex     sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// JWTValidator validates an RS256 JWT, such as a Cognito user pool token,
+// against the issuer's published key set
+type JWTValidator struct {
+	issuer   string
+	audience string
+	tokenUse string
+	keys     *jwksCache
+}
+
+// NewJWTValidator returns a validator for tokens from the issuer. An empty
+// audience skips the aud/client_id check, and an empty tokenUse skips the
+// Cognito token_use check.
+func NewJWTValidator(issuer string, audience string, tokenUse string) *JWTValidator {
+	return &JWTValidator{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+		tokenUse: tokenUse,
+		keys:     &jwksCache{},
+	}
+}
+
+// Validate accepts a JWT from the token query parameter or a bearer
+// Authorization header. The principal is the token's sub claim and the
+// claims are returned in the authorizer context.
+func (validator *JWTValidator) Validate(ctx context.Context,
+	request awsEvents.APIGatewayCustomAuthorizerRequestTypeRequest) (*Identity, error) {
+	claims, verifyErr := validator.Verify(ctx, RequestToken(request), time.Now())
+	if verifyErr != nil {
+		return nil, verifyErr
+	}
+	principalID, _ := claims["sub"].(string)
+	return &Identity{
+		PrincipalID: principalID,
+		Context:     FlattenContext(claims),
+	}, nil
+}
+
+// RequestToken returns the token in the query string or the bearer
+// Authorization header
+func RequestToken(request awsEvents.APIGatewayCustomAuthorizerRequestTypeRequest) string {
+	if token := request.QueryStringParameters[QueryParamToken]; token != "" {
+		return token
+	}
+	return strings.TrimPrefix(request.Headers[headerAuthorization], "Bearer ")
+}
+
+// Verify verifies the token's signature, issuer, audience, token use, and
+// lifetime and returns its claims. Cognito access tokens name the app client
+// in client_id rather than aud, so the token_use claim keeps an ID token
+// from being accepted where an access token is required, and vice versa.
+func (validator *JWTValidator) Verify(ctx context.Context,
+	token string,
+	now time.Time) (map[string]interface{}, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header jwtHeader
+	headerErr := decodeJWTSegment(segments[0], &header)
+	if headerErr != nil {
+		return nil, headerErr
+	}
+	if header.Algorithm != "RS256" {
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", header.Algorithm)
+	}
+	key, keyErr := validator.keys.key(ctx, validator.issuer, header.KeyID)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	signature, signatureErr := base64.RawURLEncoding.DecodeString(segments[2])
+	if signatureErr != nil {
+		return nil, signatureErr
+	}
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	verifyErr := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	if verifyErr != nil {
+		return nil, verifyErr
+	}
+	claims := make(map[string]interface{})
+	claimsErr := decodeJWTSegment(segments[1], &claims)
+	if claimsErr != nil {
+		return nil, claimsErr
+	}
+	if claims["iss"] != validator.issuer {
+		return nil, fmt.Errorf("unexpected issuer: %v", claims["iss"])
+	}
+	expiresAt, hasExpiry := claims["exp"].(float64)
+	if !hasExpiry || now.Add(-jwtClockSkew).Unix() >= int64(expiresAt) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if notBefore, hasNotBefore := claims["nbf"].(float64); hasNotBefore &&
+		now.Add(jwtClockSkew).Unix() < int64(notBefore) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if validator.audience != "" && !jwtAudienceMatches(claims, validator.audience) {
+		return nil, fmt.Errorf("unexpected audience")
+	}
+	if validator.tokenUse != "" && claims["token_use"] != validator.tokenUse {
+		return nil, fmt.Errorf("unexpected token use: %v", claims["token_use"])
+	}
+	return claims, nil
+}
+
+// key returns the signing key with the ID, fetching the key set if it's
+// stale or doesn't include the key
+func (cache *jwksCache) key(ctx context.Context, issuer string, keyID string) (*rsa.PublicKey, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	key, exists := cache.keys[keyID]
+	stale := time.Since(cache.fetchedAt) > jwksRefreshInterval
+	if (!exists || stale) && time.Since(cache.fetchedAt) > jwksRetryInterval {
+		refreshErr := cache.refresh(ctx, issuer)
+		if refreshErr != nil && !exists {
+			return nil, refreshErr
+		}
+		if refreshErr == nil {
+			key, exists = cache.keys[keyID]
+		}
+	}
+	if !exists {
+		return nil, fmt.Errorf("unknown signing key: %s", keyID)
+	}
+	return key, nil
+}
+
+// refresh replaces the cached keys with the issuer's key set
+func (cache *jwksCache) refresh(ctx context.Context, issuer string) error {
+	cache.fetchedAt = time.Now()
+	fetchCtx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	keysRequest, keysRequestErr := http.NewRequest(http.MethodGet,
+		issuer+"/.well-known/jwks.json",
+		nil)
+	if keysRequestErr != nil {
+		return keysRequestErr
+	}
+	keysResponse, keysResponseErr := http.DefaultClient.Do(keysRequest.WithContext(fetchCtx))
+	if keysResponseErr != nil {
+		return keysResponseErr
+	}
+	defer keysResponse.Body.Close()
+	if keysResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch signing keys: %s", keysResponse.Status)
+	}
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	decodeErr := json.NewDecoder(keysResponse.Body).Decode(&keySet)
+	if decodeErr != nil {
+		return decodeErr
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, eachKey := range keySet.Keys {
+		if eachKey.KeyType != "RSA" {
+			continue
+		}
+		modulus, modulusErr := base64.RawURLEncoding.DecodeString(eachKey.Modulus)
+		exponent, exponentErr := base64.RawURLEncoding.DecodeString(eachKey.Exponent)
+		if modulusErr != nil || exponentErr != nil {
+			continue
+		}
+		keys[eachKey.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(new(big.Int).SetBytes(exponent).Int64()),
+		}
+	}
+	cache.keys = keys
+	return nil
+}
+
+// decodeJWTSegment unmarshals the base64url encoded JSON segment
+func decodeJWTSegment(segment string, value interface{}) error {
+	segmentJSON, decodeErr := base64.RawURLEncoding.DecodeString(segment)
+	if decodeErr != nil {
+		return decodeErr
+	}
+	return json.Unmarshal(segmentJSON, value)
+}
+
+// jwtAudienceMatches returns true if the aud or client_id claim names the
+// audience
+func jwtAudienceMatches(claims map[string]interface{}, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == audience {
+			return true
+		}
+	case []interface{}:
+		for _, eachAudience := range aud {
+			if eachAudience == audience {
+				return true
+			}
+		}
+	}
+	return claims["client_id"] == audience
+}
@@ -0,0 +1,114 @@
+package authorizer
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testKeyID = "key-1"
+
+// testIssuer serves the key set of a single RSA signing key
+func testIssuer(t *testing.T) (*httptest.Server, *rsa.PrivateKey) {
+	key, keyErr := rsa.GenerateKey(rand.Reader, 2048)
+	if keyErr != nil {
+		t.Fatalf("Failed to generate key: %s", keyErr)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"keys": []jsonWebKey{
+				{
+					KeyID:    testKeyID,
+					KeyType:  "RSA",
+					Modulus:  base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					Exponent: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				},
+			},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server, key
+}
+
+// signToken returns the RS256 JWT for the claims
+func signToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(&jwtHeader{Algorithm: "RS256", KeyID: testKeyID})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, signErr := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if signErr != nil {
+		t.Fatalf("Failed to sign token: %s", signErr)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTValidatorVerify(t *testing.T) {
+	server, key := testIssuer(t)
+	now := time.Now()
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		tokenClaims := map[string]interface{}{
+			"iss":       server.URL,
+			"sub":       "user-1",
+			"client_id": "app-client",
+			"token_use": "access",
+			"exp":       now.Add(time.Hour).Unix(),
+		}
+		for eachName, eachValue := range overrides {
+			if eachValue == nil {
+				delete(tokenClaims, eachName)
+				continue
+			}
+			tokenClaims[eachName] = eachValue
+		}
+		return tokenClaims
+	}
+	tests := []struct {
+		name     string
+		tokenUse string
+		claims   map[string]interface{}
+		valid    bool
+	}{
+		{"access token", "access", claims(nil), true},
+		{"ID token where access is required", "access",
+			claims(map[string]interface{}{"token_use": "id", "client_id": nil, "aud": "app-client"}), false},
+		{"ID token", "id",
+			claims(map[string]interface{}{"token_use": "id", "client_id": nil, "aud": "app-client"}), true},
+		{"access token where ID is required", "id", claims(nil), false},
+		{"missing token use", "access", claims(map[string]interface{}{"token_use": nil}), false},
+		{"token use unchecked", "", claims(map[string]interface{}{"token_use": nil}), true},
+		{"wrong issuer", "access", claims(map[string]interface{}{"iss": "https://example.com"}), false},
+		{"wrong audience", "access", claims(map[string]interface{}{"client_id": "other-client"}), false},
+		{"expired", "access", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), false},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			validator := NewJWTValidator(server.URL, "app-client", eachTest.tokenUse)
+			verified, verifyErr := validator.Verify(context.Background(),
+				signToken(t, key, eachTest.claims),
+				now)
+			if (verifyErr == nil) != eachTest.valid {
+				t.Fatalf("Verify error = %v, want valid %t", verifyErr, eachTest.valid)
+			}
+			if eachTest.valid && verified["sub"] != "user-1" {
+				t.Errorf("Verified sub = %v, want user-1", verified["sub"])
+			}
+		})
+	}
+	// Tokens signed by another key aren't accepted
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	validator := NewJWTValidator(server.URL, "app-client", "access")
+	if _, verifyErr := validator.Verify(context.Background(), signToken(t, otherKey, claims(nil)), now); verifyErr == nil {
+		t.Errorf("Verify accepted a token signed by another key")
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	apigwManagement "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	apigwManagementIface "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi/apigatewaymanagementapiiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/mweagle/SpartaWebSocket/connections"
+	"github.com/mweagle/SpartaWebSocket/filter"
+	"github.com/mweagle/SpartaWebSocket/protocol"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	broadcastMessage = "broadcast"
+	// postMaxAttempts bounds the PostToConnection attempts for a throttled
+	// delivery. The jittered delay before each retry grows from
+	// postInitialBackoff up to postMaxBackoff.
+	postMaxAttempts    = 4
+	postInitialBackoff = 50 * time.Millisecond
+	postMaxBackoff     = time.Second
+	// Metric names
+	metricMessagesSent     = "MessagesSent"
+	metricDeliveryFailures = "DeliveryFailures"
+	metricPostRetries      = "PostRetries"
+)
+
+// deliveryStats summarizes a fan-out
+type deliveryStats struct {
+	Recipients int `json:"recipients"`
+	Delivered  int `json:"delivered"`
+	Failed     int `json:"failed"`
+	Gone       int `json:"gone"`
+	// Skipped counts the subprotocol connections that weren't delivered to,
+	// since the frame isn't one of their subprotocol's messages
+	Skipped int `json:"skipped"`
+}
+
+// add accumulates the other stats
+func (stats *deliveryStats) add(other deliveryStats) {
+	stats.Recipients += other.Recipients
+	stats.Delivered += other.Delivered
+	stats.Failed += other.Failed
+	stats.Gone += other.Gone
+	stats.Skipped += other.Skipped
+}
+
+// broadcaster delivers a payload to every connection in the table, or in a
+// segment of it
+type broadcaster struct {
+	logger          *logrus.Logger
+	sess            *session.Session
+	dynamoClient    dynamodbiface.DynamoDBAPI
+	apigwMgmtClient apigwManagementIface.ApiGatewayManagementApiAPI
+	metrics         *metricsEmitter
+	cleaner         *goneCleaner
+	frames          *frameCache
+	deliveries      *outbox
+	// mutex guards the stats, cleaner, and throttled connections, which
+	// concurrent posts update
+	mutex sync.Mutex
+	stats deliveryStats
+	// compression is false when the compression feature flag is off, in
+	// which case frames are delivered uncompressed regardless of the
+	// recipient's negotiation
+	compression bool
+	// onGone is called, if set, with each connection that's gone
+	onGone func(ctx context.Context, connectionID string)
+	// retryThrottled collects the connections whose delivery was throttled
+	// in throttled so that they can be retried. throttleReasons maps each
+	// to its last PostToConnection error.
+	retryThrottled  bool
+	throttled       []string
+	throttleReasons map[string]string
+	// remote maps connections that were established in another region to
+	// the management client for that region's API. remoteClients caches
+	// the clients by endpoint.
+	remote        map[string]apigwManagementIface.ApiGatewayManagementApiAPI
+	remoteClients map[string]apigwManagementIface.ApiGatewayManagementApiAPI
+	// excluded, if set, is a connection that isn't delivered to, eg one
+	// that's still being established
+	excluded string
+	// filter, if set, skips the connections whose attributes don't match
+	filter filter.Expression
+	// caching is true if the connection items that query reads are kept in
+	// readItems for the connection cache
+	caching   bool
+	readItems []map[string]*dynamodb.AttributeValue
+}
+
+func newBroadcaster(ctx context.Context,
+	sess *session.Session,
+	endpointURL string,
+	requestID string,
+	message string,
+	payload json.RawMessage,
+	logger *logrus.Logger) *broadcaster {
+	dynamoClient := newConnectionsClient(sess)
+	metrics := newMetricsEmitter()
+	logger = correlatedLogger(logger, requestID)
+	bcast := &broadcaster{
+		logger:          logger,
+		sess:            sess,
+		dynamoClient:    dynamoClient,
+		apigwMgmtClient: newManagementClient(sess, endpointURL),
+		metrics:         metrics,
+		cleaner: newGoneCleaner(sess,
+			dynamoClient,
+			metrics,
+			newAuditLog(requestID),
+			logger),
+		// Transcode the payload at most once per recipient negotiation
+		frames: newFrameCache(message,
+			requestID,
+			payload,
+			newPayloadStager(sess, requestID)),
+		compression: features.enabled(ctx, sess, featureCompression, logger),
+	}
+	bcast.deliveries = newOutbox(bcast.postFrame,
+		fanoutConcurrency(ctx, sess, logger))
+	return bcast
+}
+
+// filterBy parses the broadcast's attribute filter. The empty string
+// delivers to every connection.
+func (bcast *broadcaster) filterBy(source string) error {
+	if source == "" {
+		return nil
+	}
+	expression, expressionErr := filter.Parse(source)
+	if expressionErr != nil {
+		return expressionErr
+	}
+	bcast.filter = expression
+	return nil
+}
+
+// postBackoff returns the "full jitter" delay before the retry: a random
+// duration up to the exponentially growing, capped ceiling
+func postBackoff(retry int) time.Duration {
+	ceiling := postMaxBackoff
+	if exponential := postInitialBackoff << uint(retry); exponential > 0 && exponential < ceiling {
+		ceiling = exponential
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// post posts the frame, retrying with jittered backoff while the management
+// API throttles the connection. The concurrent posts that are backing off
+// hold their outbox slots, which slows the fan-out during bursts.
+func (bcast *broadcaster) post(ctx context.Context, connectionID string, frame []byte) error {
+	postConnectionInput := &apigwManagement.PostToConnectionInput{
+		ConnectionId: aws.String(connectionID),
+		Data:         frame,
+	}
+	var respErr error
+	for attempt := 0; attempt < postMaxAttempts; attempt++ {
+		if attempt != 0 {
+			select {
+			case <-time.After(postBackoff(attempt - 1)):
+			case <-ctx.Done():
+				return respErr
+			}
+			bcast.metrics.add(metricPostRetries, 1)
+		}
+		_, respErr = bcast.managementClient(connectionID).PostToConnectionWithContext(ctx, postConnectionInput)
+		if respErr == nil || !isThrottle(respErr) {
+			return respErr
+		}
+	}
+	return respErr
+}
+
+// postFrame posts the frame, queueing gone connections for cleanup. It's
+// called concurrently by the outbox.
+func (bcast *broadcaster) postFrame(ctx context.Context, connectionID string, frame []byte) error {
+	respErr := bcast.post(ctx, connectionID, frame)
+	if respErr != nil {
+		if connectionID != "" &&
+			strings.Contains(respErr.Error(), apigwManagement.ErrCodeGoneException) {
+			// Queue it for cleanup...
+			bcast.mutex.Lock()
+			bcast.stats.Gone++
+			bcast.cleaner.cleanup(ctx, connectionID)
+			bcast.mutex.Unlock()
+			if bcast.onGone != nil {
+				bcast.onGone(ctx, connectionID)
+			}
+		} else if bcast.retryThrottled && connectionID != "" && isThrottle(respErr) {
+			bcast.mutex.Lock()
+			bcast.throttled = append(bcast.throttled, connectionID)
+			if bcast.throttleReasons == nil {
+				bcast.throttleReasons = make(map[string]string)
+			}
+			bcast.throttleReasons[connectionID] = respErr.Error()
+			bcast.mutex.Unlock()
+		} else {
+			bcast.logger.WithField("Error", respErr).Warn("Failed to post to connection")
+		}
+	}
+	return respErr
+}
+
+// query delivers the payload to every connection in the segment's hash
+// buckets. A totalSegments value less than 2 queries every bucket. With
+// SCAN_SEGMENTS, the connection table's index is read with parallel scans
+// instead. With CONNECTION_CACHE_TTL_MS, the items a warm container read
+// for a recent broadcast are delivered to without reading the index.
+func (bcast *broadcaster) query(ctx context.Context, segment int64, totalSegments int64) (err error) {
+	ctx, span := startSpan(ctx, "broadcast.query",
+		attribute.Int64(attributeSegment, segment),
+		attribute.Int64(attributeTotalSegments, totalSegments))
+	defer func() {
+		span.SetAttributes(attribute.Int(attributeConnections, bcast.stats.Recipients))
+		endSpan(span, err)
+	}()
+	if items, cached := recentConnections.get(ctx, newDynamoClient(bcast.sess), segment, totalSegments); cached {
+		span.SetAttributes(attribute.Bool(attributeCached, true))
+		bcast.deliverItems(ctx, items)
+		return nil
+	}
+	bcast.caching = connectionCacheTTL() > 0
+	readAt := time.Now()
+	defer func() {
+		if bcast.caching && err == nil {
+			recentConnections.put(segment, totalSegments, readAt, bcast.readItems)
+		}
+	}()
+	// Query the segment's buckets
+	store := newConnectionIndex(bcast.dynamoClient)
+	if tableStore, isTable := store.(*connections.Store); isTable && scanSegments() > 1 {
+		span.SetAttributes(attribute.Int64(attributeScanSegments, scanSegments()))
+		return bcast.scan(ctx, tableStore, segment, totalSegments)
+	}
+	return store.QueryPages(ctx,
+		segment,
+		totalSegments,
+		func(items []map[string]*dynamodb.AttributeValue) bool {
+			bcast.deliverPage(ctx, items)
+			return true
+		})
+}
+
+// deliverPage queues the frame for a page of the connection index, keeping
+// the items if the broadcast caches them
+func (bcast *broadcaster) deliverPage(ctx context.Context,
+	items []map[string]*dynamodb.AttributeValue) {
+	if bcast.caching {
+		bcast.readItems = append(bcast.readItems, items...)
+	}
+	bcast.deliverItems(ctx, items)
+}
+
+// deliverItems queues the frame for each connection item. Items need only
+// the connection ID and negotiation attributes.
+func (bcast *broadcaster) deliverItems(ctx context.Context,
+	items []map[string]*dynamodb.AttributeValue) {
+	// Send the message to all the clients
+	for _, eachItem := range items {
+		receiverConnection := ""
+		if eachItem[ddbAttributeConnectionID] != nil &&
+			eachItem[ddbAttributeConnectionID].S != nil {
+			receiverConnection = *eachItem[ddbAttributeConnectionID].S
+		}
+		if bcast.excluded != "" && receiverConnection == bcast.excluded {
+			continue
+		}
+		if bcast.filter != nil && !bcast.filter.Match(itemStringMap(eachItem, ddbAttributeAttributes)) {
+			continue
+		}
+		negotiation := itemNegotiation(eachItem)
+		// Subprotocol clients close the connection on frames that aren't
+		// their subprotocol's, so they only receive deliverFrame frames
+		if negotiation.Subprotocol != "" {
+			bcast.stats.Skipped++
+			continue
+		}
+		bcast.stats.Recipients++
+		if !bcast.compression {
+			negotiation.Compression = protocol.CompressionNone
+		}
+		frame, frameErr := bcast.frames.frame(ctx, negotiation)
+		if frameErr != nil {
+			bcast.stats.Failed++
+			bcast.logger.WithFields(logrus.Fields{
+				"Error":       frameErr,
+				"Encoding":    negotiation.Encoding,
+				"Compression": negotiation.Compression,
+			}).Warn("Failed to encode frame")
+			continue
+		}
+		bcast.routeRemote(receiverConnection, eachItem)
+		bcast.deliveries.enqueue(ctx, receiverConnection, frame)
+	}
+}
+
+// deliverFrame queues a frame that was encoded for the single recipient,
+// such as a graphql-ws next frame, in place of the cached broadcast frame
+func (bcast *broadcaster) deliverFrame(ctx context.Context,
+	item map[string]*dynamodb.AttributeValue,
+	frame []byte) {
+	receiverConnection := itemString(item, ddbAttributeConnectionID)
+	bcast.stats.Recipients++
+	bcast.routeRemote(receiverConnection, item)
+	bcast.deliveries.enqueue(ctx, receiverConnection, &outboundFrame{
+		frame: frame,
+	})
+}
+
+// finish flushes pending deliveries, cleanups, and metrics and returns the
+// delivery stats
+func (bcast *broadcaster) finish(ctx context.Context) deliveryStats {
+	deliveryErrors := bcast.deliveries.close(ctx)
+	bcast.stats.Failed += len(deliveryErrors)
+	bcast.stats.Delivered = bcast.stats.Recipients - bcast.stats.Failed
+	// Cached connection lists may include the gone connections
+	if bcast.stats.Gone != 0 {
+		recentConnections.reset()
+	}
+	bcast.cleaner.flush(ctx)
+	telemetry.recordDeliveries(ctx, bcast.stats)
+	bcast.metrics.add(metricMessagesSent, float64(bcast.stats.Delivered))
+	bcast.metrics.add(metricDeliveryFailures, float64(bcast.stats.Failed))
+	metricsErr := bcast.metrics.flush()
+	if metricsErr != nil {
+		bcast.logger.WithField("Error", metricsErr).Warn("Failed to publish metrics")
+	}
+	return bcast.stats
+}
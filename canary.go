@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyCanaryDeployment is the provision-time CodeDeploy traffic shifting
+	// configuration of the route handlers (eg, Canary10Percent5Minutes). Each
+	// deploy publishes a new version of every route handler, and CodeDeploy
+	// shifts the handler's live alias to it.
+	envKeyCanaryDeployment = "CANARY_DEPLOYMENT"
+	// canaryAliasName is the alias that the WebSocket integrations invoke
+	canaryAliasName                  = "live"
+	canaryApplicationResourceName    = "HandlerDeployments"
+	canaryDeploymentGroupName        = "HandlerDeploymentGroup"
+	canaryDeploymentRoleResourceName = "HandlerDeploymentRole"
+)
+
+// canaryDeploymentConfigs are the CodeDeployDefault.Lambda traffic shifting
+// configurations
+var canaryDeploymentConfigs = []string{
+	"AllAtOnce",
+	"Canary10Percent5Minutes",
+	"Canary10Percent10Minutes",
+	"Canary10Percent15Minutes",
+	"Canary10Percent30Minutes",
+	"Linear10PercentEvery1Minute",
+	"Linear10PercentEvery2Minutes",
+	"Linear10PercentEvery3Minutes",
+	"Linear10PercentEvery10Minutes",
+}
+
+// canaryDeploymentEnabled returns true if the route handlers are rolled out
+// with CodeDeploy
+func canaryDeploymentEnabled() bool {
+	return os.Getenv(envKeyCanaryDeployment) != ""
+}
+
+// canaryDeploymentConfig returns the CodeDeploy deployment configuration name
+func canaryDeploymentConfig() (string, error) {
+	configName := os.Getenv(envKeyCanaryDeployment)
+	for _, eachConfig := range canaryDeploymentConfigs {
+		if eachConfig == configName {
+			return "CodeDeployDefault.Lambda" + configName, nil
+		}
+	}
+	return "", fmt.Errorf("%s must be one of %s: %q",
+		envKeyCanaryDeployment,
+		strings.Join(canaryDeploymentConfigs, ", "),
+		configName)
+}
+
+// invokesLambda returns true if the integration URI references the lambda's
+// ARN
+func invokesLambda(integrationURI *gocf.StringExpr, lambdaFn *sparta.LambdaAWSInfo) bool {
+	uriJSON, uriJSONErr := json.Marshal(integrationURI)
+	if uriJSONErr != nil {
+		return false
+	}
+	return strings.Contains(string(uriJSON), `"`+lambdaFn.LogicalResourceName()+`"`)
+}
+
+// canaryDeploymentDecorator publishes a version of each route handler per
+// deploy and points the WebSocket integrations at the handler's live alias.
+// CodeDeploy shifts the alias to the new version with the configured canary
+// or linear steps, so a fraction of messages reach the new handler before the
+// cutover. Deployments roll back if they fail or, when the stack has alarms,
+// if a handler's error rate alarm fires.
+func canaryDeploymentDecorator(apiGateway *sparta.APIV2,
+	routeLambdas []*sparta.LambdaAWSInfo) sparta.ServiceDecoratorHookHandler {
+	return sparta.ServiceDecoratorHookFunc(func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		deploymentConfig, deploymentConfigErr := canaryDeploymentConfig()
+		if deploymentConfigErr != nil {
+			return deploymentConfigErr
+		}
+		template.AddResource(canaryApplicationResourceName, &gocf.CodeDeployApplication{
+			ComputePlatform: gocf.String("Lambda"),
+		})
+		template.AddResource(canaryDeploymentRoleResourceName, &gocf.IAMRole{
+			AssumeRolePolicyDocument: map[string]interface{}{
+				"Version": "2012-10-17",
+				"Statement": []interface{}{
+					map[string]interface{}{
+						"Effect": "Allow",
+						"Principal": map[string]interface{}{
+							"Service": []string{"codedeploy.amazonaws.com"},
+						},
+						"Action": []string{"sts:AssumeRole"},
+					},
+				},
+			},
+			ManagedPolicyArns: gocf.StringList(gocf.Join("",
+				gocf.String("arn:"),
+				gocf.Ref("AWS::Partition"),
+				gocf.String(":iam::aws:policy/service-role/AWSCodeDeployRoleForLambdaLimited"))),
+		})
+		deploymentGroup := &gocf.CodeDeployDeploymentGroup{
+			ApplicationName:      gocf.Ref(canaryApplicationResourceName).String(),
+			ServiceRoleArn:       gocf.GetAtt(canaryDeploymentRoleResourceName, "Arn").String(),
+			DeploymentConfigName: gocf.String(deploymentConfig),
+			DeploymentStyle: &gocf.CodeDeployDeploymentGroupDeploymentStyle{
+				DeploymentType:   gocf.String("BLUE_GREEN"),
+				DeploymentOption: gocf.String("WITH_TRAFFIC_CONTROL"),
+			},
+			AutoRollbackConfiguration: &gocf.CodeDeployDeploymentGroupAutoRollbackConfiguration{
+				Enabled: gocf.Bool(true),
+				Events:  gocf.StringList(gocf.String("DEPLOYMENT_FAILURE"), gocf.String("DEPLOYMENT_STOP_ON_ALARM")),
+			},
+		}
+		if alarmsEnabled() {
+			alarms := gocf.CodeDeployDeploymentGroupAlarmList{}
+			for _, eachLambda := range routeLambdas {
+				alarms = append(alarms, gocf.CodeDeployDeploymentGroupAlarm{
+					Name: gocf.Ref(errorRateAlarmName(eachLambda)).String(),
+				})
+			}
+			deploymentGroup.AlarmConfiguration = &gocf.CodeDeployDeploymentGroupAlarmConfiguration{
+				Enabled: gocf.Bool(true),
+				Alarms:  &alarms,
+			}
+		}
+		template.AddResource(canaryDeploymentGroupName, deploymentGroup)
+
+		for _, eachLambda := range routeLambdas {
+			lambdaName := eachLambda.LogicalResourceName()
+			// The version's logical name changes every build, so each deploy
+			// publishes a new version. Earlier versions are retained since the
+			// alias may still route to them while traffic shifts.
+			versionName := sparta.CloudFormationResourceName(lambdaName+"Version", buildID)
+			versionResource := template.AddResource(versionName, &gocf.LambdaVersion{
+				FunctionName: gocf.Ref(lambdaName).String(),
+				Description:  gocf.String(buildID),
+			})
+			versionResource.DeletionPolicy = "Retain"
+			aliasName := lambdaName + "LiveAlias"
+			aliasResource := template.AddResource(aliasName, &gocf.LambdaAlias{
+				FunctionName:    gocf.Ref(lambdaName).String(),
+				FunctionVersion: gocf.GetAtt(versionName, "Version").String(),
+				Name:            gocf.String(canaryAliasName),
+			})
+			aliasResource.UpdatePolicy = &gocf.UpdatePolicy{
+				CodeDeployLambdaAliasUpdate: &gocf.CodeDeployLambdaAliasUpdate{
+					ApplicationName:     gocf.Ref(canaryApplicationResourceName).String(),
+					DeploymentGroupName: gocf.Ref(canaryDeploymentGroupName).String(),
+				},
+			}
+			// Invoke the alias rather than the function
+			for _, eachResource := range template.Resources {
+				integration, isIntegration := eachResource.Properties.(*gocf.APIGatewayV2Integration)
+				if !isIntegration || !invokesLambda(integration.IntegrationURI, eachLambda) {
+					continue
+				}
+				integration.IntegrationURI = gocf.Join("",
+					gocf.String("arn:"),
+					gocf.Ref("AWS::Partition"),
+					gocf.String(":apigateway:"),
+					gocf.Ref("AWS::Region"),
+					gocf.String(":lambda:path/2015-03-31/functions/"),
+					gocf.Ref(aliasName),
+					gocf.String("/invocations"))
+			}
+			template.AddResource(aliasName+"Permission", &gocf.LambdaPermission{
+				Action:       gocf.String("lambda:InvokeFunction"),
+				FunctionName: gocf.Ref(aliasName).String(),
+				Principal:    gocf.String("apigateway.amazonaws.com"),
+				SourceArn: gocf.Join("",
+					gocf.String("arn:"),
+					gocf.Ref("AWS::Partition"),
+					gocf.String(":execute-api:"),
+					gocf.Ref("AWS::Region"),
+					gocf.String(":"),
+					gocf.Ref("AWS::AccountId"),
+					gocf.String(":"),
+					gocf.Ref(apiGateway.LogicalResourceName()),
+					gocf.String("/*")),
+			})
+		}
+		return nil
+	})
+}
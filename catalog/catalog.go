@@ -0,0 +1,291 @@
+// Package catalog provides the localized strings for server generated
+// system messages. Connections select a locale at $connect time and the
+// handlers localize every status body and system frame they send.
+package catalog
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Key identifies a system message
+type Key string
+
+const (
+	// Connected is the $connect success response
+	Connected Key = "connected"
+	// Disconnected is the $disconnect success response
+	Disconnected Key = "disconnected"
+	// DataSent acknowledges a broadcast to the sender
+	DataSent Key = "dataSent"
+	// ConnectFailed reports a $connect error. Args: error text.
+	ConnectFailed Key = "connectFailed"
+	// DisconnectFailed reports a $disconnect error. Args: error text.
+	DisconnectFailed Key = "disconnectFailed"
+	// SendFailed reports a broadcast error. Args: error text.
+	SendFailed Key = "sendFailed"
+	// UnmarshalFailed reports a malformed request. Args: error text.
+	UnmarshalFailed Key = "unmarshalFailed"
+	// InternalError reports an unexpected server failure
+	InternalError Key = "internalError"
+	// RateLimited reports a rejected message from a connection that exceeded
+	// its send rate
+	RateLimited Key = "rateLimited"
+	// Banned rejects a $connect from a banned client
+	Banned Key = "banned"
+	// RoomJoined acknowledges a joinroom request. Args: room.
+	RoomJoined Key = "roomJoined"
+	// RoomLeft acknowledges a leaveroom request. Args: room.
+	RoomLeft Key = "roomLeft"
+	// InvalidRoom reports a room request without a valid room name
+	InvalidRoom Key = "invalidRoom"
+	// NotRoomMember rejects a sendroom request from a connection that
+	// hasn't joined the room. Args: room.
+	NotRoomMember Key = "notRoomMember"
+	// RoomsDisabled rejects room requests while the rooms feature is off
+	RoomsDisabled Key = "roomsDisabled"
+	// InvalidUser reports a senddirect request without a valid user ID
+	InvalidUser Key = "invalidUser"
+	// UserOffline reports a senddirect request to a user without any open
+	// connections. Args: user ID.
+	UserOffline Key = "userOffline"
+	// UnknownAction rejects a frame whose message doesn't name a route.
+	// Args: message.
+	UnknownAction Key = "unknownAction"
+	// MalformedFrame rejects a text frame that isn't a JSON object with a
+	// message property
+	MalformedFrame Key = "malformedFrame"
+	// ReceiptsDisabled rejects ack requests while the receipts feature is off
+	ReceiptsDisabled Key = "receiptsDisabled"
+	// UnknownMessage rejects an ack for a message that isn't tracked, or has
+	// expired. Args: message ID.
+	UnknownMessage Key = "unknownMessage"
+	// DuplicateMessage rejects a message whose ID is already tracked. Args:
+	// message ID.
+	DuplicateMessage Key = "duplicateMessage"
+	// HistoryDisabled rejects history requests while the history replay
+	// feature is off
+	HistoryDisabled Key = "historyDisabled"
+	// ResumeDisabled rejects session requests while connections can't be
+	// resumed
+	ResumeDisabled Key = "resumeDisabled"
+	// MessageQueued acknowledges a senddirect request to an offline user
+	// whose message is held until they connect. Args: user ID.
+	MessageQueued Key = "messageQueued"
+	// PayloadTooLarge rejects an inbound frame that exceeds the payload size
+	// limit. Args: limit in bytes.
+	PayloadTooLarge Key = "payloadTooLarge"
+	// InvalidRequest rejects request data that doesn't conform to the
+	// route's schema. The error frame details list the invalid fields.
+	InvalidRequest Key = "invalidRequest"
+	// MessageRejected rejects a message that the moderator didn't allow
+	MessageRejected Key = "messageRejected"
+	// Unauthenticated rejects a frame on a route that requires a validated
+	// user ID from a connection without one
+	Unauthenticated Key = "unauthenticated"
+	// InvalidAttribute rejects an update request whose connection attributes
+	// aren't valid. Args: attribute limit.
+	InvalidAttribute Key = "invalidAttribute"
+	// InvalidTopic reports a topic request without a valid topic or
+	// pattern. Args: reason.
+	InvalidTopic Key = "invalidTopic"
+	// Subscribed confirms a subscribe request. Args: pattern.
+	Subscribed Key = "subscribed"
+	// Unsubscribed confirms an unsubscribe request. Args: pattern.
+	Unsubscribed Key = "unsubscribed"
+	// TopicLimit rejects a subscribe request beyond the connection's
+	// subscription limit. Args: subscription limit.
+	TopicLimit Key = "topicLimit"
+	// InvalidTag rejects a tag request whose tags aren't valid. Args: tag
+	// limit.
+	InvalidTag Key = "invalidTag"
+)
+
+// DefaultLocale is used when the connection didn't select a supported locale
+const DefaultLocale = "en"
+
+// messages is the catalog of format strings by locale
+var messages = map[string]map[Key]string{
+	"en": {
+		Connected:        "Connected.",
+		Disconnected:     "Disconnected.",
+		DataSent:         "Data sent.",
+		ConnectFailed:    "Failed to connect: %s",
+		DisconnectFailed: "Failed to disconnect: %s",
+		SendFailed:       "Failed to send message: %s",
+		UnmarshalFailed:  "Failed to unmarshal request: %s",
+		InternalError:    "An internal error occurred.",
+		RateLimited:      "Too many messages. Try again shortly.",
+		Banned:           "Connection refused.",
+		RoomJoined:       "Joined %s.",
+		RoomLeft:         "Left %s.",
+		InvalidRoom:      "A room name of at most 128 characters is required.",
+		NotRoomMember:    "Join %s before sending to it.",
+		RoomsDisabled:    "Rooms are unavailable.",
+		InvalidUser:      "A user ID of at most 128 characters is required.",
+		UserOffline:      "%s isn't connected.",
+		UnknownAction:    "Unknown action: %s.",
+		MalformedFrame:   "Frames must be JSON objects with a message property.",
+		ReceiptsDisabled: "Receipts are unavailable.",
+		UnknownMessage:   "Unknown message: %s.",
+		DuplicateMessage: "Message %s was already sent.",
+		HistoryDisabled:  "Message history is unavailable.",
+		ResumeDisabled:   "Resuming connections is unavailable.",
+		MessageQueued:    "%s isn't connected. The message will be delivered when they connect.",
+		PayloadTooLarge:  "Messages are limited to %d bytes.",
+		InvalidRequest:   "The request data is invalid.",
+		MessageRejected:  "The message wasn't sent because it breaks the content rules.",
+		Unauthenticated:  "Sign in to use this action.",
+		InvalidAttribute: "Connections have at most %d attributes, named with letters, digits, dashes, or underscores, with values of at most 256 characters.",
+		InvalidTopic:     "A topic of dot separated levels is required: %s.",
+		Subscribed:       "Subscribed to %s.",
+		Unsubscribed:     "Unsubscribed from %s.",
+		TopicLimit:       "Connections have at most %d topic subscriptions.",
+		InvalidTag:       "Connections have at most %d tags of up to 64 letters, digits, periods, colons, dashes, or underscores.",
+	},
+	"es": {
+		Connected:        "Conectado.",
+		Disconnected:     "Desconectado.",
+		DataSent:         "Datos enviados.",
+		ConnectFailed:    "No se pudo conectar: %s",
+		DisconnectFailed: "No se pudo desconectar: %s",
+		SendFailed:       "No se pudo enviar el mensaje: %s",
+		UnmarshalFailed:  "No se pudo leer la solicitud: %s",
+		InternalError:    "Se produjo un error interno.",
+		RateLimited:      "Demasiados mensajes. Inténtelo de nuevo en breve.",
+		Banned:           "Conexión rechazada.",
+		RoomJoined:       "Se unió a %s.",
+		RoomLeft:         "Salió de %s.",
+		InvalidRoom:      "Se requiere un nombre de sala de 128 caracteres como máximo.",
+		NotRoomMember:    "Únase a %s antes de enviarle mensajes.",
+		RoomsDisabled:    "Las salas no están disponibles.",
+		InvalidUser:      "Se requiere un ID de usuario de 128 caracteres como máximo.",
+		UserOffline:      "%s no está conectado.",
+		UnknownAction:    "Acción desconocida: %s.",
+		MalformedFrame:   "Los mensajes deben ser objetos JSON con una propiedad message.",
+		ReceiptsDisabled: "Las confirmaciones no están disponibles.",
+		UnknownMessage:   "Mensaje desconocido: %s.",
+		DuplicateMessage: "El mensaje %s ya se envió.",
+		HistoryDisabled:  "El historial de mensajes no está disponible.",
+		ResumeDisabled:   "No es posible reanudar conexiones.",
+		MessageQueued:    "%s no está conectado. El mensaje se entregará cuando se conecte.",
+		PayloadTooLarge:  "Los mensajes están limitados a %d bytes.",
+		InvalidRequest:   "Los datos de la solicitud no son válidos.",
+		MessageRejected:  "El mensaje no se envió porque infringe las normas de contenido.",
+		Unauthenticated:  "Inicie sesión para usar esta acción.",
+		InvalidAttribute: "Las conexiones tienen como máximo %d atributos, con nombres de letras, dígitos, guiones o guiones bajos y valores de 256 caracteres como máximo.",
+		InvalidTopic:     "Se requiere un tema de niveles separados por puntos: %s.",
+		Subscribed:       "Suscrito a %s.",
+		Unsubscribed:     "Suscripción a %s cancelada.",
+		TopicLimit:       "Las conexiones tienen como máximo %d suscripciones a temas.",
+		InvalidTag:       "Las conexiones tienen como máximo %d etiquetas de hasta 64 letras, dígitos, puntos, dos puntos, guiones o guiones bajos.",
+	},
+	"fr": {
+		Connected:        "Connecté.",
+		Disconnected:     "Déconnecté.",
+		DataSent:         "Données envoyées.",
+		ConnectFailed:    "Échec de la connexion : %s",
+		DisconnectFailed: "Échec de la déconnexion : %s",
+		SendFailed:       "Échec de l'envoi du message : %s",
+		UnmarshalFailed:  "Échec de la lecture de la requête : %s",
+		InternalError:    "Une erreur interne s'est produite.",
+		RateLimited:      "Trop de messages. Réessayez dans un instant.",
+		Banned:           "Connexion refusée.",
+		RoomJoined:       "Vous avez rejoint %s.",
+		RoomLeft:         "Vous avez quitté %s.",
+		InvalidRoom:      "Un nom de salon de 128 caractères au maximum est requis.",
+		NotRoomMember:    "Rejoignez %s avant d'y envoyer des messages.",
+		RoomsDisabled:    "Les salons sont indisponibles.",
+		InvalidUser:      "Un identifiant d'utilisateur de 128 caractères au maximum est requis.",
+		UserOffline:      "%s n'est pas connecté.",
+		UnknownAction:    "Action inconnue : %s.",
+		MalformedFrame:   "Les messages doivent être des objets JSON avec une propriété message.",
+		ReceiptsDisabled: "Les accusés de réception sont indisponibles.",
+		UnknownMessage:   "Message inconnu : %s.",
+		DuplicateMessage: "Le message %s a déjà été envoyé.",
+		HistoryDisabled:  "L'historique des messages est indisponible.",
+		ResumeDisabled:   "La reprise des connexions est indisponible.",
+		MessageQueued:    "%s n'est pas connecté. Le message sera remis à sa connexion.",
+		PayloadTooLarge:  "Les messages sont limités à %d octets.",
+		InvalidRequest:   "Les données de la requête sont invalides.",
+		MessageRejected:  "Le message n'a pas été envoyé car il enfreint les règles de contenu.",
+		Unauthenticated:  "Connectez-vous pour utiliser cette action.",
+		InvalidAttribute: "Les connexions ont au maximum %d attributs, nommés avec des lettres, chiffres, tirets ou traits de soulignement, avec des valeurs de 256 caractères au maximum.",
+		InvalidTopic:     "Un sujet de niveaux séparés par des points est requis : %s.",
+		Subscribed:       "Abonné à %s.",
+		Unsubscribed:     "Désabonné de %s.",
+		TopicLimit:       "Les connexions ont au maximum %d abonnements à des sujets.",
+		InvalidTag:       "Les connexions ont au maximum %d étiquettes de 64 lettres, chiffres, points, deux-points, tirets ou traits de soulignement au maximum.",
+	},
+	"de": {
+		Connected:        "Verbunden.",
+		Disconnected:     "Getrennt.",
+		DataSent:         "Daten gesendet.",
+		ConnectFailed:    "Verbindung fehlgeschlagen: %s",
+		DisconnectFailed: "Trennen fehlgeschlagen: %s",
+		SendFailed:       "Senden der Nachricht fehlgeschlagen: %s",
+		UnmarshalFailed:  "Lesen der Anfrage fehlgeschlagen: %s",
+		InternalError:    "Ein interner Fehler ist aufgetreten.",
+		RateLimited:      "Zu viele Nachrichten. Bitte gleich erneut versuchen.",
+		Banned:           "Verbindung abgelehnt.",
+		RoomJoined:       "%s beigetreten.",
+		RoomLeft:         "%s verlassen.",
+		InvalidRoom:      "Ein Raumname mit höchstens 128 Zeichen ist erforderlich.",
+		NotRoomMember:    "Treten Sie %s bei, bevor Sie dorthin senden.",
+		RoomsDisabled:    "Räume sind nicht verfügbar.",
+		InvalidUser:      "Eine Benutzer-ID mit höchstens 128 Zeichen ist erforderlich.",
+		UserOffline:      "%s ist nicht verbunden.",
+		UnknownAction:    "Unbekannte Aktion: %s.",
+		MalformedFrame:   "Nachrichten müssen JSON-Objekte mit einer message-Eigenschaft sein.",
+		ReceiptsDisabled: "Lesebestätigungen sind nicht verfügbar.",
+		UnknownMessage:   "Unbekannte Nachricht: %s.",
+		DuplicateMessage: "Die Nachricht %s wurde bereits gesendet.",
+		HistoryDisabled:  "Der Nachrichtenverlauf ist nicht verfügbar.",
+		ResumeDisabled:   "Verbindungen können nicht fortgesetzt werden.",
+		MessageQueued:    "%s ist nicht verbunden. Die Nachricht wird bei der nächsten Verbindung zugestellt.",
+		PayloadTooLarge:  "Nachrichten sind auf %d Bytes begrenzt.",
+		InvalidRequest:   "Die Anfragedaten sind ungültig.",
+		MessageRejected:  "Die Nachricht wurde nicht gesendet, da sie gegen die Inhaltsregeln verstößt.",
+		Unauthenticated:  "Melden Sie sich an, um diese Aktion zu verwenden.",
+		InvalidAttribute: "Verbindungen haben höchstens %d Attribute mit Namen aus Buchstaben, Ziffern, Binde- oder Unterstrichen und Werten mit höchstens 256 Zeichen.",
+		InvalidTopic:     "Ein Thema aus durch Punkte getrennten Ebenen ist erforderlich: %s.",
+		Subscribed:       "%s abonniert.",
+		Unsubscribed:     "%s abbestellt.",
+		TopicLimit:       "Verbindungen haben höchstens %d Themenabonnements.",
+		InvalidTag:       "Verbindungen haben höchstens %d Tags mit bis zu 64 Buchstaben, Ziffern, Punkten, Doppelpunkten, Binde- oder Unterstrichen.",
+	},
+}
+
+// Match returns the supported locale that best matches the comma separated
+// language preference list (eg, an Accept-Language header value such as
+// "fr-CA,fr;q=0.8,en;q=0.5"). Regional variants fall back to their base
+// language and DefaultLocale is returned if nothing matches.
+func Match(preferences string) string {
+	for _, eachPreference := range strings.Split(preferences, ",") {
+		tag := strings.ToLower(strings.TrimSpace(strings.SplitN(eachPreference, ";", 2)[0]))
+		if _, exists := messages[tag]; exists {
+			return tag
+		}
+		base := strings.SplitN(tag, "-", 2)[0]
+		if _, exists := messages[base]; exists {
+			return base
+		}
+	}
+	return DefaultLocale
+}
+
+// Localize returns the message for the locale, formatted with args. Keys
+// missing from the locale fall back to DefaultLocale.
+func Localize(locale string, key Key, args ...interface{}) string {
+	format, exists := messages[locale][key]
+	if !exists {
+		format, exists = messages[DefaultLocale][key]
+	}
+	if !exists {
+		return string(key)
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
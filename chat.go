@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/mweagle/SpartaWebSocket/client"
+	"github.com/mweagle/SpartaWebSocket/protocol"
+)
+
+const (
+	// clientCommand opens an interactive connection to the deployed stack
+	// rather than running a Sparta command
+	clientCommand = "client"
+	// Interactive commands. Other lines are broadcast.
+	chatCommandJoin  = "/join"
+	chatCommandLeave = "/leave"
+	chatCommandQuit  = "/quit"
+)
+
+// chatLineData returns the data that's broadcast for a line of input. Lines
+// that are JSON documents are sent as-is and other lines as JSON strings.
+func chatLineData(line string) interface{} {
+	if json.Valid([]byte(line)) {
+		return json.RawMessage(line)
+	}
+	return line
+}
+
+// chatCommand handles a line that starts with a /command, returning true
+// if the session should end
+func chatCommand(wsClient *client.Client, line string) (bool, error) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case chatCommandQuit:
+		return true, nil
+	case chatCommandJoin, chatCommandLeave:
+		if len(fields) != 2 {
+			return false, fmt.Errorf("usage: %s ROOM", fields[0])
+		}
+		if fields[0] == chatCommandJoin {
+			return false, wsClient.JoinRoom(fields[1])
+		}
+		return false, wsClient.LeaveRoom(fields[1])
+	default:
+		return false, fmt.Errorf("unknown command %s (try %s, %s, or %s)",
+			fields[0],
+			chatCommandJoin,
+			chatCommandLeave,
+			chatCommandQuit)
+	}
+}
+
+// printFrames writes each inbound frame's JSON data to the output until the
+// client is closed
+func printFrames(wsClient *client.Client, output io.Writer, done chan<- struct{}) {
+	defer close(done)
+	for eachFrame := range wsClient.Frames() {
+		data, dataErr := wsClient.Data(eachFrame)
+		if dataErr != nil {
+			fmt.Fprintf(output, "< (%d byte binary frame)\n", len(eachFrame))
+			continue
+		}
+		fmt.Fprintf(output, "< %s\n", data)
+	}
+}
+
+// runClient is the client command. It connects to the URL, or to the
+// endpoint in the client configuration bundle written by provision, and
+// broadcasts each line read from stdin with the sendmessage route while
+// printing every inbound frame.
+func runClient(args []string) error {
+	flags := flag.NewFlagSet(clientCommand, flag.ContinueOnError)
+	endpoint := flags.String("url", "", "wss:// endpoint (defaults to the endpoint in "+client.ConfigFileName+")")
+	room := flags.String("room", "", "room to join once connected")
+	encoding := flags.String("encoding", "", "frame encoding to negotiate (eg, msgpack)")
+	compression := flags.String("compression", "", "broadcast compression to negotiate (eg, gzip)")
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		return parseErr
+	}
+	if *endpoint == "" {
+		config, configErr := client.LoadConfig(client.ConfigFileName)
+		if configErr != nil {
+			return fmt.Errorf("--url is required without %s: %s", client.ConfigFileName, configErr)
+		}
+		*endpoint = config.Endpoint
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	wsClient, connectErr := client.Connect(ctx, client.Options{
+		URL:         *endpoint,
+		Encoding:    protocol.Encoding(*encoding),
+		Compression: protocol.Compression(*compression),
+		OnReconnect: func(*client.Client) {
+			fmt.Fprintln(os.Stderr, "Reconnected")
+		},
+	})
+	if connectErr != nil {
+		return connectErr
+	}
+	defer wsClient.Close()
+	if *room != "" {
+		joinErr := wsClient.JoinRoom(*room)
+		if joinErr != nil {
+			return joinErr
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Connected to %s. Lines are broadcast; %s ends the session.\n",
+		*endpoint,
+		chatCommandQuit)
+	printed := make(chan struct{})
+	go printFrames(wsClient, os.Stdout, printed)
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-printed:
+			return wsClient.Err()
+		case line, lineOk := <-lines:
+			if !lineOk {
+				return nil
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			if strings.HasPrefix(line, "/") {
+				quit, commandErr := chatCommand(wsClient, line)
+				if commandErr != nil {
+					fmt.Fprintln(os.Stderr, commandErr)
+				}
+				if quit {
+					return nil
+				}
+				continue
+			}
+			sendErr := wsClient.Broadcast(chatLineData(line))
+			if sendErr != nil {
+				fmt.Fprintln(os.Stderr, sendErr)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/mweagle/SpartaWebSocket/protocol"
+)
+
+const (
+	chunkMessage = "chunk"
+	// chunkSize is the frame bytes carried by each chunk. Chunk data is
+	// base64 encoded in JSON frames, so leave headroom under
+	// maxInlineFrameSize for the expansion and the envelope.
+	chunkSize = 64 * 1024
+	// maxChunkParts bounds the chunks a frame is split into. Larger frames
+	// are staged in the payload bucket instead.
+	maxChunkParts = 16
+)
+
+// chunkEnvelope is the data property of a chunk frame. Concatenating the
+// Data of parts 1 through Parts with the same ID yields the complete frame
+// the recipient would otherwise have received, in its negotiated encoding
+// and compression. JSON clients receive the data as the frame itself, so
+// Type distinguishes it from broadcast data.
+type chunkEnvelope struct {
+	Type  string `json:"type"`
+	ID    string `json:"id"`
+	Part  int    `json:"part"`
+	Parts int    `json:"parts"`
+	Data  []byte `json:"data"`
+}
+
+// chunkable returns true if the frame can be delivered as chunks to the
+// negotiation
+func chunkable(negotiation protocol.Negotiation, frame []byte) bool {
+	return negotiation.Chunked && len(frame) <= chunkSize*maxChunkParts
+}
+
+// chunkFrame returns the outbound frame whose parts are the chunk frames for
+// the frame. The chunk frames themselves are always uncompressed so that
+// clients can inspect them before reassembly.
+func chunkFrame(id string,
+	negotiation protocol.Negotiation,
+	outbound *outboundFrame) (*outboundFrame, error) {
+	frame := outbound.frame
+	partCount := (len(frame) + chunkSize - 1) / chunkSize
+	chunked := &outboundFrame{
+		frame: frame,
+		parts: make([][]byte, 0, partCount),
+	}
+	for eachPart := 0; eachPart < partCount; eachPart++ {
+		end := (eachPart + 1) * chunkSize
+		if end > len(frame) {
+			end = len(frame)
+		}
+		chunkData, chunkDataErr := json.Marshal(&chunkEnvelope{
+			Type:  chunkMessage,
+			ID:    id,
+			Part:  eachPart + 1,
+			Parts: partCount,
+			Data:  frame[eachPart*chunkSize : end],
+		})
+		if chunkDataErr != nil {
+			return nil, chunkDataErr
+		}
+		partFrame, partFrameErr := protocol.CodecFor(negotiation.Encoding).Encode(chunkMessage,
+			chunkData)
+		if partFrameErr != nil {
+			return nil, partFrameErr
+		}
+		chunked.parts = append(chunked.parts, partFrame)
+	}
+	return chunked, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/mweagle/SpartaWebSocket/protocol"
+)
+
+func TestChunkFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		parts int
+	}{
+		{"one part", chunkSize, 1},
+		{"partial last part", 2*chunkSize + 1, 3},
+		{"largest chunkable frame", chunkSize * maxChunkParts, maxChunkParts},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			frame := bytes.Repeat([]byte("a"), eachTest.size)
+			chunked, chunkedErr := chunkFrame("frame-1",
+				protocol.DefaultNegotiation,
+				&outboundFrame{frame: frame})
+			if chunkedErr != nil {
+				t.Fatalf("chunkFrame failed: %s", chunkedErr)
+			}
+			if len(chunked.parts) != eachTest.parts {
+				t.Fatalf("Parts = %d, want %d", len(chunked.parts), eachTest.parts)
+			}
+			var reassembled []byte
+			for eachIndex, eachPart := range chunked.parts {
+				var env chunkEnvelope
+				if unmarshalErr := json.Unmarshal(eachPart, &env); unmarshalErr != nil {
+					t.Fatalf("Part %d isn't a JSON chunk frame: %s", eachIndex+1, unmarshalErr)
+				}
+				if env.Type != chunkMessage || env.ID != "frame-1" {
+					t.Errorf("Part %d type, ID = %q, %q, want %q, %q",
+						eachIndex+1,
+						env.Type,
+						env.ID,
+						chunkMessage,
+						"frame-1")
+				}
+				if env.Part != eachIndex+1 || env.Parts != eachTest.parts {
+					t.Errorf("Part %d is numbered %d of %d, want %d of %d",
+						eachIndex+1,
+						env.Part,
+						env.Parts,
+						eachIndex+1,
+						eachTest.parts)
+				}
+				reassembled = append(reassembled, env.Data...)
+			}
+			if !bytes.Equal(reassembled, frame) {
+				t.Errorf("Reassembled %d bytes, want the %d byte frame", len(reassembled), len(frame))
+			}
+		})
+	}
+}
+
+func TestChunkable(t *testing.T) {
+	chunked := protocol.Negotiation{Encoding: protocol.EncodingJSON, Chunked: true}
+	tests := []struct {
+		negotiation protocol.Negotiation
+		size        int
+		chunkable   bool
+	}{
+		{chunked, chunkSize * maxChunkParts, true},
+		{chunked, chunkSize*maxChunkParts + 1, false},
+		{protocol.DefaultNegotiation, chunkSize, false},
+	}
+	for _, eachTest := range tests {
+		frame := make([]byte, eachTest.size)
+		if chunkable := chunkable(eachTest.negotiation, frame); chunkable != eachTest.chunkable {
+			t.Errorf("chunkable(%+v, %d bytes) = %t, want %t",
+				eachTest.negotiation,
+				eachTest.size,
+				chunkable,
+				eachTest.chunkable)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	envKeyCleanupQueueURL         = "CLEANUP_QUEUE_URL"
+	cleanupQueueResourceName      = "CleanupQueue"
+	cleanupQueueVisibilityTimeout = 60
+	// SQS SendMessageBatch limit
+	cleanupQueueBatchSize = 10
+	// DynamoDB BatchWriteItem limit
+	batchDeleteSize = 25
+	// batchDeleteMaxAttempts bounds the BatchWriteItem calls for a batch
+	// whose deletes DynamoDB leaves unprocessed. The delay before each
+	// retry doubles from batchDeleteBackoff.
+	batchDeleteMaxAttempts = 4
+	batchDeleteBackoff     = 50 * time.Millisecond
+	// Metric names
+	metricGoneCleanupsQueued = "GoneCleanupsQueued"
+)
+
+// cleanupRequest is the SQS message body for a gone connection
+type cleanupRequest struct {
+	ConnectionID string `json:"connectionId"`
+}
+
+// goneCleaner queues connections that API Gateway reported as gone onto the
+// cleanup queue. Unlike a fire-and-forget goroutine, queued requests survive
+// the invocation freezing and are retried by the queue until the connection
+// is deleted. Connections are deleted directly if they can't be queued.
+type goneCleaner struct {
+	sqsService sqsiface.SQSAPI
+	ddbService dynamodbiface.DynamoDBAPI
+	queueURL   string
+	metrics    *metricsEmitter
+	audit      *auditLog
+	logger     *logrus.Logger
+	pending    []string
+}
+
+func newGoneCleaner(sess *session.Session,
+	ddbService dynamodbiface.DynamoDBAPI,
+	metrics *metricsEmitter,
+	audit *auditLog,
+	logger *logrus.Logger) *goneCleaner {
+	return &goneCleaner{
+		sqsService: newSQSClient(sess),
+		ddbService: ddbService,
+		queueURL:   os.Getenv(envKeyCleanupQueueURL),
+		metrics:    metrics,
+		audit:      audit,
+		logger:     logger,
+	}
+}
+
+// cleanup queues the connection for deletion. Requests are sent in batches
+// as they accumulate and by flush.
+func (cleaner *goneCleaner) cleanup(ctx context.Context, connectionID string) {
+	cleaner.pending = append(cleaner.pending, connectionID)
+	if len(cleaner.pending) >= cleanupQueueBatchSize {
+		cleaner.flush(ctx)
+	}
+}
+
+// flush sends every pending cleanup request to the queue
+func (cleaner *goneCleaner) flush(ctx context.Context) {
+	pending := cleaner.pending
+	cleaner.pending = nil
+	if len(pending) == 0 {
+		return
+	}
+	ctx, span := startSpan(ctx, "cleanup.queue",
+		attribute.Int(attributeConnections, len(pending)))
+	defer span.End()
+	if cleaner.queueURL == "" {
+		cleaner.deleteDirectly(ctx, pending)
+		return
+	}
+	entries := make([]*sqs.SendMessageBatchRequestEntry, 0, len(pending))
+	for eachIndex, eachConnectionID := range pending {
+		body, _ := json.Marshal(&cleanupRequest{ConnectionID: eachConnectionID})
+		entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+			Id:          aws.String(strconv.Itoa(eachIndex)),
+			MessageBody: aws.String(string(body)),
+		})
+	}
+	sendOutput, sendErr := cleaner.sqsService.SendMessageBatchWithContext(ctx,
+		&sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(cleaner.queueURL),
+			Entries:  entries,
+		})
+	if sendErr != nil {
+		span.RecordError(sendErr)
+		cleaner.logger.WithField("Error", sendErr).Warn("Failed to queue gone connections")
+		cleaner.deleteDirectly(ctx, pending)
+		return
+	}
+	var failed []string
+	for _, eachFailure := range sendOutput.Failed {
+		failedIndex, failedIndexErr := strconv.Atoi(aws.StringValue(eachFailure.Id))
+		if failedIndexErr == nil && failedIndex < len(pending) {
+			failed = append(failed, pending[failedIndex])
+		}
+	}
+	cleaner.metrics.add(metricGoneCleanupsQueued, float64(len(pending)-len(failed)))
+	telemetry.recordCleanup(ctx, "queued", len(pending)-len(failed))
+	cleaner.deleteDirectly(ctx, failed)
+}
+
+// deleteDirectly is the fallback for connections that couldn't be queued.
+// They're deleted before the flush returns, rather than by a goroutine that
+// the invocation freezing could kill.
+func (cleaner *goneCleaner) deleteDirectly(ctx context.Context, connectionIDs []string) {
+	deleteGoneConnections(ctx,
+		connectionIDs,
+		cleaner.ddbService,
+		cleaner.metrics,
+		cleaner.audit,
+		cleaner.logger)
+}
+
+// batchDeleteConnections deletes the connections with BatchWriteItem calls
+// of up to batchDeleteSize deletes each, retrying the deletes that DynamoDB
+// leaves unprocessed, and removes the deleted connections from the
+// connection index. It returns the error for each connection that wasn't
+// deleted.
+func batchDeleteConnections(ctx context.Context,
+	connectionIDs []string,
+	ddbService dynamodbiface.DynamoDBAPI) map[string]error {
+	tableName := os.Getenv(envKeyTableName)
+	failures := make(map[string]error)
+	// A batch can't delete the same key twice
+	unique := make([]string, 0, len(connectionIDs))
+	seen := make(map[string]bool, len(connectionIDs))
+	for _, eachConnectionID := range connectionIDs {
+		if !seen[eachConnectionID] {
+			seen[eachConnectionID] = true
+			unique = append(unique, eachConnectionID)
+		}
+	}
+	failRequests := func(requests []*dynamodb.WriteRequest, err error) {
+		for _, eachRequest := range requests {
+			failures[aws.StringValue(eachRequest.DeleteRequest.Key[ddbAttributeConnectionID].S)] = err
+		}
+	}
+	for start := 0; start < len(unique); start += batchDeleteSize {
+		end := start + batchDeleteSize
+		if end > len(unique) {
+			end = len(unique)
+		}
+		requests := make([]*dynamodb.WriteRequest, 0, end-start)
+		for _, eachConnectionID := range unique[start:end] {
+			requests = append(requests, &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{
+					Key: map[string]*dynamodb.AttributeValue{
+						ddbAttributeConnectionID: &dynamodb.AttributeValue{
+							S: aws.String(eachConnectionID),
+						},
+					},
+				},
+			})
+		}
+		for attempt := 0; len(requests) != 0; attempt++ {
+			if attempt == batchDeleteMaxAttempts {
+				failRequests(requests, fmt.Errorf("delete unprocessed after %d attempts", attempt))
+				break
+			}
+			if attempt != 0 {
+				select {
+				case <-time.After(batchDeleteBackoff << uint(attempt-1)):
+				case <-ctx.Done():
+					failRequests(requests, ctx.Err())
+					requests = nil
+					continue
+				}
+			}
+			batchOutput, batchErr := ddbService.BatchWriteItemWithContext(ctx,
+				&dynamodb.BatchWriteItemInput{
+					RequestItems: map[string][]*dynamodb.WriteRequest{
+						tableName: requests,
+					},
+				})
+			if batchErr != nil {
+				failRequests(requests, batchErr)
+				break
+			}
+			requests = batchOutput.UnprocessedItems[tableName]
+		}
+	}
+	for _, eachConnectionID := range unique {
+		if failures[eachConnectionID] != nil {
+			continue
+		}
+		unindexErr := unindexConnection(ctx, eachConnectionID)
+		if unindexErr != nil {
+			failures[eachConnectionID] = unindexErr
+		}
+	}
+	return failures
+}
+
+// deleteGoneConnections batch deletes the connections, counting and
+// auditing each result. It returns the error for each connection that wasn't
+// deleted.
+func deleteGoneConnections(ctx context.Context,
+	connectionIDs []string,
+	ddbService dynamodbiface.DynamoDBAPI,
+	metrics *metricsEmitter,
+	audit *auditLog,
+	logger *logrus.Logger) map[string]error {
+	if len(connectionIDs) == 0 {
+		return nil
+	}
+	failures := batchDeleteConnections(ctx, connectionIDs, ddbService)
+	for _, eachConnectionID := range connectionIDs {
+		recordGoneCleanup(eachConnectionID, failures[eachConnectionID], metrics, audit, logger)
+	}
+	return failures
+}
+
+// releaseConnection removes the closed connection's room memberships, topic
+// subscriptions, and tags, and returns the rooms it left. Each is a no-op
+// if the lambda doesn't have access to its table.
+func releaseConnection(ctx context.Context,
+	connectionID string,
+	dynamoClient dynamodbiface.DynamoDBAPI,
+	logger *logrus.Logger) []string {
+	rooms := leaveAllRooms(ctx, connectionID, dynamoClient, logger)
+	unsubscribeAll(ctx, connectionID, dynamoClient, logger)
+	untagAll(ctx, connectionID, dynamoClient, logger)
+	return rooms
+}
+
+// recordGoneCleanup counts and audits the result of deleting the gone
+// connection
+func recordGoneCleanup(connectionID string,
+	delItemErr error,
+	metrics *metricsEmitter,
+	audit *auditLog,
+	logger *logrus.Logger) {
+	event := &auditEvent{
+		Action:       auditActionGoneCleanup,
+		ConnectionID: connectionID,
+		Success:      true,
+	}
+	if delItemErr != nil {
+		metrics.add(metricGoneCleanupFailures, 1)
+		event.Success = false
+		event.Error = delItemErr.Error()
+		logger.WithFields(logrus.Fields{
+			"Error":        delItemErr,
+			"ConnectionID": connectionID,
+		}).Warn("Failed to clean up gone connection")
+	} else {
+		metrics.add(metricGoneCleanups, 1)
+	}
+	auditErr := audit.record(event)
+	if auditErr != nil {
+		logger.WithField("Error", auditErr).Warn("Failed to record audit event")
+	}
+}
+
+// cleanupConnections consumes the cleanup queue. Returning an error leaves
+// the batch on the queue so that the deletes are retried; deletes are
+// idempotent so redelivery is harmless.
+func cleanupConnections(ctx context.Context, event awsEvents.SQSEvent) (err error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	dynamoClient := newConnectionsClient(sess)
+	metrics := newMetricsEmitter()
+	audit := newAuditLog("")
+	ctx, finishInvocation := startInvocation(ctx,
+		"CleanupConnections",
+		attribute.Int(attributeConnections, len(event.Records)))
+	defer func() {
+		finishInvocation(err)
+	}()
+
+	// Operation
+	var connectionIDs []string
+	for _, eachRecord := range event.Records {
+		var request cleanupRequest
+		unmarshalErr := json.Unmarshal([]byte(eachRecord.Body), &request)
+		if unmarshalErr != nil || request.ConnectionID == "" {
+			logger.WithField("Body", eachRecord.Body).Warn("Discarding malformed cleanup request")
+			continue
+		}
+		connectionIDs = append(connectionIDs, request.ConnectionID)
+	}
+	failures := deleteGoneConnections(ctx, connectionIDs, dynamoClient, metrics, audit, logger)
+	for _, eachConnectionID := range connectionIDs {
+		if failures[eachConnectionID] == nil {
+			releaseConnection(ctx, eachConnectionID, newDynamoClient(sess), logger)
+		}
+	}
+	failureCount := len(failures)
+	deletedCount := len(connectionIDs) - failureCount
+	telemetry.recordCleanup(ctx, "deleted", deletedCount)
+	telemetry.recordCleanup(ctx, "failed", failureCount)
+	metricsErr := metrics.flush()
+	if metricsErr != nil {
+		logger.WithField("Error", metricsErr).Warn("Failed to publish metrics")
+	}
+	if failureCount != 0 {
+		return fmt.Errorf("failed to clean up %d of %d connections",
+			failureCount,
+			len(event.Records))
+	}
+	return nil
+}
+
+// cleanupQueueDecorator provisions the cleanup queue
+func cleanupQueueDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(cleanupQueueResourceName, &gocf.SQSQueue{
+		VisibilityTimeout: gocf.Integer(cleanupQueueVisibilityTimeout),
+	})
+	return nil
+}
+
+// annotateCleanupProducer grants the lambda permission to queue cleanup
+// requests and publishes the queue URL in its environment
+func annotateCleanupProducer(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"sqs:SendMessage"},
+			Resource: gocf.GetAtt(cleanupQueueResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyCleanupQueueURL, gocf.Ref(cleanupQueueResourceName).String())
+}
+
+// annotateCleanupConsumer subscribes the lambda to the cleanup queue
+func annotateCleanupConsumer(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"sqs:ReceiveMessage",
+				"sqs:DeleteMessage",
+				"sqs:GetQueueAttributes"},
+			Resource: gocf.GetAtt(cleanupQueueResourceName, "Arn"),
+		})
+	lambdaFn.EventSourceMappings = append(lambdaFn.EventSourceMappings,
+		&sparta.EventSourceMapping{
+			EventSourceArn: gocf.GetAtt(cleanupQueueResourceName, "Arn"),
+			BatchSize:      cleanupQueueBatchSize,
+		})
+}
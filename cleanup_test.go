@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestBatchDeleteConnections(t *testing.T) {
+	manyConnectionIDs := make([]string, batchDeleteSize+5)
+	for eachIndex := range manyConnectionIDs {
+		manyConnectionIDs[eachIndex] = fmt.Sprintf("conn-%d", eachIndex)
+	}
+	tests := []struct {
+		name          string
+		connectionIDs []string
+		unprocessed   int
+		batchSizes    []int
+		failed        []string
+	}{
+		{name: "single batch",
+			connectionIDs: []string{"conn-1", "conn-2"},
+			batchSizes:    []int{2}},
+		{name: "duplicates",
+			connectionIDs: []string{"conn-1", "conn-2", "conn-1"},
+			batchSizes:    []int{2}},
+		{name: "split batches",
+			connectionIDs: manyConnectionIDs,
+			batchSizes:    []int{batchDeleteSize, 5}},
+		{name: "unprocessed retried",
+			connectionIDs: []string{"conn-1", "conn-2"},
+			unprocessed:   2,
+			batchSizes:    []int{2, 1, 1}},
+		{name: "unprocessed after every attempt",
+			connectionIDs: []string{"conn-1", "conn-2"},
+			unprocessed:   batchDeleteMaxAttempts,
+			batchSizes:    []int{2, 1, 1, 1},
+			failed:        []string{"conn-1"}},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			ddb := newMockDynamo(eachTest.connectionIDs...)
+			ddb.unprocessed = eachTest.unprocessed
+			useMockClients(t, ddb, newMockManagement())
+			failures := batchDeleteConnections(context.Background(), eachTest.connectionIDs, ddb)
+			if fmt.Sprint(ddb.batchSizes) != fmt.Sprint(eachTest.batchSizes) {
+				t.Errorf("Batch sizes = %v, want %v", ddb.batchSizes, eachTest.batchSizes)
+			}
+			if len(failures) != len(eachTest.failed) {
+				t.Errorf("Failures = %v, want %q", failures, eachTest.failed)
+			}
+			for _, eachConnectionID := range eachTest.failed {
+				if failures[eachConnectionID] == nil {
+					t.Errorf("%s wasn't reported as failed", eachConnectionID)
+				}
+			}
+			if remaining := len(ddb.items); remaining != len(eachTest.failed) {
+				t.Errorf("Remaining connections = %d, want %d", remaining, len(eachTest.failed))
+			}
+		})
+	}
+}
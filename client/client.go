@@ -0,0 +1,435 @@
+// Package client is a Go client for the SpartaWebSocket service. Clients
+// transparently reconnect with jittered exponential backoff when the gateway
+// drops the connection, presenting the most recent resume token, rejoining
+// rooms, and replaying the room messages sent while they were away so that
+// brief drops are invisible to applications. Idle connections are kept open
+// with ping frames.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mweagle/SpartaWebSocket/protocol"
+)
+
+const (
+	defaultInitialBackoff = 250 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+	// Frame type that carries the server issued resume token
+	sessionFrameType = "session"
+	// Query parameter that presents the resume token on reconnect
+	queryParamResumeToken = "resumeToken"
+	// Action that requests the session frame after each connect
+	sessionAction = "session"
+	// Action that replays the room messages after a sequence number
+	resumeAction = "resume"
+)
+
+var (
+	// ErrNotConnected is returned by Send while the client is reconnecting
+	ErrNotConnected = errors.New("client: not connected")
+	// ErrClosed is returned by Send after Close
+	ErrClosed = errors.New("client: closed")
+)
+
+// Options configures a Client
+type Options struct {
+	// URL is the wss:// endpoint, including any handshake query parameters
+	URL string
+	// InitialBackoff is the maximum delay before the first reconnect attempt.
+	// Defaults to 250ms.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between reconnect attempts. Defaults to 30s.
+	MaxBackoff time.Duration
+	// MaxAttempts limits consecutive reconnect attempts before the client
+	// gives up and closes. Zero retries forever.
+	MaxAttempts int
+	// Dialer is used to open connections. Defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+	// OnReconnect, if non-nil, is called after each successful reconnect
+	// once rooms have been rejoined
+	OnReconnect func(client *Client)
+	// Encoding is the frame encoding negotiated at $connect, unless the URL
+	// already negotiates one. Defaults to protocol.EncodingJSON. Broadcast and
+	// Data use the encoding; actions are always sent as JSON text frames so
+	// that the gateway can route them.
+	Encoding protocol.Encoding
+	// Compression is the outbound frame compression negotiated at $connect
+	// along with Encoding. Defaults to protocol.CompressionNone. Data
+	// decompresses inbound frames.
+	Compression protocol.Compression
+	// PingInterval is the delay between keepalive pings, which stop API
+	// Gateway closing an idle connection. Defaults to 5m; a negative
+	// interval disables pings.
+	PingInterval time.Duration
+	// HTTPClient fetches the payloads of pointer frames. Defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// inboundFrame is the union of the properties of the inbound frames the
+// client tracks: session frames that issue a resume token, room frames with
+// a sequence number, and resume frames that replay missed room messages
+type inboundFrame struct {
+	Type        string `json:"type"`
+	ResumeToken string `json:"resumeToken"`
+	Room        string `json:"room"`
+	Seq         int64  `json:"seq"`
+	Messages    []struct {
+		Seq int64 `json:"seq"`
+	} `json:"messages"`
+	More bool `json:"more"`
+}
+
+// requestFrame is the JSON frame sent for every action
+type requestFrame struct {
+	Message        string      `json:"message"`
+	IdempotencyKey string      `json:"idempotencyKey,omitempty"`
+	Data           interface{} `json:"data,omitempty"`
+}
+
+// roomRequest is the data for the joinroom and leaveroom actions
+type roomRequest struct {
+	Room string `json:"room"`
+}
+
+// resumeRequest is the data for the resume action
+type resumeRequest struct {
+	Room  string `json:"room"`
+	Since int64  `json:"since"`
+}
+
+// Client is a reconnecting WebSocket connection. It's safe for concurrent use.
+type Client struct {
+	options Options
+	frames  chan []byte
+	done    chan struct{}
+
+	mutex       sync.Mutex
+	conn        *websocket.Conn
+	rooms       map[string]bool
+	resumeToken string
+	closed      bool
+	err         error
+	// sequences is the last sequence number seen in each joined room
+	sequences map[string]int64
+	// chunks holds the parts of partially received chunked frames by ID
+	chunks map[string]*pendingChunks
+}
+
+// Connect opens the connection and starts delivering inbound frames
+func Connect(ctx context.Context, options Options) (*Client, error) {
+	if options.InitialBackoff <= 0 {
+		options.InitialBackoff = defaultInitialBackoff
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = defaultMaxBackoff
+	}
+	if options.Dialer == nil {
+		options.Dialer = websocket.DefaultDialer
+	}
+	if options.PingInterval == 0 {
+		options.PingInterval = defaultPingInterval
+	}
+	if options.HTTPClient == nil {
+		options.HTTPClient = http.DefaultClient
+	}
+	client := &Client{
+		options:   options,
+		frames:    make(chan []byte, 64),
+		done:      make(chan struct{}),
+		rooms:     make(map[string]bool),
+		sequences: make(map[string]int64),
+		chunks:    make(map[string]*pendingChunks),
+	}
+	conn, connErr := client.dial(ctx)
+	if connErr != nil {
+		return nil, connErr
+	}
+	client.conn = conn
+	// A failed request is retried after the reconnect that follows
+	client.Send(sessionAction, nil)
+	go client.readLoop(conn)
+	if options.PingInterval > 0 {
+		go client.keepalive()
+	}
+	return client, nil
+}
+
+// Frames returns the channel of inbound frames. Pointer and chunk frames
+// are resolved into the frames they carry, so every frame on the channel
+// can be passed to Data. The channel is closed when the client is
+// closed or gives up reconnecting.
+func (client *Client) Frames() <-chan []byte {
+	return client.frames
+}
+
+// Err returns the error that caused the client to give up, if any
+func (client *Client) Err() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.err
+}
+
+// Send sends the action with the JSON marshalled data
+func (client *Client) Send(message string, data interface{}) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.sendLocked(message, data)
+}
+
+func (client *Client) sendLocked(message string, data interface{}) error {
+	if client.closed {
+		return ErrClosed
+	}
+	if client.conn == nil {
+		return ErrNotConnected
+	}
+	return client.conn.WriteJSON(&requestFrame{
+		Message: message,
+		Data:    data,
+	})
+}
+
+// SendBinary sends the opaque binary payload, such as an image, as a binary
+// frame. Binary frames arrive on the $default route and are broadcast, so
+// JSON connections receive the same binary frame.
+func (client *Client) SendBinary(payload []byte) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.closed {
+		return ErrClosed
+	}
+	if client.conn == nil {
+		return ErrNotConnected
+	}
+	return client.conn.WriteMessage(websocket.BinaryMessage, payload)
+}
+
+// JoinRoom joins the room. Joined rooms are rejoined after every reconnect.
+func (client *Client) JoinRoom(room string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.rooms[room] = true
+	return client.sendLocked("joinroom", &roomRequest{Room: room})
+}
+
+// LeaveRoom leaves the room
+func (client *Client) LeaveRoom(room string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	delete(client.rooms, room)
+	delete(client.sequences, room)
+	return client.sendLocked("leaveroom", &roomRequest{Room: room})
+}
+
+// Close closes the connection and stops reconnecting
+func (client *Client) Close() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.closed {
+		return nil
+	}
+	client.closed = true
+	close(client.done)
+	if client.conn == nil {
+		return nil
+	}
+	closeErr := client.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	client.conn.Close()
+	return closeErr
+}
+
+// dial opens a connection, presenting the resume token if there is one
+func (client *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	endpoint, endpointErr := url.Parse(client.options.URL)
+	if endpointErr != nil {
+		return nil, endpointErr
+	}
+	client.mutex.Lock()
+	resumeToken := client.resumeToken
+	client.mutex.Unlock()
+	query := endpoint.Query()
+	if resumeToken != "" {
+		query.Set(queryParamResumeToken, resumeToken)
+	}
+	if query.Get(queryParamAcceptEncodings) == "" && query.Get(queryParamProtocol) == "" {
+		query.Set(queryParamAcceptEncodings, client.acceptEncodings())
+	}
+	endpoint.RawQuery = query.Encode()
+	conn, _, dialErr := client.options.Dialer.DialContext(ctx, endpoint.String(), nil)
+	return conn, dialErr
+}
+
+// readLoop delivers frames until the connection drops, then reconnects.
+// Envelope frames that can't be resolved, such as pointers whose payload
+// can't be fetched, are dropped.
+func (client *Client) readLoop(conn *websocket.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-client.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		_, frame, readErr := conn.ReadMessage()
+		if readErr != nil {
+			conn.Close()
+			if !client.reconnect() {
+				close(client.frames)
+				return
+			}
+			client.mutex.Lock()
+			conn = client.conn
+			client.mutex.Unlock()
+			continue
+		}
+		resolved, resolveErr := client.resolve(ctx, frame)
+		if resolveErr != nil {
+			client.mutex.Lock()
+			client.err = resolveErr
+			client.mutex.Unlock()
+			continue
+		}
+		if resolved == nil {
+			continue
+		}
+		client.observe(resolved)
+		select {
+		case client.frames <- resolved:
+		case <-client.done:
+			close(client.frames)
+			return
+		}
+	}
+}
+
+// observe records the resume token from session frames and the sequence
+// numbers of joined rooms. A room frame that skips sequence numbers, and a
+// resume frame with more messages, request the missed messages.
+func (client *Client) observe(frame []byte) {
+	data, dataErr := client.Data(frame)
+	if dataErr != nil {
+		return
+	}
+	var inbound inboundFrame
+	if json.Unmarshal(data, &inbound) != nil {
+		return
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	switch {
+	case inbound.Type == sessionFrameType:
+		if inbound.ResumeToken != "" {
+			client.resumeToken = inbound.ResumeToken
+		}
+	case !client.rooms[inbound.Room]:
+		return
+	case inbound.Messages != nil:
+		for _, eachMessage := range inbound.Messages {
+			client.advanceLocked(inbound.Room, eachMessage.Seq)
+		}
+		if inbound.More && len(inbound.Messages) != 0 {
+			client.sendLocked(resumeAction, &resumeRequest{
+				Room:  inbound.Room,
+				Since: inbound.Messages[len(inbound.Messages)-1].Seq,
+			})
+		}
+	case inbound.Seq > 0:
+		if last := client.sequences[inbound.Room]; last > 0 && inbound.Seq > last+1 {
+			client.sendLocked(resumeAction, &resumeRequest{
+				Room:  inbound.Room,
+				Since: last,
+			})
+		}
+		client.advanceLocked(inbound.Room, inbound.Seq)
+	}
+}
+
+// advanceLocked records the room's sequence number if it's the latest
+func (client *Client) advanceLocked(room string, seq int64) {
+	if seq > client.sequences[room] {
+		client.sequences[room] = seq
+	}
+}
+
+// reconnect dials until it succeeds, the client is closed, or MaxAttempts
+// is exhausted. It returns true if the client is connected again.
+func (client *Client) reconnect() bool {
+	client.mutex.Lock()
+	client.conn = nil
+	client.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-client.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for attempt := 0; client.options.MaxAttempts == 0 || attempt < client.options.MaxAttempts; attempt++ {
+		select {
+		case <-time.After(client.backoff(attempt)):
+		case <-client.done:
+			return false
+		}
+		conn, dialErr := client.dial(ctx)
+		if dialErr != nil {
+			client.mutex.Lock()
+			client.err = dialErr
+			client.mutex.Unlock()
+			continue
+		}
+		client.mutex.Lock()
+		if client.closed {
+			client.mutex.Unlock()
+			conn.Close()
+			return false
+		}
+		client.conn = conn
+		client.err = nil
+		client.sendLocked(sessionAction, nil)
+		for eachRoom := range client.rooms {
+			client.sendLocked("joinroom", &roomRequest{Room: eachRoom})
+			if since := client.sequences[eachRoom]; since > 0 {
+				client.sendLocked(resumeAction, &resumeRequest{
+					Room:  eachRoom,
+					Since: since,
+				})
+			}
+		}
+		client.mutex.Unlock()
+		if client.options.OnReconnect != nil {
+			client.options.OnReconnect(client)
+		}
+		return true
+	}
+	return false
+}
+
+// backoff returns the "full jitter" delay for the attempt: a random duration
+// up to the exponentially growing, capped ceiling
+func (client *Client) backoff(attempt int) time.Duration {
+	ceiling := client.options.MaxBackoff
+	if attempt < 32 {
+		if exponential := client.options.InitialBackoff << uint(attempt); exponential > 0 && exponential < ceiling {
+			ceiling = exponential
+		}
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
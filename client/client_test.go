@@ -0,0 +1,42 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	client := &Client{
+		options: Options{
+			InitialBackoff: 100 * time.Millisecond,
+			MaxBackoff:     time.Second,
+		},
+	}
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		// Shifts that overflow are capped
+		{64, time.Second},
+	}
+	for _, eachTest := range tests {
+		longest := time.Duration(0)
+		for eachSample := 0; eachSample < 1000; eachSample++ {
+			delay := client.backoff(eachTest.attempt)
+			if delay < 0 || delay > eachTest.ceiling {
+				t.Fatalf("backoff(%d) = %s, want at most %s", eachTest.attempt, delay, eachTest.ceiling)
+			}
+			if delay > longest {
+				longest = delay
+			}
+		}
+		// Full jitter spreads delays over the whole range
+		if longest < eachTest.ceiling/2 {
+			t.Errorf("Longest backoff(%d) = %s, want close to %s", eachTest.attempt, longest, eachTest.ceiling)
+		}
+	}
+}
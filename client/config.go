@@ -0,0 +1,45 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// ConfigFileName is the configuration bundle written after provisioning
+const ConfigFileName = "client-config.json"
+
+// Config describes a provisioned service
+type Config struct {
+	// Endpoint is the wss:// URL, preferring the custom domain if one is
+	// configured
+	Endpoint string `json:"endpoint"`
+	// Stage is the API stage name
+	Stage string `json:"stage"`
+	// AuthMode is the $connect authorization type (eg, NONE)
+	AuthMode string `json:"authMode"`
+	// ProtocolVersion is the server's wire protocol version
+	ProtocolVersion int `json:"protocolVersion"`
+	// Routes are the actions clients can send
+	Routes []string `json:"routes"`
+}
+
+// LoadConfig reads a configuration bundle
+func LoadConfig(path string) (*Config, error) {
+	configBytes, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		return nil, readErr
+	}
+	config := &Config{}
+	unmarshalErr := json.Unmarshal(configBytes, config)
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	return config, nil
+}
+
+// Options returns connection options for the configured endpoint
+func (config *Config) Options() Options {
+	return Options{
+		URL: config.Endpoint,
+	}
+}
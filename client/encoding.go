@@ -0,0 +1,114 @@
+package client
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/mweagle/SpartaWebSocket/protocol"
+)
+
+const (
+	// Query parameter that negotiates the frame encoding at $connect
+	queryParamAcceptEncodings = "accept-encodings"
+	// Query parameter that older clients use to select the encoding
+	queryParamProtocol = "protocol"
+	// Action that broadcasts data to every connection
+	sendMessageAction = "sendmessage"
+)
+
+// encoding returns the negotiated frame encoding
+func (client *Client) encoding() protocol.Encoding {
+	if client.options.Encoding == "" {
+		return protocol.EncodingJSON
+	}
+	return client.options.Encoding
+}
+
+// compression returns the negotiated frame compression
+func (client *Client) compression() protocol.Compression {
+	if client.options.Compression == "" {
+		return protocol.CompressionNone
+	}
+	return client.options.Compression
+}
+
+// acceptEncodings returns the `accept-encodings` value that negotiates the
+// options' encoding and compression. The client reassembles chunk frames,
+// so it always accepts them.
+func (client *Client) acceptEncodings() string {
+	values := []string{protocol.Chunked}
+	if client.options.Encoding != "" {
+		values = append(values, string(client.options.Encoding))
+	}
+	if client.options.Compression != "" {
+		values = append(values, string(client.options.Compression))
+	}
+	return strings.Join(values, ",")
+}
+
+// Broadcast sends the JSON marshalled data to every connection. Clients that
+// negotiated a binary encoding send a binary frame in that encoding, which
+// is smaller than the JSON frame.
+func (client *Client) Broadcast(data interface{}) error {
+	encoding := client.encoding()
+	if encoding == protocol.EncodingJSON {
+		return client.Send(sendMessageAction, data)
+	}
+	jsonData, jsonDataErr := json.Marshal(data)
+	if jsonDataErr != nil {
+		return jsonDataErr
+	}
+	frame, frameErr := protocol.EncodeRequest(protocol.CodecFor(encoding),
+		sendMessageAction,
+		jsonData)
+	if frameErr != nil {
+		return frameErr
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.closed {
+		return ErrClosed
+	}
+	if client.conn == nil {
+		return ErrNotConnected
+	}
+	return client.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// BroadcastIdempotent broadcasts the JSON marshalled data with a key, such as
+// a UUID, that identifies the broadcast. Broadcasting again with the same key,
+// such as after a reconnect, doesn't deliver the data twice. Binary frames
+// don't carry a key, so the data is always sent as a JSON text frame.
+func (client *Client) BroadcastIdempotent(key string, data interface{}) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.closed {
+		return ErrClosed
+	}
+	if client.conn == nil {
+		return ErrNotConnected
+	}
+	return client.conn.WriteJSON(&requestFrame{
+		Message:        sendMessageAction,
+		IdempotencyKey: key,
+		Data:           data,
+	})
+}
+
+// Data returns the JSON data of an inbound frame. Compressed frames are
+// decompressed first; frames the service never compresses, such as chunk and
+// pointer frames, are used as-is. JSON frames are then their own data and
+// binary frames are decoded with the negotiated encoding. Frames from Frames
+// are already resolved, so their data is never an envelope.
+func (client *Client) Data(frame []byte) (json.RawMessage, error) {
+	if decompressed, decompressedErr := protocol.Decompress(client.compression(),
+		frame); decompressedErr == nil {
+		frame = decompressed
+	}
+	encoding := client.encoding()
+	if encoding == protocol.EncodingJSON {
+		return frame, nil
+	}
+	return protocol.CodecFor(encoding).Decode(frame)
+}
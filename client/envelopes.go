@@ -0,0 +1,123 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// Envelope frame types. The service wraps frames that exceed the gateway
+	// frame limit in pointer or chunk frames.
+	pointerFrameType = "pointer"
+	chunkFrameType   = "chunk"
+	// maxPendingChunks bounds the partially received chunked frames, so a
+	// lost part doesn't grow the client without bound
+	maxPendingChunks = 8
+	// maxPointerSize bounds the staged payloads the client fetches
+	maxPointerSize = 32 * 1024 * 1024
+)
+
+// envelope is the union of the envelope frame data properties
+type envelope struct {
+	Type string `json:"type"`
+	// Pointer frames
+	URL  string `json:"url"`
+	Size int    `json:"size"`
+	// Chunk frames
+	ID    string `json:"id"`
+	Part  int    `json:"part"`
+	Parts int    `json:"parts"`
+	Data  []byte `json:"data"`
+}
+
+// pendingChunks collects the parts of a chunked frame
+type pendingChunks struct {
+	parts    [][]byte
+	received int
+}
+
+// resolve returns the frame that the inbound frame carries. Pointer frames
+// are replaced by the staged frame, and chunk frames are held until every
+// part arrives, so that the returned frame is one the service would
+// otherwise have delivered as is. It returns nil while a chunked frame is
+// incomplete. Other frames are returned unchanged.
+func (client *Client) resolve(ctx context.Context, frame []byte) ([]byte, error) {
+	data, dataErr := client.Data(frame)
+	if dataErr != nil {
+		return frame, nil
+	}
+	var env envelope
+	if json.Unmarshal(data, &env) != nil {
+		return frame, nil
+	}
+	switch env.Type {
+	case pointerFrameType:
+		staged, stagedErr := client.fetch(ctx, &env)
+		if stagedErr != nil {
+			return nil, stagedErr
+		}
+		return client.resolve(ctx, staged)
+	case chunkFrameType:
+		complete := client.reassemble(&env)
+		if complete == nil {
+			return nil, nil
+		}
+		return client.resolve(ctx, complete)
+	}
+	return frame, nil
+}
+
+// fetch returns the frame staged at the pointer's presigned URL
+func (client *Client) fetch(ctx context.Context, pointer *envelope) ([]byte, error) {
+	if pointer.Size > maxPointerSize {
+		return nil, fmt.Errorf("client: staged frame of %d bytes exceeds %d", pointer.Size, maxPointerSize)
+	}
+	request, requestErr := http.NewRequestWithContext(ctx, http.MethodGet, pointer.URL, nil)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	response, responseErr := client.options.HTTPClient.Do(request)
+	if responseErr != nil {
+		return nil, responseErr
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("client: fetching staged frame failed: %s", response.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(response.Body, maxPointerSize))
+}
+
+// reassemble records the chunk and returns the complete frame once every
+// part has arrived, or nil
+func (client *Client) reassemble(chunk *envelope) []byte {
+	if chunk.Parts < 1 || chunk.Part < 1 || chunk.Part > chunk.Parts {
+		return nil
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	pending, pendingExists := client.chunks[chunk.ID]
+	if !pendingExists {
+		if len(client.chunks) >= maxPendingChunks {
+			client.chunks = make(map[string]*pendingChunks)
+		}
+		pending = &pendingChunks{
+			parts: make([][]byte, chunk.Parts),
+		}
+		client.chunks[chunk.ID] = pending
+	}
+	if len(pending.parts) != chunk.Parts || pending.parts[chunk.Part-1] != nil {
+		return nil
+	}
+	pending.parts[chunk.Part-1] = chunk.Data
+	pending.received++
+	if pending.received != chunk.Parts {
+		return nil
+	}
+	delete(client.chunks, chunk.ID)
+	return bytes.Join(pending.parts, nil)
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/mweagle/SpartaWebSocket/protocol"
+)
+
+// chunkFrames returns the JSON chunk frames that split the frame into parts
+func chunkFrames(t *testing.T, id string, frame []byte, parts int) [][]byte {
+	size := (len(frame) + parts - 1) / parts
+	frames := make([][]byte, 0, parts)
+	for eachPart := 0; eachPart < parts; eachPart++ {
+		end := (eachPart + 1) * size
+		if end > len(frame) {
+			end = len(frame)
+		}
+		data, dataErr := json.Marshal(&envelope{
+			Type:  chunkFrameType,
+			ID:    id,
+			Part:  eachPart + 1,
+			Parts: parts,
+			Data:  frame[eachPart*size : end],
+		})
+		if dataErr != nil {
+			t.Fatalf("Marshaling chunk %d failed: %s", eachPart+1, dataErr)
+		}
+		chunkFrame, chunkFrameErr := protocol.CodecFor(protocol.EncodingJSON).Encode(chunkFrameType, data)
+		if chunkFrameErr != nil {
+			t.Fatalf("Encoding chunk %d failed: %s", eachPart+1, chunkFrameErr)
+		}
+		frames = append(frames, chunkFrame)
+	}
+	return frames
+}
+
+func TestResolveChunks(t *testing.T) {
+	frame := []byte(`{"type":"message","data":"hello, world"}`)
+	tests := []struct {
+		name string
+		// order is the chunk frames received, by part number
+		order    []int
+		resolved string
+	}{
+		{"in order", []int{1, 2, 3}, string(frame)},
+		{"out of order", []int{3, 1, 2}, string(frame)},
+		{"duplicate part", []int{1, 1, 2, 3}, string(frame)},
+		{"missing part", []int{1, 3}, ""},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			client := &Client{chunks: make(map[string]*pendingChunks)}
+			chunks := chunkFrames(t, "frame-1", frame, 3)
+			resolved := ""
+			for eachIndex, eachPart := range eachTest.order {
+				complete, completeErr := client.resolve(context.Background(), chunks[eachPart-1])
+				if completeErr != nil {
+					t.Fatalf("resolve failed: %s", completeErr)
+				}
+				if complete != nil && eachIndex != len(eachTest.order)-1 {
+					t.Fatalf("Resolved %s before the last chunk", complete)
+				}
+				resolved = string(complete)
+			}
+			if resolved != eachTest.resolved {
+				t.Errorf("Resolved %q, want %q", resolved, eachTest.resolved)
+			}
+		})
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	client := &Client{chunks: make(map[string]*pendingChunks)}
+	invalid := []*envelope{
+		{ID: "frame-1", Part: 0, Parts: 2},
+		{ID: "frame-1", Part: 3, Parts: 2},
+		{ID: "frame-1", Part: 1, Parts: 0},
+	}
+	for _, eachChunk := range invalid {
+		if complete := client.reassemble(eachChunk); complete != nil {
+			t.Errorf("reassemble(part %d of %d) = %q, want nil", eachChunk.Part, eachChunk.Parts, complete)
+		}
+	}
+	if len(client.chunks) != 0 {
+		t.Errorf("Pending chunked frames = %d after invalid parts, want 0", len(client.chunks))
+	}
+	// A part count that disagrees with the frame's first part is ignored
+	client.reassemble(&envelope{ID: "frame-1", Part: 1, Parts: 2, Data: []byte("a")})
+	if complete := client.reassemble(&envelope{ID: "frame-1", Part: 2, Parts: 3, Data: []byte("b")}); complete != nil {
+		t.Errorf("reassemble(mismatched part) = %q, want nil", complete)
+	}
+	if complete := client.reassemble(&envelope{ID: "frame-1", Part: 2, Parts: 2, Data: []byte("b")}); string(complete) != "ab" {
+		t.Errorf("reassemble(last part) = %q, want %q", complete, "ab")
+	}
+	// Incomplete frames are discarded once too many are pending
+	for eachIndex := 0; eachIndex <= maxPendingChunks; eachIndex++ {
+		client.reassemble(&envelope{ID: fmt.Sprintf("frame-%d", eachIndex), Part: 1, Parts: 2})
+	}
+	if len(client.chunks) > maxPendingChunks {
+		t.Errorf("Pending chunked frames = %d, want at most %d", len(client.chunks), maxPendingChunks)
+	}
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// defaultPingInterval keeps the connection well inside API Gateway's ten
+	// minute idle timeout
+	defaultPingInterval = 5 * time.Minute
+	// pingWriteTimeout bounds how long a ping can block on a stalled
+	// connection
+	pingWriteTimeout = 10 * time.Second
+)
+
+// keepalive sends a ping control frame every PingInterval until the client
+// is closed. A failed ping is ignored; the read loop notices the dropped
+// connection and reconnects. Control frames can be written concurrently with
+// other frames, so the ping doesn't hold the client's mutex.
+func (client *Client) keepalive() {
+	ticker := time.NewTicker(client.options.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			client.mutex.Lock()
+			conn := client.conn
+			client.mutex.Unlock()
+			if conn != nil {
+				conn.WriteControl(websocket.PingMessage,
+					nil,
+					time.Now().Add(pingWriteTimeout))
+			}
+		case <-client.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Subscribe calls the handler with the data of each inbound frame that
+// unmarshals into a T until the context is done or the client closes.
+// Frames are decoded with the negotiated encoding, and frames whose data
+// isn't a T are skipped. Subscribe reads from Frames, so an application
+// either subscribes or reads Frames itself.
+func Subscribe[T any](ctx context.Context, client *Client, handler func(T)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case eachFrame, frameOk := <-client.Frames():
+			if !frameOk {
+				return client.Err()
+			}
+			data, dataErr := client.Data(eachFrame)
+			if dataErr != nil {
+				continue
+			}
+			var typedData T
+			if json.Unmarshal(data, &typedData) != nil {
+				continue
+			}
+			handler(typedData)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/mweagle/SpartaWebSocket/client"
+	"github.com/mweagle/SpartaWebSocket/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	routeSendMessage = "sendmessage"
+	routeWork        = "work"
+	routeJoinRoom    = "joinroom"
+	routeLeaveRoom   = "leaveroom"
+	routeSendRoom    = "sendroom"
+	routeSendDirect  = "senddirect"
+	routePresence    = "presence"
+	routeTyping      = "typing"
+	routeAck         = "ack"
+	routeHistory     = "history"
+	routeResume      = "resume"
+	routeSession     = "session"
+	routeUpdate      = "update"
+	routeSubscribe   = "subscribe"
+	routeUnsubscribe = "unsubscribe"
+	routePublish     = "publish"
+	routeTag         = "tag"
+	authModeNone     = "NONE"
+)
+
+// clientRoutes are the actions published in the client configuration
+var clientRoutes = []string{routeSendMessage,
+	routeWork,
+	routeJoinRoom,
+	routeLeaveRoom,
+	routeSendRoom,
+	routeSendDirect,
+	routePresence,
+	routeTyping,
+	routeAck,
+	routeHistory,
+	routeResume,
+	routeSession,
+	routeUpdate,
+	routeSubscribe,
+	routeUnsubscribe,
+	routePublish,
+	routeTag}
+
+// provisioned returns true if this invocation provisioned the stack
+func provisioned() bool {
+	if len(os.Args) < 2 || os.Args[1] != "provision" {
+		return false
+	}
+	for _, eachArg := range os.Args[2:] {
+		if eachArg == "--noop" || eachArg == "-n" {
+			return false
+		}
+	}
+	return true
+}
+
+// writeClientConfig writes the client configuration bundle from the
+// provisioned stack's outputs
+func writeClientConfig(stackName string,
+	sess *session.Session,
+	logger *logrus.Logger) error {
+	describeOutput, describeErr := cloudformation.New(sess).DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	if describeErr != nil {
+		return describeErr
+	}
+	config := &client.Config{
+		Stage:           apiStageName,
+		AuthMode:        authModeNone,
+		ProtocolVersion: protocol.Version,
+		Routes:          clientRoutes,
+	}
+	outputs := make(map[string]string)
+	for _, eachStack := range describeOutput.Stacks {
+		for _, eachOutput := range eachStack.Outputs {
+			outputs[aws.StringValue(eachOutput.OutputKey)] = aws.StringValue(eachOutput.OutputValue)
+		}
+	}
+	config.Endpoint = outputs[outputWebSocketURL]
+	if customDomainURL := outputs[outputCustomDomainURL]; customDomainURL != "" {
+		config.Endpoint = customDomainURL
+	}
+	configJSON, configJSONErr := json.MarshalIndent(config, "", "  ")
+	if configJSONErr != nil {
+		return configJSONErr
+	}
+	writeErr := ioutil.WriteFile(client.ConfigFileName, configJSON, 0644)
+	if writeErr != nil {
+		return writeErr
+	}
+	logger.WithFields(logrus.Fields{
+		"Path":     client.ConfigFileName,
+		"Endpoint": config.Endpoint,
+	}).Info("Wrote client configuration")
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	apigwManagement "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	apigwManagementIface "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi/apigatewaymanagementapiiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// sharedSession is the warm container's session, which newAWSSession
+// creates once
+var (
+	sharedSession     *session.Session
+	sharedSessionOnce sync.Once
+)
+
+// Service client constructors. The handlers depend on the service
+// interfaces rather than the SDK clients, so a test can replace the
+// constructors with ones that return mock implementations.
+var (
+	// newConnectionsClient returns the DynamoDB client for the connection
+	// table, which may be in the data account
+	newConnectionsClient = func(sess *session.Session) dynamodbiface.DynamoDBAPI {
+		return warmClients.dynamo(sess, "connections", func() dynamodbiface.DynamoDBAPI {
+			return dynamodb.New(connectionsSession(sess))
+		})
+	}
+	// newDynamoClient returns the DynamoDB client for the stack's other
+	// tables
+	newDynamoClient = func(sess *session.Session) dynamodbiface.DynamoDBAPI {
+		return warmClients.dynamo(sess, "", func() dynamodbiface.DynamoDBAPI {
+			return dynamodb.New(sess)
+		})
+	}
+	// newManagementClient returns the @connections management API client
+	// for the endpoint
+	newManagementClient = func(sess *session.Session,
+		endpointURL string) apigwManagementIface.ApiGatewayManagementApiAPI {
+		return warmClients.management(sess, endpointURL)
+	}
+	// newSQSClient returns the SQS client for the stack's queues
+	newSQSClient = func(sess *session.Session) sqsiface.SQSAPI {
+		return warmClients.queues(sess)
+	}
+)
+
+// clientCache reuses the clients created from the shared session across
+// warm invocations, so each invocation doesn't pay for client construction
+// and new connection pools. Clients for other sessions, such as copies for
+// another region, aren't cached. It's safe for concurrent use.
+type clientCache struct {
+	mutex          sync.Mutex
+	dynamoClients  map[string]dynamodbiface.DynamoDBAPI
+	managementAPIs map[string]apigwManagementIface.ApiGatewayManagementApiAPI
+	sqsClient      sqsiface.SQSAPI
+}
+
+var warmClients = &clientCache{
+	dynamoClients:  make(map[string]dynamodbiface.DynamoDBAPI),
+	managementAPIs: make(map[string]apigwManagementIface.ApiGatewayManagementApiAPI),
+}
+
+// dynamo returns the cached DynamoDB client with the name, creating it with
+// newClient on first use
+func (cache *clientCache) dynamo(sess *session.Session,
+	name string,
+	newClient func() dynamodbiface.DynamoDBAPI) dynamodbiface.DynamoDBAPI {
+	if sess != sharedSession {
+		return newClient()
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	client, clientExists := cache.dynamoClients[name]
+	if !clientExists {
+		client = newClient()
+		cache.dynamoClients[name] = client
+	}
+	return client
+}
+
+// queues returns the cached SQS client
+func (cache *clientCache) queues(sess *session.Session) sqsiface.SQSAPI {
+	if sess != sharedSession {
+		return sqs.New(sess)
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.sqsClient == nil {
+		cache.sqsClient = sqs.New(sess)
+	}
+	return cache.sqsClient
+}
+
+// management returns the cached management API client for the endpoint
+func (cache *clientCache) management(sess *session.Session,
+	endpointURL string) apigwManagementIface.ApiGatewayManagementApiAPI {
+	newClient := func() apigwManagementIface.ApiGatewayManagementApiAPI {
+		return apigwManagement.New(sess, aws.NewConfig().WithEndpoint(endpointURL))
+	}
+	if sess != sharedSession {
+		return newClient()
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	client, clientExists := cache.managementAPIs[endpointURL]
+	if !clientExists {
+		client = newClient()
+		cache.managementAPIs[endpointURL] = client
+	}
+	return client
+}
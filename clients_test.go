@@ -0,0 +1,357 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	apigwManagement "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	apigwManagementIface "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi/apigatewaymanagementapiiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/mweagle/SpartaWebSocket/connections"
+)
+
+const testTableName = "Connections"
+
+// mockDynamo is a DynamoDB client whose connection table holds items. It
+// implements the calls the connection handlers make, and panics on any
+// other, since the embedded interface is nil. It's safe for concurrent use.
+type mockDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	mutex sync.Mutex
+	items []map[string]*dynamodb.AttributeValue
+	// puts and deleted record the connection table writes
+	puts    []map[string]*dynamodb.AttributeValue
+	deleted []string
+	// putErr, deleteErr, queryErr, and scanErr fail the connection table
+	// calls
+	putErr    error
+	deleteErr error
+	queryErr  error
+	scanErr   error
+	scans     int
+	// unprocessed is the number of BatchWriteItem calls that leave their
+	// first delete unprocessed, and batchSizes records each call's deletes
+	unprocessed int
+	batchSizes  []int
+}
+
+// newMockDynamo returns a mock whose connection table holds a JSON
+// connection item for each distinct connection ID
+func newMockDynamo(connectionIDs ...string) *mockDynamo {
+	ddb := &mockDynamo{}
+	for _, eachConnectionID := range connectionIDs {
+		key := map[string]*dynamodb.AttributeValue{
+			ddbAttributeConnectionID: &dynamodb.AttributeValue{
+				S: aws.String(eachConnectionID),
+			},
+		}
+		if ddb.item(key) >= 0 {
+			continue
+		}
+		ddb.items = append(ddb.items, map[string]*dynamodb.AttributeValue{
+			ddbAttributeConnectionID: &dynamodb.AttributeValue{
+				S: aws.String(eachConnectionID),
+			},
+			connections.BucketAttribute: connections.BucketValue(eachConnectionID),
+		})
+	}
+	return ddb
+}
+
+// item returns the index of the connection's item, or -1
+func (ddb *mockDynamo) item(key map[string]*dynamodb.AttributeValue) int {
+	for eachIndex, eachItem := range ddb.items {
+		if itemString(eachItem, ddbAttributeConnectionID) == itemString(key, ddbAttributeConnectionID) {
+			return eachIndex
+		}
+	}
+	return -1
+}
+
+func (ddb *mockDynamo) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	ddb.mutex.Lock()
+	defer ddb.mutex.Unlock()
+	output := &dynamodb.GetItemOutput{}
+	if aws.StringValue(input.TableName) != testTableName {
+		return output, nil
+	}
+	if itemIndex := ddb.item(input.Key); itemIndex >= 0 {
+		output.Item = ddb.items[itemIndex]
+	}
+	return output, nil
+}
+
+func (ddb *mockDynamo) GetItemWithContext(ctx aws.Context,
+	input *dynamodb.GetItemInput,
+	opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return ddb.GetItem(input)
+}
+
+func (ddb *mockDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	ddb.mutex.Lock()
+	defer ddb.mutex.Unlock()
+	if aws.StringValue(input.TableName) != testTableName {
+		return &dynamodb.PutItemOutput{}, nil
+	}
+	if ddb.putErr != nil {
+		return nil, ddb.putErr
+	}
+	ddb.puts = append(ddb.puts, input.Item)
+	ddb.items = append(ddb.items, input.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (ddb *mockDynamo) PutItemWithContext(ctx aws.Context,
+	input *dynamodb.PutItemInput,
+	opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return ddb.PutItem(input)
+}
+
+func (ddb *mockDynamo) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	ddb.mutex.Lock()
+	defer ddb.mutex.Unlock()
+	output := &dynamodb.DeleteItemOutput{}
+	if aws.StringValue(input.TableName) != testTableName {
+		return output, nil
+	}
+	if ddb.deleteErr != nil {
+		return nil, ddb.deleteErr
+	}
+	if itemIndex := ddb.item(input.Key); itemIndex >= 0 {
+		output.Attributes = ddb.items[itemIndex]
+		ddb.items = append(ddb.items[:itemIndex], ddb.items[itemIndex+1:]...)
+	}
+	ddb.deleted = append(ddb.deleted, itemString(input.Key, ddbAttributeConnectionID))
+	return output, nil
+}
+
+func (ddb *mockDynamo) DeleteItemWithContext(ctx aws.Context,
+	input *dynamodb.DeleteItemInput,
+	opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	return ddb.DeleteItem(input)
+}
+
+func (ddb *mockDynamo) UpdateItemWithContext(ctx aws.Context,
+	input *dynamodb.UpdateItemInput,
+	opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+// QueryPagesWithContext returns the items in the queried bucket of the
+// connection index
+func (ddb *mockDynamo) QueryPagesWithContext(ctx aws.Context,
+	input *dynamodb.QueryInput,
+	fn func(*dynamodb.QueryOutput, bool) bool,
+	opts ...request.Option) error {
+	ddb.mutex.Lock()
+	if ddb.queryErr != nil {
+		ddb.mutex.Unlock()
+		return ddb.queryErr
+	}
+	output := &dynamodb.QueryOutput{}
+	bucket := input.ExpressionAttributeValues[":bucket"]
+	for _, eachItem := range ddb.items {
+		if bucket != nil &&
+			aws.StringValue(eachItem[connections.BucketAttribute].N) == aws.StringValue(bucket.N) {
+			output.Items = append(output.Items, eachItem)
+		}
+	}
+	ddb.mutex.Unlock()
+	fn(output, true)
+	return nil
+}
+
+// ScanPagesWithContext returns every item of the connection index in the
+// first scan segment
+func (ddb *mockDynamo) ScanPagesWithContext(ctx aws.Context,
+	input *dynamodb.ScanInput,
+	fn func(*dynamodb.ScanOutput, bool) bool,
+	opts ...request.Option) error {
+	ddb.mutex.Lock()
+	ddb.scans++
+	if ddb.scanErr != nil {
+		ddb.mutex.Unlock()
+		return ddb.scanErr
+	}
+	output := &dynamodb.ScanOutput{}
+	if aws.Int64Value(input.Segment) == 0 {
+		output.Items = append(output.Items, ddb.items...)
+	}
+	ddb.mutex.Unlock()
+	fn(output, true)
+	return nil
+}
+
+// BatchWriteItemWithContext processes the deletes, leaving the first one
+// unprocessed while unprocessed calls remain
+func (ddb *mockDynamo) BatchWriteItemWithContext(ctx aws.Context,
+	input *dynamodb.BatchWriteItemInput,
+	opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	ddb.mutex.Lock()
+	defer ddb.mutex.Unlock()
+	requests := input.RequestItems[testTableName]
+	ddb.batchSizes = append(ddb.batchSizes, len(requests))
+	output := &dynamodb.BatchWriteItemOutput{}
+	if ddb.unprocessed > 0 && len(requests) != 0 {
+		ddb.unprocessed--
+		output.UnprocessedItems = map[string][]*dynamodb.WriteRequest{
+			testTableName: requests[:1],
+		}
+		requests = requests[1:]
+	}
+	for _, eachRequest := range requests {
+		if eachRequest.DeleteRequest == nil {
+			continue
+		}
+		if itemIndex := ddb.item(eachRequest.DeleteRequest.Key); itemIndex >= 0 {
+			ddb.items = append(ddb.items[:itemIndex], ddb.items[itemIndex+1:]...)
+		}
+		ddb.deleted = append(ddb.deleted,
+			itemString(eachRequest.DeleteRequest.Key, ddbAttributeConnectionID))
+	}
+	return output, nil
+}
+
+// mockManagement is a management API client that records the frames posted
+// to each connection. Posts to gone connections fail with a GoneException,
+// and posts to the connections in fail with a throttle. It's safe for
+// concurrent use.
+type mockManagement struct {
+	apigwManagementIface.ApiGatewayManagementApiAPI
+	mutex sync.Mutex
+	gone  map[string]bool
+	fail  map[string]bool
+	posts map[string][][]byte
+}
+
+func newMockManagement(goneConnectionIDs ...string) *mockManagement {
+	mgmt := &mockManagement{
+		gone:  make(map[string]bool),
+		fail:  make(map[string]bool),
+		posts: make(map[string][][]byte),
+	}
+	for _, eachConnectionID := range goneConnectionIDs {
+		mgmt.gone[eachConnectionID] = true
+	}
+	return mgmt
+}
+
+func (mgmt *mockManagement) PostToConnectionWithContext(ctx aws.Context,
+	input *apigwManagement.PostToConnectionInput,
+	opts ...request.Option) (*apigwManagement.PostToConnectionOutput, error) {
+	mgmt.mutex.Lock()
+	defer mgmt.mutex.Unlock()
+	connectionID := aws.StringValue(input.ConnectionId)
+	if mgmt.gone[connectionID] {
+		return nil, awserr.New(apigwManagement.ErrCodeGoneException, "connection is gone", nil)
+	}
+	if mgmt.fail[connectionID] {
+		return nil, awserr.New(apigwManagement.ErrCodeLimitExceededException, "rate exceeded", nil)
+	}
+	mgmt.posts[connectionID] = append(mgmt.posts[connectionID], input.Data)
+	return &apigwManagement.PostToConnectionOutput{}, nil
+}
+
+// postCount returns the number of frames posted to the connection
+func (mgmt *mockManagement) postCount(connectionID string) int {
+	mgmt.mutex.Lock()
+	defer mgmt.mutex.Unlock()
+	return len(mgmt.posts[connectionID])
+}
+
+// mockSQS is an SQS client that records the messages sent to each queue.
+// Batched messages whose IDs are in fail are reported as failed. It's safe
+// for concurrent use.
+type mockSQS struct {
+	sqsiface.SQSAPI
+	mutex   sync.Mutex
+	fail    map[string]bool
+	batches [][]*sqs.SendMessageBatchRequestEntry
+	sent    []*sqs.SendMessageInput
+}
+
+func newMockSQS(failIDs ...string) *mockSQS {
+	sqsClient := &mockSQS{
+		fail: make(map[string]bool),
+	}
+	for _, eachID := range failIDs {
+		sqsClient.fail[eachID] = true
+	}
+	return sqsClient
+}
+
+func (sqsClient *mockSQS) SendMessageWithContext(ctx aws.Context,
+	input *sqs.SendMessageInput,
+	opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	sqsClient.mutex.Lock()
+	defer sqsClient.mutex.Unlock()
+	sqsClient.sent = append(sqsClient.sent, input)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (sqsClient *mockSQS) SendMessageBatchWithContext(ctx aws.Context,
+	input *sqs.SendMessageBatchInput,
+	opts ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	sqsClient.mutex.Lock()
+	defer sqsClient.mutex.Unlock()
+	sqsClient.batches = append(sqsClient.batches, input.Entries)
+	output := &sqs.SendMessageBatchOutput{}
+	for _, eachEntry := range input.Entries {
+		if sqsClient.fail[aws.StringValue(eachEntry.Id)] {
+			output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{
+				Id:   eachEntry.Id,
+				Code: aws.String("InternalError"),
+			})
+			continue
+		}
+		output.Successful = append(output.Successful, &sqs.SendMessageBatchResultEntry{
+			Id: eachEntry.Id,
+		})
+	}
+	return output, nil
+}
+
+// useMockSQS replaces the SQS client constructor with one that returns the
+// mock for the rest of the test
+func useMockSQS(t *testing.T, sqsClient *mockSQS) {
+	savedSQSClient := newSQSClient
+	t.Cleanup(func() {
+		newSQSClient = savedSQSClient
+	})
+	newSQSClient = func(sess *session.Session) sqsiface.SQSAPI {
+		return sqsClient
+	}
+}
+
+// useMockClients replaces the client constructors with ones that return the
+// mocks for the rest of the test. Tables other than the connection table
+// are disabled in the environment, so the handlers skip them.
+func useMockClients(t *testing.T, ddb *mockDynamo, mgmt *mockManagement) {
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv(envKeyTableName, testTableName)
+	savedConnectionsClient := newConnectionsClient
+	savedDynamoClient := newDynamoClient
+	savedManagementClient := newManagementClient
+	t.Cleanup(func() {
+		newConnectionsClient = savedConnectionsClient
+		newDynamoClient = savedDynamoClient
+		newManagementClient = savedManagementClient
+	})
+	newConnectionsClient = func(sess *session.Session) dynamodbiface.DynamoDBAPI {
+		return ddb
+	}
+	newDynamoClient = func(sess *session.Session) dynamodbiface.DynamoDBAPI {
+		return ddb
+	}
+	newManagementClient = func(sess *session.Session,
+		endpointURL string) apigwManagementIface.ApiGatewayManagementApiAPI {
+		return mgmt
+	}
+}
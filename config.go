@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+)
+
+// configFlags maps each provision-time flag to the environment variable it
+// overrides
+var configFlags = map[string]string{
+	"--stage":                 envKeyStage,
+	"--stageLogLevel":         envKeyStageLogLevel,
+	"--connectionTableName":   envKeyConnectionTableName,
+	"--connectionIDAttribute": envKeyConnectionIDAttribute,
+	"--tableReadCapacity":     envKeyTableReadCapacity,
+	"--tableWriteCapacity":    envKeyTableWriteCapacity,
+}
+
+// stripConfigFlags removes the provision-time flags from args and exports
+// each value as the environment variable it overrides. Sparta owns the rest
+// of the command line. Flags are either --name=value or --name value.
+func stripConfigFlags(args []string) ([]string, error) {
+	remaining := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		flagName, value := args[i], ""
+		hasValue := false
+		if separator := strings.Index(flagName, "="); separator >= 0 {
+			flagName, value, hasValue = flagName[:separator], flagName[separator+1:], true
+		}
+		envKey, isConfigFlag := configFlags[flagName]
+		if !isConfigFlag {
+			remaining = append(remaining, args[i])
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("%s requires a value", flagName)
+			}
+			i++
+			value = args[i]
+		}
+		os.Setenv(envKey, value)
+	}
+	return remaining, nil
+}
+
+// setEnvironment publishes the value in the lambda environment, creating
+// the lambda's options and environment if necessary
+func setEnvironment(lambdaFn *sparta.LambdaAWSInfo, key string, value *gocf.StringExpr) {
+	if lambdaFn.Options == nil {
+		lambdaFn.Options = &sparta.LambdaFunctionOptions{}
+	}
+	if lambdaFn.Options.Environment == nil {
+		lambdaFn.Options.Environment = make(map[string]*gocf.StringExpr)
+	}
+	lambdaFn.Options.Environment[key] = value
+}
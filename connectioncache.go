@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyConnectionCacheTTL is how long, in milliseconds, a warm container
+	// reuses the connection items it read for a broadcast. Zero reads the
+	// connections for every broadcast.
+	envKeyConnectionCacheTTL = "CONNECTION_CACHE_TTL_MS"
+	// maxConnectionCacheTTL bounds how stale a cached connection list can be
+	maxConnectionCacheTTL = 30 * time.Second
+	// The connection changes table holds a single item whose changedAt is
+	// the last time, in epoch milliseconds, that a connection was opened or
+	// its attributes updated
+	envKeyConnectionChangesTableName = "CONNECTION_CHANGES_TABLENAME"
+	connectionChangesResourceName    = "ConnectionChanges"
+	ddbAttributeChangeMarker         = "marker"
+	ddbAttributeChangedAt            = "changedAt"
+	connectionChangesMarker          = "connections"
+)
+
+// connectionCacheKey identifies the fan-out segment that the items were
+// read for
+type connectionCacheKey struct {
+	segment       int64
+	totalSegments int64
+}
+
+// connectionCacheEntry is a segment's connection items and when they were
+// read
+type connectionCacheEntry struct {
+	items  []map[string]*dynamodb.AttributeValue
+	readAt time.Time
+}
+
+// connectionCache holds the connection items of recent broadcasts between
+// warm invocations, so back-to-back broadcasts don't each read the whole
+// connection index. Cached items are bypassed once a connection is opened
+// or its attributes are updated, and a broadcast that finds a gone
+// connection resets the cache. It's safe for concurrent use.
+type connectionCache struct {
+	mutex   sync.Mutex
+	entries map[connectionCacheKey]*connectionCacheEntry
+}
+
+var recentConnections = &connectionCache{
+	entries: make(map[connectionCacheKey]*connectionCacheEntry),
+}
+
+// connectionCacheTTL returns the configured cache TTL
+func connectionCacheTTL() time.Duration {
+	ttlMS, _ := strconv.ParseInt(os.Getenv(envKeyConnectionCacheTTL), 10, 64)
+	ttl := time.Duration(ttlMS) * time.Millisecond
+	if ttl > maxConnectionCacheTTL {
+		return maxConnectionCacheTTL
+	}
+	return ttl
+}
+
+// get returns the segment's cached items, if they were read within the TTL
+// and no connection changed since. Items are bypassed if the change marker,
+// which dynamoClient reads from the stack's account, can't be read.
+func (cache *connectionCache) get(ctx context.Context,
+	dynamoClient dynamodbiface.DynamoDBAPI,
+	segment int64,
+	totalSegments int64) ([]map[string]*dynamodb.AttributeValue, bool) {
+	ttl := connectionCacheTTL()
+	if ttl <= 0 {
+		return nil, false
+	}
+	cache.mutex.Lock()
+	entry, entryExists := cache.entries[connectionCacheKey{segment, totalSegments}]
+	cache.mutex.Unlock()
+	if !entryExists || time.Since(entry.readAt) > ttl {
+		return nil, false
+	}
+	changedAt, changedAtErr := connectionsChangedAt(ctx, dynamoClient)
+	if changedAtErr != nil || !changedAt.Before(entry.readAt) {
+		return nil, false
+	}
+	return entry.items, true
+}
+
+// put caches the items that were read for the segment. readAt is when the
+// read started, so that connections which changed during the read bypass
+// the entry.
+func (cache *connectionCache) put(segment int64,
+	totalSegments int64,
+	readAt time.Time,
+	items []map[string]*dynamodb.AttributeValue) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries[connectionCacheKey{segment, totalSegments}] = &connectionCacheEntry{
+		items:  items,
+		readAt: readAt,
+	}
+}
+
+// reset discards every cached segment
+func (cache *connectionCache) reset() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries = make(map[connectionCacheKey]*connectionCacheEntry)
+}
+
+// connectionChangesKey is the key of the connection change marker
+func connectionChangesKey() map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		ddbAttributeChangeMarker: &dynamodb.AttributeValue{
+			S: aws.String(connectionChangesMarker),
+		},
+	}
+}
+
+// connectionsChangedAt returns when a connection was last opened or had its
+// attributes updated. The connection changes table is in the stack's
+// account, so dynamoClient is the stack's client even when the connection
+// table is in a data account.
+func connectionsChangedAt(ctx context.Context,
+	dynamoClient dynamodbiface.DynamoDBAPI) (time.Time, error) {
+	getItemOutput, getItemErr := dynamoClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(os.Getenv(envKeyConnectionChangesTableName)),
+		Key:       connectionChangesKey(),
+	})
+	if getItemErr != nil {
+		return time.Time{}, getItemErr
+	}
+	changedAtMS := itemNumber(getItemOutput.Item, ddbAttributeChangedAt)
+	return time.Unix(0, changedAtMS*int64(time.Millisecond)), nil
+}
+
+// markConnectionsChanged records that a connection was opened or had its
+// attributes updated, so that warm containers bypass the connection items
+// they cached. Like connectionsChangedAt, it takes the stack's client. It's
+// a no-op unless connections are cached.
+func markConnectionsChanged(ctx context.Context,
+	dynamoClient dynamodbiface.DynamoDBAPI,
+	logger *logrus.Logger) {
+	tableName := os.Getenv(envKeyConnectionChangesTableName)
+	if tableName == "" {
+		return
+	}
+	_, updateItemErr := dynamoClient.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(tableName),
+		Key:              connectionChangesKey(),
+		UpdateExpression: aws.String("SET #changedAt = :changedAt"),
+		ExpressionAttributeNames: map[string]*string{
+			"#changedAt": aws.String(ddbAttributeChangedAt),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":changedAt": &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)),
+			},
+		},
+	})
+	if updateItemErr != nil {
+		logger.WithField("Error", updateItemErr).Warn("Failed to mark connections changed")
+	}
+}
+
+// connectionChangesDecorator provisions the connection changes table, which
+// holds the change marker
+func connectionChangesDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(connectionChangesResourceName, &gocf.DynamoDBTable{
+		AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeChangeMarker),
+				AttributeType: gocf.String("S"),
+			},
+		},
+		KeySchema: &gocf.DynamoDBTableKeySchemaList{
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeChangeMarker),
+				KeyType:       gocf.String("HASH"),
+			},
+		},
+		BillingMode: gocf.String("PAY_PER_REQUEST"),
+	})
+	return nil
+}
+
+// annotateConnectionCache publishes the provision-time
+// CONNECTION_CACHE_TTL_MS in the lambda environment and lets the lambda read
+// and mark the connection changes
+func annotateConnectionCache(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:GetItem",
+				"dynamodb:UpdateItem"},
+			Resource: gocf.GetAtt(connectionChangesResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyConnectionCacheTTL, gocf.String(os.Getenv(envKeyConnectionCacheTTL)))
+	setEnvironment(lambdaFn, envKeyConnectionChangesTableName, gocf.Ref(connectionChangesResourceName).String())
+}
@@ -0,0 +1,240 @@
+package connections
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// redisPageSize is the number of connection items read per MGET
+	redisPageSize = 100
+	// Key prefixes. Each connection item is a JSON string that expires with
+	// the connection lifetime, and the bucket and user sets list the
+	// connection IDs that resolve to items.
+	redisConnectionPrefix = "connection:"
+	redisBucketPrefix     = "bucket:"
+	redisUserPrefix       = "user:"
+)
+
+// RedisStore keeps a copy of the connection items in Redis, for workloads
+// where the connection table's query and write costs dominate. Set members
+// whose items have expired are pruned as they're read, so connections whose
+// $disconnect was dropped don't accumulate.
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore returns a RedisStore that uses the client
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{
+		client: client,
+	}
+}
+
+func redisConnectionKey(connectionID string) string {
+	return redisConnectionPrefix + connectionID
+}
+
+func redisBucketKey(bucket int64) string {
+	return redisBucketPrefix + strconv.FormatInt(bucket, 10)
+}
+
+func redisUserKey(userID string) string {
+	return redisUserPrefix + userID
+}
+
+// itemUserID returns the item's user ID, or the empty string for anonymous
+// connections
+func itemUserID(item map[string]*dynamodb.AttributeValue) string {
+	if item[UserAttribute] == nil || item[UserAttribute].S == nil {
+		return ""
+	}
+	return *item[UserAttribute].S
+}
+
+// Put stores the connection item and adds it to its bucket and user sets
+func (store *RedisStore) Put(ctx aws.Context,
+	connectionID string,
+	item map[string]*dynamodb.AttributeValue) error {
+	value, valueErr := json.Marshal(item)
+	if valueErr != nil {
+		return valueErr
+	}
+	userID := itemUserID(item)
+	_, putErr := store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisConnectionKey(connectionID), value, MaxLifetime)
+		pipe.SAdd(ctx, redisBucketKey(Bucket(connectionID)), connectionID)
+		if userID != "" {
+			pipe.SAdd(ctx, redisUserKey(userID), connectionID)
+			pipe.Expire(ctx, redisUserKey(userID), MaxLifetime)
+		}
+		return nil
+	})
+	return putErr
+}
+
+// Update replaces the stored connection item, keeping its expiry. It's a
+// no-op if the connection isn't stored, so that an update racing the
+// connection's deletion doesn't store it again.
+func (store *RedisStore) Update(ctx aws.Context,
+	connectionID string,
+	item map[string]*dynamodb.AttributeValue) error {
+	value, valueErr := json.Marshal(item)
+	if valueErr != nil {
+		return valueErr
+	}
+	updateErr := store.client.SetXX(ctx, redisConnectionKey(connectionID), value, redis.KeepTTL).Err()
+	if updateErr == redis.Nil {
+		return nil
+	}
+	return updateErr
+}
+
+// Delete removes the connection item and its set memberships
+func (store *RedisStore) Delete(ctx aws.Context, connectionID string) error {
+	items, _, itemsErr := store.members(ctx, []string{connectionID})
+	if itemsErr != nil {
+		return itemsErr
+	}
+	_, deleteErr := store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, redisConnectionKey(connectionID))
+		pipe.SRem(ctx, redisBucketKey(Bucket(connectionID)), connectionID)
+		for _, eachItem := range items {
+			if userID := itemUserID(eachItem); userID != "" {
+				pipe.SRem(ctx, redisUserKey(userID), connectionID)
+			}
+		}
+		return nil
+	})
+	return deleteErr
+}
+
+// members returns the unexpired items for the connection IDs, and the IDs
+// whose items have expired
+func (store *RedisStore) members(ctx aws.Context,
+	connectionIDs []string) ([]map[string]*dynamodb.AttributeValue, []interface{}, error) {
+	if len(connectionIDs) == 0 {
+		return nil, nil, nil
+	}
+	keys := make([]string, len(connectionIDs))
+	for eachIndex, eachConnectionID := range connectionIDs {
+		keys[eachIndex] = redisConnectionKey(eachConnectionID)
+	}
+	values, valuesErr := store.client.MGet(ctx, keys...).Result()
+	if valuesErr != nil {
+		return nil, nil, valuesErr
+	}
+	var items []map[string]*dynamodb.AttributeValue
+	var expired []interface{}
+	for eachIndex, eachValue := range values {
+		value, isString := eachValue.(string)
+		if !isString {
+			expired = append(expired, connectionIDs[eachIndex])
+			continue
+		}
+		var item map[string]*dynamodb.AttributeValue
+		unmarshalErr := json.Unmarshal([]byte(value), &item)
+		if unmarshalErr != nil {
+			return nil, nil, unmarshalErr
+		}
+		items = append(items, item)
+	}
+	return items, expired, nil
+}
+
+// setPages calls pageFn with each page of unexpired items in the set,
+// pruning expired members. Iteration stops if pageFn returns false.
+func (store *RedisStore) setPages(ctx aws.Context,
+	setKey string,
+	pageFn func(items []map[string]*dynamodb.AttributeValue) bool) (bool, error) {
+	connectionIDs, membersErr := store.client.SMembers(ctx, setKey).Result()
+	if membersErr != nil {
+		return false, membersErr
+	}
+	for start := 0; start < len(connectionIDs); start += redisPageSize {
+		end := start + redisPageSize
+		if end > len(connectionIDs) {
+			end = len(connectionIDs)
+		}
+		items, expired, itemsErr := store.members(ctx, connectionIDs[start:end])
+		if itemsErr != nil {
+			return false, itemsErr
+		}
+		if len(expired) != 0 {
+			pruneErr := store.client.SRem(ctx, setKey, expired...).Err()
+			if pruneErr != nil {
+				return false, pruneErr
+			}
+		}
+		if len(items) != 0 && !pageFn(items) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// QueryPages calls pageFn with each page of unexpired connection items in the
+// segment's buckets. Iteration stops if pageFn returns false.
+func (store *RedisStore) QueryPages(ctx aws.Context,
+	segment int64,
+	totalSegments int64,
+	pageFn func(items []map[string]*dynamodb.AttributeValue) bool) error {
+	for _, eachBucket := range SegmentBuckets(segment, totalSegments) {
+		proceed, pagesErr := store.setPages(ctx, redisBucketKey(eachBucket), pageFn)
+		if pagesErr != nil {
+			return pagesErr
+		}
+		if !proceed {
+			return nil
+		}
+	}
+	return nil
+}
+
+// UserConnections returns the unexpired connection items for the user
+func (store *RedisStore) UserConnections(ctx aws.Context,
+	userID string) ([]map[string]*dynamodb.AttributeValue, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	_, pagesErr := store.setPages(ctx,
+		redisUserKey(userID),
+		func(page []map[string]*dynamodb.AttributeValue) bool {
+			items = append(items, page...)
+			return true
+		})
+	if pagesErr != nil {
+		return nil, pagesErr
+	}
+	return items, nil
+}
+
+// OnlineUsers returns the distinct user IDs with unexpired connections, from
+// the connection items in every bucket. At most limit users are returned, and
+// truncated is true if there are more; a limit less than 1 returns every
+// user.
+func (store *RedisStore) OnlineUsers(ctx aws.Context,
+	limit int) (users []string, truncated bool, err error) {
+	seen := make(map[string]bool)
+	queryErr := store.QueryPages(ctx, 0, 1, func(items []map[string]*dynamodb.AttributeValue) bool {
+		for _, eachItem := range items {
+			userID := itemUserID(eachItem)
+			if userID == "" || seen[userID] {
+				continue
+			}
+			if limit > 0 && len(users) >= limit {
+				truncated = true
+				return false
+			}
+			seen[userID] = true
+			users = append(users, userID)
+		}
+		return true
+	})
+	if queryErr != nil {
+		return nil, false, queryErr
+	}
+	return users, truncated, nil
+}
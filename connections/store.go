@@ -0,0 +1,274 @@
+// Package connections is the broadcast access path for the connection table.
+// Every connection item carries a fixed hash bucket attribute that keys a
+// global secondary index, so broadcasts Query each bucket's partition rather
+// than scanning the entire table. A second index finds the connections that
+// belong to a user. Items expire with the API Gateway connection lifetime, so
+// connections whose $disconnect was dropped don't accumulate.
+package connections
+
+import (
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/mweagle/SpartaWebSocket/connectiontable"
+)
+
+const (
+	// BucketAttribute is the numeric hash bucket attribute
+	BucketAttribute = "bucket"
+	// IndexName is the GSI keyed by bucket and connection ID
+	IndexName = "BroadcastIndex"
+	// Buckets is the number of hash buckets. Changing it strands existing
+	// items in buckets that are no longer queried, so it's fixed.
+	Buckets = 16
+	// UserAttribute is the optional user ID attribute
+	UserAttribute = "userID"
+	// UserIndexName is the GSI keyed by user ID
+	UserIndexName = "ByUser"
+	// ExpiresAtAttribute is the TTL attribute, in epoch seconds
+	ExpiresAtAttribute = "expiresAt"
+	// MaxLifetime is the API Gateway WebSocket connection duration limit
+	MaxLifetime = 2 * time.Hour
+)
+
+// unexpiredFilter excludes items that have expired but that DynamoDB hasn't
+// deleted yet, which may take up to a couple of days
+const unexpiredFilter = "attribute_not_exists(#expiresAt) OR #expiresAt > :now"
+
+// Bucket returns the hash bucket for the connection
+func Bucket(connectionID string) int64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(connectionID))
+	return int64(hash.Sum32() % Buckets)
+}
+
+// BucketValue returns the bucket attribute value to store with the
+// connection item
+func BucketValue(connectionID string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(Bucket(connectionID), 10)),
+	}
+}
+
+// ExpiresAtValue returns the TTL attribute value to store with a connection
+// item created at connectedAt
+func ExpiresAtValue(connectedAt time.Time) *dynamodb.AttributeValue {
+	return epochValue(connectedAt.Add(MaxLifetime))
+}
+
+// epochValue returns the time as a numeric epoch seconds value
+func epochValue(at time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(at.Unix(), 10)),
+	}
+}
+
+// SegmentBuckets returns the buckets delivered by the segment. Buckets are
+// dealt to segments round robin; a totalSegments value less than 2 returns
+// every bucket.
+func SegmentBuckets(segment int64, totalSegments int64) []int64 {
+	if totalSegments < 2 {
+		segment, totalSegments = 0, 1
+	}
+	var buckets []int64
+	for bucket := segment; bucket < Buckets; bucket += totalSegments {
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
+// TableOptions declares the bucket and user attributes and their indexes on
+// the connection table and enables TTL. The indexes project every attribute
+// so that deliveries don't need to read the table.
+func TableOptions(connectionIDKey string) []connectiontable.Option {
+	return []connectiontable.Option{
+		connectiontable.WithAttribute(BucketAttribute, "N"),
+		connectiontable.WithGlobalSecondaryIndex(IndexName,
+			BucketAttribute,
+			connectionIDKey,
+			dynamodb.ProjectionTypeAll),
+		connectiontable.WithAttribute(UserAttribute, "S"),
+		connectiontable.WithGlobalSecondaryIndex(UserIndexName,
+			UserAttribute,
+			"",
+			dynamodb.ProjectionTypeAll),
+		connectiontable.WithTimeToLive(ExpiresAtAttribute),
+	}
+}
+
+// Index is the broadcast access path to the connection items. Store queries
+// the connection table's indexes; RedisStore reads a copy of the items kept
+// in Redis.
+type Index interface {
+	// QueryPages calls pageFn with each page of unexpired connection items
+	// in the segment's buckets. Iteration stops if pageFn returns false.
+	QueryPages(ctx aws.Context,
+		segment int64,
+		totalSegments int64,
+		pageFn func(items []map[string]*dynamodb.AttributeValue) bool) error
+	// UserConnections returns the unexpired connection items for the user
+	UserConnections(ctx aws.Context, userID string) ([]map[string]*dynamodb.AttributeValue, error)
+	// OnlineUsers returns at most limit distinct user IDs with unexpired
+	// connections, and whether there are more
+	OnlineUsers(ctx aws.Context, limit int) (users []string, truncated bool, err error)
+}
+
+// Store queries the connection table indexes
+type Store struct {
+	client    dynamodbiface.DynamoDBAPI
+	tableName string
+}
+
+// NewStore returns a Store for the table
+func NewStore(client dynamodbiface.DynamoDBAPI, tableName string) *Store {
+	return &Store{
+		client:    client,
+		tableName: tableName,
+	}
+}
+
+// QueryPages calls pageFn with each page of unexpired connection items in the
+// segment's buckets. Iteration stops if pageFn returns false.
+func (store *Store) QueryPages(ctx aws.Context,
+	segment int64,
+	totalSegments int64,
+	pageFn func(items []map[string]*dynamodb.AttributeValue) bool) error {
+	for _, eachBucket := range SegmentBuckets(segment, totalSegments) {
+		proceed := true
+		queryErr := store.client.QueryPagesWithContext(ctx,
+			&dynamodb.QueryInput{
+				TableName:              aws.String(store.tableName),
+				IndexName:              aws.String(IndexName),
+				KeyConditionExpression: aws.String("#bucket = :bucket"),
+				FilterExpression:       aws.String(unexpiredFilter),
+				ExpressionAttributeNames: map[string]*string{
+					"#bucket":    aws.String(BucketAttribute),
+					"#expiresAt": aws.String(ExpiresAtAttribute),
+				},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":bucket": {
+						N: aws.String(strconv.FormatInt(eachBucket, 10)),
+					},
+					":now": epochValue(time.Now()),
+				},
+			},
+			func(output *dynamodb.QueryOutput, lastPage bool) bool {
+				proceed = pageFn(output.Items)
+				return proceed
+			})
+		if queryErr != nil {
+			return queryErr
+		}
+		if !proceed {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ScanPages calls pageFn with each page of unexpired connection items in the
+// parallel scan segment of the BroadcastIndex. Unlike QueryPages, the
+// segments are independent of the buckets, so concurrent segment scans read
+// the index in parallel. Iteration stops if pageFn returns false.
+func (store *Store) ScanPages(ctx aws.Context,
+	segment int64,
+	totalSegments int64,
+	pageFn func(items []map[string]*dynamodb.AttributeValue) bool) error {
+	return store.client.ScanPagesWithContext(ctx,
+		&dynamodb.ScanInput{
+			TableName:        aws.String(store.tableName),
+			IndexName:        aws.String(IndexName),
+			Segment:          aws.Int64(segment),
+			TotalSegments:    aws.Int64(totalSegments),
+			FilterExpression: aws.String(unexpiredFilter),
+			ExpressionAttributeNames: map[string]*string{
+				"#expiresAt": aws.String(ExpiresAtAttribute),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now": epochValue(time.Now()),
+			},
+		},
+		func(output *dynamodb.ScanOutput, lastPage bool) bool {
+			return pageFn(output.Items)
+		})
+}
+
+// UserConnections returns the unexpired connection items for the user
+func (store *Store) UserConnections(ctx aws.Context,
+	userID string) ([]map[string]*dynamodb.AttributeValue, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	queryErr := store.client.QueryPagesWithContext(ctx,
+		&dynamodb.QueryInput{
+			TableName:              aws.String(store.tableName),
+			IndexName:              aws.String(UserIndexName),
+			KeyConditionExpression: aws.String("#userID = :userID"),
+			FilterExpression:       aws.String(unexpiredFilter),
+			ExpressionAttributeNames: map[string]*string{
+				"#userID":    aws.String(UserAttribute),
+				"#expiresAt": aws.String(ExpiresAtAttribute),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":userID": {
+					S: aws.String(userID),
+				},
+				":now": epochValue(time.Now()),
+			},
+		},
+		func(output *dynamodb.QueryOutput, lastPage bool) bool {
+			items = append(items, output.Items...)
+			return true
+		})
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	return items, nil
+}
+
+// OnlineUsers returns the distinct user IDs with unexpired connections, from
+// a scan of the sparse user index. At most limit users are returned, and
+// truncated is true if there are more; a limit less than 1 returns every
+// user.
+func (store *Store) OnlineUsers(ctx aws.Context,
+	limit int) (users []string, truncated bool, err error) {
+	seen := make(map[string]bool)
+	scanErr := store.client.ScanPagesWithContext(ctx,
+		&dynamodb.ScanInput{
+			TableName:            aws.String(store.tableName),
+			IndexName:            aws.String(UserIndexName),
+			ProjectionExpression: aws.String("#userID"),
+			FilterExpression:     aws.String(unexpiredFilter),
+			ExpressionAttributeNames: map[string]*string{
+				"#userID":    aws.String(UserAttribute),
+				"#expiresAt": aws.String(ExpiresAtAttribute),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now": epochValue(time.Now()),
+			},
+		},
+		func(output *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, eachItem := range output.Items {
+				if eachItem[UserAttribute] == nil || eachItem[UserAttribute].S == nil {
+					continue
+				}
+				userID := *eachItem[UserAttribute].S
+				if seen[userID] {
+					continue
+				}
+				if limit > 0 && len(users) >= limit {
+					truncated = true
+					return false
+				}
+				seen[userID] = true
+				users = append(users, userID)
+			}
+			return true
+		})
+	if scanErr != nil {
+		return nil, false, scanErr
+	}
+	return users, truncated, nil
+}
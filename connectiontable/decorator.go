@@ -0,0 +1,468 @@
+// Package connectiontable provisions the DynamoDB table that tracks open
+// websocket connections
+package connectiontable
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ResourceName is the logical name of the connection table
+	ResourceName = "ConnectionTable"
+	// Capacity dimensions
+	readDimension       = "dynamodb:table:ReadCapacityUnits"
+	writeDimension      = "dynamodb:table:WriteCapacityUnits"
+	indexReadDimension  = "dynamodb:index:ReadCapacityUnits"
+	indexWriteDimension = "dynamodb:index:WriteCapacityUnits"
+	// Defaults for provisioned capacity auto scaling
+	defaultMaxCapacityMultiple = 20
+	defaultTargetUtilization   = 70
+	defaultScaleInCooldown     = 60
+	defaultScaleOutCooldown    = 60
+)
+
+// AutoScaling configures target tracking for provisioned capacity. Global
+// secondary indexes scale between the same bounds as the table.
+type AutoScaling struct {
+	// MaxReadCapacityUnits is the upper bound for read capacity
+	MaxReadCapacityUnits int64
+	// MaxWriteCapacityUnits is the upper bound for write capacity
+	MaxWriteCapacityUnits int64
+	// TargetUtilization is the consumed capacity percentage to track
+	TargetUtilization int64
+	// ScaleInCooldown is the number of seconds between scale in activities
+	ScaleInCooldown int64
+	// ScaleOutCooldown is the number of seconds between scale out activities
+	ScaleOutCooldown int64
+}
+
+// Decorator provisions the connection table and publishes its name to the
+// annotated lambdas
+type Decorator struct {
+	envTableNameKey    string
+	connectionIDKey    string
+	readCapacityUnits  int64
+	writeCapacityUnits int64
+	tableName          string
+	streamViewType     string
+	ttlAttribute       string
+	attributes         map[string]string
+	indexes            []globalSecondaryIndex
+	tags               map[string]string
+	deletionProtection bool
+	externalTableARN   string
+	globalTableName    string
+	replicaRegions     []string
+	globalTablePrimary bool
+	// AutoScaling scales provisioned capacity. It's ignored for on-demand
+	// tables and may be set to nil to keep the capacity fixed.
+	AutoScaling *AutoScaling
+}
+
+// NewDecorator returns a decorator for a table keyed by connectionIDKey.
+// Zero read and write capacity provisions an on-demand table. Provisioned
+// tables auto scale up to twenty times the initial capacity by default.
+func NewDecorator(envTableNameKey string,
+	connectionIDKey string,
+	readCapacityUnits int64,
+	writeCapacityUnits int64,
+	options ...Option) (*Decorator, error) {
+	if envTableNameKey == "" || connectionIDKey == "" {
+		return nil, fmt.Errorf("connection table environment key and connection ID key are required")
+	}
+	if (readCapacityUnits == 0) != (writeCapacityUnits == 0) {
+		return nil, fmt.Errorf("read and write capacity must both be provisioned or both be zero")
+	}
+	decorator := &Decorator{
+		envTableNameKey:    envTableNameKey,
+		connectionIDKey:    connectionIDKey,
+		readCapacityUnits:  readCapacityUnits,
+		writeCapacityUnits: writeCapacityUnits,
+		attributes: map[string]string{
+			connectionIDKey: "S",
+		},
+		tags: make(map[string]string),
+		AutoScaling: &AutoScaling{
+			MaxReadCapacityUnits:  readCapacityUnits * defaultMaxCapacityMultiple,
+			MaxWriteCapacityUnits: writeCapacityUnits * defaultMaxCapacityMultiple,
+			TargetUtilization:     defaultTargetUtilization,
+			ScaleInCooldown:       defaultScaleInCooldown,
+			ScaleOutCooldown:      defaultScaleOutCooldown,
+		},
+	}
+	for _, eachOption := range options {
+		eachOption(decorator)
+	}
+	for _, eachIndex := range decorator.indexes {
+		for _, eachKey := range []string{eachIndex.hashKey, eachIndex.rangeKey} {
+			if _, exists := decorator.attributes[eachKey]; eachKey != "" && !exists {
+				return nil, fmt.Errorf("index %s key %s is not a declared attribute",
+					eachIndex.name,
+					eachKey)
+			}
+		}
+	}
+	return decorator, nil
+}
+
+// TableName returns the connection table name
+func (decorator *Decorator) TableName() *gocf.StringExpr {
+	if decorator.externalTableARN != "" {
+		return gocf.String(decorator.externalTableARN[strings.LastIndex(decorator.externalTableARN, "/")+1:])
+	}
+	if decorator.globalTableName != "" {
+		return gocf.String(decorator.globalTableName)
+	}
+	return gocf.Ref(ResourceName).String()
+}
+
+// tableARN returns the connection table ARN
+func (decorator *Decorator) tableARN() gocf.Stringable {
+	if decorator.externalTableARN != "" {
+		return gocf.String(decorator.externalTableARN)
+	}
+	if decorator.globalTableName != "" && !decorator.globalTablePrimary {
+		return gocf.Join("",
+			gocf.String("arn:"),
+			gocf.Ref("AWS::Partition"),
+			gocf.String(":dynamodb:"),
+			gocf.Ref("AWS::Region"),
+			gocf.String(":"),
+			gocf.Ref("AWS::AccountId"),
+			gocf.String(":table/"+decorator.globalTableName))
+	}
+	return gocf.GetAtt(ResourceName, "Arn")
+}
+
+// provisioned returns true if the table uses provisioned capacity
+func (decorator *Decorator) provisioned() bool {
+	return decorator.readCapacityUnits != 0
+}
+
+// AnnotateLambdas grants the lambdas access to the table and publishes the
+// table name in their environment
+func (decorator *Decorator) AnnotateLambdas(lambdaFns []*sparta.LambdaAWSInfo) error {
+	for _, eachLambda := range lambdaFns {
+		if eachLambda == nil {
+			return fmt.Errorf("nil lambda function")
+		}
+		eachLambda.RoleDefinition.Privileges = append(eachLambda.RoleDefinition.Privileges,
+			sparta.IAMRolePrivilege{
+				Actions: []string{"dynamodb:GetItem",
+					"dynamodb:PutItem",
+					"dynamodb:UpdateItem",
+					"dynamodb:DeleteItem",
+					"dynamodb:BatchWriteItem",
+					"dynamodb:Scan",
+					"dynamodb:Query"},
+				Resource: decorator.tableARN(),
+			})
+		if len(decorator.indexes) != 0 ||
+			decorator.externalTableARN != "" ||
+			decorator.globalTableName != "" {
+			eachLambda.RoleDefinition.Privileges = append(eachLambda.RoleDefinition.Privileges,
+				sparta.IAMRolePrivilege{
+					Actions: []string{"dynamodb:Query", "dynamodb:Scan"},
+					Resource: gocf.Join("",
+						decorator.tableARN(),
+						gocf.String("/index/*")),
+				})
+		}
+		if eachLambda.Options == nil {
+			eachLambda.Options = &sparta.LambdaFunctionOptions{}
+		}
+		if eachLambda.Options.Environment == nil {
+			eachLambda.Options.Environment = make(map[string]*gocf.StringExpr)
+		}
+		eachLambda.Options.Environment[decorator.envTableNameKey] = decorator.TableName()
+	}
+	return nil
+}
+
+// DecorateService provisions the table and any auto scaling resources for
+// the table and its indexes
+func (decorator *Decorator) DecorateService(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	if decorator.externalTableARN != "" {
+		return nil
+	}
+	if decorator.globalTableName != "" {
+		if !decorator.globalTablePrimary {
+			return nil
+		}
+		globalTableResource := template.AddResource(ResourceName, decorator.globalTable())
+		if decorator.deletionProtection {
+			globalTableResource.DeletionPolicy = "Retain"
+		}
+		return nil
+	}
+	table := decorator.table()
+	tableResource := template.AddResource(ResourceName, table)
+	if decorator.deletionProtection {
+		tableResource.DeletionPolicy = "Retain"
+	}
+	if !decorator.provisioned() || decorator.AutoScaling == nil {
+		return nil
+	}
+	scalingErr := decorator.decorateScaling(template,
+		ResourceName,
+		gocf.Join("/",
+			gocf.String("table"),
+			gocf.Ref(ResourceName)),
+		readDimension,
+		writeDimension)
+	if scalingErr != nil {
+		return scalingErr
+	}
+	for _, eachIndex := range decorator.indexes {
+		scalingErr = decorator.decorateScaling(template,
+			ResourceName+logicalName(eachIndex.name),
+			gocf.Join("/",
+				gocf.String("table"),
+				gocf.Ref(ResourceName),
+				gocf.String("index"),
+				gocf.String(eachIndex.name)),
+			indexReadDimension,
+			indexWriteDimension)
+		if scalingErr != nil {
+			return scalingErr
+		}
+	}
+	return nil
+}
+
+// decorateScaling adds the read and write auto scaling resources for the
+// table or index resource ID
+func (decorator *Decorator) decorateScaling(template *gocf.Template,
+	prefix string,
+	resourceID *gocf.StringExpr,
+	readScalableDimension string,
+	writeScalableDimension string) error {
+	scalingErr := decorator.AutoScaling.decorate(template,
+		prefix+"Read",
+		resourceID,
+		readScalableDimension,
+		"DynamoDBReadCapacityUtilization",
+		decorator.readCapacityUnits,
+		decorator.AutoScaling.MaxReadCapacityUnits)
+	if scalingErr != nil {
+		return scalingErr
+	}
+	return decorator.AutoScaling.decorate(template,
+		prefix+"Write",
+		resourceID,
+		writeScalableDimension,
+		"DynamoDBWriteCapacityUtilization",
+		decorator.writeCapacityUnits,
+		decorator.AutoScaling.MaxWriteCapacityUnits)
+}
+
+// logicalName returns the alphanumeric characters of the index name, which
+// may also contain '_', '-', and '.'
+func logicalName(indexName string) string {
+	return strings.Map(func(char rune) rune {
+		if (char >= 'a' && char <= 'z') ||
+			(char >= 'A' && char <= 'Z') ||
+			(char >= '0' && char <= '9') {
+			return char
+		}
+		return -1
+	}, indexName)
+}
+
+// table returns the table resource
+func (decorator *Decorator) table() *gocf.DynamoDBTable {
+	// Sort the attributes so the template is stable between builds
+	attributeNames := make([]string, 0, len(decorator.attributes))
+	for eachName := range decorator.attributes {
+		attributeNames = append(attributeNames, eachName)
+	}
+	sort.Strings(attributeNames)
+	attributeDefinitions := gocf.DynamoDBTableAttributeDefinitionList{}
+	for _, eachName := range attributeNames {
+		attributeDefinitions = append(attributeDefinitions, gocf.DynamoDBTableAttributeDefinition{
+			AttributeName: gocf.String(eachName),
+			AttributeType: gocf.String(decorator.attributes[eachName]),
+		})
+	}
+	table := &gocf.DynamoDBTable{
+		AttributeDefinitions: &attributeDefinitions,
+		KeySchema:            keySchema(decorator.connectionIDKey, ""),
+	}
+	if decorator.tableName != "" {
+		table.TableName = gocf.String(decorator.tableName)
+	}
+	var throughput *gocf.DynamoDBTableProvisionedThroughput
+	if decorator.provisioned() {
+		throughput = &gocf.DynamoDBTableProvisionedThroughput{
+			ReadCapacityUnits:  gocf.Integer(decorator.readCapacityUnits),
+			WriteCapacityUnits: gocf.Integer(decorator.writeCapacityUnits),
+		}
+		table.ProvisionedThroughput = throughput
+	} else {
+		table.BillingMode = gocf.String("PAY_PER_REQUEST")
+	}
+	if len(decorator.indexes) != 0 {
+		indexes := gocf.DynamoDBTableGlobalSecondaryIndexList{}
+		for _, eachIndex := range decorator.indexes {
+			indexes = append(indexes, gocf.DynamoDBTableGlobalSecondaryIndex{
+				IndexName: gocf.String(eachIndex.name),
+				KeySchema: keySchema(eachIndex.hashKey, eachIndex.rangeKey),
+				Projection: &gocf.DynamoDBTableProjection{
+					ProjectionType: gocf.String(eachIndex.projectionType),
+				},
+				ProvisionedThroughput: throughput,
+			})
+		}
+		table.GlobalSecondaryIndexes = &indexes
+	}
+	if decorator.streamViewType != "" {
+		table.StreamSpecification = &gocf.DynamoDBTableStreamSpecification{
+			StreamViewType: gocf.String(decorator.streamViewType),
+		}
+	}
+	if decorator.ttlAttribute != "" {
+		table.TimeToLiveSpecification = &gocf.DynamoDBTableTimeToLiveSpecification{
+			AttributeName: gocf.String(decorator.ttlAttribute),
+			Enabled:       gocf.Bool(true),
+		}
+	}
+	if len(decorator.tags) != 0 {
+		tagKeys := make([]string, 0, len(decorator.tags))
+		for eachKey := range decorator.tags {
+			tagKeys = append(tagKeys, eachKey)
+		}
+		sort.Strings(tagKeys)
+		tags := gocf.TagList{}
+		for _, eachKey := range tagKeys {
+			tags = append(tags, gocf.Tag{
+				Key:   gocf.String(eachKey),
+				Value: gocf.String(decorator.tags[eachKey]),
+			})
+		}
+		table.Tags = &tags
+	}
+	return table
+}
+
+// globalTable returns the global table resource, with the same attributes,
+// indexes, and TTL as the regional table
+func (decorator *Decorator) globalTable() *gocf.DynamoDBGlobalTable {
+	table := decorator.table()
+	attributeDefinitions := gocf.DynamoDBGlobalTableAttributeDefinitionList{}
+	for _, eachDefinition := range *table.AttributeDefinitions {
+		attributeDefinitions = append(attributeDefinitions, gocf.DynamoDBGlobalTableAttributeDefinition{
+			AttributeName: eachDefinition.AttributeName,
+			AttributeType: eachDefinition.AttributeType,
+		})
+	}
+	globalTable := &gocf.DynamoDBGlobalTable{
+		TableName:            gocf.String(decorator.globalTableName),
+		AttributeDefinitions: &attributeDefinitions,
+		KeySchema:            globalKeySchema(table.KeySchema),
+		BillingMode:          gocf.String("PAY_PER_REQUEST"),
+		StreamSpecification: &gocf.DynamoDBGlobalTableStreamSpecification{
+			StreamViewType: gocf.String(decorator.streamViewType),
+		},
+	}
+	if table.GlobalSecondaryIndexes != nil {
+		indexes := gocf.DynamoDBGlobalTableGlobalSecondaryIndexList{}
+		for _, eachIndex := range *table.GlobalSecondaryIndexes {
+			indexes = append(indexes, gocf.DynamoDBGlobalTableGlobalSecondaryIndex{
+				IndexName: eachIndex.IndexName,
+				KeySchema: globalKeySchema(eachIndex.KeySchema),
+				Projection: &gocf.DynamoDBGlobalTableProjection{
+					ProjectionType: eachIndex.Projection.ProjectionType,
+				},
+			})
+		}
+		globalTable.GlobalSecondaryIndexes = &indexes
+	}
+	if table.TimeToLiveSpecification != nil {
+		globalTable.TimeToLiveSpecification = &gocf.DynamoDBGlobalTableTimeToLiveSpecification{
+			AttributeName: table.TimeToLiveSpecification.AttributeName,
+			Enabled:       table.TimeToLiveSpecification.Enabled,
+		}
+	}
+	replicas := gocf.DynamoDBGlobalTableReplicaSpecificationList{}
+	for _, eachRegion := range decorator.replicaRegions {
+		replicas = append(replicas, gocf.DynamoDBGlobalTableReplicaSpecification{
+			Region: gocf.String(eachRegion),
+			Tags:   table.Tags,
+		})
+	}
+	globalTable.Replicas = &replicas
+	return globalTable
+}
+
+// globalKeySchema returns the global table form of the key schema
+func globalKeySchema(schema *gocf.DynamoDBTableKeySchemaList) *gocf.DynamoDBGlobalTableKeySchemaList {
+	globalSchema := gocf.DynamoDBGlobalTableKeySchemaList{}
+	for _, eachKey := range *schema {
+		globalSchema = append(globalSchema, gocf.DynamoDBGlobalTableKeySchema{
+			AttributeName: eachKey.AttributeName,
+			KeyType:       eachKey.KeyType,
+		})
+	}
+	return &globalSchema
+}
+
+// decorate adds the scalable target and target tracking policy, named with
+// the prefix, for one capacity dimension of the resource ID
+func (scaling *AutoScaling) decorate(template *gocf.Template,
+	prefix string,
+	resourceID *gocf.StringExpr,
+	dimension string,
+	metricType string,
+	minCapacity int64,
+	maxCapacity int64) error {
+	if maxCapacity < minCapacity {
+		return fmt.Errorf("%s auto scaling maximum %d is less than the provisioned capacity %d",
+			prefix,
+			maxCapacity,
+			minCapacity)
+	}
+	targetName := prefix + "ScalableTarget"
+	template.AddResource(targetName, &gocf.ApplicationAutoScalingScalableTarget{
+		MinCapacity: gocf.Integer(minCapacity),
+		MaxCapacity: gocf.Integer(maxCapacity),
+		ResourceID:  resourceID,
+		RoleARN: gocf.Join("",
+			gocf.String("arn:"),
+			gocf.Ref("AWS::Partition"),
+			gocf.String(":iam::"),
+			gocf.Ref("AWS::AccountId"),
+			gocf.String(":role/aws-service-role/dynamodb.application-autoscaling.amazonaws.com/"),
+			gocf.String("AWSServiceRoleForApplicationAutoScaling_DynamoDBTable")),
+		ScalableDimension: gocf.String(dimension),
+		ServiceNamespace:  gocf.String("dynamodb"),
+	})
+	template.AddResource(prefix+"ScalingPolicy", &gocf.ApplicationAutoScalingScalingPolicy{
+		PolicyName:      gocf.String(prefix + "ScalingPolicy"),
+		PolicyType:      gocf.String("TargetTrackingScaling"),
+		ScalingTargetID: gocf.Ref(targetName).String(),
+		TargetTrackingScalingPolicyConfiguration: &gocf.ApplicationAutoScalingScalingPolicyTargetTrackingScalingPolicyConfiguration{
+			TargetValue:      gocf.Integer(scaling.TargetUtilization),
+			ScaleInCooldown:  gocf.Integer(scaling.ScaleInCooldown),
+			ScaleOutCooldown: gocf.Integer(scaling.ScaleOutCooldown),
+			PredefinedMetricSpecification: &gocf.ApplicationAutoScalingScalingPolicyPredefinedMetricSpecification{
+				PredefinedMetricType: gocf.String(metricType),
+			},
+		},
+	})
+	return nil
+}
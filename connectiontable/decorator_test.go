@@ -0,0 +1,54 @@
+package connectiontable
+
+import (
+	"testing"
+
+	sparta "github.com/mweagle/Sparta"
+)
+
+// handlerActions are the connection table calls that the handlers make,
+// including the batched deletes of gone connections
+var handlerActions = []string{"dynamodb:GetItem",
+	"dynamodb:PutItem",
+	"dynamodb:UpdateItem",
+	"dynamodb:DeleteItem",
+	"dynamodb:BatchWriteItem",
+	"dynamodb:Scan",
+	"dynamodb:Query"}
+
+func TestAnnotateLambdasGrants(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{"provisioned", nil},
+		{"external", []Option{WithExternalTable("arn:aws:dynamodb:us-east-1:123456789012:table/Connections")}},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			decorator, decoratorErr := NewDecorator("CONNECTIONS_TABLENAME", "connectionID", 5, 5, eachTest.options...)
+			if decoratorErr != nil {
+				t.Fatalf("NewDecorator failed: %s", decoratorErr)
+			}
+			lambdaFn := &sparta.LambdaAWSInfo{
+				RoleDefinition: &sparta.IAMRoleDefinition{},
+			}
+			annotateErr := decorator.AnnotateLambdas([]*sparta.LambdaAWSInfo{lambdaFn})
+			if annotateErr != nil {
+				t.Fatalf("AnnotateLambdas failed: %s", annotateErr)
+			}
+			granted := make(map[string]bool)
+			for _, eachAction := range lambdaFn.RoleDefinition.Privileges[0].Actions {
+				granted[eachAction] = true
+			}
+			for _, eachAction := range handlerActions {
+				if !granted[eachAction] {
+					t.Errorf("Table grant is missing %s", eachAction)
+				}
+			}
+			if lambdaFn.Options.Environment["CONNECTIONS_TABLENAME"] == nil {
+				t.Errorf("Table name isn't published in the environment")
+			}
+		})
+	}
+}
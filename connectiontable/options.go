@@ -0,0 +1,133 @@
+package connectiontable
+
+import (
+	gocf "github.com/mweagle/go-cloudformation"
+)
+
+// Option customizes the provisioned table
+type Option func(decorator *Decorator)
+
+// globalSecondaryIndex is a GSI requested by WithGlobalSecondaryIndex
+type globalSecondaryIndex struct {
+	name           string
+	hashKey        string
+	rangeKey       string
+	projectionType string
+}
+
+// WithTableName sets the physical name of the provisioned table. It's
+// ignored by global and external tables, which are already named.
+func WithTableName(tableName string) Option {
+	return func(decorator *Decorator) {
+		decorator.tableName = tableName
+	}
+}
+
+// WithStream enables the table stream with the given view type (eg,
+// NEW_AND_OLD_IMAGES)
+func WithStream(streamViewType string) Option {
+	return func(decorator *Decorator) {
+		decorator.streamViewType = streamViewType
+	}
+}
+
+// WithAttribute declares a key attribute used by a secondary index.
+// attributeType is one of S, N, or B.
+func WithAttribute(attributeName string, attributeType string) Option {
+	return func(decorator *Decorator) {
+		decorator.attributes[attributeName] = attributeType
+	}
+}
+
+// WithGlobalSecondaryIndex adds a GSI. The key attributes must be declared
+// with WithAttribute. rangeKey is optional. Indexes on provisioned tables
+// use the table's provisioned capacity.
+func WithGlobalSecondaryIndex(indexName string,
+	hashKey string,
+	rangeKey string,
+	projectionType string) Option {
+	return func(decorator *Decorator) {
+		decorator.indexes = append(decorator.indexes, globalSecondaryIndex{
+			name:           indexName,
+			hashKey:        hashKey,
+			rangeKey:       rangeKey,
+			projectionType: projectionType,
+		})
+	}
+}
+
+// WithTimeToLive enables DynamoDB TTL on the numeric attribute, which holds
+// each item's expiry in epoch seconds
+func WithTimeToLive(attributeName string) Option {
+	return func(decorator *Decorator) {
+		decorator.ttlAttribute = attributeName
+	}
+}
+
+// WithTags tags the table
+func WithTags(tags map[string]string) Option {
+	return func(decorator *Decorator) {
+		for eachKey, eachValue := range tags {
+			decorator.tags[eachKey] = eachValue
+		}
+	}
+}
+
+// WithDeletionProtection retains the table when it's removed from the
+// template or the stack is deleted
+func WithDeletionProtection() Option {
+	return func(decorator *Decorator) {
+		decorator.deletionProtection = true
+	}
+}
+
+// WithPayPerRequest provisions an on-demand table regardless of the capacity
+// passed to NewDecorator, which suits bursty connect and disconnect traffic
+func WithPayPerRequest() Option {
+	return func(decorator *Decorator) {
+		decorator.readCapacityUnits = 0
+		decorator.writeCapacityUnits = 0
+	}
+}
+
+// WithGlobalTable makes the table a DynamoDB global table named tableName
+// with a replica in each region. The stack in the first region provisions
+// the global table; stacks in the other regions use their region's replica.
+// Global tables are on-demand and stream NEW_AND_OLD_IMAGES, which
+// replication requires.
+func WithGlobalTable(tableName string, regions []string, region string) Option {
+	return func(decorator *Decorator) {
+		decorator.globalTableName = tableName
+		decorator.replicaRegions = regions
+		decorator.globalTablePrimary = len(regions) != 0 && regions[0] == region
+		decorator.readCapacityUnits = 0
+		decorator.writeCapacityUnits = 0
+		decorator.streamViewType = "NEW_AND_OLD_IMAGES"
+	}
+}
+
+// WithExternalTable uses an existing table, possibly in another account,
+// instead of provisioning one. The other options don't apply to external
+// tables.
+func WithExternalTable(tableARN string) Option {
+	return func(decorator *Decorator) {
+		decorator.externalTableARN = tableARN
+	}
+}
+
+// keySchema returns the key schema for the hash and optional range key
+func keySchema(hashKey string, rangeKey string) *gocf.DynamoDBTableKeySchemaList {
+	schema := gocf.DynamoDBTableKeySchemaList{
+		gocf.DynamoDBTableKeySchema{
+			AttributeName: gocf.String(hashKey),
+			KeyType:       gocf.String("HASH"),
+		},
+	}
+	if rangeKey != "" {
+		schema = append(schema, gocf.DynamoDBTableKeySchema{
+			AttributeName: gocf.String(rangeKey),
+			KeyType:       gocf.String("RANGE"),
+		})
+	}
+	return &schema
+}
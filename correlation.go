@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/sirupsen/logrus"
+)
+
+// logFieldCorrelationID is the log entry field that identifies the inbound
+// message an entry relates to
+const logFieldCorrelationID = "CorrelationID"
+
+// correlationHook adds the correlation ID to every entry
+type correlationHook struct {
+	correlationID string
+}
+
+func (hook *correlationHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *correlationHook) Fire(entry *logrus.Entry) error {
+	entry.Data[logFieldCorrelationID] = hook.correlationID
+	return nil
+}
+
+// correlatedLogger returns a copy of the logger whose entries include the
+// correlation ID. The correlation ID of a message is the API Gateway request
+// ID of the frame that sent it, which is also the requestId of error frames
+// and the correlationId of the frames that deliver it.
+func correlatedLogger(logger *logrus.Logger, correlationID string) *logrus.Logger {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	if correlationID == "" {
+		return logger
+	}
+	correlated := uncorrelatedLogger(logger)
+	correlated.AddHook(&correlationHook{
+		correlationID: correlationID,
+	})
+	return correlated
+}
+
+// uncorrelatedLogger returns a copy of the logger without its correlation
+// ID, for state such as the shared session that outlives the invocation
+func uncorrelatedLogger(logger *logrus.Logger) *logrus.Logger {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	uncorrelated := logrus.New()
+	uncorrelated.Out = logger.Out
+	uncorrelated.Formatter = logger.Formatter
+	uncorrelated.ReportCaller = logger.ReportCaller
+	uncorrelated.ExitFunc = logger.ExitFunc
+	uncorrelated.SetLevel(logger.GetLevel())
+	for eachLevel, eachHooks := range logger.Hooks {
+		for _, eachHook := range eachHooks {
+			if _, isCorrelation := eachHook.(*correlationHook); !isCorrelation {
+				uncorrelated.Hooks[eachLevel] = append(uncorrelated.Hooks[eachLevel], eachHook)
+			}
+		}
+	}
+	return uncorrelated
+}
+
+// withCorrelation wraps the handler so that every entry logged while
+// handling the request includes its correlation ID
+func withCorrelation(handler wsHandler) wsHandler {
+	return func(ctx context.Context,
+		request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+		logger := contextLogger(ctx)
+		ctx = context.WithValue(ctx,
+			sparta.ContextKeyLogger,
+			correlatedLogger(logger, request.RequestContext.RequestID))
+		return handler(ctx, request)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+)
+
+const (
+	// Provision-time environment variables for deployments that keep data
+	// in a separate account. EXTERNAL_CONNECTION_TABLE_ARN uses an existing
+	// connection table rather than provisioning one, and
+	// DATA_ACCOUNT_ROLE_ARN is the role the handlers assume to access it.
+	envKeyExternalTableARN      = "EXTERNAL_CONNECTION_TABLE_ARN"
+	envKeyDataAccountRoleARN    = "DATA_ACCOUNT_ROLE_ARN"
+	envKeyDataAccountExternalID = "DATA_ACCOUNT_EXTERNAL_ID"
+	// envKeyExternalKMSKeyARN encrypts the payload bucket with a key that
+	// may belong to another account
+	envKeyExternalKMSKeyARN = "EXTERNAL_KMS_KEY_ARN"
+)
+
+var (
+	dataAccountCredentialsOnce sync.Once
+	dataAccountCredentials     *credentials.Credentials
+)
+
+// connectionsSession returns the session for connection table clients. If a
+// data account role is configured the session uses its assumed-role
+// credentials, which are cached and refreshed for the life of the container.
+func connectionsSession(sess *session.Session) *session.Session {
+	roleARN := os.Getenv(envKeyDataAccountRoleARN)
+	if roleARN == "" {
+		return sess
+	}
+	dataAccountCredentialsOnce.Do(func() {
+		dataAccountCredentials = stscreds.NewCredentials(sess,
+			roleARN,
+			func(provider *stscreds.AssumeRoleProvider) {
+				if externalID := os.Getenv(envKeyDataAccountExternalID); externalID != "" {
+					provider.ExternalID = aws.String(externalID)
+				}
+			})
+	})
+	return sess.Copy(&aws.Config{
+		Credentials: dataAccountCredentials,
+	})
+}
+
+// annotateDataAccount lets the lambda assume the data account role and
+// publishes it in the lambda environment
+func annotateDataAccount(lambdaFn *sparta.LambdaAWSInfo) {
+	roleARN := os.Getenv(envKeyDataAccountRoleARN)
+	if roleARN == "" {
+		return
+	}
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"sts:AssumeRole"},
+			Resource: gocf.String(roleARN),
+		})
+	setEnvironment(lambdaFn, envKeyDataAccountRoleARN, gocf.String(roleARN))
+	if externalID := os.Getenv(envKeyDataAccountExternalID); externalID != "" {
+		setEnvironment(lambdaFn, envKeyDataAccountExternalID, gocf.String(externalID))
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyDashboard provisions the stack's CloudWatch dashboard
+	envKeyDashboard           = "DASHBOARD"
+	dashboardResourceName     = "Dashboard"
+	outputDashboardURL        = "DashboardURL"
+	dashboardPeriod           = 300
+	dashboardWidgetWidth      = 12
+	dashboardWidgetHeight     = 6
+	dashboardReferenceAPIID   = "ApiId"
+	dashboardReferenceRegion  = "AWS::Region"
+	dashboardReferenceTable   = "TableName"
+	dashboardWidgetsPerRow    = 2
+	dashboardNamespaceGateway = "AWS/ApiGateway"
+	dashboardNamespaceLambda  = "AWS/Lambda"
+	dashboardNamespaceDynamo  = "AWS/DynamoDB"
+)
+
+// dashboardReference matches the ${Name} placeholders in the dashboard body
+var dashboardReference = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// dashboardWidget is a CloudWatch dashboard metric graph
+type dashboardWidget struct {
+	Type       string                    `json:"type"`
+	X          int                       `json:"x"`
+	Y          int                       `json:"y"`
+	Width      int                       `json:"width"`
+	Height     int                       `json:"height"`
+	Properties dashboardWidgetProperties `json:"properties"`
+}
+
+type dashboardWidgetProperties struct {
+	Title   string          `json:"title"`
+	Region  string          `json:"region"`
+	Stat    string          `json:"stat"`
+	Period  int             `json:"period"`
+	View    string          `json:"view"`
+	Metrics [][]interface{} `json:"metrics"`
+}
+
+// dashboardEnabled returns true if the stack provisions a dashboard
+func dashboardEnabled() bool {
+	return os.Getenv(envKeyDashboard) == "true"
+}
+
+// reference returns the placeholder that dashboardBody replaces with the
+// named value
+func reference(name string) string {
+	return "${" + name + "}"
+}
+
+// dashboardWidgets returns the gateway, lambda, and connection table graphs.
+// Lambda metrics are graphed for each function, which the body references by
+// logical name.
+func dashboardWidgets(lambdaFns []*sparta.LambdaAWSInfo) []*dashboardWidget {
+	gatewayMetrics := func(names ...string) [][]interface{} {
+		var metrics [][]interface{}
+		for _, eachName := range names {
+			metrics = append(metrics, []interface{}{
+				dashboardNamespaceGateway,
+				eachName,
+				"ApiId",
+				reference(dashboardReferenceAPIID),
+				"Stage",
+				apiStageName,
+			})
+		}
+		return metrics
+	}
+	lambdaMetrics := func(name string) [][]interface{} {
+		var metrics [][]interface{}
+		for _, eachLambda := range lambdaFns {
+			metrics = append(metrics, []interface{}{
+				dashboardNamespaceLambda,
+				name,
+				"FunctionName",
+				reference(eachLambda.LogicalResourceName()),
+			})
+		}
+		return metrics
+	}
+	tableMetrics := func(names ...string) [][]interface{} {
+		var metrics [][]interface{}
+		for _, eachName := range names {
+			metrics = append(metrics, []interface{}{
+				dashboardNamespaceDynamo,
+				eachName,
+				"TableName",
+				reference(dashboardReferenceTable),
+			})
+		}
+		return metrics
+	}
+	graphs := []dashboardWidgetProperties{
+		{
+			Title:   "Connections and messages",
+			Stat:    "Sum",
+			Metrics: gatewayMetrics("ConnectCount", "MessageCount"),
+		},
+		{
+			Title:   "Gateway errors",
+			Stat:    "Sum",
+			Metrics: gatewayMetrics("IntegrationError", "ClientError", "ExecutionError"),
+		},
+		{
+			Title:   "Lambda duration",
+			Stat:    "Average",
+			Metrics: lambdaMetrics("Duration"),
+		},
+		{
+			Title:   "Lambda errors",
+			Stat:    "Sum",
+			Metrics: lambdaMetrics("Errors"),
+		},
+		{
+			Title:   "Connection table capacity",
+			Stat:    "Sum",
+			Metrics: tableMetrics("ConsumedReadCapacityUnits", "ConsumedWriteCapacityUnits"),
+		},
+		{
+			Title:   "Connection table throttles",
+			Stat:    "Sum",
+			Metrics: tableMetrics("ReadThrottleEvents", "WriteThrottleEvents"),
+		},
+	}
+	widgets := make([]*dashboardWidget, 0, len(graphs))
+	for eachIndex, eachGraph := range graphs {
+		eachGraph.Region = reference(dashboardReferenceRegion)
+		eachGraph.Period = dashboardPeriod
+		eachGraph.View = "timeSeries"
+		widgets = append(widgets, &dashboardWidget{
+			Type:       "metric",
+			X:          (eachIndex % dashboardWidgetsPerRow) * dashboardWidgetWidth,
+			Y:          (eachIndex / dashboardWidgetsPerRow) * dashboardWidgetHeight,
+			Width:      dashboardWidgetWidth,
+			Height:     dashboardWidgetHeight,
+			Properties: eachGraph,
+		})
+	}
+	return widgets
+}
+
+// dashboardBody marshals the widgets and joins the JSON with the values of
+// its placeholders
+func dashboardBody(widgets []*dashboardWidget,
+	values map[string]gocf.Stringable) (*gocf.StringExpr, error) {
+	body, bodyErr := json.Marshal(map[string]interface{}{
+		"widgets": widgets,
+	})
+	if bodyErr != nil {
+		return nil, bodyErr
+	}
+	return joinReferences(body, values), nil
+}
+
+// joinReferences joins the document with the value of each ${Name}
+// placeholder. Unlike Fn::Sub, a value can be any expression, such as the
+// name of a connection table that's provisioned outside the stack.
+func joinReferences(body []byte, values map[string]gocf.Stringable) *gocf.StringExpr {
+	var parts []gocf.Stringable
+	start := 0
+	for _, eachMatch := range dashboardReference.FindAllSubmatchIndex(body, -1) {
+		value, exists := values[string(body[eachMatch[2]:eachMatch[3]])]
+		if !exists {
+			continue
+		}
+		parts = append(parts, gocf.String(string(body[start:eachMatch[0]])), value)
+		start = eachMatch[1]
+	}
+	parts = append(parts, gocf.String(string(body[start:])))
+	return gocf.Join("", parts...)
+}
+
+// dashboardDecorator provisions a CloudWatch dashboard that graphs the
+// gateway's connections, messages, and errors, each lambda's duration and
+// errors, and the connection table's consumed capacity and throttles. The
+// dashboard's console URL is a stack output.
+func dashboardDecorator(apiGateway *sparta.APIV2,
+	lambdaFns []*sparta.LambdaAWSInfo,
+	tableName *gocf.StringExpr) sparta.ServiceDecoratorHookHandler {
+	return sparta.ServiceDecoratorHookFunc(func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		values := map[string]gocf.Stringable{
+			dashboardReferenceAPIID:  gocf.Ref(apiGateway.LogicalResourceName()),
+			dashboardReferenceRegion: gocf.Ref("AWS::Region"),
+			dashboardReferenceTable:  tableName,
+		}
+		for _, eachLambda := range lambdaFns {
+			values[eachLambda.LogicalResourceName()] = gocf.Ref(eachLambda.LogicalResourceName())
+		}
+		body, bodyErr := dashboardBody(dashboardWidgets(lambdaFns), values)
+		if bodyErr != nil {
+			return bodyErr
+		}
+		template.AddResource(dashboardResourceName, &gocf.CloudWatchDashboard{
+			DashboardBody: body,
+		})
+		template.Outputs[outputDashboardURL] = &gocf.Output{
+			Description: "CloudWatch dashboard",
+			Value: gocf.Join("",
+				gocf.String("https://console.aws.amazon.com/cloudwatch/home?region="),
+				gocf.Ref("AWS::Region"),
+				gocf.String("#dashboards:name="),
+				gocf.Ref(dashboardResourceName)),
+		}
+		return nil
+	})
+}
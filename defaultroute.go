@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+)
+
+const routeDefault = "$default"
+
+// actionFrame is the route selection property of a text frame
+type actionFrame struct {
+	Message string `json:"message"`
+}
+
+// withDefaultRoute wraps the $default route handler. Binary frames can't be
+// evaluated by the route selection expression, so they're passed to the
+// handler. Text frames only arrive on $default if they don't name a route,
+// so rather than API Gateway silently dropping them the sender gets an
+// unknownAction or malformedFrame error frame. graphql-ws frames never
+// reach the handler, since withSubprotocol handles them on every route.
+func withDefaultRoute(handler wsHandler) wsHandler {
+	return func(ctx context.Context,
+		request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+		if request.RequestContext.RouteKey != routeDefault || request.IsBase64Encoded {
+			return handler(ctx, request)
+		}
+		// Preconditions
+		logger := contextLogger(ctx)
+		sess := newAWSSession(logger)
+		apigwMgmtClient := newManagementClient(sess, managementEndpoint(request.RequestContext))
+		senderItem, senderItemErr := senderConnectionItem(ctx, request,
+			newConnectionsClient(sess))
+		if senderItemErr != nil {
+			logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+		}
+		locale := itemLocale(senderItem)
+
+		// Operation
+		var frame actionFrame
+		if json.Unmarshal([]byte(request.Body), &frame) != nil || frame.Message == "" {
+			return wsError(ctx,
+				request,
+				senderItem,
+				apigwMgmtClient,
+				errorCodeMalformedFrame,
+				catalog.Localize(locale, catalog.MalformedFrame),
+				logger), nil
+		}
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeUnknownAction,
+			catalog.Localize(locale, catalog.UnknownAction, frame.Message),
+			logger), nil
+	}
+}
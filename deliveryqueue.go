@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	apigwManagement "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// fanoutModeSQS queues each segment on the delivery queue so that
+	// deliveries survive PostToConnection throttling
+	fanoutModeSQS = "sqs"
+	// envKeyDeliveryQueueURL is the delivery queue URL
+	envKeyDeliveryQueueURL            = "DELIVERY_QUEUE_URL"
+	deliveryQueueResourceName         = "DeliveryQueue"
+	deliveryDeadLetterQueueName       = "DeliveryDeadLetterQueue"
+	deliveryQueueVisibilityTimeout    = 120
+	deliveryConsumerTimeout           = 100
+	deliveryQueueBatchSize            = 1
+	deliveryDeadLetterRetentionPeriod = 14 * 24 * 60 * 60
+	// deliverySendBatchSize and maxSendBatchSize are the SQS limits on the
+	// number of messages in a SendMessageBatch request and on their total
+	// size, attributes included
+	deliverySendBatchSize = 10
+	maxSendBatchSize      = 256 * 1024
+	// deliveryMaxAttempts bounds both the throttled connection retries and
+	// the queue's receives before a message is dead lettered
+	deliveryMaxAttempts = 5
+	// Retries back off exponentially from deliveryRetryBaseDelay, up to the
+	// SQS maximum message delay
+	deliveryRetryBaseDelay = 2 * time.Second
+	deliveryRetryMaxDelay  = 15 * time.Minute
+	// Metric names
+	metricDeliveryRetries     = "DeliveryRetries"
+	metricDeliveriesAbandoned = "DeliveriesAbandoned"
+)
+
+// queuedDelivery is the delivery queue message body. A message delivers the
+// payload to a segment or, when it's retrying throttled deliveries, to the
+// listed connections. Deliveries that are parked in the dead letter queue
+// include the reason they failed.
+type queuedDelivery struct {
+	segmentRequest
+	ConnectionIDs []string `json:"connectionIds,omitempty"`
+	Attempt       int      `json:"attempt"`
+	Reason        string   `json:"reason,omitempty"`
+}
+
+// deliveryQueueEnabled returns true if segments are queued for delivery
+func deliveryQueueEnabled() bool {
+	return os.Getenv(envKeyFanoutMode) == fanoutModeSQS
+}
+
+// deliveryRetryDelay returns the backoff before the attempt
+func deliveryRetryDelay(attempt int) time.Duration {
+	delay := deliveryRetryBaseDelay
+	for eachAttempt := 1; eachAttempt < attempt && delay < deliveryRetryMaxDelay; eachAttempt++ {
+		delay *= 2
+	}
+	if delay > deliveryRetryMaxDelay {
+		delay = deliveryRetryMaxDelay
+	}
+	return delay
+}
+
+// isThrottle returns true if the PostToConnection error is a throttle
+func isThrottle(postErr error) bool {
+	return request.IsErrorThrottle(postErr) ||
+		strings.Contains(postErr.Error(), apigwManagement.ErrCodeLimitExceededException)
+}
+
+// sendEntrySize returns the size that SQS counts against the batch limit
+// for the entry: its body and its attributes' names, types, and values
+func sendEntrySize(entry *sqs.SendMessageBatchRequestEntry) int {
+	size := len(aws.StringValue(entry.MessageBody))
+	for eachName, eachValue := range entry.MessageAttributes {
+		size += len(eachName) +
+			len(aws.StringValue(eachValue.DataType)) +
+			len(aws.StringValue(eachValue.StringValue))
+	}
+	return size
+}
+
+// enqueueSegments queues a delivery for each segment. Every broadcast is
+// queued, even when it isn't segmented, so the sender only waits for the
+// queue. Each batch holds at most deliverySendBatchSize messages whose total
+// size is within the SQS batch limit. The deliveries haven't happened yet,
+// so the returned stats are empty.
+func enqueueSegments(ctx context.Context,
+	sess *session.Session,
+	queueURL string,
+	endpointURL string,
+	requestID string,
+	payload json.RawMessage,
+	binary bool,
+	excluded string,
+	filterSource string,
+	totalSegments int64,
+	logger *logrus.Logger) (stats deliveryStats, err error) {
+	if totalSegments < 1 {
+		totalSegments = 1
+	}
+	ctx, span := startSpan(ctx, "fanout.enqueue",
+		attribute.Int64(attributeTotalSegments, totalSegments))
+	defer func() {
+		endSpan(span, err)
+	}()
+	sqsClient := newSQSClient(sess)
+	traceContext := injectTraceContext(ctx)
+	var entries []*sqs.SendMessageBatchRequestEntry
+	var entriesSize int
+	var failedCount int
+	sendEntries := func() {
+		if len(entries) == 0 {
+			return
+		}
+		sendOutput, sendErr := sqsClient.SendMessageBatchWithContext(ctx,
+			&sqs.SendMessageBatchInput{
+				QueueUrl: aws.String(queueURL),
+				Entries:  entries,
+			})
+		if sendErr != nil {
+			logger.WithField("Error", sendErr).Warn("Failed to queue segments")
+			failedCount += len(entries)
+		} else {
+			failedCount += len(sendOutput.Failed)
+		}
+		entries = nil
+		entriesSize = 0
+	}
+	for segment := int64(0); segment < totalSegments; segment++ {
+		body, _ := json.Marshal(&queuedDelivery{
+			segmentRequest: segmentRequest{
+				EndpointURL:          endpointURL,
+				RequestID:            requestID,
+				Payload:              payload,
+				Binary:               binary,
+				Segment:              segment,
+				TotalSegments:        totalSegments,
+				ExcludedConnectionID: excluded,
+				Filter:               filterSource,
+				TraceContext:         traceContext,
+			},
+			Attempt: 1,
+		})
+		entry := &sqs.SendMessageBatchRequestEntry{
+			Id:          aws.String(strconv.FormatInt(segment, 10)),
+			MessageBody: aws.String(string(body)),
+		}
+		entrySize := sendEntrySize(entry)
+		if len(entries) == deliverySendBatchSize || entriesSize+entrySize > maxSendBatchSize {
+			sendEntries()
+		}
+		entries = append(entries, entry)
+		entriesSize += entrySize
+	}
+	sendEntries()
+	if failedCount != 0 {
+		return stats, fmt.Errorf("failed to queue %d of %d segments",
+			failedCount,
+			totalSegments)
+	}
+	return stats, nil
+}
+
+// deliverQueued is the delivery queue consumer. Connections whose delivery
+// is throttled are queued again, with an exponential delay, rather than
+// failing the message and repeating every delivery. A message that fails
+// outright is hidden for the next backoff interval and retried until it's
+// dead lettered.
+func deliverQueued(ctx context.Context, event awsEvents.SQSEvent) (err error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	sqsClient := newSQSClient(sess)
+	queueURL := os.Getenv(envKeyDeliveryQueueURL)
+
+	// Operation
+	for _, eachRecord := range event.Records {
+		var delivery queuedDelivery
+		unmarshalErr := json.Unmarshal([]byte(eachRecord.Body), &delivery)
+		if unmarshalErr != nil {
+			logger.WithField("Body", eachRecord.Body).Warn("Discarding malformed delivery")
+			continue
+		}
+		deliveryErr := deliverQueuedMessage(ctx, sess, sqsClient, queueURL, &delivery, logger)
+		if deliveryErr != nil {
+			receiveCount, _ := strconv.Atoi(eachRecord.Attributes["ApproximateReceiveCount"])
+			_, visibilityErr := sqsClient.ChangeMessageVisibilityWithContext(ctx,
+				&sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(queueURL),
+					ReceiptHandle:     aws.String(eachRecord.ReceiptHandle),
+					VisibilityTimeout: aws.Int64(int64(deliveryRetryDelay(receiveCount) / time.Second)),
+				})
+			if visibilityErr != nil {
+				logger.WithField("Error", visibilityErr).Warn("Failed to back off delivery")
+			}
+			return deliveryErr
+		}
+	}
+	return nil
+}
+
+// deliverQueuedMessage delivers the message and queues a retry for the
+// connections that were throttled
+func deliverQueuedMessage(ctx context.Context,
+	sess *session.Session,
+	sqsClient sqsiface.SQSAPI,
+	queueURL string,
+	delivery *queuedDelivery,
+	logger *logrus.Logger) (err error) {
+	ctx, finishInvocation := startInvocation(extractTraceContext(ctx, delivery.TraceContext),
+		"DeliverQueued",
+		attribute.Int64(attributeSegment, delivery.Segment),
+		attribute.Int64(attributeTotalSegments, delivery.TotalSegments))
+	defer func() {
+		finishInvocation(err)
+	}()
+	bcast := newBroadcaster(ctx,
+		sess,
+		delivery.EndpointURL,
+		delivery.RequestID,
+		broadcastMessage,
+		delivery.Payload,
+		logger)
+	bcast.frames.binary = delivery.Binary
+	bcast.retryThrottled = true
+	bcast.excluded = delivery.ExcludedConnectionID
+	queryErr := bcast.filterBy(delivery.Filter)
+	if queryErr == nil {
+		if len(delivery.ConnectionIDs) != 0 {
+			queryErr = bcast.deliverConnections(ctx, delivery.ConnectionIDs)
+		} else {
+			queryErr = bcast.query(ctx, delivery.Segment, delivery.TotalSegments)
+		}
+	}
+	stats := bcast.finish(ctx)
+	logger.WithFields(logrus.Fields{
+		"Segment":   delivery.Segment,
+		"Attempt":   delivery.Attempt,
+		"Throttled": len(bcast.throttled),
+		"Stats":     stats,
+	}).Info("Queued delivery complete")
+	if queryErr != nil {
+		return queryErr
+	}
+	if len(bcast.throttled) == 0 {
+		return nil
+	}
+	metrics := newMetricsEmitter()
+	defer func() {
+		metricsErr := metrics.flush()
+		if metricsErr != nil {
+			logger.WithField("Error", metricsErr).Warn("Failed to publish metrics")
+		}
+	}()
+	if delivery.Attempt >= deliveryMaxAttempts {
+		logger.WithField("Connections", len(bcast.throttled)).Warn("Parking throttled deliveries")
+		// A failure to park retries this message, and so the deliveries
+		parkErr := parkUndeliverable(ctx, sqsClient, delivery, bcast.throttleReasons)
+		if parkErr != nil {
+			return parkErr
+		}
+		metrics.add(metricDeliveriesAbandoned, float64(len(bcast.throttled)))
+		return nil
+	}
+	retry := *delivery
+	retry.ConnectionIDs = bcast.throttled
+	retry.Attempt++
+	retry.Reason = ""
+	retry.TraceContext = injectTraceContext(ctx)
+	body, _ := json.Marshal(&retry)
+	_, sendErr := sqsClient.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:     aws.String(queueURL),
+		MessageBody:  aws.String(string(body)),
+		DelaySeconds: aws.Int64(int64(deliveryRetryDelay(retry.Attempt) / time.Second)),
+	})
+	if sendErr != nil {
+		return sendErr
+	}
+	metrics.add(metricDeliveryRetries, float64(len(bcast.throttled)))
+	return nil
+}
+
+// deliverConnections delivers the payload to the listed connections
+func (bcast *broadcaster) deliverConnections(ctx context.Context, connectionIDs []string) error {
+	items := make([]map[string]*dynamodb.AttributeValue, 0, len(connectionIDs))
+	for _, eachConnectionID := range connectionIDs {
+		item, itemErr := getConnectionItem(eachConnectionID, bcast.dynamoClient)
+		if itemErr != nil {
+			return itemErr
+		}
+		// Connections that disconnected since the first attempt are skipped
+		if len(item) != 0 {
+			items = append(items, item)
+		}
+	}
+	bcast.deliverItems(ctx, items)
+	return nil
+}
+
+// deliveryQueueDecorator provisions the delivery queue and its dead letter
+// queue
+func deliveryQueueDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(deliveryDeadLetterQueueName, &gocf.SQSQueue{
+		MessageRetentionPeriod: gocf.Integer(deliveryDeadLetterRetentionPeriod),
+	})
+	template.AddResource(deliveryQueueResourceName, &gocf.SQSQueue{
+		VisibilityTimeout: gocf.Integer(deliveryQueueVisibilityTimeout),
+		RedrivePolicy: map[string]interface{}{
+			"deadLetterTargetArn": gocf.GetAtt(deliveryDeadLetterQueueName, "Arn"),
+			"maxReceiveCount":     deliveryMaxAttempts,
+		},
+	})
+	return nil
+}
+
+// annotateDeliveryProducer lets the lambda queue deliveries and publishes
+// the queue URL in its environment
+func annotateDeliveryProducer(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"sqs:SendMessage"},
+			Resource: gocf.GetAtt(deliveryQueueResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyDeliveryQueueURL, gocf.Ref(deliveryQueueResourceName).String())
+}
+
+// annotateDeliveryConsumer subscribes the lambda to the delivery queue. It
+// also requeues throttled deliveries, parks those that exhaust their
+// retries, and backs off failed messages.
+func annotateDeliveryConsumer(lambdaFn *sparta.LambdaAWSInfo) {
+	annotateDeliveryProducer(lambdaFn)
+	annotateDeadLetterProducer(lambdaFn)
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"sqs:ReceiveMessage",
+				"sqs:DeleteMessage",
+				"sqs:ChangeMessageVisibility",
+				"sqs:GetQueueAttributes"},
+			Resource: gocf.GetAtt(deliveryQueueResourceName, "Arn"),
+		})
+	// The visibility timeout must exceed the consumer's timeout
+	lambdaFn.Options.Timeout = deliveryConsumerTimeout
+	lambdaFn.EventSourceMappings = append(lambdaFn.EventSourceMappings,
+		&sparta.EventSourceMapping{
+			EventSourceArn: gocf.GetAtt(deliveryQueueResourceName, "Arn"),
+			BatchSize:      deliveryQueueBatchSize,
+		})
+}
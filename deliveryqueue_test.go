@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestEnqueueSegments(t *testing.T) {
+	largePayload := json.RawMessage(`"` + strings.Repeat("a", 100*1024) + `"`)
+	tests := []struct {
+		name          string
+		payload       json.RawMessage
+		totalSegments int64
+		fail          []string
+		// batches is the number of messages in each batch
+		batches string
+		failed  bool
+	}{
+		{name: "unsegmented",
+			payload:       json.RawMessage(`"hello"`),
+			totalSegments: 0,
+			batches:       "[1]"},
+		{name: "split by count",
+			payload:       json.RawMessage(`"hello"`),
+			totalSegments: 25,
+			batches:       "[10 10 5]"},
+		{name: "split by size",
+			payload:       largePayload,
+			totalSegments: 5,
+			batches:       "[2 2 1]"},
+		{name: "failed segments",
+			payload:       json.RawMessage(`"hello"`),
+			totalSegments: 4,
+			fail:          []string{"2"},
+			batches:       "[4]",
+			failed:        true},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			sqsClient := newMockSQS(eachTest.fail...)
+			useMockSQS(t, sqsClient)
+			_, enqueueErr := enqueueSegments(context.Background(),
+				nil,
+				"https://sqs.us-east-1.amazonaws.com/123456789012/DeliveryQueue",
+				"https://abc123.execute-api.us-east-1.amazonaws.com/test",
+				"request-1",
+				eachTest.payload,
+				false,
+				"",
+				"",
+				eachTest.totalSegments,
+				logrus.New())
+			if (enqueueErr != nil) != eachTest.failed {
+				t.Errorf("enqueueSegments error = %v, want failed %t", enqueueErr, eachTest.failed)
+			}
+			var batches []int
+			var segments int
+			for _, eachBatch := range sqsClient.batches {
+				batches = append(batches, len(eachBatch))
+				batchSize := 0
+				for _, eachEntry := range eachBatch {
+					batchSize += sendEntrySize(eachEntry)
+					segments++
+				}
+				if batchSize > maxSendBatchSize {
+					t.Errorf("Batch of %d bytes exceeds the %d byte limit", batchSize, maxSendBatchSize)
+				}
+			}
+			if fmt.Sprint(batches) != eachTest.batches {
+				t.Errorf("Batches = %v, want %s", batches, eachTest.batches)
+			}
+			expectedSegments := eachTest.totalSegments
+			if expectedSegments < 1 {
+				expectedSegments = 1
+			}
+			if int64(segments) != expectedSegments {
+				t.Errorf("Queued %d segments, want %d", segments, expectedSegments)
+			}
+		})
+	}
+}
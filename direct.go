@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	"github.com/sirupsen/logrus"
+)
+
+const directMessage = "direct"
+
+// directRequest is the data of a senddirect frame
+type directRequest struct {
+	UserID    string          `json:"userId"`
+	MessageID string          `json:"messageId,omitempty"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// directFrame is the data of the direct frame delivered to each of the
+// target user's connections. Verified is false if the sender's user ID was
+// supplied by the client rather than validated at $connect. MessageID is set
+// if the message can be acknowledged.
+type directFrame struct {
+	From      string          `json:"from,omitempty"`
+	Verified  bool            `json:"verified"`
+	MessageID string          `json:"messageId,omitempty"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// sendDirect delivers the request data to every connection that belongs to
+// the target user. Messages to an offline user are held until they next
+// connect.
+func sendDirect(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	endpointURL := managementEndpoint(request.RequestContext)
+	dynamoClient := newConnectionsClient(sess)
+	apigwMgmtClient := newManagementClient(sess, endpointURL)
+	connectionID := request.RequestContext.ConnectionID
+
+	senderItem, senderItemErr := senderConnectionItem(ctx, request, dynamoClient)
+	if senderItemErr != nil {
+		logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+	}
+	locale := itemLocale(senderItem)
+	if rateLimited(ctx, sess, connectionID, dynamoClient, logger) {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeRateLimited,
+			catalog.Localize(locale, catalog.RateLimited),
+			logger), nil
+	}
+	var direct directRequest
+	payload, payloadErr := requestPayload(request, senderItem)
+	if payloadErr == nil {
+		payloadErr = json.Unmarshal(payload, &direct)
+	}
+	if payloadErr != nil {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeMalformedRequest,
+			catalog.Localize(locale, catalog.UnmarshalFailed, payloadErr.Error()),
+			logger), nil
+	}
+	if direct.UserID == "" || len(direct.UserID) > maxUserIDLength {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeMalformedRequest,
+			catalog.Localize(locale, catalog.InvalidUser),
+			logger), nil
+	}
+
+	// Operation
+	store := newConnectionIndex(dynamoClient)
+	receiverItems, receiverItemsErr := store.UserConnections(ctx, direct.UserID)
+	if receiverItemsErr != nil {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeSendFailed,
+			catalog.Localize(locale, catalog.SendFailed, receiverItemsErr.Error()),
+			logger), nil
+	}
+	if len(receiverItems) == 0 && !pendingEnabled() {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeUserOffline,
+			catalog.Localize(locale, catalog.UserOffline, direct.UserID),
+			logger), nil
+	}
+	messageID, trackErr := trackMessage(ctx,
+		sess,
+		request,
+		direct.MessageID,
+		receiptAudience{userID: direct.UserID},
+		logger)
+	if trackErr == errDuplicateMessage {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeDuplicateMessage,
+			catalog.Localize(locale, catalog.DuplicateMessage, direct.MessageID),
+			logger), nil
+	}
+	if trackErr != nil {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeSendFailed,
+			catalog.Localize(locale, catalog.SendFailed, trackErr.Error()),
+			logger), nil
+	}
+	frameData, _ := json.Marshal(&directFrame{
+		From:      itemUserID(senderItem),
+		Verified:  itemAuthenticated(senderItem),
+		MessageID: messageID,
+		Data:      direct.Data,
+	})
+	if len(receiverItems) == 0 {
+		holdErr := holdPending(ctx, sess, request, direct.UserID, messageID, frameData, logger)
+		if holdErr == errPendingFull {
+			return wsError(ctx,
+				request,
+				senderItem,
+				apigwMgmtClient,
+				errorCodeUserOffline,
+				catalog.Localize(locale, catalog.UserOffline, direct.UserID),
+				logger), nil
+		}
+		if holdErr != nil {
+			return wsError(ctx,
+				request,
+				senderItem,
+				apigwMgmtClient,
+				errorCodeSendFailed,
+				catalog.Localize(locale, catalog.SendFailed, holdErr.Error()),
+				logger), nil
+		}
+		forwardMessage(ctx, sess, request, &webhookEvent{
+			Type:      webhookTypeDirect,
+			MessageID: messageID,
+			To:        direct.UserID,
+			Data:      direct.Data,
+		}, senderItem, logger)
+		return &wsResponse{
+			StatusCode: 200,
+			Body:       catalog.Localize(locale, catalog.MessageQueued, direct.UserID),
+		}, nil
+	}
+	bcast := newBroadcaster(ctx,
+		sess,
+		endpointURL,
+		request.RequestContext.RequestID,
+		directMessage,
+		frameData,
+		logger)
+	bcast.deliverItems(ctx, receiverItems)
+	stats := bcast.finish(ctx)
+	countRecipients(ctx, sess, messageID, stats.Delivered, logger)
+	logger.WithFields(logrus.Fields{
+		"UserID": direct.UserID,
+		"Stats":  stats,
+	}).Info("Direct message complete")
+	forwardMessage(ctx, sess, request, &webhookEvent{
+		Type:      webhookTypeDirect,
+		MessageID: messageID,
+		To:        direct.UserID,
+		Data:      direct.Data,
+	}, senderItem, logger)
+	return &wsResponse{
+		StatusCode: 200,
+		Body:       catalog.Localize(locale, catalog.DataSent),
+	}, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Provision-time environment variables that attach CUSTOM_DOMAIN_NAME to
+	// the stage. HOSTED_ZONE_ID is the Route53 zone for the domain, and
+	// CERTIFICATE_ARN, if set, is an existing ACM certificate for the domain
+	// in the region being provisioned.
+	envKeyHostedZoneID   = "HOSTED_ZONE_ID"
+	envKeyCertificateARN = "CERTIFICATE_ARN"
+
+	domainCertificateResourceName = "DomainCertificate"
+	domainNameResourceName        = "DomainName"
+	domainMappingResourceName     = "DomainAPIMapping"
+	domainRecordResourceName      = "DomainRecord"
+)
+
+// customDomain is the optional custom wss:// domain for the stage
+type customDomain struct {
+	domainName     string
+	hostedZoneID   string
+	certificateARN string
+	// latency routes the domain to the nearest of the deployment regions
+	latency bool
+}
+
+// customDomainFromEnvironment returns the custom domain from the
+// provision-time environment, or nil if the stack doesn't manage one. A
+// CUSTOM_DOMAIN_NAME without a HOSTED_ZONE_ID is managed outside the stack.
+func customDomainFromEnvironment() *customDomain {
+	if os.Getenv(envKeyCustomDomainName) == "" || os.Getenv(envKeyHostedZoneID) == "" {
+		return nil
+	}
+	return &customDomain{
+		domainName:     os.Getenv(envKeyCustomDomainName),
+		hostedZoneID:   os.Getenv(envKeyHostedZoneID),
+		certificateARN: os.Getenv(envKeyCertificateARN),
+		latency:        multiRegionEnabled(),
+	}
+}
+
+// certificate returns the certificate ARN, which is the provisioned
+// certificate unless an existing one was configured
+func (domain *customDomain) certificate() *gocf.StringExpr {
+	if domain.certificateARN != "" {
+		return gocf.String(domain.certificateARN)
+	}
+	return gocf.Ref(domainCertificateResourceName).String()
+}
+
+// decorator returns the decorator that provisions the regional domain name,
+// maps it to the stage, and aliases it in the hosted zone. Unless a
+// certificate was configured, it also requests an ACM certificate that's
+// validated with a record in the hosted zone. Multi-region stacks add a
+// latency record for their region instead of a simple alias.
+func (domain *customDomain) decorator(apiGateway *sparta.APIV2) sparta.ServiceDecoratorHookFunc {
+	return func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		if domain.certificateARN == "" {
+			template.AddResource(domainCertificateResourceName, &gocf.CertificateManagerCertificate{
+				DomainName:       gocf.String(domain.domainName),
+				ValidationMethod: gocf.String("DNS"),
+				DomainValidationOptions: &gocf.CertificateManagerCertificateDomainValidationOptionList{
+					gocf.CertificateManagerCertificateDomainValidationOption{
+						DomainName:   gocf.String(domain.domainName),
+						HostedZoneID: gocf.String(domain.hostedZoneID),
+					},
+				},
+			})
+		}
+		template.AddResource(domainNameResourceName, &gocf.APIGatewayV2DomainName{
+			DomainName: gocf.String(domain.domainName),
+			DomainNameConfigurations: &gocf.APIGatewayV2DomainNameDomainNameConfigurationList{
+				gocf.APIGatewayV2DomainNameDomainNameConfiguration{
+					CertificateARN: domain.certificate(),
+					EndpointType:   gocf.String("REGIONAL"),
+					SecurityPolicy: gocf.String("TLS_1_2"),
+				},
+			},
+		})
+		template.AddResource(domainMappingResourceName, &gocf.APIGatewayV2APIMapping{
+			APIID:      gocf.Ref(apiGateway.LogicalResourceName()).String(),
+			DomainName: gocf.Ref(domainNameResourceName).String(),
+			Stage:      gocf.String(apiStageName),
+		})
+		record := &gocf.Route53RecordSet{
+			HostedZoneID: gocf.String(domain.hostedZoneID),
+			Name:         gocf.String(domain.domainName),
+			Type:         gocf.String("A"),
+			AliasTarget: &gocf.Route53RecordSetAliasTarget{
+				DNSName:              gocf.GetAtt(domainNameResourceName, "RegionalDomainName").String(),
+				HostedZoneID:         gocf.GetAtt(domainNameResourceName, "RegionalHostedZoneId").String(),
+				EvaluateTargetHealth: gocf.Bool(false),
+			},
+		}
+		if domain.latency {
+			record.SetIdentifier = gocf.Ref("AWS::Region").String()
+			record.Region = gocf.Ref("AWS::Region").String()
+		}
+		template.AddResource(domainRecordResourceName, record)
+		return nil
+	}
+}
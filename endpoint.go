@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+)
+
+const (
+	// envKeyManagementEndpoint overrides the management API endpoint URL,
+	// eg for localstack or other emulators
+	envKeyManagementEndpoint = "MANAGEMENT_ENDPOINT"
+	// envKeyManagementScheme overrides the management API URL scheme
+	envKeyManagementScheme  = "MANAGEMENT_ENDPOINT_SCHEME"
+	defaultManagementScheme = "https"
+	executeAPIDomainSuffix  = ".amazonaws.com"
+)
+
+// managementEndpoint returns the @connections management API endpoint for the
+// request. An explicit MANAGEMENT_ENDPOINT is used verbatim. Requests that
+// arrive via a custom domain are routed to the execute-api domain, since the
+// custom domain's base path mapping doesn't necessarily expose the stage.
+func managementEndpoint(requestContext awsEvents.APIGatewayWebsocketProxyRequestContext) string {
+	if overrideURL := os.Getenv(envKeyManagementEndpoint); overrideURL != "" {
+		return strings.TrimSuffix(overrideURL, "/")
+	}
+	scheme := os.Getenv(envKeyManagementScheme)
+	if scheme == "" {
+		scheme = defaultManagementScheme
+	}
+	domainName := requestContext.DomainName
+	if !strings.HasSuffix(domainName, executeAPIDomainSuffix) &&
+		requestContext.APIID != "" &&
+		os.Getenv("AWS_REGION") != "" {
+		domainName = fmt.Sprintf("%s.execute-api.%s%s",
+			requestContext.APIID,
+			os.Getenv("AWS_REGION"),
+			executeAPIDomainSuffix)
+	}
+	return fmt.Sprintf("%s://%s/%s",
+		scheme,
+		domainName,
+		requestContext.Stage)
+}
+
+// annotateManagementEndpoint lets a lambda that isn't invoked by a route
+// manage the stage's connections, and publishes the stage's management
+// endpoint since there's no request to derive it from. A provision-time
+// MANAGEMENT_ENDPOINT is used verbatim.
+func annotateManagementEndpoint(lambdaFn *sparta.LambdaAWSInfo, apiGateway *sparta.APIV2) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"execute-api:ManageConnections"},
+			Resource: manageConnectionsArn(apiGateway),
+		})
+	endpoint := stageManagementEndpoint(apiGateway)
+	if overrideURL := os.Getenv(envKeyManagementEndpoint); overrideURL != "" {
+		endpoint = gocf.String(overrideURL)
+	}
+	setEnvironment(lambdaFn, envKeyManagementEndpoint, endpoint)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	apigwManagement "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	apigwManagementIface "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi/apigatewaymanagementapiiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sirupsen/logrus"
+)
+
+// errorCode is the machine readable reason in an error frame
+type errorCode string
+
+const (
+	errorCodeMalformedRequest errorCode = "malformedRequest"
+	errorCodeSendFailed       errorCode = "sendFailed"
+	errorCodeInternal         errorCode = "internalError"
+	errorCodeRateLimited      errorCode = "rateLimited"
+	errorCodeNotRoomMember    errorCode = "notRoomMember"
+	errorCodeFeatureDisabled  errorCode = "featureDisabled"
+	errorCodeUserOffline      errorCode = "userOffline"
+	errorCodeUnknownAction    errorCode = "unknownAction"
+	errorCodeMalformedFrame   errorCode = "malformedFrame"
+	errorCodeUnknownMessage   errorCode = "unknownMessage"
+	errorCodeDuplicateMessage errorCode = "duplicateMessage"
+	errorCodePayloadTooLarge  errorCode = "payloadTooLarge"
+	errorCodeInvalidRequest   errorCode = "invalidRequest"
+	errorCodeMessageRejected  errorCode = "messageRejected"
+	errorCodeUnauthenticated  errorCode = "unauthenticated"
+)
+
+// errorFrame is the standard frame posted back to a connection whose request
+// failed. Browser WebSocket clients never see the route response status, so
+// this is the only way they learn about failures.
+// Details, if set, lists the problems with each invalid request field.
+type errorFrame struct {
+	Type      string        `json:"type"`
+	Code      errorCode     `json:"code"`
+	Message   string        `json:"message"`
+	RequestID string        `json:"requestId"`
+	Details   []*fieldError `json:"details,omitempty"`
+}
+
+// fieldError is a single problem with a request field. Field is the dotted
+// path to the field, or "(root)" for the request data itself.
+type fieldError struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// wsError posts the structured error frame to the sender and returns the
+// route response with the same message
+func wsError(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	senderItem map[string]*dynamodb.AttributeValue,
+	apigwMgmtClient apigwManagementIface.ApiGatewayManagementApiAPI,
+	code errorCode,
+	message string,
+	logger *logrus.Logger) *wsResponse {
+	postErrorFrame(ctx, request, senderItem, apigwMgmtClient, code, message, logger)
+	return &wsResponse{
+		StatusCode: 500,
+		Body:       message,
+	}
+}
+
+// postErrorFrame encodes the error frame in the sender's negotiated encoding
+// and posts it. Failures are logged since there's nothing else to be done
+// for the sender.
+func postErrorFrame(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	senderItem map[string]*dynamodb.AttributeValue,
+	apigwMgmtClient apigwManagementIface.ApiGatewayManagementApiAPI,
+	code errorCode,
+	message string,
+	logger *logrus.Logger) {
+	postErrorDetails(ctx, request, senderItem, apigwMgmtClient, &errorFrame{
+		Type:      errorMessage,
+		Code:      code,
+		Message:   message,
+		RequestID: request.RequestContext.RequestID,
+	}, logger)
+}
+
+// postErrorDetails encodes the error frame in the sender's negotiated
+// encoding and posts it
+func postErrorDetails(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	senderItem map[string]*dynamodb.AttributeValue,
+	apigwMgmtClient apigwManagementIface.ApiGatewayManagementApiAPI,
+	errFrame *errorFrame,
+	logger *logrus.Logger) {
+	errorData, errorDataErr := json.Marshal(errFrame)
+	if errorDataErr != nil {
+		logger.WithField("Error", errorDataErr).Warn("Failed to marshal error frame")
+		return
+	}
+	frame, frameErr := itemNegotiation(senderItem).EncodeFrame(errorMessage, errorData)
+	if frameErr != nil {
+		logger.WithField("Error", frameErr).Warn("Failed to encode error frame")
+		return
+	}
+	_, postErr := apigwMgmtClient.PostToConnectionWithContext(ctx,
+		&apigwManagement.PostToConnectionInput{
+			ConnectionId: aws.String(request.RequestContext.ConnectionID),
+			Data:         frame,
+		})
+	if postErr != nil {
+		logger.WithField("Error", postErr).Warn("Failed to post error frame")
+	}
+}
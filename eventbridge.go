@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyEventBridge provisions the rule that pushes matching default bus
+	// events to every connection. envKeyEventBridgePattern overrides the
+	// rule's JSON event pattern.
+	envKeyEventBridge        = "EVENT_BRIDGE"
+	envKeyEventBridgePattern = "EVENT_BRIDGE_PATTERN"
+	eventBridgeRuleName      = "BusNotifications"
+	// defaultEventBridgeDetailType is the detail type that the default pattern
+	// matches
+	defaultEventBridgeDetailType = "WebSocket Notification"
+)
+
+// busNotification is the data of the broadcast for a bus event
+type busNotification struct {
+	Source     string          `json:"source"`
+	DetailType string          `json:"detailType"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// eventBridgeEnabled returns true if the stack provisions the bus rule
+func eventBridgeEnabled() bool {
+	return os.Getenv(envKeyEventBridge) == "true"
+}
+
+// eventBridgePattern returns the rule's event pattern, which defaults to
+// events with the WebSocket Notification detail type
+func eventBridgePattern() (map[string]interface{}, error) {
+	value := os.Getenv(envKeyEventBridgePattern)
+	if value == "" {
+		return map[string]interface{}{
+			"detail-type": []string{defaultEventBridgeDetailType},
+		}, nil
+	}
+	var pattern map[string]interface{}
+	unmarshalErr := json.Unmarshal([]byte(value), &pattern)
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("%s isn't a JSON event pattern: %s", envKeyEventBridgePattern, unmarshalErr)
+	}
+	return pattern, nil
+}
+
+// pushBusEvent is the bus rule's target. It broadcasts the event's source,
+// detail type, and detail to every connection, with the event ID as the
+// correlation ID. A failed broadcast is retried by the asynchronous
+// invocation.
+func pushBusEvent(ctx context.Context, event awsEvents.CloudWatchEvent) (err error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	ctx, finishInvocation := startInvocation(ctx, "PushBusEvents")
+	defer func() {
+		finishInvocation(err)
+	}()
+
+	// Operation
+	payload, payloadErr := json.Marshal(&busNotification{
+		Source:     event.Source,
+		DetailType: event.DetailType,
+		Detail:     event.Detail,
+	})
+	if payloadErr != nil {
+		return payloadErr
+	}
+	stats, deliverErr := deliverBroadcast(ctx,
+		sess,
+		os.Getenv(envKeyManagementEndpoint),
+		event.ID,
+		payload,
+		false,
+		"",
+		"",
+		logger)
+	correlatedLogger(logger, event.ID).WithFields(logrus.Fields{
+		"Source":     event.Source,
+		"DetailType": event.DetailType,
+		"Stats":      stats,
+	}).Info("Bus event broadcast complete")
+	return deliverErr
+}
+
+// annotateEventBridgeTarget subscribes the lambda to the default bus events
+// that match the pattern
+func annotateEventBridgeTarget(lambdaFn *sparta.LambdaAWSInfo,
+	apiGateway *sparta.APIV2,
+	pattern map[string]interface{}) {
+	annotateManagementEndpoint(lambdaFn, apiGateway)
+	lambdaFn.Permissions = append(lambdaFn.Permissions, sparta.CloudWatchEventsPermission{
+		Rules: map[string]sparta.CloudWatchEventsRule{
+			eventBridgeRuleName: {
+				Description:  "Broadcast matching bus events to every connection",
+				EventPattern: pattern,
+			},
+		},
+	})
+}
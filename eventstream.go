@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/protocol"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyEventStream provisions the event stream, whose records are
+	// pushed to the members of the EVENT_STREAM_ROOM room. EVENT_STREAM_SHARDS
+	// sets the stream's provisioned shards.
+	envKeyEventStream       = "EVENT_STREAM"
+	envKeyEventStreamRoom   = "EVENT_STREAM_ROOM"
+	envKeyEventStreamShards = "EVENT_STREAM_SHARDS"
+	defaultEventStreamRoom  = "events"
+	eventStreamResourceName = "EventStream"
+	outputEventStreamName   = "EventStreamName"
+	// eventStreamMappingName and eventStreamFailuresName are the consumer's
+	// event source mapping and the queue that records which exhaust their
+	// retries are dropped to
+	eventStreamMappingName  = "EventStreamConsumer"
+	eventStreamFailuresName = "EventStreamFailures"
+	// eventStreamBatchSize bounds the records in each consumer invocation.
+	// Records are delivered in order, one room broadcast each.
+	eventStreamBatchSize = 100
+	// eventStreamMaxRetries bounds the retries of a failed batch, which
+	// Lambda bisects, so that a bad record doesn't block its shard until the
+	// record expires
+	eventStreamMaxRetries = 3
+	// eventStreamFailuresRetentionPeriod is the maximum 14 days, in seconds
+	eventStreamFailuresRetentionPeriod = 1209600
+)
+
+// eventStreamEnabled returns true if the stack provisions the event stream
+func eventStreamEnabled() bool {
+	return os.Getenv(envKeyEventStream) == "true"
+}
+
+// eventStreamRoom returns the room that the stream's records are delivered to
+func eventStreamRoom() string {
+	if room := os.Getenv(envKeyEventStreamRoom); room != "" {
+		return room
+	}
+	return defaultEventStreamRoom
+}
+
+// eventStreamShards returns the stream's provisioned shard count
+func eventStreamShards() int64 {
+	shards, _ := strconv.ParseInt(os.Getenv(envKeyEventStreamShards), 10, 64)
+	if shards < 1 {
+		return 1
+	}
+	return shards
+}
+
+// recordData returns the data of a stream record's room frame. JSON records
+// are delivered as-is and other records as opaque binary data.
+func recordData(data []byte) (json.RawMessage, error) {
+	if json.Valid(data) {
+		return json.RawMessage(data), nil
+	}
+	return protocol.BinaryData(data)
+}
+
+// streamEvents is the event stream consumer. Each record is delivered, in
+// order, to the stream room's members as a room frame, with the record's
+// event ID as the correlation ID. A failed delivery fails the batch, which
+// is bisected and retried, so members may receive a record more than once.
+// Records that still fail are dropped to the EventStreamFailures queue.
+func streamEvents(ctx context.Context, event awsEvents.KinesisEvent) (err error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	endpointURL := os.Getenv(envKeyManagementEndpoint)
+	room := eventStreamRoom()
+	ctx, finishInvocation := startInvocation(ctx, "StreamEvents")
+	defer func() {
+		finishInvocation(err)
+	}()
+
+	// Operation
+	for _, eachRecord := range event.Records {
+		data, dataErr := recordData(eachRecord.Kinesis.Data)
+		if dataErr != nil {
+			return dataErr
+		}
+		stats, deliverErr := deliverRoom(ctx,
+			sess,
+			endpointURL,
+			eachRecord.EventID,
+			&roomFrame{
+				Room: room,
+				Data: data,
+			},
+			logger)
+		logger.WithFields(logrus.Fields{
+			"PartitionKey":   eachRecord.Kinesis.PartitionKey,
+			"SequenceNumber": eachRecord.Kinesis.SequenceNumber,
+			"Stats":          stats,
+		}).Info("Stream record delivered")
+		if deliverErr != nil {
+			return deliverErr
+		}
+	}
+	return nil
+}
+
+// eventStreamDecorator provisions the encrypted event stream and publishes
+// its name, which producers put records to, as a stack output. It also
+// subscribes the consumer with a bounded number of bisected retries and
+// the failure queue as the on-failure destination, which the sparta event
+// source mappings can't configure.
+func eventStreamDecorator(consumer *sparta.LambdaAWSInfo) sparta.ServiceDecoratorHookHandler {
+	return sparta.ServiceDecoratorHookFunc(func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		template.AddResource(eventStreamResourceName, &gocf.KinesisStream{
+			ShardCount: gocf.Integer(eventStreamShards()),
+			StreamEncryption: &gocf.KinesisStreamStreamEncryption{
+				EncryptionType: gocf.String("KMS"),
+				KeyID:          gocf.String("alias/aws/kinesis"),
+			},
+		})
+		template.AddResource(eventStreamFailuresName, &gocf.SQSQueue{
+			MessageRetentionPeriod: gocf.Integer(eventStreamFailuresRetentionPeriod),
+		})
+		template.AddResource(eventStreamMappingName, &gocf.LambdaEventSourceMapping{
+			EventSourceArn:             gocf.GetAtt(eventStreamResourceName, "Arn").String(),
+			FunctionName:               gocf.Ref(consumer.LogicalResourceName()).String(),
+			StartingPosition:           gocf.String("LATEST"),
+			BatchSize:                  gocf.Integer(eventStreamBatchSize),
+			MaximumRetryAttempts:       gocf.Integer(eventStreamMaxRetries),
+			BisectBatchOnFunctionError: gocf.Bool(true),
+			DestinationConfig: &gocf.LambdaEventSourceMappingDestinationConfig{
+				OnFailure: &gocf.LambdaEventSourceMappingOnFailure{
+					Destination: gocf.GetAtt(eventStreamFailuresName, "Arn").String(),
+				},
+			},
+		})
+		template.Outputs[outputEventStreamName] = &gocf.Output{
+			Description: "Kinesis stream whose records are pushed to connections",
+			Value:       gocf.Ref(eventStreamResourceName),
+			Export:      stackExport(outputEventStreamName),
+		}
+		return nil
+	})
+}
+
+// annotateEventStreamConsumer lets the lambda consume the event stream and
+// drop failed records to the failure queue, and propagates the
+// provision-time stream room. eventStreamDecorator subscribes it.
+func annotateEventStreamConsumer(lambdaFn *sparta.LambdaAWSInfo, apiGateway *sparta.APIV2) {
+	annotateManagementEndpoint(lambdaFn, apiGateway)
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"kinesis:GetRecords",
+				"kinesis:GetShardIterator",
+				"kinesis:DescribeStream",
+				"kinesis:DescribeStreamSummary",
+				"kinesis:ListShards"},
+			Resource: gocf.GetAtt(eventStreamResourceName, "Arn"),
+		},
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"kinesis:ListStreams"},
+			Resource: gocf.String("*"),
+		},
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"sqs:SendMessage"},
+			Resource: gocf.GetAtt(eventStreamFailuresName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyEventStreamRoom, gocf.String(eventStreamRoom()))
+}
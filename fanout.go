@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/connections"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// envKeyFanoutSegments is the number of bucket segments, each delivered by
+	// its own invocation of the delivery lambda. Values less than 2 deliver
+	// within the sendMessage invocation.
+	envKeyFanoutSegments = "FANOUT_SEGMENTS"
+	// envKeyDeliveryFunction is the name of the segment delivery lambda
+	envKeyDeliveryFunction = "DELIVERY_FUNCTIONNAME"
+	// maxScannedFanoutSegments bounds the segments of a scanned index, which
+	// aren't bounded by the hash buckets
+	maxScannedFanoutSegments = 1024
+)
+
+// segmentRequest is the delivery lambda input for one bucket segment
+type segmentRequest struct {
+	EndpointURL   string          `json:"endpointURL"`
+	RequestID     string          `json:"requestId"`
+	Payload       json.RawMessage `json:"payload"`
+	Segment       int64           `json:"segment"`
+	TotalSegments int64           `json:"totalSegments"`
+	// Binary is true if Payload is the JSON form of an opaque binary payload
+	Binary bool `json:"binary,omitempty"`
+	// ExcludedConnectionID, if set, is the sender's connection when the
+	// sender excluded itself from the broadcast
+	ExcludedConnectionID string `json:"excludedConnectionId,omitempty"`
+	// Filter, if set, is the attribute filter of the connections to deliver
+	// to
+	Filter string `json:"filter,omitempty"`
+	// Tag, if set, delivers to the tagged connections with IDs from
+	// FirstConnectionID through LastConnectionID rather than to a bucket
+	// segment
+	Tag               string `json:"tag,omitempty"`
+	FirstConnectionID string `json:"firstConnectionId,omitempty"`
+	LastConnectionID  string `json:"lastConnectionId,omitempty"`
+	// TraceContext carries the sender's span so that the segment
+	// deliveries are part of the broadcast trace
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+}
+
+// fanoutSegments returns the configured number of delivery segments
+func fanoutSegments() int64 {
+	segments, _ := strconv.ParseInt(os.Getenv(envKeyFanoutSegments), 10, 64)
+	return segments
+}
+
+// runtimeFanoutSegments returns the fanoutSegments tunable, falling back to
+// the configured number of delivery segments. Each segment of a queried
+// index delivers at least one hash bucket, so there are never more segments
+// than buckets. Segments of a scanned index deliver a range of its scan
+// segments instead, so they're bounded by maxScannedFanoutSegments.
+func runtimeFanoutSegments(ctx context.Context, sess *session.Session, logger *logrus.Logger) int64 {
+	segments := tunables.intValue(ctx, sess, tunableFanoutSegments, fanoutSegments(), logger)
+	maxSegments := int64(connections.Buckets)
+	if indexScanned() {
+		maxSegments = maxScannedFanoutSegments
+	}
+	if segments > maxSegments {
+		segments = maxSegments
+	}
+	return segments
+}
+
+// deliverBroadcast delivers the payload to every connection. Large tables
+// can be split into FANOUT_SEGMENTS bucket segments, each delivered by a
+// concurrent invocation of the delivery lambda so that the fan-out isn't
+// bounded by a single invocation's time and network limits. The per-segment
+// stats are aggregated into the result. binary is true if the payload is the
+// JSON form of an opaque binary payload. With the fan-out topic, delivery
+// queue, or broadcast state machine, segments are published, queued, or
+// orchestrated instead and delivered asynchronously.
+func deliverBroadcast(ctx context.Context,
+	sess *session.Session,
+	endpointURL string,
+	requestID string,
+	payload json.RawMessage,
+	binary bool,
+	excluded string,
+	filterSource string,
+	logger *logrus.Logger) (deliveryStats, error) {
+	totalSegments := runtimeFanoutSegments(ctx, sess, logger)
+	functionName := os.Getenv(envKeyDeliveryFunction)
+	if queueURL := os.Getenv(envKeyDeliveryQueueURL); queueURL != "" {
+		return enqueueSegments(ctx, sess, queueURL, endpointURL, requestID, payload, binary, excluded, filterSource, totalSegments, logger)
+	}
+	if totalSegments < 2 || functionName == "" {
+		bcast := newBroadcaster(ctx, sess, endpointURL, requestID, broadcastMessage, payload, logger)
+		bcast.frames.binary = binary
+		bcast.excluded = excluded
+		filterErr := bcast.filterBy(filterSource)
+		if filterErr != nil {
+			return deliveryStats{}, filterErr
+		}
+		queryErr := bcast.query(ctx, 0, 0)
+		return bcast.finish(ctx), queryErr
+	}
+	if topicARN := os.Getenv(envKeyFanoutTopicARN); topicARN != "" {
+		return publishSegments(ctx, sess, topicARN, endpointURL, requestID, payload, binary, excluded, filterSource, totalSegments, logger)
+	}
+	if stateMachineARN := os.Getenv(envKeyBroadcastStateMachineARN); stateMachineARN != "" {
+		return startBroadcastExecution(ctx, sess, stateMachineARN, endpointURL, requestID, payload, binary, excluded, filterSource, totalSegments, logger)
+	}
+
+	requests := make([]*segmentRequest, 0, totalSegments)
+	for segment := int64(0); segment < totalSegments; segment++ {
+		requests = append(requests, &segmentRequest{
+			EndpointURL:          endpointURL,
+			RequestID:            requestID,
+			Payload:              payload,
+			Binary:               binary,
+			Segment:              segment,
+			TotalSegments:        totalSegments,
+			ExcludedConnectionID: excluded,
+			Filter:               filterSource,
+		})
+	}
+	return invokeSegments(ctx, sess, functionName, requests, logger)
+}
+
+// invokeSegments concurrently invokes the delivery lambda for each segment
+// and aggregates the per-segment stats
+func invokeSegments(ctx context.Context,
+	sess *session.Session,
+	functionName string,
+	requests []*segmentRequest,
+	logger *logrus.Logger) (deliveryStats, error) {
+	lambdaClient := lambda.New(sess)
+	var waitGroup sync.WaitGroup
+	var mutex sync.Mutex
+	var stats deliveryStats
+	var segmentErrors []error
+	for _, eachRequest := range requests {
+		waitGroup.Add(1)
+		go func(request *segmentRequest) {
+			defer waitGroup.Done()
+			segmentStats, segmentErr := invokeSegment(ctx, lambdaClient, functionName, request)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if segmentErr != nil {
+				segmentErrors = append(segmentErrors, segmentErr)
+				logger.WithFields(logrus.Fields{
+					"Error":   segmentErr,
+					"Segment": request.Segment,
+				}).Warn("Failed to deliver segment")
+				return
+			}
+			stats.add(segmentStats)
+		}(eachRequest)
+	}
+	waitGroup.Wait()
+	if len(segmentErrors) != 0 {
+		return stats, fmt.Errorf("failed to deliver %d of %d segments: %s",
+			len(segmentErrors),
+			len(requests),
+			segmentErrors[0])
+	}
+	return stats, nil
+}
+
+// invokeSegment synchronously invokes the delivery lambda for the segment
+func invokeSegment(ctx context.Context,
+	lambdaClient *lambda.Lambda,
+	functionName string,
+	request *segmentRequest) (stats deliveryStats, err error) {
+	ctx, span := startSpan(ctx, "fanout.segment",
+		attribute.Int64(attributeSegment, request.Segment),
+		attribute.Int64(attributeTotalSegments, request.TotalSegments))
+	defer func() {
+		endSpan(span, err)
+	}()
+	request.TraceContext = injectTraceContext(ctx)
+	requestJSON, requestJSONErr := json.Marshal(request)
+	if requestJSONErr != nil {
+		return stats, requestJSONErr
+	}
+	invokeOutput, invokeErr := lambdaClient.InvokeWithContext(ctx, &lambda.InvokeInput{
+		FunctionName: aws.String(functionName),
+		Payload:      requestJSON,
+	})
+	if invokeErr != nil {
+		return stats, invokeErr
+	}
+	if invokeOutput.FunctionError != nil {
+		return stats, fmt.Errorf("%s: %s",
+			aws.StringValue(invokeOutput.FunctionError),
+			string(invokeOutput.Payload))
+	}
+	unmarshalErr := json.Unmarshal(invokeOutput.Payload, &stats)
+	return stats, unmarshalErr
+}
+
+// deliverSegment is the delivery lambda that handles one table segment
+func deliverSegment(ctx context.Context, request segmentRequest) (*deliveryStats, error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	ctx, finishInvocation := startInvocation(extractTraceContext(ctx, request.TraceContext),
+		"DeliverSegment",
+		attribute.Int64(attributeSegment, request.Segment),
+		attribute.Int64(attributeTotalSegments, request.TotalSegments))
+
+	// Operation
+	bcast := newBroadcaster(ctx,
+		sess,
+		request.EndpointURL,
+		request.RequestID,
+		broadcastMessage,
+		request.Payload,
+		logger)
+	bcast.frames.binary = request.Binary
+	bcast.excluded = request.ExcludedConnectionID
+	var queryErr error
+	if request.Tag != "" {
+		queryErr = bcast.queryTag(ctx,
+			newDynamoClient(sess),
+			request.Tag,
+			request.FirstConnectionID,
+			request.LastConnectionID)
+	} else {
+		queryErr = bcast.filterBy(request.Filter)
+		if queryErr == nil {
+			queryErr = bcast.query(ctx, request.Segment, request.TotalSegments)
+		}
+	}
+	stats := bcast.finish(ctx)
+	finishInvocation(queryErr)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	return &stats, nil
+}
+
+// annotateFanout lets the sender invoke the delivery lambda and propagates
+// the provision-time segment count
+func annotateFanout(sender *sparta.LambdaAWSInfo, delivery *sparta.LambdaAWSInfo) {
+	sender.RoleDefinition.Privileges = append(sender.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"lambda:InvokeFunction"},
+			Resource: gocf.GetAtt(delivery.LogicalResourceName(), "Arn"),
+		})
+	setEnvironment(sender, envKeyDeliveryFunction, gocf.Ref(delivery.LogicalResourceName()).String())
+	setEnvironment(sender, envKeyFanoutSegments, gocf.String(strconv.FormatInt(fanoutSegments(), 10)))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/appconfig"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Provision-time environment variables that identify the AppConfig
+	// configuration profile holding the feature flags. The application,
+	// environment, and profile are managed outside this stack so that flags
+	// can change without a deploy.
+	envKeyAppConfigApplication = "APPCONFIG_APPLICATION"
+	envKeyAppConfigEnvironment = "APPCONFIG_ENVIRONMENT"
+	envKeyAppConfigProfile     = "APPCONFIG_PROFILE"
+	// How long a warm container uses the flags before asking AppConfig for
+	// a newer version
+	featureFlagsTTL = 45 * time.Second
+	// Feature flag names
+	featureRooms         = "rooms"
+	featureHistoryReplay = "historyReplay"
+	featureModeration    = "moderation"
+	featureCompression   = "compression"
+	// featurePresenceNotifications broadcasts presence changes
+	featurePresenceNotifications = "presenceNotifications"
+	// featureReceipts tracks room and direct messages for acknowledgment
+	featureReceipts = "receipts"
+)
+
+// defaultFeatureFlags apply when AppConfig isn't configured, is unreachable,
+// or omits a flag
+var defaultFeatureFlags = map[string]bool{
+	featureRooms:                 true,
+	featureHistoryReplay:         false,
+	featureModeration:            false,
+	featureCompression:           true,
+	featurePresenceNotifications: false,
+	featureReceipts:              false,
+}
+
+// featureFlags caches the AppConfig feature flags for the life of the warm
+// container. It's safe for concurrent use.
+type featureFlags struct {
+	mutex     sync.Mutex
+	flags     map[string]bool
+	version   string
+	fetchedAt time.Time
+}
+
+// features is shared by every invocation in the container
+var features = &featureFlags{}
+
+// enabled returns whether the named feature is on, refreshing the cached
+// flags from AppConfig once they're older than featureFlagsTTL
+func (flags *featureFlags) enabled(ctx context.Context,
+	sess *session.Session,
+	name string,
+	logger *logrus.Logger) bool {
+	flags.mutex.Lock()
+	defer flags.mutex.Unlock()
+	if appConfigEnabled() &&
+		time.Since(flags.fetchedAt) > featureFlagsTTL {
+		refreshErr := flags.refresh(ctx, sess)
+		if refreshErr != nil {
+			logger.WithField("Error", refreshErr).Warn("Failed to refresh feature flags")
+		}
+		// Don't retry on every call while AppConfig is unavailable
+		flags.fetchedAt = time.Now()
+	}
+	if value, exists := flags.flags[name]; exists {
+		return value
+	}
+	return defaultFeatureFlags[name]
+}
+
+// refresh fetches the configuration if it has changed since the cached
+// version. AppConfig returns empty content when the version is current.
+func (flags *featureFlags) refresh(ctx context.Context, sess *session.Session) error {
+	getConfigOutput, getConfigErr := appconfig.New(sess).GetConfigurationWithContext(ctx,
+		&appconfig.GetConfigurationInput{
+			Application:                aws.String(os.Getenv(envKeyAppConfigApplication)),
+			Environment:                aws.String(os.Getenv(envKeyAppConfigEnvironment)),
+			Configuration:              aws.String(os.Getenv(envKeyAppConfigProfile)),
+			ClientId:                   aws.String(os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME")),
+			ClientConfigurationVersion: aws.String(flags.version),
+		})
+	if getConfigErr != nil {
+		return getConfigErr
+	}
+	if len(getConfigOutput.Content) == 0 {
+		return nil
+	}
+	parsedFlags := make(map[string]bool)
+	unmarshalErr := json.Unmarshal(getConfigOutput.Content, &parsedFlags)
+	if unmarshalErr != nil {
+		return unmarshalErr
+	}
+	flags.flags = parsedFlags
+	flags.version = aws.StringValue(getConfigOutput.ConfigurationVersion)
+	return nil
+}
+
+// appConfigEnabled returns true if feature flags are configured in the
+// provision-time environment
+func appConfigEnabled() bool {
+	return os.Getenv(envKeyAppConfigApplication) != ""
+}
+
+// annotateFeatureFlags lets the lambda read the feature flag configuration
+// and publishes its identifiers in the lambda environment
+func annotateFeatureFlags(lambdaFn *sparta.LambdaAWSInfo) {
+	application := os.Getenv(envKeyAppConfigApplication)
+	environment := os.Getenv(envKeyAppConfigEnvironment)
+	profile := os.Getenv(envKeyAppConfigProfile)
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"appconfig:GetConfiguration"},
+			Resource: gocf.Join("",
+				gocf.String("arn:"),
+				gocf.Ref("AWS::Partition"),
+				gocf.String(":appconfig:"),
+				gocf.Ref("AWS::Region"),
+				gocf.String(":"),
+				gocf.Ref("AWS::AccountId"),
+				gocf.String(":application/"+application+
+					"/environment/"+environment+
+					"/configuration/"+profile)),
+		})
+	setEnvironment(lambdaFn, envKeyAppConfigApplication, gocf.String(application))
+	setEnvironment(lambdaFn, envKeyAppConfigEnvironment, gocf.String(environment))
+	setEnvironment(lambdaFn, envKeyAppConfigProfile, gocf.String(profile))
+}
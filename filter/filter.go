@@ -0,0 +1,199 @@
+// Package filter parses and evaluates the attribute filter expressions that
+// narrow a broadcast to the connections whose attributes match, such as:
+//
+//	region=eu AND plan=pro
+//	(plan=pro OR plan=team) AND NOT region="us-east"
+//
+// A comparison is an attribute name, = or !=, and a value, which is quoted if
+// it isn't a bare word. A connection without the attribute doesn't equal any
+// value. NOT binds tighter than AND, which binds tighter than OR, and the
+// keywords are case insensitive.
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxLength bounds the expression source
+const MaxLength = 1024
+
+// Expression is a parsed filter expression
+type Expression interface {
+	// Match returns true if the attributes satisfy the expression
+	Match(attributes map[string]string) bool
+	// String returns the canonical expression source
+	String() string
+}
+
+// comparison matches an attribute against a value
+type comparison struct {
+	name   string
+	value  string
+	negate bool
+}
+
+func (expr *comparison) Match(attributes map[string]string) bool {
+	value, exists := attributes[expr.name]
+	return (exists && value == expr.value) != expr.negate
+}
+
+func (expr *comparison) String() string {
+	operator := "="
+	if expr.negate {
+		operator = "!="
+	}
+	return expr.name + operator + fmt.Sprintf("%q", expr.value)
+}
+
+// not negates its operand
+type not struct {
+	operand Expression
+}
+
+func (expr *not) Match(attributes map[string]string) bool {
+	return !expr.operand.Match(attributes)
+}
+
+func (expr *not) String() string {
+	return "NOT " + expr.operand.String()
+}
+
+// junction is a conjunction or disjunction of its operands
+type junction struct {
+	all      bool
+	operands []Expression
+}
+
+func (expr *junction) Match(attributes map[string]string) bool {
+	for _, eachOperand := range expr.operands {
+		if eachOperand.Match(attributes) != expr.all {
+			return !expr.all
+		}
+	}
+	return expr.all
+}
+
+func (expr *junction) String() string {
+	keyword := " OR "
+	if expr.all {
+		keyword = " AND "
+	}
+	operands := make([]string, 0, len(expr.operands))
+	for _, eachOperand := range expr.operands {
+		operands = append(operands, eachOperand.String())
+	}
+	return "(" + strings.Join(operands, keyword) + ")"
+}
+
+// Parse returns the expression for the source
+func Parse(source string) (Expression, error) {
+	if len(source) > MaxLength {
+		return nil, fmt.Errorf("filter exceeds %d characters", MaxLength)
+	}
+	tokens, tokensErr := tokenize(source)
+	if tokensErr != nil {
+		return nil, tokensErr
+	}
+	parser := &parser{
+		tokens: tokens,
+	}
+	expr, exprErr := parser.or()
+	if exprErr != nil {
+		return nil, exprErr
+	}
+	if next := parser.peek(); next.kind != tokenEnd {
+		return nil, fmt.Errorf("unexpected %s at offset %d", next, next.offset)
+	}
+	return expr, nil
+}
+
+// parser is a recursive descent parser of the tokens
+type parser struct {
+	tokens   []token
+	position int
+}
+
+func (parser *parser) peek() token {
+	return parser.tokens[parser.position]
+}
+
+func (parser *parser) next() token {
+	next := parser.tokens[parser.position]
+	if next.kind != tokenEnd {
+		parser.position++
+	}
+	return next
+}
+
+// or parses a disjunction of conjunctions
+func (parser *parser) or() (Expression, error) {
+	return parser.junction(false, "OR", parser.and)
+}
+
+// and parses a conjunction of unary expressions
+func (parser *parser) and() (Expression, error) {
+	return parser.junction(true, "AND", parser.unary)
+}
+
+func (parser *parser) junction(all bool, keyword string, operand func() (Expression, error)) (Expression, error) {
+	first, firstErr := operand()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	operands := []Expression{first}
+	for parser.peek().keyword(keyword) {
+		parser.next()
+		eachOperand, eachOperandErr := operand()
+		if eachOperandErr != nil {
+			return nil, eachOperandErr
+		}
+		operands = append(operands, eachOperand)
+	}
+	if len(operands) == 1 {
+		return first, nil
+	}
+	return &junction{
+		all:      all,
+		operands: operands,
+	}, nil
+}
+
+// unary parses a negation, a parenthesized expression, or a comparison
+func (parser *parser) unary() (Expression, error) {
+	next := parser.next()
+	switch {
+	case next.keyword("NOT"):
+		operand, operandErr := parser.unary()
+		if operandErr != nil {
+			return nil, operandErr
+		}
+		return &not{
+			operand: operand,
+		}, nil
+	case next.kind == tokenOpen:
+		expr, exprErr := parser.or()
+		if exprErr != nil {
+			return nil, exprErr
+		}
+		if closing := parser.next(); closing.kind != tokenClose {
+			return nil, fmt.Errorf("expected ) at offset %d", closing.offset)
+		}
+		return expr, nil
+	case next.kind == tokenWord && !next.reserved():
+		operator := parser.next()
+		if operator.kind != tokenEquals && operator.kind != tokenNotEquals {
+			return nil, fmt.Errorf("expected = or != after %q at offset %d", next.text, operator.offset)
+		}
+		value := parser.next()
+		if (value.kind != tokenWord || value.reserved()) && value.kind != tokenQuoted {
+			return nil, fmt.Errorf("expected a value for %q at offset %d", next.text, value.offset)
+		}
+		return &comparison{
+			name:   next.text,
+			value:  value.text,
+			negate: operator.kind == tokenNotEquals,
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected %s at offset %d", next, next.offset)
+}
@@ -0,0 +1,105 @@
+package filter
+
+import (
+	"testing"
+)
+
+func TestParseMatch(t *testing.T) {
+	attributes := map[string]string{
+		"region": "eu",
+		"plan":   "pro",
+		"zone":   "us-east",
+	}
+	tests := []struct {
+		name   string
+		source string
+		match  bool
+	}{
+		{"equals", "region=eu", true},
+		{"equals other value", "region=us", false},
+		{"missing attribute", "tier=gold", false},
+		{"not equals", "plan!=team", true},
+		{"not equals missing attribute", "tier!=gold", true},
+		{"quoted value", `zone="us-east"`, true},
+		{"single quoted value", `zone='us-east'`, true},
+		{"and", "region=eu AND plan=pro", true},
+		{"and false", "region=eu AND plan=team", false},
+		{"or", "region=us OR plan=pro", true},
+		{"or false", "region=us OR plan=team", false},
+		{"not", "NOT region=us", true},
+		{"lowercase keywords", "region=eu and not plan=team", true},
+		{"and binds tighter than or", "region=us AND plan=team OR zone=us-east", true},
+		{"parentheses", "region=us AND (plan=team OR zone=us-east)", false},
+		{"nested", "(plan=pro OR plan=team) AND NOT region=\"us-east\"", true},
+		{"quoted keyword value", `plan="and"`, false},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			expr, parseErr := Parse(eachTest.source)
+			if parseErr != nil {
+				t.Fatalf("Parse(%q) failed: %s", eachTest.source, parseErr)
+			}
+			if match := expr.Match(attributes); match != eachTest.match {
+				t.Errorf("Parse(%q).Match() = %t, want %t", eachTest.source, match, eachTest.match)
+			}
+		})
+	}
+}
+
+func TestParseString(t *testing.T) {
+	tests := []struct {
+		source    string
+		canonical string
+	}{
+		{"region=eu", `region="eu"`},
+		{"plan != team", `plan!="team"`},
+		{"a=1 and b=2 or c=3", `((a="1" AND b="2") OR c="3")`},
+		{"not (a=1 or b=2)", `NOT (a="1" OR b="2")`},
+	}
+	for _, eachTest := range tests {
+		expr, parseErr := Parse(eachTest.source)
+		if parseErr != nil {
+			t.Fatalf("Parse(%q) failed: %s", eachTest.source, parseErr)
+		}
+		if canonical := expr.String(); canonical != eachTest.canonical {
+			t.Errorf("Parse(%q).String() = %q, want %q", eachTest.source, canonical, eachTest.canonical)
+		}
+		// The canonical source parses to the same expression
+		reparsed, reparseErr := Parse(expr.String())
+		if reparseErr != nil {
+			t.Fatalf("Parse(%q) failed: %s", expr.String(), reparseErr)
+		}
+		if reparsed.String() != expr.String() {
+			t.Errorf("Parse(%q).String() = %q, want %q", expr.String(), reparsed.String(), expr.String())
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"empty", ""},
+		{"whitespace", "   "},
+		{"missing operator", "region"},
+		{"missing value", "region="},
+		{"keyword value", "region=AND"},
+		{"keyword name", "AND=eu"},
+		{"unterminated string", `region="eu`},
+		{"unbalanced parenthesis", "(region=eu"},
+		{"unexpected parenthesis", "region=eu)"},
+		{"trailing junction", "region=eu AND"},
+		{"unexpected character", "region=eu & plan=pro"},
+		{"bare not equals", "region!eu"},
+		{"too long", "region=" + string(make([]byte, MaxLength))},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			expr, parseErr := Parse(eachTest.source)
+			if parseErr == nil {
+				t.Errorf("Parse(%q) = %s, want an error", eachTest.source, expr)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenWord
+	tokenQuoted
+	tokenEquals
+	tokenNotEquals
+	tokenOpen
+	tokenClose
+)
+
+// token is a lexical token of the expression source
+type token struct {
+	kind   tokenKind
+	text   string
+	offset int
+}
+
+// keyword returns true if the token is the case insensitive keyword
+func (tok token) keyword(keyword string) bool {
+	return tok.kind == tokenWord && strings.EqualFold(tok.text, keyword)
+}
+
+// reserved returns true if the token is a keyword, which must be quoted to
+// be used as a value
+func (tok token) reserved() bool {
+	return tok.keyword("AND") || tok.keyword("OR") || tok.keyword("NOT")
+}
+
+func (tok token) String() string {
+	switch tok.kind {
+	case tokenEnd:
+		return "end of filter"
+	case tokenQuoted:
+		return fmt.Sprintf("%q", tok.text)
+	}
+	return tok.text
+}
+
+// wordCharacter returns true if the character can appear in a bare word
+func wordCharacter(char byte) bool {
+	return char >= 'a' && char <= 'z' ||
+		char >= 'A' && char <= 'Z' ||
+		char >= '0' && char <= '9' ||
+		char == '_' || char == '-' || char == '.' || char == ':'
+}
+
+// tokenize splits the source into tokens, ending with a tokenEnd
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	for offset := 0; offset < len(source); {
+		char := source[offset]
+		switch {
+		case char == ' ' || char == '\t' || char == '\n' || char == '\r':
+			offset++
+		case char == '(':
+			tokens = append(tokens, token{kind: tokenOpen, text: "(", offset: offset})
+			offset++
+		case char == ')':
+			tokens = append(tokens, token{kind: tokenClose, text: ")", offset: offset})
+			offset++
+		case char == '=':
+			tokens = append(tokens, token{kind: tokenEquals, text: "=", offset: offset})
+			offset++
+		case char == '!' && offset+1 < len(source) && source[offset+1] == '=':
+			tokens = append(tokens, token{kind: tokenNotEquals, text: "!=", offset: offset})
+			offset += 2
+		case char == '"' || char == '\'':
+			var text strings.Builder
+			end := offset + 1
+			for ; end < len(source) && source[end] != char; end++ {
+				if source[end] == '\\' && end+1 < len(source) {
+					end++
+				}
+				text.WriteByte(source[end])
+			}
+			if end == len(source) {
+				return nil, fmt.Errorf("unterminated string at offset %d", offset)
+			}
+			tokens = append(tokens, token{kind: tokenQuoted, text: text.String(), offset: offset})
+			offset = end + 1
+		case wordCharacter(char):
+			end := offset
+			for end < len(source) && wordCharacter(source[end]) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: source[offset:end], offset: offset})
+			offset = end
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", char, offset)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("filter is empty")
+	}
+	return append(tokens, token{kind: tokenEnd, offset: len(source)}), nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	spartaAWS "github.com/mweagle/Sparta/aws"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+// envKeyFIPSEndpoints switches every AWS client to FIPS 140-2 endpoints. It's
+// read at provision time and propagated to the lambda environments.
+const envKeyFIPSEndpoints = "USE_FIPS_ENDPOINTS"
+
+// fipsServices are the services the handlers call that publish
+// `{service}-fips.{region}` endpoints
+var fipsServices = map[string]bool{
+	endpoints.DynamodbServiceID: true,
+	endpoints.S3ServiceID:       true,
+}
+
+// partitionlessArn matches ARN literals that hardcode the commercial partition
+var partitionlessArn = regexp.MustCompile(`"arn:aws:[^"]*`)
+
+// fipsEnabled returns true if USE_FIPS_ENDPOINTS is set
+func fipsEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(envKeyFIPSEndpoints))
+	return enabled
+}
+
+// fipsResolver resolves FIPS endpoints for services that support them and
+// falls back to the default endpoint otherwise
+func fipsResolver(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+	resolved, resolvedErr := endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	if resolvedErr != nil || !fipsServices[service] {
+		return resolved, resolvedErr
+	}
+	// GovCloud endpoints are FIPS validated by default
+	partition, partitionExists := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if partitionExists && partition.ID() == endpoints.AwsUsGovPartitionID {
+		return resolved, nil
+	}
+	resolved.URL = strings.Replace(resolved.URL,
+		fmt.Sprintf("://%s.", service),
+		fmt.Sprintf("://%s-fips.", service),
+		1)
+	return resolved, nil
+}
+
+// newAWSSession returns the session the handlers use for every AWS client.
+// The session is created by the first invocation and reused by the warm
+// container's later invocations, along with the clients created from it, so
+// it logs without the first invocation's correlation ID. Handlers log their
+// requests' failures with their own logger.
+func newAWSSession(logger *logrus.Logger) *session.Session {
+	sharedSessionOnce.Do(func() {
+		logger = uncorrelatedLogger(logger)
+		sess := spartaAWS.NewSession(logger)
+		if fipsEnabled() {
+			sess = sess.Copy(&aws.Config{
+				EndpointResolver: endpoints.ResolverFunc(fipsResolver),
+			})
+		}
+		sharedSession = xraySession(sess, logger)
+	})
+	return sharedSession
+}
+
+// annotateFIPS propagates the FIPS switch to the lambda environment
+func annotateFIPS(lambdaFn *sparta.LambdaAWSInfo) {
+	setEnvironment(lambdaFn, envKeyFIPSEndpoints, gocf.String("true"))
+}
+
+// partitionValidationDecorator rejects templates that include ARN literals
+// bound to the commercial `aws` partition, which fail to deploy in GovCloud.
+// ARNs should use the AWS::Partition pseudo parameter instead.
+func partitionValidationDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	templateJSON, templateJSONErr := json.Marshal(template)
+	if templateJSONErr != nil {
+		return templateJSONErr
+	}
+	matches := partitionlessArn.FindAllString(string(templateJSON), -1)
+	if len(matches) != 0 {
+		return fmt.Errorf("template includes partition specific ARNs: %s",
+			strings.Join(matches, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/mweagle/SpartaWebSocket/protocol"
+)
+
+// frameCacheEntry lazily computes a single cached value
+type frameCacheEntry struct {
+	once  sync.Once
+	frame *outboundFrame
+	err   error
+}
+
+// frameCache serializes a broadcast payload exactly once per encoding and
+// compresses and stages it exactly once per negotiation. The returned frames
+// are shared by every recipient and must be treated as read-only. It's safe
+// for concurrent use by delivery goroutines.
+type frameCache struct {
+	message       string
+	correlationID string
+	data          json.RawMessage
+	stager        *payloadStager
+	// binary is true if data is the JSON form of an opaque binary payload,
+	// which JSON connections receive as the binary frame the sender posted
+	binary bool
+
+	mutex       sync.Mutex
+	encoded     map[protocol.Encoding]*frameCacheEntry
+	deliverable map[protocol.Negotiation]*frameCacheEntry
+}
+
+func newFrameCache(message string,
+	correlationID string,
+	data json.RawMessage,
+	stager *payloadStager) *frameCache {
+	return &frameCache{
+		message:       message,
+		correlationID: correlationID,
+		data:          data,
+		stager:        stager,
+		encoded:       make(map[protocol.Encoding]*frameCacheEntry),
+		deliverable:   make(map[protocol.Negotiation]*frameCacheEntry),
+	}
+}
+
+// entry returns the (possibly new) cache entry for the key
+func (cache *frameCache) entry(encoding protocol.Encoding,
+	negotiation *protocol.Negotiation) *frameCacheEntry {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if negotiation == nil {
+		if cache.encoded[encoding] == nil {
+			cache.encoded[encoding] = &frameCacheEntry{}
+		}
+		return cache.encoded[encoding]
+	}
+	if cache.deliverable[*negotiation] == nil {
+		cache.deliverable[*negotiation] = &frameCacheEntry{}
+	}
+	return cache.deliverable[*negotiation]
+}
+
+// encodedFrame returns the uncompressed frame for the encoding
+func (cache *frameCache) encodedFrame(encoding protocol.Encoding) (*outboundFrame, error) {
+	entry := cache.entry(encoding, nil)
+	entry.once.Do(func() {
+		encode := protocol.Encode
+		if cache.binary {
+			encode = protocol.EncodeBinary
+		}
+		frame, frameErr := encode(protocol.CodecFor(encoding),
+			cache.message,
+			cache.correlationID,
+			cache.data)
+		entry.frame = &outboundFrame{
+			frame: frame,
+		}
+		entry.err = frameErr
+	})
+	return entry.frame, entry.err
+}
+
+// frame returns the deliverable frame for the negotiation
+func (cache *frameCache) frame(ctx context.Context,
+	negotiation protocol.Negotiation) (*outboundFrame, error) {
+	entry := cache.entry(negotiation.Encoding, &negotiation)
+	entry.once.Do(func() {
+		encoded, encodedErr := cache.encodedFrame(negotiation.Encoding)
+		if encodedErr != nil {
+			entry.err = encodedErr
+			return
+		}
+		compressed, compressedErr := protocol.Compress(negotiation.Compression, encoded.frame)
+		if compressedErr != nil {
+			entry.err = compressedErr
+			return
+		}
+		entry.frame, entry.err = cache.stager.deliverableFrame(ctx, negotiation, &outboundFrame{
+			frame: compressed,
+		})
+	})
+	return entry.frame, entry.err
+}
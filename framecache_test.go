@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/mweagle/SpartaWebSocket/protocol"
+)
+
+func TestFrameCacheBinary(t *testing.T) {
+	binaryForm, _ := protocol.BinaryData([]byte("hello"))
+	tests := []struct {
+		name     string
+		data     json.RawMessage
+		binary   bool
+		encoding protocol.Encoding
+		frame    string
+	}{
+		{"binary payload", binaryForm, true, protocol.EncodingJSON, "hello"},
+		{"text with the binary form", binaryForm, false, protocol.EncodingJSON, string(binaryForm)},
+		{"JSON text", json.RawMessage(`"hello"`), false, protocol.EncodingJSON, `"hello"`},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			cache := newFrameCache(broadcastMessage, "request-1", eachTest.data, nil)
+			cache.binary = eachTest.binary
+			encoded, encodedErr := cache.encodedFrame(eachTest.encoding)
+			if encodedErr != nil {
+				t.Fatalf("encodedFrame failed: %s", encodedErr)
+			}
+			if string(encoded.frame) != eachTest.frame {
+				t.Errorf("Frame = %q, want %q", encoded.frame, eachTest.frame)
+			}
+		})
+	}
+	// Other encodings carry the binary form as the frame data
+	cache := newFrameCache(broadcastMessage, "request-1", binaryForm, nil)
+	cache.binary = true
+	encoded, encodedErr := cache.encodedFrame(protocol.EncodingMessagePack)
+	if encodedErr != nil {
+		t.Fatalf("encodedFrame failed: %s", encodedErr)
+	}
+	data, decodeErr := protocol.CodecFor(protocol.EncodingMessagePack).Decode(encoded.frame)
+	if decodeErr != nil {
+		t.Fatalf("Decode failed: %s", decodeErr)
+	}
+	var binary struct {
+		Type string `json:"type"`
+		Data []byte `json:"data"`
+	}
+	if json.Unmarshal(data, &binary) != nil || binary.Type != protocol.BinaryType || string(binary.Data) != "hello" {
+		t.Errorf("MessagePack data = %s, want the binary form", data)
+	}
+}
+
+func TestFrameCacheCompression(t *testing.T) {
+	data := json.RawMessage(`{"text":"hello"}`)
+	cache := newFrameCache(broadcastMessage, "request-1", data, nil)
+	for _, eachCompression := range []protocol.Compression{protocol.CompressionGzip, protocol.CompressionDeflate} {
+		negotiation := protocol.Negotiation{
+			Encoding:    protocol.EncodingJSON,
+			Compression: eachCompression,
+		}
+		deliverable, deliverableErr := cache.frame(context.Background(), negotiation)
+		if deliverableErr != nil {
+			t.Fatalf("frame(%s) failed: %s", eachCompression, deliverableErr)
+		}
+		decompressed, decompressErr := protocol.Decompress(eachCompression, deliverable.frame)
+		if decompressErr != nil || string(decompressed) != string(data) {
+			t.Errorf("Decompressed %s frame = %s (%v), want %s", eachCompression, decompressed, decompressErr, data)
+		}
+		// Recipients with the same negotiation share the frame
+		if cached, _ := cache.frame(context.Background(), negotiation); cached != deliverable {
+			t.Errorf("%s frame wasn't cached", eachCompression)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	apigwManagement "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	apigwManagementIface "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi/apigatewaymanagementapiiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/mweagle/SpartaWebSocket/graphqlws"
+	"github.com/mweagle/SpartaWebSocket/protocol"
+	"github.com/mweagle/SpartaWebSocket/topics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	headerWebSocketProtocol = "Sec-WebSocket-Protocol"
+	// ddbAttributeOperations maps a graphql-ws connection's operation IDs to
+	// their topic patterns. connection_init creates it, so it only exists
+	// once the connection is acknowledged.
+	ddbAttributeOperations = "operations"
+	// Topic subscriptions of graphql-ws operations record the operation and
+	// the response key of the next messages
+	ddbAttributeOperationID = "operationId"
+	ddbAttributeResponseKey = "responseKey"
+	// graphqlTopicField is the subscription root field that subscribes to
+	// the topics matching its pattern argument
+	graphqlTopicField      = "topic"
+	graphqlPatternArgument = "pattern"
+	maxGraphQLOperations   = 32
+)
+
+// operationIDPattern matches the operation IDs that can be stored in the
+// subscription table's range key, which separates its values with spaces
+var operationIDPattern = regexp.MustCompile(`^[\x21-\x7e]{1,64}$`)
+
+// handshakeSubprotocol returns the graphql-ws subprotocol if the $connect
+// Sec-WebSocket-Protocol header requests it, or the empty string
+func handshakeSubprotocol(request awsEvents.APIGatewayWebsocketProxyRequest) string {
+	for eachName, eachValue := range request.Headers {
+		if strings.EqualFold(eachName, headerWebSocketProtocol) && graphqlws.Requested(eachValue) {
+			return graphqlws.Subprotocol
+		}
+	}
+	return ""
+}
+
+// subprotocolNegotiation returns the negotiation of a subprotocol
+// connection. graphql-ws frames are uncompressed JSON text, regardless of
+// the accept-encodings parameter.
+func subprotocolNegotiation(subprotocol string) protocol.Negotiation {
+	return protocol.Negotiation{
+		Encoding:    protocol.EncodingJSON,
+		Compression: protocol.CompressionNone,
+		Subprotocol: subprotocol,
+	}
+}
+
+// operationSubscriber returns the subscription table subscriber of the
+// connection's graphql-ws operation
+func operationSubscriber(connectionID string, operationID string) string {
+	return connectionID + " " + operationID
+}
+
+// graphQLConnection handles a single graphql-ws frame
+type graphQLConnection struct {
+	request         awsEvents.APIGatewayWebsocketProxyRequest
+	sess            *session.Session
+	apigwMgmtClient apigwManagementIface.ApiGatewayManagementApiAPI
+	logger          *logrus.Logger
+}
+
+// withSubprotocol hands every frame from a graphql-ws connection to
+// handleGraphQLFrame, whichever route its body selected, so that the client
+// only ever receives graphql-ws messages. Frames that aren't graphql-ws
+// messages, such as {"message": "sendmessage"}, close the connection as the
+// subprotocol requires. The sender item is kept for the handler.
+func withSubprotocol(handler wsHandler) wsHandler {
+	return func(ctx context.Context,
+		request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+		logger := contextLogger(ctx)
+		sess := newAWSSession(logger)
+		senderItem, senderItemErr := senderConnectionItem(ctx, request, newConnectionsClient(sess))
+		if senderItemErr != nil {
+			// The handler reports the failed read
+			return handler(ctx, request)
+		}
+		if itemNegotiation(senderItem).Subprotocol != graphqlws.Subprotocol {
+			return handler(withSenderItem(ctx, senderItem), request)
+		}
+		apigwMgmtClient := newManagementClient(sess, managementEndpoint(request.RequestContext))
+		return handleGraphQLFrame(ctx, request, sess, apigwMgmtClient, logger), nil
+	}
+}
+
+// handleGraphQLFrame handles the frames of graphql-ws connections, which
+// name their message type rather than a route. Operations are
+// subscriptions to the topics that match the topic field's pattern, eg:
+//
+//	subscription { topic(pattern: "orders.#") { topic data } }
+func handleGraphQLFrame(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	sess *session.Session,
+	apigwMgmtClient apigwManagementIface.ApiGatewayManagementApiAPI,
+	logger *logrus.Logger) *wsResponse {
+	conn := &graphQLConnection{
+		request:         request,
+		sess:            sess,
+		apigwMgmtClient: apigwMgmtClient,
+		logger:          logger,
+	}
+	var message graphqlws.Message
+	if json.Unmarshal([]byte(request.Body), &message) != nil {
+		return conn.close(ctx, "invalid message received")
+	}
+	var handleErr error
+	switch message.Type {
+	case graphqlws.TypeConnectionInit:
+		handleErr = conn.initialize(ctx)
+	case graphqlws.TypePing:
+		handleErr = conn.post(ctx, graphqlws.TypePong, "", nil)
+	case graphqlws.TypePong:
+	case graphqlws.TypeSubscribe:
+		handleErr = conn.subscribe(ctx, &message)
+	case graphqlws.TypeComplete:
+		handleErr = conn.complete(ctx, message.ID)
+	default:
+		return conn.close(ctx, fmt.Sprintf("unsupported message type: %q", message.Type))
+	}
+	if handleErr != nil {
+		conn.logger.WithFields(logrus.Fields{
+			"Error": handleErr,
+			"Type":  message.Type,
+		}).Warn("Failed to handle graphql-ws message")
+		return &wsResponse{
+			StatusCode: 500,
+			Body:       handleErr.Error(),
+		}
+	}
+	return &wsResponse{
+		StatusCode: 200,
+	}
+}
+
+// post sends the graphql-ws message to the connection
+func (conn *graphQLConnection) post(ctx context.Context,
+	messageType string,
+	id string,
+	payload interface{}) error {
+	frame, frameErr := graphqlws.Encode(messageType, id, payload)
+	if frameErr != nil {
+		return frameErr
+	}
+	return conn.postFrame(ctx, frame)
+}
+
+// postFrame sends the encoded graphql-ws message to the connection
+func (conn *graphQLConnection) postFrame(ctx context.Context, frame []byte) error {
+	_, postErr := conn.apigwMgmtClient.PostToConnectionWithContext(ctx,
+		&apigwManagement.PostToConnectionInput{
+			ConnectionId: aws.String(conn.request.RequestContext.ConnectionID),
+			Data:         frame,
+		})
+	return postErr
+}
+
+// close disconnects a client that violated the subprotocol. The gateway
+// can't close connections with the subprotocol's close codes, so the reason
+// is only logged.
+func (conn *graphQLConnection) close(ctx context.Context, reason string) *wsResponse {
+	conn.logger.WithField("Reason", reason).Warn("Closing graphql-ws connection")
+	_, deleteErr := conn.apigwMgmtClient.DeleteConnectionWithContext(ctx,
+		&apigwManagement.DeleteConnectionInput{
+			ConnectionId: aws.String(conn.request.RequestContext.ConnectionID),
+		})
+	if deleteErr != nil {
+		conn.logger.WithField("Error", deleteErr).Warn("Failed to close graphql-ws connection")
+	}
+	return &wsResponse{
+		StatusCode: 400,
+		Body:       reason,
+	}
+}
+
+// updateOperations applies the update expression to the connection item's
+// operations. It returns false if the condition fails.
+func (conn *graphQLConnection) updateOperations(ctx context.Context,
+	updateExpression string,
+	conditionExpression string,
+	names map[string]*string,
+	values map[string]*dynamodb.AttributeValue) (bool, error) {
+	names["#connectionID"] = aws.String(ddbAttributeConnectionID)
+	names["#operations"] = aws.String(ddbAttributeOperations)
+	updateOutput, updateErr := newConnectionsClient(conn.sess).UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv(envKeyTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			ddbAttributeConnectionID: &dynamodb.AttributeValue{
+				S: aws.String(conn.request.RequestContext.ConnectionID),
+			},
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String("attribute_exists(#connectionID) AND " + conditionExpression),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if conditionalCheckFailed(updateErr) {
+		return false, nil
+	}
+	if updateErr != nil {
+		return false, updateErr
+	}
+	// Keep the Redis connection store's copy current for deliveries
+	indexErr := reindexConnection(ctx, conn.request.RequestContext.ConnectionID, updateOutput.Attributes)
+	if indexErr != nil {
+		conn.logger.WithField("Error", indexErr).Warn("Failed to index connection operations")
+	}
+	return true, nil
+}
+
+// operations returns the connection item's operations, or nil if the
+// connection isn't acknowledged. The read is strongly consistent, since
+// clients subscribe as soon as they're acknowledged.
+func (conn *graphQLConnection) operations(ctx context.Context) (map[string]*dynamodb.AttributeValue, error) {
+	getItemOutput, getItemErr := newConnectionsClient(conn.sess).GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(os.Getenv(envKeyTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			ddbAttributeConnectionID: &dynamodb.AttributeValue{
+				S: aws.String(conn.request.RequestContext.ConnectionID),
+			},
+		},
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#operations"),
+		ExpressionAttributeNames: map[string]*string{
+			"#operations": aws.String(ddbAttributeOperations),
+		},
+	})
+	if getItemErr != nil {
+		return nil, getItemErr
+	}
+	operations := getItemOutput.Item[ddbAttributeOperations]
+	if operations == nil || operations.M == nil {
+		return nil, nil
+	}
+	return operations.M, nil
+}
+
+// initialize acknowledges the connection_init message. Clients authenticate
+// at $connect, so the init payload is ignored.
+func (conn *graphQLConnection) initialize(ctx context.Context) error {
+	initialized, updateErr := conn.updateOperations(ctx,
+		"SET #operations = :operations",
+		"attribute_not_exists(#operations)",
+		map[string]*string{},
+		map[string]*dynamodb.AttributeValue{
+			":operations": &dynamodb.AttributeValue{
+				M: map[string]*dynamodb.AttributeValue{},
+			},
+		})
+	if updateErr != nil {
+		return updateErr
+	}
+	if !initialized {
+		conn.close(ctx, "too many initialization requests")
+		return nil
+	}
+	return conn.post(ctx, graphqlws.TypeConnectionAck, "", nil)
+}
+
+// operationPattern returns the topic pattern of the operation, or the
+// errors that reject it
+func operationPattern(payload *graphqlws.SubscribePayload) (*graphqlws.Operation, string, error) {
+	operation, parseErr := graphqlws.Parse(payload)
+	if parseErr != nil {
+		return nil, "", parseErr
+	}
+	if operation.Field.Name != graphqlTopicField {
+		return nil, "", fmt.Errorf("unknown subscription field: %q", operation.Field.Name)
+	}
+	pattern, patternErr := operation.Field.StringArgument(graphqlPatternArgument)
+	if patternErr != nil {
+		return nil, "", patternErr
+	}
+	patternErr = topics.ValidatePattern(pattern)
+	if patternErr != nil {
+		return nil, "", patternErr
+	}
+	return operation, pattern, nil
+}
+
+// subscribe records the operation with the connection and subscribes it to
+// the topic pattern. Operations that can't be resolved are rejected with an
+// error message.
+func (conn *graphQLConnection) subscribe(ctx context.Context, message *graphqlws.Message) error {
+	// Preconditions
+	operations, operationsErr := conn.operations(ctx)
+	if operationsErr != nil {
+		return operationsErr
+	}
+	if operations == nil {
+		conn.close(ctx, "unauthorized")
+		return nil
+	}
+	if !operationIDPattern.MatchString(message.ID) {
+		conn.close(ctx, "invalid operation id")
+		return nil
+	}
+	var payload graphqlws.SubscribePayload
+	if json.Unmarshal(message.Payload, &payload) != nil {
+		conn.close(ctx, "invalid subscribe payload")
+		return nil
+	}
+	operation, pattern, operationErr := operationPattern(&payload)
+	if operationErr == nil && len(operations) >= maxGraphQLOperations {
+		operationErr = fmt.Errorf("connections have at most %d subscriptions", maxGraphQLOperations)
+	}
+	if operationErr != nil {
+		rejection, rejectionErr := graphqlws.Errors(message.ID, operationErr)
+		if rejectionErr != nil {
+			return rejectionErr
+		}
+		return conn.postFrame(ctx, rejection)
+	}
+
+	// Operation
+	added, updateErr := conn.updateOperations(ctx,
+		"SET #operations.#id = :pattern",
+		"attribute_exists(#operations) AND attribute_not_exists(#operations.#id)",
+		map[string]*string{
+			"#id": aws.String(message.ID),
+		},
+		map[string]*dynamodb.AttributeValue{
+			":pattern": &dynamodb.AttributeValue{
+				S: aws.String(pattern),
+			},
+		})
+	if updateErr != nil {
+		return updateErr
+	}
+	if !added {
+		conn.close(ctx, fmt.Sprintf("subscriber for %s already exists", message.ID))
+		return nil
+	}
+	connectionID := conn.request.RequestContext.ConnectionID
+	subscriptionItem := subscriptionKey(pattern, operationSubscriber(connectionID, message.ID))
+	subscriptionItem[ddbAttributeTopicPattern] = &dynamodb.AttributeValue{
+		S: aws.String(pattern),
+	}
+	subscriptionItem[ddbAttributeConnectionID] = &dynamodb.AttributeValue{
+		S: aws.String(connectionID),
+	}
+	subscriptionItem[ddbAttributeOperationID] = &dynamodb.AttributeValue{
+		S: aws.String(message.ID),
+	}
+	subscriptionItem[ddbAttributeResponseKey] = &dynamodb.AttributeValue{
+		S: aws.String(operation.Field.ResponseKey()),
+	}
+	subscriptionItem[ddbAttributeSubprotocol] = &dynamodb.AttributeValue{
+		S: aws.String(graphqlws.Subprotocol),
+	}
+	_, putItemErr := newDynamoClient(conn.sess).PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(os.Getenv(envKeySubscriptionsTableName)),
+		Item:      subscriptionItem,
+	})
+	if putItemErr != nil {
+		return putItemErr
+	}
+	conn.logger.WithFields(logrus.Fields{
+		"OperationID": message.ID,
+		"Pattern":     pattern,
+	}).Debug("Subscribed graphql-ws operation")
+	return nil
+}
+
+// complete stops the operation. Unknown operations are ignored, since the
+// client and server may complete an operation at the same time.
+func (conn *graphQLConnection) complete(ctx context.Context, operationID string) error {
+	operations, operationsErr := conn.operations(ctx)
+	if operationsErr != nil {
+		return operationsErr
+	}
+	pattern := itemString(operations, operationID)
+	if pattern == "" {
+		return nil
+	}
+	_, updateErr := conn.updateOperations(ctx,
+		"REMOVE #operations.#id",
+		"attribute_exists(#operations)",
+		map[string]*string{
+			"#id": aws.String(operationID),
+		},
+		nil)
+	if updateErr != nil {
+		return updateErr
+	}
+	_, deleteErr := deleteSubscription(ctx,
+		pattern,
+		operationSubscriber(conn.request.RequestContext.ConnectionID, operationID),
+		newDynamoClient(conn.sess))
+	return deleteErr
+}
+
+// deliverOperation queues the topic frame data for the graphql-ws operation
+// of the subscription item as a next message
+func deliverOperation(ctx context.Context,
+	bcast *broadcaster,
+	item map[string]*dynamodb.AttributeValue,
+	frameData json.RawMessage) {
+	frame, frameErr := graphqlws.Next(itemString(item, ddbAttributeOperationID),
+		itemString(item, ddbAttributeResponseKey),
+		frameData)
+	if frameErr != nil {
+		bcast.logger.WithField("Error", frameErr).Warn("Failed to encode graphql-ws frame")
+		return
+	}
+	bcast.deliverFrame(ctx, item, frame)
+}
@@ -0,0 +1,106 @@
+// Package graphqlws implements the message types of the graphql-ws
+// (graphql-transport-ws) subprotocol, with which off-the-shelf GraphQL
+// subscription clients exchange JSON text frames such as:
+//
+//	{"type": "connection_init"}
+//	{"id": "1", "type": "subscribe", "payload": {"query": "subscription { topic(pattern: \"orders.#\") { topic data } }"}}
+//	{"id": "1", "type": "next", "payload": {"data": {"topic": {"topic": "orders.eu", "data": {}}}}}
+//	{"id": "1", "type": "complete"}
+//
+// Subscriptions are resolved by the caller from the parsed Operation, since
+// the stack pushes JSON data rather than executing a GraphQL schema.
+package graphqlws
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Subprotocol is the Sec-WebSocket-Protocol value that selects graphql-ws
+const Subprotocol = "graphql-transport-ws"
+
+// Message types
+const (
+	TypeConnectionInit = "connection_init"
+	TypeConnectionAck  = "connection_ack"
+	TypePing           = "ping"
+	TypePong           = "pong"
+	TypeSubscribe      = "subscribe"
+	TypeNext           = "next"
+	TypeError          = "error"
+	TypeComplete       = "complete"
+)
+
+// Message is a graphql-ws frame. ID identifies the operation of subscribe,
+// next, error, and complete messages.
+type Message struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// SubscribePayload is the payload of a subscribe message
+type SubscribePayload struct {
+	OperationName string                     `json:"operationName,omitempty"`
+	Query         string                     `json:"query"`
+	Variables     map[string]json.RawMessage `json:"variables,omitempty"`
+	Extensions    map[string]json.RawMessage `json:"extensions,omitempty"`
+}
+
+// Error is a GraphQL error, as delivered by error messages
+type Error struct {
+	Message string `json:"message"`
+}
+
+// nextPayload is the execution result of a next message
+type nextPayload struct {
+	Data map[string]json.RawMessage `json:"data"`
+}
+
+// Requested returns true if the comma separated Sec-WebSocket-Protocol
+// header value lists the graphql-ws subprotocol
+func Requested(protocols string) bool {
+	for _, eachProtocol := range strings.Split(protocols, ",") {
+		if strings.TrimSpace(eachProtocol) == Subprotocol {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode returns the JSON text frame for the message
+func Encode(messageType string, id string, payload interface{}) ([]byte, error) {
+	message := &Message{
+		ID:   id,
+		Type: messageType,
+	}
+	if payload != nil {
+		payloadJSON, payloadErr := json.Marshal(payload)
+		if payloadErr != nil {
+			return nil, payloadErr
+		}
+		message.Payload = payloadJSON
+	}
+	return json.Marshal(message)
+}
+
+// Next returns the next message that delivers the data as the value of the
+// operation's response key
+func Next(id string, responseKey string, data json.RawMessage) ([]byte, error) {
+	return Encode(TypeNext, id, &nextPayload{
+		Data: map[string]json.RawMessage{
+			responseKey: data,
+		},
+	})
+}
+
+// Errors returns the error message that rejects the operation
+func Errors(id string, errs ...error) ([]byte, error) {
+	graphQLErrors := make([]Error, len(errs))
+	for eachIndex, eachErr := range errs {
+		graphQLErrors[eachIndex] = Error{
+			Message: eachErr.Error(),
+		}
+	}
+	return Encode(TypeError, id, graphQLErrors)
+}
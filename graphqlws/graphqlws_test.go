@@ -0,0 +1,195 @@
+package graphqlws
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRequested(t *testing.T) {
+	tests := []struct {
+		protocols string
+		requested bool
+	}{
+		{"graphql-transport-ws", true},
+		{"chat, graphql-transport-ws", true},
+		{" graphql-transport-ws ,chat", true},
+		{"graphql-ws", false},
+		{"chat", false},
+		{"", false},
+	}
+	for _, eachTest := range tests {
+		if requested := Requested(eachTest.protocols); requested != eachTest.requested {
+			t.Errorf("Requested(%q) = %t, want %t", eachTest.protocols, requested, eachTest.requested)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		encode   func() ([]byte, error)
+		expected string
+	}{
+		{"without payload",
+			func() ([]byte, error) {
+				return Encode(TypeConnectionAck, "", nil)
+			},
+			`{"type":"connection_ack"}`},
+		{"complete",
+			func() ([]byte, error) {
+				return Encode(TypeComplete, "1", nil)
+			},
+			`{"id":"1","type":"complete"}`},
+		{"next",
+			func() ([]byte, error) {
+				return Next("1", "orders", json.RawMessage(`{"topic":"orders.eu"}`))
+			},
+			`{"id":"1","type":"next","payload":{"data":{"orders":{"topic":"orders.eu"}}}}`},
+		{"errors",
+			func() ([]byte, error) {
+				return Errors("2", errors.New("unknown field"), errors.New("too many"))
+			},
+			`{"id":"2","type":"error","payload":[{"message":"unknown field"},{"message":"too many"}]}`},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			frame, encodeErr := eachTest.encode()
+			if encodeErr != nil {
+				t.Fatalf("Failed to encode: %s", encodeErr)
+			}
+			if string(frame) != eachTest.expected {
+				t.Errorf("Encoded %s, want %s", frame, eachTest.expected)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		payload     SubscribePayload
+		opName      string
+		field       string
+		responseKey string
+		arguments   map[string]string
+	}{
+		{"anonymous",
+			SubscribePayload{
+				Query: `subscription { topic(pattern: "orders.#") { topic data } }`,
+			},
+			"", "topic", "topic",
+			map[string]string{"pattern": `"orders.#"`}},
+		{"named with alias",
+			SubscribePayload{
+				OperationName: "Orders",
+				Query:         `subscription Orders { orders: topic(pattern: "orders.*") }`,
+			},
+			"Orders", "topic", "orders",
+			map[string]string{"pattern": `"orders.*"`}},
+		{"variables",
+			SubscribePayload{
+				Query:     `subscription ($pattern: String!) { topic(pattern: $pattern) }`,
+				Variables: map[string]json.RawMessage{"pattern": json.RawMessage(`"orders.eu"`)},
+			},
+			"", "topic", "topic",
+			map[string]string{"pattern": `"orders.eu"`}},
+		{"default variables",
+			SubscribePayload{
+				Query: `subscription ($pattern: String = "orders.#", $limit: Int) { topic(pattern: $pattern, limit: $limit) }`,
+			},
+			"", "topic", "topic",
+			map[string]string{"pattern": `"orders.#"`, "limit": "null"}},
+		{"values",
+			SubscribePayload{
+				Query: `# comment
+				subscription @live {
+					room(id: 42, ratio: -1.5e3, live: true, kind: PUBLIC, tags: ["a" "b"], where: {region: "eu"}) @skip(if: false) {
+						... on Room { data }
+					}
+				}`,
+			},
+			"", "room", "room",
+			map[string]string{
+				"id":    "42",
+				"ratio": "-1.5e3",
+				"live":  "true",
+				"kind":  `"PUBLIC"`,
+				"tags":  `["a","b"]`,
+				"where": `{"region":"eu"}`,
+			}},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			operation, parseErr := Parse(&eachTest.payload)
+			if parseErr != nil {
+				t.Fatalf("Parse(%q) failed: %s", eachTest.payload.Query, parseErr)
+			}
+			if operation.Name != eachTest.opName {
+				t.Errorf("Operation name = %q, want %q", operation.Name, eachTest.opName)
+			}
+			if operation.Field.Name != eachTest.field {
+				t.Errorf("Field name = %q, want %q", operation.Field.Name, eachTest.field)
+			}
+			if responseKey := operation.Field.ResponseKey(); responseKey != eachTest.responseKey {
+				t.Errorf("Response key = %q, want %q", responseKey, eachTest.responseKey)
+			}
+			if len(operation.Field.Arguments) != len(eachTest.arguments) {
+				t.Errorf("Arguments = %d, want %d", len(operation.Field.Arguments), len(eachTest.arguments))
+			}
+			for eachName, eachValue := range eachTest.arguments {
+				if value := string(operation.Field.Arguments[eachName]); value != eachValue {
+					t.Errorf("Argument %s = %s, want %s", eachName, value, eachValue)
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload SubscribePayload
+	}{
+		{"empty", SubscribePayload{Query: ""}},
+		{"query", SubscribePayload{Query: `query { topic }`}},
+		{"shorthand", SubscribePayload{Query: `{ topic }`}},
+		{"two fields", SubscribePayload{Query: `subscription { topic other }`}},
+		{"two definitions", SubscribePayload{Query: `subscription { topic } subscription { other }`}},
+		{"fragment", SubscribePayload{Query: `subscription { ...Topic } fragment Topic on Subscription { topic }`}},
+		{"unknown operation name", SubscribePayload{OperationName: "Other", Query: `subscription Orders { topic }`}},
+		{"unterminated selection set", SubscribePayload{Query: `subscription { topic { data }`}},
+		{"unterminated string", SubscribePayload{Query: `subscription { topic(pattern: "orders) }`}},
+		{"block string", SubscribePayload{Query: `subscription { topic(pattern: """orders""") }`}},
+		{"invalid number", SubscribePayload{Query: `subscription { topic(limit: 012) }`}},
+		{"missing value", SubscribePayload{Query: `subscription { topic(pattern:) }`}},
+		{"too long", SubscribePayload{Query: "subscription { topic }" + strings.Repeat(" ", MaxQueryLength)}},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			operation, parseErr := Parse(&eachTest.payload)
+			if parseErr == nil {
+				t.Errorf("Parse(%q) = %+v, want an error", eachTest.payload.Query, operation)
+			}
+		})
+	}
+}
+
+func TestStringArgument(t *testing.T) {
+	operation, parseErr := Parse(&SubscribePayload{
+		Query: `subscription { topic(pattern: "orders.#", limit: 5, empty: "") }`,
+	})
+	if parseErr != nil {
+		t.Fatalf("Parse failed: %s", parseErr)
+	}
+	pattern, patternErr := operation.Field.StringArgument("pattern")
+	if patternErr != nil || pattern != "orders.#" {
+		t.Errorf("StringArgument(pattern) = %q, %v, want %q", pattern, patternErr, "orders.#")
+	}
+	for _, eachName := range []string{"limit", "empty", "missing"} {
+		if _, argumentErr := operation.Field.StringArgument(eachName); argumentErr == nil {
+			t.Errorf("StringArgument(%s) succeeded, want an error", eachName)
+		}
+	}
+}
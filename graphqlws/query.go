@@ -0,0 +1,363 @@
+package graphqlws
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MaxQueryLength bounds the subscribe message's query document
+const MaxQueryLength = 4096
+
+// Operation is a parsed subscription operation. Only documents with a
+// single subscription operation and no fragments are supported.
+type Operation struct {
+	// Name is the operation name, if the document names it
+	Name string
+	// Field is the operation's root field. GraphQL subscriptions select
+	// exactly one.
+	Field Field
+}
+
+// Field is the root field of a subscription and its argument values, with
+// variables replaced by their values. The field's selection set is ignored,
+// since the pushed data isn't typed.
+type Field struct {
+	Name      string
+	Alias     string
+	Arguments map[string]json.RawMessage
+}
+
+// ResponseKey returns the key of the field's value in the execution result
+func (field *Field) ResponseKey() string {
+	if field.Alias != "" {
+		return field.Alias
+	}
+	return field.Name
+}
+
+// StringArgument returns the value of the named string argument
+func (field *Field) StringArgument(name string) (string, error) {
+	var value string
+	if json.Unmarshal(field.Arguments[name], &value) != nil || value == "" {
+		return "", fmt.Errorf("%s requires a %s string argument", field.Name, name)
+	}
+	return value, nil
+}
+
+// parser is a recursive descent parser of a subscription document
+type parser struct {
+	tokens    []token
+	next      int
+	variables map[string]json.RawMessage
+	defaults  map[string]json.RawMessage
+}
+
+// Parse returns the subscription operation of the subscribe payload
+func Parse(payload *SubscribePayload) (*Operation, error) {
+	if len(payload.Query) > MaxQueryLength {
+		return nil, fmt.Errorf("queries are at most %d characters", MaxQueryLength)
+	}
+	tokens, tokensErr := tokenize(payload.Query)
+	if tokensErr != nil {
+		return nil, tokensErr
+	}
+	p := &parser{
+		tokens:    tokens,
+		variables: payload.Variables,
+		defaults:  make(map[string]json.RawMessage),
+	}
+	operation, operationErr := p.operation()
+	if operationErr != nil {
+		return nil, operationErr
+	}
+	if payload.OperationName != "" && payload.OperationName != operation.Name {
+		return nil, fmt.Errorf("unknown operation named %q", payload.OperationName)
+	}
+	return operation, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) advance() token {
+	tok := p.tokens[p.next]
+	if tok.kind != tokenEnd {
+		p.next++
+	}
+	return tok
+}
+
+// expect consumes the punctuator
+func (p *parser) expect(punctuator string) error {
+	tok := p.advance()
+	if !tok.punctuator(punctuator) {
+		return fmt.Errorf("expected %s at offset %d, found %s", punctuator, tok.offset, tok)
+	}
+	return nil
+}
+
+// expectName consumes a name
+func (p *parser) expectName() (string, error) {
+	tok := p.advance()
+	if tok.kind != tokenName {
+		return "", fmt.Errorf("expected a name at offset %d, found %s", tok.offset, tok)
+	}
+	return tok.text, nil
+}
+
+// operation := "subscription" Name? VariableDefinitions? Directives? "{" Field "}"
+func (p *parser) operation() (*Operation, error) {
+	tok := p.advance()
+	if !tok.keyword("subscription") {
+		return nil, fmt.Errorf("only subscription operations are supported")
+	}
+	operation := &Operation{}
+	if p.peek().kind == tokenName {
+		operation.Name = p.advance().text
+	}
+	if p.peek().punctuator("(") {
+		variablesErr := p.variableDefinitions()
+		if variablesErr != nil {
+			return nil, variablesErr
+		}
+	}
+	directivesErr := p.directives()
+	if directivesErr != nil {
+		return nil, directivesErr
+	}
+	openErr := p.expect("{")
+	if openErr != nil {
+		return nil, openErr
+	}
+	field, fieldErr := p.field()
+	if fieldErr != nil {
+		return nil, fieldErr
+	}
+	operation.Field = *field
+	if !p.peek().punctuator("}") {
+		return nil, fmt.Errorf("subscriptions select exactly one root field")
+	}
+	p.advance()
+	if p.peek().kind != tokenEnd {
+		return nil, fmt.Errorf("documents with more than one definition aren't supported")
+	}
+	return operation, nil
+}
+
+// variableDefinitions := "(" ("$" Name ":" Type ("=" Value)? Directives?)+ ")"
+func (p *parser) variableDefinitions() error {
+	p.advance()
+	for !p.peek().punctuator(")") {
+		dollarErr := p.expect("$")
+		if dollarErr != nil {
+			return dollarErr
+		}
+		name, nameErr := p.expectName()
+		if nameErr != nil {
+			return nameErr
+		}
+		colonErr := p.expect(":")
+		if colonErr != nil {
+			return colonErr
+		}
+		typeErr := p.typeReference()
+		if typeErr != nil {
+			return typeErr
+		}
+		if p.peek().punctuator("=") {
+			p.advance()
+			value, valueErr := p.value()
+			if valueErr != nil {
+				return valueErr
+			}
+			p.defaults[name] = value
+		}
+		directivesErr := p.directives()
+		if directivesErr != nil {
+			return directivesErr
+		}
+	}
+	p.advance()
+	return nil
+}
+
+// typeReference := (Name | "[" Type "]") "!"?
+func (p *parser) typeReference() error {
+	if p.peek().punctuator("[") {
+		p.advance()
+		elementErr := p.typeReference()
+		if elementErr != nil {
+			return elementErr
+		}
+		closeErr := p.expect("]")
+		if closeErr != nil {
+			return closeErr
+		}
+	} else {
+		_, nameErr := p.expectName()
+		if nameErr != nil {
+			return nameErr
+		}
+	}
+	if p.peek().punctuator("!") {
+		p.advance()
+	}
+	return nil
+}
+
+// directives := ("@" Name Arguments?)*. Directives are parsed and ignored.
+func (p *parser) directives() error {
+	for p.peek().punctuator("@") {
+		p.advance()
+		_, nameErr := p.expectName()
+		if nameErr != nil {
+			return nameErr
+		}
+		if p.peek().punctuator("(") {
+			argumentsErr := p.arguments(make(map[string]json.RawMessage))
+			if argumentsErr != nil {
+				return argumentsErr
+			}
+		}
+	}
+	return nil
+}
+
+// field := (Alias ":")? Name Arguments? Directives? SelectionSet?
+func (p *parser) field() (*Field, error) {
+	name, nameErr := p.expectName()
+	if nameErr != nil {
+		return nil, nameErr
+	}
+	field := &Field{
+		Name:      name,
+		Arguments: make(map[string]json.RawMessage),
+	}
+	if p.peek().punctuator(":") {
+		p.advance()
+		field.Alias = field.Name
+		field.Name, nameErr = p.expectName()
+		if nameErr != nil {
+			return nil, nameErr
+		}
+	}
+	if p.peek().punctuator("(") {
+		argumentsErr := p.arguments(field.Arguments)
+		if argumentsErr != nil {
+			return nil, argumentsErr
+		}
+	}
+	directivesErr := p.directives()
+	if directivesErr != nil {
+		return nil, directivesErr
+	}
+	if p.peek().punctuator("{") {
+		selectionErr := p.skipSelectionSet()
+		if selectionErr != nil {
+			return nil, selectionErr
+		}
+	}
+	return field, nil
+}
+
+// arguments := "(" (Name ":" Value)+ ")"
+func (p *parser) arguments(into map[string]json.RawMessage) error {
+	p.advance()
+	for !p.peek().punctuator(")") {
+		name, nameErr := p.expectName()
+		if nameErr != nil {
+			return nameErr
+		}
+		colonErr := p.expect(":")
+		if colonErr != nil {
+			return colonErr
+		}
+		value, valueErr := p.value()
+		if valueErr != nil {
+			return valueErr
+		}
+		into[name] = value
+	}
+	p.advance()
+	return nil
+}
+
+// skipSelectionSet consumes the balanced selection set
+func (p *parser) skipSelectionSet() error {
+	depth := 0
+	for {
+		tok := p.advance()
+		switch {
+		case tok.kind == tokenEnd:
+			return fmt.Errorf("unterminated selection set")
+		case tok.punctuator("{"):
+			depth++
+		case tok.punctuator("}"):
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+// value returns the JSON form of the value. Variables are replaced by their
+// value, their default value, or null.
+func (p *parser) value() (json.RawMessage, error) {
+	tok := p.advance()
+	switch {
+	case tok.punctuator("$"):
+		name, nameErr := p.expectName()
+		if nameErr != nil {
+			return nil, nameErr
+		}
+		if value, valueExists := p.variables[name]; valueExists {
+			return value, nil
+		}
+		if value, valueExists := p.defaults[name]; valueExists {
+			return value, nil
+		}
+		return json.RawMessage("null"), nil
+	case tok.kind == tokenString:
+		return json.Marshal(tok.text)
+	case tok.kind == tokenNumber:
+		return json.RawMessage(tok.text), nil
+	case tok.keyword("true") || tok.keyword("false") || tok.keyword("null"):
+		return json.RawMessage(tok.text), nil
+	case tok.kind == tokenName:
+		// Enum values are delivered as strings
+		return json.Marshal(tok.text)
+	case tok.punctuator("["):
+		elements := []json.RawMessage{}
+		for !p.peek().punctuator("]") {
+			element, elementErr := p.value()
+			if elementErr != nil {
+				return nil, elementErr
+			}
+			elements = append(elements, element)
+		}
+		p.advance()
+		return json.Marshal(elements)
+	case tok.punctuator("{"):
+		fields := make(map[string]json.RawMessage)
+		for !p.peek().punctuator("}") {
+			name, nameErr := p.expectName()
+			if nameErr != nil {
+				return nil, nameErr
+			}
+			colonErr := p.expect(":")
+			if colonErr != nil {
+				return nil, colonErr
+			}
+			fieldValue, fieldValueErr := p.value()
+			if fieldValueErr != nil {
+				return nil, fieldValueErr
+			}
+			fields[name] = fieldValue
+		}
+		p.advance()
+		return json.Marshal(fields)
+	}
+	return nil, fmt.Errorf("expected a value at offset %d, found %s", tok.offset, tok)
+}
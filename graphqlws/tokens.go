@@ -0,0 +1,166 @@
+package graphqlws
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// byteOrderMark is ignored like whitespace
+const byteOrderMark = "\ufeff"
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenPunctuator
+	tokenName
+	tokenNumber
+	tokenString
+)
+
+// token is a lexical token of the query document
+type token struct {
+	kind   tokenKind
+	text   string
+	offset int
+}
+
+// punctuator returns true if the token is the punctuator
+func (tok token) punctuator(punctuator string) bool {
+	return tok.kind == tokenPunctuator && tok.text == punctuator
+}
+
+// keyword returns true if the token is the name. GraphQL names are case
+// sensitive.
+func (tok token) keyword(keyword string) bool {
+	return tok.kind == tokenName && tok.text == keyword
+}
+
+func (tok token) String() string {
+	switch tok.kind {
+	case tokenEnd:
+		return "end of document"
+	case tokenString:
+		return fmt.Sprintf("%q", tok.text)
+	}
+	return tok.text
+}
+
+// nameCharacter returns true if the character can appear in a name. Names
+// don't start with a digit.
+func nameCharacter(char byte, first bool) bool {
+	return char >= 'a' && char <= 'z' ||
+		char >= 'A' && char <= 'Z' ||
+		char == '_' ||
+		!first && char >= '0' && char <= '9'
+}
+
+func digit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+// digits returns the offset following the digits at the offset
+func digits(source string, offset int) int {
+	for offset < len(source) && digit(source[offset]) {
+		offset++
+	}
+	return offset
+}
+
+// number returns the end offset of the int or float value at the offset.
+// GraphQL numbers are valid JSON numbers.
+func number(source string, offset int) (int, error) {
+	start := offset
+	if source[offset] == '-' {
+		offset++
+	}
+	end := digits(source, offset)
+	if end == offset || source[offset] == '0' && end != offset+1 {
+		return 0, fmt.Errorf("invalid number at offset %d", start)
+	}
+	offset = end
+	if offset < len(source) && source[offset] == '.' {
+		end = digits(source, offset+1)
+		if end == offset+1 {
+			return 0, fmt.Errorf("invalid number at offset %d", start)
+		}
+		offset = end
+	}
+	if offset < len(source) && (source[offset] == 'e' || source[offset] == 'E') {
+		offset++
+		if offset < len(source) && (source[offset] == '+' || source[offset] == '-') {
+			offset++
+		}
+		end = digits(source, offset)
+		if end == offset {
+			return 0, fmt.Errorf("invalid number at offset %d", start)
+		}
+		offset = end
+	}
+	if offset < len(source) && nameCharacter(source[offset], false) {
+		return 0, fmt.Errorf("invalid number at offset %d", start)
+	}
+	return offset, nil
+}
+
+// tokenize splits the document into tokens, ending with a tokenEnd. Commas,
+// whitespace, and comments are insignificant.
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	for offset := 0; offset < len(source); {
+		char := source[offset]
+		switch {
+		case char == ' ' || char == '\t' || char == '\n' || char == '\r' || char == ',':
+			offset++
+		case strings.HasPrefix(source[offset:], byteOrderMark):
+			offset += len(byteOrderMark)
+		case char == '#':
+			for offset < len(source) && source[offset] != '\n' && source[offset] != '\r' {
+				offset++
+			}
+		case strings.HasPrefix(source[offset:], "..."):
+			tokens = append(tokens, token{kind: tokenPunctuator, text: "...", offset: offset})
+			offset += 3
+		case strings.IndexByte("!$&()*:=@[]{|}", char) >= 0:
+			tokens = append(tokens, token{kind: tokenPunctuator, text: string(char), offset: offset})
+			offset++
+		case strings.HasPrefix(source[offset:], `"""`):
+			return nil, fmt.Errorf("block strings aren't supported at offset %d", offset)
+		case char == '"':
+			end := offset + 1
+			for ; end < len(source) && source[end] != '"'; end++ {
+				if source[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("unterminated string at offset %d", offset)
+			}
+			// GraphQL string escapes are JSON's
+			var text string
+			if json.Unmarshal([]byte(source[offset:end+1]), &text) != nil {
+				return nil, fmt.Errorf("invalid string at offset %d", offset)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text, offset: offset})
+			offset = end + 1
+		case char == '-' || digit(char):
+			end, numberErr := number(source, offset)
+			if numberErr != nil {
+				return nil, numberErr
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: source[offset:end], offset: offset})
+			offset = end
+		case nameCharacter(char, true):
+			end := offset
+			for end < len(source) && nameCharacter(source[end], false) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenName, text: source[offset:end], offset: offset})
+			offset = end
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", char, offset)
+		}
+	}
+	return append(tokens, token{kind: tokenEnd, offset: len(source)}), nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	"github.com/mweagle/SpartaWebSocket/connections"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	envKeyHistoryTableName     = "MESSAGE_HISTORY_TABLENAME"
+	messageHistoryResourceName = "MessageHistory"
+	// History items are keyed by the room ID and a sortable sent time key,
+	// the zero padded epoch nanoseconds and request ID
+	ddbAttributeRoomID  = "roomID"
+	ddbAttributeSentAt  = "sentAt"
+	ddbAttributePayload = "payload"
+	// Room IDs are prefixed so that room names can't collide with the
+	// broadcast history
+	historyBroadcastRoomID = "broadcast"
+	historyRoomIDPrefix    = "room/"
+	// historyRetention is how long messages are kept
+	historyRetention = 7 * 24 * time.Hour
+	// maxHistoryPayloadSize bounds the persisted payloads, well under the
+	// DynamoDB item size limit. Larger messages aren't persisted.
+	maxHistoryPayloadSize = 64 * 1024
+	defaultHistoryLimit   = 50
+	maxHistoryLimit       = 100
+	historyMessage        = "history"
+)
+
+// historyRequest is the data of a history frame. Room is empty for the
+// broadcast history. Before is the next cursor from a previous page.
+type historyRequest struct {
+	Room   string `json:"room,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Before string `json:"before,omitempty"`
+}
+
+// historyEntry is a persisted message. SentAt is in epoch milliseconds, and
+// Seq is the room sequence number, if it has one.
+type historyEntry struct {
+	SentAt    int64           `json:"sentAt"`
+	Seq       int64           `json:"seq,omitempty"`
+	From      string          `json:"from,omitempty"`
+	MessageID string          `json:"messageId,omitempty"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// historyFrame is the data of the history frame posted to the sender.
+// Messages are oldest first. Next is the cursor for the preceding page, and
+// is empty once there are no older messages.
+type historyFrame struct {
+	Room     string          `json:"room,omitempty"`
+	Messages []*historyEntry `json:"messages"`
+	Next     string          `json:"next,omitempty"`
+}
+
+// historyEnabled returns true if messages are persisted for replay
+func historyEnabled(ctx context.Context, sess *session.Session, logger *logrus.Logger) bool {
+	return os.Getenv(envKeyHistoryTableName) != "" &&
+		features.enabled(ctx, sess, featureHistoryReplay, logger)
+}
+
+// historyRoomID returns the history partition for the room, or for the
+// broadcast history if the room is empty
+func historyRoomID(room string) string {
+	if room == "" {
+		return historyBroadcastRoomID
+	}
+	return historyRoomIDPrefix + room
+}
+
+// recordHistory persists the delivered message. It's best-effort: failures
+// are logged rather than failing the send.
+func recordHistory(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	room string,
+	senderItem map[string]*dynamodb.AttributeValue,
+	messageID string,
+	sequence int64,
+	payload json.RawMessage,
+	logger *logrus.Logger) {
+	if !historyEnabled(ctx, sess, logger) {
+		return
+	}
+	if len(payload) > maxHistoryPayloadSize {
+		logger.WithField("Size", len(payload)).Warn("Message too large for history")
+		return
+	}
+	sentAt := time.Now()
+	historyItem := map[string]*dynamodb.AttributeValue{
+		ddbAttributeRoomID: &dynamodb.AttributeValue{
+			S: aws.String(historyRoomID(room)),
+		},
+		ddbAttributeSentAt: &dynamodb.AttributeValue{
+			S: aws.String(fmt.Sprintf("%019d#%s", sentAt.UnixNano(), request.RequestContext.RequestID)),
+		},
+		ddbAttributePayload: &dynamodb.AttributeValue{
+			S: aws.String(string(payload)),
+		},
+		connections.ExpiresAtAttribute: &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(sentAt.Add(historyRetention).Unix(), 10)),
+		},
+	}
+	if userID := itemUserID(senderItem); userID != "" {
+		historyItem[connections.UserAttribute] = &dynamodb.AttributeValue{
+			S: aws.String(userID),
+		}
+	}
+	if messageID != "" {
+		historyItem[ddbAttributeMessageID] = &dynamodb.AttributeValue{
+			S: aws.String(messageID),
+		}
+	}
+	// The sequence index is sparse, so only sequenced messages are indexed
+	if sequence != 0 {
+		historyItem[ddbAttributeSequence] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(sequence, 10)),
+		}
+	}
+	_, putItemErr := newDynamoClient(sess).PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(os.Getenv(envKeyHistoryTableName)),
+		Item:      historyItem,
+	})
+	if putItemErr != nil {
+		logger.WithFields(logrus.Fields{
+			"Error": putItemErr,
+			"Room":  room,
+		}).Warn("Failed to record message history")
+	}
+}
+
+// fetchHistory replies to the sender with a page of the broadcast or room
+// history. Room history is only available to members.
+func fetchHistory(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	endpointURL := managementEndpoint(request.RequestContext)
+	apigwMgmtClient := newManagementClient(sess, endpointURL)
+	historyClient := newDynamoClient(sess)
+	connectionID := request.RequestContext.ConnectionID
+
+	senderItem, senderItemErr := senderConnectionItem(ctx, request, newConnectionsClient(sess))
+	if senderItemErr != nil {
+		logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+	}
+	locale := itemLocale(senderItem)
+	rejectHistory := func(code errorCode, key catalog.Key, args ...interface{}) (*wsResponse, error) {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			code,
+			catalog.Localize(locale, key, args...),
+			logger), nil
+	}
+	if !historyEnabled(ctx, sess, logger) {
+		return rejectHistory(errorCodeFeatureDisabled, catalog.HistoryDisabled)
+	}
+	var history historyRequest
+	payload, payloadErr := requestPayload(request, senderItem)
+	if payloadErr == nil {
+		payloadErr = json.Unmarshal(payload, &history)
+	}
+	if payloadErr != nil {
+		return rejectHistory(errorCodeMalformedRequest, catalog.UnmarshalFailed, payloadErr.Error())
+	}
+	if len(history.Room) > maxRoomNameLength {
+		return rejectHistory(errorCodeMalformedRequest, catalog.InvalidRoom)
+	}
+	if history.Limit < 1 {
+		history.Limit = defaultHistoryLimit
+	} else if history.Limit > maxHistoryLimit {
+		history.Limit = maxHistoryLimit
+	}
+	if history.Room != "" {
+		if !features.enabled(ctx, sess, featureRooms, logger) {
+			return rejectHistory(errorCodeFeatureDisabled, catalog.RoomsDisabled)
+		}
+		getItemOutput, getItemErr := historyClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(os.Getenv(envKeyRoomsTableName)),
+			Key:       membershipKey(history.Room, connectionID),
+		})
+		if getItemErr != nil {
+			return rejectHistory(errorCodeSendFailed, catalog.SendFailed, getItemErr.Error())
+		}
+		if len(getItemOutput.Item) == 0 {
+			return rejectHistory(errorCodeNotRoomMember, catalog.NotRoomMember, history.Room)
+		}
+	}
+
+	// Operation
+	frame, queryErr := queryHistory(ctx, historyClient, history)
+	if queryErr != nil {
+		return rejectHistory(errorCodeSendFailed, catalog.SendFailed, queryErr.Error())
+	}
+	frameData, _ := json.Marshal(frame)
+	bcast := newBroadcaster(ctx,
+		sess,
+		endpointURL,
+		request.RequestContext.RequestID,
+		historyMessage,
+		frameData,
+		logger)
+	bcast.deliverItems(ctx, []map[string]*dynamodb.AttributeValue{senderItem})
+	bcast.finish(ctx)
+	return &wsResponse{
+		StatusCode: 200,
+		Body:       catalog.Localize(locale, catalog.DataSent),
+	}, nil
+}
+
+// queryHistory returns the page of messages that precede the request's
+// cursor, or the latest messages if it doesn't have one
+func queryHistory(ctx context.Context,
+	historyClient dynamodbiface.DynamoDBAPI,
+	history historyRequest) (*historyFrame, error) {
+	keyCondition := "#roomID = :roomID"
+	values := map[string]*dynamodb.AttributeValue{
+		":roomID": &dynamodb.AttributeValue{
+			S: aws.String(historyRoomID(history.Room)),
+		},
+	}
+	if history.Before != "" {
+		keyCondition += " AND #sentAt < :before"
+		values[":before"] = &dynamodb.AttributeValue{
+			S: aws.String(history.Before),
+		}
+	}
+	queryOutput, queryErr := historyClient.QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv(envKeyHistoryTableName)),
+		KeyConditionExpression: aws.String(keyCondition),
+		ExpressionAttributeNames: map[string]*string{
+			"#roomID": aws.String(ddbAttributeRoomID),
+			"#sentAt": aws.String(ddbAttributeSentAt),
+		},
+		ExpressionAttributeValues: values,
+		// Newest first, so that the limit applies to the latest messages
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(int64(history.Limit)),
+	})
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	frame := &historyFrame{
+		Room:     history.Room,
+		Messages: make([]*historyEntry, 0, len(queryOutput.Items)),
+	}
+	for eachIndex := len(queryOutput.Items) - 1; eachIndex >= 0; eachIndex-- {
+		frame.Messages = append(frame.Messages, newHistoryEntry(queryOutput.Items[eachIndex]))
+	}
+	if len(queryOutput.LastEvaluatedKey) != 0 && len(queryOutput.Items) != 0 {
+		frame.Next = itemString(queryOutput.Items[len(queryOutput.Items)-1], ddbAttributeSentAt)
+	}
+	return frame, nil
+}
+
+// newHistoryEntry returns the message for the history item
+func newHistoryEntry(item map[string]*dynamodb.AttributeValue) *historyEntry {
+	var sentAtNanos int64
+	fmt.Sscanf(itemString(item, ddbAttributeSentAt), "%019d", &sentAtNanos)
+	return &historyEntry{
+		SentAt:    sentAtNanos / int64(time.Millisecond),
+		Seq:       itemNumber(item, ddbAttributeSequence),
+		From:      itemUserID(item),
+		MessageID: itemString(item, ddbAttributeMessageID),
+		Data:      json.RawMessage(itemString(item, ddbAttributePayload)),
+	}
+}
+
+// messageHistoryDecorator provisions the message history table. Items expire
+// historyRetention after they're sent. The sequence LSI finds the room
+// messages a resuming client missed.
+func messageHistoryDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(messageHistoryResourceName, &gocf.DynamoDBTable{
+		AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeRoomID),
+				AttributeType: gocf.String("S"),
+			},
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeSentAt),
+				AttributeType: gocf.String("S"),
+			},
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeSequence),
+				AttributeType: gocf.String("N"),
+			},
+		},
+		KeySchema: &gocf.DynamoDBTableKeySchemaList{
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeRoomID),
+				KeyType:       gocf.String("HASH"),
+			},
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeSentAt),
+				KeyType:       gocf.String("RANGE"),
+			},
+		},
+		LocalSecondaryIndexes: &gocf.DynamoDBTableLocalSecondaryIndexList{
+			gocf.DynamoDBTableLocalSecondaryIndex{
+				IndexName: gocf.String(historyBySequenceIndex),
+				KeySchema: &gocf.DynamoDBTableKeySchemaList{
+					gocf.DynamoDBTableKeySchema{
+						AttributeName: gocf.String(ddbAttributeRoomID),
+						KeyType:       gocf.String("HASH"),
+					},
+					gocf.DynamoDBTableKeySchema{
+						AttributeName: gocf.String(ddbAttributeSequence),
+						KeyType:       gocf.String("RANGE"),
+					},
+				},
+				Projection: &gocf.DynamoDBTableProjection{
+					ProjectionType: gocf.String("ALL"),
+				},
+			},
+		},
+		TimeToLiveSpecification: &gocf.DynamoDBTableTimeToLiveSpecification{
+			AttributeName: gocf.String(connections.ExpiresAtAttribute),
+			Enabled:       gocf.Bool(true),
+		},
+		BillingMode: gocf.String("PAY_PER_REQUEST"),
+	})
+	return nil
+}
+
+// annotateMessageHistory grants the lambda access to the message history
+// table and publishes the table name in its environment
+func annotateMessageHistory(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:PutItem",
+				"dynamodb:Query"},
+			Resource: gocf.GetAtt(messageHistoryResourceName, "Arn"),
+		},
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:Query"},
+			Resource: gocf.Join("",
+				gocf.GetAtt(messageHistoryResourceName, "Arn"),
+				gocf.String("/index/*")),
+		})
+	setEnvironment(lambdaFn, envKeyHistoryTableName, gocf.Ref(messageHistoryResourceName).String())
+}
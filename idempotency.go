@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/connections"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	envKeyIdempotencyTableName     = "IDEMPOTENCY_KEYS_TABLENAME"
+	idempotencyKeysResourceName    = "IdempotencyKeys"
+	ddbAttributeIdempotencyKey     = "idempotencyKey"
+	ddbAttributeIdempotencyRequest = "requestID"
+	ddbAttributeIdempotencyState   = "state"
+	idempotencyStateInProgress     = "inProgress"
+	idempotencyStateComplete       = "complete"
+	// idempotencyRetention is how long a retried send is recognized
+	idempotencyRetention = time.Hour
+	// idempotencyClaimTimeout is how long an in-progress claim holds the key.
+	// A send that times out or crashes never completes its claim, so the key
+	// can be claimed again once the claim lapses.
+	idempotencyClaimTimeout = 2 * time.Minute
+	maxIdempotencyKeyLength = 128
+)
+
+// errDuplicateRequest is returned by claimIdempotencyKey if the key was
+// already claimed
+var errDuplicateRequest = errors.New("duplicate idempotency key")
+
+// idempotencyEnvelope is the part of a JSON text frame that carries the
+// optional idempotency key alongside the data
+type idempotencyEnvelope struct {
+	IdempotencyKey string `json:"idempotencyKey"`
+}
+
+// requestIdempotencyKey returns the idempotency key of a JSON text frame, or
+// the empty string. Binary frames don't carry one.
+func requestIdempotencyKey(request awsEvents.APIGatewayWebsocketProxyRequest) (string, error) {
+	if request.IsBase64Encoded {
+		return "", nil
+	}
+	var envelope idempotencyEnvelope
+	if json.Unmarshal([]byte(request.Body), &envelope) != nil {
+		return "", nil
+	}
+	if len(envelope.IdempotencyKey) > maxIdempotencyKeyLength {
+		return "", fmt.Errorf("idempotencyKey exceeds %d characters", maxIdempotencyKeyLength)
+	}
+	return envelope.IdempotencyKey, nil
+}
+
+// scopedIdempotencyKey returns the table key for the sender's idempotency
+// key. A retry is often sent from a new connection after a reconnect, so keys
+// are scoped to the sender's user ID rather than its connection. Anonymous
+// senders have no ID in common across connections, so their keys are scoped
+// to the connection.
+func scopedIdempotencyKey(key string,
+	connectionID string,
+	senderItem map[string]*dynamodb.AttributeValue) string {
+	if userID := itemUserID(senderItem); userID != "" {
+		return "user:" + userID + "/" + key
+	}
+	return "connection:" + connectionID + "/" + key
+}
+
+// claimIdempotencyKey records an in-progress claim of the key for the
+// request, which lapses after idempotencyClaimTimeout unless the request
+// completes it. If the key was already claimed it returns
+// errDuplicateRequest and the ID of the request that claimed it.
+func claimIdempotencyKey(ctx context.Context,
+	ddbService dynamodbiface.DynamoDBAPI,
+	key string,
+	requestID string) (string, error) {
+	tableName := os.Getenv(envKeyIdempotencyTableName)
+	_, putItemErr := ddbService.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			ddbAttributeIdempotencyKey: &dynamodb.AttributeValue{
+				S: aws.String(key),
+			},
+			ddbAttributeIdempotencyRequest: &dynamodb.AttributeValue{
+				S: aws.String(requestID),
+			},
+			ddbAttributeIdempotencyState: &dynamodb.AttributeValue{
+				S: aws.String(idempotencyStateInProgress),
+			},
+			connections.ExpiresAtAttribute: &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatInt(time.Now().Add(idempotencyClaimTimeout).Unix(), 10)),
+			},
+		},
+		// DynamoDB TTL deletes lazily, so expired keys and lapsed claims can
+		// be claimed again
+		ConditionExpression: aws.String("attribute_not_exists(#key) OR #expiresAt < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key":       aws.String(ddbAttributeIdempotencyKey),
+			"#expiresAt": aws.String(connections.ExpiresAtAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+			},
+		},
+	})
+	if !conditionalCheckFailed(putItemErr) {
+		return requestID, putItemErr
+	}
+	getItemOutput, getItemErr := ddbService.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			ddbAttributeIdempotencyKey: &dynamodb.AttributeValue{
+				S: aws.String(key),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if getItemErr != nil {
+		return "", errDuplicateRequest
+	}
+	if originalRequest := getItemOutput.Item[ddbAttributeIdempotencyRequest]; originalRequest != nil {
+		return aws.StringValue(originalRequest.S), errDuplicateRequest
+	}
+	return "", errDuplicateRequest
+}
+
+// completeIdempotencyKey marks the request's claim on the key complete once
+// the send is delivered, so that retries are recognized for
+// idempotencyRetention
+func completeIdempotencyKey(ctx context.Context,
+	ddbService dynamodbiface.DynamoDBAPI,
+	key string,
+	requestID string,
+	logger *logrus.Logger) {
+	_, updateItemErr := ddbService.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv(envKeyIdempotencyTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			ddbAttributeIdempotencyKey: &dynamodb.AttributeValue{
+				S: aws.String(key),
+			},
+		},
+		UpdateExpression:    aws.String("SET #state = :complete, #expiresAt = :expiresAt"),
+		ConditionExpression: aws.String("#request = :request"),
+		ExpressionAttributeNames: map[string]*string{
+			"#state":     aws.String(ddbAttributeIdempotencyState),
+			"#expiresAt": aws.String(connections.ExpiresAtAttribute),
+			"#request":   aws.String(ddbAttributeIdempotencyRequest),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":complete": &dynamodb.AttributeValue{
+				S: aws.String(idempotencyStateComplete),
+			},
+			":expiresAt": &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatInt(time.Now().Add(idempotencyRetention).Unix(), 10)),
+			},
+			":request": &dynamodb.AttributeValue{
+				S: aws.String(requestID),
+			},
+		},
+	})
+	if updateItemErr != nil {
+		// The claim lapses, so a retry after idempotencyClaimTimeout is
+		// delivered again
+		logger.WithFields(logrus.Fields{
+			"Error":          updateItemErr,
+			"IdempotencyKey": key,
+		}).Warn("Failed to complete idempotency key")
+	}
+}
+
+// releaseIdempotencyKey deletes the request's claim on the key, so that a
+// retry of a send that failed isn't rejected as a duplicate
+func releaseIdempotencyKey(ctx context.Context,
+	ddbService dynamodbiface.DynamoDBAPI,
+	key string,
+	requestID string,
+	logger *logrus.Logger) {
+	_, delItemErr := ddbService.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv(envKeyIdempotencyTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			ddbAttributeIdempotencyKey: &dynamodb.AttributeValue{
+				S: aws.String(key),
+			},
+		},
+		ConditionExpression: aws.String("#request = :request"),
+		ExpressionAttributeNames: map[string]*string{
+			"#request": aws.String(ddbAttributeIdempotencyRequest),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":request": &dynamodb.AttributeValue{
+				S: aws.String(requestID),
+			},
+		},
+	})
+	if delItemErr != nil && !conditionalCheckFailed(delItemErr) {
+		logger.WithFields(logrus.Fields{
+			"Error":          delItemErr,
+			"IdempotencyKey": key,
+		}).Warn("Failed to release idempotency key")
+	}
+}
+
+// idempotencyKeysDecorator provisions the idempotency keys table. Claims
+// expire idempotencyClaimTimeout after they're written, and completed keys
+// idempotencyRetention after they're completed.
+func idempotencyKeysDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(idempotencyKeysResourceName, &gocf.DynamoDBTable{
+		AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeIdempotencyKey),
+				AttributeType: gocf.String("S"),
+			},
+		},
+		KeySchema: &gocf.DynamoDBTableKeySchemaList{
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeIdempotencyKey),
+				KeyType:       gocf.String("HASH"),
+			},
+		},
+		TimeToLiveSpecification: &gocf.DynamoDBTableTimeToLiveSpecification{
+			AttributeName: gocf.String(connections.ExpiresAtAttribute),
+			Enabled:       gocf.Bool(true),
+		},
+		BillingMode: gocf.String("PAY_PER_REQUEST"),
+	})
+	return nil
+}
+
+// annotateIdempotencyKeys grants the lambda access to the idempotency keys
+// table and publishes the table name in its environment
+func annotateIdempotencyKeys(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:GetItem",
+				"dynamodb:PutItem",
+				"dynamodb:UpdateItem",
+				"dynamodb:DeleteItem"},
+			Resource: gocf.GetAtt(idempotencyKeysResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyIdempotencyTableName, gocf.Ref(idempotencyKeysResourceName).String())
+}
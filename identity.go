@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/connections"
+	gocf "github.com/mweagle/go-cloudformation"
+)
+
+const (
+	// queryParamUserID identifies the connecting user when the $connect
+	// route isn't authorized and the query identity is allowed
+	queryParamUserID = "user"
+	// envKeyInsecureQueryIdentity is a provision-time flag that accepts the
+	// self-asserted `user` query parameter as the user ID. Anyone can claim
+	// any user with it, so it's only meant for development stacks.
+	envKeyInsecureQueryIdentity = "INSECURE_QUERY_IDENTITY"
+	maxUserIDLength             = 128
+	ddbAttributeIdentitySource  = "identitySource"
+	ddbAttributeClaims          = "claims"
+	// Identity sources, in order of precedence
+	identitySourceAuthorizer = "authorizer"
+	identitySourceCognito    = "cognito"
+	identitySourceIAM        = "iam"
+	identitySourceQuery      = "query"
+)
+
+// authorizerUserKeys are the authorizer context keys that may hold the user
+// ID, in order of preference. Lambda authorizers return their principalId
+// and context values; Cognito and JWT claims are commonly forwarded under
+// claims.
+var authorizerUserKeys = []string{"userId", "sub", "cognito:username", "principalId"}
+
+// authorizerReservedKeys are authorizer context keys set by API Gateway
+// rather than the authorizer
+var authorizerReservedKeys = map[string]bool{
+	"principalId":        true,
+	"integrationLatency": true,
+}
+
+// identity is the connecting user. Claims are the authorizer's context
+// values, eg validated JWT claims.
+type identity struct {
+	userID string
+	source string
+	claims map[string]string
+}
+
+// queryIdentityEnabled returns true if the `user` query parameter is
+// accepted as the connecting user
+func queryIdentityEnabled() bool {
+	return os.Getenv(envKeyInsecureQueryIdentity) == "true"
+}
+
+// handshakeIdentity returns the connecting user. Validated identities from
+// the route authorizer or IAM take precedence over the unauthenticated
+// `user` query parameter, which is ignored unless the insecure query
+// identity is enabled. The zero identity is returned for anonymous
+// connections.
+func handshakeIdentity(request awsEvents.APIGatewayWebsocketProxyRequest) identity {
+	requestContext := request.RequestContext
+	if authorizer, ok := requestContext.Authorizer.(map[string]interface{}); ok {
+		if userID := authorizerUserID(authorizer); userID != "" {
+			return identity{
+				userID: userID,
+				source: identitySourceAuthorizer,
+				claims: authorizerClaims(authorizer),
+			}
+		}
+	}
+	candidates := []identity{
+		{userID: requestContext.Identity.CognitoIdentityID, source: identitySourceCognito},
+		{userID: requestContext.Identity.UserArn, source: identitySourceIAM},
+	}
+	if queryIdentityEnabled() {
+		candidates = append(candidates, identity{
+			userID: request.QueryStringParameters[queryParamUserID],
+			source: identitySourceQuery,
+		})
+	}
+	for _, eachCandidate := range candidates {
+		if eachCandidate.userID != "" && len(eachCandidate.userID) <= maxUserIDLength {
+			return eachCandidate
+		}
+	}
+	return identity{}
+}
+
+// authorizerUserID returns the user ID from the authorizer context, looking
+// in a nested claims object if there is one
+func authorizerUserID(authorizer map[string]interface{}) string {
+	contexts := []map[string]interface{}{authorizer}
+	if claims, ok := authorizer["claims"].(map[string]interface{}); ok {
+		contexts = append(contexts, claims)
+	}
+	for _, eachContext := range contexts {
+		for _, eachKey := range authorizerUserKeys {
+			value, exists := eachContext[eachKey]
+			if !exists || value == nil {
+				continue
+			}
+			userID := fmt.Sprintf("%v", value)
+			if userID != "" && len(userID) <= maxUserIDLength {
+				return userID
+			}
+		}
+	}
+	return ""
+}
+
+// authorizerClaims returns the authorizer's context values
+func authorizerClaims(authorizer map[string]interface{}) map[string]string {
+	claims := make(map[string]string)
+	for eachName, eachValue := range authorizer {
+		if authorizerReservedKeys[eachName] || eachValue == nil {
+			continue
+		}
+		if number, isNumber := eachValue.(float64); isNumber {
+			claims[eachName] = strconv.FormatFloat(number, 'f', -1, 64)
+			continue
+		}
+		claims[eachName] = fmt.Sprintf("%v", eachValue)
+	}
+	return claims
+}
+
+// attributes returns the connection item attributes for the identity
+func (user identity) attributes() map[string]*dynamodb.AttributeValue {
+	if user.userID == "" {
+		return nil
+	}
+	attributes := map[string]*dynamodb.AttributeValue{
+		connections.UserAttribute: &dynamodb.AttributeValue{
+			S: aws.String(user.userID),
+		},
+		ddbAttributeIdentitySource: &dynamodb.AttributeValue{
+			S: aws.String(user.source),
+		},
+	}
+	if len(user.claims) != 0 {
+		claims := make(map[string]*dynamodb.AttributeValue, len(user.claims))
+		for eachName, eachValue := range user.claims {
+			claims[eachName] = &dynamodb.AttributeValue{
+				S: aws.String(eachValue),
+			}
+		}
+		attributes[ddbAttributeClaims] = &dynamodb.AttributeValue{
+			M: claims,
+		}
+	}
+	return attributes
+}
+
+// itemUserID returns the user ID stored in the connection item
+func itemUserID(item map[string]*dynamodb.AttributeValue) string {
+	if item[connections.UserAttribute] == nil || item[connections.UserAttribute].S == nil {
+		return ""
+	}
+	return *item[connections.UserAttribute].S
+}
+
+// itemAuthenticated returns true if the connection's user ID was validated
+// rather than supplied by the client
+func itemAuthenticated(item map[string]*dynamodb.AttributeValue) bool {
+	if item[ddbAttributeIdentitySource] == nil || item[ddbAttributeIdentitySource].S == nil {
+		return false
+	}
+	return *item[ddbAttributeIdentitySource].S != identitySourceQuery
+}
+
+// annotateQueryIdentity publishes the provision-time INSECURE_QUERY_IDENTITY
+// flag in the lambda environment
+func annotateQueryIdentity(lambdaFn *sparta.LambdaAWSInfo) {
+	if queryIdentityEnabled() {
+		setEnvironment(lambdaFn, envKeyInsecureQueryIdentity, gocf.String("true"))
+	}
+}
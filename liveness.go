@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	apigwManagement "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	apigwManagementIface "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi/apigatewaymanagementapiiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// connectionLiveness is API Gateway's view of a connection. Live is false if
+// API Gateway reports the connection as gone, in which case the other fields
+// are empty.
+type connectionLiveness struct {
+	Live         bool   `json:"live"`
+	ConnectedAt  string `json:"connectedAt,omitempty"`
+	LastActiveAt string `json:"lastActiveAt,omitempty"`
+	SourceIP     string `json:"sourceIp,omitempty"`
+	UserAgent    string `json:"userAgent,omitempty"`
+}
+
+// getConnectionLiveness returns whether the connection is still live. A
+// stored connection that isn't live is a ghost whose $disconnect didn't
+// delete it.
+func getConnectionLiveness(ctx context.Context,
+	apigwMgmtClient apigwManagementIface.ApiGatewayManagementApiAPI,
+	connectionID string) (*connectionLiveness, error) {
+	getOutput, getErr := apigwMgmtClient.GetConnectionWithContext(ctx,
+		&apigwManagement.GetConnectionInput{
+			ConnectionId: aws.String(connectionID),
+		})
+	if getErr != nil {
+		if strings.Contains(getErr.Error(), apigwManagement.ErrCodeGoneException) {
+			return &connectionLiveness{}, nil
+		}
+		return nil, getErr
+	}
+	liveness := &connectionLiveness{
+		Live:         true,
+		ConnectedAt:  livenessTime(getOutput.ConnectedAt),
+		LastActiveAt: livenessTime(getOutput.LastActiveAt),
+	}
+	if getOutput.Identity != nil {
+		liveness.SourceIP = aws.StringValue(getOutput.Identity.SourceIp)
+		liveness.UserAgent = aws.StringValue(getOutput.Identity.UserAgent)
+	}
+	return liveness, nil
+}
+
+// livenessTime formats the GetConnection timestamp, if there is one
+func livenessTime(timestamp *time.Time) string {
+	if timestamp == nil {
+		return ""
+	}
+	return timestamp.UTC().Format(time.RFC3339)
+}
+
+// itemManagementClient returns the management client for the connection
+// item. Connections established in another region are managed by that
+// region's endpoint.
+func itemManagementClient(sess *session.Session,
+	item map[string]*dynamodb.AttributeValue) apigwManagementIface.ApiGatewayManagementApiAPI {
+	region := itemString(item, ddbAttributeRegion)
+	endpointURL := itemString(item, ddbAttributeEndpoint)
+	if region == "" || endpointURL == "" || region == os.Getenv("AWS_REGION") {
+		return newManagementClient(sess, os.Getenv(envKeyManagementEndpoint))
+	}
+	return newManagementClient(sess.Copy(aws.NewConfig().WithRegion(region)), endpointURL)
+}
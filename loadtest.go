@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mweagle/SpartaWebSocket/client"
+	"github.com/mweagle/SpartaWebSocket/protocol"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// loadtestCommand drives load against the deployed stack rather than
+	// running a Sparta command
+	loadtestCommand = "loadtest"
+	// loadtestDialConcurrency limits the connections that are opened at once
+	loadtestDialConcurrency = 50
+)
+
+// loadtestProbe is the data of each load test message. Run distinguishes
+// the run's messages from other broadcasts.
+type loadtestProbe struct {
+	Run    string `json:"loadtest"`
+	Seq    int    `json:"seq"`
+	SentAt int64  `json:"sentAt"`
+	Pad    string `json:"pad,omitempty"`
+}
+
+// loadtestResults accumulates the run's counts and delivery latencies. It's
+// safe for concurrent use.
+type loadtestResults struct {
+	mutex         sync.Mutex
+	connections   int
+	connectErrors int
+	reconnects    int
+	sent          int
+	sendErrors    int
+	received      int
+	latencies     []time.Duration
+}
+
+func (results *loadtestResults) add(update func(results *loadtestResults)) {
+	results.mutex.Lock()
+	defer results.mutex.Unlock()
+	update(results)
+}
+
+// percentile returns the latency at the percentile of the sorted latencies
+func percentile(sorted []time.Duration, percent float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	index := int(float64(len(sorted)-1) * percent / 100)
+	return sorted[index]
+}
+
+// write reports the results. Every connection receives every broadcast, so
+// the expected deliveries are the messages sent times the connections.
+func (results *loadtestResults) write(output io.Writer, elapsed time.Duration) {
+	results.mutex.Lock()
+	defer results.mutex.Unlock()
+	sorted := append([]time.Duration{}, results.latencies...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	expected := results.sent * results.connections
+	fmt.Fprintf(output, "Connections:     %d (%d failed, %d reconnects)\n",
+		results.connections,
+		results.connectErrors,
+		results.reconnects)
+	fmt.Fprintf(output, "Messages sent:   %d (%d failed) in %s\n",
+		results.sent,
+		results.sendErrors,
+		elapsed.Round(time.Millisecond))
+	fmt.Fprintf(output, "Deliveries:      %d of %d expected (%d missing)\n",
+		results.received,
+		expected,
+		expected-results.received)
+	for _, eachPercentile := range []float64{50, 90, 99} {
+		fmt.Fprintf(output, "Latency p%-2.0f:     %s\n",
+			eachPercentile,
+			percentile(sorted, eachPercentile).Round(time.Millisecond))
+	}
+	if len(sorted) != 0 {
+		fmt.Fprintf(output, "Latency max:     %s\n", sorted[len(sorted)-1].Round(time.Millisecond))
+	}
+}
+
+// receiveProbes records the delivery latency of each of the run's messages
+// that the connection receives
+func receiveProbes(wsClient *client.Client, run string, results *loadtestResults) {
+	for eachFrame := range wsClient.Frames() {
+		data, dataErr := wsClient.Data(eachFrame)
+		if dataErr != nil {
+			continue
+		}
+		var probe loadtestProbe
+		if json.Unmarshal(data, &probe) != nil || probe.Run != run {
+			continue
+		}
+		latency := time.Since(time.Unix(0, probe.SentAt))
+		results.add(func(results *loadtestResults) {
+			results.received++
+			results.latencies = append(results.latencies, latency)
+		})
+	}
+}
+
+// runLoadtest is the loadtest command. It opens the connections, broadcasts
+// messages at the rate from each connection in turn for the duration, waits
+// for the last deliveries to drain, and reports the delivery latency
+// percentiles and error counts.
+func runLoadtest(args []string) error {
+	flags := flag.NewFlagSet(loadtestCommand, flag.ContinueOnError)
+	endpoint := flags.String("url", "", "wss:// endpoint (defaults to the endpoint in "+client.ConfigFileName+")")
+	connections := flags.Int("connections", 10, "concurrent connections")
+	rate := flags.Float64("rate", 1, "messages broadcast per second, across all connections")
+	duration := flags.Duration("duration", 30*time.Second, "how long to send messages")
+	drain := flags.Duration("drain", 5*time.Second, "how long to wait for deliveries once sending stops")
+	payloadSize := flags.Int("payload-size", 0, "bytes of padding added to each message")
+	encoding := flags.String("encoding", "", "frame encoding to negotiate (eg, msgpack)")
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		return parseErr
+	}
+	interval := time.Duration(float64(time.Second) / *rate)
+	if *connections < 1 || interval <= 0 {
+		return fmt.Errorf("--connections and --rate must be positive")
+	}
+	if *endpoint == "" {
+		config, configErr := client.LoadConfig(client.ConfigFileName)
+		if configErr != nil {
+			return fmt.Errorf("--url is required without %s: %s", client.ConfigFileName, configErr)
+		}
+		*endpoint = config.Endpoint
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	run := fmt.Sprintf("%d", time.Now().UnixNano())
+	results := &loadtestResults{}
+
+	// Open the connections
+	clients := make([]*client.Client, *connections)
+	dialGroup, dialCtx := errgroup.WithContext(ctx)
+	dialGroup.SetLimit(loadtestDialConcurrency)
+	for eachIndex := range clients {
+		eachIndex := eachIndex
+		dialGroup.Go(func() error {
+			wsClient, connectErr := client.Connect(dialCtx, client.Options{
+				URL:         *endpoint,
+				Encoding:    protocol.Encoding(*encoding),
+				MaxAttempts: 3,
+				OnReconnect: func(*client.Client) {
+					results.add(func(results *loadtestResults) {
+						results.reconnects++
+					})
+				},
+			})
+			if connectErr != nil {
+				results.add(func(results *loadtestResults) {
+					results.connectErrors++
+				})
+				return nil
+			}
+			clients[eachIndex] = wsClient
+			return nil
+		})
+	}
+	dialGroup.Wait()
+	var connected []*client.Client
+	for _, eachClient := range clients {
+		if eachClient != nil {
+			connected = append(connected, eachClient)
+		}
+	}
+	if len(connected) == 0 {
+		return fmt.Errorf("failed to open any connections to %s", *endpoint)
+	}
+	results.connections = len(connected)
+	var receivers sync.WaitGroup
+	for _, eachClient := range connected {
+		receivers.Add(1)
+		go func(wsClient *client.Client) {
+			defer receivers.Done()
+			receiveProbes(wsClient, run, results)
+		}(eachClient)
+	}
+	fmt.Fprintf(os.Stderr, "Opened %d connections to %s; sending %.1f messages/s for %s\n",
+		len(connected),
+		*endpoint,
+		*rate,
+		*duration)
+
+	// Send the messages
+	started := time.Now()
+	ticker := time.NewTicker(interval)
+	deadline := time.After(*duration)
+	pad := strings.Repeat("x", *payloadSize)
+sending:
+	for seq := 0; ; seq++ {
+		select {
+		case <-ctx.Done():
+			break sending
+		case <-deadline:
+			break sending
+		case <-ticker.C:
+			sendErr := connected[seq%len(connected)].Broadcast(&loadtestProbe{
+				Run:    run,
+				Seq:    seq,
+				SentAt: time.Now().UnixNano(),
+				Pad:    pad,
+			})
+			results.add(func(results *loadtestResults) {
+				if sendErr != nil {
+					results.sendErrors++
+					return
+				}
+				results.sent++
+			})
+		}
+	}
+	ticker.Stop()
+	elapsed := time.Since(started)
+
+	// Wait for the last deliveries
+	select {
+	case <-ctx.Done():
+	case <-time.After(*drain):
+	}
+	for _, eachClient := range connected {
+		eachClient.Close()
+	}
+	receivers.Wait()
+	results.write(os.Stdout, elapsed)
+	return nil
+}
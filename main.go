@@ -2,36 +2,73 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	_ "net/http/pprof" // include pprop
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	awsEvents "github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	apigwManagement "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	sparta "github.com/mweagle/Sparta"
-	spartaAWS "github.com/mweagle/Sparta/aws"
 	spartaCF "github.com/mweagle/Sparta/aws/cloudformation"
-	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/mweagle/SpartaWebSocket/authorizer"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	"github.com/mweagle/SpartaWebSocket/connections"
+	"github.com/mweagle/SpartaWebSocket/connectiontable"
+	"github.com/mweagle/SpartaWebSocket/protocol"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	envKeyTableName          = "CONNECTIONS_TABLENAME"
-	ddbAttributeConnectionID = "connectionID"
+	ddbAttributeEncoding     = "encoding"
+	ddbAttributeCompression  = "compression"
+	ddbAttributeChunked      = "chunked"
+	ddbAttributeSubprotocol  = "subprotocol"
+	ddbAttributeLocale       = "locale"
+	queryParamProtocol       = "protocol"
+	queryParamAccept         = "accept-encodings"
+	queryParamLocale         = "locale"
+	headerAcceptLanguage     = "Accept-Language"
+	// envKeyTableBillingMode provisions an on-demand connection table at
+	// provision time when it's PAY_PER_REQUEST
+	envKeyTableBillingMode   = "CONNECTION_TABLE_BILLING_MODE"
+	billingModePayPerRequest = "PAY_PER_REQUEST"
 )
 
 type wsResponse struct {
-	StatusCode int    `json:"statusCode"`
-	Body       string `json:"body"`
+	StatusCode int               `json:"statusCode"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body"`
 }
 
-func deleteConnection(connectionID string, ddbService *dynamodb.DynamoDB) error {
+// statusResponse is the route response body of typed handlers that only
+// report a status message
+type statusResponse struct {
+	Message       string `json:"message"`
+	CorrelationID string `json:"correlationId,omitempty"`
+	// Duplicate is true if the send was a retry of an earlier request, whose
+	// correlation ID is returned, and wasn't broadcast again
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+func deleteConnection(ctx context.Context, connectionID string, ddbService dynamodbiface.DynamoDBAPI) error {
+	_, delItemErr := deleteConnectionItem(ctx, connectionID, ddbService)
+	return delItemErr
+}
+
+// deleteConnectionItem deletes the connection and returns the deleted item
+func deleteConnectionItem(ctx context.Context,
+	connectionID string,
+	ddbService dynamodbiface.DynamoDBAPI) (map[string]*dynamodb.AttributeValue, error) {
 	delItemInput := &dynamodb.DeleteItemInput{
 		TableName: aws.String(os.Getenv(envKeyTableName)),
 		Key: map[string]*dynamodb.AttributeValue{
@@ -39,209 +76,1044 @@ func deleteConnection(connectionID string, ddbService *dynamodb.DynamoDB) error
 				S: aws.String(connectionID),
 			},
 		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
 	}
-	_, delItemErr := ddbService.DeleteItem(delItemInput)
-	return delItemErr
+	delItemOutput, delItemErr := ddbService.DeleteItemWithContext(ctx, delItemInput)
+	if delItemErr != nil {
+		return nil, delItemErr
+	}
+	unindexErr := unindexConnection(ctx, connectionID)
+	if unindexErr != nil {
+		return nil, unindexErr
+	}
+	return delItemOutput.Attributes, nil
+}
+
+// getConnectionItem returns the stored item for the connection
+func getConnectionItem(connectionID string,
+	ddbService dynamodbiface.DynamoDBAPI) (map[string]*dynamodb.AttributeValue, error) {
+	getItemInput := &dynamodb.GetItemInput{
+		TableName: aws.String(os.Getenv(envKeyTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			ddbAttributeConnectionID: &dynamodb.AttributeValue{
+				S: aws.String(connectionID),
+			},
+		},
+	}
+	getItemOutput, getItemErr := ddbService.GetItem(getItemInput)
+	if getItemErr != nil {
+		return nil, getItemErr
+	}
+	return getItemOutput.Item, nil
+}
+
+// itemLocale returns the locale stored in the connection item
+func itemLocale(item map[string]*dynamodb.AttributeValue) string {
+	if item[ddbAttributeLocale] == nil || item[ddbAttributeLocale].S == nil {
+		return catalog.DefaultLocale
+	}
+	return catalog.Match(*item[ddbAttributeLocale].S)
+}
+
+// handshakeLocale returns the locale requested by the $connect query
+// parameter, falling back to the Accept-Language header
+func handshakeLocale(request awsEvents.APIGatewayWebsocketProxyRequest) string {
+	if locale, localeExists := request.QueryStringParameters[queryParamLocale]; localeExists {
+		return catalog.Match(locale)
+	}
+	return catalog.Match(request.Headers[headerAcceptLanguage])
+}
+
+// itemNegotiation returns the content negotiation stored in the connection item
+func itemNegotiation(item map[string]*dynamodb.AttributeValue) protocol.Negotiation {
+	negotiation := protocol.DefaultNegotiation
+	if item[ddbAttributeEncoding] != nil && item[ddbAttributeEncoding].S != nil {
+		negotiation.Encoding = protocol.ParseEncoding(*item[ddbAttributeEncoding].S)
+	}
+	if item[ddbAttributeCompression] != nil && item[ddbAttributeCompression].S != nil {
+		negotiation.Compression = protocol.ParseCompression(*item[ddbAttributeCompression].S)
+	}
+	if item[ddbAttributeChunked] != nil && item[ddbAttributeChunked].BOOL != nil {
+		negotiation.Chunked = *item[ddbAttributeChunked].BOOL
+	}
+	negotiation.Subprotocol = itemString(item, ddbAttributeSubprotocol)
+	return negotiation
+}
+
+// negotiationAttributes are the connection item attributes that
+// itemNegotiation reads. They're copied to the room membership, tag, and
+// subscription items so that deliveries don't read the connection table.
+var negotiationAttributes = []string{ddbAttributeEncoding,
+	ddbAttributeCompression,
+	ddbAttributeChunked,
+	ddbAttributeSubprotocol}
+
+// handshakeNegotiation returns the content negotiation requested by the
+// $connect query parameters. The `protocol` parameter is honored for clients
+// that don't supply `accept-encodings`.
+func handshakeNegotiation(queryParams map[string]string) protocol.Negotiation {
+	acceptEncodings, acceptEncodingsExists := queryParams[queryParamAccept]
+	if !acceptEncodingsExists {
+		acceptEncodings = queryParams[queryParamProtocol]
+	}
+	return protocol.Negotiate(acceptEncodings)
+}
+
+// requestPayload returns the JSON data to broadcast from either a JSON text
+// frame or a binary frame in the sender's negotiated encoding
+func requestPayload(request awsEvents.APIGatewayWebsocketProxyRequest,
+	senderItem map[string]*dynamodb.AttributeValue) (json.RawMessage, error) {
+	payload, _, payloadErr := requestData(request, senderItem)
+	return payload, payloadErr
+}
+
+// requestData returns the request's JSON data like requestPayload, and
+// whether it's an opaque binary payload. Binary frames from JSON connections
+// that aren't JSON frames are opaque binary payloads, whose data is the
+// protocol.BinaryData form; the form is only trusted alongside the returned
+// flag, since a text frame could carry the same data.
+func requestData(request awsEvents.APIGatewayWebsocketProxyRequest,
+	senderItem map[string]*dynamodb.AttributeValue) (json.RawMessage, bool, error) {
+	if !request.IsBase64Encoded {
+		payload, payloadErr := protocol.CodecFor(protocol.EncodingJSON).Decode([]byte(request.Body))
+		return payload, false, payloadErr
+	}
+	frame, decodeErr := base64.StdEncoding.DecodeString(request.Body)
+	if decodeErr != nil {
+		return nil, false, decodeErr
+	}
+	encoding := itemNegotiation(senderItem).Encoding
+	payload, payloadErr := protocol.CodecFor(encoding).Decode(frame)
+	if payloadErr != nil && encoding == protocol.EncodingJSON {
+		payload, payloadErr = protocol.BinaryData(frame)
+		return payload, payloadErr == nil, payloadErr
+	}
+	return payload, false, payloadErr
 }
 
 // Connect the client
 func connectWorld(ctx context.Context, request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
 	// Preconditions
-	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
-	sess := spartaAWS.NewSession(logger)
-	dynamoClient := dynamodb.New(sess)
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	dynamoClient := newConnectionsClient(sess)
 
 	// Operation
+	negotiation := handshakeNegotiation(request.QueryStringParameters)
+	subprotocol := handshakeSubprotocol(request)
+	if subprotocol != "" {
+		negotiation = subprotocolNegotiation(subprotocol)
+	}
+	locale := handshakeLocale(request)
+	affinityKey := handshakeAffinityKey(request)
+	if bannedSourceIP(ctx, sess, request.RequestContext.Identity.SourceIP, logger) {
+		return &wsResponse{
+			StatusCode: 403,
+			Body:       catalog.Localize(locale, catalog.Banned),
+		}, nil
+	}
+	resumeToken, resumeTokenErr := newResumeToken()
+	if resumeTokenErr != nil {
+		return &wsResponse{
+			StatusCode: 500,
+			Body:       catalog.Localize(locale, catalog.ConnectFailed, resumeTokenErr.Error()),
+		}, nil
+	}
+	connectedAt := time.Now()
 	putItemInput := &dynamodb.PutItemInput{
 		TableName: aws.String(os.Getenv(envKeyTableName)),
 		Item: map[string]*dynamodb.AttributeValue{
 			ddbAttributeConnectionID: &dynamodb.AttributeValue{
 				S: aws.String(request.RequestContext.ConnectionID),
 			},
+			connections.BucketAttribute:    connections.BucketValue(request.RequestContext.ConnectionID),
+			connections.ExpiresAtAttribute: connections.ExpiresAtValue(connectedAt),
+			ddbAttributeEncoding: &dynamodb.AttributeValue{
+				S: aws.String(string(negotiation.Encoding)),
+			},
+			ddbAttributeCompression: &dynamodb.AttributeValue{
+				S: aws.String(string(negotiation.Compression)),
+			},
+			ddbAttributeLocale: &dynamodb.AttributeValue{
+				S: aws.String(locale),
+			},
+			ddbAttributeAffinityKey: &dynamodb.AttributeValue{
+				S: aws.String(affinityKey),
+			},
+			ddbAttributeShard: &dynamodb.AttributeValue{
+				S: aws.String(stickyShard(ctx, affinityKey, newDynamoClient(sess), logger)),
+			},
+			ddbAttributeResumeToken: &dynamodb.AttributeValue{
+				S: aws.String(resumeToken),
+			},
 		},
 	}
+	if negotiation.Chunked {
+		putItemInput.Item[ddbAttributeChunked] = &dynamodb.AttributeValue{
+			BOOL: aws.Bool(true),
+		}
+	}
+	if negotiation.Subprotocol != "" {
+		putItemInput.Item[ddbAttributeSubprotocol] = &dynamodb.AttributeValue{
+			S: aws.String(negotiation.Subprotocol),
+		}
+	}
+	// The user index is sparse, so only identified connections are indexed
+	user := handshakeIdentity(request)
+	for eachName, eachValue := range user.attributes() {
+		putItemInput.Item[eachName] = eachValue
+	}
+	for eachName, eachValue := range handshakeMetadata(request, connectedAt) {
+		putItemInput.Item[eachName] = eachValue
+	}
+	for eachName, eachValue := range regionAttributes(request) {
+		putItemInput.Item[eachName] = eachValue
+	}
+	for eachName, eachValue := range handshakeAttributes(request) {
+		putItemInput.Item[eachName] = eachValue
+	}
+	tags := handshakeTags(request)
+	if len(tags) != 0 && os.Getenv(envKeyTagsTableName) != "" {
+		putItemInput.Item[ddbAttributeTagCount] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.Itoa(len(tags))),
+		}
+	}
 	_, putItemErr := dynamoClient.PutItem(putItemInput)
+	if putItemErr == nil {
+		putItemErr = indexConnection(ctx, request.RequestContext.ConnectionID, putItemInput.Item)
+	}
+	if putItemErr == nil {
+		markConnectionsChanged(ctx, newDynamoClient(sess), logger)
+	}
+	if putItemErr == nil {
+		_, putItemErr = putTags(ctx,
+			request.RequestContext.ConnectionID,
+			putItemInput.Item,
+			tags,
+			newDynamoClient(sess))
+	}
 	if putItemErr != nil {
 		return &wsResponse{
 			StatusCode: 500,
-			Body:       fmt.Sprintf("Failed to connect: %s", putItemErr.Error()),
+			Body:       catalog.Localize(locale, catalog.ConnectFailed, putItemErr.Error()),
 		}, nil
 	}
-	return &wsResponse{
+	restoreResumeSession(ctx, sess, request, putItemInput.Item, logger)
+	publishMetric(metricConnectionsOpened, 1, logger)
+	notifyPresenceChange(ctx, sess, request, user.userID, true, logger)
+	schedulePendingFlush(ctx, sess, request, user, logger)
+	response := &wsResponse{
 		StatusCode: 200,
-		Body:       "Connected.",
-	}, nil
+		Body:       catalog.Localize(locale, catalog.Connected),
+	}
+	// Clients that request a subprotocol close the connection unless the
+	// handshake response selects it
+	if subprotocol != "" {
+		response.Headers = map[string]string{
+			headerWebSocketProtocol: subprotocol,
+		}
+	}
+	return response, nil
 }
 
 // Disconnect the client
 func disconnectWorld(ctx context.Context, request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
 
 	// Preconditions
-	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
-	sess := spartaAWS.NewSession(logger)
-	dynamoClient := dynamodb.New(sess)
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	dynamoClient := newConnectionsClient(sess)
 
 	// Operation
-	delItemErr := deleteConnection(request.RequestContext.ConnectionID, dynamoClient)
+	rooms := releaseConnection(ctx, request.RequestContext.ConnectionID, newDynamoClient(sess), logger)
+	deletedItem, delItemErr := deleteConnectionItem(ctx, request.RequestContext.ConnectionID, dynamoClient)
 	if delItemErr != nil {
 		return &wsResponse{
 			StatusCode: 500,
-			Body:       fmt.Sprintf("Failed to disconnect: %s", delItemErr.Error()),
+			Body:       catalog.Localize(catalog.DefaultLocale, catalog.DisconnectFailed, delItemErr.Error()),
 		}, nil
 	}
+	saveResumeSession(ctx, deletedItem, rooms, newDynamoClient(sess), logger)
+	publishMetric(metricConnectionsClosed, 1, logger)
+	notifyPresenceChange(ctx, sess, request, itemUserID(deletedItem), false, logger)
+	if record := newConnectionRecord(deletedItem); record != nil {
+		logger.WithFields(logrus.Fields{
+			"ConnectionID": record.ConnectionID,
+			"SourceIP":     record.SourceIP,
+			"Duration":     record.Duration(time.Now()).String(),
+		}).Info("Connection closed")
+	}
 	return &wsResponse{
 		StatusCode: 200,
-		Body:       "Disconnected.",
+		Body:       catalog.Localize(itemLocale(deletedItem), catalog.Disconnected),
 	}, nil
 }
 
-// sendMessage to all the subscribers
+// sendMessage to all the subscribers. The request data is broadcast as is.
 func sendMessage(ctx context.Context,
-	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	call *wsCall[json.RawMessage]) (*statusResponse, error) {
 
 	// Preconditions
-	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
-	sess := spartaAWS.NewSession(logger)
-	endpointURL := fmt.Sprintf("%s/%s",
-		request.RequestContext.DomainName,
-		request.RequestContext.Stage)
-	logger.WithField("Endpoint", endpointURL).Info("API Gateway Endpoint")
-	dynamoClient := dynamodb.New(sess)
-	apigwMgmtClient := apigwManagement.New(sess, aws.NewConfig().WithEndpoint(endpointURL))
-
-	// Get the input request...
-	var objMap map[string]*json.RawMessage
-	unmarshalErr := json.Unmarshal([]byte(request.Body), &objMap)
-	if unmarshalErr != nil || objMap["data"] == nil {
-		return &wsResponse{
-			StatusCode: 500,
-			Body:       "Failed to unmarshal request: " + unmarshalErr.Error(),
-		}, nil
+	call.logger.WithField("Endpoint", call.endpointURL).Info("API Gateway Endpoint")
+	if rateLimited(ctx, call.sess, call.request.RequestContext.ConnectionID, call.dynamoClient, call.logger) {
+		return nil, call.fail(errorCodeRateLimited, catalog.RateLimited)
 	}
-	// Operations
-	scanCallback := func(output *dynamodb.ScanOutput, lastPage bool) bool {
-		// Send the message to all the clients
-		for _, eachItem := range output.Items {
-			receiverConnection := ""
-			if eachItem[ddbAttributeConnectionID].S != nil {
-				receiverConnection = *eachItem[ddbAttributeConnectionID].S
-			}
-			postConnectionInput := &apigwManagement.PostToConnectionInput{
-				ConnectionId: aws.String(receiverConnection),
-				Data:         *objMap["data"],
-			}
-			_, respErr := apigwMgmtClient.PostToConnectionWithContext(ctx, postConnectionInput)
-			if respErr != nil {
-				if receiverConnection != "" &&
-					strings.Contains(respErr.Error(), apigwManagement.ErrCodeGoneException) {
-					// Async clean it up...
-					go deleteConnection(receiverConnection, dynamoClient)
-				} else {
-					logger.WithField("Error", respErr).Warn("Failed to post to connection")
-				}
-			}
-			return true
+	moderatedData, delivered, moderateErr := moderateMessage(ctx, call, call.data)
+	if moderateErr != nil {
+		return nil, moderateErr
+	}
+	if !delivered {
+		return nil, call.fail(errorCodeMessageRejected, catalog.MessageRejected)
+	}
+	call.data = moderatedData
+	requestID := call.request.RequestContext.RequestID
+	idempotencyKey, idempotencyKeyErr := requestIdempotencyKey(call.request)
+	if idempotencyKeyErr != nil {
+		return nil, call.fail(errorCodeMalformedRequest, catalog.UnmarshalFailed, idempotencyKeyErr.Error())
+	}
+	targets, targetsErr := requestTargets(call.request)
+	if targetsErr != nil {
+		return nil, call.fail(errorCodeMalformedRequest, catalog.UnmarshalFailed, targetsErr.Error())
+	}
+	idempotencyClient := newDynamoClient(call.sess)
+	if idempotencyKey != "" {
+		idempotencyKey = scopedIdempotencyKey(idempotencyKey,
+			call.request.RequestContext.ConnectionID,
+			call.senderItem)
+		originalRequestID, claimErr := claimIdempotencyKey(ctx, idempotencyClient, idempotencyKey, requestID)
+		if claimErr == errDuplicateRequest {
+			call.logger.WithField("OriginalRequestID", originalRequestID).Info("Skipping duplicate broadcast")
+			return &statusResponse{
+				Message:       catalog.Localize(call.locale, catalog.DataSent),
+				CorrelationID: originalRequestID,
+				Duplicate:     true,
+			}, nil
+		}
+		if claimErr != nil {
+			return nil, claimErr
 		}
-		return true
 	}
 
-	// Scan the connections table
-	scanInput := &dynamodb.ScanInput{
-		TableName: aws.String(os.Getenv(envKeyTableName)),
+	// Operations
+	var stats deliveryStats
+	var scanItemErr error
+	switch {
+	case targets.Tag != "":
+		stats, scanItemErr = deliverTag(ctx,
+			call.sess,
+			call.endpointURL,
+			requestID,
+			targets.Tag,
+			call.data,
+			call.binary,
+			targets.excluded(call.request),
+			call.logger)
+	case targets.targeted():
+		stats, scanItemErr = deliverTargeted(ctx,
+			call.sess,
+			call.endpointURL,
+			requestID,
+			call.data,
+			call.binary,
+			targets,
+			targets.excluded(call.request),
+			call.logger)
+	default:
+		stats, scanItemErr = deliverBroadcast(ctx,
+			call.sess,
+			call.endpointURL,
+			requestID,
+			call.data,
+			call.binary,
+			targets.excluded(call.request),
+			targets.Filter,
+			call.logger)
 	}
-	scanItemErr := dynamoClient.ScanPagesWithContext(ctx,
-		scanInput,
-		scanCallback)
+	call.logger.WithField("Stats", stats).Info("Broadcast complete")
 	if scanItemErr != nil {
-		return &wsResponse{
-			StatusCode: 500,
-			Body:       fmt.Sprintf("Failed to send message: %s", scanItemErr.Error()),
-		}, nil
+		if idempotencyKey != "" {
+			releaseIdempotencyKey(ctx, idempotencyClient, idempotencyKey, requestID, call.logger)
+		}
+		return nil, scanItemErr
+	}
+	if idempotencyKey != "" {
+		completeIdempotencyKey(ctx, idempotencyClient, idempotencyKey, requestID, call.logger)
 	}
+	// Targeted, filtered, and tagged messages aren't part of the shared
+	// history, which every connection can fetch
+	if targets.everyone() {
+		recordHistory(ctx, call.sess, call.request, "", call.senderItem, "", 0, call.data, call.logger)
+	}
+	forwardMessage(ctx, call.sess, call.request, &webhookEvent{
+		Type: webhookTypeBroadcast,
+		Data: call.data,
+	}, call.senderItem, call.logger)
 	// Respond to the sender that data was sent
-	return &wsResponse{
-		StatusCode: 200,
-		Body:       "Data sent.",
+	return &statusResponse{
+		Message:       catalog.Localize(call.locale, catalog.DataSent),
+		CorrelationID: requestID,
 	}, nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 // Main
 func main() {
+	// The client and loadtest commands don't need the stack
+	if len(os.Args) > 1 && os.Args[1] == clientCommand {
+		clientErr := runClient(os.Args[2:])
+		if clientErr != nil {
+			fmt.Fprintln(os.Stderr, clientErr)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == loadtestCommand {
+		loadtestErr := runLoadtest(os.Args[2:])
+		if loadtestErr != nil {
+			fmt.Fprintln(os.Stderr, loadtestErr)
+			os.Exit(1)
+		}
+		return
+	}
+	// The deployment stage and connection table flags configure the stack,
+	// the rest belong to Sparta
+	spartaArgs, configFlagsErr := stripConfigFlags(os.Args[1:])
+	if configFlagsErr != nil {
+		fmt.Fprintln(os.Stderr, configFlagsErr)
+		os.Exit(1)
+	}
+	os.Args = append(os.Args[:1], spartaArgs...)
+	deployment, deploymentErr := newDeploymentStage()
+	if deploymentErr != nil {
+		fmt.Fprintln(os.Stderr, deploymentErr)
+		os.Exit(1)
+	}
+	apiStageName = deployment.apiStageName()
+	tables, tablesErr := newTableConfig()
+	if tablesErr != nil {
+		fmt.Fprintln(os.Stderr, tablesErr)
+		os.Exit(1)
+	}
+	tables.Name = deployment.tableName(tables.Name)
+	ddbAttributeConnectionID = tables.ConnectionIDAttribute
+
 	// StackName
 	pathName, _ := os.Getwd()
 	dirName := strings.Split(pathName, string(filepath.Separator))
 
+	// The describe command renders the topology offline, so it uses the
+	// unscoped name rather than looking up the account
+	describing := len(os.Args) > 1 && os.Args[1] == describeCommand
 	sess := session.Must(session.NewSession())
-	awsName, awsNameErr := spartaCF.UserAccountScopedStackName(dirName[len(dirName)-1],
-		sess)
-	if awsNameErr != nil {
-		fmt.Print("Failed to create stack name\n")
-		os.Exit(1)
+	awsName := dirName[len(dirName)-1]
+	if !describing {
+		scopedName, awsNameErr := spartaCF.UserAccountScopedStackName(awsName, sess)
+		if awsNameErr != nil {
+			fmt.Print("Failed to create stack name\n")
+			os.Exit(1)
+		}
+		awsName = scopedName
 	}
-	// 1. Lambda Functions
-	lambdaConnect, _ := sparta.NewAWSLambda("ConnectWorld",
-		connectWorld,
-		sparta.IAMRoleDefinition{})
-	lambdaDisconnect, _ := sparta.NewAWSLambda("DisconnectWorld",
-		disconnectWorld,
-		sparta.IAMRoleDefinition{})
-	lambdaSend, _ := sparta.NewAWSLambda("SendMessage",
-		sendMessage,
-		sparta.IAMRoleDefinition{})
+	awsName = deployment.stackName(awsName)
+	// 1. Lambda Functions. The topology records the lambdas, routes, and
+	// resources for the describe command.
+	topo := newTopology()
+	lambdaConnect := topo.lambda("ConnectWorld", routeHandler(connectWorld))
+	lambdaDisconnect := topo.lambda("DisconnectWorld", routeHandler(disconnectWorld))
+	lambdaSend := topo.lambda("SendMessage", frameHandler(withDefaultRoute(withTypedRequest(sendMessage))))
+	lambdaDeliver := topo.lambda("DeliverSegment", deliverSegmentEvent)
+	lambdaSubmitWork := topo.lambda("SubmitWork", frameHandler(submitWork))
+	lambdaProcessWork := topo.lambda("ProcessWork", processWork)
+	lambdaCleanup := topo.lambda("CleanupConnections", cleanupConnections)
+	lambdaRebalance := topo.lambda("RebalanceShards", rebalanceShards)
+	lambdaReaper := topo.lambda("ReapConnections", reapConnections)
 
 	// APIv2 Websockets
-	stage, _ := sparta.NewAPIV2Stage("v1")
+	stage, _ := sparta.NewAPIV2Stage(apiStageName)
 	stage.Description = "New deploy!"
 
 	apiGateway, _ := sparta.NewAPIV2(sparta.Websocket,
 		"sample",
 		"$request.body.message",
 		stage)
-	apiv2ConnectRoute, _ := apiGateway.NewAPIV2Route("$connect",
-		lambdaConnect)
-	apiv2ConnectRoute.OperationName = "ConnectRoute"
-	apiv2DisconnectRoute, _ := apiGateway.NewAPIV2Route("$disconnect",
-		lambdaDisconnect)
-	apiv2DisconnectRoute.OperationName = "DisconnectRoute"
+	topo.route(apiGateway, "$connect", "ConnectRoute", lambdaConnect)
+	topo.route(apiGateway, "$disconnect", "DisconnectRoute", lambdaDisconnect)
+	topo.route(apiGateway, routeSendMessage, "SendRoute", lambdaSend)
+	topo.route(apiGateway, routeWork, "WorkRoute", lambdaSubmitWork)
+	// The room and direct message actions share a single lambda, which
+	// provisions a route for each registered action
+	actions := newActionRouter().
+		handle(routeJoinRoom, "JoinRoomRoute", withSchema(roomSchema, joinRoom)).
+		handle(routeLeaveRoom, "LeaveRoomRoute", withSchema(roomSchema, leaveRoom)).
+		handle(routeSendRoom, "SendRoomRoute", withSchema(roomSchema, sendRoom)).
+		handle(routeSendDirect, "SendDirectRoute", withSchema(directSchema, sendDirect)).
+		handle(routePresence, "PresenceRoute", withSchema(presenceSchema, queryPresence)).
+		handle(routeTyping, "TypingRoute", withSchema(typingSchema, sendTyping)).
+		handle(routeAck, "AckRoute", withSchema(ackSchema, sendAck)).
+		handle(routeHistory, "HistoryRoute", withSchema(historySchema, fetchHistory)).
+		handle(routeResume, "ResumeRoute", withSchema(resumeSchema, resumeRoom)).
+		handle(routeSession, "SessionRoute", issueSession).
+		handle(routeUpdate, "UpdateRoute", withSchema(attributesSchema, withTypedRequest(updateAttributes))).
+		handle(routeSubscribe, "SubscribeRoute", withSchema(topicSchema, withTypedRequest(subscribeTopic))).
+		handle(routeUnsubscribe, "UnsubscribeRoute", withSchema(topicSchema, withTypedRequest(unsubscribeTopic))).
+		handle(routePublish, "PublishRoute", withSchema(topicSchema, withTypedRequest(publishTopic))).
+		handle(routeTag, "TagRoute", withSchema(tagSchema, withTypedRequest(tagConnection)))
+	lambdaActions := actions.provision(topo, apiGateway, "Actions")
 
-	apiv2SendRoute, _ := apiGateway.NewAPIV2Route("sendmessage",
-		lambdaSend)
-	apiv2SendRoute.OperationName = "SendRoute"
+	// Binary protobuf frames can't be evaluated by the route selection
+	// expression, so they arrive on the $default route. Text frames that
+	// don't name a route are rejected with an error frame.
+	topo.route(apiGateway, routeDefault, "DefaultRoute", lambdaSend)
 
 	var apigwPermissions = []sparta.IAMRolePrivilege{
 		{
-			Actions: []string{"execute-api:ManageConnections"},
-			Resource: gocf.Join("",
-				gocf.String("arn:aws:execute-api:"),
-				gocf.Ref("AWS::Region"),
-				gocf.String(":"),
-				gocf.Ref("AWS::AccountId"),
-				gocf.String(":"),
-				gocf.Ref(apiGateway.LogicalResourceName()),
-				gocf.String("/*")),
+			Actions:  []string{"execute-api:ManageConnections"},
+			Resource: manageConnectionsArn(apiGateway),
 		},
 	}
 	lambdaSend.RoleDefinition.Privileges = append(lambdaSend.RoleDefinition.Privileges, apigwPermissions...)
+	lambdaDeliver.RoleDefinition.Privileges = append(lambdaDeliver.RoleDefinition.Privileges, apigwPermissions...)
+	// $connect and $disconnect broadcast presence changes
+	for _, eachNotifier := range []*sparta.LambdaAWSInfo{lambdaConnect, lambdaDisconnect} {
+		eachNotifier.RoleDefinition.Privileges = append(eachNotifier.RoleDefinition.Privileges, apigwPermissions...)
+	}
+	lambdaActions.RoleDefinition.Privileges = append(lambdaActions.RoleDefinition.Privileges, apigwPermissions...)
+	topo.broadcaster(lambdaSend, lambdaDeliver, lambdaActions, lambdaConnect, lambdaDisconnect)
+	// Direct messages to offline users are held and flushed at $connect
+	lambdaFlushPending := topo.lambda("FlushPending", flushPending)
+	lambdaFlushPending.RoleDefinition.Privileges = append(lambdaFlushPending.RoleDefinition.Privileges, apigwPermissions...)
+	topo.broadcaster(lambdaFlushPending)
+	topo.grant(
+		// graphql-ws subscribe and complete messages arrive on $default.
+		// Closed connections' rooms are saved at $disconnect and rejoined
+		// when the client resumes at $connect. Every lambda that deletes
+		// connections releases their memberships, subscriptions, and tags.
+		resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaActions, lambdaDisconnect, lambdaConnect, lambdaReaper, lambdaCleanup},
+			kind:     nodeKindTable,
+			resource: roomMembershipsResourceName,
+			annotate: annotateRoomMemberships,
+		},
+		resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaActions, lambdaDisconnect, lambdaSend, lambdaReaper, lambdaCleanup},
+			kind:     nodeKindTable,
+			resource: topicSubscriptionsResourceName,
+			annotate: annotateTopicSubscriptions,
+		},
+		// Connections are tagged at $connect and by the tag action, and
+		// sendmessage broadcasts to a tag, fanning out to the delivery lambda
+		resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaActions, lambdaDisconnect, lambdaConnect, lambdaSend, lambdaDeliver, lambdaReaper, lambdaCleanup},
+			kind:     nodeKindTable,
+			resource: connectionTagsResourceName,
+			annotate: annotateConnectionTags,
+		},
+		resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaActions, lambdaFlushPending},
+			kind:     nodeKindTable,
+			resource: messageReceiptsResourceName,
+			annotate: annotateMessageReceipts,
+		},
+		resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaSend, lambdaActions},
+			kind:     nodeKindTable,
+			resource: messageHistoryResourceName,
+			annotate: annotateMessageHistory,
+		},
+		resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaSend},
+			kind:     nodeKindTable,
+			resource: idempotencyKeysResourceName,
+			annotate: annotateIdempotencyKeys,
+		},
+		resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaActions},
+			kind:     nodeKindTable,
+			resource: roomSequencesResourceName,
+			annotate: annotateRoomSequences,
+		},
+		resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaActions, lambdaConnect, lambdaDisconnect},
+			kind:     nodeKindTable,
+			resource: resumeSessionsResourceName,
+			annotate: annotateResumeSessions,
+		},
+		resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaActions, lambdaConnect, lambdaFlushPending},
+			kind:     nodeKindTable,
+			resource: pendingDeliveriesResourceName,
+			annotate: annotatePendingDeliveries,
+		},
+		resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaConnect},
+			kind:     nodeKindQueue,
+			resource: pendingFlushQueueResourceName,
+			annotate: annotatePendingFlushProducer,
+		})
+	annotateModeration(lambdaSend)
+	annotatePendingFlushConsumer(lambdaFlushPending)
+	topo.invokes(pendingFlushQueueResourceName, nodeKindQueue, lambdaFlushPending)
+	annotateQueryIdentity(lambdaConnect)
+	annotateFanout(lambdaSend, lambdaDeliver)
+	// Optionally queue broadcast segments for delivery with retries
+	var lambdaDeliverQueued *sparta.LambdaAWSInfo
+	var lambdaRedrive *sparta.LambdaAWSInfo
+	if deliveryQueueEnabled() {
+		lambdaDeliverQueued = topo.lambda("DeliverQueued", deliverQueued)
+		lambdaDeliverQueued.RoleDefinition.Privileges = append(lambdaDeliverQueued.RoleDefinition.Privileges, apigwPermissions...)
+		topo.broadcaster(lambdaDeliverQueued)
+		annotateDeliveryConsumer(lambdaDeliverQueued)
+		annotateDeliveryProducer(lambdaSend)
+		// Deliveries that exhaust their retries are parked in the dead letter
+		// queue until they're redriven
+		lambdaRedrive = topo.lambda("RedriveDeliveries", redriveDeliveries)
+		annotateRedriver(lambdaRedrive)
+	}
+	// Optionally orchestrate segment deliveries with Step Functions
+	var lambdaAggregate *sparta.LambdaAWSInfo
+	if broadcastStateMachineEnabled() {
+		lambdaAggregate = topo.lambda("AggregateDeliveries", aggregateDeliveries)
+		annotateBroadcastStateMachine(lambdaSend)
+	}
+	// Optionally queue room messages so members see them in the same order
+	var lambdaDeliverRoomOrdered *sparta.LambdaAWSInfo
+	if orderedRoomsEnabled() {
+		lambdaDeliverRoomOrdered = topo.lambda("DeliverRoomOrdered", deliverOrderedRooms)
+		lambdaDeliverRoomOrdered.RoleDefinition.Privileges = append(lambdaDeliverRoomOrdered.RoleDefinition.Privileges, apigwPermissions...)
+		topo.broadcaster(lambdaDeliverRoomOrdered)
+		topo.grant(
+			resourceGrant{
+				lambdas:  []*sparta.LambdaAWSInfo{lambdaDeliverRoomOrdered},
+				kind:     nodeKindTable,
+				resource: roomMembershipsResourceName,
+				annotate: annotateRoomMemberships,
+			},
+			resourceGrant{
+				lambdas:  []*sparta.LambdaAWSInfo{lambdaDeliverRoomOrdered},
+				kind:     nodeKindTable,
+				resource: messageReceiptsResourceName,
+				annotate: annotateMessageReceipts,
+			},
+			resourceGrant{
+				lambdas:  []*sparta.LambdaAWSInfo{lambdaDeliverRoomOrdered},
+				kind:     nodeKindQueue,
+				resource: roomQueueResourceName,
+				annotate: annotateRoomConsumer,
+			},
+			resourceGrant{
+				lambdas:  []*sparta.LambdaAWSInfo{lambdaActions},
+				kind:     nodeKindQueue,
+				resource: roomQueueResourceName,
+				annotate: annotateRoomProducer,
+			})
+		topo.invokes(roomQueueResourceName, nodeKindQueue, lambdaDeliverRoomOrdered)
+	}
+	// Optionally push the event stream's records to the stream room
+	var lambdaStream *sparta.LambdaAWSInfo
+	if eventStreamEnabled() {
+		lambdaStream = topo.lambda("StreamEvents", streamEvents)
+		topo.broadcaster(lambdaStream)
+		topo.grant(resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaStream},
+			kind:     nodeKindTable,
+			resource: roomMembershipsResourceName,
+			annotate: annotateRoomMemberships,
+		})
+		annotateEventStreamConsumer(lambdaStream, apiGateway)
+		topo.invokes(eventStreamResourceName, nodeKindStream, lambdaStream)
+	}
+	// Optionally broadcast matching EventBridge events
+	var lambdaPushBus *sparta.LambdaAWSInfo
+	if eventBridgeEnabled() {
+		pattern, patternErr := eventBridgePattern()
+		if patternErr != nil {
+			fmt.Fprintln(os.Stderr, patternErr)
+			os.Exit(1)
+		}
+		lambdaPushBus = topo.lambda("PushBusEvents", pushBusEvent)
+		topo.broadcaster(lambdaPushBus)
+		topo.fansOut(lambdaPushBus, lambdaDeliver)
+		annotateEventBridgeTarget(lambdaPushBus, apiGateway, pattern)
+		topo.invokes(eventBridgeRuleName, nodeKindRule, lambdaPushBus)
+	}
+	// Optionally push the notification topic's messages to connections
+	var lambdaNotify *sparta.LambdaAWSInfo
+	if notificationTopicEnabled() {
+		lambdaNotify = topo.lambda("PublishNotifications", publishNotifications)
+		topo.broadcaster(lambdaNotify)
+		topo.fansOut(lambdaNotify, lambdaDeliver)
+		topo.grant(resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaNotify},
+			kind:     nodeKindTable,
+			resource: roomMembershipsResourceName,
+			annotate: annotateRoomMemberships,
+		})
+		annotateManagementEndpoint(lambdaNotify, apiGateway)
+		topo.invokes(notificationTopicResourceName, nodeKindTopic, lambdaNotify)
+	}
+	// Optionally notify users when their uploads are created
+	var lambdaUploads *sparta.LambdaAWSInfo
+	if uploadNotificationsEnabled() {
+		lambdaUploads = topo.lambda("NotifyUploads", notifyUploads)
+		topo.broadcaster(lambdaUploads)
+		annotateUploadSubscriber(lambdaUploads, apiGateway)
+		topo.invokes(os.Getenv(envKeyUploadBucket), nodeKindBucket, lambdaUploads)
+	}
+	// Optionally let backend systems broadcast over the admin HTTP API
+	var lambdaAdmin *sparta.LambdaAWSInfo
+	if adminAPIEnabled() {
+		lambdaAdmin = topo.lambda("AdminAPI", adminAPI)
+		topo.broadcaster(lambdaAdmin)
+		topo.fansOut(lambdaAdmin, lambdaDeliver)
+		topo.grant(
+			resourceGrant{
+				lambdas:  []*sparta.LambdaAWSInfo{lambdaAdmin},
+				kind:     nodeKindTable,
+				resource: roomMembershipsResourceName,
+				annotate: annotateRoomMemberships,
+			},
+			resourceGrant{
+				lambdas:  []*sparta.LambdaAWSInfo{lambdaAdmin},
+				kind:     nodeKindTable,
+				resource: topicSubscriptionsResourceName,
+				annotate: annotateTopicSubscriptions,
+			},
+			resourceGrant{
+				lambdas:  []*sparta.LambdaAWSInfo{lambdaAdmin},
+				kind:     nodeKindTable,
+				resource: connectionTagsResourceName,
+				annotate: annotateConnectionTags,
+			})
+		annotateManagementEndpoint(lambdaAdmin, apiGateway)
+		topo.invokes(adminAPIResourceName, nodeKindAPI, lambdaAdmin)
+	}
+	// Optionally forward accepted messages to an external webhook
+	var lambdaForward *sparta.LambdaAWSInfo
+	if webhookEnabled() {
+		lambdaForward = topo.lambda("ForwardWebhooks", forwardWebhooks)
+		annotateWebhookForwarder(lambdaForward)
+		topo.grant(resourceGrant{
+			lambdas:  []*sparta.LambdaAWSInfo{lambdaSend, lambdaActions},
+			kind:     nodeKindQueue,
+			resource: webhookQueueResourceName,
+			annotate: annotateWebhookProducer,
+		})
+		topo.invokes(webhookQueueResourceName, nodeKindQueue, lambdaForward)
+		topo.uses(lambdaForward, nodeKindAPI, os.Getenv(envKeyWebhookURL))
+	}
+	annotateShardAssignments(lambdaConnect)
+	annotateWorkProducer(lambdaSubmitWork)
+	annotateShardAssignments(lambdaSubmitWork)
+	annotateRebalancer(lambdaRebalance, lambdaSubmitWork)
+	annotateWorkConsumer(lambdaProcessWork)
+	lambdaProcessWork.RoleDefinition.Privileges = append(lambdaProcessWork.RoleDefinition.Privileges, apigwPermissions...)
+	lambdaSubmitWork.RoleDefinition.Privileges = append(lambdaSubmitWork.RoleDefinition.Privileges, apigwPermissions...)
+	annotateCleanupConsumer(lambdaCleanup)
+	annotateReaper(lambdaReaper, apiGateway)
 
 	// Create the connection table decorator to provision the table and hook
-	// up the environment variables
-	decorator, _ := apiGateway.NewConnectionTableDecorator(envKeyTableName,
-		ddbAttributeConnectionID,
-		5,
-		5)
+	// up the environment variables. The provisioned capacity auto scales,
+	// unless the table is on-demand.
+	// Broadcasts query the table's hash bucket index.
+	tableOptions := connections.TableOptions(ddbAttributeConnectionID)
+	if tableARN := os.Getenv(envKeyExternalTableARN); tableARN != "" {
+		tableOptions = append(tableOptions, connectiontable.WithExternalTable(tableARN))
+	}
+	if strings.EqualFold(os.Getenv(envKeyTableBillingMode), billingModePayPerRequest) {
+		tableOptions = append(tableOptions, connectiontable.WithPayPerRequest())
+	}
+	// Multi-region stacks share a global table, so broadcasts reach the
+	// connections in every region
+	if multiRegionEnabled() {
+		tableOptions = append(tableOptions, connectiontable.WithGlobalTable(globalTableName(awsName),
+			globalTableRegions(),
+			aws.StringValue(sess.Config.Region)))
+	}
+	decorator, decoratorErr := tables.decorator(tableOptions...)
+	if decoratorErr != nil {
+		fmt.Fprintln(os.Stderr, decoratorErr)
+		os.Exit(1)
+	}
 	var lambdaFunctions []*sparta.LambdaAWSInfo
 	lambdaFunctions = append(lambdaFunctions,
 		lambdaConnect,
 		lambdaDisconnect,
-		lambdaSend)
+		lambdaSend,
+		lambdaDeliver,
+		lambdaSubmitWork,
+		lambdaProcessWork,
+		lambdaCleanup,
+		lambdaRebalance,
+		lambdaReaper,
+		lambdaActions,
+		lambdaFlushPending)
+	if lambdaDeliverQueued != nil {
+		lambdaFunctions = append(lambdaFunctions, lambdaDeliverQueued, lambdaRedrive)
+	}
+	if lambdaDeliverRoomOrdered != nil {
+		lambdaFunctions = append(lambdaFunctions, lambdaDeliverRoomOrdered)
+	}
+	if lambdaAggregate != nil {
+		lambdaFunctions = append(lambdaFunctions, lambdaAggregate)
+	}
+	if lambdaStream != nil {
+		lambdaFunctions = append(lambdaFunctions, lambdaStream)
+	}
+	if lambdaPushBus != nil {
+		lambdaFunctions = append(lambdaFunctions, lambdaPushBus)
+	}
+	if lambdaNotify != nil {
+		lambdaFunctions = append(lambdaFunctions, lambdaNotify)
+	}
+	if lambdaUploads != nil {
+		lambdaFunctions = append(lambdaFunctions, lambdaUploads)
+	}
+	if lambdaAdmin != nil {
+		lambdaFunctions = append(lambdaFunctions, lambdaAdmin)
+	}
+	if lambdaForward != nil {
+		lambdaFunctions = append(lambdaFunctions, lambdaForward)
+	}
 	annotateErr := decorator.AnnotateLambdas(lambdaFunctions)
 	if annotateErr != nil {
 		os.Exit(2)
 	}
+	for _, eachLambda := range lambdaFunctions {
+		annotateDataAccount(eachLambda)
+	}
+	for _, eachLambda := range lambdaFunctions {
+		topo.uses(eachLambda, nodeKindTable, connectiontable.ResourceName)
+	}
+	topo.invokes(cleanupQueueResourceName, nodeKindQueue, lambdaCleanup)
+	// Optionally publish broadcast segments to SNS rather than invoking the
+	// delivery lambda
+	if fanoutTopicEnabled() {
+		annotateFanoutTopic(lambdaSend)
+		topo.uses(lambdaSend, nodeKindTopic, fanoutTopicResourceName)
+		topo.invokes(fanoutTopicResourceName, nodeKindTopic, lambdaDeliver)
+	} else if lambdaDeliverQueued != nil {
+		topo.uses(lambdaSend, nodeKindQueue, deliveryQueueResourceName)
+		topo.invokes(deliveryQueueResourceName, nodeKindQueue, lambdaDeliverQueued)
+		topo.uses(lambdaDeliverQueued, nodeKindQueue, deliveryQueueResourceName)
+		topo.uses(lambdaDeliverQueued, nodeKindQueue, deliveryDeadLetterQueueName)
+		topo.uses(lambdaRedrive, nodeKindQueue, deliveryDeadLetterQueueName)
+		topo.uses(lambdaRedrive, nodeKindQueue, deliveryQueueResourceName)
+	} else if lambdaAggregate != nil {
+		topo.uses(lambdaSend, nodeKindStateMachine, broadcastStateMachineResourceName)
+		topo.invokes(broadcastStateMachineResourceName, nodeKindStateMachine, lambdaDeliver)
+		topo.invokes(broadcastStateMachineResourceName, nodeKindStateMachine, lambdaAggregate)
+	} else {
+		topo.invokes(topo.lambdaNames[lambdaSend], nodeKindLambda, lambdaDeliver)
+	}
+	for _, eachLambda := range []*sparta.LambdaAWSInfo{lambdaConnect, lambdaSubmitWork, lambdaRebalance} {
+		topo.uses(eachLambda, nodeKindTable, shardAssignmentsResourceName)
+	}
+	topo.uses(lambdaSubmitWork, nodeKindQueue, workQueueResourceName)
+	topo.invokes(workQueueResourceName, nodeKindQueue, lambdaProcessWork)
+	// Optionally require a JWT (eg, a Cognito user pool token), or whatever
+	// the custom validator accepts, to connect
+	var lambdaAuthorizer *sparta.LambdaAWSInfo
+	if validator := connectValidator(); validator != nil {
+		lambdaAuthorizer = topo.lambda("AuthorizeConnect", authorizer.NewHandler(validator))
+		annotateConnectAuthorizer(lambdaAuthorizer)
+		lambdaFunctions = append(lambdaFunctions, lambdaAuthorizer)
+		topo.invokes(authorizer.ResourceName, nodeKindRoute, lambdaAuthorizer)
+	}
+	if describing {
+		topologyErr := renderTopology(topo, os.Args[2:])
+		if topologyErr != nil {
+			fmt.Fprintln(os.Stderr, topologyErr)
+			os.Exit(1)
+		}
+		return
+	}
 	// Set everything up and run it...
 	workflowHooks := &sparta.WorkflowHooks{
-		ServiceDecorators: []sparta.ServiceDecoratorHookHandler{decorator},
+		ServiceDecorators: []sparta.ServiceDecoratorHookHandler{
+			decorator,
+			sparta.ServiceDecoratorHookFunc(payloadBucketDecorator),
+			sparta.ServiceDecoratorHookFunc(cleanupQueueDecorator),
+			workQueueDecorator(lambdaProcessWork),
+			sparta.ServiceDecoratorHookFunc(shardAssignmentsDecorator),
+			sparta.ServiceDecoratorHookFunc(roomMembershipsDecorator),
+			sparta.ServiceDecoratorHookFunc(topicSubscriptionsDecorator),
+			sparta.ServiceDecoratorHookFunc(connectionTagsDecorator),
+			sparta.ServiceDecoratorHookFunc(messageReceiptsDecorator),
+			sparta.ServiceDecoratorHookFunc(messageHistoryDecorator),
+			sparta.ServiceDecoratorHookFunc(roomSequencesDecorator),
+			sparta.ServiceDecoratorHookFunc(resumeSessionsDecorator),
+			sparta.ServiceDecoratorHookFunc(pendingDeliveriesDecorator),
+			sparta.ServiceDecoratorHookFunc(idempotencyKeysDecorator),
+			stackOutputsDecorator(apiGateway, decorator.TableName()),
+		},
+	}
+	if lambdaDeliverQueued != nil {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			sparta.ServiceDecoratorHookFunc(deliveryQueueDecorator))
+	}
+	if lambdaDeliverRoomOrdered != nil {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			sparta.ServiceDecoratorHookFunc(roomQueueDecorator))
+	}
+	if lambdaAggregate != nil {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			broadcastStateMachineDecorator(lambdaDeliver, lambdaAggregate))
+	}
+	if lambdaStream != nil {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			eventStreamDecorator(lambdaStream))
+	}
+	if fanoutTopicEnabled() {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			fanoutTopicDecorator(lambdaDeliver))
+	}
+	if lambdaNotify != nil {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			notificationTopicDecorator(lambdaNotify))
+	}
+	if lambdaAdmin != nil {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			adminAPIDecorator(lambdaAdmin))
+	}
+	if lambdaForward != nil {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			webhookDecorator(lambdaForward))
+	}
+	if connectionCacheTTL() > 0 {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			sparta.ServiceDecoratorHookFunc(connectionChangesDecorator))
+	}
+	if lambdaAuthorizer != nil {
+		authorizerDecorator, authorizerDecoratorErr := authorizer.NewDecorator(apiGateway,
+			lambdaAuthorizer,
+			connectIdentitySources...)
+		if authorizerDecoratorErr != nil {
+			fmt.Fprintln(os.Stderr, authorizerDecoratorErr)
+			os.Exit(1)
+		}
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			authorizerDecorator)
+	}
+	// Optionally read tunables from Parameter Store
+	if os.Getenv(envKeyRuntimeConfigPrefix) != "" {
+		for _, eachLambda := range lambdaFunctions {
+			annotateRuntimeConfig(eachLambda)
+		}
+	}
+	// Optionally read feature flags from AppConfig
+	if appConfigEnabled() {
+		for _, eachLambda := range lambdaFunctions {
+			annotateFeatureFlags(eachLambda)
+		}
+	}
+	// Optionally cache the connection items between warm broadcasts
+	if connectionCacheTTL() > 0 {
+		for _, eachLambda := range lambdaFunctions {
+			annotateConnectionCache(eachLambda)
+		}
+	}
+	// Optionally read the connection index with parallel scans
+	if scanSegments() > 1 {
+		for _, eachLambda := range lambdaFunctions {
+			annotateScanSegments(eachLambda)
+		}
+	}
+	// Every handler keys connection items by the configured attribute and
+	// logs at the stage's level
+	for _, eachLambda := range lambdaFunctions {
+		tables.annotate(eachLambda)
+		deployment.annotate(eachLambda)
+		annotateAuthenticatedRoutes(eachLambda)
+	}
+
+	// Optionally export OpenTelemetry traces and metrics
+	if telemetryEnabled() {
+		for _, eachLambda := range lambdaFunctions {
+			annotateTelemetry(eachLambda)
+		}
+	}
+	// Optionally trace every invocation and AWS call with X-Ray
+	if xrayEnabled() {
+		for _, eachLambda := range lambdaFunctions {
+			annotateXRay(eachLambda)
+		}
+	}
+	// Optionally use FIPS endpoints and verify the template is GovCloud ready
+	if fipsEnabled() {
+		for _, eachLambda := range lambdaFunctions {
+			annotateFIPS(eachLambda)
+		}
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			sparta.ServiceDecoratorHookFunc(partitionValidationDecorator))
+	}
+	// Optionally run the lambdas in a VPC with a private management endpoint
+	vpc := vpcConfigFromEnvironment()
+	if vpc != nil {
+		for _, eachLambda := range lambdaFunctions {
+			vpc.annotateVPC(eachLambda)
+		}
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			vpc.executeAPIEndpointDecorator(apiGateway))
+	}
+	// Multi-region stacks post to connections in the other regions
+	if multiRegionEnabled() {
+		for _, eachLambda := range lambdaFunctions {
+			annotateMultiRegion(eachLambda)
+		}
+	}
+	// Optionally throttle messages at the gateway, before they reach the
+	// lambdas
+	throttling, throttlingErr := throttlingConfigFromEnvironment()
+	if throttlingErr != nil {
+		fmt.Fprintln(os.Stderr, throttlingErr)
+		os.Exit(1)
+	}
+	if throttling != nil {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			throttling.decorator())
+	}
+	// Optionally log every message the stage handles
+	if accessLogsEnabled() {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			sparta.ServiceDecoratorHookFunc(accessLogsDecorator))
+	}
+	// Optionally graph the stack's gateway, lambda, and table metrics
+	if dashboardEnabled() {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			dashboardDecorator(apiGateway, lambdaFunctions, decorator.TableName()))
+	}
+	// Optionally alarm on error rates and throttles
+	if alarmsEnabled() {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			alarmsDecorator(apiGateway,
+				lambdaFunctions,
+				[]*sparta.LambdaAWSInfo{lambdaSend, lambdaDeliver, lambdaActions, lambdaConnect, lambdaDisconnect},
+				decorator.TableName()))
+	}
+	// Optionally shift traffic to new route handler versions with CodeDeploy
+	if canaryDeploymentEnabled() {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			canaryDeploymentDecorator(apiGateway, topo.routeLambdas))
+	}
+	// Optionally attach the custom domain to the stage
+	if domain := customDomainFromEnvironment(); domain != nil {
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			domain.decorator(apiGateway))
+	}
+	// Optionally keep the connection items in Redis, which must be in the VPC
+	if redisStoreEnabled() {
+		if vpc == nil {
+			fmt.Fprintf(os.Stderr, "%s=%s requires %s\n",
+				envKeyConnectionStore,
+				connectionStoreRedis,
+				envKeyVPCID)
+			os.Exit(1)
+		}
+		for _, eachLambda := range lambdaFunctions {
+			annotateRedisStore(eachLambda)
+		}
+		workflowHooks.ServiceDecorators = append(workflowHooks.ServiceDecorators,
+			vpc.redisStoreDecorator())
 	}
 	err := sparta.MainEx(awsName,
 		"Sparta application that demonstrates API v2 Websocket support",
@@ -253,4 +1125,13 @@ func main() {
 	if err != nil {
 		os.Exit(1)
 	}
+	// Sparta doesn't have a post-provision hook, so write the client
+	// configuration once the provision command returns
+	if provisioned() {
+		logger := logrus.New()
+		configErr := writeClientConfig(awsName, sess, logger)
+		if configErr != nil {
+			logger.WithField("Error", configErr).Warn("Failed to write client configuration")
+		}
+	}
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/mweagle/SpartaWebSocket/protocol"
+)
+
+// testRequest returns a WebSocket request from the connection
+func testRequest(connectionID string, body string) awsEvents.APIGatewayWebsocketProxyRequest {
+	return awsEvents.APIGatewayWebsocketProxyRequest{
+		Body: body,
+		RequestContext: awsEvents.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: connectionID,
+			RequestID:    "request-" + connectionID,
+			DomainName:   "abc123.execute-api.us-east-1.amazonaws.com",
+			Stage:        "test",
+		},
+	}
+}
+
+func TestConnectWorld(t *testing.T) {
+	tests := []struct {
+		name       string
+		putErr     error
+		statusCode int
+		stored     bool
+	}{
+		{"success", nil, 200, true},
+		{"put error", errors.New("throttled"), 500, false},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			ddb := newMockDynamo()
+			ddb.putErr = eachTest.putErr
+			useMockClients(t, ddb, newMockManagement())
+			response, responseErr := connectWorld(context.Background(), testRequest("conn-1", ""))
+			if responseErr != nil {
+				t.Fatalf("connectWorld failed: %s", responseErr)
+			}
+			if response.StatusCode != eachTest.statusCode {
+				t.Errorf("Status = %d, want %d", response.StatusCode, eachTest.statusCode)
+			}
+			if stored := len(ddb.puts) == 1; stored != eachTest.stored {
+				t.Fatalf("Stored = %t, want %t", stored, eachTest.stored)
+			}
+			if eachTest.stored {
+				item := ddb.puts[0]
+				if connectionID := itemString(item, ddbAttributeConnectionID); connectionID != "conn-1" {
+					t.Errorf("Stored connection = %q, want %q", connectionID, "conn-1")
+				}
+				if itemString(item, ddbAttributeResumeToken) == "" {
+					t.Errorf("Stored connection has no resume token")
+				}
+			}
+		})
+	}
+}
+
+func TestDisconnectWorld(t *testing.T) {
+	tests := []struct {
+		name       string
+		deleteErr  error
+		statusCode int
+		remaining  int
+	}{
+		{"success", nil, 200, 1},
+		{"delete error", errors.New("throttled"), 500, 2},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			ddb := newMockDynamo("conn-1", "conn-2")
+			ddb.deleteErr = eachTest.deleteErr
+			useMockClients(t, ddb, newMockManagement())
+			response, responseErr := disconnectWorld(context.Background(), testRequest("conn-1", ""))
+			if responseErr != nil {
+				t.Fatalf("disconnectWorld failed: %s", responseErr)
+			}
+			if response.StatusCode != eachTest.statusCode {
+				t.Errorf("Status = %d, want %d", response.StatusCode, eachTest.statusCode)
+			}
+			if len(ddb.items) != eachTest.remaining {
+				t.Errorf("Remaining connections = %d, want %d", len(ddb.items), eachTest.remaining)
+			}
+		})
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		scanSegments string
+		gone         []string
+		queryErr     error
+		scanErr      error
+		statusCode   int
+		// posts is the number of frames posted to each connection, including
+		// error frames posted to the sender
+		posts   map[string]int
+		deleted []string
+	}{
+		{name: "broadcast",
+			body:       `{"data":"hello"}`,
+			statusCode: 200,
+			posts:      map[string]int{"sender": 1, "conn-1": 1, "conn-2": 1}},
+		{name: "broadcast excluding the sender",
+			body:       `{"data":"hello","excludeSelf":true}`,
+			statusCode: 200,
+			posts:      map[string]int{"sender": 0, "conn-1": 1, "conn-2": 1}},
+		{name: "targeted",
+			body:       `{"data":"hello","to":["conn-2","conn-2"]}`,
+			statusCode: 200,
+			posts:      map[string]int{"sender": 0, "conn-1": 0, "conn-2": 1}},
+		{name: "gone connection",
+			body:       `{"data":"hello"}`,
+			gone:       []string{"conn-2"},
+			statusCode: 200,
+			posts:      map[string]int{"sender": 1, "conn-1": 1, "conn-2": 0},
+			deleted:    []string{"conn-2"}},
+		{name: "scanned broadcast",
+			body:         `{"data":"hello"}`,
+			scanSegments: "2",
+			statusCode:   200,
+			posts:        map[string]int{"sender": 1, "conn-1": 1, "conn-2": 1}},
+		{name: "query error",
+			body:       `{"data":"hello"}`,
+			queryErr:   errors.New("provisioned throughput exceeded"),
+			statusCode: 500,
+			posts:      map[string]int{"sender": 1, "conn-1": 0, "conn-2": 0}},
+		{name: "scan error",
+			body:         `{"data":"hello"}`,
+			scanSegments: "2",
+			scanErr:      errors.New("provisioned throughput exceeded"),
+			statusCode:   500,
+			posts:        map[string]int{"sender": 1, "conn-1": 0, "conn-2": 0}},
+		{name: "mistyped targets",
+			body:       `{"data":"hello","to":"conn-1"}`,
+			statusCode: 500,
+			posts:      map[string]int{"sender": 1, "conn-1": 0, "conn-2": 0}},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			ddb := newMockDynamo("sender", "conn-1", "conn-2")
+			ddb.queryErr = eachTest.queryErr
+			ddb.scanErr = eachTest.scanErr
+			mgmt := newMockManagement(eachTest.gone...)
+			useMockClients(t, ddb, mgmt)
+			t.Setenv(envKeyScanSegments, eachTest.scanSegments)
+			handler := withTypedRequest(sendMessage)
+			response, responseErr := handler(context.Background(), testRequest("sender", eachTest.body))
+			if responseErr != nil {
+				t.Fatalf("sendMessage failed: %s", responseErr)
+			}
+			if response.StatusCode != eachTest.statusCode {
+				t.Errorf("Status = %d (%s), want %d", response.StatusCode, response.Body, eachTest.statusCode)
+			}
+			for eachConnectionID, eachCount := range eachTest.posts {
+				if count := mgmt.postCount(eachConnectionID); count != eachCount {
+					t.Errorf("Posts to %s = %d, want %d", eachConnectionID, count, eachCount)
+				}
+			}
+			if eachTest.scanSegments != "" && ddb.scans == 0 {
+				t.Errorf("Broadcast didn't scan the connection index")
+			}
+			if len(ddb.deleted) != len(eachTest.deleted) {
+				t.Fatalf("Deleted %q, want %q", ddb.deleted, eachTest.deleted)
+			}
+			for eachIndex, eachConnectionID := range eachTest.deleted {
+				if ddb.deleted[eachIndex] != eachConnectionID {
+					t.Errorf("Deleted %q, want %q", ddb.deleted, eachTest.deleted)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestData(t *testing.T) {
+	binaryForm := `{"type":"binary","data":"aGVsbG8="}`
+	tests := []struct {
+		name    string
+		body    string
+		base64  bool
+		payload string
+		binary  bool
+	}{
+		{name: "text frame",
+			body:    `{"data":"hello"}`,
+			payload: `"hello"`},
+		{name: "text frame with the binary form",
+			body:    `{"data":` + binaryForm + `}`,
+			payload: binaryForm},
+		{name: "JSON binary frame",
+			body:    base64.StdEncoding.EncodeToString([]byte(`{"data":"hello"}`)),
+			base64:  true,
+			payload: `"hello"`},
+		{name: "opaque binary frame",
+			body:    base64.StdEncoding.EncodeToString([]byte("hello")),
+			base64:  true,
+			payload: binaryForm,
+			binary:  true},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			request := testRequest("sender", eachTest.body)
+			request.IsBase64Encoded = eachTest.base64
+			payload, binary, payloadErr := requestData(request, nil)
+			if payloadErr != nil {
+				t.Fatalf("requestData failed: %s", payloadErr)
+			}
+			if string(payload) != eachTest.payload {
+				t.Errorf("Payload = %s, want %s", payload, eachTest.payload)
+			}
+			if binary != eachTest.binary {
+				t.Errorf("Binary = %t, want %t", binary, eachTest.binary)
+			}
+		})
+	}
+}
+
+func TestHandshakeNegotiation(t *testing.T) {
+	tests := []struct {
+		queryParams map[string]string
+		negotiation protocol.Negotiation
+	}{
+		{nil, protocol.DefaultNegotiation},
+		{map[string]string{queryParamProtocol: "protobuf"},
+			protocol.Negotiation{Encoding: protocol.EncodingProtobuf, Compression: protocol.CompressionNone}},
+		// accept-encodings takes precedence over the older protocol parameter
+		{map[string]string{queryParamAccept: "cbor,gzip", queryParamProtocol: "protobuf"},
+			protocol.Negotiation{Encoding: protocol.EncodingCBOR, Compression: protocol.CompressionGzip}},
+		{map[string]string{queryParamAccept: "", queryParamProtocol: "protobuf"},
+			protocol.DefaultNegotiation},
+	}
+	for _, eachTest := range tests {
+		if negotiation := handshakeNegotiation(eachTest.queryParams); negotiation != eachTest.negotiation {
+			t.Errorf("handshakeNegotiation(%v) = %+v, want %+v", eachTest.queryParams, negotiation, eachTest.negotiation)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/mweagle/SpartaWebSocket/connections"
+)
+
+const (
+	ddbAttributeSourceIP    = "sourceIP"
+	ddbAttributeUserAgent   = "userAgent"
+	ddbAttributeHeaders     = "headers"
+	ddbAttributeConnectedAt = "connectedAt"
+	// maxHeaderValueLength bounds each stored header value, since connection
+	// items are read by every broadcast
+	maxHeaderValueLength = 512
+)
+
+// capturedHeaders are the $connect request headers stored with the
+// connection. Assign it in an init function to capture other headers.
+var capturedHeaders = []string{"Origin",
+	"X-Forwarded-For",
+	"CloudFront-Viewer-Country"}
+
+// ConnectionRecord is the typed view of a connection item
+type ConnectionRecord struct {
+	ConnectionID   string
+	UserID         string
+	IdentitySource string
+	Claims         map[string]string
+	Encoding       string
+	Compression    string
+	Locale         string
+	AffinityKey    string
+	Shard          string
+	SourceIP       string
+	UserAgent      string
+	// Headers are the capturedHeaders values, keyed by canonical header name
+	Headers map[string]string
+	// Attributes are the client attributes that broadcast filters match
+	Attributes  map[string]string
+	ConnectedAt time.Time
+	ExpiresAt   time.Time
+}
+
+// Duration returns how long the connection has been connected, or zero if
+// the connect time wasn't recorded
+func (record *ConnectionRecord) Duration(now time.Time) time.Duration {
+	if record.ConnectedAt.IsZero() {
+		return 0
+	}
+	return now.Sub(record.ConnectedAt)
+}
+
+// newConnectionRecord returns the typed connection record for the item, or
+// nil if there's no item. Items stored before metadata was captured have
+// empty metadata fields.
+func newConnectionRecord(item map[string]*dynamodb.AttributeValue) *ConnectionRecord {
+	if len(item) == 0 {
+		return nil
+	}
+	record := &ConnectionRecord{
+		ConnectionID:   itemString(item, ddbAttributeConnectionID),
+		UserID:         itemUserID(item),
+		IdentitySource: itemString(item, ddbAttributeIdentitySource),
+		Claims:         itemStringMap(item, ddbAttributeClaims),
+		Encoding:       itemString(item, ddbAttributeEncoding),
+		Compression:    itemString(item, ddbAttributeCompression),
+		Locale:         itemLocale(item),
+		AffinityKey:    itemString(item, ddbAttributeAffinityKey),
+		Shard:          itemString(item, ddbAttributeShard),
+		SourceIP:       itemString(item, ddbAttributeSourceIP),
+		UserAgent:      itemString(item, ddbAttributeUserAgent),
+		Headers:        itemStringMap(item, ddbAttributeHeaders),
+		Attributes:     itemStringMap(item, ddbAttributeAttributes),
+		ConnectedAt:    itemTime(item, ddbAttributeConnectedAt),
+		ExpiresAt:      itemTime(item, connections.ExpiresAtAttribute),
+	}
+	return record
+}
+
+// handshakeMetadata returns the connection item attributes that describe
+// the $connect request
+func handshakeMetadata(request awsEvents.APIGatewayWebsocketProxyRequest,
+	connectedAt time.Time) map[string]*dynamodb.AttributeValue {
+	attributes := map[string]*dynamodb.AttributeValue{
+		ddbAttributeConnectedAt: &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(connectedAt.Unix(), 10)),
+		},
+	}
+	identity := request.RequestContext.Identity
+	if identity.SourceIP != "" {
+		attributes[ddbAttributeSourceIP] = &dynamodb.AttributeValue{
+			S: aws.String(identity.SourceIP),
+		}
+	}
+	userAgent := identity.UserAgent
+	if userAgent == "" {
+		userAgent = requestHeader(request.Headers, "User-Agent")
+	}
+	if userAgent != "" {
+		attributes[ddbAttributeUserAgent] = &dynamodb.AttributeValue{
+			S: aws.String(truncateHeader(userAgent)),
+		}
+	}
+	headers := make(map[string]*dynamodb.AttributeValue)
+	for _, eachName := range capturedHeaders {
+		if value := requestHeader(request.Headers, eachName); value != "" {
+			headers[http.CanonicalHeaderKey(eachName)] = &dynamodb.AttributeValue{
+				S: aws.String(truncateHeader(value)),
+			}
+		}
+	}
+	if len(headers) != 0 {
+		attributes[ddbAttributeHeaders] = &dynamodb.AttributeValue{
+			M: headers,
+		}
+	}
+	return attributes
+}
+
+// requestHeader returns the header value. API Gateway preserves the
+// client's header name casing, so names are compared case insensitively.
+func requestHeader(headers map[string]string, name string) string {
+	if value, exists := headers[name]; exists {
+		return value
+	}
+	canonicalName := http.CanonicalHeaderKey(name)
+	for eachName, eachValue := range headers {
+		if http.CanonicalHeaderKey(eachName) == canonicalName {
+			return eachValue
+		}
+	}
+	return ""
+}
+
+// truncateHeader bounds the stored header value length
+func truncateHeader(value string) string {
+	if len(value) > maxHeaderValueLength {
+		return value[:maxHeaderValueLength]
+	}
+	return value
+}
+
+// itemString returns the item's string attribute value
+func itemString(item map[string]*dynamodb.AttributeValue, name string) string {
+	if item[name] == nil || item[name].S == nil {
+		return ""
+	}
+	return *item[name].S
+}
+
+// itemStringMap returns the item's map attribute as string values
+func itemStringMap(item map[string]*dynamodb.AttributeValue, name string) map[string]string {
+	if item[name] == nil || len(item[name].M) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(item[name].M))
+	for eachName, eachValue := range item[name].M {
+		if eachValue != nil && eachValue.S != nil {
+			values[eachName] = *eachValue.S
+		}
+	}
+	return values
+}
+
+// itemTime returns the item's epoch seconds attribute as a time
+func itemTime(item map[string]*dynamodb.AttributeValue, name string) time.Time {
+	if item[name] == nil || item[name].N == nil {
+		return time.Time{}
+	}
+	epoch, epochErr := strconv.ParseInt(*item[name].N, 10, 64)
+	if epochErr != nil {
+		return time.Time{}
+	}
+	return time.Unix(epoch, 0)
+}
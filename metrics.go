@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	metricsNamespace = "SpartaWebSocket"
+	// Metric names
+	metricGoneCleanups        = "GoneCleanups"
+	metricGoneCleanupFailures = "GoneCleanupFailures"
+	metricConnectionsOpened   = "ConnectionsOpened"
+	metricConnectionsClosed   = "ConnectionsClosed"
+)
+
+// metricsEmitter accumulates counters during an invocation and writes them
+// as a single CloudWatch Embedded Metric Format record, which avoids the
+// latency of PutMetricData calls. It's safe for concurrent use.
+type metricsEmitter struct {
+	writer     io.Writer
+	dimensions map[string]string
+	mutex      sync.Mutex
+	counts     map[string]float64
+}
+
+func newMetricsEmitter() *metricsEmitter {
+	return &metricsEmitter{
+		writer: os.Stdout,
+		dimensions: map[string]string{
+			"FunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+		},
+		counts: make(map[string]float64),
+	}
+}
+
+// withDimension returns a new emitter whose metrics include the additional
+// dimension
+func (emitter *metricsEmitter) withDimension(name string, value string) *metricsEmitter {
+	dimensions := make(map[string]string, len(emitter.dimensions)+1)
+	for eachName, eachValue := range emitter.dimensions {
+		dimensions[eachName] = eachValue
+	}
+	dimensions[name] = value
+	return &metricsEmitter{
+		writer:     emitter.writer,
+		dimensions: dimensions,
+		counts:     make(map[string]float64),
+	}
+}
+
+// publishMetric writes a single counter record, logging rather than returning
+// any failure since metrics are best-effort
+func publishMetric(name string, value float64, logger *logrus.Logger) {
+	metrics := newMetricsEmitter()
+	metrics.add(name, value)
+	metricsErr := metrics.flush()
+	if metricsErr != nil {
+		logger.WithField("Error", metricsErr).Warn("Failed to publish metrics")
+	}
+}
+
+// add increments the named counter
+func (emitter *metricsEmitter) add(name string, value float64) {
+	emitter.mutex.Lock()
+	defer emitter.mutex.Unlock()
+	emitter.counts[name] += value
+}
+
+// flush writes the accumulated counters and resets them
+func (emitter *metricsEmitter) flush() error {
+	emitter.mutex.Lock()
+	defer emitter.mutex.Unlock()
+	if len(emitter.counts) == 0 {
+		return nil
+	}
+	metricDefinitions := make([]map[string]string, 0, len(emitter.counts))
+	record := make(map[string]interface{})
+	dimensionNames := make([]string, 0, len(emitter.dimensions))
+	for eachName, eachValue := range emitter.dimensions {
+		record[eachName] = eachValue
+		dimensionNames = append(dimensionNames, eachName)
+	}
+	sort.Strings(dimensionNames)
+	for eachName, eachValue := range emitter.counts {
+		metricDefinitions = append(metricDefinitions, map[string]string{
+			"Name": eachName,
+			"Unit": "Count",
+		})
+		record[eachName] = eachValue
+	}
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixNano() / int64(time.Millisecond),
+		"CloudWatchMetrics": []map[string]interface{}{
+			{
+				"Namespace":  metricsNamespace,
+				"Dimensions": [][]string{dimensionNames},
+				"Metrics":    metricDefinitions,
+			},
+		},
+	}
+	recordJSON, recordJSONErr := json.Marshal(record)
+	if recordJSONErr != nil {
+		return recordJSONErr
+	}
+	emitter.counts = make(map[string]float64)
+	_, writeErr := fmt.Fprintln(emitter.writer, string(recordJSON))
+	return writeErr
+}
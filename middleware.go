@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	errorMessage       = "error"
+	metricHandlerPanic = "HandlerPanics"
+	// metricRouteFrames and metricRouteErrors count each route's frames and
+	// the ones that failed, with a RouteKey dimension
+	metricRouteFrames = "RouteFrames"
+	metricRouteErrors = "RouteErrors"
+	// envKeyAuthenticatedRoutes is a provision-time, comma separated list of
+	// the routes whose frames are rejected unless the connection's user ID
+	// was validated by the authorizer
+	envKeyAuthenticatedRoutes = "AUTHENTICATED_ROUTES"
+	// maxInboundPayloadSize is the API Gateway WebSocket message limit. The
+	// maxPayloadSize tunable can lower it.
+	maxInboundPayloadSize = 128 * 1024
+)
+
+// wsHandler is the signature shared by the WebSocket route handlers
+type wsHandler func(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error)
+
+// wsMiddleware wraps a route handler with behavior that's shared by every
+// route, such as logging or error reporting
+type wsMiddleware func(handler wsHandler) wsHandler
+
+// routeMiddleware wraps every route handler, outermost first. Append to it
+// in an init function to add middleware to every route.
+var routeMiddleware = []wsMiddleware{
+	withTracing,
+	withCorrelation,
+	withLogging,
+	withMetrics,
+	withPanicRecovery,
+}
+
+// frameMiddleware additionally screens the inbound frames of the message
+// routes, after routeMiddleware
+var frameMiddleware = []wsMiddleware{
+	withSubprotocol,
+	withAuthentication,
+	withPayloadLimit,
+}
+
+// chainMiddleware wraps the handler with the middleware, so that the first
+// middleware is the outermost
+func chainMiddleware(handler wsHandler, middleware ...wsMiddleware) wsHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// routeHandler wraps the lifecycle route handler ($connect and $disconnect)
+// with routeMiddleware
+func routeHandler(handler wsHandler) wsHandler {
+	return chainMiddleware(handler, routeMiddleware...)
+}
+
+// frameHandler wraps the message route handler with routeMiddleware and
+// frameMiddleware
+func frameHandler(handler wsHandler) wsHandler {
+	middleware := make([]wsMiddleware, 0, len(routeMiddleware)+len(frameMiddleware))
+	middleware = append(middleware, routeMiddleware...)
+	middleware = append(middleware, frameMiddleware...)
+	return chainMiddleware(handler, middleware...)
+}
+
+// contextLogger returns the invocation's logger, which withCorrelation
+// stamps with the request's correlation ID
+func contextLogger(ctx context.Context) *logrus.Logger {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+	if logger == nil {
+		return logrus.StandardLogger()
+	}
+	return logger
+}
+
+// senderItemKey is the context key of the sender's connection item, which
+// the frame middleware stores so that the handler doesn't read it again
+type senderItemKey struct{}
+
+// withSenderItem returns a copy of the context that carries the sender's
+// connection item
+func withSenderItem(ctx context.Context,
+	senderItem map[string]*dynamodb.AttributeValue) context.Context {
+	return context.WithValue(ctx, senderItemKey{}, senderItem)
+}
+
+// senderConnectionItem returns the connection item of the request's sender,
+// reading it only if the frame middleware didn't
+func senderConnectionItem(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	ddbService dynamodbiface.DynamoDBAPI) (map[string]*dynamodb.AttributeValue, error) {
+	if senderItem, stored := ctx.Value(senderItemKey{}).(map[string]*dynamodb.AttributeValue); stored {
+		return senderItem, nil
+	}
+	return getConnectionItem(request.RequestContext.ConnectionID, ddbService)
+}
+
+// withLogging wraps the handler so that every frame is logged once it's
+// handled, with its route, status, and duration
+func withLogging(handler wsHandler) wsHandler {
+	return func(ctx context.Context,
+		request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+		startedAt := time.Now()
+		response, err := handler(ctx, request)
+		fields := logrus.Fields{
+			"RouteKey":     request.RequestContext.RouteKey,
+			"ConnectionID": request.RequestContext.ConnectionID,
+			"Duration":     time.Since(startedAt).String(),
+		}
+		if response != nil {
+			fields["StatusCode"] = response.StatusCode
+		}
+		if err != nil {
+			fields["Error"] = err
+			contextLogger(ctx).WithFields(fields).Warn("Route failed")
+		} else {
+			contextLogger(ctx).WithFields(fields).Debug("Route handled")
+		}
+		return response, err
+	}
+}
+
+// withMetrics wraps the handler so that each route's frames and failures
+// are counted. Frames that are rejected with an error frame count as
+// failures.
+func withMetrics(handler wsHandler) wsHandler {
+	return func(ctx context.Context,
+		request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+		response, err := handler(ctx, request)
+		metrics := newMetricsEmitter().withDimension("RouteKey", request.RequestContext.RouteKey)
+		metrics.add(metricRouteFrames, 1)
+		if err != nil || (response != nil && response.StatusCode >= 400) {
+			metrics.add(metricRouteErrors, 1)
+		}
+		metricsErr := metrics.flush()
+		if metricsErr != nil {
+			contextLogger(ctx).WithField("Error", metricsErr).Warn("Failed to publish metrics")
+		}
+		return response, err
+	}
+}
+
+// authenticatedRoute returns true if the route only accepts frames from
+// connections whose user ID was validated
+func authenticatedRoute(routeKey string) bool {
+	for _, eachRoute := range strings.Split(os.Getenv(envKeyAuthenticatedRoutes), ",") {
+		if strings.TrimSpace(eachRoute) == routeKey {
+			return true
+		}
+	}
+	return false
+}
+
+// withAuthentication wraps the handler so that frames on the
+// AUTHENTICATED_ROUTES from anonymous or self-asserted connections are
+// rejected with an unauthenticated error frame. The sender item it reads is
+// passed to the handler in the context.
+func withAuthentication(handler wsHandler) wsHandler {
+	return func(ctx context.Context,
+		request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+		if !authenticatedRoute(request.RequestContext.RouteKey) {
+			return handler(ctx, request)
+		}
+		logger := contextLogger(ctx)
+		sess := newAWSSession(logger)
+		senderItem, senderItemErr := senderConnectionItem(ctx, request, newConnectionsClient(sess))
+		if senderItemErr != nil {
+			return nil, senderItemErr
+		}
+		if itemAuthenticated(senderItem) {
+			return handler(withSenderItem(ctx, senderItem), request)
+		}
+		apigwMgmtClient := newManagementClient(sess, managementEndpoint(request.RequestContext))
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeUnauthenticated,
+			catalog.Localize(itemLocale(senderItem), catalog.Unauthenticated),
+			logger), nil
+	}
+}
+
+// annotateAuthenticatedRoutes publishes the provision-time
+// AUTHENTICATED_ROUTES in the lambda environment
+func annotateAuthenticatedRoutes(lambdaFn *sparta.LambdaAWSInfo) {
+	setEnvironment(lambdaFn, envKeyAuthenticatedRoutes, gocf.String(os.Getenv(envKeyAuthenticatedRoutes)))
+}
+
+// withPanicRecovery wraps the handler so that a panic (eg, from a malformed
+// payload) is logged with its stack, counted, and reported to the sender as a
+// generic error frame rather than failing the invocation
+func withPanicRecovery(handler wsHandler) wsHandler {
+	return func(ctx context.Context,
+		request awsEvents.APIGatewayWebsocketProxyRequest) (response *wsResponse, err error) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			logger := contextLogger(ctx)
+			logger.WithFields(logrus.Fields{
+				"Panic":        recovered,
+				"Stack":        string(debug.Stack()),
+				"ConnectionID": request.RequestContext.ConnectionID,
+				"RouteKey":     request.RequestContext.RouteKey,
+			}).Error("Recovered from handler panic")
+			metrics := newMetricsEmitter()
+			metrics.add(metricHandlerPanic, 1)
+			metricsErr := metrics.flush()
+			if metricsErr != nil {
+				logger.WithField("Error", metricsErr).Warn("Failed to publish metrics")
+			}
+			locale := notifyInternalError(ctx, request, logger)
+			response = &wsResponse{
+				StatusCode: 500,
+				Body:       catalog.Localize(locale, catalog.InternalError),
+			}
+			err = nil
+		}()
+		return handler(ctx, request)
+	}
+}
+
+// withPayloadLimit wraps the handler so that frames larger than the
+// maxPayloadSize tunable are rejected with a payloadTooLarge error frame
+// before they're processed
+func withPayloadLimit(handler wsHandler) wsHandler {
+	return func(ctx context.Context,
+		request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+		logger := contextLogger(ctx)
+		sess := newAWSSession(logger)
+		limit := tunables.intValue(ctx, sess, tunableMaxPayloadSize, maxInboundPayloadSize, logger)
+		if limit <= 0 || limit > maxInboundPayloadSize {
+			limit = maxInboundPayloadSize
+		}
+		size := int64(len(request.Body))
+		if request.IsBase64Encoded {
+			size = int64(base64.StdEncoding.DecodedLen(len(request.Body)))
+		}
+		if size <= limit {
+			return handler(ctx, request)
+		}
+		logger.WithFields(logrus.Fields{
+			"ConnectionID": request.RequestContext.ConnectionID,
+			"Size":         size,
+			"Limit":        limit,
+		}).Warn("Rejecting oversized payload")
+		senderItem, senderItemErr := senderConnectionItem(ctx, request, newConnectionsClient(sess))
+		if senderItemErr != nil {
+			logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+		}
+		apigwMgmtClient := newManagementClient(sess, managementEndpoint(request.RequestContext))
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodePayloadTooLarge,
+			catalog.Localize(itemLocale(senderItem), catalog.PayloadTooLarge, limit),
+			logger), nil
+	}
+}
+
+// notifyInternalError posts a generic error frame to the sender and returns
+// the sender locale
+func notifyInternalError(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	logger *logrus.Logger) string {
+	connectionID := request.RequestContext.ConnectionID
+	if connectionID == "" {
+		return catalog.DefaultLocale
+	}
+	sess := newAWSSession(logger)
+	senderItem, senderItemErr := getConnectionItem(connectionID, newConnectionsClient(sess))
+	if senderItemErr != nil {
+		logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+	}
+	locale := itemLocale(senderItem)
+	apigwMgmtClient := newManagementClient(sess, managementEndpoint(request.RequestContext))
+	postErrorFrame(ctx,
+		request,
+		senderItem,
+		apigwMgmtClient,
+		errorCodeInternal,
+		catalog.Localize(locale, catalog.InternalError),
+		logger)
+	return locale
+}
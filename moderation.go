@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/moderation"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Provision-time configuration of the regex moderator that screens
+	// sendmessage data while the moderation feature is on.
+	// MODERATION_REDACT_WORDS is a comma separated list of words to redact,
+	// MODERATION_BLOCK_LINKS=true rejects messages with links, and
+	// MODERATION_FLAG_PATTERN is a regular expression whose matches are
+	// delivered but audited for review.
+	envKeyModerationRedactWords = "MODERATION_REDACT_WORDS"
+	envKeyModerationBlockLinks  = "MODERATION_BLOCK_LINKS"
+	envKeyModerationFlagPattern = "MODERATION_FLAG_PATTERN"
+)
+
+// customModerator screens sendmessage data in place of the regex moderator
+// configured by the provision-time environment. Assign it in an init
+// function so that it's set in the lambda. Combine moderators with
+// moderation.Chain.
+var customModerator moderation.Moderator
+
+// configuredModerator is the regex moderator built from the lambda
+// environment, once per container
+var (
+	configuredModerator     moderation.Moderator
+	configuredModeratorErr  error
+	configuredModeratorOnce sync.Once
+)
+
+// messageModerator returns the sendmessage moderator, or nil if no rules are
+// configured
+func messageModerator() (moderation.Moderator, error) {
+	if customModerator != nil {
+		return customModerator, nil
+	}
+	configuredModeratorOnce.Do(func() {
+		var rules []moderation.Rule
+		if os.Getenv(envKeyModerationBlockLinks) == "true" {
+			rules = append(rules, moderation.Links())
+		}
+		var words []string
+		for _, eachWord := range strings.Split(os.Getenv(envKeyModerationRedactWords), ",") {
+			if eachWord = strings.TrimSpace(eachWord); eachWord != "" {
+				words = append(words, eachWord)
+			}
+		}
+		if len(words) != 0 {
+			rules = append(rules, moderation.Profanity(words...))
+		}
+		if flagPattern := os.Getenv(envKeyModerationFlagPattern); flagPattern != "" {
+			pattern, patternErr := regexp.Compile(flagPattern)
+			if patternErr != nil {
+				configuredModeratorErr = patternErr
+				return
+			}
+			rules = append(rules, moderation.Rule{
+				Pattern: pattern,
+				Action:  moderation.Flag,
+			})
+		}
+		if len(rules) != 0 {
+			configuredModerator = moderation.NewRegexModerator(rules...)
+		}
+	})
+	return configuredModerator, configuredModeratorErr
+}
+
+// moderateMessage screens the data of a sendmessage or publish request
+// before it's delivered. It returns the data to deliver, which is redacted if
+// the moderator says so, and false if the message was rejected. Verdicts
+// other than Allow are audited with their reasons. Messages are delivered
+// unmoderated while the moderation feature is off.
+func moderateMessage[T any](ctx context.Context,
+	call *wsCall[T],
+	data json.RawMessage) (json.RawMessage, bool, error) {
+	if !features.enabled(ctx, call.sess, featureModeration, call.logger) {
+		return data, true, nil
+	}
+	moderator, moderatorErr := messageModerator()
+	if moderatorErr != nil || moderator == nil {
+		return data, true, moderatorErr
+	}
+	verdict, verdictErr := moderator.Moderate(ctx, &moderation.Message{
+		ConnectionID: call.request.RequestContext.ConnectionID,
+		UserID:       itemUserID(call.senderItem),
+		Data:         data,
+	})
+	if verdictErr != nil {
+		return nil, false, verdictErr
+	}
+	if verdict == nil || verdict.Action == moderation.Allow {
+		return data, true, nil
+	}
+	call.logger.WithFields(logrus.Fields{
+		"Action":  verdict.Action,
+		"Reasons": verdict.Reasons,
+	}).Info("Moderated message")
+	auditErr := newAuditLog(call.request.RequestContext.RequestID).record(&auditEvent{
+		Action:       auditActionModerate,
+		ConnectionID: call.request.RequestContext.ConnectionID,
+		Success:      true,
+		Verdict:      string(verdict.Action),
+		Reasons:      verdict.Reasons,
+	})
+	if auditErr != nil {
+		call.logger.WithField("Error", auditErr).Warn("Failed to record audit event")
+	}
+	switch verdict.Action {
+	case moderation.Reject:
+		return nil, false, nil
+	case moderation.Redact:
+		return verdict.Data, true, nil
+	}
+	return data, true, nil
+}
+
+// annotateModeration publishes the provision-time moderation rules in the
+// lambda environment
+func annotateModeration(lambdaFn *sparta.LambdaAWSInfo) {
+	if customModerator != nil {
+		return
+	}
+	for _, eachKey := range []string{envKeyModerationRedactWords,
+		envKeyModerationBlockLinks,
+		envKeyModerationFlagPattern} {
+		setEnvironment(lambdaFn, eachKey, gocf.String(os.Getenv(eachKey)))
+	}
+}
@@ -0,0 +1,105 @@
+// Package moderation screens messages before they're broadcast. A Moderator
+// returns a Verdict that allows, rejects, redacts, or flags the message data,
+// so content policies such as profanity filters or link blockers can be
+// supplied without changing the handlers.
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Action is what's done with a moderated message
+type Action string
+
+const (
+	// Allow delivers the message unchanged
+	Allow Action = "allow"
+	// Flag delivers the message unchanged and records it for review
+	Flag Action = "flag"
+	// Redact delivers the verdict's data in place of the message data
+	Redact Action = "redact"
+	// Reject drops the message and reports the rejection to the sender
+	Reject Action = "reject"
+)
+
+// severity orders the actions, so the most severe verdict of a chain wins
+var severity = map[Action]int{
+	Allow:  0,
+	Flag:   1,
+	Redact: 2,
+	Reject: 3,
+}
+
+// Message is a message to moderate
+type Message struct {
+	// ConnectionID is the sender's connection
+	ConnectionID string
+	// UserID is the sender's user ID, if the connection is authenticated
+	UserID string
+	// Data is the JSON message data
+	Data json.RawMessage
+}
+
+// Verdict is a moderator's decision about a message
+type Verdict struct {
+	Action Action
+	// Data is the redacted message data. It's only used by Redact.
+	Data json.RawMessage
+	// Reasons explain the verdict. They're recorded for review, but aren't
+	// sent to the sender.
+	Reasons []string
+}
+
+// Moderator screens a message
+type Moderator interface {
+	Moderate(ctx context.Context, message *Message) (*Verdict, error)
+}
+
+// ModeratorFunc adapts a function to a Moderator
+type ModeratorFunc func(ctx context.Context, message *Message) (*Verdict, error)
+
+// Moderate calls the function
+func (moderatorFn ModeratorFunc) Moderate(ctx context.Context, message *Message) (*Verdict, error) {
+	return moderatorFn(ctx, message)
+}
+
+// chain runs each moderator in turn
+type chain []Moderator
+
+// Chain returns a moderator that runs the moderators in order. Each moderator
+// sees the data redacted by the ones before it, and the first rejection stops
+// the chain. The most severe action wins, and the reasons accumulate.
+func Chain(moderators ...Moderator) Moderator {
+	return chain(moderators)
+}
+
+// Moderate runs the chain
+func (moderators chain) Moderate(ctx context.Context, message *Message) (*Verdict, error) {
+	verdict := &Verdict{
+		Action: Allow,
+	}
+	current := *message
+	for _, eachModerator := range moderators {
+		eachVerdict, moderateErr := eachModerator.Moderate(ctx, &current)
+		if moderateErr != nil {
+			return nil, moderateErr
+		}
+		if eachVerdict == nil {
+			continue
+		}
+		verdict.Reasons = append(verdict.Reasons, eachVerdict.Reasons...)
+		if severity[eachVerdict.Action] > severity[verdict.Action] {
+			verdict.Action = eachVerdict.Action
+		}
+		switch eachVerdict.Action {
+		case Reject:
+			verdict.Data = nil
+			return verdict, nil
+		case Redact:
+			current.Data = eachVerdict.Data
+			verdict.Data = eachVerdict.Data
+		}
+	}
+	return verdict, nil
+}
@@ -0,0 +1,161 @@
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// Rule applies its action to messages with a string value that matches the
+// pattern
+type Rule struct {
+	Pattern *regexp.Regexp
+	Action  Action
+	// Replacement replaces each match when the action is Redact. The empty
+	// string replaces each match with asterisks of the same length.
+	Replacement string
+	// Reason is recorded with the verdict. It defaults to the pattern.
+	Reason string
+}
+
+// reason returns the rule's recorded reason
+func (rule *Rule) reason() string {
+	if rule.Reason != "" {
+		return rule.Reason
+	}
+	return rule.Pattern.String()
+}
+
+// redact returns the value with each match replaced
+func (rule *Rule) redact(value string) string {
+	return rule.Pattern.ReplaceAllStringFunc(value, func(match string) string {
+		if rule.Replacement != "" {
+			return rule.Replacement
+		}
+		return strings.Repeat("*", len([]rune(match)))
+	})
+}
+
+// Profanity returns a rule that redacts each of the case insensitive words.
+// At least one word is required.
+func Profanity(words ...string) Rule {
+	quoted := make([]string, 0, len(words))
+	for _, eachWord := range words {
+		quoted = append(quoted, regexp.QuoteMeta(eachWord))
+	}
+	return Rule{
+		Pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`),
+		Action:  Redact,
+		Reason:  "profanity",
+	}
+}
+
+// Links returns a rule that rejects messages with http, https, or www links
+func Links() Rule {
+	return Rule{
+		Pattern: regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`),
+		Action:  Reject,
+		Reason:  "link",
+	}
+}
+
+// RegexModerator is the reference Moderator. It matches its rules against
+// every string value in the message data, including nested object and array
+// values, so redaction keeps the data valid JSON. Object keys, numbers, and
+// booleans aren't matched.
+type RegexModerator struct {
+	Rules []Rule
+}
+
+// NewRegexModerator returns a moderator that applies the rules in order
+func NewRegexModerator(rules ...Rule) *RegexModerator {
+	return &RegexModerator{
+		Rules: rules,
+	}
+}
+
+// Moderate applies each rule to the message data
+func (moderator *RegexModerator) Moderate(ctx context.Context, message *Message) (*Verdict, error) {
+	verdict := &Verdict{
+		Action: Allow,
+	}
+	if len(moderator.Rules) == 0 {
+		return verdict, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(message.Data))
+	decoder.UseNumber()
+	var value interface{}
+	decodeErr := decoder.Decode(&value)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	redacted := false
+	for i := range moderator.Rules {
+		rule := &moderator.Rules[i]
+		if !matchValue(rule.Pattern, value) {
+			continue
+		}
+		verdict.Reasons = append(verdict.Reasons, rule.reason())
+		switch rule.Action {
+		case Reject:
+			verdict.Action = Reject
+			return verdict, nil
+		case Redact:
+			value = redactValue(rule, value)
+			redacted = true
+		}
+		if severity[rule.Action] > severity[verdict.Action] {
+			verdict.Action = rule.Action
+		}
+	}
+	if redacted {
+		redactedData, redactedDataErr := json.Marshal(value)
+		if redactedDataErr != nil {
+			return nil, redactedDataErr
+		}
+		verdict.Data = redactedData
+	}
+	return verdict, nil
+}
+
+// matchValue returns true if any string in the decoded JSON value matches
+// the pattern
+func matchValue(pattern *regexp.Regexp, value interface{}) bool {
+	switch typedValue := value.(type) {
+	case string:
+		return pattern.MatchString(typedValue)
+	case []interface{}:
+		for _, eachElement := range typedValue {
+			if matchValue(pattern, eachElement) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, eachElement := range typedValue {
+			if matchValue(pattern, eachElement) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactValue returns the decoded JSON value with the rule's matches
+// redacted from every string
+func redactValue(rule *Rule, value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case string:
+		return rule.redact(typedValue)
+	case []interface{}:
+		for i, eachElement := range typedValue {
+			typedValue[i] = redactValue(rule, eachElement)
+		}
+	case map[string]interface{}:
+		for eachKey, eachElement := range typedValue {
+			typedValue[eachKey] = redactValue(rule, eachElement)
+		}
+	}
+	return value
+}
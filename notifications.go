@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyNotificationTopic provisions the notification topic, whose
+	// messages are pushed to connections
+	envKeyNotificationTopic              = "NOTIFICATION_TOPIC"
+	notificationTopicResourceName        = "NotificationTopic"
+	notificationSubscriptionResourceName = "NotificationTopicSubscription"
+	notificationTopicPermissionName      = "NotificationTopicPermission"
+	outputNotificationTopicARN           = "NotificationTopicArn"
+	// attributeNotificationRoom is the optional message attribute that
+	// delivers the notification to a room's members rather than to every
+	// connection
+	attributeNotificationRoom = "room"
+)
+
+// notificationTopicEnabled returns true if the stack provisions the
+// notification topic
+func notificationTopicEnabled() bool {
+	return os.Getenv(envKeyNotificationTopic) == "true"
+}
+
+// notificationData returns the data of a notification's frame. JSON messages
+// are delivered as-is and other messages as JSON strings.
+func notificationData(message string) (json.RawMessage, error) {
+	if json.Valid([]byte(message)) {
+		return json.RawMessage(message), nil
+	}
+	return json.Marshal(message)
+}
+
+// notificationRoom returns the value of the message's room attribute, or the
+// empty string
+func notificationRoom(record awsEvents.SNSEventRecord) string {
+	attribute, _ := record.SNS.MessageAttributes[attributeNotificationRoom].(map[string]interface{})
+	room, _ := attribute["Value"].(string)
+	return room
+}
+
+// publishNotifications is the notification topic subscriber. Each message is
+// broadcast to every connection, or delivered as a room frame to the members
+// of the room named by its room attribute, with the SNS message ID as the
+// correlation ID. A failed delivery is retried by SNS, so connections may
+// receive a notification more than once.
+func publishNotifications(ctx context.Context, event awsEvents.SNSEvent) (err error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	endpointURL := os.Getenv(envKeyManagementEndpoint)
+	ctx, finishInvocation := startInvocation(ctx, "PublishNotifications")
+	defer func() {
+		finishInvocation(err)
+	}()
+
+	// Operation
+	for _, eachRecord := range event.Records {
+		data, dataErr := notificationData(eachRecord.SNS.Message)
+		if dataErr != nil {
+			return dataErr
+		}
+		messageID := eachRecord.SNS.MessageID
+		var stats deliveryStats
+		var deliverErr error
+		room := notificationRoom(eachRecord)
+		if room != "" {
+			stats, deliverErr = deliverRoom(ctx,
+				sess,
+				endpointURL,
+				messageID,
+				&roomFrame{
+					Room: room,
+					Data: data,
+				},
+				logger)
+		} else {
+			stats, deliverErr = deliverBroadcast(ctx,
+				sess,
+				endpointURL,
+				messageID,
+				data,
+				false,
+				"",
+				"",
+				logger)
+		}
+		correlatedLogger(logger, messageID).WithFields(logrus.Fields{
+			"Room":  room,
+			"Stats": stats,
+		}).Info("Notification delivered")
+		if deliverErr != nil {
+			return deliverErr
+		}
+	}
+	return nil
+}
+
+// notificationTopicDecorator provisions the notification topic, subscribes
+// the lambda to it, and publishes the topic ARN, which backend services
+// publish to, as a stack output
+func notificationTopicDecorator(subscriber *sparta.LambdaAWSInfo) sparta.ServiceDecoratorHookHandler {
+	return sparta.ServiceDecoratorHookFunc(func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		subscriberARN := gocf.GetAtt(subscriber.LogicalResourceName(), "Arn")
+		template.AddResource(notificationTopicResourceName, &gocf.SNSTopic{})
+		template.AddResource(notificationSubscriptionResourceName, &gocf.SNSSubscription{
+			Endpoint: subscriberARN.String(),
+			Protocol: gocf.String("lambda"),
+			TopicArn: gocf.Ref(notificationTopicResourceName).String(),
+		})
+		template.AddResource(notificationTopicPermissionName, &gocf.LambdaPermission{
+			Action:       gocf.String("lambda:InvokeFunction"),
+			FunctionName: subscriberARN.String(),
+			Principal:    gocf.String("sns.amazonaws.com"),
+			SourceArn:    gocf.Ref(notificationTopicResourceName).String(),
+		})
+		template.Outputs[outputNotificationTopicARN] = &gocf.Output{
+			Description: "SNS topic whose messages are pushed to connections",
+			Value:       gocf.Ref(notificationTopicResourceName),
+			Export:      stackExport(outputNotificationTopicARN),
+		}
+		return nil
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// envKeyFanoutConcurrency is the number of connections an outbox flush
+	// posts to in parallel
+	envKeyFanoutConcurrency  = "FANOUT_CONCURRENCY"
+	defaultFanoutConcurrency = 32
+	// outboxFlushSize is the number of connections an outbox queues frames
+	// for before it flushes, so large broadcasts post while they read the
+	// connection index rather than holding every frame until they finish
+	outboxFlushSize = 1000
+)
+
+// outboundFrame is a message encoded for a recipient negotiation. Parts, if
+// set, are the chunk frames posted in place of the frame.
+type outboundFrame struct {
+	frame []byte
+	parts [][]byte
+}
+
+// postFunc delivers a frame to a connection
+type postFunc func(ctx context.Context, connectionID string, frame []byte) error
+
+// outbox posts the frames queued for each connection, posting to up to
+// concurrency connections in parallel, so the post function must be safe for
+// concurrent use. A connection's frames are posted in the order they were
+// queued.
+type outbox struct {
+	post        postFunc
+	concurrency int
+	pending     map[string][]*outboundFrame
+	order       []string
+	// failed accumulates the delivery errors of every flush
+	failed map[string]error
+}
+
+// fanoutConcurrency returns the fanoutConcurrency tunable, falling back to
+// FANOUT_CONCURRENCY or the default concurrency
+func fanoutConcurrency(ctx context.Context, sess *session.Session, logger *logrus.Logger) int {
+	concurrency := int64(defaultFanoutConcurrency)
+	if envConcurrency, envConcurrencyErr := strconv.ParseInt(os.Getenv(envKeyFanoutConcurrency), 10, 64); envConcurrencyErr == nil {
+		concurrency = envConcurrency
+	}
+	concurrency = tunables.intValue(ctx, sess, tunableFanoutConcurrency, concurrency, logger)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return int(concurrency)
+}
+
+// annotateFanoutConcurrency publishes the provision-time FANOUT_CONCURRENCY
+// in the broadcasting lambda environment
+func annotateFanoutConcurrency(lambdaFn *sparta.LambdaAWSInfo) {
+	concurrency := os.Getenv(envKeyFanoutConcurrency)
+	if concurrency == "" {
+		return
+	}
+	setEnvironment(lambdaFn, envKeyFanoutConcurrency, gocf.String(concurrency))
+}
+
+func newOutbox(post postFunc, concurrency int) *outbox {
+	return &outbox{
+		post:        post,
+		concurrency: concurrency,
+		pending:     make(map[string][]*outboundFrame),
+		failed:      make(map[string]error),
+	}
+}
+
+// enqueue queues the frame for the connection, flushing the outbox once it
+// holds frames for outboxFlushSize connections
+func (box *outbox) enqueue(ctx context.Context,
+	connectionID string,
+	frame *outboundFrame) {
+	if _, pendingExists := box.pending[connectionID]; !pendingExists {
+		box.order = append(box.order, connectionID)
+	}
+	box.pending[connectionID] = append(box.pending[connectionID], frame)
+	if len(box.order) >= outboxFlushSize {
+		box.flush(ctx)
+	}
+}
+
+// flush delivers every pending frame, posting to connections in parallel.
+// A connection's frames are posted in order. The returned map includes the
+// delivery error for each connection that failed.
+func (box *outbox) flush(ctx context.Context) map[string]error {
+	deliveryErrors := make(map[string]error)
+	if len(box.order) == 0 {
+		return deliveryErrors
+	}
+	ctx, span := startSpan(ctx, "fanout.flush",
+		attribute.Int(attributeConnections, len(box.order)))
+	defer func() {
+		span.SetAttributes(attribute.Int(attributeFailed, len(deliveryErrors)))
+		span.End()
+	}()
+	var mutex sync.Mutex
+	var group errgroup.Group
+	group.SetLimit(box.concurrency)
+	for _, eachConnectionID := range box.order {
+		connectionID := eachConnectionID
+		frames := box.pending[connectionID]
+		group.Go(func() error {
+			for _, eachFrame := range postedFrames(frames) {
+				postErr := box.post(ctx, connectionID, eachFrame)
+				if postErr != nil {
+					mutex.Lock()
+					deliveryErrors[connectionID] = postErr
+					mutex.Unlock()
+					break
+				}
+			}
+			return nil
+		})
+	}
+	group.Wait()
+	for eachConnectionID, eachErr := range deliveryErrors {
+		box.failed[eachConnectionID] = eachErr
+	}
+	box.pending = make(map[string][]*outboundFrame)
+	box.order = nil
+	return deliveryErrors
+}
+
+// close flushes the outbox and returns the delivery error for each
+// connection that failed in any flush
+func (box *outbox) close(ctx context.Context) map[string]error {
+	box.flush(ctx)
+	return box.failed
+}
+
+// postedFrames returns the frames to post for the queued frames, which are
+// their chunk frames if they're chunked
+func postedFrames(frames []*outboundFrame) [][]byte {
+	posted := make([][]byte, 0, len(frames))
+	for _, eachFrame := range frames {
+		if len(eachFrame.parts) != 0 {
+			posted = append(posted, eachFrame.parts...)
+			continue
+		}
+		posted = append(posted, eachFrame.frame)
+	}
+	return posted
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// recordingPoster records the frames posted to each connection, failing the
+// posts to the connections in fail
+type recordingPoster struct {
+	mutex    sync.Mutex
+	fail     map[string]bool
+	posts    map[string][]string
+	inFlight int
+	peak     int
+}
+
+func newRecordingPoster(failConnectionIDs ...string) *recordingPoster {
+	poster := &recordingPoster{
+		fail:  make(map[string]bool),
+		posts: make(map[string][]string),
+	}
+	for _, eachConnectionID := range failConnectionIDs {
+		poster.fail[eachConnectionID] = true
+	}
+	return poster
+}
+
+func (poster *recordingPoster) post(ctx context.Context, connectionID string, frame []byte) error {
+	poster.mutex.Lock()
+	poster.inFlight++
+	if poster.inFlight > poster.peak {
+		poster.peak = poster.inFlight
+	}
+	poster.posts[connectionID] = append(poster.posts[connectionID], string(frame))
+	poster.mutex.Unlock()
+	defer func() {
+		poster.mutex.Lock()
+		poster.inFlight--
+		poster.mutex.Unlock()
+	}()
+	if poster.fail[connectionID] {
+		return errors.New("post failed")
+	}
+	return nil
+}
+
+func TestOutboxFlush(t *testing.T) {
+	poster := newRecordingPoster("conn-3")
+	box := newOutbox(poster.post, 2)
+	ctx := context.Background()
+	box.enqueue(ctx, "conn-1", &outboundFrame{frame: []byte("a")})
+	box.enqueue(ctx, "conn-2", &outboundFrame{frame: []byte("b")})
+	box.enqueue(ctx, "conn-1", &outboundFrame{
+		frame: []byte("chunked"),
+		parts: [][]byte{[]byte("c1"), []byte("c2")},
+	})
+	box.enqueue(ctx, "conn-3", &outboundFrame{frame: []byte("d")})
+	box.enqueue(ctx, "conn-3", &outboundFrame{frame: []byte("e")})
+	if len(poster.posts) != 0 {
+		t.Fatalf("Posted %v before the flush", poster.posts)
+	}
+	failed := box.close(ctx)
+	expected := map[string]string{
+		// A connection's frames are posted in order, chunked frames as their
+		// parts
+		"conn-1": "[a c1 c2]",
+		"conn-2": "[b]",
+		// Frames after a failed post aren't posted
+		"conn-3": "[d]",
+	}
+	for eachConnectionID, eachPosts := range expected {
+		if posts := fmt.Sprint(poster.posts[eachConnectionID]); posts != eachPosts {
+			t.Errorf("Posts to %s = %s, want %s", eachConnectionID, posts, eachPosts)
+		}
+	}
+	if len(failed) != 1 || failed["conn-3"] == nil {
+		t.Errorf("Failed = %v, want conn-3", failed)
+	}
+	if poster.peak > 2 {
+		t.Errorf("Posted to %d connections in parallel, want at most 2", poster.peak)
+	}
+	// Flushed frames aren't posted again
+	box.close(ctx)
+	if posts := fmt.Sprint(poster.posts["conn-2"]); posts != "[b]" {
+		t.Errorf("Posts to conn-2 after a second close = %s, want [b]", posts)
+	}
+}
+
+func TestOutboxFlushSize(t *testing.T) {
+	poster := newRecordingPoster()
+	box := newOutbox(poster.post, defaultFanoutConcurrency)
+	ctx := context.Background()
+	for eachIndex := 0; eachIndex < outboxFlushSize; eachIndex++ {
+		box.enqueue(ctx, fmt.Sprintf("conn-%d", eachIndex), &outboundFrame{frame: []byte("a")})
+	}
+	if len(poster.posts) != outboxFlushSize {
+		t.Errorf("Posted to %d connections once %d were queued, want %d",
+			len(poster.posts),
+			outboxFlushSize,
+			outboxFlushSize)
+	}
+	box.enqueue(ctx, "conn-last", &outboundFrame{frame: []byte("a")})
+	if len(poster.posts) != outboxFlushSize {
+		t.Errorf("Posted to conn-last before the outbox filled")
+	}
+	box.close(ctx)
+	if len(poster.posts["conn-last"]) != 1 {
+		t.Errorf("conn-last wasn't posted to by close")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyCustomDomainName is the provision-time custom domain that's
+	// mapped to the stage
+	envKeyCustomDomainName = "CUSTOM_DOMAIN_NAME"
+	// Stack output names
+	outputWebSocketURL        = "WebSocketURL"
+	outputCallbackURL         = "CallbackURL"
+	outputCustomDomainURL     = "CustomDomainURL"
+	outputConnectionTableName = "ConnectionTableName"
+)
+
+// webSocketURL returns the stage's execute-api wss:// endpoint
+func webSocketURL(apiGateway *sparta.APIV2) *gocf.StringExpr {
+	return gocf.Join("",
+		gocf.String("wss://"),
+		gocf.Ref(apiGateway.LogicalResourceName()),
+		gocf.String(".execute-api."),
+		gocf.Ref("AWS::Region"),
+		gocf.String("."),
+		gocf.Ref("AWS::URLSuffix"),
+		gocf.String("/"+apiStageName))
+}
+
+// stageManagementEndpoint returns the stage's @connections management API
+// endpoint
+func stageManagementEndpoint(apiGateway *sparta.APIV2) *gocf.StringExpr {
+	return gocf.Join("",
+		gocf.String("https://"),
+		gocf.Ref(apiGateway.LogicalResourceName()),
+		gocf.String(".execute-api."),
+		gocf.Ref("AWS::Region"),
+		gocf.String("."),
+		gocf.Ref("AWS::URLSuffix"),
+		gocf.String("/"+apiStageName))
+}
+
+// stackExport returns the export of the stack's named output, which other
+// stacks import as {stack name}-{output name}
+func stackExport(outputName string) *gocf.OutputExport {
+	return &gocf.OutputExport{
+		Name: gocf.Join("-",
+			gocf.Ref("AWS::StackName"),
+			gocf.String(outputName)),
+	}
+}
+
+// stackOutputsDecorator publishes the endpoints and connection table name as
+// stack outputs, exporting the endpoints. Sparta logs the outputs once the
+// stack is provisioned.
+func stackOutputsDecorator(apiGateway *sparta.APIV2,
+	tableName *gocf.StringExpr) sparta.ServiceDecoratorHookHandler {
+	return sparta.ServiceDecoratorHookFunc(func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		template.Outputs[outputWebSocketURL] = &gocf.Output{
+			Description: "Websocket endpoint",
+			Value:       webSocketURL(apiGateway),
+			Export:      stackExport(outputWebSocketURL),
+		}
+		template.Outputs[outputCallbackURL] = &gocf.Output{
+			Description: "@connections management API endpoint",
+			Value:       stageManagementEndpoint(apiGateway),
+			Export:      stackExport(outputCallbackURL),
+		}
+		if customDomainName := os.Getenv(envKeyCustomDomainName); customDomainName != "" {
+			template.Outputs[outputCustomDomainURL] = &gocf.Output{
+				Description: "Websocket custom domain endpoint",
+				Value:       gocf.String("wss://" + customDomainName),
+			}
+		}
+		template.Outputs[outputConnectionTableName] = &gocf.Output{
+			Description: "Connection table name",
+			Value:       tableName,
+		}
+		return nil
+	})
+}
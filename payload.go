@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/protocol"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	envKeyPayloadBucket = "PAYLOAD_BUCKETNAME"
+	// API Gateway rejects frames larger than 128KB. Leave headroom for the
+	// pointer frame itself.
+	maxInlineFrameSize = 96 * 1024
+	// How long recipients have to fetch a staged payload
+	payloadURLExpiry = 15 * time.Minute
+	// Staged payloads are only useful until the presigned URL expires
+	payloadBucketExpirationDays = 1
+	payloadBucketResourceName   = "PayloadBucket"
+	pointerMessage              = "pointer"
+)
+
+// payloadPointer is the data property of a pointer frame. The object at URL
+// is the complete frame the recipient would otherwise have received, in its
+// negotiated encoding and compression. JSON clients receive the data as the
+// frame itself, so Type distinguishes it from broadcast data.
+type payloadPointer struct {
+	Type        string               `json:"type"`
+	URL         string               `json:"url"`
+	Size        int                  `json:"size"`
+	Encoding    protocol.Encoding    `json:"encoding"`
+	Compression protocol.Compression `json:"compression"`
+}
+
+// payloadStager replaces frames that exceed the gateway frame limit with
+// pointer frames that reference a presigned S3 GET URL
+type payloadStager struct {
+	s3Client  *s3.S3
+	bucket    string
+	keyPrefix string
+}
+
+func newPayloadStager(sess *session.Session, keyPrefix string) *payloadStager {
+	return &payloadStager{
+		s3Client:  s3.New(sess),
+		bucket:    os.Getenv(envKeyPayloadBucket),
+		keyPrefix: keyPrefix,
+	}
+}
+
+// deliverableFrame returns the frame if it's small enough to post directly.
+// Otherwise it chunks the frame, if the negotiation accepts chunks, or
+// stages the frame in S3 and returns a pointer frame.
+func (stager *payloadStager) deliverableFrame(ctx context.Context,
+	negotiation protocol.Negotiation,
+	outbound *outboundFrame) (*outboundFrame, error) {
+	frame := outbound.frame
+	if len(frame) <= maxInlineFrameSize {
+		return outbound, nil
+	}
+	objectKey := fmt.Sprintf("%s/%s-%s",
+		stager.keyPrefix,
+		negotiation.Encoding,
+		negotiation.Compression)
+	if chunkable(negotiation, frame) {
+		return chunkFrame(objectKey, negotiation, outbound)
+	}
+	if stager.bucket == "" {
+		return nil, fmt.Errorf("frame size %d exceeds limit %d and no payload bucket is configured",
+			len(frame),
+			maxInlineFrameSize)
+	}
+	_, putObjectErr := stager.s3Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(stager.bucket),
+		Key:    aws.String(objectKey),
+		Body:   bytes.NewReader(frame),
+	})
+	if putObjectErr != nil {
+		return nil, putObjectErr
+	}
+	getObjectRequest, _ := stager.s3Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(stager.bucket),
+		Key:    aws.String(objectKey),
+	})
+	presignedURL, presignErr := getObjectRequest.Presign(payloadURLExpiry)
+	if presignErr != nil {
+		return nil, presignErr
+	}
+	pointerData, pointerDataErr := json.Marshal(&payloadPointer{
+		Type:        pointerMessage,
+		URL:         presignedURL,
+		Size:        len(frame),
+		Encoding:    negotiation.Encoding,
+		Compression: negotiation.Compression,
+	})
+	if pointerDataErr != nil {
+		return nil, pointerDataErr
+	}
+	// The pointer frame itself is always uncompressed so that clients can
+	// inspect it before fetching
+	pointerFrame, pointerFrameErr := protocol.CodecFor(negotiation.Encoding).Encode(pointerMessage,
+		pointerData)
+	if pointerFrameErr != nil {
+		return nil, pointerFrameErr
+	}
+	return &outboundFrame{
+		frame: pointerFrame,
+	}, nil
+}
+
+// payloadBucketDecorator provisions the bucket that holds staged payloads
+func payloadBucketDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	bucket := &gocf.S3Bucket{
+		LifecycleConfiguration: &gocf.S3BucketLifecycleConfiguration{
+			Rules: &gocf.S3BucketRuleList{
+				gocf.S3BucketRule{
+					ExpirationInDays: gocf.Integer(payloadBucketExpirationDays),
+					Status:           gocf.String("Enabled"),
+				},
+			},
+		},
+	}
+	if keyARN := os.Getenv(envKeyExternalKMSKeyARN); keyARN != "" {
+		bucket.BucketEncryption = &gocf.S3BucketBucketEncryption{
+			ServerSideEncryptionConfiguration: &gocf.S3BucketServerSideEncryptionRuleList{
+				gocf.S3BucketServerSideEncryptionRule{
+					ServerSideEncryptionByDefault: &gocf.S3BucketServerSideEncryptionByDefault{
+						SSEAlgorithm:   gocf.String("aws:kms"),
+						KMSMasterKeyID: gocf.String(keyARN),
+					},
+				},
+			},
+		}
+	}
+	template.AddResource(payloadBucketResourceName, bucket)
+	return nil
+}
+
+// annotatePayloadBucket grants the lambda access to the payload bucket and
+// publishes the bucket name in its environment
+func annotatePayloadBucket(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"s3:PutObject", "s3:GetObject"},
+			Resource: gocf.Join("",
+				gocf.GetAtt(payloadBucketResourceName, "Arn"),
+				gocf.String("/*")),
+		})
+	// Staging and presigning objects encrypted with the key requires
+	// access to it
+	if keyARN := os.Getenv(envKeyExternalKMSKeyARN); keyARN != "" {
+		lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+			sparta.IAMRolePrivilege{
+				Actions:  []string{"kms:GenerateDataKey", "kms:Decrypt"},
+				Resource: gocf.String(keyARN),
+			})
+	}
+	setEnvironment(lambdaFn, envKeyPayloadBucket, gocf.Ref(payloadBucketResourceName).String())
+}
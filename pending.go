@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/connections"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	envKeyPendingTableName        = "PENDING_DELIVERIES_TABLENAME"
+	pendingDeliveriesResourceName = "PendingDeliveries"
+	// envKeyPendingFlushQueueURL is the queue of connections to flush
+	// pending messages to
+	envKeyPendingFlushQueueURL    = "PENDING_FLUSH_QUEUE_URL"
+	pendingFlushQueueResourceName = "PendingFlushQueue"
+	pendingFlushVisibilityTimeout = 60
+	pendingFlushConsumerTimeout   = 30
+	pendingFlushBatchSize         = 10
+	// pendingFlushDelay defers the flush until $connect has completed, since
+	// the connection can't be posted to before then
+	pendingFlushDelay = 2
+	// pendingRetention is how long messages are held for an offline user
+	pendingRetention = 7 * 24 * time.Hour
+	// maxPendingMessages bounds the messages held for each user
+	maxPendingMessages = 100
+	// maxPendingPayloadSize bounds the held frames, well under the DynamoDB
+	// item size limit
+	maxPendingPayloadSize = 64 * 1024
+)
+
+// errPendingFull is returned when a message can't be held for an offline
+// user, either because it's too large or because the user already has
+// maxPendingMessages held messages
+var errPendingFull = errors.New("pending messages full")
+
+// pendingFlushRequest is the pending flush queue message body
+type pendingFlushRequest struct {
+	EndpointURL  string            `json:"endpointURL"`
+	RequestID    string            `json:"requestId"`
+	ConnectionID string            `json:"connectionId"`
+	UserID       string            `json:"userId"`
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+}
+
+// pendingEnabled returns true if direct messages to offline users are held
+// until they connect
+func pendingEnabled() bool {
+	return os.Getenv(envKeyPendingTableName) != ""
+}
+
+// pendingCount returns the number of messages held for the user, up to
+// limit
+func pendingCount(ctx context.Context,
+	pendingClient dynamodbiface.DynamoDBAPI,
+	userID string,
+	limit int64) (int64, error) {
+	queryOutput, queryErr := pendingClient.QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv(envKeyPendingTableName)),
+		KeyConditionExpression: aws.String("#userID = :userID"),
+		ExpressionAttributeNames: map[string]*string{
+			"#userID": aws.String(connections.UserAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":userID": &dynamodb.AttributeValue{S: aws.String(userID)},
+		},
+		Select: aws.String(dynamodb.SelectCount),
+		Limit:  aws.Int64(limit),
+	})
+	if queryErr != nil {
+		return 0, queryErr
+	}
+	return aws.Int64Value(queryOutput.Count), nil
+}
+
+// holdPending stores the direct frame for delivery when the user next
+// connects
+func holdPending(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	userID string,
+	messageID string,
+	frameData json.RawMessage,
+	logger *logrus.Logger) error {
+	if len(frameData) > maxPendingPayloadSize {
+		return errPendingFull
+	}
+	pendingClient := newDynamoClient(sess)
+	count, countErr := pendingCount(ctx, pendingClient, userID, maxPendingMessages)
+	if countErr != nil {
+		return countErr
+	}
+	if count >= maxPendingMessages {
+		return errPendingFull
+	}
+	heldAt := time.Now()
+	pendingItem := map[string]*dynamodb.AttributeValue{
+		connections.UserAttribute: &dynamodb.AttributeValue{
+			S: aws.String(userID),
+		},
+		ddbAttributeSentAt: &dynamodb.AttributeValue{
+			S: aws.String(fmt.Sprintf("%019d#%s", heldAt.UnixNano(), request.RequestContext.RequestID)),
+		},
+		ddbAttributePayload: &dynamodb.AttributeValue{
+			S: aws.String(string(frameData)),
+		},
+		connections.ExpiresAtAttribute: &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(heldAt.Add(pendingRetention).Unix(), 10)),
+		},
+	}
+	if messageID != "" {
+		pendingItem[ddbAttributeMessageID] = &dynamodb.AttributeValue{
+			S: aws.String(messageID),
+		}
+	}
+	_, putItemErr := pendingClient.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(os.Getenv(envKeyPendingTableName)),
+		Item:      pendingItem,
+	})
+	if putItemErr != nil {
+		return putItemErr
+	}
+	logger.WithFields(logrus.Fields{
+		"UserID":    userID,
+		"MessageID": messageID,
+	}).Info("Direct message held for offline user")
+	return nil
+}
+
+// schedulePendingFlush queues a flush of the user's held messages to the
+// connection being established, if there are any and the user ID was
+// validated. It's best-effort: the messages are held until a later
+// connection if it fails.
+func schedulePendingFlush(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	user identity,
+	logger *logrus.Logger) {
+	queueURL := os.Getenv(envKeyPendingFlushQueueURL)
+	if user.userID == "" || user.source == identitySourceQuery || queueURL == "" || !pendingEnabled() {
+		return
+	}
+	userID := user.userID
+	count, countErr := pendingCount(ctx, newDynamoClient(sess), userID, 1)
+	if countErr != nil {
+		logger.WithField("Error", countErr).Warn("Failed to query pending messages")
+		return
+	}
+	if count == 0 {
+		return
+	}
+	body, _ := json.Marshal(&pendingFlushRequest{
+		EndpointURL:  managementEndpoint(request.RequestContext),
+		RequestID:    request.RequestContext.RequestID,
+		ConnectionID: request.RequestContext.ConnectionID,
+		UserID:       userID,
+		TraceContext: injectTraceContext(ctx),
+	})
+	_, sendErr := newSQSClient(sess).SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:     aws.String(queueURL),
+		MessageBody:  aws.String(string(body)),
+		DelaySeconds: aws.Int64(pendingFlushDelay),
+	})
+	if sendErr != nil {
+		logger.WithField("Error", sendErr).Warn("Failed to schedule pending message flush")
+	}
+}
+
+// flushPending is the pending flush queue consumer. It delivers each held
+// message, oldest first, to the newly established connection and deletes
+// it once delivered.
+func flushPending(ctx context.Context, event awsEvents.SQSEvent) error {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+
+	// Operation
+	var failureCount int
+	for _, eachRecord := range event.Records {
+		var flush pendingFlushRequest
+		unmarshalErr := json.Unmarshal([]byte(eachRecord.Body), &flush)
+		if unmarshalErr != nil || flush.ConnectionID == "" || flush.UserID == "" {
+			logger.WithField("Body", eachRecord.Body).Warn("Discarding malformed pending flush request")
+			continue
+		}
+		flushErr := flushPendingConnection(ctx, sess, &flush, logger)
+		if flushErr != nil {
+			logger.WithFields(logrus.Fields{
+				"Error":        flushErr,
+				"ConnectionID": flush.ConnectionID,
+			}).Warn("Failed to flush pending messages")
+			failureCount++
+		}
+	}
+	if failureCount != 0 {
+		return fmt.Errorf("failed to flush pending messages to %d of %d connections",
+			failureCount,
+			len(event.Records))
+	}
+	return nil
+}
+
+// flushPendingConnection delivers the user's held messages to the
+// connection. Delivery stops, leaving the remaining messages held, if the
+// connection has closed. Messages are only flushed to connections whose user
+// ID was validated, so they aren't delivered to a connection that merely
+// claims the user.
+func flushPendingConnection(ctx context.Context,
+	sess *session.Session,
+	flush *pendingFlushRequest,
+	logger *logrus.Logger) (err error) {
+	ctx, finishInvocation := startInvocation(extractTraceContext(ctx, flush.TraceContext),
+		"FlushPending",
+		attribute.String(attributeConnectionID, flush.ConnectionID))
+	defer func() {
+		finishInvocation(err)
+	}()
+	receiverItem, receiverItemErr := getConnectionItem(flush.ConnectionID, newConnectionsClient(sess))
+	if receiverItemErr != nil {
+		return receiverItemErr
+	}
+	if len(receiverItem) == 0 {
+		// Disconnected before the flush
+		return nil
+	}
+	if !itemAuthenticated(receiverItem) || itemUserID(receiverItem) != flush.UserID {
+		logger.WithField("ConnectionID", flush.ConnectionID).Warn("Not flushing pending messages to an unauthenticated connection")
+		return nil
+	}
+	pendingClient := newDynamoClient(sess)
+	queryOutput, queryErr := pendingClient.QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv(envKeyPendingTableName)),
+		KeyConditionExpression: aws.String("#userID = :userID"),
+		ExpressionAttributeNames: map[string]*string{
+			"#userID": aws.String(connections.UserAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":userID": &dynamodb.AttributeValue{S: aws.String(flush.UserID)},
+		},
+		ConsistentRead: aws.Bool(true),
+		Limit:          aws.Int64(maxPendingMessages),
+	})
+	if queryErr != nil {
+		return queryErr
+	}
+	var delivered int
+	for _, eachItem := range queryOutput.Items {
+		bcast := newBroadcaster(ctx,
+			sess,
+			flush.EndpointURL,
+			flush.RequestID,
+			directMessage,
+			json.RawMessage(itemString(eachItem, ddbAttributePayload)),
+			logger)
+		bcast.deliverItems(ctx, []map[string]*dynamodb.AttributeValue{receiverItem})
+		stats := bcast.finish(ctx)
+		if stats.Gone != 0 {
+			break
+		}
+		if stats.Delivered == 0 {
+			return fmt.Errorf("failed to deliver pending message to %s", flush.ConnectionID)
+		}
+		_, deleteErr := pendingClient.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(os.Getenv(envKeyPendingTableName)),
+			Key: map[string]*dynamodb.AttributeValue{
+				connections.UserAttribute: eachItem[connections.UserAttribute],
+				ddbAttributeSentAt:        eachItem[ddbAttributeSentAt],
+			},
+		})
+		if deleteErr != nil {
+			return deleteErr
+		}
+		countRecipients(ctx, sess, itemString(eachItem, ddbAttributeMessageID), 1, logger)
+		delivered++
+	}
+	logger.WithFields(logrus.Fields{
+		"UserID":    flush.UserID,
+		"Delivered": delivered,
+	}).Info("Pending messages flushed")
+	return nil
+}
+
+// pendingDeliveriesDecorator provisions the pending delivery table, keyed by
+// user ID and held time, and the pending flush queue
+func pendingDeliveriesDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(pendingDeliveriesResourceName, &gocf.DynamoDBTable{
+		AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(connections.UserAttribute),
+				AttributeType: gocf.String("S"),
+			},
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeSentAt),
+				AttributeType: gocf.String("S"),
+			},
+		},
+		KeySchema: &gocf.DynamoDBTableKeySchemaList{
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(connections.UserAttribute),
+				KeyType:       gocf.String("HASH"),
+			},
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeSentAt),
+				KeyType:       gocf.String("RANGE"),
+			},
+		},
+		TimeToLiveSpecification: &gocf.DynamoDBTableTimeToLiveSpecification{
+			AttributeName: gocf.String(connections.ExpiresAtAttribute),
+			Enabled:       gocf.Bool(true),
+		},
+		BillingMode: gocf.String("PAY_PER_REQUEST"),
+	})
+	template.AddResource(pendingFlushQueueResourceName, &gocf.SQSQueue{
+		VisibilityTimeout: gocf.Integer(pendingFlushVisibilityTimeout),
+	})
+	return nil
+}
+
+// annotatePendingDeliveries grants the lambda access to the pending delivery
+// table and publishes the table name in its environment
+func annotatePendingDeliveries(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:PutItem",
+				"dynamodb:Query",
+				"dynamodb:DeleteItem"},
+			Resource: gocf.GetAtt(pendingDeliveriesResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyPendingTableName, gocf.Ref(pendingDeliveriesResourceName).String())
+}
+
+// annotatePendingFlushProducer grants the lambda permission to queue pending
+// flushes and publishes the queue URL in its environment
+func annotatePendingFlushProducer(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"sqs:SendMessage"},
+			Resource: gocf.GetAtt(pendingFlushQueueResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyPendingFlushQueueURL, gocf.Ref(pendingFlushQueueResourceName).String())
+}
+
+// annotatePendingFlushConsumer subscribes the lambda to the pending flush
+// queue
+func annotatePendingFlushConsumer(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"sqs:ReceiveMessage",
+				"sqs:DeleteMessage",
+				"sqs:GetQueueAttributes"},
+			Resource: gocf.GetAtt(pendingFlushQueueResourceName, "Arn"),
+		})
+	if lambdaFn.Options == nil {
+		lambdaFn.Options = &sparta.LambdaFunctionOptions{}
+	}
+	// The visibility timeout must exceed the consumer's timeout
+	lambdaFn.Options.Timeout = pendingFlushConsumerTimeout
+	lambdaFn.EventSourceMappings = append(lambdaFn.EventSourceMappings,
+		&sparta.EventSourceMapping{
+			EventSourceArn: gocf.GetAtt(pendingFlushQueueResourceName, "Arn"),
+			BatchSize:      pendingFlushBatchSize,
+		})
+}
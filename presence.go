@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	"github.com/mweagle/SpartaWebSocket/connections"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	presenceMessage       = "presence"
+	presenceChangeMessage = "presenceChange"
+	// maxPresenceUsers bounds the users listed in a presence frame, and the
+	// user IDs a presence request may ask about
+	maxPresenceUsers = 1000
+)
+
+// presenceRequest is the data of a presence frame. UserIDs, if set, limits
+// the reply to those users. Count replies with the number of online users
+// rather than listing them.
+type presenceRequest struct {
+	UserIDs []string `json:"userIds,omitempty"`
+	Count   bool     `json:"count,omitempty"`
+}
+
+// presenceFrame is the data of the presence frame posted to the sender.
+// Truncated is true if there were more than maxPresenceUsers online users.
+type presenceFrame struct {
+	Users     []string `json:"users,omitempty"`
+	Count     int      `json:"count"`
+	Truncated bool     `json:"truncated,omitempty"`
+}
+
+// presenceChangeFrame is the data of the presenceChange frame broadcast when a
+// user's first connection opens or last connection closes
+type presenceChangeFrame struct {
+	UserID string `json:"userId"`
+	Online bool   `json:"online"`
+}
+
+// queryPresence replies to the sender with the online users, or their count
+func queryPresence(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	endpointURL := managementEndpoint(request.RequestContext)
+	dynamoClient := newConnectionsClient(sess)
+	apigwMgmtClient := newManagementClient(sess, endpointURL)
+
+	senderItem, senderItemErr := senderConnectionItem(ctx, request, dynamoClient)
+	if senderItemErr != nil {
+		logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+	}
+	locale := itemLocale(senderItem)
+	var presence presenceRequest
+	payload, payloadErr := requestPayload(request, senderItem)
+	if payloadErr == nil {
+		payloadErr = json.Unmarshal(payload, &presence)
+	}
+	if payloadErr != nil {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeMalformedRequest,
+			catalog.Localize(locale, catalog.UnmarshalFailed, payloadErr.Error()),
+			logger), nil
+	}
+	if len(presence.UserIDs) > maxPresenceUsers {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeMalformedRequest,
+			catalog.Localize(locale, catalog.InvalidUser),
+			logger), nil
+	}
+
+	// Operation
+	store := newConnectionIndex(dynamoClient)
+	frame := &presenceFrame{}
+	var presenceErr error
+	if len(presence.UserIDs) != 0 {
+		frame.Users, presenceErr = onlineUsers(ctx, store, presence.UserIDs)
+	} else {
+		limit := maxPresenceUsers
+		if presence.Count {
+			limit = 0
+		}
+		frame.Users, frame.Truncated, presenceErr = store.OnlineUsers(ctx, limit)
+	}
+	if presenceErr != nil {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeSendFailed,
+			catalog.Localize(locale, catalog.SendFailed, presenceErr.Error()),
+			logger), nil
+	}
+	frame.Count = len(frame.Users)
+	if presence.Count {
+		frame.Users = nil
+	}
+	frameData, _ := json.Marshal(frame)
+	bcast := newBroadcaster(ctx,
+		sess,
+		endpointURL,
+		request.RequestContext.RequestID,
+		presenceMessage,
+		frameData,
+		logger)
+	bcast.deliverItems(ctx, []map[string]*dynamodb.AttributeValue{senderItem})
+	bcast.finish(ctx)
+	return &wsResponse{
+		StatusCode: 200,
+		Body:       catalog.Localize(locale, catalog.DataSent),
+	}, nil
+}
+
+// onlineUsers returns the subset of the users that have an unexpired
+// connection
+func onlineUsers(ctx context.Context,
+	store connections.Index,
+	userIDs []string) ([]string, error) {
+	var online []string
+	seen := make(map[string]bool)
+	for _, eachUserID := range userIDs {
+		if seen[eachUserID] || eachUserID == "" || len(eachUserID) > maxUserIDLength {
+			continue
+		}
+		seen[eachUserID] = true
+		items, itemsErr := store.UserConnections(ctx, eachUserID)
+		if itemsErr != nil {
+			return nil, itemsErr
+		}
+		if len(items) != 0 {
+			online = append(online, eachUserID)
+		}
+	}
+	return online, nil
+}
+
+// notifyPresenceChange broadcasts a presenceChange frame if the connection
+// was the user's first, or last, open connection. The connection being
+// established isn't notified, since it can't be posted to until $connect
+// completes. Notifications are best-effort and off unless the
+// presenceNotifications feature flag is on, since each is a broadcast.
+func notifyPresenceChange(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	userID string,
+	online bool,
+	logger *logrus.Logger) {
+	if userID == "" || !features.enabled(ctx, sess, featurePresenceNotifications, logger) {
+		return
+	}
+	connectionID := request.RequestContext.ConnectionID
+	store := newConnectionIndex(newConnectionsClient(sess))
+	items, itemsErr := store.UserConnections(ctx, userID)
+	if itemsErr != nil {
+		logger.WithField("Error", itemsErr).Warn("Failed to query user connections")
+		return
+	}
+	for _, eachItem := range items {
+		if itemString(eachItem, ddbAttributeConnectionID) != connectionID {
+			// The user has another connection, so presence didn't change
+			return
+		}
+	}
+	frameData, _ := json.Marshal(&presenceChangeFrame{
+		UserID: userID,
+		Online: online,
+	})
+	bcast := newBroadcaster(ctx,
+		sess,
+		managementEndpoint(request.RequestContext),
+		request.RequestContext.RequestID,
+		presenceChangeMessage,
+		frameData,
+		logger)
+	bcast.excluded = connectionID
+	queryErr := bcast.query(ctx, 0, 0)
+	stats := bcast.finish(ctx)
+	if queryErr != nil {
+		logger.WithField("Error", queryErr).Warn("Failed to notify presence change")
+	}
+	logger.WithFields(logrus.Fields{
+		"UserID": userID,
+		"Online": online,
+		"Stats":  stats,
+	}).Info("Presence change notified")
+}
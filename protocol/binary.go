@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// BinaryType is the type property of the JSON form of an opaque binary
+// payload
+const BinaryType = "binary"
+
+// binaryData is the JSON form of an opaque binary payload, such as an image,
+// that a JSON connection sent as a binary frame. Data is base64 encoded in
+// the JSON form.
+type binaryData struct {
+	Type string `json:"type"`
+	Data []byte `json:"data"`
+}
+
+// binaryPrefix is the start of every marshaled binaryData
+var binaryPrefix = []byte(`{"type":"` + BinaryType + `"`)
+
+// BinaryData returns the JSON data that carries the opaque binary payload
+// through transcoding. JSON connections receive the payload as a binary
+// frame; connections that negotiated other encodings receive the JSON form.
+// Text senders can send the same JSON, so whether data is a binary payload
+// is carried alongside it rather than detected from it.
+func BinaryData(payload []byte) (json.RawMessage, error) {
+	return json.Marshal(&binaryData{
+		Type: BinaryType,
+		Data: payload,
+	})
+}
+
+// ParseBinaryData returns the opaque binary payload if the JSON data is the
+// form returned by BinaryData
+func ParseBinaryData(data json.RawMessage) ([]byte, bool) {
+	if !bytes.HasPrefix(data, binaryPrefix) {
+		return nil, false
+	}
+	var binary binaryData
+	if json.Unmarshal(data, &binary) != nil || binary.Type != BinaryType {
+		return nil, false
+	}
+	return binary.Data, true
+}
+
+// EncodeBinary returns the outbound frame in the codec's wire format for the
+// message name and the JSON form of an opaque binary payload. JSON frames
+// are the payload itself; other encodings carry the JSON form as the data.
+func EncodeBinary(codec Codec, message string, correlationID string, data json.RawMessage) ([]byte, error) {
+	if codec.Encoding() == EncodingJSON {
+		if payload, isBinary := ParseBinaryData(data); isBinary {
+			return payload, nil
+		}
+	}
+	return Encode(codec, message, correlationID, data)
+}
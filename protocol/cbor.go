@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// cborFrame is the CBOR map exchanged with connections that negotiated
+// EncodingCBOR, typically constrained devices
+type cborFrame struct {
+	Message       string      `cbor:"message"`
+	CorrelationID string      `cbor:"correlationId,omitempty"`
+	Data          interface{} `cbor:"data"`
+}
+
+// cborCodec exchanges cborFrame maps
+type cborCodec struct{}
+
+func (cborCodec) Encoding() Encoding {
+	return EncodingCBOR
+}
+
+func (cborCodec) Decode(frame []byte) (json.RawMessage, error) {
+	var cFrame cborFrame
+	unmarshalErr := cbor.Unmarshal(frame, &cFrame)
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	if cFrame.Data == nil {
+		return nil, fmt.Errorf("request does not contain a data property")
+	}
+	jsonData, jsonDataErr := jsonCompatible(cFrame.Data)
+	if jsonDataErr != nil {
+		return nil, jsonDataErr
+	}
+	return json.Marshal(jsonData)
+}
+
+func (codec cborCodec) Encode(message string, data json.RawMessage) ([]byte, error) {
+	return codec.EncodeCorrelated(message, "", data)
+}
+
+func (cborCodec) EncodeCorrelated(message string,
+	correlationID string,
+	data json.RawMessage) ([]byte, error) {
+	cFrame := cborFrame{
+		Message:       message,
+		CorrelationID: correlationID,
+	}
+	// Payloads that aren't JSON documents are delivered as CBOR byte strings
+	if unmarshalErr := json.Unmarshal(data, &cFrame.Data); unmarshalErr != nil {
+		cFrame.Data = []byte(data)
+	}
+	return cbor.Marshal(&cFrame)
+}
+
+// jsonCompatible converts the map[interface{}]interface{} values produced
+// by the CBOR decoder into string keyed maps that encoding/json accepts
+func jsonCompatible(value interface{}) (interface{}, error) {
+	switch typedValue := value.(type) {
+	case map[interface{}]interface{}:
+		mapValue := make(map[string]interface{}, len(typedValue))
+		for eachKey, eachValue := range typedValue {
+			keyValue, keyValueOk := eachKey.(string)
+			if !keyValueOk {
+				return nil, fmt.Errorf("unsupported CBOR map key: %#v", eachKey)
+			}
+			convertedValue, convertedValueErr := jsonCompatible(eachValue)
+			if convertedValueErr != nil {
+				return nil, convertedValueErr
+			}
+			mapValue[keyValue] = convertedValue
+		}
+		return mapValue, nil
+	case []interface{}:
+		for eachIndex, eachValue := range typedValue {
+			convertedValue, convertedValueErr := jsonCompatible(eachValue)
+			if convertedValueErr != nil {
+				return nil, convertedValueErr
+			}
+			typedValue[eachIndex] = convertedValue
+		}
+		return typedValue, nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestCBORCodec(t *testing.T) {
+	codec := CodecFor(EncodingCBOR)
+	tests := []struct {
+		name string
+		data json.RawMessage
+	}{
+		{"object", json.RawMessage(`{"count":2,"text":"hello"}`)},
+		{"nested", json.RawMessage(`{"points":[{"x":1},{"x":2}]}`)},
+		{"string", json.RawMessage(`"hello"`)},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			frame, frameErr := Encode(codec, "broadcast", "request-1", eachTest.data)
+			if frameErr != nil {
+				t.Fatalf("Encode failed: %s", frameErr)
+			}
+			var cFrame cborFrame
+			unmarshalErr := cbor.Unmarshal(frame, &cFrame)
+			if unmarshalErr != nil {
+				t.Fatalf("Failed to unmarshal frame: %s", unmarshalErr)
+			}
+			if cFrame.Message != "broadcast" || cFrame.CorrelationID != "request-1" {
+				t.Errorf("Frame = %q/%q, want broadcast/request-1", cFrame.Message, cFrame.CorrelationID)
+			}
+			decoded, decodeErr := codec.Decode(frame)
+			if decodeErr != nil {
+				t.Fatalf("Decode failed: %s", decodeErr)
+			}
+			if string(decoded) != string(eachTest.data) {
+				t.Errorf("Decoded data = %s, want %s", decoded, eachTest.data)
+			}
+		})
+	}
+	// Maps with keys that JSON can't represent aren't data
+	intKeys, _ := cbor.Marshal(map[string]interface{}{
+		"message": "sendmessage",
+		"data":    map[int]string{1: "one"},
+	})
+	if _, decodeErr := codec.Decode(intKeys); decodeErr == nil {
+		t.Errorf("Decode accepted a map with integer keys")
+	}
+	empty, _ := cbor.Marshal(&cborFrame{Message: "sendmessage"})
+	if _, decodeErr := codec.Decode(empty); decodeErr == nil {
+		t.Errorf("Decode accepted a frame without data")
+	}
+}
@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Codec converts between an encoding's wire frames and the JSON data that's
+// the canonical form used to transcode between connections that negotiated
+// different encodings
+type Codec interface {
+	// Encoding is the handshake name of the codec's wire format
+	Encoding() Encoding
+	// Decode returns the JSON data property of an inbound frame
+	Decode(frame []byte) (json.RawMessage, error)
+	// Encode returns the outbound frame for the message name and JSON data
+	Encode(message string, data json.RawMessage) ([]byte, error)
+}
+
+// RequestEncoder is implemented by codecs whose client request frames differ
+// from the frames they deliver
+type RequestEncoder interface {
+	// EncodeRequest returns the inbound frame a client sends for the message
+	// name and JSON data
+	EncodeRequest(message string, data json.RawMessage) ([]byte, error)
+}
+
+// EncodeRequest returns the frame a client sends in the codec's wire format
+// for the message name and JSON data
+func EncodeRequest(codec Codec, message string, data json.RawMessage) ([]byte, error) {
+	if requestEncoder, isRequestEncoder := codec.(RequestEncoder); isRequestEncoder {
+		return requestEncoder.EncodeRequest(message, data)
+	}
+	return codec.Encode(message, data)
+}
+
+// CorrelatedEncoder is implemented by codecs whose outbound frames carry the
+// correlation ID of the inbound message they deliver
+type CorrelatedEncoder interface {
+	// EncodeCorrelated returns the outbound frame for the message name,
+	// correlation ID, and JSON data
+	EncodeCorrelated(message string, correlationID string, data json.RawMessage) ([]byte, error)
+}
+
+// Encode returns the outbound frame in the codec's wire format for the
+// message name and JSON data. The correlation ID is included if the codec's
+// frames carry one; JSON frames are the data itself, so they don't.
+func Encode(codec Codec, message string, correlationID string, data json.RawMessage) ([]byte, error) {
+	if correlatedEncoder, isCorrelatedEncoder := codec.(CorrelatedEncoder); isCorrelatedEncoder {
+		return correlatedEncoder.EncodeCorrelated(message, correlationID, data)
+	}
+	return codec.Encode(message, data)
+}
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = map[Encoding]Codec{}
+)
+
+func init() {
+	RegisterCodec(jsonCodec{})
+	RegisterCodec(protobufCodec{})
+	RegisterCodec(messagePackCodec{})
+	RegisterCodec(cborCodec{})
+}
+
+// RegisterCodec makes the codec available for negotiation, replacing any
+// codec already registered for its encoding
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecs[codec.Encoding()] = codec
+}
+
+// CodecFor returns the codec for the encoding, falling back to the JSON codec
+// for unregistered encodings
+func CodecFor(encoding Encoding) Codec {
+	if codec, exists := lookupCodec(encoding); exists {
+		return codec
+	}
+	return jsonCodec{}
+}
+
+func lookupCodec(encoding Encoding) (Codec, bool) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	codec, exists := codecs[encoding]
+	return codec, exists
+}
+
+// jsonCodec is the default text frame codec. Outbound data is sent as-is,
+// so JSON clients receive the data property as the frame.
+type jsonCodec struct{}
+
+func (jsonCodec) Encoding() Encoding {
+	return EncodingJSON
+}
+
+func (jsonCodec) Decode(frame []byte) (json.RawMessage, error) {
+	var objMap map[string]*json.RawMessage
+	unmarshalErr := json.Unmarshal(frame, &objMap)
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	if objMap["data"] == nil {
+		return nil, fmt.Errorf("request does not contain a data property")
+	}
+	return *objMap["data"], nil
+}
+
+func (jsonCodec) Encode(message string, data json.RawMessage) ([]byte, error) {
+	return data, nil
+}
+
+// protobufCodec exchanges Envelope messages. Clients send SendMessage
+// payloads and receive Broadcast payloads.
+type protobufCodec struct{}
+
+func (protobufCodec) Encoding() Encoding {
+	return EncodingProtobuf
+}
+
+func (protobufCodec) Decode(frame []byte) (json.RawMessage, error) {
+	envelope := &Envelope{}
+	unmarshalErr := proto.Unmarshal(frame, envelope)
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	switch payload := envelope.Payload.(type) {
+	case *Envelope_SendMessage:
+		return payload.SendMessage.GetData(), nil
+	case *Envelope_Broadcast:
+		return payload.Broadcast.GetData(), nil
+	}
+	return nil, fmt.Errorf("envelope does not contain a payload")
+}
+
+func (codec protobufCodec) Encode(message string, data json.RawMessage) ([]byte, error) {
+	return codec.EncodeCorrelated(message, "", data)
+}
+
+func (protobufCodec) EncodeCorrelated(message string,
+	correlationID string,
+	data json.RawMessage) ([]byte, error) {
+	return proto.Marshal(&Envelope{
+		Message:       message,
+		CorrelationId: correlationID,
+		Payload: &Envelope_Broadcast{
+			Broadcast: &Broadcast{
+				Data: data,
+			},
+		},
+	})
+}
+
+func (protobufCodec) EncodeRequest(message string, data json.RawMessage) ([]byte, error) {
+	return proto.Marshal(&Envelope{
+		Message: message,
+		Payload: &Envelope_SendMessage{
+			SendMessage: &SendMessage{
+				Data: data,
+			},
+		},
+	})
+}
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestProtobufCodec(t *testing.T) {
+	codec := CodecFor(EncodingProtobuf)
+	data := json.RawMessage(`{"text":"hello"}`)
+	// Clients send SendMessage envelopes
+	request, requestErr := EncodeRequest(codec, "sendmessage", data)
+	if requestErr != nil {
+		t.Fatalf("EncodeRequest failed: %s", requestErr)
+	}
+	decoded, decodeErr := codec.Decode(request)
+	if decodeErr != nil {
+		t.Fatalf("Decode failed: %s", decodeErr)
+	}
+	if string(decoded) != string(data) {
+		t.Errorf("Decoded request data = %s, want %s", decoded, data)
+	}
+	// and receive Broadcast envelopes with the correlation ID
+	frame, frameErr := Encode(codec, "broadcast", "request-1", data)
+	if frameErr != nil {
+		t.Fatalf("Encode failed: %s", frameErr)
+	}
+	envelope := &Envelope{}
+	unmarshalErr := proto.Unmarshal(frame, envelope)
+	if unmarshalErr != nil {
+		t.Fatalf("Failed to unmarshal envelope: %s", unmarshalErr)
+	}
+	if envelope.GetMessage() != "broadcast" || envelope.GetCorrelationId() != "request-1" {
+		t.Errorf("Envelope = %q/%q, want broadcast/request-1",
+			envelope.GetMessage(),
+			envelope.GetCorrelationId())
+	}
+	if string(envelope.GetBroadcast().GetData()) != string(data) {
+		t.Errorf("Broadcast data = %s, want %s", envelope.GetBroadcast().GetData(), data)
+	}
+	decoded, decodeErr = codec.Decode(frame)
+	if decodeErr != nil || string(decoded) != string(data) {
+		t.Errorf("Decoded broadcast = %s (%v), want %s", decoded, decodeErr, data)
+	}
+	// Envelopes without a payload aren't data
+	empty, _ := proto.Marshal(&Envelope{Message: "sendmessage"})
+	if _, decodeErr := codec.Decode(empty); decodeErr == nil {
+		t.Errorf("Decode accepted an envelope without a payload")
+	}
+	if _, decodeErr := codec.Decode([]byte{0xff, 0xff}); decodeErr == nil {
+		t.Errorf("Decode accepted a malformed envelope")
+	}
+}
+
+// upperCodec is a test codec that registers its own encoding
+type upperCodec struct{}
+
+func (upperCodec) Encoding() Encoding {
+	return Encoding("upper")
+}
+
+func (upperCodec) Decode(frame []byte) (json.RawMessage, error) {
+	return json.RawMessage(frame), nil
+}
+
+func (upperCodec) Encode(message string, data json.RawMessage) ([]byte, error) {
+	return []byte(message + ":" + string(data)), nil
+}
+
+func TestRegisterCodec(t *testing.T) {
+	if CodecFor(Encoding("upper")).Encoding() != EncodingJSON {
+		t.Fatalf("CodecFor an unregistered encoding didn't fall back to JSON")
+	}
+	if ParseEncoding("upper") != EncodingJSON {
+		t.Fatalf("ParseEncoding accepted an unregistered encoding")
+	}
+	RegisterCodec(upperCodec{})
+	t.Cleanup(func() {
+		codecsMutex.Lock()
+		defer codecsMutex.Unlock()
+		delete(codecs, Encoding("upper"))
+	})
+	if ParseEncoding(" UPPER ") != Encoding("upper") {
+		t.Errorf("ParseEncoding didn't accept the registered encoding")
+	}
+	codec := CodecFor(Encoding("upper"))
+	// Codecs without the optional interfaces encode requests and correlated
+	// frames with Encode
+	request, _ := EncodeRequest(codec, "sendmessage", json.RawMessage(`1`))
+	frame, _ := Encode(codec, "broadcast", "request-1", json.RawMessage(`2`))
+	if string(request) != "sendmessage:1" || string(frame) != "broadcast:2" {
+		t.Errorf("Frames = %s, %s, want sendmessage:1, broadcast:2", request, frame)
+	}
+	if negotiation := Negotiate("upper,gzip"); negotiation.Encoding != Encoding("upper") {
+		t.Errorf("Negotiate didn't select the registered encoding: %+v", negotiation)
+	}
+}
+
+func TestJSONCodec(t *testing.T) {
+	codec := CodecFor(EncodingJSON)
+	decoded, decodeErr := codec.Decode([]byte(`{"action":"sendmessage","data":{"text":"hello"}}`))
+	if decodeErr != nil || string(decoded) != `{"text":"hello"}` {
+		t.Errorf("Decoded = %s (%v), want the data property", decoded, decodeErr)
+	}
+	if _, decodeErr := codec.Decode([]byte(`{"action":"sendmessage"}`)); decodeErr == nil {
+		t.Errorf("Decode accepted a request without data")
+	}
+	// JSON frames are the data itself, without the correlation ID
+	frame, _ := Encode(codec, "broadcast", "request-1", json.RawMessage(`{"text":"hello"}`))
+	if string(frame) != `{"text":"hello"}` {
+		t.Errorf("Frame = %s, want the data", frame)
+	}
+}
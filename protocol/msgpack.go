@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// messagePackFrame is the MessagePack map exchanged with connections that
+// negotiated EncodingMessagePack
+type messagePackFrame struct {
+	Message       string      `msgpack:"message"`
+	CorrelationID string      `msgpack:"correlationId,omitempty"`
+	Data          interface{} `msgpack:"data"`
+}
+
+// messagePackCodec exchanges messagePackFrame maps
+type messagePackCodec struct{}
+
+func (messagePackCodec) Encoding() Encoding {
+	return EncodingMessagePack
+}
+
+func (messagePackCodec) Decode(frame []byte) (json.RawMessage, error) {
+	var mpFrame messagePackFrame
+	unmarshalErr := msgpack.Unmarshal(frame, &mpFrame)
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	if mpFrame.Data == nil {
+		return nil, fmt.Errorf("request does not contain a data property")
+	}
+	return json.Marshal(mpFrame.Data)
+}
+
+func (codec messagePackCodec) Encode(message string, data json.RawMessage) ([]byte, error) {
+	return codec.EncodeCorrelated(message, "", data)
+}
+
+func (messagePackCodec) EncodeCorrelated(message string,
+	correlationID string,
+	data json.RawMessage) ([]byte, error) {
+	mpFrame := messagePackFrame{
+		Message:       message,
+		CorrelationID: correlationID,
+	}
+	// Payloads that aren't JSON documents (eg, opaque protobuf data) are
+	// delivered as MessagePack binary values
+	if unmarshalErr := json.Unmarshal(data, &mpFrame.Data); unmarshalErr != nil {
+		mpFrame.Data = []byte(data)
+	}
+	return msgpack.Marshal(&mpFrame)
+}
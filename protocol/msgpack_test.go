@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+func TestMessagePackCodec(t *testing.T) {
+	codec := CodecFor(EncodingMessagePack)
+	tests := []struct {
+		name string
+		data json.RawMessage
+	}{
+		{"object", json.RawMessage(`{"count":2,"text":"hello"}`)},
+		{"array", json.RawMessage(`[1,"two",null]`)},
+		{"string", json.RawMessage(`"hello"`)},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			frame, frameErr := Encode(codec, "broadcast", "request-1", eachTest.data)
+			if frameErr != nil {
+				t.Fatalf("Encode failed: %s", frameErr)
+			}
+			var mpFrame messagePackFrame
+			unmarshalErr := msgpack.Unmarshal(frame, &mpFrame)
+			if unmarshalErr != nil {
+				t.Fatalf("Failed to unmarshal frame: %s", unmarshalErr)
+			}
+			if mpFrame.Message != "broadcast" || mpFrame.CorrelationID != "request-1" {
+				t.Errorf("Frame = %q/%q, want broadcast/request-1", mpFrame.Message, mpFrame.CorrelationID)
+			}
+			decoded, decodeErr := codec.Decode(frame)
+			if decodeErr != nil {
+				t.Fatalf("Decode failed: %s", decodeErr)
+			}
+			if string(decoded) != string(eachTest.data) {
+				t.Errorf("Decoded data = %s, want %s", decoded, eachTest.data)
+			}
+		})
+	}
+	// Data that isn't JSON is delivered as a binary value
+	frame, frameErr := codec.Encode("broadcast", json.RawMessage("\x01\x02"))
+	if frameErr != nil {
+		t.Fatalf("Encode failed: %s", frameErr)
+	}
+	var mpFrame messagePackFrame
+	if msgpack.Unmarshal(frame, &mpFrame) != nil {
+		t.Fatalf("Failed to unmarshal frame")
+	}
+	if binary, isBinary := mpFrame.Data.([]byte); !isBinary || string(binary) != "\x01\x02" {
+		t.Errorf("Non-JSON data = %#v, want a binary value", mpFrame.Data)
+	}
+	// Frames without data aren't data
+	empty, _ := msgpack.Marshal(&messagePackFrame{Message: "sendmessage"})
+	if _, decodeErr := codec.Decode(empty); decodeErr == nil {
+		t.Errorf("Decode accepted a frame without data")
+	}
+}
@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// Compression is the outbound frame compression negotiated by a connection
+type Compression string
+
+const (
+	// CompressionNone delivers frames uncompressed
+	CompressionNone Compression = "identity"
+	// CompressionGzip delivers gzip compressed binary frames
+	CompressionGzip Compression = "gzip"
+	// CompressionDeflate delivers raw DEFLATE compressed binary frames
+	CompressionDeflate Compression = "deflate"
+)
+
+// ParseCompression returns the Compression for the given value, falling
+// back to CompressionNone for empty or unknown values
+func ParseCompression(value string) Compression {
+	compression, _ := lookupCompression(value)
+	return compression
+}
+
+func lookupCompression(value string) (Compression, bool) {
+	switch Compression(strings.ToLower(strings.TrimSpace(value))) {
+	case CompressionNone:
+		return CompressionNone, true
+	case CompressionGzip:
+		return CompressionGzip, true
+	case CompressionDeflate:
+		return CompressionDeflate, true
+	default:
+		return CompressionNone, false
+	}
+}
+
+// Chunked is the `accept-encodings` value with which a connection accepts
+// frames that exceed the gateway frame limit as a series of chunk frames
+const Chunked = "chunked"
+
+// Negotiation is the per-connection result of the $connect content
+// negotiation. It's comparable so that broadcasts can cache one frame
+// per distinct Negotiation.
+type Negotiation struct {
+	Encoding    Encoding
+	Compression Compression
+	// Chunked is true if the connection reassembles chunk frames
+	Chunked bool
+	// Subprotocol is the negotiated WebSocket subprotocol, if any. Frames
+	// for subprotocol connections are encoded for each recipient and are
+	// never batched.
+	Subprotocol string
+}
+
+// DefaultNegotiation is used for connections that didn't negotiate
+var DefaultNegotiation = Negotiation{
+	Encoding:    EncodingJSON,
+	Compression: CompressionNone,
+}
+
+// Negotiate returns the Negotiation for the comma separated `accept-encodings`
+// handshake value (eg, "cbor,msgpack,gzip"). Values are listed in client
+// preference order and the first supported encoding and the first supported
+// compression are selected, and the Chunked value may appear anywhere.
+// Unknown values are ignored.
+func Negotiate(acceptEncodings string) Negotiation {
+	negotiation := DefaultNegotiation
+	encodingSelected := false
+	compressionSelected := false
+	for _, eachValue := range strings.Split(acceptEncodings, ",") {
+		// Tolerate HTTP style quality values (eg, "gzip;q=0.5")
+		eachValue = strings.SplitN(eachValue, ";", 2)[0]
+		if strings.ToLower(strings.TrimSpace(eachValue)) == Chunked {
+			negotiation.Chunked = true
+		} else if encoding, encodingOk := lookupEncoding(eachValue); encodingOk && !encodingSelected {
+			negotiation.Encoding = encoding
+			encodingSelected = true
+		} else if compression, compressionOk := lookupCompression(eachValue); compressionOk && !compressionSelected {
+			negotiation.Compression = compression
+			compressionSelected = true
+		}
+	}
+	return negotiation
+}
+
+// EncodeFrame returns the outbound frame for the given message name and JSON
+// data, encoded and compressed as negotiated
+func (negotiation Negotiation) EncodeFrame(message string, data json.RawMessage) ([]byte, error) {
+	frame, frameErr := CodecFor(negotiation.Encoding).Encode(message, data)
+	if frameErr != nil {
+		return nil, frameErr
+	}
+	return Compress(negotiation.Compression, frame)
+}
+
+// Compress returns the frame compressed with the given Compression
+func Compress(compression Compression, frame []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	var writer io.WriteCloser
+	switch compression {
+	case CompressionGzip:
+		writer = gzip.NewWriter(&compressed)
+	case CompressionDeflate:
+		flateWriter, flateWriterErr := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if flateWriterErr != nil {
+			return nil, flateWriterErr
+		}
+		writer = flateWriter
+	default:
+		return frame, nil
+	}
+	_, writeErr := writer.Write(frame)
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	closeErr := writer.Close()
+	if closeErr != nil {
+		return nil, closeErr
+	}
+	return compressed.Bytes(), nil
+}
+
+// Decompress returns the frame decompressed with the given Compression
+func Decompress(compression Compression, frame []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	switch compression {
+	case CompressionGzip:
+		gzipReader, gzipReaderErr := gzip.NewReader(bytes.NewReader(frame))
+		if gzipReaderErr != nil {
+			return nil, gzipReaderErr
+		}
+		reader = gzipReader
+	case CompressionDeflate:
+		reader = flate.NewReader(bytes.NewReader(frame))
+	default:
+		return frame, nil
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
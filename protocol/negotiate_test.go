@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		acceptEncodings string
+		negotiation     Negotiation
+	}{
+		{"", DefaultNegotiation},
+		{"json", DefaultNegotiation},
+		{"cbor,msgpack,gzip", Negotiation{Encoding: EncodingCBOR, Compression: CompressionGzip}},
+		{"gzip, MessagePack", Negotiation{Encoding: EncodingMessagePack, Compression: CompressionGzip}},
+		{"avro,protobuf", Negotiation{Encoding: EncodingProtobuf, Compression: CompressionNone}},
+		{"gzip;q=0.5,deflate", Negotiation{Encoding: EncodingJSON, Compression: CompressionGzip}},
+		{"brotli,deflate", Negotiation{Encoding: EncodingJSON, Compression: CompressionDeflate}},
+		{"json,chunked", Negotiation{Encoding: EncodingJSON, Compression: CompressionNone, Chunked: true}},
+		{"chunked,cbor", Negotiation{Encoding: EncodingCBOR, Compression: CompressionNone, Chunked: true}},
+	}
+	for _, eachTest := range tests {
+		if negotiation := Negotiate(eachTest.acceptEncodings); negotiation != eachTest.negotiation {
+			t.Errorf("Negotiate(%q) = %+v, want %+v", eachTest.acceptEncodings, negotiation, eachTest.negotiation)
+		}
+	}
+}
+
+func TestParseEncodingAndCompression(t *testing.T) {
+	if encoding := ParseEncoding("MessagePack"); encoding != EncodingMessagePack {
+		t.Errorf("ParseEncoding(MessagePack) = %s, want %s", encoding, EncodingMessagePack)
+	}
+	if encoding := ParseEncoding("avro"); encoding != EncodingJSON {
+		t.Errorf("ParseEncoding(avro) = %s, want %s", encoding, EncodingJSON)
+	}
+	if compression := ParseCompression(" GZIP "); compression != CompressionGzip {
+		t.Errorf("ParseCompression(GZIP) = %s, want %s", compression, CompressionGzip)
+	}
+	if compression := ParseCompression("brotli"); compression != CompressionNone {
+		t.Errorf("ParseCompression(brotli) = %s, want %s", compression, CompressionNone)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	frame := bytes.Repeat([]byte(`{"text":"hello"}`), 100)
+	for _, eachCompression := range []Compression{CompressionNone, CompressionGzip, CompressionDeflate} {
+		t.Run(string(eachCompression), func(t *testing.T) {
+			compressed, compressErr := Compress(eachCompression, frame)
+			if compressErr != nil {
+				t.Fatalf("Compress failed: %s", compressErr)
+			}
+			if eachCompression == CompressionNone && !bytes.Equal(compressed, frame) {
+				t.Errorf("Uncompressed frame changed")
+			}
+			if eachCompression != CompressionNone && len(compressed) >= len(frame) {
+				t.Errorf("Compressed frame is %d bytes, want fewer than %d", len(compressed), len(frame))
+			}
+			decompressed, decompressErr := Decompress(eachCompression, compressed)
+			if decompressErr != nil {
+				t.Fatalf("Decompress failed: %s", decompressErr)
+			}
+			if !bytes.Equal(decompressed, frame) {
+				t.Errorf("Decompressed frame doesn't match the original")
+			}
+		})
+	}
+	if _, decompressErr := Decompress(CompressionGzip, frame); decompressErr == nil {
+		t.Errorf("Decompress accepted a frame that isn't gzip compressed")
+	}
+}
+
+func TestEncodeFrame(t *testing.T) {
+	negotiation := Negotiation{Encoding: EncodingMessagePack, Compression: CompressionGzip}
+	data := json.RawMessage(`{"text":"hello"}`)
+	frame, frameErr := negotiation.EncodeFrame("broadcast", data)
+	if frameErr != nil {
+		t.Fatalf("EncodeFrame failed: %s", frameErr)
+	}
+	decompressed, decompressErr := Decompress(negotiation.Compression, frame)
+	if decompressErr != nil {
+		t.Fatalf("Decompress failed: %s", decompressErr)
+	}
+	decoded, decodeErr := CodecFor(negotiation.Encoding).Decode(decompressed)
+	if decodeErr != nil || string(decoded) != string(data) {
+		t.Errorf("Decoded frame = %s (%v), want %s", decoded, decodeErr, data)
+	}
+}
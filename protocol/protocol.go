@@ -0,0 +1,46 @@
+// Package protocol defines the wire formats for clients that negotiate
+// binary frames at $connect time. The protobuf Go types are generated from
+// protocol.proto via `go generate`.
+package protocol
+
+//go:generate protoc --go_out=paths=source_relative:. protocol.proto
+
+import "strings"
+
+// Version is the wire protocol version published in the client
+// configuration bundle. It changes when frame semantics change incompatibly.
+const Version = 1
+
+// Encoding is the wire format negotiated by a connection
+type Encoding string
+
+const (
+	// EncodingJSON is the default text frame encoding
+	EncodingJSON Encoding = "json"
+	// EncodingProtobuf is the binary Envelope frame encoding
+	EncodingProtobuf Encoding = "protobuf"
+	// EncodingMessagePack is the binary MessagePack frame encoding
+	EncodingMessagePack Encoding = "msgpack"
+	// EncodingCBOR is the binary CBOR (RFC 7049) frame encoding
+	EncodingCBOR Encoding = "cbor"
+)
+
+// ParseEncoding returns the Encoding for the given handshake value,
+// falling back to EncodingJSON for empty or unknown values
+func ParseEncoding(value string) Encoding {
+	encoding, _ := lookupEncoding(value)
+	return encoding
+}
+
+// lookupEncoding returns the Encoding for the given value and whether a
+// codec is registered for it
+func lookupEncoding(value string) (Encoding, bool) {
+	encoding := Encoding(strings.ToLower(strings.TrimSpace(value)))
+	if encoding == "messagepack" {
+		encoding = EncodingMessagePack
+	}
+	if _, exists := lookupCodec(encoding); exists {
+		return encoding, true
+	}
+	return EncodingJSON, false
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ddbAttributeRateWindow = "rateWindow"
+	ddbAttributeRateCount  = "rateCount"
+	rateLimitWindow        = time.Minute
+)
+
+// conditionalCheckFailed returns true if the error is a failed DynamoDB
+// condition expression
+func conditionalCheckFailed(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// claimConnectionSlots adds count to the connection item's counter and
+// returns false, without changing it, if the counter would exceed the limit.
+// Counting in the connection item keeps per-connection limits exact under
+// concurrent requests, and the counters are deleted with the connection.
+func claimConnectionSlots(ctx context.Context,
+	connectionID string,
+	counter string,
+	count int,
+	limit int,
+	ddbService dynamodbiface.DynamoDBAPI) (bool, error) {
+	if count <= 0 {
+		return true, nil
+	}
+	_, claimErr := ddbService.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv(envKeyTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			ddbAttributeConnectionID: &dynamodb.AttributeValue{
+				S: aws.String(connectionID),
+			},
+		},
+		UpdateExpression:    aws.String("ADD #counter :count"),
+		ConditionExpression: aws.String("attribute_exists(#connectionID) AND (attribute_not_exists(#counter) OR #counter <= :headroom)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#connectionID": aws.String(ddbAttributeConnectionID),
+			"#counter":      aws.String(counter),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":count":    &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(count))},
+			":headroom": &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(limit - count))},
+		},
+	})
+	if conditionalCheckFailed(claimErr) {
+		return false, nil
+	}
+	return claimErr == nil, claimErr
+}
+
+// releaseConnectionSlots subtracts count from the connection item's counter.
+// It's best-effort, and a no-op once the connection is deleted.
+func releaseConnectionSlots(ctx context.Context,
+	connectionID string,
+	counter string,
+	count int,
+	ddbService dynamodbiface.DynamoDBAPI,
+	logger *logrus.Logger) {
+	if count <= 0 {
+		return
+	}
+	_, releaseErr := ddbService.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv(envKeyTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			ddbAttributeConnectionID: &dynamodb.AttributeValue{
+				S: aws.String(connectionID),
+			},
+		},
+		UpdateExpression:    aws.String("ADD #counter :count"),
+		ConditionExpression: aws.String("attribute_exists(#connectionID) AND #counter >= :release"),
+		ExpressionAttributeNames: map[string]*string{
+			"#connectionID": aws.String(ddbAttributeConnectionID),
+			"#counter":      aws.String(counter),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":count":   &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(-count))},
+			":release": &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(count))},
+		},
+	})
+	if releaseErr != nil && !conditionalCheckFailed(releaseErr) {
+		logger.WithFields(logrus.Fields{
+			"Error":   releaseErr,
+			"Counter": counter,
+		}).Warn("Failed to release connection slots")
+	}
+}
+
+// allowSend counts a message against the connection's fixed one minute
+// window in the connection table and returns false once the count reaches
+// the limit
+func allowSend(ctx context.Context,
+	connectionID string,
+	limit int64,
+	ddbService dynamodbiface.DynamoDBAPI) (bool, error) {
+	window := strconv.FormatInt(time.Now().Unix()/int64(rateLimitWindow/time.Second), 10)
+	key := map[string]*dynamodb.AttributeValue{
+		ddbAttributeConnectionID: &dynamodb.AttributeValue{
+			S: aws.String(connectionID),
+		},
+	}
+	// Count the message in the current window...
+	_, countErr := ddbService.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(os.Getenv(envKeyTableName)),
+		Key:                 key,
+		UpdateExpression:    aws.String("ADD " + ddbAttributeRateCount + " :one"),
+		ConditionExpression: aws.String(ddbAttributeRateWindow + " = :window AND " + ddbAttributeRateCount + " < :limit"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":    &dynamodb.AttributeValue{N: aws.String("1")},
+			":window": &dynamodb.AttributeValue{N: aws.String(window)},
+			":limit":  &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(limit, 10))},
+		},
+	})
+	if countErr == nil {
+		return true, nil
+	}
+	if !conditionalCheckFailed(countErr) {
+		return false, countErr
+	}
+	// ...or start a new window if the current one has elapsed
+	_, resetErr := ddbService.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(os.Getenv(envKeyTableName)),
+		Key:              key,
+		UpdateExpression: aws.String("SET " + ddbAttributeRateWindow + " = :window, " + ddbAttributeRateCount + " = :one"),
+		ConditionExpression: aws.String("attribute_exists(" + ddbAttributeConnectionID + ") AND " +
+			"(attribute_not_exists(" + ddbAttributeRateWindow + ") OR " + ddbAttributeRateWindow + " < :window)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":    &dynamodb.AttributeValue{N: aws.String("1")},
+			":window": &dynamodb.AttributeValue{N: aws.String(window)},
+		},
+	})
+	if resetErr == nil {
+		return true, nil
+	}
+	if conditionalCheckFailed(resetErr) {
+		return false, nil
+	}
+	return false, resetErr
+}
+
+// rateLimited returns true if the connection exceeded the sendRateLimit
+// tunable. Rate limiting fails open if the count can't be updated.
+func rateLimited(ctx context.Context,
+	sess *session.Session,
+	connectionID string,
+	ddbService dynamodbiface.DynamoDBAPI,
+	logger *logrus.Logger) bool {
+	limit := tunables.intValue(ctx, sess, tunableSendRateLimit, 0, logger)
+	if limit <= 0 {
+		return false
+	}
+	allowed, allowedErr := allowSend(ctx, connectionID, limit, ddbService)
+	if allowedErr != nil {
+		logger.WithField("Error", allowedErr).Warn("Failed to update rate limit")
+		return false
+	}
+	return !allowed
+}
+
+// bannedSourceIP returns true if the address is in the bannedSourceIPs
+// tunable
+func bannedSourceIP(ctx context.Context,
+	sess *session.Session,
+	sourceIP string,
+	logger *logrus.Logger) bool {
+	for _, eachBanned := range tunables.listValue(ctx, sess, tunableBannedSourceIPs, logger) {
+		if eachBanned == sourceIP {
+			return true
+		}
+	}
+	return false
+}
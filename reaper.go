@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyReaperSchedule is the provision-time schedule expression for the
+	// stale connection reaper
+	envKeyReaperSchedule   = "REAPER_SCHEDULE"
+	defaultReaperSchedule  = "rate(1 hour)"
+	reaperScheduleRuleName = "ReapStaleConnections"
+	// reaperTimeout is the reaper lambda timeout, in seconds
+	reaperTimeout = 300
+	// reaperDeadlineMargin is the time left for the final deletes and metrics
+	// once the reaper stops scanning. The next run starts over.
+	reaperDeadlineMargin = 10 * time.Second
+	// Metric names
+	metricStaleConnectionsReaped = "StaleConnectionsReaped"
+	metricActiveConnections      = "ActiveConnections"
+)
+
+// reapResult is the ReapConnections response
+type reapResult struct {
+	Scanned int  `json:"scanned"`
+	Reaped  int  `json:"reaped"`
+	Failed  int  `json:"failed"`
+	Partial bool `json:"partial"`
+}
+
+// reapConnections is the scheduled stale connection reaper. $disconnect is
+// best-effort, so it walks the connection table and deletes every connection
+// that API Gateway reports as gone.
+func reapConnections(ctx context.Context, event awsEvents.CloudWatchEvent) (_ *reapResult, err error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	dynamoClient := newConnectionsClient(sess)
+	metrics := newMetricsEmitter()
+	audit := newAuditLog("")
+	result := &reapResult{}
+	ctx, finishInvocation := startInvocation(ctx, "ReapConnections")
+	defer func() {
+		finishInvocation(err)
+	}()
+
+	// Operation
+	deadline, hasDeadline := ctx.Deadline()
+	scanErr := dynamoClient.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName: aws.String(os.Getenv(envKeyTableName)),
+		// Connections established in other regions are checked with their
+		// region's management API
+		ProjectionExpression: aws.String("#connectionID, #region, #endpoint"),
+		ExpressionAttributeNames: map[string]*string{
+			"#connectionID": aws.String(ddbAttributeConnectionID),
+			"#region":       aws.String(ddbAttributeRegion),
+			"#endpoint":     aws.String(ddbAttributeEndpoint),
+		},
+	}, func(output *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, eachItem := range output.Items {
+			if hasDeadline && time.Until(deadline) < reaperDeadlineMargin {
+				result.Partial = true
+				return false
+			}
+			if eachItem[ddbAttributeConnectionID] == nil {
+				continue
+			}
+			connectionID := aws.StringValue(eachItem[ddbAttributeConnectionID].S)
+			result.Scanned++
+			liveness, livenessErr := getConnectionLiveness(ctx,
+				itemManagementClient(sess, eachItem),
+				connectionID)
+			if livenessErr != nil {
+				logger.WithFields(logrus.Fields{
+					"Error":        livenessErr,
+					"ConnectionID": connectionID,
+				}).Warn("Failed to get connection")
+				continue
+			}
+			if liveness.Live {
+				continue
+			}
+			if deleteStaleConnection(ctx, connectionID, dynamoClient, audit, logger) != nil {
+				result.Failed++
+				continue
+			}
+			releaseConnection(ctx, connectionID, newDynamoClient(sess), logger)
+			result.Reaped++
+		}
+		return true
+	})
+	metrics.add(metricStaleConnectionsReaped, float64(result.Reaped))
+	metrics.add(metricGoneCleanupFailures, float64(result.Failed))
+	// Only a complete scan counts every live connection
+	if scanErr == nil && !result.Partial {
+		metrics.add(metricActiveConnections,
+			float64(result.Scanned-result.Reaped-result.Failed))
+	}
+	metricsErr := metrics.flush()
+	if metricsErr != nil {
+		logger.WithField("Error", metricsErr).Warn("Failed to publish metrics")
+	}
+	logger.WithField("Result", result).Info("Reaped stale connections")
+	return result, scanErr
+}
+
+// deleteStaleConnection deletes the gone connection and audits the result
+func deleteStaleConnection(ctx context.Context,
+	connectionID string,
+	ddbService dynamodbiface.DynamoDBAPI,
+	audit *auditLog,
+	logger *logrus.Logger) error {
+	event := &auditEvent{
+		Action:       auditActionReap,
+		ConnectionID: connectionID,
+		Success:      true,
+	}
+	delItemErr := deleteConnection(ctx, connectionID, ddbService)
+	if delItemErr != nil {
+		event.Success = false
+		event.Error = delItemErr.Error()
+		logger.WithFields(logrus.Fields{
+			"Error":        delItemErr,
+			"ConnectionID": connectionID,
+		}).Warn("Failed to reap stale connection")
+	}
+	auditErr := audit.record(event)
+	if auditErr != nil {
+		logger.WithField("Error", auditErr).Warn("Failed to record audit event")
+	}
+	return delItemErr
+}
+
+// annotateReaper schedules the reaper and grants it GetConnection on the
+// stage's management endpoint
+func annotateReaper(lambdaFn *sparta.LambdaAWSInfo, apiGateway *sparta.APIV2) {
+	schedule := os.Getenv(envKeyReaperSchedule)
+	if schedule == "" {
+		schedule = defaultReaperSchedule
+	}
+	annotateManagementEndpoint(lambdaFn, apiGateway)
+	lambdaFn.Permissions = append(lambdaFn.Permissions, sparta.CloudWatchEventsPermission{
+		Rules: map[string]sparta.CloudWatchEventsRule{
+			reaperScheduleRuleName: {
+				Description:        "Delete connections that API Gateway reports as gone",
+				ScheduleExpression: schedule,
+			},
+		},
+	})
+	lambdaFn.Options.Timeout = reaperTimeout
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	"github.com/mweagle/SpartaWebSocket/connections"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	envKeyReceiptsTableName     = "MESSAGE_RECEIPTS_TABLENAME"
+	messageReceiptsResourceName = "MessageReceipts"
+	// Receipt table items are keyed by message ID and receiver. Each
+	// message's header item, with the receiver receiptHeader, holds the
+	// sender and the aggregate counts; the other items are receipts keyed by
+	// the acknowledging connection ID.
+	ddbAttributeMessageID        = "messageID"
+	ddbAttributeReceiver         = "receiver"
+	ddbAttributeSenderConnection = "senderConnectionID"
+	ddbAttributeRecipientUser    = "recipientUserID"
+	ddbAttributeRecipients       = "recipients"
+	ddbAttributeDelivered        = "delivered"
+	ddbAttributeRead             = "read"
+	ddbAttributeReceiptState     = "state"
+	ddbAttributeAckedAt          = "ackedAt"
+	receiptHeader                = "$message"
+	// receiptRetention is how long messages can be acknowledged
+	receiptRetention   = 24 * time.Hour
+	maxMessageIDLength = 128
+	// Receipt states. A read receipt implies delivery.
+	receiptStateDelivered = "delivered"
+	receiptStateRead      = "read"
+	receiptMessage        = "receipt"
+)
+
+// errDuplicateMessage is returned by trackMessage if the message ID is
+// already tracked
+var errDuplicateMessage = errors.New("duplicate message ID")
+
+// ackRequest is the data of an ack frame. State defaults to delivered.
+type ackRequest struct {
+	MessageID string `json:"messageId"`
+	State     string `json:"state,omitempty"`
+}
+
+// receiptFrame is the data of the receipt frame posted to a message's sender
+// when a recipient acknowledges it. The counts are the message's aggregate
+// read state; From is the acknowledging user ID, if it has one.
+type receiptFrame struct {
+	MessageID  string `json:"messageId"`
+	From       string `json:"from,omitempty"`
+	State      string `json:"state"`
+	Recipients int64  `json:"recipients"`
+	Delivered  int64  `json:"delivered"`
+	Read       int64  `json:"read"`
+}
+
+// receiptAudience is who a tracked message is delivered to: the members of
+// a room, or the connections of a user. Only the audience can acknowledge
+// the message.
+type receiptAudience struct {
+	room   string
+	userID string
+}
+
+// receiptsEnabled returns true if messages are tracked for receipts
+func receiptsEnabled(ctx context.Context, sess *session.Session, logger *logrus.Logger) bool {
+	return os.Getenv(envKeyReceiptsTableName) != "" &&
+		features.enabled(ctx, sess, featureReceipts, logger)
+}
+
+// receiptKey returns the receipt table key
+func receiptKey(messageID string, receiver string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		ddbAttributeMessageID: &dynamodb.AttributeValue{
+			S: aws.String(messageID),
+		},
+		ddbAttributeReceiver: &dynamodb.AttributeValue{
+			S: aws.String(receiver),
+		},
+	}
+}
+
+// trackMessage stores the header item for a message that its audience can
+// acknowledge and returns its ID: the client's requested ID, if any, or the
+// request ID. The empty ID is returned while receipts are disabled.
+func trackMessage(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	requestedID string,
+	audience receiptAudience,
+	logger *logrus.Logger) (string, error) {
+	if !receiptsEnabled(ctx, sess, logger) {
+		return "", nil
+	}
+	messageID := requestedID
+	if messageID == "" {
+		messageID = request.RequestContext.RequestID
+	}
+	if len(messageID) > maxMessageIDLength {
+		return "", fmt.Errorf("messageId exceeds %d characters", maxMessageIDLength)
+	}
+	headerItem := receiptKey(messageID, receiptHeader)
+	headerItem[ddbAttributeSenderConnection] = &dynamodb.AttributeValue{
+		S: aws.String(request.RequestContext.ConnectionID),
+	}
+	if audience.room != "" {
+		headerItem[ddbAttributeRoom] = &dynamodb.AttributeValue{
+			S: aws.String(audience.room),
+		}
+	}
+	if audience.userID != "" {
+		headerItem[ddbAttributeRecipientUser] = &dynamodb.AttributeValue{
+			S: aws.String(audience.userID),
+		}
+	}
+	for _, eachAttribute := range []string{ddbAttributeRecipients, ddbAttributeDelivered, ddbAttributeRead} {
+		headerItem[eachAttribute] = &dynamodb.AttributeValue{N: aws.String("0")}
+	}
+	headerItem[connections.ExpiresAtAttribute] = receiptExpiresAt()
+	_, putItemErr := newDynamoClient(sess).PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(os.Getenv(envKeyReceiptsTableName)),
+		Item:                headerItem,
+		ConditionExpression: aws.String("attribute_not_exists(" + ddbAttributeMessageID + ")"),
+	})
+	if conditionalCheckFailed(putItemErr) {
+		return "", errDuplicateMessage
+	}
+	if putItemErr != nil {
+		return "", putItemErr
+	}
+	return messageID, nil
+}
+
+// countRecipients records the number of connections the tracked message was
+// delivered to. It's a no-op for untracked messages.
+func countRecipients(ctx context.Context,
+	sess *session.Session,
+	messageID string,
+	recipients int,
+	logger *logrus.Logger) {
+	if messageID == "" {
+		return
+	}
+	_, updateErr := newDynamoClient(sess).UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(os.Getenv(envKeyReceiptsTableName)),
+		Key:              receiptKey(messageID, receiptHeader),
+		UpdateExpression: aws.String("SET #recipients = :recipients"),
+		ExpressionAttributeNames: map[string]*string{
+			"#recipients": aws.String(ddbAttributeRecipients),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":recipients": &dynamodb.AttributeValue{
+				N: aws.String(strconv.Itoa(recipients)),
+			},
+		},
+	})
+	if updateErr != nil {
+		logger.WithFields(logrus.Fields{
+			"Error":     updateErr,
+			"MessageID": messageID,
+		}).Warn("Failed to count message recipients")
+	}
+}
+
+// receiptExpiresAt returns the TTL attribute value for receipt items
+func receiptExpiresAt() *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(time.Now().Add(receiptRetention).Unix(), 10)),
+	}
+}
+
+// sendAck records the sender's receipt for a message and posts the
+// message's aggregate read state to the message's sender. Only the
+// message's audience can acknowledge it, and never the connection that sent
+// it. Repeated acks are accepted but not counted again.
+func sendAck(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	endpointURL := managementEndpoint(request.RequestContext)
+	dynamoClient := newConnectionsClient(sess)
+	apigwMgmtClient := newManagementClient(sess, endpointURL)
+	connectionID := request.RequestContext.ConnectionID
+
+	ackerItem, ackerItemErr := senderConnectionItem(ctx, request, dynamoClient)
+	if ackerItemErr != nil {
+		logger.WithField("Error", ackerItemErr).Warn("Failed to get sender connection")
+	}
+	locale := itemLocale(ackerItem)
+	rejectAck := func(code errorCode, key catalog.Key, args ...interface{}) (*wsResponse, error) {
+		return wsError(ctx,
+			request,
+			ackerItem,
+			apigwMgmtClient,
+			code,
+			catalog.Localize(locale, key, args...),
+			logger), nil
+	}
+	if !receiptsEnabled(ctx, sess, logger) {
+		return rejectAck(errorCodeFeatureDisabled, catalog.ReceiptsDisabled)
+	}
+	var ack ackRequest
+	payload, payloadErr := requestPayload(request, ackerItem)
+	if payloadErr == nil {
+		payloadErr = json.Unmarshal(payload, &ack)
+	}
+	if payloadErr == nil && (ack.MessageID == "" || len(ack.MessageID) > maxMessageIDLength) {
+		payloadErr = fmt.Errorf("a messageId of at most %d characters is required", maxMessageIDLength)
+	}
+	if ack.State == "" {
+		ack.State = receiptStateDelivered
+	}
+	if payloadErr == nil && ack.State != receiptStateDelivered && ack.State != receiptStateRead {
+		payloadErr = fmt.Errorf("unsupported receipt state: %s", ack.State)
+	}
+	if payloadErr != nil {
+		return rejectAck(errorCodeMalformedRequest, catalog.UnmarshalFailed, payloadErr.Error())
+	}
+	receiptsClient := newDynamoClient(sess)
+	headerOutput, headerErr := receiptsClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(os.Getenv(envKeyReceiptsTableName)),
+		Key:       receiptKey(ack.MessageID, receiptHeader),
+	})
+	if headerErr != nil {
+		return rejectAck(errorCodeSendFailed, catalog.SendFailed, headerErr.Error())
+	}
+	// Expired headers may not have been deleted yet
+	if len(headerOutput.Item) == 0 ||
+		itemTime(headerOutput.Item, connections.ExpiresAtAttribute).Before(time.Now()) {
+		return rejectAck(errorCodeUnknownMessage, catalog.UnknownMessage, ack.MessageID)
+	}
+	// Messages are unknown to connections outside their audience
+	recipient, recipientErr := receiptRecipient(ctx, receiptsClient, headerOutput.Item, connectionID, ackerItem)
+	if recipientErr != nil {
+		return rejectAck(errorCodeSendFailed, catalog.SendFailed, recipientErr.Error())
+	}
+	if !recipient {
+		return rejectAck(errorCodeUnknownMessage, catalog.UnknownMessage, ack.MessageID)
+	}
+
+	// Operation
+	delivered, read, receiptErr := recordReceipt(ctx, receiptsClient, ack, connectionID, itemUserID(ackerItem))
+	if receiptErr != nil {
+		return rejectAck(errorCodeSendFailed, catalog.SendFailed, receiptErr.Error())
+	}
+	if delivered == 0 && read == 0 {
+		// Already acknowledged
+		return &wsResponse{
+			StatusCode: 200,
+			Body:       catalog.Localize(locale, catalog.DataSent),
+		}, nil
+	}
+	updateOutput, updateErr := receiptsClient.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(os.Getenv(envKeyReceiptsTableName)),
+		Key:              receiptKey(ack.MessageID, receiptHeader),
+		UpdateExpression: aws.String("ADD #delivered :delivered, #read :read"),
+		ExpressionAttributeNames: map[string]*string{
+			"#delivered": aws.String(ddbAttributeDelivered),
+			"#read":      aws.String(ddbAttributeRead),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":delivered": &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(delivered))},
+			":read":      &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(read))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if updateErr != nil {
+		return rejectAck(errorCodeSendFailed, catalog.SendFailed, updateErr.Error())
+	}
+	postReceipt(ctx,
+		sess,
+		request,
+		&receiptFrame{
+			MessageID:  ack.MessageID,
+			From:       itemUserID(ackerItem),
+			State:      ack.State,
+			Recipients: itemNumber(updateOutput.Attributes, ddbAttributeRecipients),
+			Delivered:  itemNumber(updateOutput.Attributes, ddbAttributeDelivered),
+			Read:       itemNumber(updateOutput.Attributes, ddbAttributeRead),
+		},
+		itemString(updateOutput.Attributes, ddbAttributeSenderConnection),
+		logger)
+	return &wsResponse{
+		StatusCode: 200,
+		Body:       catalog.Localize(locale, catalog.DataSent),
+	}, nil
+}
+
+// receiptRecipient returns true if the connection is in the audience of the
+// message with the header item: a member of the message's room, or a
+// connection of the message's user. The sending connection isn't a
+// recipient.
+func receiptRecipient(ctx context.Context,
+	roomsClient dynamodbiface.DynamoDBAPI,
+	headerItem map[string]*dynamodb.AttributeValue,
+	connectionID string,
+	connectionItem map[string]*dynamodb.AttributeValue) (bool, error) {
+	if itemString(headerItem, ddbAttributeSenderConnection) == connectionID {
+		return false, nil
+	}
+	if userID := itemString(headerItem, ddbAttributeRecipientUser); userID != "" {
+		return userID == itemUserID(connectionItem), nil
+	}
+	room := itemString(headerItem, ddbAttributeRoom)
+	if room == "" {
+		return false, nil
+	}
+	getItemOutput, getItemErr := roomsClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(os.Getenv(envKeyRoomsTableName)),
+		Key:       membershipKey(room, connectionID),
+	})
+	if getItemErr != nil {
+		return false, getItemErr
+	}
+	return len(getItemOutput.Item) != 0, nil
+}
+
+// recordReceipt stores the connection's receipt for the message and returns
+// the increments to the message's delivered and read counts. Both are zero
+// if the connection already acknowledged the message in that state.
+func recordReceipt(ctx context.Context,
+	receiptsClient dynamodbiface.DynamoDBAPI,
+	ack ackRequest,
+	connectionID string,
+	userID string) (delivered int, read int, err error) {
+	// A read receipt may follow a delivery receipt, but not the reverse
+	condition := "attribute_not_exists(#state)"
+	if ack.State == receiptStateRead {
+		condition = "attribute_not_exists(#state) OR #state = :delivered"
+	}
+	updateInput := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(os.Getenv(envKeyReceiptsTableName)),
+		Key:                 receiptKey(ack.MessageID, connectionID),
+		UpdateExpression:    aws.String("SET #state = :state, #ackedAt = :ackedAt, #expiresAt = :expiresAt"),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]*string{
+			"#state":     aws.String(ddbAttributeReceiptState),
+			"#ackedAt":   aws.String(ddbAttributeAckedAt),
+			"#expiresAt": aws.String(connections.ExpiresAtAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":state": &dynamodb.AttributeValue{S: aws.String(ack.State)},
+			":ackedAt": &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+			},
+			":expiresAt": receiptExpiresAt(),
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	}
+	if ack.State == receiptStateRead {
+		updateInput.ExpressionAttributeValues[":delivered"] = &dynamodb.AttributeValue{
+			S: aws.String(receiptStateDelivered),
+		}
+	}
+	if userID != "" {
+		updateInput.UpdateExpression = aws.String(*updateInput.UpdateExpression + ", #userID = :userID")
+		updateInput.ExpressionAttributeNames["#userID"] = aws.String(connections.UserAttribute)
+		updateInput.ExpressionAttributeValues[":userID"] = &dynamodb.AttributeValue{S: aws.String(userID)}
+	}
+	updateOutput, updateErr := receiptsClient.UpdateItemWithContext(ctx, updateInput)
+	if conditionalCheckFailed(updateErr) {
+		return 0, 0, nil
+	}
+	if updateErr != nil {
+		return 0, 0, updateErr
+	}
+	if itemString(updateOutput.Attributes, ddbAttributeReceiptState) == "" {
+		delivered = 1
+	}
+	if ack.State == receiptStateRead {
+		read = 1
+	}
+	return delivered, read, nil
+}
+
+// postReceipt posts the receipt frame to the message's sender, if it's still
+// connected
+func postReceipt(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	receipt *receiptFrame,
+	senderConnectionID string,
+	logger *logrus.Logger) {
+	if senderConnectionID == "" {
+		return
+	}
+	senderItem, senderItemErr := getConnectionItem(senderConnectionID, newConnectionsClient(sess))
+	if senderItemErr != nil || len(senderItem) == 0 {
+		return
+	}
+	frameData, _ := json.Marshal(receipt)
+	bcast := newBroadcaster(ctx,
+		sess,
+		managementEndpoint(request.RequestContext),
+		request.RequestContext.RequestID,
+		receiptMessage,
+		frameData,
+		logger)
+	bcast.deliverItems(ctx, []map[string]*dynamodb.AttributeValue{senderItem})
+	bcast.finish(ctx)
+}
+
+// itemNumber returns the item's numeric attribute value
+func itemNumber(item map[string]*dynamodb.AttributeValue, name string) int64 {
+	if item[name] == nil || item[name].N == nil {
+		return 0
+	}
+	value, _ := strconv.ParseInt(*item[name].N, 10, 64)
+	return value
+}
+
+// messageReceiptsDecorator provisions the message receipts table. Items
+// expire receiptRetention after they're written.
+func messageReceiptsDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(messageReceiptsResourceName, &gocf.DynamoDBTable{
+		AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeMessageID),
+				AttributeType: gocf.String("S"),
+			},
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeReceiver),
+				AttributeType: gocf.String("S"),
+			},
+		},
+		KeySchema: &gocf.DynamoDBTableKeySchemaList{
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeMessageID),
+				KeyType:       gocf.String("HASH"),
+			},
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeReceiver),
+				KeyType:       gocf.String("RANGE"),
+			},
+		},
+		TimeToLiveSpecification: &gocf.DynamoDBTableTimeToLiveSpecification{
+			AttributeName: gocf.String(connections.ExpiresAtAttribute),
+			Enabled:       gocf.Bool(true),
+		},
+		BillingMode: gocf.String("PAY_PER_REQUEST"),
+	})
+	return nil
+}
+
+// annotateMessageReceipts grants the lambda access to the message receipts
+// table and publishes the table name in its environment
+func annotateMessageReceipts(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:GetItem",
+				"dynamodb:PutItem",
+				"dynamodb:UpdateItem"},
+			Resource: gocf.GetAtt(messageReceiptsResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyReceiptsTableName, gocf.Ref(messageReceiptsResourceName).String())
+}
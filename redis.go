@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/go-redis/redis/v8"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/connections"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyConnectionStore selects the connection store at provision time.
+	// connectionStoreRedis keeps a copy of the connection items in an
+	// ElastiCache Redis replication group, which serves broadcasts, direct
+	// messages, and presence instead of the connection table's indexes. The
+	// copy is written through whenever an attribute that deliveries read
+	// changes.
+	envKeyConnectionStore = "CONNECTION_STORE"
+	connectionStoreRedis  = "redis"
+	// envKeyRedisAddress is the replication group's primary endpoint
+	envKeyRedisAddress        = "REDIS_ADDRESS"
+	redisReplicationGroupName = "ConnectionStoreRedis"
+	redisSubnetGroupName      = "ConnectionStoreRedisSubnets"
+	redisNodeType             = "cache.t3.small"
+	// redisCacheClusters is a primary and a replica, so that the group
+	// fails over automatically
+	redisCacheClusters = 2
+)
+
+var (
+	redisClientOnce sync.Once
+	redisClient     *redis.Client
+)
+
+// redisStoreEnabled returns true if the stack provisions the Redis
+// connection store
+func redisStoreEnabled() bool {
+	return os.Getenv(envKeyConnectionStore) == connectionStoreRedis
+}
+
+// connectionRedis returns the Redis client for the connection store, or nil
+// if the connection table is the store. The client's connection pool is
+// reused for the life of the container.
+func connectionRedis() *redis.Client {
+	address := os.Getenv(envKeyRedisAddress)
+	if address == "" {
+		return nil
+	}
+	redisClientOnce.Do(func() {
+		redisClient = redis.NewClient(&redis.Options{
+			Addr: address,
+			// The replication group requires in-transit encryption
+			TLSConfig: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+			},
+		})
+	})
+	return redisClient
+}
+
+// newConnectionIndex returns the broadcast access path to the connection
+// items
+func newConnectionIndex(dynamoClient dynamodbiface.DynamoDBAPI) connections.Index {
+	if client := connectionRedis(); client != nil {
+		return connections.NewRedisStore(client)
+	}
+	return connections.NewStore(dynamoClient, os.Getenv(envKeyTableName))
+}
+
+// indexConnection copies the connection item to the Redis connection store,
+// if there is one. Handlers that change the attributes deliveries read,
+// such as connection attributes and graphql-ws operations, write the
+// updated item through with reindexConnection.
+func indexConnection(ctx context.Context,
+	connectionID string,
+	item map[string]*dynamodb.AttributeValue) error {
+	client := connectionRedis()
+	if client == nil {
+		return nil
+	}
+	return connections.NewRedisStore(client).Put(ctx, connectionID, item)
+}
+
+// reindexConnection replaces the Redis connection store's copy of the
+// connection item with the updated item, if there is a store
+func reindexConnection(ctx context.Context,
+	connectionID string,
+	item map[string]*dynamodb.AttributeValue) error {
+	client := connectionRedis()
+	if client == nil {
+		return nil
+	}
+	return connections.NewRedisStore(client).Update(ctx, connectionID, item)
+}
+
+// unindexConnection removes the connection from the Redis connection store,
+// if there is one
+func unindexConnection(ctx context.Context, connectionID string) error {
+	client := connectionRedis()
+	if client == nil {
+		return nil
+	}
+	return connections.NewRedisStore(client).Delete(ctx, connectionID)
+}
+
+// redisStoreDecorator returns the decorator that provisions the Redis
+// replication group in the VPC subnets. The security groups must allow
+// ingress on the Redis port from themselves, since the lambdas share them.
+func (config *vpcConfig) redisStoreDecorator() sparta.ServiceDecoratorHookFunc {
+	return func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		template.AddResource(redisSubnetGroupName, &gocf.ElastiCacheSubnetGroup{
+			Description: gocf.String("Connection store subnets"),
+			SubnetIDs:   stringList(config.subnetIDs),
+		})
+		template.AddResource(redisReplicationGroupName, &gocf.ElastiCacheReplicationGroup{
+			ReplicationGroupDescription: gocf.String("Connection store"),
+			Engine:                      gocf.String("redis"),
+			CacheNodeType:               gocf.String(redisNodeType),
+			NumCacheClusters:            gocf.Integer(redisCacheClusters),
+			AutomaticFailoverEnabled:    gocf.Bool(true),
+			AtRestEncryptionEnabled:     gocf.Bool(true),
+			TransitEncryptionEnabled:    gocf.Bool(true),
+			CacheSubnetGroupName:        gocf.Ref(redisSubnetGroupName).String(),
+			SecurityGroupIDs:            stringList(config.securityGroupIDs),
+		})
+		return nil
+	}
+}
+
+// annotateRedisStore publishes the Redis connection store address in the
+// lambda environment
+func annotateRedisStore(lambdaFn *sparta.LambdaAWSInfo) {
+	setEnvironment(lambdaFn, envKeyRedisAddress, gocf.Join("",
+		gocf.GetAtt(redisReplicationGroupName, "PrimaryEndPoint.Address"),
+		gocf.String(":"),
+		gocf.GetAtt(redisReplicationGroupName, "PrimaryEndPoint.Port")))
+}
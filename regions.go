@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	apigwManagementIface "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi/apigatewaymanagementapiiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+)
+
+const (
+	// envKeyGlobalTableRegions lists the deployment regions, primary region
+	// first. The stack is provisioned once per region, and the connection
+	// table is a global table with a replica in each.
+	envKeyGlobalTableRegions = "GLOBAL_TABLE_REGIONS"
+	// Connection attributes that route deliveries to connections that were
+	// established in another region
+	ddbAttributeRegion   = "region"
+	ddbAttributeEndpoint = "endpoint"
+)
+
+// globalTableRegions returns the deployment regions
+func globalTableRegions() []string {
+	return splitList(os.Getenv(envKeyGlobalTableRegions))
+}
+
+// multiRegionEnabled returns true if the stack is deployed to more than one
+// region
+func multiRegionEnabled() bool {
+	return len(globalTableRegions()) > 1
+}
+
+// globalTableName returns the connection table name shared by every region's
+// stack
+func globalTableName(stackName string) string {
+	return stackName + "-connections"
+}
+
+// regionAttributes returns the attributes that let other regions deliver to
+// the connection, or nil for single region deployments
+func regionAttributes(request awsEvents.APIGatewayWebsocketProxyRequest) map[string]*dynamodb.AttributeValue {
+	if !multiRegionEnabled() {
+		return nil
+	}
+	return map[string]*dynamodb.AttributeValue{
+		ddbAttributeRegion: &dynamodb.AttributeValue{
+			S: aws.String(os.Getenv("AWS_REGION")),
+		},
+		ddbAttributeEndpoint: &dynamodb.AttributeValue{
+			S: aws.String(managementEndpoint(request.RequestContext)),
+		},
+	}
+}
+
+// routeRemote records the management client for the connection if it was
+// established in another region, whose API has its own management endpoint
+func (bcast *broadcaster) routeRemote(connectionID string,
+	item map[string]*dynamodb.AttributeValue) {
+	region := itemString(item, ddbAttributeRegion)
+	endpointURL := itemString(item, ddbAttributeEndpoint)
+	if region == "" || endpointURL == "" || region == os.Getenv("AWS_REGION") {
+		return
+	}
+	bcast.mutex.Lock()
+	defer bcast.mutex.Unlock()
+	if bcast.remote == nil {
+		bcast.remote = make(map[string]apigwManagementIface.ApiGatewayManagementApiAPI)
+		bcast.remoteClients = make(map[string]apigwManagementIface.ApiGatewayManagementApiAPI)
+	}
+	client, clientExists := bcast.remoteClients[endpointURL]
+	if !clientExists {
+		client = newManagementClient(bcast.sess.Copy(aws.NewConfig().WithRegion(region)),
+			endpointURL)
+		bcast.remoteClients[endpointURL] = client
+	}
+	bcast.remote[connectionID] = client
+}
+
+// managementClient returns the management client that posts to the
+// connection
+func (bcast *broadcaster) managementClient(connectionID string) apigwManagementIface.ApiGatewayManagementApiAPI {
+	bcast.mutex.Lock()
+	defer bcast.mutex.Unlock()
+	if client, isRemote := bcast.remote[connectionID]; isRemote {
+		return client
+	}
+	return bcast.apigwMgmtClient
+}
+
+// annotateMultiRegion publishes the deployment regions in the lambda
+// environment and lets it post to the APIs in every region
+func annotateMultiRegion(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"execute-api:ManageConnections"},
+			// The other regions' APIs have their own IDs
+			Resource: gocf.Join("",
+				gocf.String("arn:"),
+				gocf.Ref("AWS::Partition"),
+				gocf.String(":execute-api:*:"),
+				gocf.Ref("AWS::AccountId"),
+				gocf.String(":*/*")),
+		})
+	setEnvironment(lambdaFn, envKeyGlobalTableRegions, gocf.String(os.Getenv(envKeyGlobalTableRegions)))
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	envKeySequencesTableName  = "ROOM_SEQUENCES_TABLENAME"
+	roomSequencesResourceName = "RoomSequences"
+	ddbAttributeSequence      = "seq"
+	// historyBySequenceIndex is the message history LSI keyed by room ID and
+	// sequence number
+	historyBySequenceIndex = "BySequence"
+	// maxResumeMessages bounds the messages in a resume frame. Clients resume
+	// again from the last sequence while more is true.
+	maxResumeMessages = 100
+	resumeMessage     = "resume"
+)
+
+// resumeRequest is the data of a resume frame, along with the room. Since is
+// the last sequence number the client saw in the room.
+type resumeRequest struct {
+	Since int64 `json:"since"`
+}
+
+// resumeFrame is the data of the resume frame posted to the sender. Messages
+// are in sequence order, and Latest is the room's current sequence. More is
+// true if there are missed messages after the last one in the frame.
+type resumeFrame struct {
+	Room     string          `json:"room"`
+	Messages []*historyEntry `json:"messages"`
+	Latest   int64           `json:"latest"`
+	More     bool            `json:"more,omitempty"`
+}
+
+// nextSequence increments and returns the room's sequence number. The empty
+// sequence, 0, is returned while history is disabled, since there'd be
+// nothing to resume from.
+func nextSequence(ctx context.Context,
+	sess *session.Session,
+	room string,
+	logger *logrus.Logger) (int64, error) {
+	if !historyEnabled(ctx, sess, logger) || os.Getenv(envKeySequencesTableName) == "" {
+		return 0, nil
+	}
+	updateOutput, updateErr := newDynamoClient(sess).UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv(envKeySequencesTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			ddbAttributeRoomID: &dynamodb.AttributeValue{
+				S: aws.String(historyRoomID(room)),
+			},
+		},
+		UpdateExpression: aws.String("ADD #seq :one"),
+		ExpressionAttributeNames: map[string]*string{
+			"#seq": aws.String(ddbAttributeSequence),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": &dynamodb.AttributeValue{N: aws.String("1")},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if updateErr != nil {
+		return 0, updateErr
+	}
+	return itemNumber(updateOutput.Attributes, ddbAttributeSequence), nil
+}
+
+// currentSequence returns the room's latest sequence number
+func currentSequence(ctx context.Context,
+	sequencesClient dynamodbiface.DynamoDBAPI,
+	room string) (int64, error) {
+	getItemOutput, getItemErr := sequencesClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(os.Getenv(envKeySequencesTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			ddbAttributeRoomID: &dynamodb.AttributeValue{
+				S: aws.String(historyRoomID(room)),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if getItemErr != nil {
+		return 0, getItemErr
+	}
+	return itemNumber(getItemOutput.Item, ddbAttributeSequence), nil
+}
+
+// resumeRoom replies to a reconnecting member with the room messages sent
+// after the sequence number it last saw. Messages older than the history
+// retention can't be replayed.
+func resumeRoom(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	// Preconditions
+	route, rejected := newRoomRoute(ctx, request)
+	if rejected != nil {
+		return rejected, nil
+	}
+	if !historyEnabled(ctx, route.sess, route.logger) || os.Getenv(envKeySequencesTableName) == "" {
+		return route.error(ctx, request, errorCodeFeatureDisabled, catalog.HistoryDisabled), nil
+	}
+	var resume resumeRequest
+	payload, payloadErr := requestPayload(request, route.senderItem)
+	if payloadErr == nil {
+		payloadErr = json.Unmarshal(payload, &resume)
+	}
+	if payloadErr != nil {
+		return route.error(ctx, request, errorCodeMalformedRequest, catalog.UnmarshalFailed, payloadErr.Error()), nil
+	}
+	getItemOutput, getItemErr := route.roomsClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(os.Getenv(envKeyRoomsTableName)),
+		Key:       membershipKey(route.request.Room, request.RequestContext.ConnectionID),
+	})
+	if getItemErr != nil {
+		return route.error(ctx, request, errorCodeSendFailed, catalog.SendFailed, getItemErr.Error()), nil
+	}
+	if len(getItemOutput.Item) == 0 {
+		return route.error(ctx, request, errorCodeNotRoomMember, catalog.NotRoomMember, route.request.Room), nil
+	}
+
+	// Operation
+	frame, queryErr := queryMissed(ctx, route.roomsClient, route.request.Room, resume.Since)
+	if queryErr != nil {
+		return route.error(ctx, request, errorCodeSendFailed, catalog.SendFailed, queryErr.Error()), nil
+	}
+	frameData, _ := json.Marshal(frame)
+	bcast := newBroadcaster(ctx,
+		route.sess,
+		route.endpointURL,
+		request.RequestContext.RequestID,
+		resumeMessage,
+		frameData,
+		route.logger)
+	bcast.deliverItems(ctx, []map[string]*dynamodb.AttributeValue{route.senderItem})
+	bcast.finish(ctx)
+	route.logger.WithFields(logrus.Fields{
+		"Room":     route.request.Room,
+		"Since":    resume.Since,
+		"Messages": len(frame.Messages),
+	}).Info("Room resumed")
+	return &wsResponse{
+		StatusCode: 200,
+		Body:       catalog.Localize(route.locale, catalog.DataSent),
+	}, nil
+}
+
+// queryMissed returns the room messages with sequence numbers after since
+func queryMissed(ctx context.Context,
+	dynamoClient dynamodbiface.DynamoDBAPI,
+	room string,
+	since int64) (*resumeFrame, error) {
+	latest, latestErr := currentSequence(ctx, dynamoClient, room)
+	if latestErr != nil {
+		return nil, latestErr
+	}
+	frame := &resumeFrame{
+		Room:     room,
+		Messages: make([]*historyEntry, 0),
+		Latest:   latest,
+	}
+	if since >= latest {
+		return frame, nil
+	}
+	queryOutput, queryErr := dynamoClient.QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv(envKeyHistoryTableName)),
+		IndexName:              aws.String(historyBySequenceIndex),
+		KeyConditionExpression: aws.String("#roomID = :roomID AND #seq > :since"),
+		ExpressionAttributeNames: map[string]*string{
+			"#roomID": aws.String(ddbAttributeRoomID),
+			"#seq":    aws.String(ddbAttributeSequence),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":roomID": &dynamodb.AttributeValue{
+				S: aws.String(historyRoomID(room)),
+			},
+			":since": &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatInt(since, 10)),
+			},
+		},
+		Limit: aws.Int64(maxResumeMessages),
+	})
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	for _, eachItem := range queryOutput.Items {
+		frame.Messages = append(frame.Messages, newHistoryEntry(eachItem))
+	}
+	frame.More = len(queryOutput.LastEvaluatedKey) != 0
+	return frame, nil
+}
+
+// roomSequencesDecorator provisions the room sequence table, which holds a
+// counter per history room ID
+func roomSequencesDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(roomSequencesResourceName, &gocf.DynamoDBTable{
+		AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeRoomID),
+				AttributeType: gocf.String("S"),
+			},
+		},
+		KeySchema: &gocf.DynamoDBTableKeySchemaList{
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeRoomID),
+				KeyType:       gocf.String("HASH"),
+			},
+		},
+		BillingMode: gocf.String("PAY_PER_REQUEST"),
+	})
+	return nil
+}
+
+// annotateRoomSequences grants the lambda access to the room sequence table
+// and publishes the table name in its environment
+func annotateRoomSequences(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:GetItem",
+				"dynamodb:UpdateItem"},
+			Resource: gocf.GetAtt(roomSequencesResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeySequencesTableName, gocf.Ref(roomSequencesResourceName).String())
+}
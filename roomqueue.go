@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// envKeyRoomDelivery selects the room delivery mode at provision time.
+	// roomDeliveryOrdered queues room messages on a FIFO queue, grouped by
+	// room, so that every member sees a room's messages in the same order.
+	envKeyRoomDelivery  = "ROOM_DELIVERY"
+	roomDeliveryOrdered = "ordered"
+	// envKeyRoomQueueURL is the ordered room queue URL
+	envKeyRoomQueueURL            = "ROOM_QUEUE_URL"
+	roomQueueResourceName         = "RoomQueue"
+	roomDeadLetterQueueName       = "RoomDeadLetterQueue"
+	roomQueueVisibilityTimeout    = 120
+	roomConsumerTimeout           = 100
+	roomDeadLetterRetentionPeriod = 14 * 24 * 60 * 60
+	// roomQueueBatchSize is 1 so that a failed delivery doesn't redeliver the
+	// room messages that preceded it in the batch
+	roomQueueBatchSize = 1
+	// roomQueueMaxReceives bounds the receives before a message is dead
+	// lettered, unblocking the room's message group
+	roomQueueMaxReceives = 5
+)
+
+// queuedRoomMessage is the ordered room queue message body
+type queuedRoomMessage struct {
+	EndpointURL  string            `json:"endpointURL"`
+	RequestID    string            `json:"requestId"`
+	Frame        *roomFrame        `json:"frame"`
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+}
+
+// orderedRoomsEnabled returns true if room messages are delivered through the
+// ordered room queue
+func orderedRoomsEnabled() bool {
+	return os.Getenv(envKeyRoomDelivery) == roomDeliveryOrdered
+}
+
+// roomMessageGroup returns the FIFO message group for the room. Room names
+// may be longer than message group IDs allow, so the group is a digest.
+func roomMessageGroup(room string) string {
+	digest := sha256.Sum256([]byte(historyRoomID(room)))
+	return hex.EncodeToString(digest[:])
+}
+
+// enqueueRoomMessage queues the room frame for ordered delivery. The queue
+// is deduplicated by request ID, so a retried send isn't delivered twice.
+func enqueueRoomMessage(ctx context.Context,
+	sess *session.Session,
+	queueURL string,
+	endpointURL string,
+	requestID string,
+	frame *roomFrame) (err error) {
+	ctx, span := startSpan(ctx, "room.enqueue", attribute.String(attributeRoom, frame.Room))
+	defer func() {
+		endSpan(span, err)
+	}()
+	body, bodyErr := json.Marshal(&queuedRoomMessage{
+		EndpointURL:  endpointURL,
+		RequestID:    requestID,
+		Frame:        frame,
+		TraceContext: injectTraceContext(ctx),
+	})
+	if bodyErr != nil {
+		return bodyErr
+	}
+	_, sendErr := newSQSClient(sess).SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:               aws.String(queueURL),
+		MessageBody:            aws.String(string(body)),
+		MessageGroupId:         aws.String(roomMessageGroup(frame.Room)),
+		MessageDeduplicationId: aws.String(requestID),
+	})
+	return sendErr
+}
+
+// deliverOrderedRooms is the ordered room queue consumer. Each room's
+// messages are received in order, one at a time, and a message's delivery
+// completes before the next one's starts. Failed deliveries are retried
+// before the room's later messages.
+func deliverOrderedRooms(ctx context.Context, event awsEvents.SQSEvent) error {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+
+	// Operation
+	for _, eachRecord := range event.Records {
+		var message queuedRoomMessage
+		unmarshalErr := json.Unmarshal([]byte(eachRecord.Body), &message)
+		if unmarshalErr != nil || message.Frame == nil {
+			logger.WithField("Body", eachRecord.Body).Warn("Discarding malformed room message")
+			continue
+		}
+		deliveryErr := deliverQueuedRoomMessage(ctx, sess, &message, logger)
+		if deliveryErr != nil {
+			return deliveryErr
+		}
+	}
+	return nil
+}
+
+// deliverQueuedRoomMessage delivers the queued room frame to the room
+func deliverQueuedRoomMessage(ctx context.Context,
+	sess *session.Session,
+	message *queuedRoomMessage,
+	logger *logrus.Logger) (err error) {
+	ctx, finishInvocation := startInvocation(extractTraceContext(ctx, message.TraceContext),
+		"DeliverRoomOrdered",
+		attribute.String(attributeRoom, message.Frame.Room))
+	defer func() {
+		finishInvocation(err)
+	}()
+	stats, deliverErr := deliverRoom(ctx,
+		sess,
+		message.EndpointURL,
+		message.RequestID,
+		message.Frame,
+		logger)
+	logger.WithFields(logrus.Fields{
+		"Room":  message.Frame.Room,
+		"Stats": stats,
+	}).Info("Ordered room broadcast complete")
+	if deliverErr != nil {
+		return deliverErr
+	}
+	// The sender's own copy isn't a recipient
+	if stats.Delivered > 0 {
+		countRecipients(ctx, sess, message.Frame.MessageID, stats.Delivered-1, logger)
+	}
+	return nil
+}
+
+// roomQueueDecorator provisions the ordered room FIFO queue and its FIFO
+// dead letter queue
+func roomQueueDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(roomDeadLetterQueueName, &gocf.SQSQueue{
+		FifoQueue:              gocf.Bool(true),
+		MessageRetentionPeriod: gocf.Integer(roomDeadLetterRetentionPeriod),
+	})
+	template.AddResource(roomQueueResourceName, &gocf.SQSQueue{
+		FifoQueue:         gocf.Bool(true),
+		VisibilityTimeout: gocf.Integer(roomQueueVisibilityTimeout),
+		RedrivePolicy: map[string]interface{}{
+			"deadLetterTargetArn": gocf.GetAtt(roomDeadLetterQueueName, "Arn"),
+			"maxReceiveCount":     roomQueueMaxReceives,
+		},
+	})
+	return nil
+}
+
+// annotateRoomProducer lets the lambda queue room messages and publishes the
+// queue URL in its environment
+func annotateRoomProducer(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"sqs:SendMessage"},
+			Resource: gocf.GetAtt(roomQueueResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyRoomQueueURL, gocf.Ref(roomQueueResourceName).String())
+}
+
+// annotateRoomConsumer subscribes the lambda to the ordered room queue
+func annotateRoomConsumer(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"sqs:ReceiveMessage",
+				"sqs:DeleteMessage",
+				"sqs:GetQueueAttributes"},
+			Resource: gocf.GetAtt(roomQueueResourceName, "Arn"),
+		})
+	if lambdaFn.Options == nil {
+		lambdaFn.Options = &sparta.LambdaFunctionOptions{}
+	}
+	// The visibility timeout must exceed the consumer's timeout
+	lambdaFn.Options.Timeout = roomConsumerTimeout
+	lambdaFn.EventSourceMappings = append(lambdaFn.EventSourceMappings,
+		&sparta.EventSourceMapping{
+			EventSourceArn: gocf.GetAtt(roomQueueResourceName, "Arn"),
+			BatchSize:      roomQueueBatchSize,
+		})
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	apigwManagementIface "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi/apigatewaymanagementapiiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	envKeyRoomsTableName        = "ROOM_MEMBERSHIPS_TABLENAME"
+	roomMembershipsResourceName = "RoomMemberships"
+	// roomsByConnectionIndex finds a connection's memberships so they can be
+	// removed when it disconnects
+	roomsByConnectionIndex = "ByConnection"
+	ddbAttributeRoom       = "room"
+	maxRoomNameLength      = 128
+	roomMessage            = "room"
+	attributeRoom          = "websocket.room"
+)
+
+// roomRequest is the data of a joinroom, leaveroom, or sendroom frame. Data
+// and MessageID are only used by sendroom.
+type roomRequest struct {
+	Room      string          `json:"room"`
+	MessageID string          `json:"messageId,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// roomFrame is the data of the room frame delivered to each member.
+// MessageID is set if the message can be acknowledged, and Seq is the room
+// sequence number to resume from while history is enabled.
+type roomFrame struct {
+	Room      string          `json:"room"`
+	MessageID string          `json:"messageId,omitempty"`
+	Seq       int64           `json:"seq,omitempty"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// roomRoute is the state shared by the room handlers
+type roomRoute struct {
+	logger          *logrus.Logger
+	sess            *session.Session
+	endpointURL     string
+	roomsClient     dynamodbiface.DynamoDBAPI
+	apigwMgmtClient apigwManagementIface.ApiGatewayManagementApiAPI
+	senderItem      map[string]*dynamodb.AttributeValue
+	locale          string
+	request         roomRequest
+}
+
+// newRoomRoute reads the sender's connection and the room request. The
+// returned response is non-nil if the request was rejected.
+func newRoomRoute(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*roomRoute, *wsResponse) {
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	endpointURL := managementEndpoint(request.RequestContext)
+	route := &roomRoute{
+		logger:          logger,
+		sess:            sess,
+		endpointURL:     endpointURL,
+		roomsClient:     newDynamoClient(sess),
+		apigwMgmtClient: newManagementClient(sess, endpointURL),
+	}
+	senderItem, senderItemErr := senderConnectionItem(ctx, request,
+		newConnectionsClient(sess))
+	if senderItemErr != nil {
+		logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+	}
+	route.senderItem = senderItem
+	route.locale = itemLocale(senderItem)
+	if !features.enabled(ctx, sess, featureRooms, logger) {
+		return nil, route.error(ctx, request, errorCodeFeatureDisabled, catalog.RoomsDisabled)
+	}
+	payload, payloadErr := requestPayload(request, senderItem)
+	if payloadErr == nil {
+		payloadErr = json.Unmarshal(payload, &route.request)
+	}
+	if payloadErr != nil {
+		return nil, route.error(ctx, request, errorCodeMalformedRequest, catalog.UnmarshalFailed, payloadErr.Error())
+	}
+	if route.request.Room == "" || len(route.request.Room) > maxRoomNameLength {
+		return nil, route.error(ctx, request, errorCodeMalformedRequest, catalog.InvalidRoom)
+	}
+	return route, nil
+}
+
+// error posts the localized error frame to the sender
+func (route *roomRoute) error(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	code errorCode,
+	key catalog.Key,
+	args ...interface{}) *wsResponse {
+	return wsError(ctx,
+		request,
+		route.senderItem,
+		route.apigwMgmtClient,
+		code,
+		catalog.Localize(route.locale, key, args...),
+		route.logger)
+}
+
+// membershipKey returns the membership table key
+func membershipKey(room string, connectionID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		ddbAttributeRoom: &dynamodb.AttributeValue{
+			S: aws.String(room),
+		},
+		ddbAttributeConnectionID: &dynamodb.AttributeValue{
+			S: aws.String(connectionID),
+		},
+	}
+}
+
+// putRoomMembership adds the connection to the room. The membership record
+// copies the connection's negotiation so that room broadcasts don't read the
+// connection table.
+func putRoomMembership(ctx context.Context,
+	room string,
+	connectionID string,
+	connectionItem map[string]*dynamodb.AttributeValue,
+	roomsClient dynamodbiface.DynamoDBAPI) error {
+	membershipItem := membershipKey(room, connectionID)
+	for _, eachAttribute := range negotiationAttributes {
+		if connectionItem[eachAttribute] != nil {
+			membershipItem[eachAttribute] = connectionItem[eachAttribute]
+		}
+	}
+	_, putItemErr := roomsClient.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(os.Getenv(envKeyRoomsTableName)),
+		Item:      membershipItem,
+	})
+	return putItemErr
+}
+
+// joinRoom adds the sender to the room
+func joinRoom(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	// Preconditions
+	route, rejected := newRoomRoute(ctx, request)
+	if rejected != nil {
+		return rejected, nil
+	}
+
+	// Operation
+	putItemErr := putRoomMembership(ctx,
+		route.request.Room,
+		request.RequestContext.ConnectionID,
+		route.senderItem,
+		route.roomsClient)
+	if putItemErr != nil {
+		return route.error(ctx, request, errorCodeSendFailed, catalog.SendFailed, putItemErr.Error()), nil
+	}
+	return &wsResponse{
+		StatusCode: 200,
+		Body:       catalog.Localize(route.locale, catalog.RoomJoined, route.request.Room),
+	}, nil
+}
+
+// leaveRoom removes the sender from the room
+func leaveRoom(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	// Preconditions
+	route, rejected := newRoomRoute(ctx, request)
+	if rejected != nil {
+		return rejected, nil
+	}
+
+	// Operation
+	deleteErr := deleteRoomMembership(ctx,
+		route.request.Room,
+		request.RequestContext.ConnectionID,
+		route.roomsClient)
+	if deleteErr != nil {
+		return route.error(ctx, request, errorCodeSendFailed, catalog.SendFailed, deleteErr.Error()), nil
+	}
+	return &wsResponse{
+		StatusCode: 200,
+		Body:       catalog.Localize(route.locale, catalog.RoomLeft, route.request.Room),
+	}, nil
+}
+
+// sendRoom delivers the request data to every member of the room. Only
+// members can send to a room. With ordered room delivery, the frame is
+// queued and delivered by the ordered room queue consumer.
+func sendRoom(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	// Preconditions
+	route, rejected := newRoomRoute(ctx, request)
+	if rejected != nil {
+		return rejected, nil
+	}
+	connectionID := request.RequestContext.ConnectionID
+	if rateLimited(ctx, route.sess, connectionID, newConnectionsClient(route.sess), route.logger) {
+		return route.error(ctx, request, errorCodeRateLimited, catalog.RateLimited), nil
+	}
+	getItemOutput, getItemErr := route.roomsClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(os.Getenv(envKeyRoomsTableName)),
+		Key:       membershipKey(route.request.Room, connectionID),
+	})
+	if getItemErr != nil {
+		return route.error(ctx, request, errorCodeSendFailed, catalog.SendFailed, getItemErr.Error()), nil
+	}
+	if len(getItemOutput.Item) == 0 {
+		return route.error(ctx, request, errorCodeNotRoomMember, catalog.NotRoomMember, route.request.Room), nil
+	}
+	messageID, trackErr := trackMessage(ctx,
+		route.sess,
+		request,
+		route.request.MessageID,
+		receiptAudience{room: route.request.Room},
+		route.logger)
+	if trackErr == errDuplicateMessage {
+		return route.error(ctx, request, errorCodeDuplicateMessage, catalog.DuplicateMessage, route.request.MessageID), nil
+	}
+	if trackErr != nil {
+		return route.error(ctx, request, errorCodeSendFailed, catalog.SendFailed, trackErr.Error()), nil
+	}
+	sequence, sequenceErr := nextSequence(ctx, route.sess, route.request.Room, route.logger)
+	if sequenceErr != nil {
+		return route.error(ctx, request, errorCodeSendFailed, catalog.SendFailed, sequenceErr.Error()), nil
+	}
+
+	// Operation
+	frame := &roomFrame{
+		Room:      route.request.Room,
+		MessageID: messageID,
+		Seq:       sequence,
+		Data:      route.request.Data,
+	}
+	if queueURL := os.Getenv(envKeyRoomQueueURL); queueURL != "" {
+		enqueueErr := enqueueRoomMessage(ctx,
+			route.sess,
+			queueURL,
+			route.endpointURL,
+			request.RequestContext.RequestID,
+			frame)
+		if enqueueErr != nil {
+			return route.error(ctx, request, errorCodeSendFailed, catalog.SendFailed, enqueueErr.Error()), nil
+		}
+		recordHistory(ctx,
+			route.sess,
+			request,
+			route.request.Room,
+			route.senderItem,
+			messageID,
+			sequence,
+			route.request.Data,
+			route.logger)
+		forwardRoomMessage(ctx, route, request, messageID)
+		return &wsResponse{
+			StatusCode: 200,
+			Body:       catalog.Localize(route.locale, catalog.DataSent),
+		}, nil
+	}
+	stats, deliverErr := deliverRoom(ctx,
+		route.sess,
+		route.endpointURL,
+		request.RequestContext.RequestID,
+		frame,
+		route.logger)
+	route.logger.WithFields(logrus.Fields{
+		"Room":  route.request.Room,
+		"Stats": stats,
+	}).Info("Room broadcast complete")
+	// The sender's own copy isn't a recipient
+	if stats.Delivered > 0 {
+		countRecipients(ctx, route.sess, messageID, stats.Delivered-1, route.logger)
+	}
+	if deliverErr != nil {
+		return route.error(ctx, request, errorCodeSendFailed, catalog.SendFailed, deliverErr.Error()), nil
+	}
+	recordHistory(ctx,
+		route.sess,
+		request,
+		route.request.Room,
+		route.senderItem,
+		messageID,
+		sequence,
+		route.request.Data,
+		route.logger)
+	forwardRoomMessage(ctx, route, request, messageID)
+	return &wsResponse{
+		StatusCode: 200,
+		Body:       catalog.Localize(route.locale, catalog.DataSent),
+	}, nil
+}
+
+// forwardRoomMessage forwards the accepted room message to the webhook
+func forwardRoomMessage(ctx context.Context,
+	route *roomRoute,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	messageID string) {
+	forwardMessage(ctx, route.sess, request, &webhookEvent{
+		Type:      webhookTypeRoom,
+		MessageID: messageID,
+		Room:      route.request.Room,
+		Data:      route.request.Data,
+	}, route.senderItem, route.logger)
+}
+
+// deliverRoom delivers a room frame to every member of the room. Members
+// whose connections are gone are removed from the room.
+func deliverRoom(ctx context.Context,
+	sess *session.Session,
+	endpointURL string,
+	requestID string,
+	frame *roomFrame,
+	logger *logrus.Logger) (deliveryStats, error) {
+	frameData, frameDataErr := json.Marshal(frame)
+	if frameDataErr != nil {
+		return deliveryStats{}, frameDataErr
+	}
+	return deliverRoomFrame(ctx, sess, endpointURL, requestID, frame.Room, roomMessage, frameData, "", logger)
+}
+
+// deliverRoomFrame delivers the message to every member of the room other
+// than the excluded connection, if any. Members whose connections are gone
+// are removed from the room.
+func deliverRoomFrame(ctx context.Context,
+	sess *session.Session,
+	endpointURL string,
+	requestID string,
+	room string,
+	message string,
+	frameData json.RawMessage,
+	excluded string,
+	logger *logrus.Logger) (deliveryStats, error) {
+	roomsClient := newDynamoClient(sess)
+	bcast := newBroadcaster(ctx, sess, endpointURL, requestID, message, frameData, logger)
+	bcast.excluded = excluded
+	bcast.onGone = func(ctx context.Context, connectionID string) {
+		deleteErr := deleteRoomMembership(ctx, room, connectionID, roomsClient)
+		if deleteErr != nil {
+			logger.WithField("Error", deleteErr).Warn("Failed to remove gone room member")
+		}
+	}
+	queryErr := bcast.queryRoom(ctx, room, roomsClient)
+	return bcast.finish(ctx), queryErr
+}
+
+// queryRoom delivers the payload to every member of the room
+func (bcast *broadcaster) queryRoom(ctx context.Context,
+	room string,
+	roomsClient dynamodbiface.DynamoDBAPI) (err error) {
+	ctx, span := startSpan(ctx, "broadcast.room", attribute.String(attributeRoom, room))
+	defer func() {
+		span.SetAttributes(attribute.Int(attributeConnections, bcast.stats.Recipients))
+		endSpan(span, err)
+	}()
+	return roomsClient.QueryPagesWithContext(ctx,
+		&dynamodb.QueryInput{
+			TableName:              aws.String(os.Getenv(envKeyRoomsTableName)),
+			KeyConditionExpression: aws.String("#room = :room"),
+			ExpressionAttributeNames: map[string]*string{
+				"#room": aws.String(ddbAttributeRoom),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":room": &dynamodb.AttributeValue{
+					S: aws.String(room),
+				},
+			},
+		},
+		func(output *dynamodb.QueryOutput, lastPage bool) bool {
+			bcast.deliverItems(ctx, output.Items)
+			return true
+		})
+}
+
+// deleteRoomMembership removes the connection from the room
+func deleteRoomMembership(ctx context.Context,
+	room string,
+	connectionID string,
+	roomsClient dynamodbiface.DynamoDBAPI) error {
+	_, delItemErr := roomsClient.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv(envKeyRoomsTableName)),
+		Key:       membershipKey(room, connectionID),
+	})
+	return delItemErr
+}
+
+// leaveAllRooms removes every membership for the connection and returns the
+// rooms it left. It's a no-op if the lambda doesn't have access to the
+// membership table.
+func leaveAllRooms(ctx context.Context,
+	connectionID string,
+	roomsClient dynamodbiface.DynamoDBAPI,
+	logger *logrus.Logger) []string {
+	if os.Getenv(envKeyRoomsTableName) == "" {
+		return nil
+	}
+	var rooms []string
+	queryErr := roomsClient.QueryPagesWithContext(ctx,
+		&dynamodb.QueryInput{
+			TableName:              aws.String(os.Getenv(envKeyRoomsTableName)),
+			IndexName:              aws.String(roomsByConnectionIndex),
+			KeyConditionExpression: aws.String("#connectionID = :connectionID"),
+			ExpressionAttributeNames: map[string]*string{
+				"#connectionID": aws.String(ddbAttributeConnectionID),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":connectionID": &dynamodb.AttributeValue{
+					S: aws.String(connectionID),
+				},
+			},
+		},
+		func(output *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, eachItem := range output.Items {
+				if eachItem[ddbAttributeRoom] != nil && eachItem[ddbAttributeRoom].S != nil {
+					rooms = append(rooms, *eachItem[ddbAttributeRoom].S)
+				}
+			}
+			return true
+		})
+	if queryErr != nil {
+		logger.WithField("Error", queryErr).Warn("Failed to find room memberships")
+		return nil
+	}
+	for _, eachRoom := range rooms {
+		deleteErr := deleteRoomMembership(ctx, eachRoom, connectionID, roomsClient)
+		if deleteErr != nil {
+			logger.WithFields(logrus.Fields{
+				"Error": deleteErr,
+				"Room":  eachRoom,
+			}).Warn("Failed to leave room")
+		}
+	}
+	return rooms
+}
+
+// roomMembershipsDecorator provisions the room membership table. Items are
+// keyed by room and connection ID, with a GSI to find a connection's rooms.
+func roomMembershipsDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(roomMembershipsResourceName, &gocf.DynamoDBTable{
+		AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeRoom),
+				AttributeType: gocf.String("S"),
+			},
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeConnectionID),
+				AttributeType: gocf.String("S"),
+			},
+		},
+		KeySchema: &gocf.DynamoDBTableKeySchemaList{
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeRoom),
+				KeyType:       gocf.String("HASH"),
+			},
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeConnectionID),
+				KeyType:       gocf.String("RANGE"),
+			},
+		},
+		GlobalSecondaryIndexes: &gocf.DynamoDBTableGlobalSecondaryIndexList{
+			gocf.DynamoDBTableGlobalSecondaryIndex{
+				IndexName: gocf.String(roomsByConnectionIndex),
+				KeySchema: &gocf.DynamoDBTableKeySchemaList{
+					gocf.DynamoDBTableKeySchema{
+						AttributeName: gocf.String(ddbAttributeConnectionID),
+						KeyType:       gocf.String("HASH"),
+					},
+					gocf.DynamoDBTableKeySchema{
+						AttributeName: gocf.String(ddbAttributeRoom),
+						KeyType:       gocf.String("RANGE"),
+					},
+				},
+				Projection: &gocf.DynamoDBTableProjection{
+					ProjectionType: gocf.String("KEYS_ONLY"),
+				},
+			},
+		},
+		BillingMode: gocf.String("PAY_PER_REQUEST"),
+	})
+	return nil
+}
+
+// annotateRoomMemberships grants the lambda access to the room membership
+// table and publishes the table name in its environment
+func annotateRoomMemberships(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:GetItem",
+				"dynamodb:PutItem",
+				"dynamodb:DeleteItem",
+				"dynamodb:Query"},
+			Resource: gocf.GetAtt(roomMembershipsResourceName, "Arn"),
+		},
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:Query"},
+			Resource: gocf.Join("",
+				gocf.GetAtt(roomMembershipsResourceName, "Arn"),
+				gocf.String("/index/*")),
+		})
+	setEnvironment(lambdaFn, envKeyRoomsTableName, gocf.Ref(roomMembershipsResourceName).String())
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+)
+
+// routedAction is an action registered with the router
+type routedAction struct {
+	routeKey      string
+	operationName string
+	handler       wsHandler
+}
+
+// actionRouter serves several routes from a single lambda, dispatching each
+// request to the handler registered for its route key. Fewer lambdas means
+// fewer cold starts, and an action is added with a single registration that
+// also provisions its route.
+type actionRouter struct {
+	actions  []*routedAction
+	handlers map[string]wsHandler
+}
+
+func newActionRouter() *actionRouter {
+	return &actionRouter{
+		handlers: make(map[string]wsHandler),
+	}
+}
+
+// handle registers the handler for the route key. The operation name is the
+// route's OperationName in the template.
+func (router *actionRouter) handle(routeKey string,
+	operationName string,
+	handler wsHandler) *actionRouter {
+	router.actions = append(router.actions, &routedAction{
+		routeKey:      routeKey,
+		operationName: operationName,
+		handler:       handler,
+	})
+	router.handlers[routeKey] = handler
+	return router
+}
+
+// dispatch calls the handler registered for the request's route key. A
+// route that's provisioned but not registered (eg, by hand) gets an
+// unknownAction error frame.
+func (router *actionRouter) dispatch(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	if handler, exists := router.handlers[request.RequestContext.RouteKey]; exists {
+		return handler(ctx, request)
+	}
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	senderItem, senderItemErr := senderConnectionItem(ctx, request,
+		newConnectionsClient(sess))
+	if senderItemErr != nil {
+		logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+	}
+	return wsError(ctx,
+		request,
+		senderItem,
+		newManagementClient(sess, managementEndpoint(request.RequestContext)),
+		errorCodeUnknownAction,
+		catalog.Localize(itemLocale(senderItem), catalog.UnknownAction, request.RequestContext.RouteKey),
+		logger), nil
+}
+
+// provision creates the router lambda and a route to it for every
+// registered action
+func (router *actionRouter) provision(topo *topology,
+	apiGateway *sparta.APIV2,
+	name string) *sparta.LambdaAWSInfo {
+	lambdaFn := topo.lambda(name, frameHandler(router.dispatch))
+	for _, eachAction := range router.actions {
+		topo.route(apiGateway, eachAction.routeKey, eachAction.operationName, lambdaFn)
+	}
+	return lambdaFn
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyRuntimeConfigPrefix is the Parameter Store path (eg,
+	// /spartaws/prod/) that holds the runtime tunables
+	envKeyRuntimeConfigPrefix = "RUNTIME_CONFIG_PREFIX"
+	// Warm containers refresh the tunables every 30 to 50 seconds. The
+	// jitter keeps a fleet of containers from refreshing in lockstep.
+	runtimeConfigRefresh = 30 * time.Second
+	runtimeConfigJitter  = 20 * time.Second
+	// Tunable parameter names, relative to the prefix
+	tunableFanoutSegments    = "fanoutSegments"
+	tunableFanoutConcurrency = "fanoutConcurrency"
+	tunableSendRateLimit     = "sendRateLimit"
+	tunableBannedSourceIPs   = "bannedSourceIPs"
+	tunableMaxPayloadSize    = "maxPayloadSize"
+)
+
+// runtimeConfig caches the Parameter Store tunables for the life of the warm
+// container. It's safe for concurrent use.
+type runtimeConfig struct {
+	mutex     sync.Mutex
+	values    map[string]string
+	refreshAt time.Time
+}
+
+// tunables is shared by every invocation in the container
+var tunables = &runtimeConfig{}
+
+// value returns the named tunable, refreshing the cached parameters if
+// they're due
+func (config *runtimeConfig) value(ctx context.Context,
+	sess *session.Session,
+	name string,
+	logger *logrus.Logger) (string, bool) {
+	prefix := os.Getenv(envKeyRuntimeConfigPrefix)
+	if prefix == "" {
+		return "", false
+	}
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	if time.Now().After(config.refreshAt) {
+		refreshErr := config.refresh(ctx, sess, prefix)
+		if refreshErr != nil {
+			logger.WithField("Error", refreshErr).Warn("Failed to refresh runtime configuration")
+		}
+		config.refreshAt = time.Now().
+			Add(runtimeConfigRefresh).
+			Add(time.Duration(rand.Int63n(int64(runtimeConfigJitter))))
+	}
+	value, exists := config.values[name]
+	return value, exists
+}
+
+// intValue returns the named integer tunable, or the fallback if it's unset
+// or malformed
+func (config *runtimeConfig) intValue(ctx context.Context,
+	sess *session.Session,
+	name string,
+	fallback int64,
+	logger *logrus.Logger) int64 {
+	value, exists := config.value(ctx, sess, name, logger)
+	if !exists {
+		return fallback
+	}
+	parsed, parseErr := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if parseErr != nil {
+		logger.WithFields(logrus.Fields{
+			"Name":  name,
+			"Value": value,
+		}).Warn("Ignoring malformed runtime configuration value")
+		return fallback
+	}
+	return parsed
+}
+
+// listValue returns the named comma separated (or StringList) tunable
+func (config *runtimeConfig) listValue(ctx context.Context,
+	sess *session.Session,
+	name string,
+	logger *logrus.Logger) []string {
+	value, _ := config.value(ctx, sess, name, logger)
+	return splitList(value)
+}
+
+// refresh replaces the cached values with the parameters under the prefix.
+// The previous values are kept if Parameter Store can't be read.
+func (config *runtimeConfig) refresh(ctx context.Context,
+	sess *session.Session,
+	prefix string) error {
+	values := make(map[string]string)
+	getParamsErr := ssm.New(sess).GetParametersByPathPagesWithContext(ctx,
+		&ssm.GetParametersByPathInput{
+			Path:      aws.String(prefix),
+			Recursive: aws.Bool(true),
+		},
+		func(output *ssm.GetParametersByPathOutput, lastPage bool) bool {
+			for _, eachParameter := range output.Parameters {
+				name := strings.TrimPrefix(aws.StringValue(eachParameter.Name), prefix)
+				values[strings.TrimPrefix(name, "/")] = aws.StringValue(eachParameter.Value)
+			}
+			return true
+		})
+	if getParamsErr != nil {
+		return getParamsErr
+	}
+	config.values = values
+	return nil
+}
+
+// annotateRuntimeConfig lets the lambda read the tunables and publishes the
+// provision-time prefix in its environment
+func annotateRuntimeConfig(lambdaFn *sparta.LambdaAWSInfo) {
+	prefix := os.Getenv(envKeyRuntimeConfigPrefix)
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"ssm:GetParametersByPath"},
+			Resource: gocf.Join("",
+				gocf.String("arn:"),
+				gocf.Ref("AWS::Partition"),
+				gocf.String(":ssm:"),
+				gocf.Ref("AWS::Region"),
+				gocf.String(":"),
+				gocf.Ref("AWS::AccountId"),
+				gocf.String(":parameter"+strings.TrimSuffix(prefix, "/")+"*")),
+		})
+	setEnvironment(lambdaFn, envKeyRuntimeConfigPrefix, gocf.String(prefix))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/connections"
+	gocf "github.com/mweagle/go-cloudformation"
+)
+
+const (
+	// envKeyScanSegments is the number of parallel scan segments that each
+	// broadcast invocation reads the BroadcastIndex with. Values less than 2
+	// query the buckets one at a time.
+	envKeyScanSegments = "SCAN_SEGMENTS"
+	// maxScanSegments bounds the concurrent scans in each invocation
+	maxScanSegments = 32
+)
+
+// scanSegments returns the configured number of parallel scan segments
+func scanSegments() int64 {
+	segments, _ := strconv.ParseInt(os.Getenv(envKeyScanSegments), 10, 64)
+	if segments > maxScanSegments {
+		return maxScanSegments
+	}
+	return segments
+}
+
+// indexScanned returns true if broadcasts read the BroadcastIndex with
+// parallel scans. The Redis connection store is always queried by bucket.
+func indexScanned() bool {
+	return scanSegments() > 1 && connectionRedis() == nil
+}
+
+// scan delivers the payload to every connection in the fan-out segment with
+// concurrent scan segments of the BroadcastIndex. Each fan-out segment scans
+// its own contiguous range of the scan segments, so the invocations of a
+// segmented broadcast read disjoint parts of the index.
+func (bcast *broadcaster) scan(ctx context.Context,
+	store *connections.Store,
+	segment int64,
+	totalSegments int64) error {
+	if totalSegments < 2 {
+		segment, totalSegments = 0, 1
+	}
+	perSegment := scanSegments()
+	var waitGroup sync.WaitGroup
+	// deliverMutex serializes deliverPage, which isn't safe for concurrent
+	// use. The posts themselves are concurrent in the outbox.
+	var deliverMutex sync.Mutex
+	scanErrors := make([]error, perSegment)
+	for eachScanSegment := int64(0); eachScanSegment < perSegment; eachScanSegment++ {
+		waitGroup.Add(1)
+		go func(scanSegment int64) {
+			defer waitGroup.Done()
+			scanErrors[scanSegment] = store.ScanPages(ctx,
+				segment*perSegment+scanSegment,
+				totalSegments*perSegment,
+				func(items []map[string]*dynamodb.AttributeValue) bool {
+					deliverMutex.Lock()
+					defer deliverMutex.Unlock()
+					bcast.deliverPage(ctx, items)
+					return true
+				})
+		}(eachScanSegment)
+	}
+	waitGroup.Wait()
+	for _, eachErr := range scanErrors {
+		if eachErr != nil {
+			return eachErr
+		}
+	}
+	return nil
+}
+
+// annotateScanSegments publishes the provision-time SCAN_SEGMENTS in the
+// lambda environment
+func annotateScanSegments(lambdaFn *sparta.LambdaAWSInfo) {
+	setEnvironment(lambdaFn, envKeyScanSegments, gocf.String(strconv.FormatInt(scanSegments(), 10)))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	"github.com/mweagle/SpartaWebSocket/connections"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	envKeyResumeSessionsTableName = "RESUME_SESSIONS_TABLENAME"
+	resumeSessionsResourceName    = "ResumeSessions"
+	ddbAttributeResumeToken       = "resumeToken"
+	ddbAttributeRooms             = "rooms"
+	// queryParamResumeToken presents the previous connection's resume token
+	// at $connect
+	queryParamResumeToken = "resumeToken"
+	// resumeSessionRetention is how long a closed connection's rooms can be
+	// resumed
+	resumeSessionRetention = 10 * time.Minute
+	resumeTokenSize        = 16
+	sessionMessage         = "session"
+)
+
+// sessionFrame is the data of the session frame posted to the sender. The
+// connection's rooms are restored if the client presents the resume token
+// when it reconnects.
+type sessionFrame struct {
+	Type        string `json:"type"`
+	ResumeToken string `json:"resumeToken"`
+}
+
+// newResumeToken returns a random resume token for a new connection
+func newResumeToken() (string, error) {
+	token := make([]byte, resumeTokenSize)
+	_, readErr := rand.Read(token)
+	if readErr != nil {
+		return "", readErr
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// resumeSessionsEnabled returns true if closed connections can be resumed
+func resumeSessionsEnabled() bool {
+	return os.Getenv(envKeyResumeSessionsTableName) != "" &&
+		os.Getenv(envKeyRoomsTableName) != ""
+}
+
+// saveResumeSession records the rooms of the closed connection under its
+// resume token, so that a reconnecting client rejoins them. Sessions without
+// rooms aren't recorded. It's best-effort: a client whose session isn't
+// recorded rejoins its rooms itself.
+func saveResumeSession(ctx context.Context,
+	connectionItem map[string]*dynamodb.AttributeValue,
+	rooms []string,
+	sessionsClient dynamodbiface.DynamoDBAPI,
+	logger *logrus.Logger) {
+	resumeToken := itemString(connectionItem, ddbAttributeResumeToken)
+	if !resumeSessionsEnabled() || resumeToken == "" || len(rooms) == 0 {
+		return
+	}
+	sessionItem := map[string]*dynamodb.AttributeValue{
+		ddbAttributeResumeToken: &dynamodb.AttributeValue{
+			S: aws.String(resumeToken),
+		},
+		ddbAttributeRooms: &dynamodb.AttributeValue{
+			SS: aws.StringSlice(rooms),
+		},
+		connections.ExpiresAtAttribute: &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(time.Now().Add(resumeSessionRetention).Unix(), 10)),
+		},
+	}
+	if userID := itemUserID(connectionItem); userID != "" {
+		sessionItem[connections.UserAttribute] = &dynamodb.AttributeValue{
+			S: aws.String(userID),
+		}
+	}
+	_, putItemErr := sessionsClient.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(os.Getenv(envKeyResumeSessionsTableName)),
+		Item:      sessionItem,
+	})
+	if putItemErr != nil {
+		logger.WithField("Error", putItemErr).Warn("Failed to save resume session")
+	}
+}
+
+// restoreResumeSession rejoins the new connection to the rooms of the
+// session named by the $connect resume token. Tokens are single use, expire
+// with their session, and only resume sessions of the same user.
+func restoreResumeSession(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	connectionItem map[string]*dynamodb.AttributeValue,
+	logger *logrus.Logger) {
+	resumeToken := request.QueryStringParameters[queryParamResumeToken]
+	if !resumeSessionsEnabled() || resumeToken == "" {
+		return
+	}
+	if !features.enabled(ctx, sess, featureRooms, logger) {
+		return
+	}
+	dynamoClient := newDynamoClient(sess)
+	deleteOutput, deleteErr := dynamoClient.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv(envKeyResumeSessionsTableName)),
+		Key: map[string]*dynamodb.AttributeValue{
+			ddbAttributeResumeToken: &dynamodb.AttributeValue{
+				S: aws.String(resumeToken),
+			},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if deleteErr != nil {
+		logger.WithField("Error", deleteErr).Warn("Failed to read resume session")
+		return
+	}
+	sessionItem := deleteOutput.Attributes
+	if len(sessionItem) == 0 ||
+		itemNumber(sessionItem, connections.ExpiresAtAttribute) < time.Now().Unix() ||
+		itemUserID(sessionItem) != itemUserID(connectionItem) {
+		logger.Info("Ignoring unknown or expired resume token")
+		return
+	}
+	var rooms []string
+	if sessionItem[ddbAttributeRooms] != nil {
+		rooms = aws.StringValueSlice(sessionItem[ddbAttributeRooms].SS)
+	}
+	for _, eachRoom := range rooms {
+		putErr := putRoomMembership(ctx,
+			eachRoom,
+			request.RequestContext.ConnectionID,
+			connectionItem,
+			dynamoClient)
+		if putErr != nil {
+			logger.WithFields(logrus.Fields{
+				"Error": putErr,
+				"Room":  eachRoom,
+			}).Warn("Failed to rejoin room")
+		}
+	}
+	logger.WithField("Rooms", len(rooms)).Info("Session resumed")
+}
+
+// issueSession posts the session frame with the connection's resume token
+// to the sender. $connect can't post to the connection, so clients request
+// the frame once connected.
+func issueSession(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	endpointURL := managementEndpoint(request.RequestContext)
+	senderItem, senderItemErr := senderConnectionItem(ctx, request,
+		newConnectionsClient(sess))
+	if senderItemErr != nil {
+		logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+	}
+	locale := itemLocale(senderItem)
+	resumeToken := itemString(senderItem, ddbAttributeResumeToken)
+	if !resumeSessionsEnabled() || resumeToken == "" {
+		return wsError(ctx,
+			request,
+			senderItem,
+			newManagementClient(sess, endpointURL),
+			errorCodeFeatureDisabled,
+			catalog.Localize(locale, catalog.ResumeDisabled),
+			logger), nil
+	}
+
+	// Operation
+	frameData, _ := json.Marshal(&sessionFrame{
+		Type:        sessionMessage,
+		ResumeToken: resumeToken,
+	})
+	bcast := newBroadcaster(ctx,
+		sess,
+		endpointURL,
+		request.RequestContext.RequestID,
+		sessionMessage,
+		frameData,
+		logger)
+	bcast.deliverItems(ctx, []map[string]*dynamodb.AttributeValue{senderItem})
+	bcast.finish(ctx)
+	return &wsResponse{
+		StatusCode: 200,
+		Body:       catalog.Localize(locale, catalog.DataSent),
+	}, nil
+}
+
+// resumeSessionsDecorator provisions the resume session table, keyed by
+// resume token. Sessions expire with the table's TTL.
+func resumeSessionsDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(resumeSessionsResourceName, &gocf.DynamoDBTable{
+		AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeResumeToken),
+				AttributeType: gocf.String("S"),
+			},
+		},
+		KeySchema: &gocf.DynamoDBTableKeySchemaList{
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeResumeToken),
+				KeyType:       gocf.String("HASH"),
+			},
+		},
+		TimeToLiveSpecification: &gocf.DynamoDBTableTimeToLiveSpecification{
+			AttributeName: gocf.String(connections.ExpiresAtAttribute),
+			Enabled:       gocf.Bool(true),
+		},
+		BillingMode: gocf.String("PAY_PER_REQUEST"),
+	})
+	return nil
+}
+
+// annotateResumeSessions grants the lambda access to the resume session
+// table and publishes the table name in its environment
+func annotateResumeSessions(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:PutItem",
+				"dynamodb:DeleteItem"},
+			Resource: gocf.GetAtt(resumeSessionsResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyResumeSessionsTableName, gocf.Ref(resumeSessionsResourceName).String())
+}
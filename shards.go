@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	envKeyShardTableName          = "SHARD_ASSIGNMENTS_TABLENAME"
+	envKeySubmitFunctionName      = "SUBMIT_FUNCTIONNAME"
+	shardAssignmentsResourceName  = "ShardAssignments"
+	ddbAttributeAffinityKey       = "affinityKey"
+	ddbAttributeWorkCount         = "workCount"
+	metricWorkItems               = "WorkItems"
+	metricDimensionShard          = "Shard"
+	defaultRebalanceWindowMinutes = 15
+	defaultRebalanceThreshold     = 1.5
+)
+
+// rebalanceRequest is the RebalanceShards event. If AffinityKey is set, that
+// key is moved to TargetShard. Otherwise shards whose recent work exceeds the
+// mean by Threshold shed their busiest keys to the least loaded shard.
+type rebalanceRequest struct {
+	AffinityKey   string  `json:"affinityKey,omitempty"`
+	TargetShard   string  `json:"targetShard,omitempty"`
+	WindowMinutes int     `json:"windowMinutes,omitempty"`
+	Threshold     float64 `json:"threshold,omitempty"`
+}
+
+// shardMove is a single affinity key migration
+type shardMove struct {
+	AffinityKey string `json:"affinityKey"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+}
+
+// rebalanceResult is the RebalanceShards response
+type rebalanceResult struct {
+	Loads map[string]float64 `json:"loads,omitempty"`
+	Moves []shardMove        `json:"moves"`
+}
+
+// shardAssignment is a persisted affinity key to shard mapping
+type shardAssignment struct {
+	affinityKey string
+	shard       string
+	workCount   float64
+}
+
+func shardAssignmentFromItem(item map[string]*dynamodb.AttributeValue) *shardAssignment {
+	if item[ddbAttributeAffinityKey] == nil || item[ddbAttributeShard] == nil {
+		return nil
+	}
+	assignment := &shardAssignment{
+		affinityKey: aws.StringValue(item[ddbAttributeAffinityKey].S),
+		shard:       aws.StringValue(item[ddbAttributeShard].S),
+	}
+	if item[ddbAttributeWorkCount] != nil {
+		assignment.workCount, _ = strconv.ParseFloat(aws.StringValue(item[ddbAttributeWorkCount].N), 64)
+	}
+	return assignment
+}
+
+// affinityKeyAttribute returns the key attribute for an assignment item
+func affinityKeyAttribute(affinityKey string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		ddbAttributeAffinityKey: &dynamodb.AttributeValue{
+			S: aws.String(affinityKey),
+		},
+	}
+}
+
+// itemAffinityKey returns the affinity key stored in the connection item
+func itemAffinityKey(connectionID string, item map[string]*dynamodb.AttributeValue) string {
+	if item[ddbAttributeAffinityKey] == nil || item[ddbAttributeAffinityKey].S == nil {
+		return connectionID
+	}
+	return *item[ddbAttributeAffinityKey].S
+}
+
+// stickyShard returns the persisted shard for the affinity key, creating the
+// assignment from the hash ring if this is the first connection to use it.
+// Assignment errors fall back to the hash ring.
+func stickyShard(ctx context.Context,
+	affinityKey string,
+	ddbService dynamodbiface.DynamoDBAPI,
+	logger *logrus.Logger) string {
+	ringShard := shardRing().Shard(affinityKey)
+	item := affinityKeyAttribute(affinityKey)
+	item[ddbAttributeShard] = &dynamodb.AttributeValue{
+		S: aws.String(ringShard),
+	}
+	_, putItemErr := ddbService.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(os.Getenv(envKeyShardTableName)),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(" + ddbAttributeAffinityKey + ")"),
+	})
+	if putItemErr == nil {
+		return ringShard
+	}
+	if !conditionalCheckFailed(putItemErr) {
+		logger.WithField("Error", putItemErr).Warn("Failed to assign shard")
+		return ringShard
+	}
+	getItemOutput, getItemErr := ddbService.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv(envKeyShardTableName)),
+		Key:            affinityKeyAttribute(affinityKey),
+		ConsistentRead: aws.Bool(true),
+	})
+	if getItemErr != nil {
+		logger.WithField("Error", getItemErr).Warn("Failed to get shard assignment")
+		return ringShard
+	}
+	if assignment := shardAssignmentFromItem(getItemOutput.Item); assignment != nil {
+		return assignment.shard
+	}
+	return ringShard
+}
+
+// claimShard records a unit of work for the affinity key and returns its
+// current shard. Resolving the shard for every submission is what lets a
+// rebalance move a key without touching its connections. Errors fall back to
+// the shard recorded on the connection item.
+func claimShard(ctx context.Context,
+	affinityKey string,
+	fallbackShard string,
+	ddbService dynamodbiface.DynamoDBAPI,
+	logger *logrus.Logger) string {
+	updateItemOutput, updateItemErr := ddbService.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(os.Getenv(envKeyShardTableName)),
+		Key:                 affinityKeyAttribute(affinityKey),
+		UpdateExpression:    aws.String("ADD " + ddbAttributeWorkCount + " :one"),
+		ConditionExpression: aws.String("attribute_exists(" + ddbAttributeAffinityKey + ")"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": &dynamodb.AttributeValue{
+				N: aws.String("1"),
+			},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if updateItemErr != nil {
+		logger.WithFields(logrus.Fields{
+			"Error":       updateItemErr,
+			"AffinityKey": affinityKey,
+		}).Warn("Failed to claim shard assignment")
+		return fallbackShard
+	}
+	if assignment := shardAssignmentFromItem(updateItemOutput.Attributes); assignment != nil {
+		return assignment.shard
+	}
+	return fallbackShard
+}
+
+// moveAffinityKey reassigns the key and resets its work count
+func moveAffinityKey(ctx context.Context,
+	affinityKey string,
+	targetShard string,
+	ddbService dynamodbiface.DynamoDBAPI) error {
+	_, updateItemErr := ddbService.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(os.Getenv(envKeyShardTableName)),
+		Key:                 affinityKeyAttribute(affinityKey),
+		UpdateExpression:    aws.String("SET #shard = :shard, " + ddbAttributeWorkCount + " = :zero"),
+		ConditionExpression: aws.String("attribute_exists(" + ddbAttributeAffinityKey + ")"),
+		ExpressionAttributeNames: map[string]*string{
+			"#shard": aws.String(ddbAttributeShard),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":shard": &dynamodb.AttributeValue{
+				S: aws.String(targetShard),
+			},
+			":zero": &dynamodb.AttributeValue{
+				N: aws.String("0"),
+			},
+		},
+	})
+	return updateItemErr
+}
+
+// shardLoads returns the number of work items each shard received during
+// the window, as published by submitWork
+func shardLoads(ctx context.Context,
+	sess *session.Session,
+	shards []string,
+	window time.Duration) (map[string]float64, error) {
+	cloudwatchClient := cloudwatch.New(sess)
+	endTime := time.Now()
+	loads := make(map[string]float64, len(shards))
+	for _, eachShard := range shards {
+		statsOutput, statsErr := cloudwatchClient.GetMetricStatisticsWithContext(ctx,
+			&cloudwatch.GetMetricStatisticsInput{
+				Namespace:  aws.String(metricsNamespace),
+				MetricName: aws.String(metricWorkItems),
+				Dimensions: []*cloudwatch.Dimension{
+					&cloudwatch.Dimension{
+						Name:  aws.String("FunctionName"),
+						Value: aws.String(os.Getenv(envKeySubmitFunctionName)),
+					},
+					&cloudwatch.Dimension{
+						Name:  aws.String(metricDimensionShard),
+						Value: aws.String(eachShard),
+					},
+				},
+				StartTime:  aws.Time(endTime.Add(-window)),
+				EndTime:    aws.Time(endTime),
+				Period:     aws.Int64(int64(window / time.Second)),
+				Statistics: []*string{aws.String(cloudwatch.StatisticSum)},
+			})
+		if statsErr != nil {
+			return nil, statsErr
+		}
+		for _, eachDatapoint := range statsOutput.Datapoints {
+			loads[eachShard] += aws.Float64Value(eachDatapoint.Sum)
+		}
+	}
+	return loads, nil
+}
+
+// shardAssignments returns every assignment for the shard, busiest first
+func shardAssignments(ctx context.Context,
+	shard string,
+	ddbService dynamodbiface.DynamoDBAPI) ([]*shardAssignment, error) {
+	var assignments []*shardAssignment
+	scanErr := ddbService.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:        aws.String(os.Getenv(envKeyShardTableName)),
+		FilterExpression: aws.String("#shard = :shard"),
+		ExpressionAttributeNames: map[string]*string{
+			"#shard": aws.String(ddbAttributeShard),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":shard": &dynamodb.AttributeValue{
+				S: aws.String(shard),
+			},
+		},
+	}, func(output *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, eachItem := range output.Items {
+			if assignment := shardAssignmentFromItem(eachItem); assignment != nil {
+				assignments = append(assignments, assignment)
+			}
+		}
+		return true
+	})
+	sort.Slice(assignments, func(i, j int) bool {
+		return assignments[i].workCount > assignments[j].workCount
+	})
+	return assignments, scanErr
+}
+
+// rebalanceShards is the administrative rebalancing lambda. Connections are
+// never dropped: a moved key's next submission is queued on its new shard.
+// Work already queued on the old shard is still processed there, so ordering
+// across the move is only guaranteed once the old shard drains.
+func rebalanceShards(ctx context.Context, request rebalanceRequest) (_ *rebalanceResult, err error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	dynamoClient := newDynamoClient(sess)
+	result := &rebalanceResult{}
+	ctx, finishInvocation := startInvocation(ctx, "RebalanceShards")
+	defer func() {
+		finishInvocation(err)
+	}()
+
+	// Operation
+	if request.AffinityKey != "" {
+		if !containsShard(workerShards(), request.TargetShard) {
+			return nil, fmt.Errorf("unknown target shard: %s", request.TargetShard)
+		}
+		moveErr := moveAffinityKey(ctx, request.AffinityKey, request.TargetShard, dynamoClient)
+		if moveErr != nil {
+			return nil, moveErr
+		}
+		result.Moves = append(result.Moves, shardMove{
+			AffinityKey: request.AffinityKey,
+			To:          request.TargetShard,
+		})
+		return result, nil
+	}
+	windowMinutes := request.WindowMinutes
+	if windowMinutes <= 0 {
+		windowMinutes = defaultRebalanceWindowMinutes
+	}
+	threshold := request.Threshold
+	if threshold <= 1 {
+		threshold = defaultRebalanceThreshold
+	}
+	shards := workerShards()
+	loads, loadsErr := shardLoads(ctx, sess, shards, time.Duration(windowMinutes)*time.Minute)
+	if loadsErr != nil {
+		return nil, loadsErr
+	}
+	result.Loads = loads
+	totalLoad := 0.0
+	for _, eachShard := range shards {
+		totalLoad += loads[eachShard]
+	}
+	meanLoad := totalLoad / float64(len(shards))
+	for _, eachShard := range shards {
+		if loads[eachShard] <= meanLoad*threshold {
+			continue
+		}
+		assignments, assignmentsErr := shardAssignments(ctx, eachShard, dynamoClient)
+		if assignmentsErr != nil {
+			return nil, assignmentsErr
+		}
+		// The work counts are cumulative since the key was last moved, so
+		// use them to apportion the shard's windowed load across its keys
+		totalWork := 0.0
+		for _, eachAssignment := range assignments {
+			totalWork += eachAssignment.workCount
+		}
+		if totalWork == 0 {
+			continue
+		}
+		for _, eachAssignment := range assignments {
+			coldShard := coldestShard(shards, loads)
+			keyLoad := loads[eachShard] * eachAssignment.workCount / totalWork
+			// Only move the key if that narrows the gap between the shards
+			if keyLoad == 0 || loads[coldShard]+keyLoad >= loads[eachShard] {
+				continue
+			}
+			moveErr := moveAffinityKey(ctx, eachAssignment.affinityKey, coldShard, dynamoClient)
+			if moveErr != nil {
+				return result, moveErr
+			}
+			logger.WithFields(logrus.Fields{
+				"AffinityKey": eachAssignment.affinityKey,
+				"From":        eachShard,
+				"To":          coldShard,
+			}).Info("Moved affinity key")
+			result.Moves = append(result.Moves, shardMove{
+				AffinityKey: eachAssignment.affinityKey,
+				From:        eachShard,
+				To:          coldShard,
+			})
+			loads[eachShard] -= keyLoad
+			loads[coldShard] += keyLoad
+			if loads[eachShard] <= meanLoad*threshold {
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func containsShard(shards []string, shard string) bool {
+	for _, eachShard := range shards {
+		if eachShard == shard {
+			return true
+		}
+	}
+	return false
+}
+
+// coldestShard returns the least loaded shard
+func coldestShard(shards []string, loads map[string]float64) string {
+	coldShard := ""
+	coldLoad := math.MaxFloat64
+	for _, eachShard := range shards {
+		if loads[eachShard] < coldLoad {
+			coldShard = eachShard
+			coldLoad = loads[eachShard]
+		}
+	}
+	return coldShard
+}
+
+// shardAssignmentsDecorator provisions the affinity key to shard table
+func shardAssignmentsDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(shardAssignmentsResourceName, &gocf.DynamoDBTable{
+		AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeAffinityKey),
+				AttributeType: gocf.String("S"),
+			},
+		},
+		KeySchema: &gocf.DynamoDBTableKeySchemaList{
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeAffinityKey),
+				KeyType:       gocf.String("HASH"),
+			},
+		},
+		BillingMode: gocf.String("PAY_PER_REQUEST"),
+	})
+	return nil
+}
+
+// annotateShardAssignments grants the lambda access to the shard assignment
+// table and publishes the table name in its environment
+func annotateShardAssignments(lambdaFn *sparta.LambdaAWSInfo) {
+	annotateWorkerShards(lambdaFn)
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:GetItem",
+				"dynamodb:PutItem",
+				"dynamodb:UpdateItem",
+				"dynamodb:Scan"},
+			Resource: gocf.GetAtt(shardAssignmentsResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyShardTableName, gocf.Ref(shardAssignmentsResourceName).String())
+}
+
+// annotateRebalancer lets the rebalancing lambda read the submitter's shard
+// metrics
+func annotateRebalancer(lambdaFn *sparta.LambdaAWSInfo, submitter *sparta.LambdaAWSInfo) {
+	annotateShardAssignments(lambdaFn)
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"cloudwatch:GetMetricStatistics"},
+			Resource: gocf.String("*"),
+		})
+	setEnvironment(lambdaFn, envKeySubmitFunctionName, gocf.Ref(submitter.LogicalResourceName()).String())
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/sirupsen/logrus"
+)
+
+// mockShardTable is a DynamoDB client whose shard assignment table maps
+// affinity keys to shards. It implements the calls the assignment functions
+// make, failing each with err if it's set.
+type mockShardTable struct {
+	dynamodbiface.DynamoDBAPI
+	shards map[string]string
+	err    error
+}
+
+func (table *mockShardTable) PutItemWithContext(ctx aws.Context,
+	input *dynamodb.PutItemInput,
+	opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if table.err != nil {
+		return nil, table.err
+	}
+	affinityKey := itemString(input.Item, ddbAttributeAffinityKey)
+	if _, exists := table.shards[affinityKey]; exists {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "assignment exists", nil)
+	}
+	table.shards[affinityKey] = itemString(input.Item, ddbAttributeShard)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (table *mockShardTable) GetItemWithContext(ctx aws.Context,
+	input *dynamodb.GetItemInput,
+	opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	if table.err != nil {
+		return nil, table.err
+	}
+	return &dynamodb.GetItemOutput{
+		Item: table.assignmentItem(itemString(input.Key, ddbAttributeAffinityKey)),
+	}, nil
+}
+
+func (table *mockShardTable) UpdateItemWithContext(ctx aws.Context,
+	input *dynamodb.UpdateItemInput,
+	opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if table.err != nil {
+		return nil, table.err
+	}
+	affinityKey := itemString(input.Key, ddbAttributeAffinityKey)
+	if _, exists := table.shards[affinityKey]; !exists {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "no assignment", nil)
+	}
+	return &dynamodb.UpdateItemOutput{
+		Attributes: table.assignmentItem(affinityKey),
+	}, nil
+}
+
+// assignmentItem returns the affinity key's assignment item, or nil
+func (table *mockShardTable) assignmentItem(affinityKey string) map[string]*dynamodb.AttributeValue {
+	shard, exists := table.shards[affinityKey]
+	if !exists {
+		return nil
+	}
+	item := affinityKeyAttribute(affinityKey)
+	item[ddbAttributeShard] = &dynamodb.AttributeValue{
+		S: aws.String(shard),
+	}
+	return item
+}
+
+func TestStickyShard(t *testing.T) {
+	ringShard := shardRing().Shard("game-1")
+	tests := []struct {
+		name   string
+		shards map[string]string
+		err    error
+		shard  string
+	}{
+		{name: "first connection",
+			shards: map[string]string{},
+			shard:  ringShard},
+		// A rebalanced key keeps its shard rather than the ring's
+		{name: "assigned",
+			shards: map[string]string{"game-1": "shard-moved"},
+			shard:  "shard-moved"},
+		{name: "assignment error",
+			shards: map[string]string{"game-1": "shard-moved"},
+			err:    errors.New("throttled"),
+			shard:  ringShard},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			table := &mockShardTable{shards: eachTest.shards, err: eachTest.err}
+			shard := stickyShard(context.Background(), "game-1", table, logrus.New())
+			if shard != eachTest.shard {
+				t.Errorf("stickyShard = %q, want %q", shard, eachTest.shard)
+			}
+			if eachTest.err == nil && table.shards["game-1"] != eachTest.shard {
+				t.Errorf("Assigned shard = %q, want %q", table.shards["game-1"], eachTest.shard)
+			}
+		})
+	}
+}
+
+func TestClaimShard(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards map[string]string
+		err    error
+		shard  string
+	}{
+		{name: "assigned",
+			shards: map[string]string{"game-1": "shard-moved"},
+			shard:  "shard-moved"},
+		{name: "unassigned",
+			shards: map[string]string{},
+			shard:  "shard-connection"},
+		{name: "claim error",
+			shards: map[string]string{"game-1": "shard-moved"},
+			err:    errors.New("throttled"),
+			shard:  "shard-connection"},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			table := &mockShardTable{shards: eachTest.shards, err: eachTest.err}
+			shard := claimShard(context.Background(), "game-1", "shard-connection", table, logrus.New())
+			if shard != eachTest.shard {
+				t.Errorf("claimShard = %q, want %q", shard, eachTest.shard)
+			}
+		})
+	}
+}
+
+func TestColdestShard(t *testing.T) {
+	shards := []string{"shard-0", "shard-1", "shard-2"}
+	tests := []struct {
+		loads map[string]float64
+		shard string
+	}{
+		{map[string]float64{"shard-0": 5, "shard-1": 2, "shard-2": 9}, "shard-1"},
+		// Shards without recent work are the coldest
+		{map[string]float64{"shard-0": 5, "shard-1": 2}, "shard-2"},
+		{map[string]float64{}, "shard-0"},
+	}
+	for _, eachTest := range tests {
+		if shard := coldestShard(shards, eachTest.loads); shard != eachTest.shard {
+			t.Errorf("coldestShard(%v) = %q, want %q", eachTest.loads, shard, eachTest.shard)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyStage is the provision-time deployment environment (eg, dev,
+	// staging, or prod). Each stage is an independent stack with its own
+	// API stage, connection table, and log level.
+	envKeyStage = "STAGE"
+	// envKeyStageLogLevel overrides the stage's lambda log level. It's
+	// published in the lambda environment.
+	envKeyStageLogLevel = "STAGE_LOG_LEVEL"
+	// defaultAPIStageName is the API stage of stacks without a stage
+	defaultAPIStageName = "v1"
+	maxStageNameLength  = 32
+)
+
+// apiStageName is the API Gateway stage name. main sets it to the deployment
+// stage's name.
+var apiStageName = defaultAPIStageName
+
+// stageLogLevels are the lambda log levels of the well known stages. Other
+// stages log at the info level.
+var stageLogLevels = map[string]logrus.Level{
+	"dev":     logrus.DebugLevel,
+	"staging": logrus.InfoLevel,
+	"prod":    logrus.WarnLevel,
+}
+
+// stageNamePattern matches names that are valid in both stack and API stage
+// names
+var stageNamePattern = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// deploymentStage is the environment that the stack is deployed to. The zero
+// value is the unstaged stack.
+type deploymentStage struct {
+	// Name is the stage name, or the empty string
+	Name string
+	// LogLevel is the lambda log level, or the empty string to keep Sparta's
+	LogLevel string
+}
+
+// newDeploymentStage returns the deployment stage in the environment, after
+// any command line overrides
+func newDeploymentStage() (*deploymentStage, error) {
+	stage := &deploymentStage{
+		Name:     os.Getenv(envKeyStage),
+		LogLevel: os.Getenv(envKeyStageLogLevel),
+	}
+	if stage.Name != "" {
+		if len(stage.Name) > maxStageNameLength || !stageNamePattern.MatchString(stage.Name) {
+			return nil, fmt.Errorf("%s must be at most %d letters, digits, or hyphens: %q",
+				envKeyStage,
+				maxStageNameLength,
+				stage.Name)
+		}
+		if stage.LogLevel == "" {
+			level, levelExists := stageLogLevels[stage.Name]
+			if !levelExists {
+				level = logrus.InfoLevel
+			}
+			stage.LogLevel = level.String()
+		}
+	}
+	if stage.LogLevel != "" {
+		if _, levelErr := logrus.ParseLevel(stage.LogLevel); levelErr != nil {
+			return nil, fmt.Errorf("%s: %s", envKeyStageLogLevel, levelErr)
+		}
+	}
+	return stage, nil
+}
+
+// stackName returns the stage's stack name for the base stack name
+func (stage *deploymentStage) stackName(baseName string) string {
+	if stage.Name == "" {
+		return baseName
+	}
+	return baseName + "-" + stage.Name
+}
+
+// apiStageName returns the stage's API Gateway stage name
+func (stage *deploymentStage) apiStageName() string {
+	if stage.Name == "" {
+		return defaultAPIStageName
+	}
+	return stage.Name
+}
+
+// tableName returns the stage's physical connection table name for the
+// configured name, so stages don't contend for the same table
+func (stage *deploymentStage) tableName(name string) string {
+	if name == "" || stage.Name == "" {
+		return name
+	}
+	return name + "-" + stage.Name
+}
+
+// annotate publishes the stage's log level in the lambda environment
+func (stage *deploymentStage) annotate(lambdaFn *sparta.LambdaAWSInfo) {
+	if stage.LogLevel == "" {
+		return
+	}
+	setEnvironment(lambdaFn, envKeyStageLogLevel, gocf.String(stage.LogLevel))
+}
+
+// applyStageLogLevel sets the logger to the provision-time stage log level,
+// if there is one
+func applyStageLogLevel(logger *logrus.Logger) {
+	level, levelErr := logrus.ParseLevel(os.Getenv(envKeyStageLogLevel))
+	if levelErr == nil && logger.GetLevel() != level {
+		logger.SetLevel(level)
+	}
+}
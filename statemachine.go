@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// fanoutModeStepFunctions starts an execution of the broadcast state
+	// machine, which delivers the segments in parallel and aggregates their
+	// results, rather than invoking the delivery lambda from the sender
+	fanoutModeStepFunctions = "stepfunctions"
+	// envKeyBroadcastStateMachineARN is the broadcast state machine ARN
+	envKeyBroadcastStateMachineARN    = "BROADCAST_STATE_MACHINE_ARN"
+	broadcastStateMachineResourceName = "BroadcastStateMachine"
+	broadcastStateMachineRoleName     = "BroadcastStateMachineRole"
+	// State machine placeholders, replaced with the lambda ARNs
+	stateMachineReferenceDeliver   = "DeliverSegmentArn"
+	stateMachineReferenceAggregate = "AggregateDeliveriesArn"
+	// Segment deliveries that fail with a lambda service error are retried
+	stateMachineRetryInterval    = 2
+	stateMachineRetryMaxAttempts = 3
+	stateMachineRetryBackoff     = 2
+	// stateMachineMaxConcurrency doesn't limit the map state's concurrent
+	// segment deliveries beyond the Step Functions limit
+	stateMachineMaxConcurrency = 0
+)
+
+// broadcastExecution is the broadcast state machine input. The map state
+// delivers each of the segments with the shared fields.
+type broadcastExecution struct {
+	EndpointURL   string            `json:"endpointURL"`
+	RequestID     string            `json:"requestId"`
+	Payload       json.RawMessage   `json:"payload"`
+	Binary        bool              `json:"binary"`
+	Segments      []int64           `json:"segments"`
+	TotalSegments int64             `json:"totalSegments"`
+	TraceContext  map[string]string `json:"traceContext"`
+	// ExcludedConnectionID is always present, since the map state's
+	// parameters reference it
+	ExcludedConnectionID string `json:"excludedConnectionId"`
+	Filter               string `json:"filter"`
+}
+
+// segmentResult is the map state's result for one segment: the segment's
+// delivery stats, or the error that the segment failed with once its retries
+// were exhausted
+type segmentResult struct {
+	deliveryStats
+	Segment *int64 `json:"segment,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// aggregateRequest is the AggregateDeliveries input
+type aggregateRequest struct {
+	RequestID string          `json:"requestId"`
+	Results   []segmentResult `json:"results"`
+}
+
+// aggregateResult is the AggregateDeliveries response, which is the
+// execution's output
+type aggregateResult struct {
+	Stats          deliveryStats `json:"stats"`
+	FailedSegments []int64       `json:"failedSegments,omitempty"`
+}
+
+// broadcastStateMachineEnabled returns true if broadcasts are delivered by
+// the broadcast state machine
+func broadcastStateMachineEnabled() bool {
+	return os.Getenv(envKeyFanoutMode) == fanoutModeStepFunctions
+}
+
+// startBroadcastExecution starts a broadcast state machine execution that
+// delivers every segment. Like the fan-out topic, the sender doesn't wait for
+// the deliveries, so the returned stats are empty; the aggregated stats are
+// logged by AggregateDeliveries and are the execution's output.
+func startBroadcastExecution(ctx context.Context,
+	sess *session.Session,
+	stateMachineARN string,
+	endpointURL string,
+	requestID string,
+	payload json.RawMessage,
+	binary bool,
+	excluded string,
+	filterSource string,
+	totalSegments int64,
+	logger *logrus.Logger) (stats deliveryStats, err error) {
+	ctx, span := startSpan(ctx, "fanout.execution",
+		attribute.Int64(attributeTotalSegments, totalSegments))
+	defer func() {
+		endSpan(span, err)
+	}()
+	execution := &broadcastExecution{
+		EndpointURL:          endpointURL,
+		RequestID:            requestID,
+		Payload:              payload,
+		Binary:               binary,
+		TotalSegments:        totalSegments,
+		TraceContext:         injectTraceContext(ctx),
+		ExcludedConnectionID: excluded,
+		Filter:               filterSource,
+	}
+	for segment := int64(0); segment < totalSegments; segment++ {
+		execution.Segments = append(execution.Segments, segment)
+	}
+	input, inputErr := json.Marshal(execution)
+	if inputErr != nil {
+		return stats, inputErr
+	}
+	startOutput, startErr := sfn.New(sess).StartExecutionWithContext(ctx, &sfn.StartExecutionInput{
+		StateMachineArn: aws.String(stateMachineARN),
+		Input:           aws.String(string(input)),
+	})
+	if startErr != nil {
+		return stats, startErr
+	}
+	logger.WithField("ExecutionArn", aws.StringValue(startOutput.ExecutionArn)).Info("Started broadcast execution")
+	return stats, nil
+}
+
+// aggregateDeliveries is the broadcast state machine's final state. It sums
+// the segments' delivery stats and fails the execution if any segment
+// couldn't be delivered.
+func aggregateDeliveries(ctx context.Context, request aggregateRequest) (*aggregateResult, error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	logger = correlatedLogger(logger, request.RequestID)
+
+	// Operation
+	result := &aggregateResult{}
+	for _, eachResult := range request.Results {
+		if eachResult.Error != "" {
+			segment := int64(-1)
+			if eachResult.Segment != nil {
+				segment = *eachResult.Segment
+			}
+			result.FailedSegments = append(result.FailedSegments, segment)
+			logger.WithFields(logrus.Fields{
+				"Error":   eachResult.Error,
+				"Segment": segment,
+			}).Warn("Failed to deliver segment")
+			continue
+		}
+		result.Stats.add(eachResult.deliveryStats)
+	}
+	logger.WithField("Stats", result.Stats).Info("Broadcast complete")
+	if len(result.FailedSegments) != 0 {
+		return result, fmt.Errorf("failed to deliver %d of %d segments",
+			len(result.FailedSegments),
+			len(request.Results))
+	}
+	return result, nil
+}
+
+// broadcastStateMachineDefinition returns the state machine's Amazon States
+// Language definition. A map state invokes the delivery lambda for each
+// segment in parallel, retrying lambda service errors; a segment that still
+// fails is caught so that the other segments' results are aggregated.
+func broadcastStateMachineDefinition() ([]byte, error) {
+	lambdaErrors := []string{"Lambda.ServiceException",
+		"Lambda.AWSLambdaException",
+		"Lambda.SdkClientException",
+		"Lambda.TooManyRequestsException"}
+	return json.Marshal(map[string]interface{}{
+		"Comment": "Delivers a broadcast's segments in parallel",
+		"StartAt": "DeliverSegments",
+		"States": map[string]interface{}{
+			"DeliverSegments": map[string]interface{}{
+				"Type":      "Map",
+				"ItemsPath": "$.segments",
+				// Segments are bounded by runtimeFanoutSegments, which
+				// allows more segments than buckets for a scanned index
+				"MaxConcurrency": stateMachineMaxConcurrency,
+				"Parameters": map[string]interface{}{
+					"endpointURL.$":   "$.endpointURL",
+					"requestId.$":     "$.requestId",
+					"payload.$":       "$.payload",
+					"binary.$":        "$.binary",
+					"totalSegments.$": "$.totalSegments",
+					"traceContext.$":  "$.traceContext",
+					"segment.$":       "$$.Map.Item.Value",
+					// The delivery lambda ignores empty strings
+					"excludedConnectionId.$": "$.excludedConnectionId",
+					"filter.$":               "$.filter",
+				},
+				"Iterator": map[string]interface{}{
+					"StartAt": "DeliverSegment",
+					"States": map[string]interface{}{
+						"DeliverSegment": map[string]interface{}{
+							"Type":     "Task",
+							"Resource": reference(stateMachineReferenceDeliver),
+							"Retry": []interface{}{
+								map[string]interface{}{
+									"ErrorEquals":     lambdaErrors,
+									"IntervalSeconds": stateMachineRetryInterval,
+									"MaxAttempts":     stateMachineRetryMaxAttempts,
+									"BackoffRate":     stateMachineRetryBackoff,
+								},
+							},
+							"Catch": []interface{}{
+								map[string]interface{}{
+									"ErrorEquals": []string{"States.ALL"},
+									"ResultPath":  "$.failure",
+									"Next":        "SegmentFailed",
+								},
+							},
+							"End": true,
+						},
+						"SegmentFailed": map[string]interface{}{
+							"Type": "Pass",
+							"Parameters": map[string]interface{}{
+								"segment.$": "$.segment",
+								"error.$":   "$.failure.Cause",
+							},
+							"End": true,
+						},
+					},
+				},
+				"ResultPath": "$.results",
+				"Next":       "AggregateDeliveries",
+			},
+			"AggregateDeliveries": map[string]interface{}{
+				"Type":     "Task",
+				"Resource": reference(stateMachineReferenceAggregate),
+				"Parameters": map[string]interface{}{
+					"requestId.$": "$.requestId",
+					"results.$":   "$.results",
+				},
+				"End": true,
+			},
+		},
+	})
+}
+
+// broadcastStateMachineDecorator provisions the broadcast state machine and
+// the role that lets it invoke the delivery and aggregation lambdas
+func broadcastStateMachineDecorator(delivery *sparta.LambdaAWSInfo,
+	aggregator *sparta.LambdaAWSInfo) sparta.ServiceDecoratorHookHandler {
+	return sparta.ServiceDecoratorHookFunc(func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		definition, definitionErr := broadcastStateMachineDefinition()
+		if definitionErr != nil {
+			return definitionErr
+		}
+		deliveryARN := gocf.GetAtt(delivery.LogicalResourceName(), "Arn")
+		aggregatorARN := gocf.GetAtt(aggregator.LogicalResourceName(), "Arn")
+		template.AddResource(broadcastStateMachineRoleName, &gocf.IAMRole{
+			AssumeRolePolicyDocument: map[string]interface{}{
+				"Version": "2012-10-17",
+				"Statement": []interface{}{
+					map[string]interface{}{
+						"Effect": "Allow",
+						"Principal": map[string]interface{}{
+							"Service": []string{"states.amazonaws.com"},
+						},
+						"Action": []string{"sts:AssumeRole"},
+					},
+				},
+			},
+			Policies: &gocf.IAMRolePolicyList{
+				gocf.IAMRolePolicy{
+					PolicyName: gocf.String("InvokeDeliveries"),
+					PolicyDocument: map[string]interface{}{
+						"Version": "2012-10-17",
+						"Statement": []interface{}{
+							map[string]interface{}{
+								"Effect":   "Allow",
+								"Action":   []string{"lambda:InvokeFunction"},
+								"Resource": []interface{}{deliveryARN, aggregatorARN},
+							},
+						},
+					},
+				},
+			},
+		})
+		template.AddResource(broadcastStateMachineResourceName, &gocf.StepFunctionsStateMachine{
+			DefinitionString: joinReferences(definition, map[string]gocf.Stringable{
+				stateMachineReferenceDeliver:   deliveryARN,
+				stateMachineReferenceAggregate: aggregatorARN,
+			}),
+			RoleArn: gocf.GetAtt(broadcastStateMachineRoleName, "Arn").String(),
+		})
+		return nil
+	})
+}
+
+// annotateBroadcastStateMachine lets the sender start executions of the
+// broadcast state machine and publishes its ARN in the sender's environment
+func annotateBroadcastStateMachine(sender *sparta.LambdaAWSInfo) {
+	sender.RoleDefinition.Privileges = append(sender.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"states:StartExecution"},
+			Resource: gocf.Ref(broadcastStateMachineResourceName),
+		})
+	setEnvironment(sender, envKeyBroadcastStateMachineARN, gocf.Ref(broadcastStateMachineResourceName).String())
+}
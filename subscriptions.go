@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	"github.com/mweagle/SpartaWebSocket/topics"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	envKeySubscriptionsTableName   = "TOPIC_SUBSCRIPTIONS_TABLENAME"
+	topicSubscriptionsResourceName = "TopicSubscriptions"
+	// subscriptionsByConnectionIndex finds a connection's subscriptions so
+	// they can be removed when it disconnects
+	subscriptionsByConnectionIndex = "ByConnection"
+	// Subscriptions are keyed by the pattern's root and, since a connection
+	// can subscribe to several patterns with the same root, the pattern and
+	// subscriber
+	ddbAttributeTopicRoot    = "root"
+	ddbAttributeSubscription = "subscription"
+	ddbAttributeTopicPattern = "pattern"
+	topicMessage             = "topic"
+	attributeTopic           = "websocket.topic"
+	// ddbAttributeSubscriptionCount counts the connection item's topic
+	// subscriptions, which are bounded by maxConnectionSubscriptions since
+	// every publish reads the subscriptions of its topic's roots
+	ddbAttributeSubscriptionCount = "subscriptions"
+	maxConnectionSubscriptions    = 32
+)
+
+// topicSchema is the subscribe, unsubscribe, and publish request data
+// schema. The handlers check the topic syntax.
+var topicSchema = newRequestSchema(`{
+	"type": "object",
+	"required": ["topic"],
+	"properties": {
+		"topic": {"type": "string", "minLength": 1, "maxLength": 128}
+	}
+}`)
+
+// topicRequest is the data of a subscribe, unsubscribe, or publish frame.
+// Topic is a pattern when subscribing and unsubscribing. Data is only used
+// by publish.
+type topicRequest struct {
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// topicFrame is the data of the topic frame delivered to each subscriber
+type topicFrame struct {
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// subscriptionKey returns the subscription table key. The subscriber is the
+// connection ID or, for graphql-ws operations, the operationSubscriber.
+func subscriptionKey(pattern string, subscriber string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		ddbAttributeTopicRoot: &dynamodb.AttributeValue{
+			S: aws.String(topics.Root(pattern)),
+		},
+		ddbAttributeSubscription: &dynamodb.AttributeValue{
+			S: aws.String(pattern + " " + subscriber),
+		},
+	}
+}
+
+// subscribeTopic subscribes the sender to the topic pattern. Like a room
+// membership, the subscription copies the sender's negotiation so that
+// topic deliveries don't read the connection table. Subscribing is rate
+// limited like sending, and connections have at most
+// maxConnectionSubscriptions subscriptions.
+func subscribeTopic(ctx context.Context, call *wsCall[topicRequest]) (*statusResponse, error) {
+	// Preconditions
+	connectionID := call.request.RequestContext.ConnectionID
+	if rateLimited(ctx, call.sess, connectionID, call.dynamoClient, call.logger) {
+		return nil, call.fail(errorCodeRateLimited, catalog.RateLimited)
+	}
+	patternErr := topics.ValidatePattern(call.data.Topic)
+	if patternErr != nil {
+		return nil, call.fail(errorCodeMalformedRequest, catalog.InvalidTopic, patternErr.Error())
+	}
+	claimed, claimErr := claimConnectionSlots(ctx,
+		connectionID,
+		ddbAttributeSubscriptionCount,
+		1,
+		maxConnectionSubscriptions,
+		call.dynamoClient)
+	if claimErr != nil {
+		return nil, claimErr
+	}
+	if !claimed {
+		return nil, call.fail(errorCodeMalformedRequest, catalog.TopicLimit, maxConnectionSubscriptions)
+	}
+
+	// Operation
+	subscriptionItem := subscriptionKey(call.data.Topic, connectionID)
+	subscriptionItem[ddbAttributeTopicPattern] = &dynamodb.AttributeValue{
+		S: aws.String(call.data.Topic),
+	}
+	subscriptionItem[ddbAttributeConnectionID] = &dynamodb.AttributeValue{
+		S: aws.String(connectionID),
+	}
+	for _, eachAttribute := range negotiationAttributes {
+		if call.senderItem[eachAttribute] != nil {
+			subscriptionItem[eachAttribute] = call.senderItem[eachAttribute]
+		}
+	}
+	_, putItemErr := newDynamoClient(call.sess).PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(os.Getenv(envKeySubscriptionsTableName)),
+		Item:                subscriptionItem,
+		ConditionExpression: aws.String("attribute_not_exists(#subscription)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#subscription": aws.String(ddbAttributeSubscription),
+		},
+	})
+	if putItemErr != nil {
+		// Resubscribing doesn't use another slot
+		releaseConnectionSlots(ctx,
+			connectionID,
+			ddbAttributeSubscriptionCount,
+			1,
+			call.dynamoClient,
+			call.logger)
+		if !conditionalCheckFailed(putItemErr) {
+			return nil, putItemErr
+		}
+	}
+	return &statusResponse{
+		Message: catalog.Localize(call.locale, catalog.Subscribed, call.data.Topic),
+	}, nil
+}
+
+// unsubscribeTopic removes the sender's subscription to the topic pattern
+func unsubscribeTopic(ctx context.Context, call *wsCall[topicRequest]) (*statusResponse, error) {
+	// Preconditions
+	patternErr := topics.ValidatePattern(call.data.Topic)
+	if patternErr != nil {
+		return nil, call.fail(errorCodeMalformedRequest, catalog.InvalidTopic, patternErr.Error())
+	}
+
+	// Operation
+	connectionID := call.request.RequestContext.ConnectionID
+	deleted, deleteErr := deleteSubscription(ctx,
+		call.data.Topic,
+		connectionID,
+		newDynamoClient(call.sess))
+	if deleteErr != nil {
+		return nil, deleteErr
+	}
+	if deleted {
+		releaseConnectionSlots(ctx,
+			connectionID,
+			ddbAttributeSubscriptionCount,
+			1,
+			call.dynamoClient,
+			call.logger)
+	}
+	return &statusResponse{
+		Message: catalog.Localize(call.locale, catalog.Unsubscribed, call.data.Topic),
+	}, nil
+}
+
+// publishTopic delivers the request data to every connection subscribed to
+// a pattern that matches the topic. Published topics don't have wildcards,
+// and senders don't need to be subscribed. The data is moderated like
+// sendmessage data.
+func publishTopic(ctx context.Context, call *wsCall[topicRequest]) (*statusResponse, error) {
+	// Preconditions
+	if rateLimited(ctx, call.sess, call.request.RequestContext.ConnectionID, call.dynamoClient, call.logger) {
+		return nil, call.fail(errorCodeRateLimited, catalog.RateLimited)
+	}
+	topicErr := topics.ValidateTopic(call.data.Topic)
+	if topicErr != nil {
+		return nil, call.fail(errorCodeMalformedRequest, catalog.InvalidTopic, topicErr.Error())
+	}
+	moderatedData, delivered, moderateErr := moderateMessage(ctx, call, call.data.Data)
+	if moderateErr != nil {
+		return nil, moderateErr
+	}
+	if !delivered {
+		return nil, call.fail(errorCodeMessageRejected, catalog.MessageRejected)
+	}
+	call.data.Data = moderatedData
+
+	// Operation
+	requestID := call.request.RequestContext.RequestID
+	frameData, _ := json.Marshal(&topicFrame{
+		Topic: call.data.Topic,
+		Data:  call.data.Data,
+	})
+	stats, deliverErr := deliverTopic(ctx,
+		call.sess,
+		call.endpointURL,
+		requestID,
+		call.data.Topic,
+		frameData,
+		call.logger)
+	call.logger.WithFields(logrus.Fields{
+		"Topic": call.data.Topic,
+		"Stats": stats,
+	}).Info("Topic publish complete")
+	if deliverErr != nil {
+		return nil, deliverErr
+	}
+	forwardMessage(ctx, call.sess, call.request, &webhookEvent{
+		Type:  webhookTypeTopic,
+		Topic: call.data.Topic,
+		Data:  call.data.Data,
+	}, call.senderItem, call.logger)
+	return &statusResponse{
+		Message:       catalog.Localize(call.locale, catalog.DataSent),
+		CorrelationID: requestID,
+	}, nil
+}
+
+// deliverTopic delivers the frame to each connection with a subscription
+// that matches the topic. A connection whose subscriptions overlap receives
+// the frame once, and connections that are gone are unsubscribed.
+func deliverTopic(ctx context.Context,
+	sess *session.Session,
+	endpointURL string,
+	requestID string,
+	topic string,
+	frameData json.RawMessage,
+	logger *logrus.Logger) (stats deliveryStats, err error) {
+	ctx, span := startSpan(ctx, "broadcast.topic", attribute.String(attributeTopic, topic))
+	subscriptionsClient := newDynamoClient(sess)
+	bcast := newBroadcaster(ctx, sess, endpointURL, requestID, topicMessage, frameData, logger)
+	defer func() {
+		span.SetAttributes(attribute.Int(attributeConnections, bcast.stats.Recipients))
+		endSpan(span, err)
+	}()
+	bcast.onGone = func(ctx context.Context, connectionID string) {
+		unsubscribeAll(ctx, connectionID, subscriptionsClient, logger)
+	}
+	delivered := make(map[string]bool)
+	var queryErr error
+	for _, eachRoot := range topics.Roots(topic) {
+		queryErr = subscriptionsClient.QueryPagesWithContext(ctx,
+			&dynamodb.QueryInput{
+				TableName:              aws.String(os.Getenv(envKeySubscriptionsTableName)),
+				KeyConditionExpression: aws.String("#root = :root"),
+				ExpressionAttributeNames: map[string]*string{
+					"#root": aws.String(ddbAttributeTopicRoot),
+				},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":root": &dynamodb.AttributeValue{
+						S: aws.String(eachRoot),
+					},
+				},
+			},
+			func(output *dynamodb.QueryOutput, lastPage bool) bool {
+				var matching []map[string]*dynamodb.AttributeValue
+				for _, eachItem := range output.Items {
+					// graphql-ws operations are delivered individually, even
+					// if they share a connection
+					subscriber := itemString(eachItem, ddbAttributeConnectionID)
+					operationID := itemString(eachItem, ddbAttributeOperationID)
+					if operationID != "" {
+						subscriber = operationSubscriber(subscriber, operationID)
+					}
+					if delivered[subscriber] ||
+						!topics.Match(itemString(eachItem, ddbAttributeTopicPattern), topic) {
+						continue
+					}
+					delivered[subscriber] = true
+					if operationID != "" {
+						deliverOperation(ctx, bcast, eachItem, frameData)
+						continue
+					}
+					matching = append(matching, eachItem)
+				}
+				bcast.deliverItems(ctx, matching)
+				return true
+			})
+		if queryErr != nil {
+			break
+		}
+	}
+	return bcast.finish(ctx), queryErr
+}
+
+// deleteSubscription removes the subscriber's subscription to the pattern
+// and returns true if it existed
+func deleteSubscription(ctx context.Context,
+	pattern string,
+	subscriber string,
+	subscriptionsClient dynamodbiface.DynamoDBAPI) (bool, error) {
+	delItemOutput, delItemErr := subscriptionsClient.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:    aws.String(os.Getenv(envKeySubscriptionsTableName)),
+		Key:          subscriptionKey(pattern, subscriber),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if delItemErr != nil {
+		return false, delItemErr
+	}
+	return len(delItemOutput.Attributes) != 0, nil
+}
+
+// unsubscribeAll removes every subscription for the connection. It's a no-op
+// if the lambda doesn't have access to the subscription table.
+func unsubscribeAll(ctx context.Context,
+	connectionID string,
+	subscriptionsClient dynamodbiface.DynamoDBAPI,
+	logger *logrus.Logger) {
+	if os.Getenv(envKeySubscriptionsTableName) == "" {
+		return
+	}
+	var keys []map[string]*dynamodb.AttributeValue
+	queryErr := subscriptionsClient.QueryPagesWithContext(ctx,
+		&dynamodb.QueryInput{
+			TableName:              aws.String(os.Getenv(envKeySubscriptionsTableName)),
+			IndexName:              aws.String(subscriptionsByConnectionIndex),
+			KeyConditionExpression: aws.String("#connectionID = :connectionID"),
+			ExpressionAttributeNames: map[string]*string{
+				"#connectionID": aws.String(ddbAttributeConnectionID),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":connectionID": &dynamodb.AttributeValue{
+					S: aws.String(connectionID),
+				},
+			},
+		},
+		func(output *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, eachItem := range output.Items {
+				keys = append(keys, map[string]*dynamodb.AttributeValue{
+					ddbAttributeTopicRoot:    eachItem[ddbAttributeTopicRoot],
+					ddbAttributeSubscription: eachItem[ddbAttributeSubscription],
+				})
+			}
+			return true
+		})
+	if queryErr != nil {
+		logger.WithField("Error", queryErr).Warn("Failed to find topic subscriptions")
+		return
+	}
+	for _, eachKey := range keys {
+		_, delItemErr := subscriptionsClient.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(os.Getenv(envKeySubscriptionsTableName)),
+			Key:       eachKey,
+		})
+		if delItemErr != nil {
+			logger.WithFields(logrus.Fields{
+				"Error":        delItemErr,
+				"Subscription": itemString(eachKey, ddbAttributeSubscription),
+			}).Warn("Failed to unsubscribe")
+		}
+	}
+}
+
+// topicSubscriptionsDecorator provisions the topic subscription table.
+// Items are keyed by the pattern's root and the subscription, with a GSI to
+// find a connection's subscriptions.
+func topicSubscriptionsDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(topicSubscriptionsResourceName, &gocf.DynamoDBTable{
+		AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeTopicRoot),
+				AttributeType: gocf.String("S"),
+			},
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeSubscription),
+				AttributeType: gocf.String("S"),
+			},
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeConnectionID),
+				AttributeType: gocf.String("S"),
+			},
+		},
+		KeySchema: &gocf.DynamoDBTableKeySchemaList{
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeTopicRoot),
+				KeyType:       gocf.String("HASH"),
+			},
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeSubscription),
+				KeyType:       gocf.String("RANGE"),
+			},
+		},
+		GlobalSecondaryIndexes: &gocf.DynamoDBTableGlobalSecondaryIndexList{
+			gocf.DynamoDBTableGlobalSecondaryIndex{
+				IndexName: gocf.String(subscriptionsByConnectionIndex),
+				KeySchema: &gocf.DynamoDBTableKeySchemaList{
+					gocf.DynamoDBTableKeySchema{
+						AttributeName: gocf.String(ddbAttributeConnectionID),
+						KeyType:       gocf.String("HASH"),
+					},
+				},
+				Projection: &gocf.DynamoDBTableProjection{
+					ProjectionType: gocf.String("KEYS_ONLY"),
+				},
+			},
+		},
+		BillingMode: gocf.String("PAY_PER_REQUEST"),
+	})
+	return nil
+}
+
+// annotateTopicSubscriptions grants the lambda access to the topic
+// subscription table and publishes the table name in its environment
+func annotateTopicSubscriptions(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:PutItem",
+				"dynamodb:DeleteItem",
+				"dynamodb:Query"},
+			Resource: gocf.GetAtt(topicSubscriptionsResourceName, "Arn"),
+		},
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:Query"},
+			Resource: gocf.Join("",
+				gocf.GetAtt(topicSubscriptionsResourceName, "Arn"),
+				gocf.String("/index/*")),
+		})
+	setEnvironment(lambdaFn, envKeySubscriptionsTableName, gocf.Ref(topicSubscriptionsResourceName).String())
+}
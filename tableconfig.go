@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/connectiontable"
+	gocf "github.com/mweagle/go-cloudformation"
+)
+
+const (
+	// envKeyConnectionTableName is the physical name of the provisioned
+	// connection table. The empty string lets CloudFormation name it.
+	envKeyConnectionTableName = "CONNECTION_TABLE_NAME"
+	// envKeyConnectionIDAttribute is the connection table's hash key. It's
+	// published in the lambda environment, since every handler reads and
+	// writes connection items by it.
+	envKeyConnectionIDAttribute = "CONNECTION_ID_ATTRIBUTE"
+	// envKeyTableReadCapacity and envKeyTableWriteCapacity are the connection
+	// table's initial provisioned capacity. Zero read and write capacity
+	// provisions an on-demand table.
+	envKeyTableReadCapacity  = "CONNECTION_TABLE_READ_CAPACITY"
+	envKeyTableWriteCapacity = "CONNECTION_TABLE_WRITE_CAPACITY"
+
+	defaultConnectionIDAttribute = "connectionID"
+	defaultTableCapacity         = 5
+)
+
+// ddbAttributeConnectionID is the connection table's hash key
+var ddbAttributeConnectionID = connectionIDAttribute()
+
+// tableConfig names and sizes the connection table, so the same binary can
+// provision differently named stacks side by side
+type tableConfig struct {
+	// EnvKey is the lambda environment variable with the table name
+	EnvKey string
+	// Name is the physical table name, or the empty string to let
+	// CloudFormation name it
+	Name string
+	// ConnectionIDAttribute is the table's hash key
+	ConnectionIDAttribute string
+	// ReadCapacityUnits and WriteCapacityUnits are the initial provisioned
+	// capacity
+	ReadCapacityUnits  int64
+	WriteCapacityUnits int64
+}
+
+// connectionIDAttribute returns the configured connection ID attribute. In
+// the lambdas it's the provision-time value published by annotate.
+func connectionIDAttribute() string {
+	if attributeName := os.Getenv(envKeyConnectionIDAttribute); attributeName != "" {
+		return attributeName
+	}
+	return defaultConnectionIDAttribute
+}
+
+// tableCapacity returns the capacity in the environment variable, or the
+// default capacity if it's unset
+func tableCapacity(envKey string) (int64, error) {
+	value := os.Getenv(envKey)
+	if value == "" {
+		return defaultTableCapacity, nil
+	}
+	capacity, parseErr := strconv.ParseInt(value, 10, 64)
+	if parseErr != nil || capacity < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer: %q", envKey, value)
+	}
+	return capacity, nil
+}
+
+// newTableConfig returns the connection table configuration in the
+// environment, after any command line overrides
+func newTableConfig() (*tableConfig, error) {
+	readCapacity, readCapacityErr := tableCapacity(envKeyTableReadCapacity)
+	if readCapacityErr != nil {
+		return nil, readCapacityErr
+	}
+	writeCapacity, writeCapacityErr := tableCapacity(envKeyTableWriteCapacity)
+	if writeCapacityErr != nil {
+		return nil, writeCapacityErr
+	}
+	return &tableConfig{
+		EnvKey:                envKeyTableName,
+		Name:                  os.Getenv(envKeyConnectionTableName),
+		ConnectionIDAttribute: connectionIDAttribute(),
+		ReadCapacityUnits:     readCapacity,
+		WriteCapacityUnits:    writeCapacity,
+	}, nil
+}
+
+// options returns the decorator options for the configured table
+func (config *tableConfig) options() []connectiontable.Option {
+	var options []connectiontable.Option
+	if config.Name != "" {
+		options = append(options, connectiontable.WithTableName(config.Name))
+	}
+	return options
+}
+
+// decorator returns the decorator that provisions the configured table
+func (config *tableConfig) decorator(options ...connectiontable.Option) (*connectiontable.Decorator, error) {
+	return connectiontable.NewDecorator(config.EnvKey,
+		config.ConnectionIDAttribute,
+		config.ReadCapacityUnits,
+		config.WriteCapacityUnits,
+		append(options, config.options()...)...)
+}
+
+// annotate publishes the connection ID attribute in the lambda environment
+func (config *tableConfig) annotate(lambdaFn *sparta.LambdaAWSInfo) {
+	setEnvironment(lambdaFn, envKeyConnectionIDAttribute, gocf.String(config.ConnectionIDAttribute))
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	envKeyTagsTableName        = "CONNECTION_TAGS_TABLENAME"
+	connectionTagsResourceName = "ConnectionTags"
+	// tagsByConnectionIndex finds a connection's tags so they can be removed
+	// when it disconnects
+	tagsByConnectionIndex = "ByConnection"
+	ddbAttributeTag       = "tag"
+	// queryParamTags is the comma separated list of tags to attach at
+	// $connect
+	queryParamTags = "tags"
+	// maxConnectionTags bounds the tags per connection, which the connection
+	// item counts in ddbAttributeTagCount
+	maxConnectionTags    = 16
+	ddbAttributeTagCount = "tagCount"
+	attributeTag         = "websocket.tag"
+)
+
+// tagPattern matches valid tags
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+// tagSchema is the tag route's request data schema
+var tagSchema = newRequestSchema(`{
+	"type": "object",
+	"properties": {
+		"add": {
+			"type": "array",
+			"maxItems": 16,
+			"items": {"type": "string", "pattern": "^[A-Za-z0-9_.:-]{1,64}$"}
+		},
+		"remove": {
+			"type": "array",
+			"maxItems": 16,
+			"items": {"type": "string", "minLength": 1, "maxLength": 64}
+		}
+	}
+}`)
+
+// tagRequest is the data of a tag frame
+type tagRequest struct {
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// tagResponse is the tag route response body
+type tagResponse struct {
+	Tags []string `json:"tags"`
+}
+
+// tagKey returns the tag table key
+func tagKey(tag string, connectionID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		ddbAttributeTag: &dynamodb.AttributeValue{
+			S: aws.String(tag),
+		},
+		ddbAttributeConnectionID: &dynamodb.AttributeValue{
+			S: aws.String(connectionID),
+		},
+	}
+}
+
+// handshakeTags returns the distinct valid tags of the $connect query
+// string, up to the limit. Tags are chosen by the client, so they route
+// broadcasts rather than restrict them: any connection can tag itself with
+// any tag and receive the broadcasts to it.
+func handshakeTags(request awsEvents.APIGatewayWebsocketProxyRequest) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, eachTag := range strings.Split(request.QueryStringParameters[queryParamTags], ",") {
+		eachTag = strings.TrimSpace(eachTag)
+		if tagPattern.MatchString(eachTag) && !seen[eachTag] && len(tags) < maxConnectionTags {
+			seen[eachTag] = true
+			tags = append(tags, eachTag)
+		}
+	}
+	return tags
+}
+
+// putTags attaches the tags to the connection and returns the number of
+// tags it didn't already have. Like a room membership, each tag item copies
+// the connection's negotiation so that tag broadcasts don't read the
+// connection table. It's a no-op if the lambda doesn't have access to the
+// tag table.
+func putTags(ctx context.Context,
+	connectionID string,
+	connectionItem map[string]*dynamodb.AttributeValue,
+	tags []string,
+	tagsClient dynamodbiface.DynamoDBAPI) (int, error) {
+	if os.Getenv(envKeyTagsTableName) == "" {
+		return 0, nil
+	}
+	added := 0
+	for _, eachTag := range tags {
+		tagItem := tagKey(eachTag, connectionID)
+		for _, eachAttribute := range negotiationAttributes {
+			if connectionItem[eachAttribute] != nil {
+				tagItem[eachAttribute] = connectionItem[eachAttribute]
+			}
+		}
+		_, putItemErr := tagsClient.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(os.Getenv(envKeyTagsTableName)),
+			Item:                tagItem,
+			ConditionExpression: aws.String("attribute_not_exists(#tag)"),
+			ExpressionAttributeNames: map[string]*string{
+				"#tag": aws.String(ddbAttributeTag),
+			},
+		})
+		if conditionalCheckFailed(putItemErr) {
+			continue
+		}
+		if putItemErr != nil {
+			return added, putItemErr
+		}
+		added++
+	}
+	return added, nil
+}
+
+// connectionTags returns the connection's tags
+func connectionTags(ctx context.Context,
+	connectionID string,
+	tagsClient dynamodbiface.DynamoDBAPI) ([]string, error) {
+	var tags []string
+	queryErr := tagsClient.QueryPagesWithContext(ctx,
+		&dynamodb.QueryInput{
+			TableName:              aws.String(os.Getenv(envKeyTagsTableName)),
+			IndexName:              aws.String(tagsByConnectionIndex),
+			KeyConditionExpression: aws.String("#connectionID = :connectionID"),
+			ExpressionAttributeNames: map[string]*string{
+				"#connectionID": aws.String(ddbAttributeConnectionID),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":connectionID": &dynamodb.AttributeValue{
+					S: aws.String(connectionID),
+				},
+			},
+		},
+		func(output *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, eachItem := range output.Items {
+				if tag := itemString(eachItem, ddbAttributeTag); tag != "" {
+					tags = append(tags, tag)
+				}
+			}
+			return true
+		})
+	return tags, queryErr
+}
+
+// deleteTag removes the tag from the connection and returns true if the
+// connection had it
+func deleteTag(ctx context.Context,
+	tag string,
+	connectionID string,
+	tagsClient dynamodbiface.DynamoDBAPI) (bool, error) {
+	delItemOutput, delItemErr := tagsClient.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:    aws.String(os.Getenv(envKeyTagsTableName)),
+		Key:          tagKey(tag, connectionID),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if delItemErr != nil {
+		return false, delItemErr
+	}
+	return len(delItemOutput.Attributes) != 0, nil
+}
+
+// tagConnection adds and removes the sender's tags and responds with the
+// connection's tags. Removals apply after additions, so a tag in both lists
+// is removed. The added tags are claimed against the connection item's tag
+// count first, so concurrent requests can't exceed maxConnectionTags.
+func tagConnection(ctx context.Context, call *wsCall[tagRequest]) (*tagResponse, error) {
+	// Preconditions
+	connectionID := call.request.RequestContext.ConnectionID
+	tagsClient := newDynamoClient(call.sess)
+	existing, existingErr := connectionTags(ctx, connectionID, tagsClient)
+	if existingErr != nil {
+		return nil, existingErr
+	}
+	tags := make(map[string]bool, len(existing))
+	for _, eachTag := range existing {
+		tags[eachTag] = true
+	}
+	var added []string
+	for _, eachTag := range call.data.Add {
+		if !tagPattern.MatchString(eachTag) {
+			return nil, call.fail(errorCodeMalformedRequest, catalog.InvalidTag, maxConnectionTags)
+		}
+		if !tags[eachTag] {
+			tags[eachTag] = true
+			added = append(added, eachTag)
+		}
+	}
+	for _, eachTag := range call.data.Remove {
+		delete(tags, eachTag)
+	}
+	if len(tags) > maxConnectionTags {
+		return nil, call.fail(errorCodeMalformedRequest, catalog.InvalidTag, maxConnectionTags)
+	}
+
+	// Operation
+	var kept []string
+	for _, eachTag := range added {
+		if tags[eachTag] {
+			kept = append(kept, eachTag)
+		}
+	}
+	claimed, claimErr := claimConnectionSlots(ctx,
+		connectionID,
+		ddbAttributeTagCount,
+		len(kept),
+		maxConnectionTags,
+		call.dynamoClient)
+	if claimErr != nil {
+		return nil, claimErr
+	}
+	if !claimed {
+		return nil, call.fail(errorCodeMalformedRequest, catalog.InvalidTag, maxConnectionTags)
+	}
+	putCount, putErr := putTags(ctx, connectionID, call.senderItem, kept, tagsClient)
+	// Tags that a concurrent request added, or that weren't added, don't
+	// use their slots
+	releaseConnectionSlots(ctx, connectionID, ddbAttributeTagCount, len(kept)-putCount, call.dynamoClient, call.logger)
+	if putErr != nil {
+		return nil, putErr
+	}
+	removedCount := 0
+	for _, eachTag := range call.data.Remove {
+		deleted, deleteErr := deleteTag(ctx, eachTag, connectionID, tagsClient)
+		if deleteErr != nil {
+			releaseConnectionSlots(ctx, connectionID, ddbAttributeTagCount, removedCount, call.dynamoClient, call.logger)
+			return nil, deleteErr
+		}
+		if deleted {
+			removedCount++
+		}
+	}
+	releaseConnectionSlots(ctx, connectionID, ddbAttributeTagCount, removedCount, call.dynamoClient, call.logger)
+	response := &tagResponse{
+		Tags: make([]string, 0, len(tags)),
+	}
+	for eachTag := range tags {
+		response.Tags = append(response.Tags, eachTag)
+	}
+	sort.Strings(response.Tags)
+	call.logger.WithField("Tags", response.Tags).Debug("Updated connection tags")
+	return response, nil
+}
+
+// deliverTag delivers the broadcast payload to every connection with the
+// tag other than the excluded connection, if any. Like a broadcast, the
+// tagged connections are split into FANOUT_SEGMENTS ranges of connection
+// IDs, each delivered by an invocation of the delivery lambda, when the
+// sender can invoke it. Connections that are gone are untagged.
+func deliverTag(ctx context.Context,
+	sess *session.Session,
+	endpointURL string,
+	requestID string,
+	tag string,
+	payload json.RawMessage,
+	binary bool,
+	excluded string,
+	logger *logrus.Logger) (stats deliveryStats, err error) {
+	ctx, span := startSpan(ctx, "broadcast.tag", attribute.String(attributeTag, tag))
+	defer func() {
+		span.SetAttributes(attribute.Int(attributeConnections, stats.Recipients))
+		endSpan(span, err)
+	}()
+	tagsClient := newDynamoClient(sess)
+	totalSegments := runtimeFanoutSegments(ctx, sess, logger)
+	functionName := os.Getenv(envKeyDeliveryFunction)
+	if totalSegments >= 2 && functionName != "" {
+		connectionIDs, connectionIDsErr := taggedConnectionIDs(ctx, tag, tagsClient)
+		if connectionIDsErr != nil {
+			return stats, connectionIDsErr
+		}
+		segmentSize := (int64(len(connectionIDs)) + totalSegments - 1) / totalSegments
+		var requests []*segmentRequest
+		for start := int64(0); start < int64(len(connectionIDs)); start += segmentSize {
+			end := start + segmentSize
+			if end > int64(len(connectionIDs)) {
+				end = int64(len(connectionIDs))
+			}
+			requests = append(requests, &segmentRequest{
+				EndpointURL:          endpointURL,
+				RequestID:            requestID,
+				Payload:              payload,
+				Binary:               binary,
+				Segment:              int64(len(requests)),
+				TotalSegments:        totalSegments,
+				ExcludedConnectionID: excluded,
+				Tag:                  tag,
+				FirstConnectionID:    connectionIDs[start],
+				LastConnectionID:     connectionIDs[end-1],
+			})
+		}
+		return invokeSegments(ctx, sess, functionName, requests, logger)
+	}
+	bcast := newBroadcaster(ctx, sess, endpointURL, requestID, broadcastMessage, payload, logger)
+	bcast.frames.binary = binary
+	bcast.excluded = excluded
+	queryErr := bcast.queryTag(ctx, tagsClient, tag, "", "")
+	return bcast.finish(ctx), queryErr
+}
+
+// taggedConnectionIDs returns the IDs of the connections with the tag, in
+// order
+func taggedConnectionIDs(ctx context.Context,
+	tag string,
+	tagsClient dynamodbiface.DynamoDBAPI) ([]string, error) {
+	var connectionIDs []string
+	queryErr := tagsClient.QueryPagesWithContext(ctx,
+		&dynamodb.QueryInput{
+			TableName:              aws.String(os.Getenv(envKeyTagsTableName)),
+			KeyConditionExpression: aws.String("#tag = :tag"),
+			ProjectionExpression:   aws.String("#connectionID"),
+			ExpressionAttributeNames: map[string]*string{
+				"#tag":          aws.String(ddbAttributeTag),
+				"#connectionID": aws.String(ddbAttributeConnectionID),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":tag": &dynamodb.AttributeValue{
+					S: aws.String(tag),
+				},
+			},
+		},
+		func(output *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, eachItem := range output.Items {
+				if connectionID := itemString(eachItem, ddbAttributeConnectionID); connectionID != "" {
+					connectionIDs = append(connectionIDs, connectionID)
+				}
+			}
+			return true
+		})
+	return connectionIDs, queryErr
+}
+
+// queryTag delivers to the connections with the tag and, if first is set,
+// an ID from first through last. Connections that are gone are untagged.
+func (bcast *broadcaster) queryTag(ctx context.Context,
+	tagsClient dynamodbiface.DynamoDBAPI,
+	tag string,
+	first string,
+	last string) error {
+	bcast.onGone = func(ctx context.Context, connectionID string) {
+		untagAll(ctx, connectionID, tagsClient, bcast.logger)
+	}
+	queryInput := &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv(envKeyTagsTableName)),
+		KeyConditionExpression: aws.String("#tag = :tag"),
+		ExpressionAttributeNames: map[string]*string{
+			"#tag": aws.String(ddbAttributeTag),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":tag": &dynamodb.AttributeValue{
+				S: aws.String(tag),
+			},
+		},
+	}
+	if first != "" {
+		queryInput.KeyConditionExpression = aws.String("#tag = :tag AND #connectionID BETWEEN :first AND :last")
+		queryInput.ExpressionAttributeNames["#connectionID"] = aws.String(ddbAttributeConnectionID)
+		queryInput.ExpressionAttributeValues[":first"] = &dynamodb.AttributeValue{
+			S: aws.String(first),
+		}
+		queryInput.ExpressionAttributeValues[":last"] = &dynamodb.AttributeValue{
+			S: aws.String(last),
+		}
+	}
+	return tagsClient.QueryPagesWithContext(ctx,
+		queryInput,
+		func(output *dynamodb.QueryOutput, lastPage bool) bool {
+			bcast.deliverItems(ctx, output.Items)
+			return true
+		})
+}
+
+// untagAll removes every tag from the connection. It's a no-op if the lambda
+// doesn't have access to the tag table.
+func untagAll(ctx context.Context,
+	connectionID string,
+	tagsClient dynamodbiface.DynamoDBAPI,
+	logger *logrus.Logger) {
+	if os.Getenv(envKeyTagsTableName) == "" {
+		return
+	}
+	tags, tagsErr := connectionTags(ctx, connectionID, tagsClient)
+	if tagsErr != nil {
+		logger.WithField("Error", tagsErr).Warn("Failed to find connection tags")
+		return
+	}
+	for _, eachTag := range tags {
+		_, deleteErr := deleteTag(ctx, eachTag, connectionID, tagsClient)
+		if deleteErr != nil {
+			logger.WithFields(logrus.Fields{
+				"Error": deleteErr,
+				"Tag":   eachTag,
+			}).Warn("Failed to untag connection")
+		}
+	}
+}
+
+// connectionTagsDecorator provisions the connection tag table. Items are
+// keyed by tag and connection ID, with a GSI to find a connection's tags.
+func connectionTagsDecorator(context map[string]interface{},
+	serviceName string,
+	template *gocf.Template,
+	S3Bucket string,
+	S3Key string,
+	buildID string,
+	awsSession *session.Session,
+	noop bool,
+	logger *logrus.Logger) error {
+	template.AddResource(connectionTagsResourceName, &gocf.DynamoDBTable{
+		AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeTag),
+				AttributeType: gocf.String("S"),
+			},
+			gocf.DynamoDBTableAttributeDefinition{
+				AttributeName: gocf.String(ddbAttributeConnectionID),
+				AttributeType: gocf.String("S"),
+			},
+		},
+		KeySchema: &gocf.DynamoDBTableKeySchemaList{
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeTag),
+				KeyType:       gocf.String("HASH"),
+			},
+			gocf.DynamoDBTableKeySchema{
+				AttributeName: gocf.String(ddbAttributeConnectionID),
+				KeyType:       gocf.String("RANGE"),
+			},
+		},
+		GlobalSecondaryIndexes: &gocf.DynamoDBTableGlobalSecondaryIndexList{
+			gocf.DynamoDBTableGlobalSecondaryIndex{
+				IndexName: gocf.String(tagsByConnectionIndex),
+				KeySchema: &gocf.DynamoDBTableKeySchemaList{
+					gocf.DynamoDBTableKeySchema{
+						AttributeName: gocf.String(ddbAttributeConnectionID),
+						KeyType:       gocf.String("HASH"),
+					},
+					gocf.DynamoDBTableKeySchema{
+						AttributeName: gocf.String(ddbAttributeTag),
+						KeyType:       gocf.String("RANGE"),
+					},
+				},
+				Projection: &gocf.DynamoDBTableProjection{
+					ProjectionType: gocf.String("KEYS_ONLY"),
+				},
+			},
+		},
+		BillingMode: gocf.String("PAY_PER_REQUEST"),
+	})
+	return nil
+}
+
+// annotateConnectionTags grants the lambda access to the connection tag
+// table and publishes the table name in its environment
+func annotateConnectionTags(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:PutItem",
+				"dynamodb:DeleteItem",
+				"dynamodb:Query"},
+			Resource: gocf.GetAtt(connectionTagsResourceName, "Arn"),
+		},
+		sparta.IAMRolePrivilege{
+			Actions: []string{"dynamodb:Query"},
+			Resource: gocf.Join("",
+				gocf.GetAtt(connectionTagsResourceName, "Arn"),
+				gocf.String("/index/*")),
+		})
+	setEnvironment(lambdaFn, envKeyTagsTableName, gocf.Ref(connectionTagsResourceName).String())
+}
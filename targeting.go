@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/mweagle/SpartaWebSocket/filter"
+	"github.com/sirupsen/logrus"
+)
+
+// maxDeliveryTargets bounds the connections and users that a sendmessage
+// frame can target, since targeted messages are delivered by the sender
+const maxDeliveryTargets = 100
+
+// deliveryTargets is the part of a JSON text frame that picks the
+// sendmessage audience alongside the data. Without To or ToUsers the
+// message is broadcast to every connection, or with Filter, to every
+// connection whose attributes match.
+type deliveryTargets struct {
+	// ExcludeSelf skips the sender's connection
+	ExcludeSelf bool `json:"excludeSelf"`
+	// To lists the connection IDs to deliver to
+	To []string `json:"to"`
+	// ToUsers lists the user IDs whose connections are delivered to
+	ToUsers []string `json:"toUsers"`
+	// Filter is the attribute filter expression of the connections to
+	// deliver to, eg region=eu AND plan=pro
+	Filter string `json:"filter"`
+	// Tag delivers to the connections with the tag. It can't be combined
+	// with the other targets or the filter, since tag lookups don't read the
+	// connection items.
+	Tag string `json:"tag"`
+}
+
+// everyone returns true if the message is broadcast to every connection,
+// other than the sender's if it's excluded
+func (targets *deliveryTargets) everyone() bool {
+	return !targets.targeted() && targets.Filter == "" && targets.Tag == ""
+}
+
+// targeted returns true if the message is delivered to the listed
+// connections and users rather than broadcast
+func (targets *deliveryTargets) targeted() bool {
+	return len(targets.To) != 0 || len(targets.ToUsers) != 0
+}
+
+// excluded returns the connection that isn't delivered to, or the empty
+// string
+func (targets *deliveryTargets) excluded(request awsEvents.APIGatewayWebsocketProxyRequest) string {
+	if targets.ExcludeSelf {
+		return request.RequestContext.ConnectionID
+	}
+	return ""
+}
+
+// targetingKeys are the JSON properties of the deliveryTargets
+var targetingKeys = []string{"excludeSelf", "to", "toUsers", "filter", "tag"}
+
+// requestTargets returns the delivery targets of a JSON text frame. Binary
+// frames and frames that aren't JSON objects with a targeting property don't
+// carry any, so they're broadcast. A targeting property of the wrong type is
+// an error rather than a broadcast, since it most likely names a private
+// audience.
+func requestTargets(request awsEvents.APIGatewayWebsocketProxyRequest) (*deliveryTargets, error) {
+	targets := &deliveryTargets{}
+	if request.IsBase64Encoded {
+		return targets, nil
+	}
+	var properties map[string]json.RawMessage
+	if json.Unmarshal([]byte(request.Body), &properties) != nil {
+		return targets, nil
+	}
+	targeted := false
+	for _, eachKey := range targetingKeys {
+		if _, exists := properties[eachKey]; exists {
+			targeted = true
+		}
+	}
+	if !targeted {
+		return targets, nil
+	}
+	unmarshalErr := json.Unmarshal([]byte(request.Body), targets)
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("invalid delivery targets: %s", unmarshalErr)
+	}
+	if len(targets.To)+len(targets.ToUsers) > maxDeliveryTargets {
+		return nil, fmt.Errorf("to and toUsers exceed %d targets", maxDeliveryTargets)
+	}
+	for _, eachConnectionID := range targets.To {
+		if eachConnectionID == "" {
+			return nil, fmt.Errorf("to has an empty connection ID")
+		}
+	}
+	for _, eachUserID := range targets.ToUsers {
+		if eachUserID == "" || len(eachUserID) > maxUserIDLength {
+			return nil, fmt.Errorf("toUsers has an invalid user ID: %q", eachUserID)
+		}
+	}
+	if targets.Tag != "" {
+		if targets.targeted() || targets.Filter != "" {
+			return nil, fmt.Errorf("tag can't be combined with to, toUsers, or filter")
+		}
+		if !tagPattern.MatchString(targets.Tag) {
+			return nil, fmt.Errorf("invalid tag: %q", targets.Tag)
+		}
+	}
+	if targets.Filter != "" {
+		_, filterErr := filter.Parse(targets.Filter)
+		if filterErr != nil {
+			return nil, fmt.Errorf("invalid filter: %s", filterErr)
+		}
+	}
+	return targets, nil
+}
+
+// deliverTargeted delivers the message to the targeted connections and to
+// each connection of the targeted users that matches the filter, if any.
+// Connections that are listed more than once are delivered to once, and
+// connections that don't exist are skipped.
+func deliverTargeted(ctx context.Context,
+	sess *session.Session,
+	endpointURL string,
+	requestID string,
+	payload json.RawMessage,
+	binary bool,
+	targets *deliveryTargets,
+	excluded string,
+	logger *logrus.Logger) (deliveryStats, error) {
+	bcast := newBroadcaster(ctx, sess, endpointURL, requestID, broadcastMessage, payload, logger)
+	bcast.frames.binary = binary
+	bcast.excluded = excluded
+	filterErr := bcast.filterBy(targets.Filter)
+	if filterErr != nil {
+		return deliveryStats{}, filterErr
+	}
+	delivered := make(map[string]bool)
+	var connectionIDs []string
+	for _, eachConnectionID := range targets.To {
+		if !delivered[eachConnectionID] {
+			delivered[eachConnectionID] = true
+			connectionIDs = append(connectionIDs, eachConnectionID)
+		}
+	}
+	targetErr := bcast.deliverConnections(ctx, connectionIDs)
+	store := newConnectionIndex(bcast.dynamoClient)
+	for _, eachUserID := range targets.ToUsers {
+		if targetErr != nil {
+			break
+		}
+		userItems, userItemsErr := store.UserConnections(ctx, eachUserID)
+		if userItemsErr != nil {
+			targetErr = userItemsErr
+			break
+		}
+		items := make([]map[string]*dynamodb.AttributeValue, 0, len(userItems))
+		for _, eachItem := range userItems {
+			if eachItem[ddbAttributeConnectionID] == nil || eachItem[ddbAttributeConnectionID].S == nil {
+				continue
+			}
+			connectionID := *eachItem[ddbAttributeConnectionID].S
+			if !delivered[connectionID] {
+				delivered[connectionID] = true
+				items = append(items, eachItem)
+			}
+		}
+		bcast.deliverItems(ctx, items)
+	}
+	return bcast.finish(ctx), targetErr
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+)
+
+func TestRequestTargets(t *testing.T) {
+	manyTargets := make([]string, maxDeliveryTargets+1)
+	for eachIndex := range manyTargets {
+		manyTargets[eachIndex] = fmt.Sprintf(`"conn-%d"`, eachIndex)
+	}
+	tests := []struct {
+		name    string
+		body    string
+		binary  bool
+		targets *deliveryTargets
+	}{
+		{name: "binary frame",
+			body:    `eyJ0byI6ImFiYyJ9`,
+			binary:  true,
+			targets: &deliveryTargets{}},
+		{name: "not JSON",
+			body:    `hello`,
+			targets: &deliveryTargets{}},
+		{name: "JSON array",
+			body:    `["to"]`,
+			targets: &deliveryTargets{}},
+		{name: "no targeting keys",
+			body:    `{"message":"hello"}`,
+			targets: &deliveryTargets{}},
+		{name: "exclude self",
+			body:    `{"excludeSelf":true}`,
+			targets: &deliveryTargets{ExcludeSelf: true}},
+		{name: "connections and users",
+			body: `{"to":["conn-1"],"toUsers":["alice"]}`,
+			targets: &deliveryTargets{
+				To:      []string{"conn-1"},
+				ToUsers: []string{"alice"},
+			}},
+		{name: "filter",
+			body:    `{"filter":"region=eu AND plan=pro"}`,
+			targets: &deliveryTargets{Filter: "region=eu AND plan=pro"}},
+		{name: "tag",
+			body:    `{"tag":"beta-testers"}`,
+			targets: &deliveryTargets{Tag: "beta-testers"}},
+		{name: "mistyped to", body: `{"to":"abc"}`},
+		{name: "mistyped toUsers", body: `{"toUsers":{}}`},
+		{name: "mistyped filter", body: `{"filter":5}`},
+		{name: "mistyped excludeSelf", body: `{"excludeSelf":"yes"}`},
+		{name: "too many targets", body: `{"to":[` + strings.Join(manyTargets, ",") + `]}`},
+		{name: "empty connection ID", body: `{"to":[""]}`},
+		{name: "empty user ID", body: `{"toUsers":[""]}`},
+		{name: "long user ID", body: `{"toUsers":["` + strings.Repeat("u", maxUserIDLength+1) + `"]}`},
+		{name: "invalid filter", body: `{"filter":"region="}`},
+		{name: "invalid tag", body: `{"tag":"beta testers"}`},
+		{name: "tag with to", body: `{"tag":"beta","to":["conn-1"]}`},
+		{name: "tag with filter", body: `{"tag":"beta","filter":"region=eu"}`},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			targets, targetsErr := requestTargets(awsEvents.APIGatewayWebsocketProxyRequest{
+				Body:            eachTest.body,
+				IsBase64Encoded: eachTest.binary,
+			})
+			if eachTest.targets == nil {
+				if targetsErr == nil {
+					t.Errorf("requestTargets(%s) = %+v, want an error", eachTest.body, targets)
+				}
+				return
+			}
+			if targetsErr != nil {
+				t.Fatalf("requestTargets(%s) failed: %s", eachTest.body, targetsErr)
+			}
+			if !reflect.DeepEqual(targets, eachTest.targets) {
+				t.Errorf("requestTargets(%s) = %+v, want %+v", eachTest.body, targets, eachTest.targets)
+			}
+		})
+	}
+}
+
+func TestDeliveryTargetsAudience(t *testing.T) {
+	tests := []struct {
+		targets  deliveryTargets
+		everyone bool
+		targeted bool
+	}{
+		{deliveryTargets{}, true, false},
+		{deliveryTargets{ExcludeSelf: true}, true, false},
+		{deliveryTargets{To: []string{"conn-1"}}, false, true},
+		{deliveryTargets{ToUsers: []string{"alice"}}, false, true},
+		{deliveryTargets{Filter: "region=eu"}, false, false},
+		{deliveryTargets{Tag: "beta"}, false, false},
+	}
+	for _, eachTest := range tests {
+		if everyone := eachTest.targets.everyone(); everyone != eachTest.everyone {
+			t.Errorf("%+v everyone() = %t, want %t", eachTest.targets, everyone, eachTest.everyone)
+		}
+		if targeted := eachTest.targets.targeted(); targeted != eachTest.targeted {
+			t.Errorf("%+v targeted() = %t, want %t", eachTest.targets, targeted, eachTest.targeted)
+		}
+	}
+}
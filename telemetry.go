@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// The standard OpenTelemetry exporter variables. Setting the endpoint at
+	// provision time enables the export, eg to an ADOT collector extension
+	// (http://localhost:4318) or to Honeycomb (https://api.honeycomb.io with
+	// OTEL_EXPORTER_OTLP_HEADERS=x-honeycomb-team=<key>).
+	envKeyOTLPEndpoint = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	envKeyOTLPHeaders  = "OTEL_EXPORTER_OTLP_HEADERS"
+	envKeyOTelService  = "OTEL_SERVICE_NAME"
+	// instrumentationName identifies the tracer and meter
+	instrumentationName = "github.com/mweagle/SpartaWebSocket"
+	// Metric instrument names
+	instrumentDeliveries = "websocket.deliveries"
+	instrumentCleanups   = "websocket.cleanups"
+	// Span and metric attributes
+	attributeOutcome       = "outcome"
+	attributeSegment       = "websocket.segment"
+	attributeTotalSegments = "websocket.total_segments"
+	attributeScanSegments  = "websocket.scan_segments"
+	attributeCached        = "websocket.cached"
+	attributeConnections   = "websocket.connections"
+	attributeFailed        = "websocket.failed"
+	attributeRouteKey      = "websocket.route_key"
+	attributeConnectionID  = "websocket.connection_id"
+)
+
+// otelProviders are created once per container. The lambda may be frozen as
+// soon as the handler returns, so every invocation flushes the providers
+// rather than relying on their background export.
+type otelProviders struct {
+	once           sync.Once
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+	deliveries     metric.Int64Counter
+	cleanups       metric.Int64Counter
+}
+
+// telemetry is shared by every invocation in the container
+var telemetry = &otelProviders{}
+
+// telemetryEnabled returns true if an OTLP endpoint is configured
+func telemetryEnabled() bool {
+	return os.Getenv(envKeyOTLPEndpoint) != ""
+}
+
+// init creates the exporters and registers the global providers. When
+// telemetry isn't configured the global no-op providers are left in place.
+func (providers *otelProviders) init(ctx context.Context, logger *logrus.Logger) {
+	providers.once.Do(func() {
+		if telemetryEnabled() {
+			serviceResource := resource.NewSchemaless(
+				attribute.String("service.name", telemetryServiceName()),
+				attribute.String("faas.name", lambdacontext.FunctionName),
+				attribute.String("faas.version", lambdacontext.FunctionVersion),
+				attribute.String("cloud.provider", "aws"),
+				attribute.String("cloud.region", os.Getenv("AWS_REGION")))
+			traceExporter, traceExporterErr := otlptracehttp.New(ctx)
+			if traceExporterErr != nil {
+				logger.WithField("Error", traceExporterErr).Warn("Failed to create OTLP trace exporter")
+			} else {
+				providers.tracerProvider = sdktrace.NewTracerProvider(
+					sdktrace.WithBatcher(traceExporter),
+					sdktrace.WithResource(serviceResource))
+				otel.SetTracerProvider(providers.tracerProvider)
+			}
+			metricExporter, metricExporterErr := otlpmetrichttp.New(ctx)
+			if metricExporterErr != nil {
+				logger.WithField("Error", metricExporterErr).Warn("Failed to create OTLP metric exporter")
+			} else {
+				providers.meterProvider = sdkmetric.NewMeterProvider(
+					sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)),
+					sdkmetric.WithResource(serviceResource))
+				otel.SetMeterProvider(providers.meterProvider)
+			}
+			otel.SetTextMapPropagator(propagation.TraceContext{})
+		}
+		meter := otel.Meter(instrumentationName)
+		providers.deliveries, _ = meter.Int64Counter(instrumentDeliveries,
+			metric.WithDescription("Broadcast frame deliveries by outcome"))
+		providers.cleanups, _ = meter.Int64Counter(instrumentCleanups,
+			metric.WithDescription("Gone connection cleanups by outcome"))
+	})
+}
+
+// flush exports the spans and metrics recorded by the invocation
+func (providers *otelProviders) flush(ctx context.Context, logger *logrus.Logger) {
+	if providers.tracerProvider != nil {
+		flushErr := providers.tracerProvider.ForceFlush(ctx)
+		if flushErr != nil {
+			logger.WithField("Error", flushErr).Warn("Failed to export spans")
+		}
+	}
+	if providers.meterProvider != nil {
+		flushErr := providers.meterProvider.ForceFlush(ctx)
+		if flushErr != nil {
+			logger.WithField("Error", flushErr).Warn("Failed to export OpenTelemetry metrics")
+		}
+	}
+}
+
+// recordDeliveries adds the broadcast stats to the deliveries counter
+func (providers *otelProviders) recordDeliveries(ctx context.Context, stats deliveryStats) {
+	if providers.deliveries == nil {
+		return
+	}
+	for outcome, count := range map[string]int{
+		"delivered": stats.Delivered,
+		"failed":    stats.Failed,
+		"gone":      stats.Gone,
+		"skipped":   stats.Skipped,
+	} {
+		if count != 0 {
+			providers.deliveries.Add(ctx, int64(count),
+				metric.WithAttributes(attribute.String(attributeOutcome, outcome)))
+		}
+	}
+}
+
+// recordCleanup counts a gone connection cleanup with the given outcome
+// (queued, deleted, or failed)
+func (providers *otelProviders) recordCleanup(ctx context.Context, outcome string, count int) {
+	if providers.cleanups == nil || count == 0 {
+		return
+	}
+	providers.cleanups.Add(ctx, int64(count),
+		metric.WithAttributes(attribute.String(attributeOutcome, outcome)))
+}
+
+// telemetryServiceName returns the service name reported with every span
+func telemetryServiceName() string {
+	if serviceName := os.Getenv(envKeyOTelService); serviceName != "" {
+		return serviceName
+	}
+	return lambdacontext.FunctionName
+}
+
+// tracer returns the tracer for handler spans
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// startSpan starts a child span of the span in the context
+func startSpan(ctx context.Context,
+	name string,
+	attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startInvocation starts the root span for a lambda invocation. The returned
+// function ends the span with the handler's error and flushes the exporters.
+func startInvocation(ctx context.Context,
+	name string,
+	attributes ...attribute.KeyValue) (context.Context, func(err error)) {
+	logger := contextLogger(ctx)
+	applyStageLogLevel(logger)
+	telemetry.init(ctx, logger)
+	if lambdaContext, ok := lambdacontext.FromContext(ctx); ok {
+		attributes = append(attributes,
+			attribute.String("faas.execution", lambdaContext.AwsRequestID))
+	}
+	spanCtx, span := tracer().Start(ctx,
+		name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attributes...))
+	return spanCtx, func(err error) {
+		endSpan(span, err)
+		telemetry.flush(ctx, logger)
+	}
+}
+
+// withTracing wraps the WebSocket handler in an invocation span
+func withTracing(handler wsHandler) wsHandler {
+	return func(ctx context.Context,
+		request awsEvents.APIGatewayWebsocketProxyRequest) (response *wsResponse, err error) {
+		spanCtx, finish := startInvocation(ctx,
+			request.RequestContext.RouteKey,
+			attribute.String(attributeRouteKey, request.RequestContext.RouteKey),
+			attribute.String(attributeConnectionID, request.RequestContext.ConnectionID))
+		defer func() {
+			finish(err)
+		}()
+		return handler(spanCtx, request)
+	}
+}
+
+// injectTraceContext returns the W3C trace context carrier for the span in
+// the context so that an invoked lambda continues the trace
+func injectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// extractTraceContext returns a context whose remote parent is the span in
+// the carrier
+func extractTraceContext(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// annotateTelemetry publishes the provision-time exporter configuration in
+// the lambda environment
+func annotateTelemetry(lambdaFn *sparta.LambdaAWSInfo) {
+	for _, eachKey := range []string{envKeyOTLPEndpoint,
+		envKeyOTLPHeaders,
+		envKeyOTelService} {
+		if value := os.Getenv(eachKey); value != "" {
+			setEnvironment(lambdaFn, eachKey, gocf.String(value))
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Provision-time environment variables that throttle messages at the
+	// gateway. STAGE_THROTTLING is the stage default and ROUTE_THROTTLING
+	// lists route overrides (eg, "sendmessage=50:100,joinroom=5:10"). Each
+	// throttle is rate:burst, in requests per second and requests.
+	envKeyStageThrottling = "STAGE_THROTTLING"
+	envKeyRouteThrottling = "ROUTE_THROTTLING"
+)
+
+// throttle is a steady-state rate limit and burst limit
+type throttle struct {
+	rateLimit  int64
+	burstLimit int64
+}
+
+// throttlingConfig is the optional gateway throttling for the stage
+type throttlingConfig struct {
+	stage  *throttle
+	routes map[string]*throttle
+}
+
+// parseThrottle returns the throttle for the rate:burst value
+func parseThrottle(value string) (*throttle, error) {
+	limits := strings.SplitN(strings.TrimSpace(value), ":", 2)
+	if len(limits) != 2 {
+		return nil, fmt.Errorf("throttle %q isn't rate:burst", value)
+	}
+	rateLimit, rateLimitErr := strconv.ParseInt(limits[0], 10, 64)
+	if rateLimitErr != nil || rateLimit < 0 {
+		return nil, fmt.Errorf("throttle %q has an invalid rate limit", value)
+	}
+	burstLimit, burstLimitErr := strconv.ParseInt(limits[1], 10, 64)
+	if burstLimitErr != nil || burstLimit < 0 {
+		return nil, fmt.Errorf("throttle %q has an invalid burst limit", value)
+	}
+	return &throttle{
+		rateLimit:  rateLimit,
+		burstLimit: burstLimit,
+	}, nil
+}
+
+// throttlingConfigFromEnvironment returns the throttling from the
+// provision-time environment, or nil if the gateway's account limits apply
+func throttlingConfigFromEnvironment() (*throttlingConfig, error) {
+	stageValue := os.Getenv(envKeyStageThrottling)
+	routeValues := splitList(os.Getenv(envKeyRouteThrottling))
+	if stageValue == "" && len(routeValues) == 0 {
+		return nil, nil
+	}
+	config := &throttlingConfig{
+		routes: make(map[string]*throttle),
+	}
+	if stageValue != "" {
+		stage, stageErr := parseThrottle(stageValue)
+		if stageErr != nil {
+			return nil, fmt.Errorf("%s: %s", envKeyStageThrottling, stageErr)
+		}
+		config.stage = stage
+	}
+	for _, eachValue := range routeValues {
+		routeThrottle := strings.SplitN(eachValue, "=", 2)
+		if len(routeThrottle) != 2 || strings.TrimSpace(routeThrottle[0]) == "" {
+			return nil, fmt.Errorf("%s: %q isn't route=rate:burst", envKeyRouteThrottling, eachValue)
+		}
+		route, routeErr := parseThrottle(routeThrottle[1])
+		if routeErr != nil {
+			return nil, fmt.Errorf("%s: %s", envKeyRouteThrottling, routeErr)
+		}
+		config.routes[strings.TrimSpace(routeThrottle[0])] = route
+	}
+	return config, nil
+}
+
+// decorator returns the decorator that applies the throttling to the stage
+// resource Sparta provisions
+func (config *throttlingConfig) decorator() sparta.ServiceDecoratorHookFunc {
+	return func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		stage, stageErr := stageResource(template)
+		if stageErr != nil {
+			return stageErr
+		}
+		if config.stage != nil {
+			stage.DefaultRouteSettings = &gocf.APIGatewayV2StageRouteSettings{
+				ThrottlingRateLimit:  gocf.Integer(config.stage.rateLimit),
+				ThrottlingBurstLimit: gocf.Integer(config.stage.burstLimit),
+			}
+		}
+		if len(config.routes) != 0 {
+			routeSettings := make(map[string]interface{}, len(config.routes))
+			for eachRouteKey, eachThrottle := range config.routes {
+				routeSettings[eachRouteKey] = map[string]interface{}{
+					"ThrottlingRateLimit":  eachThrottle.rateLimit,
+					"ThrottlingBurstLimit": eachThrottle.burstLimit,
+				}
+			}
+			stage.RouteSettings = routeSettings
+		}
+		return nil
+	}
+}
+
+// stageResource returns the stage resource Sparta provisions for the API
+func stageResource(template *gocf.Template) (*gocf.APIGatewayV2Stage, error) {
+	for _, eachResource := range template.Resources {
+		if stage, isStage := eachResource.Properties.(*gocf.APIGatewayV2Stage); isStage {
+			return stage, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to find the %s stage", apiStageName)
+}
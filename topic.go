@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// envKeyFanoutMode selects the segment fan-out transport at provision
+	// time. fanoutModeSNS publishes each segment to the fan-out topic rather
+	// than invoking the delivery lambda directly.
+	envKeyFanoutMode = "FANOUT_MODE"
+	fanoutModeSNS    = "sns"
+	// envKeyFanoutTopicARN is the fan-out topic ARN
+	envKeyFanoutTopicARN            = "FANOUT_TOPIC_ARN"
+	fanoutTopicResourceName         = "FanoutTopic"
+	fanoutSubscriptionResourceName  = "FanoutTopicSubscription"
+	fanoutTopicPermissionName       = "FanoutTopicPermission"
+	messageAttributeSegment         = "segment"
+	messageAttributeSegmentDataType = "Number"
+)
+
+// fanoutTopicEnabled returns true if segments are published to the fan-out
+// topic
+func fanoutTopicEnabled() bool {
+	return os.Getenv(envKeyFanoutMode) == fanoutModeSNS
+}
+
+// publishSegments publishes a segment request for each segment to the
+// fan-out topic. Unlike invoking the delivery lambda, the sender doesn't wait
+// for the deliveries, so its latency is independent of the audience size.
+// The deliveries haven't happened yet, so the returned stats are empty.
+func publishSegments(ctx context.Context,
+	sess *session.Session,
+	topicARN string,
+	endpointURL string,
+	requestID string,
+	payload json.RawMessage,
+	binary bool,
+	excluded string,
+	filterSource string,
+	totalSegments int64,
+	logger *logrus.Logger) (deliveryStats, error) {
+	snsClient := sns.New(sess)
+	var waitGroup sync.WaitGroup
+	var mutex sync.Mutex
+	var segmentErrors []error
+	for segment := int64(0); segment < totalSegments; segment++ {
+		waitGroup.Add(1)
+		go func(segment int64) {
+			defer waitGroup.Done()
+			segmentErr := publishSegment(ctx, snsClient, topicARN, &segmentRequest{
+				EndpointURL:          endpointURL,
+				RequestID:            requestID,
+				Payload:              payload,
+				Binary:               binary,
+				Segment:              segment,
+				TotalSegments:        totalSegments,
+				ExcludedConnectionID: excluded,
+				Filter:               filterSource,
+			})
+			if segmentErr != nil {
+				mutex.Lock()
+				defer mutex.Unlock()
+				segmentErrors = append(segmentErrors, segmentErr)
+				logger.WithFields(logrus.Fields{
+					"Error":   segmentErr,
+					"Segment": segment,
+				}).Warn("Failed to publish segment")
+			}
+		}(segment)
+	}
+	waitGroup.Wait()
+	if len(segmentErrors) != 0 {
+		return deliveryStats{}, fmt.Errorf("failed to publish %d of %d segments: %s",
+			len(segmentErrors),
+			totalSegments,
+			segmentErrors[0])
+	}
+	return deliveryStats{}, nil
+}
+
+// publishSegment publishes the segment request. The segment is also a
+// message attribute so that subscriptions can filter on it.
+func publishSegment(ctx context.Context,
+	snsClient *sns.SNS,
+	topicARN string,
+	request *segmentRequest) (err error) {
+	ctx, span := startSpan(ctx, "fanout.publish",
+		attribute.Int64(attributeSegment, request.Segment),
+		attribute.Int64(attributeTotalSegments, request.TotalSegments))
+	defer func() {
+		endSpan(span, err)
+	}()
+	request.TraceContext = injectTraceContext(ctx)
+	requestJSON, requestJSONErr := json.Marshal(request)
+	if requestJSONErr != nil {
+		return requestJSONErr
+	}
+	_, publishErr := snsClient.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(topicARN),
+		Message:  aws.String(string(requestJSON)),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			messageAttributeSegment: {
+				DataType:    aws.String(messageAttributeSegmentDataType),
+				StringValue: aws.String(strconv.FormatInt(request.Segment, 10)),
+			},
+		},
+	})
+	return publishErr
+}
+
+// deliverSegmentEvent is the delivery lambda handler. It accepts either a
+// segment request, when invoked by the sender, or the fan-out topic's SNS
+// event.
+func deliverSegmentEvent(ctx context.Context, event json.RawMessage) (*deliveryStats, error) {
+	var snsEvent awsEvents.SNSEvent
+	if json.Unmarshal(event, &snsEvent) != nil || len(snsEvent.Records) == 0 {
+		var request segmentRequest
+		unmarshalErr := json.Unmarshal(event, &request)
+		if unmarshalErr != nil {
+			return nil, unmarshalErr
+		}
+		return deliverSegment(ctx, request)
+	}
+	stats := &deliveryStats{}
+	for _, eachRecord := range snsEvent.Records {
+		var request segmentRequest
+		unmarshalErr := json.Unmarshal([]byte(eachRecord.SNS.Message), &request)
+		if unmarshalErr != nil {
+			return stats, unmarshalErr
+		}
+		// Failed deliveries are retried by the asynchronous invocation
+		segmentStats, segmentErr := deliverSegment(ctx, request)
+		if segmentErr != nil {
+			return stats, segmentErr
+		}
+		stats.add(*segmentStats)
+	}
+	return stats, nil
+}
+
+// fanoutTopicDecorator provisions the fan-out topic and subscribes the
+// delivery lambda to it
+func fanoutTopicDecorator(delivery *sparta.LambdaAWSInfo) sparta.ServiceDecoratorHookHandler {
+	return sparta.ServiceDecoratorHookFunc(func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		deliveryARN := gocf.GetAtt(delivery.LogicalResourceName(), "Arn")
+		template.AddResource(fanoutTopicResourceName, &gocf.SNSTopic{})
+		template.AddResource(fanoutSubscriptionResourceName, &gocf.SNSSubscription{
+			Endpoint: deliveryARN.String(),
+			Protocol: gocf.String("lambda"),
+			TopicArn: gocf.Ref(fanoutTopicResourceName).String(),
+		})
+		template.AddResource(fanoutTopicPermissionName, &gocf.LambdaPermission{
+			Action:       gocf.String("lambda:InvokeFunction"),
+			FunctionName: deliveryARN.String(),
+			Principal:    gocf.String("sns.amazonaws.com"),
+			SourceArn:    gocf.Ref(fanoutTopicResourceName).String(),
+		})
+		return nil
+	})
+}
+
+// annotateFanoutTopic lets the sender publish to the fan-out topic and
+// publishes the topic ARN in its environment
+func annotateFanoutTopic(sender *sparta.LambdaAWSInfo) {
+	sender.RoleDefinition.Privileges = append(sender.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"sns:Publish"},
+			Resource: gocf.Ref(fanoutTopicResourceName),
+		})
+	setEnvironment(sender, envKeyFanoutTopicARN, gocf.Ref(fanoutTopicResourceName).String())
+}
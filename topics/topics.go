@@ -0,0 +1,139 @@
+// Package topics validates and matches the hierarchical pub/sub topics.
+// Topics are dot separated levels, such as orders.eu.shipped. Subscription
+// patterns may use * in place of exactly one level and, as the last level,
+// # in place of any number of levels, including none:
+//
+//	orders.eu.*  matches orders.eu.shipped, but not orders.eu or orders.eu.shipped.late
+//	orders.#     matches orders, orders.eu, and orders.eu.shipped
+//	*.eu.#       matches orders.eu and returns.eu.received
+//
+// Subscriptions are stored by their root, the literal levels before the
+// first wildcard, so resolving a published topic reads one partition per
+// level rather than every subscription.
+package topics
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// Separator separates topic levels
+	Separator = "."
+	// SingleLevel matches exactly one level
+	SingleLevel = "*"
+	// MultiLevel matches the remaining levels, including none. It must be
+	// the last level of the pattern.
+	MultiLevel = "#"
+	// MaxLength bounds topics and patterns
+	MaxLength = 128
+	// MaxLevels bounds the levels of topics and patterns
+	MaxLevels = 8
+	// rootSuffix terminates every root, so that the root of a pattern that
+	// starts with a wildcard isn't empty
+	rootSuffix = "/"
+)
+
+// validLevel returns true if the level is a non-empty literal of letters,
+// digits, dashes, and underscores
+func validLevel(level string) bool {
+	if level == "" {
+		return false
+	}
+	for _, eachChar := range level {
+		if !(eachChar >= 'a' && eachChar <= 'z' ||
+			eachChar >= 'A' && eachChar <= 'Z' ||
+			eachChar >= '0' && eachChar <= '9' ||
+			eachChar == '_' || eachChar == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// levels splits the topic or pattern, checking its bounds
+func levels(value string) ([]string, error) {
+	if value == "" || len(value) > MaxLength {
+		return nil, fmt.Errorf("topics are 1 to %d characters", MaxLength)
+	}
+	split := strings.Split(value, Separator)
+	if len(split) > MaxLevels {
+		return nil, fmt.Errorf("topics have at most %d levels", MaxLevels)
+	}
+	return split, nil
+}
+
+// ValidateTopic returns an error unless the topic can be published to.
+// Published topics don't have wildcards.
+func ValidateTopic(topic string) error {
+	split, splitErr := levels(topic)
+	if splitErr != nil {
+		return splitErr
+	}
+	for _, eachLevel := range split {
+		if !validLevel(eachLevel) {
+			return fmt.Errorf("invalid topic level: %q", eachLevel)
+		}
+	}
+	return nil
+}
+
+// ValidatePattern returns an error unless the pattern can be subscribed to
+func ValidatePattern(pattern string) error {
+	split, splitErr := levels(pattern)
+	if splitErr != nil {
+		return splitErr
+	}
+	for i, eachLevel := range split {
+		switch {
+		case eachLevel == SingleLevel:
+		case eachLevel == MultiLevel && i == len(split)-1:
+		case eachLevel == MultiLevel:
+			return fmt.Errorf("%s must be the last level", MultiLevel)
+		case !validLevel(eachLevel):
+			return fmt.Errorf("invalid topic level: %q", eachLevel)
+		}
+	}
+	return nil
+}
+
+// Match returns true if the published topic matches the pattern
+func Match(pattern string, topic string) bool {
+	patternLevels := strings.Split(pattern, Separator)
+	topicLevels := strings.Split(topic, Separator)
+	for i, eachLevel := range patternLevels {
+		if eachLevel == MultiLevel {
+			return true
+		}
+		if i == len(topicLevels) {
+			return false
+		}
+		if eachLevel != SingleLevel && eachLevel != topicLevels[i] {
+			return false
+		}
+	}
+	return len(patternLevels) == len(topicLevels)
+}
+
+// Root returns the partition that stores subscriptions to the pattern
+func Root(pattern string) string {
+	var literal []string
+	for _, eachLevel := range strings.Split(pattern, Separator) {
+		if eachLevel == SingleLevel || eachLevel == MultiLevel {
+			break
+		}
+		literal = append(literal, eachLevel)
+	}
+	return strings.Join(literal, Separator) + rootSuffix
+}
+
+// Roots returns the partitions that may store subscriptions matching the
+// published topic: the root of each of its prefixes, from the shortest
+func Roots(topic string) []string {
+	split := strings.Split(topic, Separator)
+	roots := make([]string, 0, len(split)+1)
+	for i := 0; i <= len(split); i++ {
+		roots = append(roots, strings.Join(split[:i], Separator)+rootSuffix)
+	}
+	return roots
+}
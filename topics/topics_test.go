@@ -0,0 +1,120 @@
+package topics
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		valid bool
+	}{
+		{"orders", true},
+		{"orders.eu.shipped", true},
+		{"Orders_2.eu-west", true},
+		{"", false},
+		{"orders..shipped", false},
+		{"orders.", false},
+		{"orders.*", false},
+		{"orders.#", false},
+		{"orders/eu", false},
+		{strings.Repeat("a.", MaxLevels) + "a", false},
+		{strings.Repeat("a", MaxLength+1), false},
+	}
+	for _, eachTest := range tests {
+		validateErr := ValidateTopic(eachTest.topic)
+		if (validateErr == nil) != eachTest.valid {
+			t.Errorf("ValidateTopic(%q) = %v, want valid %t", eachTest.topic, validateErr, eachTest.valid)
+		}
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"orders", true},
+		{"orders.eu.*", true},
+		{"orders.#", true},
+		{"*.eu.#", true},
+		{"#", true},
+		{"*", true},
+		{"", false},
+		{"orders.#.shipped", false},
+		{"#.eu", false},
+		{"orders.e*", false},
+		{"orders..eu", false},
+	}
+	for _, eachTest := range tests {
+		validateErr := ValidatePattern(eachTest.pattern)
+		if (validateErr == nil) != eachTest.valid {
+			t.Errorf("ValidatePattern(%q) = %v, want valid %t", eachTest.pattern, validateErr, eachTest.valid)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"orders.eu.shipped", "orders.eu.shipped", true},
+		{"orders.eu.shipped", "orders.eu", false},
+		{"orders.eu.*", "orders.eu.shipped", true},
+		{"orders.eu.*", "orders.eu", false},
+		{"orders.eu.*", "orders.eu.shipped.late", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.eu", true},
+		{"orders.#", "orders.eu.shipped", true},
+		{"orders.#", "returns.eu", false},
+		{"*.eu.#", "orders.eu", true},
+		{"*.eu.#", "returns.eu.received", true},
+		{"*.eu.#", "orders.us", false},
+		{"#", "orders.eu", true},
+	}
+	for _, eachTest := range tests {
+		if match := Match(eachTest.pattern, eachTest.topic); match != eachTest.match {
+			t.Errorf("Match(%q, %q) = %t, want %t", eachTest.pattern, eachTest.topic, match, eachTest.match)
+		}
+	}
+}
+
+func TestRoots(t *testing.T) {
+	tests := []struct {
+		pattern string
+		root    string
+	}{
+		{"orders.eu.shipped", "orders.eu.shipped/"},
+		{"orders.eu.*", "orders.eu/"},
+		{"orders.#", "orders/"},
+		{"*.eu.#", "/"},
+		{"#", "/"},
+	}
+	for _, eachTest := range tests {
+		if root := Root(eachTest.pattern); root != eachTest.root {
+			t.Errorf("Root(%q) = %q, want %q", eachTest.pattern, root, eachTest.root)
+		}
+	}
+	roots := Roots("orders.eu.shipped")
+	expected := []string{"/", "orders/", "orders.eu/", "orders.eu.shipped/"}
+	if !reflect.DeepEqual(roots, expected) {
+		t.Errorf("Roots(%q) = %q, want %q", "orders.eu.shipped", roots, expected)
+	}
+	// Every matching pattern is stored in one of the topic's roots
+	for _, eachTest := range tests {
+		if !Match(eachTest.pattern, "orders.eu.shipped") {
+			continue
+		}
+		found := false
+		for _, eachRoot := range roots {
+			found = found || eachRoot == Root(eachTest.pattern)
+		}
+		if !found {
+			t.Errorf("Roots(%q) doesn't include Root(%q)", "orders.eu.shipped", eachTest.pattern)
+		}
+	}
+}
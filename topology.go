@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"strings"
+
+	sparta "github.com/mweagle/Sparta"
+)
+
+const (
+	// describeCommand renders the service topology instead of running
+	// Sparta's describe command, which doesn't include the websocket routes.
+	// It runs offline, without AWS credentials.
+	describeCommand = "describe"
+	// Node kinds
+	nodeKindRoute  = "route"
+	nodeKindLambda = "lambda"
+	nodeKindTable  = "table"
+	nodeKindQueue  = "queue"
+	nodeKindBucket = "bucket"
+	nodeKindTopic  = "topic"
+	// nodeKindStateMachine is a Step Functions state machine
+	nodeKindStateMachine = "statemachine"
+	nodeKindStream       = "stream"
+	nodeKindRule         = "rule"
+	nodeKindAPI          = "api"
+)
+
+// nodeShapes are the graphviz shapes for each node kind
+var nodeShapes = map[string]string{
+	nodeKindRoute:        "cds",
+	nodeKindLambda:       "box",
+	nodeKindTable:        "cylinder",
+	nodeKindQueue:        "rarrow",
+	nodeKindBucket:       "folder",
+	nodeKindTopic:        "doubleoctagon",
+	nodeKindStateMachine: "hexagon",
+	nodeKindStream:       "parallelogram",
+	nodeKindRule:         "component",
+	nodeKindAPI:          "house",
+}
+
+type topologyNode struct {
+	id    string
+	label string
+	kind  string
+}
+
+type topologyEdge struct {
+	from string
+	to   string
+}
+
+// topology records the routes, lambdas, and resources as they're registered
+// so that the describe command renders exactly what's provisioned
+type topology struct {
+	nodes       map[string]*topologyNode
+	nodeOrder   []string
+	edges       []topologyEdge
+	lambdaNames map[*sparta.LambdaAWSInfo]string
+	// routeLambdas are the lambdas that handle a route, in the order they
+	// were routed
+	routeLambdas []*sparta.LambdaAWSInfo
+}
+
+func newTopology() *topology {
+	return &topology{
+		nodes:       make(map[string]*topologyNode),
+		lambdaNames: make(map[*sparta.LambdaAWSInfo]string),
+	}
+}
+
+func (topo *topology) node(kind string, label string) string {
+	nodeID := kind + ":" + label
+	if _, exists := topo.nodes[nodeID]; !exists {
+		topo.nodes[nodeID] = &topologyNode{
+			id:    nodeID,
+			label: label,
+			kind:  kind,
+		}
+		topo.nodeOrder = append(topo.nodeOrder, nodeID)
+	}
+	return nodeID
+}
+
+// lambda creates and records the lambda function
+func (topo *topology) lambda(name string, handler interface{}) *sparta.LambdaAWSInfo {
+	lambdaFn, _ := sparta.NewAWSLambda(name,
+		handler,
+		sparta.IAMRoleDefinition{})
+	topo.lambdaNames[lambdaFn] = name
+	topo.node(nodeKindLambda, name)
+	return lambdaFn
+}
+
+// route creates and records the route
+func (topo *topology) route(apiGateway *sparta.APIV2,
+	routeKey string,
+	operationName string,
+	lambdaFn *sparta.LambdaAWSInfo) *sparta.APIV2Route {
+	apiv2Route, _ := apiGateway.NewAPIV2Route(routeKey, lambdaFn)
+	apiv2Route.OperationName = operationName
+	topo.edges = append(topo.edges, topologyEdge{
+		from: topo.node(nodeKindRoute, routeKey),
+		to:   topo.node(nodeKindLambda, topo.lambdaNames[lambdaFn]),
+	})
+	for _, eachLambda := range topo.routeLambdas {
+		if eachLambda == lambdaFn {
+			return apiv2Route
+		}
+	}
+	topo.routeLambdas = append(topo.routeLambdas, lambdaFn)
+	return apiv2Route
+}
+
+// uses records that the lambda sends to or reads from the resource
+func (topo *topology) uses(lambdaFn *sparta.LambdaAWSInfo, kind string, resourceName string) {
+	topo.edges = append(topo.edges, topologyEdge{
+		from: topo.node(nodeKindLambda, topo.lambdaNames[lambdaFn]),
+		to:   topo.node(kind, resourceName),
+	})
+}
+
+// resourceGrant is a stack resource that lambdas access: the annotate
+// function grants each of the lambdas access, and the topology records it
+type resourceGrant struct {
+	lambdas  []*sparta.LambdaAWSInfo
+	kind     string
+	resource string
+	annotate func(lambdaFn *sparta.LambdaAWSInfo)
+}
+
+// grant annotates each grant's lambdas and records that they use its
+// resource
+func (topo *topology) grant(grants ...resourceGrant) {
+	for _, eachGrant := range grants {
+		for _, eachLambda := range eachGrant.lambdas {
+			eachGrant.annotate(eachLambda)
+			topo.uses(eachLambda, eachGrant.kind, eachGrant.resource)
+		}
+	}
+}
+
+// broadcaster annotates the lambdas that post to connections, which stage
+// large payloads to the payload bucket, queue gone connections for cleanup,
+// and bound their concurrent posts
+func (topo *topology) broadcaster(lambdas ...*sparta.LambdaAWSInfo) {
+	for _, eachLambda := range lambdas {
+		annotateFanoutConcurrency(eachLambda)
+	}
+	topo.grant(resourceGrant{
+		lambdas:  lambdas,
+		kind:     nodeKindBucket,
+		resource: payloadBucketResourceName,
+		annotate: annotatePayloadBucket,
+	}, resourceGrant{
+		lambdas:  lambdas,
+		kind:     nodeKindQueue,
+		resource: cleanupQueueResourceName,
+		annotate: annotateCleanupProducer,
+	})
+}
+
+// fansOut lets the sender invoke the delivery lambda for broadcast segments
+// and records the invocation
+func (topo *topology) fansOut(sender *sparta.LambdaAWSInfo, delivery *sparta.LambdaAWSInfo) {
+	annotateFanout(sender, delivery)
+	topo.invokes(topo.lambdaNames[sender], nodeKindLambda, delivery)
+}
+
+// invokes records that one lambda invokes or feeds another, eg via a queue
+func (topo *topology) invokes(source string, sourceKind string, lambdaFn *sparta.LambdaAWSInfo) {
+	topo.edges = append(topo.edges, topologyEdge{
+		from: topo.node(sourceKind, source),
+		to:   topo.node(nodeKindLambda, topo.lambdaNames[lambdaFn]),
+	})
+}
+
+// writeDOT renders the topology as a graphviz digraph
+func (topo *topology) writeDOT(writer io.Writer) error {
+	var dot strings.Builder
+	dot.WriteString("digraph SpartaWebSocket {\n")
+	dot.WriteString("  rankdir=LR;\n")
+	dot.WriteString("  node [fontname=\"Helvetica\"];\n")
+	for _, eachID := range topo.nodeOrder {
+		eachNode := topo.nodes[eachID]
+		fmt.Fprintf(&dot, "  %q [label=%q, shape=%s];\n",
+			eachNode.id,
+			eachNode.label,
+			nodeShapes[eachNode.kind])
+	}
+	for _, eachEdge := range topo.edges {
+		fmt.Fprintf(&dot, "  %q -> %q;\n", eachEdge.from, eachEdge.to)
+	}
+	dot.WriteString("}\n")
+	_, writeErr := io.WriteString(writer, dot.String())
+	return writeErr
+}
+
+var topologyHTML = template.Must(template.New("topology").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>SpartaWebSocket topology</title>
+<script src="https://unpkg.com/viz.js@2.1.2/viz.js"></script>
+<script src="https://unpkg.com/viz.js@2.1.2/full.render.js"></script>
+</head>
+<body>
+<div id="topology"></div>
+<script>
+new Viz().renderSVGElement({{.}}).then(function(svg) {
+  document.getElementById("topology").appendChild(svg);
+});
+</script>
+</body>
+</html>
+`))
+
+// writeHTML renders the topology as a standalone page
+func (topo *topology) writeHTML(writer io.Writer) error {
+	var dot strings.Builder
+	dotErr := topo.writeDOT(&dot)
+	if dotErr != nil {
+		return dotErr
+	}
+	return topologyHTML.Execute(writer, dot.String())
+}
+
+// renderTopology handles the describe command:
+//
+//	go run main.go describe [--format dot|html]
+func renderTopology(topo *topology, args []string) error {
+	format := "html"
+	for eachIndex, eachArg := range args {
+		if eachArg == "--format" && eachIndex+1 < len(args) {
+			format = args[eachIndex+1]
+		}
+	}
+	switch format {
+	case "dot":
+		return topo.writeDOT(os.Stdout)
+	case "html":
+		return topo.writeHTML(os.Stdout)
+	default:
+		return fmt.Errorf("unsupported topology format: %s", format)
+	}
+}
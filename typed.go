@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/session"
+	apigwManagementIface "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi/apigatewaymanagementapiiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	"github.com/sirupsen/logrus"
+)
+
+// wsCall is a request whose data has been unmarshaled into Req, along with
+// the preconditions every handler sets up: the sender's connection item and
+// locale, and clients for the request's management endpoint
+type wsCall[Req any] struct {
+	request         awsEvents.APIGatewayWebsocketProxyRequest
+	logger          *logrus.Logger
+	sess            *session.Session
+	endpointURL     string
+	dynamoClient    dynamodbiface.DynamoDBAPI
+	apigwMgmtClient apigwManagementIface.ApiGatewayManagementApiAPI
+	senderItem      map[string]*dynamodb.AttributeValue
+	locale          string
+	data            Req
+	// binary is true if data is the JSON form of an opaque binary payload
+	binary bool
+}
+
+// callError is a typed handler failure that's reported to the sender with an
+// error frame
+type callError struct {
+	code    errorCode
+	message string
+}
+
+func (err *callError) Error() string {
+	return err.message
+}
+
+// fail returns the error that reports the localized message to the sender
+// with the code
+func (call *wsCall[Req]) fail(code errorCode, key catalog.Key, args ...interface{}) error {
+	return &callError{
+		code:    code,
+		message: catalog.Localize(call.locale, key, args...),
+	}
+}
+
+// typedHandler handles a request whose data is a Req and returns the Resp
+// that's marshaled into the route response body
+type typedHandler[Req any, Resp any] func(ctx context.Context, call *wsCall[Req]) (Resp, error)
+
+// withTypedRequest adapts the typed handler to a wsHandler. Data that can't
+// be unmarshaled into a Req is rejected with a malformedRequest error frame.
+// A callError from the handler is reported with its code, and any other
+// error with sendFailed.
+func withTypedRequest[Req any, Resp any](handler typedHandler[Req, Resp]) wsHandler {
+	return func(ctx context.Context,
+		request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+		// Preconditions
+		logger := contextLogger(ctx)
+		sess := newAWSSession(logger)
+		endpointURL := managementEndpoint(request.RequestContext)
+		call := &wsCall[Req]{
+			request:         request,
+			logger:          logger,
+			sess:            sess,
+			endpointURL:     endpointURL,
+			dynamoClient:    newConnectionsClient(sess),
+			apigwMgmtClient: newManagementClient(sess, endpointURL),
+		}
+		senderItem, senderItemErr := senderConnectionItem(ctx, request, call.dynamoClient)
+		if senderItemErr != nil {
+			logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+		}
+		call.senderItem = senderItem
+		call.locale = itemLocale(senderItem)
+		payload, binary, payloadErr := requestData(request, senderItem)
+		call.binary = binary
+		if payloadErr == nil {
+			payloadErr = json.Unmarshal(payload, &call.data)
+		}
+		if payloadErr != nil {
+			return wsError(ctx,
+				request,
+				senderItem,
+				call.apigwMgmtClient,
+				errorCodeMalformedRequest,
+				catalog.Localize(call.locale, catalog.UnmarshalFailed, payloadErr.Error()),
+				logger), nil
+		}
+
+		// Operation
+		response, handlerErr := handler(ctx, call)
+		if handlerErr != nil {
+			var failure *callError
+			if !errors.As(handlerErr, &failure) {
+				failure = &callError{
+					code:    errorCodeSendFailed,
+					message: catalog.Localize(call.locale, catalog.SendFailed, handlerErr.Error()),
+				}
+			}
+			return wsError(ctx,
+				request,
+				senderItem,
+				call.apigwMgmtClient,
+				failure.code,
+				failure.message,
+				logger), nil
+		}
+		body, bodyErr := json.Marshal(response)
+		if bodyErr != nil {
+			return nil, bodyErr
+		}
+		return &wsResponse{
+			StatusCode: 200,
+			Body:       string(body),
+		}, nil
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	"github.com/sirupsen/logrus"
+)
+
+const typingMessage = "typing"
+
+// typingFrame is the data of the typing frame delivered to the other members
+// of the room
+type typingFrame struct {
+	Room   string `json:"room"`
+	From   string `json:"from,omitempty"`
+	Typing bool   `json:"typing"`
+}
+
+// typingRequest is the data of a typing frame. Typing defaults to true;
+// clients send false when the user stops typing before sending.
+type typingRequest struct {
+	Typing *bool `json:"typing,omitempty"`
+}
+
+// sendTyping tells the other members of the room that the sender is typing.
+// Typing events are ephemeral: nothing is written, and they aren't rate
+// limited, since the rate limiter counts in the connection table. Clients
+// are expected to throttle them.
+func sendTyping(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	// Preconditions
+	route, rejected := newRoomRoute(ctx, request)
+	if rejected != nil {
+		return rejected, nil
+	}
+	connectionID := request.RequestContext.ConnectionID
+	getItemOutput, getItemErr := route.roomsClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(os.Getenv(envKeyRoomsTableName)),
+		Key:       membershipKey(route.request.Room, connectionID),
+	})
+	if getItemErr != nil {
+		return route.error(ctx, request, errorCodeSendFailed, catalog.SendFailed, getItemErr.Error()), nil
+	}
+	if len(getItemOutput.Item) == 0 {
+		return route.error(ctx, request, errorCodeNotRoomMember, catalog.NotRoomMember, route.request.Room), nil
+	}
+	typing := typingRequest{}
+	if len(route.request.Data) != 0 {
+		unmarshalErr := json.Unmarshal(route.request.Data, &typing)
+		if unmarshalErr != nil {
+			return route.error(ctx, request, errorCodeMalformedRequest, catalog.UnmarshalFailed, unmarshalErr.Error()), nil
+		}
+	}
+
+	// Operation
+	frameData, _ := json.Marshal(&typingFrame{
+		Room:   route.request.Room,
+		From:   itemUserID(route.senderItem),
+		Typing: typing.Typing == nil || *typing.Typing,
+	})
+	stats, deliverErr := deliverRoomFrame(ctx,
+		route.sess,
+		route.endpointURL,
+		request.RequestContext.RequestID,
+		route.request.Room,
+		typingMessage,
+		frameData,
+		connectionID,
+		route.logger)
+	route.logger.WithFields(logrus.Fields{
+		"Room":  route.request.Room,
+		"Stats": stats,
+	}).Debug("Typing event complete")
+	if deliverErr != nil {
+		return route.error(ctx, request, errorCodeSendFailed, catalog.SendFailed, deliverErr.Error()), nil
+	}
+	return &wsResponse{
+		StatusCode: 200,
+		Body:       catalog.Localize(route.locale, catalog.DataSent),
+	}, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+)
+
+const (
+	// envKeyDeliveryDeadLetterQueueURL is the delivery dead letter queue URL
+	envKeyDeliveryDeadLetterQueueURL = "DELIVERY_DEAD_LETTER_QUEUE_URL"
+	// Parked message attributes, so deliveries can be inspected without
+	// parsing the body
+	attributeParkedConnectionID = "connectionId"
+	attributeParkedReason       = "reason"
+	// redriveReceiveWaitSeconds is the long poll for each receive. An empty
+	// receive ends the redrive.
+	redriveReceiveWaitSeconds = 1
+	// Metric names
+	metricDeliveriesRedriven = "DeliveriesRedriven"
+)
+
+// redriveRequest is the RedriveDeliveries input. A zero MaxMessages
+// redrives every parked delivery.
+type redriveRequest struct {
+	MaxMessages int `json:"maxMessages,omitempty"`
+}
+
+// redriveResult is the RedriveDeliveries response
+type redriveResult struct {
+	Redriven int `json:"redriven"`
+	Failed   int `json:"failed"`
+}
+
+// parkUndeliverable moves the connections whose delivery exhausted its
+// retries to the dead letter queue, one message per connection with the
+// connection's last failure as the reason. Each batch holds at most
+// deliverySendBatchSize messages whose total size is within the SQS batch
+// limit. A message is the delivery, which the delivery queue accepted, with
+// a single connection and its reason, so each fits in a batch by itself.
+func parkUndeliverable(ctx context.Context,
+	sqsClient sqsiface.SQSAPI,
+	delivery *queuedDelivery,
+	reasons map[string]string) error {
+	queueURL := os.Getenv(envKeyDeliveryDeadLetterQueueURL)
+	var entries []*sqs.SendMessageBatchRequestEntry
+	var entriesSize int
+	var failedCount int
+	sendEntries := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		sendOutput, sendErr := sqsClient.SendMessageBatchWithContext(ctx,
+			&sqs.SendMessageBatchInput{
+				QueueUrl: aws.String(queueURL),
+				Entries:  entries,
+			})
+		entries = nil
+		entriesSize = 0
+		if sendErr != nil {
+			return sendErr
+		}
+		failedCount += len(sendOutput.Failed)
+		return nil
+	}
+	for eachConnectionID, eachReason := range reasons {
+		parked := *delivery
+		parked.ConnectionIDs = []string{eachConnectionID}
+		parked.Reason = eachReason
+		body, _ := json.Marshal(&parked)
+		entry := &sqs.SendMessageBatchRequestEntry{
+			MessageBody: aws.String(string(body)),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				attributeParkedConnectionID: &sqs.MessageAttributeValue{
+					DataType:    aws.String("String"),
+					StringValue: aws.String(eachConnectionID),
+				},
+				attributeParkedReason: &sqs.MessageAttributeValue{
+					DataType:    aws.String("String"),
+					StringValue: aws.String(eachReason),
+				},
+			},
+		}
+		entrySize := sendEntrySize(entry)
+		if len(entries) == deliverySendBatchSize || entriesSize+entrySize > maxSendBatchSize {
+			sendErr := sendEntries()
+			if sendErr != nil {
+				return sendErr
+			}
+		}
+		entry.Id = aws.String(strconv.Itoa(len(entries)))
+		entries = append(entries, entry)
+		entriesSize += entrySize
+	}
+	sendErr := sendEntries()
+	if sendErr != nil {
+		return sendErr
+	}
+	if failedCount != 0 {
+		return fmt.Errorf("failed to park %d of %d deliveries", failedCount, len(reasons))
+	}
+	return nil
+}
+
+// redriveDeliveries is the administrative redrive lambda. It moves the
+// messages in the delivery dead letter queue back to the delivery queue as
+// first attempts, until the dead letter queue is empty or MaxMessages have
+// been redriven. Messages that were dead lettered after failing outright are
+// redriven too.
+func redriveDeliveries(ctx context.Context, request redriveRequest) (_ *redriveResult, err error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	sqsClient := newSQSClient(sess)
+	deadLetterQueueURL := os.Getenv(envKeyDeliveryDeadLetterQueueURL)
+	queueURL := os.Getenv(envKeyDeliveryQueueURL)
+	metrics := newMetricsEmitter()
+	result := &redriveResult{}
+	ctx, finishInvocation := startInvocation(ctx, "RedriveDeliveries")
+	defer func() {
+		metrics.add(metricDeliveriesRedriven, float64(result.Redriven))
+		metricsErr := metrics.flush()
+		if metricsErr != nil {
+			logger.WithField("Error", metricsErr).Warn("Failed to publish metrics")
+		}
+		finishInvocation(err)
+	}()
+
+	// Operation
+	for request.MaxMessages == 0 || result.Redriven < request.MaxMessages {
+		maxMessages := int64(deliverySendBatchSize)
+		if remaining := request.MaxMessages - result.Redriven; request.MaxMessages != 0 &&
+			int64(remaining) < maxMessages {
+			maxMessages = int64(remaining)
+		}
+		receiveOutput, receiveErr := sqsClient.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(deadLetterQueueURL),
+			MaxNumberOfMessages: aws.Int64(maxMessages),
+			WaitTimeSeconds:     aws.Int64(redriveReceiveWaitSeconds),
+		})
+		if receiveErr != nil {
+			return result, receiveErr
+		}
+		if len(receiveOutput.Messages) == 0 {
+			break
+		}
+		for _, eachMessage := range receiveOutput.Messages {
+			var delivery queuedDelivery
+			unmarshalErr := json.Unmarshal([]byte(aws.StringValue(eachMessage.Body)), &delivery)
+			if unmarshalErr != nil {
+				// Left in the dead letter queue for inspection
+				logger.WithField("MessageId", aws.StringValue(eachMessage.MessageId)).Warn("Skipping malformed delivery")
+				result.Failed++
+				continue
+			}
+			delivery.Attempt = 1
+			delivery.Reason = ""
+			body, _ := json.Marshal(&delivery)
+			_, sendErr := sqsClient.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+				QueueUrl:    aws.String(queueURL),
+				MessageBody: aws.String(string(body)),
+			})
+			if sendErr != nil {
+				return result, sendErr
+			}
+			_, deleteErr := sqsClient.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(deadLetterQueueURL),
+				ReceiptHandle: eachMessage.ReceiptHandle,
+			})
+			if deleteErr != nil {
+				// The delivery was requeued, so a later redrive repeats it
+				logger.WithField("Error", deleteErr).Warn("Failed to delete redriven delivery")
+			}
+			result.Redriven++
+		}
+	}
+	logger.WithField("Result", result).Info("Redrive complete")
+	return result, nil
+}
+
+// annotateDeadLetterProducer lets the lambda park undeliverable deliveries
+// and publishes the dead letter queue URL in its environment
+func annotateDeadLetterProducer(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"sqs:SendMessage"},
+			Resource: gocf.GetAtt(deliveryDeadLetterQueueName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyDeliveryDeadLetterQueueURL, gocf.Ref(deliveryDeadLetterQueueName).String())
+}
+
+// annotateRedriver lets the lambda move dead lettered deliveries back to the
+// delivery queue
+func annotateRedriver(lambdaFn *sparta.LambdaAWSInfo) {
+	annotateDeliveryProducer(lambdaFn)
+	annotateDeadLetterProducer(lambdaFn)
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"sqs:ReceiveMessage",
+				"sqs:DeleteMessage"},
+			Resource: gocf.GetAtt(deliveryDeadLetterQueueName, "Arn"),
+		})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"strings"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyUploadBucket is the provision-time name of the existing bucket
+	// whose ObjectCreated events are pushed to the uploading user
+	envKeyUploadBucket = "UPLOAD_BUCKET"
+	uploadMessage      = "upload"
+)
+
+// uploadFrame is the data of the upload frame delivered to each of the
+// uploading user's connections
+type uploadFrame struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	ETag   string `json:"eTag,omitempty"`
+	Event  string `json:"event"`
+}
+
+// uploadNotificationsEnabled returns true if the stack subscribes to the
+// upload bucket's events
+func uploadNotificationsEnabled() bool {
+	return os.Getenv(envKeyUploadBucket) != ""
+}
+
+// uploadUserID returns the user ID that owns an object, which is the first
+// segment of its {userID}/{name} key, or the empty string
+func uploadUserID(key string) string {
+	segments := strings.SplitN(key, "/", 2)
+	if len(segments) != 2 || len(segments[0]) > maxUserIDLength {
+		return ""
+	}
+	return segments[0]
+}
+
+// notifyUploads is the upload bucket's ObjectCreated subscriber. Objects are
+// keyed by the uploading user's ID, and each new object is delivered as an
+// upload frame to that user's connections, with the S3 request ID as the
+// correlation ID. Users that are offline aren't notified.
+func notifyUploads(ctx context.Context, event awsEvents.S3Event) (err error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	endpointURL := os.Getenv(envKeyManagementEndpoint)
+	store := newConnectionIndex(newConnectionsClient(sess))
+	ctx, finishInvocation := startInvocation(ctx, "NotifyUploads")
+	defer func() {
+		finishInvocation(err)
+	}()
+
+	// Operation
+	for _, eachRecord := range event.Records {
+		requestID := eachRecord.ResponseElements["x-amz-request-id"]
+		recordLogger := correlatedLogger(logger, requestID)
+		// Event keys are URL encoded
+		key, keyErr := url.QueryUnescape(eachRecord.S3.Object.Key)
+		if keyErr != nil {
+			return keyErr
+		}
+		userID := uploadUserID(key)
+		if userID == "" {
+			recordLogger.WithField("Key", key).Warn("Skipping upload without a user ID prefix")
+			continue
+		}
+		receiverItems, receiverItemsErr := store.UserConnections(ctx, userID)
+		if receiverItemsErr != nil {
+			return receiverItemsErr
+		}
+		if len(receiverItems) == 0 {
+			recordLogger.WithField("UserID", userID).Info("Uploading user is offline")
+			continue
+		}
+		frameData, _ := json.Marshal(&uploadFrame{
+			Bucket: eachRecord.S3.Bucket.Name,
+			Key:    key,
+			Size:   eachRecord.S3.Object.Size,
+			ETag:   eachRecord.S3.Object.ETag,
+			Event:  eachRecord.EventName,
+		})
+		bcast := newBroadcaster(ctx,
+			sess,
+			endpointURL,
+			requestID,
+			uploadMessage,
+			frameData,
+			recordLogger)
+		bcast.deliverItems(ctx, receiverItems)
+		stats := bcast.finish(ctx)
+		recordLogger.WithFields(logrus.Fields{
+			"UserID": userID,
+			"Key":    key,
+			"Stats":  stats,
+		}).Info("Upload notification complete")
+	}
+	return nil
+}
+
+// annotateUploadSubscriber subscribes the lambda to the upload bucket's
+// ObjectCreated events
+func annotateUploadSubscriber(lambdaFn *sparta.LambdaAWSInfo, apiGateway *sparta.APIV2) {
+	annotateManagementEndpoint(lambdaFn, apiGateway)
+	lambdaFn.Permissions = append(lambdaFn.Permissions, sparta.S3Permission{
+		BasePermission: sparta.BasePermission{
+			SourceArn: gocf.Join("",
+				gocf.String("arn:"),
+				gocf.Ref("AWS::Partition"),
+				gocf.String(":s3:::"+os.Getenv(envKeyUploadBucket))),
+		},
+		Events: []string{"s3:ObjectCreated:*"},
+	})
+}
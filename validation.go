@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Request data schemas for the action routes. The handlers still check
+// anything the schemas can't express, such as membership.
+var (
+	roomSchema = newRequestSchema(`{
+		"type": "object",
+		"required": ["room"],
+		"properties": {
+			"room": {"type": "string", "minLength": 1, "maxLength": 128},
+			"messageId": {"type": "string", "maxLength": 128}
+		}
+	}`)
+	typingSchema = newRequestSchema(`{
+		"type": "object",
+		"required": ["room"],
+		"properties": {
+			"room": {"type": "string", "minLength": 1, "maxLength": 128},
+			"data": {
+				"type": "object",
+				"properties": {
+					"typing": {"type": "boolean"}
+				}
+			}
+		}
+	}`)
+	directSchema = newRequestSchema(`{
+		"type": "object",
+		"required": ["userId"],
+		"properties": {
+			"userId": {"type": "string", "minLength": 1, "maxLength": 128},
+			"messageId": {"type": "string", "maxLength": 128}
+		}
+	}`)
+	presenceSchema = newRequestSchema(`{
+		"type": "object",
+		"properties": {
+			"userIds": {
+				"type": "array",
+				"maxItems": 1000,
+				"items": {"type": "string", "minLength": 1, "maxLength": 128}
+			},
+			"count": {"type": "boolean"}
+		}
+	}`)
+	ackSchema = newRequestSchema(`{
+		"type": "object",
+		"required": ["messageId"],
+		"properties": {
+			"messageId": {"type": "string", "minLength": 1, "maxLength": 128},
+			"state": {"type": "string", "enum": ["delivered", "read"]}
+		}
+	}`)
+	historySchema = newRequestSchema(`{
+		"type": "object",
+		"properties": {
+			"room": {"type": "string", "maxLength": 128},
+			"limit": {"type": "integer"},
+			"before": {"type": "string"}
+		}
+	}`)
+	resumeSchema = newRequestSchema(`{
+		"type": "object",
+		"required": ["room"],
+		"properties": {
+			"room": {"type": "string", "minLength": 1, "maxLength": 128},
+			"since": {"type": "integer", "minimum": 0}
+		}
+	}`)
+)
+
+// requestSchema is a compiled JSON Schema for a route's request data
+type requestSchema struct {
+	schema *gojsonschema.Schema
+}
+
+// newRequestSchema compiles the JSON Schema source. It panics if the schema
+// is invalid, since the schemas are fixed at build time.
+func newRequestSchema(source string) *requestSchema {
+	schema, schemaErr := gojsonschema.NewSchema(gojsonschema.NewStringLoader(source))
+	if schemaErr != nil {
+		panic(schemaErr)
+	}
+	return &requestSchema{
+		schema: schema,
+	}
+}
+
+// validate returns the problems with the JSON request data, if any
+func (requestSchema *requestSchema) validate(data []byte) ([]*fieldError, error) {
+	result, resultErr := requestSchema.schema.Validate(gojsonschema.NewBytesLoader(data))
+	if resultErr != nil {
+		return nil, resultErr
+	}
+	var details []*fieldError
+	for _, eachErr := range result.Errors() {
+		details = append(details, &fieldError{
+			Field:       eachErr.Field(),
+			Description: eachErr.Description(),
+		})
+	}
+	return details, nil
+}
+
+// withSchema wraps the handler so that request data that doesn't conform
+// to the schema is rejected with an invalidRequest error frame listing the
+// invalid fields before it's processed
+func withSchema(requestSchema *requestSchema, handler wsHandler) wsHandler {
+	return func(ctx context.Context,
+		request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+		logger := contextLogger(ctx)
+		sess := newAWSSession(logger)
+		// Binary frames are decoded with the sender's negotiation
+		var senderItem map[string]*dynamodb.AttributeValue
+		var senderItemErr error
+		if request.IsBase64Encoded {
+			senderItem, senderItemErr = senderConnectionItem(ctx, request,
+				newConnectionsClient(sess))
+			if senderItemErr != nil {
+				logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+			}
+		}
+		payload, payloadErr := requestPayload(request, senderItem)
+		if payloadErr != nil {
+			// The handler reports unreadable frames
+			return handler(ctx, request)
+		}
+		details, validateErr := requestSchema.validate(payload)
+		if validateErr != nil {
+			logger.WithField("Error", validateErr).Warn("Failed to validate request")
+			return handler(ctx, request)
+		}
+		if len(details) == 0 {
+			return handler(ctx, request)
+		}
+		if senderItem == nil {
+			senderItem, senderItemErr = senderConnectionItem(ctx, request,
+				newConnectionsClient(sess))
+			if senderItemErr != nil {
+				logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+			}
+		}
+		message := catalog.Localize(itemLocale(senderItem), catalog.InvalidRequest)
+		apigwMgmtClient := newManagementClient(sess, managementEndpoint(request.RequestContext))
+		postErrorDetails(ctx, request, senderItem, apigwMgmtClient, &errorFrame{
+			Type:      errorMessage,
+			Code:      errorCodeInvalidRequest,
+			Message:   message,
+			RequestID: request.RequestContext.RequestID,
+			Details:   details,
+		}, logger)
+		return &wsResponse{
+			StatusCode: 500,
+			Body:       message,
+		}, nil
+	}
+}
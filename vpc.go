@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Provision-time environment variables that place the lambdas in a VPC
+	envKeyVPCID               = "VPC_ID"
+	envKeyVPCSubnetIDs        = "VPC_SUBNET_IDS"
+	envKeyVPCSecurityGroupIDs = "VPC_SECURITY_GROUP_IDS"
+
+	executeAPIEndpointResourceName = "ExecuteAPIVPCEndpoint"
+)
+
+// vpcConfig is the optional VPC placement for the lambda functions
+type vpcConfig struct {
+	vpcID            string
+	subnetIDs        []string
+	securityGroupIDs []string
+}
+
+// vpcConfigFromEnvironment returns the VPC placement from the provision-time
+// environment, or nil if the lambdas shouldn't run in a VPC
+func vpcConfigFromEnvironment() *vpcConfig {
+	if os.Getenv(envKeyVPCID) == "" {
+		return nil
+	}
+	return &vpcConfig{
+		vpcID:            os.Getenv(envKeyVPCID),
+		subnetIDs:        splitList(os.Getenv(envKeyVPCSubnetIDs)),
+		securityGroupIDs: splitList(os.Getenv(envKeyVPCSecurityGroupIDs)),
+	}
+}
+
+// splitList returns the non-empty elements of a comma separated list
+func splitList(value string) []string {
+	var values []string
+	for _, eachValue := range strings.Split(value, ",") {
+		if trimmed := strings.TrimSpace(eachValue); trimmed != "" {
+			values = append(values, trimmed)
+		}
+	}
+	return values
+}
+
+// stringList returns the CloudFormation list for the values
+func stringList(values []string) *gocf.StringListExpr {
+	stringables := make([]gocf.Stringable, len(values))
+	for eachIndex, eachValue := range values {
+		stringables[eachIndex] = gocf.String(eachValue)
+	}
+	return gocf.StringList(stringables...)
+}
+
+// manageConnectionsArn returns the resource ARN that grants
+// execute-api:ManageConnections for every stage of the API
+func manageConnectionsArn(apiGateway *sparta.APIV2) *gocf.StringExpr {
+	return gocf.Join("",
+		gocf.String("arn:"),
+		gocf.Ref("AWS::Partition"),
+		gocf.String(":execute-api:"),
+		gocf.Ref("AWS::Region"),
+		gocf.String(":"),
+		gocf.Ref("AWS::AccountId"),
+		gocf.String(":"),
+		gocf.Ref(apiGateway.LogicalResourceName()),
+		gocf.String("/*"))
+}
+
+// annotateVPC places the lambda in the VPC subnets and grants it permission
+// to manage the ENIs that requires
+func (config *vpcConfig) annotateVPC(lambdaFn *sparta.LambdaAWSInfo) {
+	if lambdaFn.Options == nil {
+		lambdaFn.Options = &sparta.LambdaFunctionOptions{}
+	}
+	lambdaFn.Options.VpcConfig = &gocf.LambdaFunctionVPCConfig{
+		SubnetIDs:        stringList(config.subnetIDs),
+		SecurityGroupIDs: stringList(config.securityGroupIDs),
+	}
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"ec2:CreateNetworkInterface",
+				"ec2:DescribeNetworkInterfaces",
+				"ec2:DeleteNetworkInterface"},
+			Resource: "*",
+		})
+}
+
+// executeAPIEndpointDecorator returns the decorator that provisions an
+// execute-api interface endpoint so that PostToConnection traffic from the
+// VPC never traverses the public internet. Private DNS makes the regular
+// execute-api hostname resolve to the endpoint, so handlers don't change.
+func (config *vpcConfig) executeAPIEndpointDecorator(apiGateway *sparta.APIV2) sparta.ServiceDecoratorHookFunc {
+	return func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+
+		endpointPolicy := map[string]interface{}{
+			"Version": "2012-10-17",
+			"Statement": []map[string]interface{}{
+				{
+					"Effect":    "Allow",
+					"Principal": "*",
+					"Action":    []string{"execute-api:ManageConnections"},
+					"Resource":  manageConnectionsArn(apiGateway),
+				},
+			},
+		}
+		template.AddResource(executeAPIEndpointResourceName, &gocf.EC2VPCEndpoint{
+			ServiceName: gocf.Join("",
+				gocf.String("com.amazonaws."),
+				gocf.Ref("AWS::Region"),
+				gocf.String(".execute-api")),
+			VPCEndpointType:   gocf.String("Interface"),
+			VPCID:             gocf.String(config.vpcID),
+			SubnetIDs:         stringList(config.subnetIDs),
+			SecurityGroupIDs:  stringList(config.securityGroupIDs),
+			PrivateDNSEnabled: gocf.Bool(true),
+			PolicyDocument:    endpointPolicy,
+		})
+		return nil
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyWebhookURL is the provision-time HTTPS endpoint that every
+	// accepted message is POSTed to, in addition to being broadcast
+	envKeyWebhookURL = "WEBHOOK_URL"
+	// envKeyWebhookQueueURL is the queue of messages to forward
+	envKeyWebhookQueueURL = "WEBHOOK_QUEUE_URL"
+	// envKeyWebhookSecretARN is the secret the forwarder signs requests with
+	envKeyWebhookSecretARN           = "WEBHOOK_SECRET_ARN"
+	webhookQueueResourceName         = "WebhookQueue"
+	webhookDeadLetterQueueName       = "WebhookDeadLetterQueue"
+	webhookSecretResourceName        = "WebhookSecret"
+	webhookMappingResourceName       = "WebhookQueueConsumer"
+	outputWebhookSecretARN           = "WebhookSecretArn"
+	webhookQueueVisibilityTimeout    = 60
+	webhookDeadLetterRetentionPeriod = 14 * 24 * 60 * 60
+	webhookMaxAttempts               = 5
+	webhookQueueBatchSize            = 10
+	webhookConsumerTimeout           = 30
+	webhookRequestTimeout            = 10 * time.Second
+	// webhookSecretTTL is how long a warm forwarder signs with the secret
+	// before reading it again, so rotations apply without a deploy
+	webhookSecretTTL = 5 * time.Minute
+	// Signed request headers. The signature is the hex HMAC-SHA256 of the
+	// timestamp, a period, and the body.
+	headerWebhookID        = "X-Webhook-Id"
+	headerWebhookTimestamp = "X-Webhook-Timestamp"
+	headerWebhookSignature = "X-Webhook-Signature"
+	// Forwarded message types
+	webhookTypeBroadcast = "broadcast"
+	webhookTypeRoom      = "room"
+	webhookTypeDirect    = "direct"
+	webhookTypeTopic     = "topic"
+)
+
+// webhookEvent is the forwarded message body
+type webhookEvent struct {
+	// ID is the request ID of the frame that sent the message, which is also
+	// its correlation ID
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	MessageID    string          `json:"messageId,omitempty"`
+	ConnectionID string          `json:"connectionId"`
+	UserID       string          `json:"userId,omitempty"`
+	Room         string          `json:"room,omitempty"`
+	Topic        string          `json:"topic,omitempty"`
+	To           string          `json:"to,omitempty"`
+	Data         json.RawMessage `json:"data"`
+	SentAt       string          `json:"sentAt"`
+}
+
+// webhookEnabled returns true if accepted messages are forwarded
+func webhookEnabled() bool {
+	return os.Getenv(envKeyWebhookURL) != ""
+}
+
+// webhookURL returns the provision-time webhook URL, which must be HTTPS
+func webhookURL() (string, error) {
+	rawURL := os.Getenv(envKeyWebhookURL)
+	parsedURL, parseErr := url.Parse(rawURL)
+	if parseErr != nil || parsedURL.Scheme != "https" || parsedURL.Host == "" {
+		return "", fmt.Errorf("%s must be an https:// URL: %q", envKeyWebhookURL, rawURL)
+	}
+	return rawURL, nil
+}
+
+// forwardMessage queues the accepted message for the webhook, if there is
+// one. Forwarding is best effort, so failures are logged rather than
+// failing the send.
+func forwardMessage(ctx context.Context,
+	sess *session.Session,
+	request awsEvents.APIGatewayWebsocketProxyRequest,
+	event *webhookEvent,
+	senderItem map[string]*dynamodb.AttributeValue,
+	logger *logrus.Logger) {
+	queueURL := os.Getenv(envKeyWebhookQueueURL)
+	if queueURL == "" {
+		return
+	}
+	event.ID = request.RequestContext.RequestID
+	event.ConnectionID = request.RequestContext.ConnectionID
+	event.UserID = itemUserID(senderItem)
+	event.SentAt = time.Now().UTC().Format(time.RFC3339Nano)
+	body, bodyErr := json.Marshal(event)
+	if bodyErr != nil {
+		logger.WithField("Error", bodyErr).Warn("Failed to marshal webhook event")
+		return
+	}
+	_, sendErr := newSQSClient(sess).SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueURL),
+		MessageBody: aws.String(string(body)),
+	})
+	if sendErr != nil {
+		logger.WithField("Error", sendErr).Warn("Failed to queue webhook event")
+	}
+}
+
+// webhookSigningKey caches the signing secret for the life of the warm
+// container. It's safe for concurrent use.
+type webhookSigningKey struct {
+	mutex     sync.Mutex
+	secret    []byte
+	fetchedAt time.Time
+}
+
+var webhookKey = &webhookSigningKey{}
+
+// get returns the signing secret, reading it again once it's older than
+// webhookSecretTTL
+func (key *webhookSigningKey) get(ctx context.Context, sess *session.Session) ([]byte, error) {
+	key.mutex.Lock()
+	defer key.mutex.Unlock()
+	if key.secret != nil && time.Since(key.fetchedAt) < webhookSecretTTL {
+		return key.secret, nil
+	}
+	secretOutput, secretErr := secretsmanager.New(sess).GetSecretValueWithContext(ctx,
+		&secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(os.Getenv(envKeyWebhookSecretARN)),
+		})
+	if secretErr != nil {
+		return nil, secretErr
+	}
+	key.secret = []byte(aws.StringValue(secretOutput.SecretString))
+	key.fetchedAt = time.Now()
+	return key.secret, nil
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of the timestamp and body
+func webhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var webhookClient = &http.Client{
+	Timeout: webhookRequestTimeout,
+}
+
+// sqsBatchResponse is the partial batch response of an SQS consumer whose
+// event source mapping reports batch item failures. Only the failed
+// messages are retried.
+type sqsBatchResponse struct {
+	BatchItemFailures []sqsBatchItemFailure `json:"batchItemFailures"`
+}
+
+// sqsBatchItemFailure identifies a failed message by its message ID
+type sqsBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// forwardWebhooks is the webhook queue consumer. The batch's messages are
+// POSTed to the webhook concurrently, each with its signature. Messages that
+// can't be parsed, or whose POST fails or has a response other than 2xx, are
+// reported as failed, so SQS retries only them before parking them in the
+// dead letter queue. The webhook may receive a message more than once and
+// should dedupe on the X-Webhook-Id header.
+func forwardWebhooks(ctx context.Context, event awsEvents.SQSEvent) (response *sqsBatchResponse, err error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	ctx, finishInvocation := startInvocation(ctx, "ForwardWebhooks")
+	defer func() {
+		finishInvocation(err)
+	}()
+	targetURL, targetURLErr := webhookURL()
+	if targetURLErr != nil {
+		return nil, targetURLErr
+	}
+	secret, secretErr := webhookKey.get(ctx, sess)
+	if secretErr != nil {
+		return nil, secretErr
+	}
+
+	// Operation
+	response = &sqsBatchResponse{
+		BatchItemFailures: []sqsBatchItemFailure{},
+	}
+	var waitGroup sync.WaitGroup
+	var mutex sync.Mutex
+	for _, eachRecord := range event.Records {
+		waitGroup.Add(1)
+		go func(record awsEvents.SQSMessage) {
+			defer waitGroup.Done()
+			forwardErr := forwardWebhook(ctx, targetURL, secret, record, logger)
+			if forwardErr == nil {
+				return
+			}
+			logger.WithFields(logrus.Fields{
+				"Error":     forwardErr,
+				"MessageID": record.MessageId,
+			}).Warn("Failed to forward message")
+			mutex.Lock()
+			defer mutex.Unlock()
+			response.BatchItemFailures = append(response.BatchItemFailures, sqsBatchItemFailure{
+				ItemIdentifier: record.MessageId,
+			})
+		}(eachRecord)
+	}
+	waitGroup.Wait()
+	return response, nil
+}
+
+// forwardWebhook POSTs the queued message to the webhook with its signature
+func forwardWebhook(ctx context.Context,
+	targetURL string,
+	secret []byte,
+	record awsEvents.SQSMessage,
+	logger *logrus.Logger) error {
+	var forwarded webhookEvent
+	unmarshalErr := json.Unmarshal([]byte(record.Body), &forwarded)
+	if unmarshalErr != nil {
+		return unmarshalErr
+	}
+	body := []byte(record.Body)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	postRequest, postRequestErr := http.NewRequestWithContext(ctx,
+		http.MethodPost,
+		targetURL,
+		bytes.NewReader(body))
+	if postRequestErr != nil {
+		return postRequestErr
+	}
+	postRequest.Header.Set("Content-Type", "application/json")
+	postRequest.Header.Set(headerWebhookID, forwarded.ID)
+	postRequest.Header.Set(headerWebhookTimestamp, timestamp)
+	postRequest.Header.Set(headerWebhookSignature, webhookSignature(secret, timestamp, body))
+	postResponse, postErr := webhookClient.Do(postRequest)
+	if postErr != nil {
+		return postErr
+	}
+	postResponse.Body.Close()
+	if postResponse.StatusCode < 200 || postResponse.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d to %s",
+			postResponse.StatusCode,
+			forwarded.ID)
+	}
+	correlatedLogger(logger, forwarded.ID).WithField("Type", forwarded.Type).Debug("Forwarded message")
+	return nil
+}
+
+// sqsEventSourceMapping is an SQS event source mapping that reports batch
+// item failures, which the sparta event source mappings can't configure
+type sqsEventSourceMapping struct {
+	EventSourceArn        *gocf.StringExpr `json:"EventSourceArn,omitempty"`
+	FunctionName          *gocf.StringExpr `json:"FunctionName,omitempty"`
+	BatchSize             int64            `json:"BatchSize,omitempty"`
+	FunctionResponseTypes []string         `json:"FunctionResponseTypes,omitempty"`
+}
+
+func (mapping *sqsEventSourceMapping) CfnResourceType() string {
+	return "AWS::Lambda::EventSourceMapping"
+}
+
+func (mapping *sqsEventSourceMapping) CfnResourceAttributes() []string {
+	return []string{}
+}
+
+// webhookDecorator provisions the webhook queue, its dead letter queue, and
+// the signing secret, whose ARN is exported so the webhook's backend can read
+// it. It also subscribes the forwarder to the queue.
+func webhookDecorator(forwarder *sparta.LambdaAWSInfo) sparta.ServiceDecoratorHookHandler {
+	return sparta.ServiceDecoratorHookFunc(func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		if _, webhookURLErr := webhookURL(); webhookURLErr != nil {
+			return webhookURLErr
+		}
+		template.AddResource(webhookDeadLetterQueueName, &gocf.SQSQueue{
+			MessageRetentionPeriod: gocf.Integer(webhookDeadLetterRetentionPeriod),
+		})
+		template.AddResource(webhookQueueResourceName, &gocf.SQSQueue{
+			VisibilityTimeout: gocf.Integer(webhookQueueVisibilityTimeout),
+			RedrivePolicy: map[string]interface{}{
+				"deadLetterTargetArn": gocf.GetAtt(webhookDeadLetterQueueName, "Arn"),
+				"maxReceiveCount":     webhookMaxAttempts,
+			},
+		})
+		template.AddResource(webhookSecretResourceName, &gocf.SecretsManagerSecret{
+			Description: gocf.String("Signs the messages forwarded to " + os.Getenv(envKeyWebhookURL)),
+			GenerateSecretString: &gocf.SecretsManagerSecretGenerateSecretString{
+				PasswordLength:     gocf.Integer(64),
+				ExcludePunctuation: gocf.Bool(true),
+			},
+		})
+		template.Outputs[outputWebhookSecretARN] = &gocf.Output{
+			Description: "Secret whose value signs the forwarded webhook requests",
+			Value:       gocf.Ref(webhookSecretResourceName),
+			Export:      stackExport(outputWebhookSecretARN),
+		}
+		template.AddResource(webhookMappingResourceName, &sqsEventSourceMapping{
+			EventSourceArn:        gocf.GetAtt(webhookQueueResourceName, "Arn").String(),
+			FunctionName:          gocf.Ref(forwarder.LogicalResourceName()).String(),
+			BatchSize:             webhookQueueBatchSize,
+			FunctionResponseTypes: []string{"ReportBatchItemFailures"},
+		})
+		return nil
+	})
+}
+
+// annotateWebhookProducer lets the lambda queue accepted messages for the
+// webhook and publishes the queue URL in its environment
+func annotateWebhookProducer(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"sqs:SendMessage"},
+			Resource: gocf.GetAtt(webhookQueueResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyWebhookQueueURL, gocf.Ref(webhookQueueResourceName).String())
+}
+
+// annotateWebhookForwarder lets the lambda consume the webhook queue and read
+// the signing secret. webhookDecorator subscribes it.
+func annotateWebhookForwarder(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"sqs:ReceiveMessage",
+				"sqs:DeleteMessage",
+				"sqs:GetQueueAttributes"},
+			Resource: gocf.GetAtt(webhookQueueResourceName, "Arn"),
+		},
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"secretsmanager:GetSecretValue"},
+			Resource: gocf.Ref(webhookSecretResourceName),
+		})
+	setEnvironment(lambdaFn, envKeyWebhookURL, gocf.String(os.Getenv(envKeyWebhookURL)))
+	setEnvironment(lambdaFn, envKeyWebhookSecretARN, gocf.Ref(webhookSecretResourceName).String())
+	// The visibility timeout must exceed the forwarder's timeout
+	lambdaFn.Options.Timeout = webhookConsumerTimeout
+}
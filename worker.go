@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	apigwManagement "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaWebSocket/affinity"
+	"github.com/mweagle/SpartaWebSocket/catalog"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// envKeyWorkerShards is the comma separated list of worker shard names.
+	// Defaults to defaultWorkerShardCount numbered shards.
+	envKeyWorkerShards      = "WORKER_SHARDS"
+	envKeyWorkQueueURL      = "WORK_QUEUE_URL"
+	defaultWorkerShardCount = 4
+	workQueueResourceName   = "WorkQueue"
+	workMappingResourceName = "WorkQueueConsumer"
+	workQueueBatchSize      = 10
+	ddbAttributeShard       = "shard"
+	// queryParamAffinityKey groups connections (eg, players in one game) onto
+	// the same shard. Defaults to the connection ID.
+	queryParamAffinityKey = "affinity"
+	workMessage           = "work"
+)
+
+// workItem is the work queue message body
+type workItem struct {
+	ConnectionID string          `json:"connectionId"`
+	Shard        string          `json:"shard"`
+	EndpointURL  string          `json:"endpointURL"`
+	Data         json.RawMessage `json:"data"`
+}
+
+// workerShards returns the configured shard names
+func workerShards() []string {
+	if shards := splitList(os.Getenv(envKeyWorkerShards)); len(shards) != 0 {
+		return shards
+	}
+	shards := make([]string, defaultWorkerShardCount)
+	for eachIndex := range shards {
+		shards[eachIndex] = "shard-" + strconv.Itoa(eachIndex)
+	}
+	return shards
+}
+
+// shardRing returns the consistent hash ring for the configured shards
+func shardRing() *affinity.Ring {
+	ring, _ := affinity.NewRing(workerShards(), affinity.DefaultReplicas)
+	return ring
+}
+
+// handshakeAffinityKey returns the affinity key for the connecting client
+func handshakeAffinityKey(request awsEvents.APIGatewayWebsocketProxyRequest) string {
+	affinityKey := request.QueryStringParameters[queryParamAffinityKey]
+	if affinityKey == "" {
+		affinityKey = request.RequestContext.ConnectionID
+	}
+	return affinityKey
+}
+
+// itemShard returns the shard stored in the connection item, assigning one
+// for connections that predate sharding
+func itemShard(connectionID string, item map[string]*dynamodb.AttributeValue) string {
+	if item[ddbAttributeShard] == nil || item[ddbAttributeShard].S == nil {
+		return shardRing().Shard(connectionID)
+	}
+	return *item[ddbAttributeShard].S
+}
+
+// submitWork queues the request data for the sender's worker shard. The
+// work queue is FIFO with the shard as the message group, so each shard's
+// work is processed in order by one worker invocation at a time.
+func submitWork(ctx context.Context,
+	request awsEvents.APIGatewayWebsocketProxyRequest) (*wsResponse, error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	endpointURL := managementEndpoint(request.RequestContext)
+	dynamoClient := newConnectionsClient(sess)
+	apigwMgmtClient := newManagementClient(sess, endpointURL)
+	connectionID := request.RequestContext.ConnectionID
+
+	senderItem, senderItemErr := senderConnectionItem(ctx, request, dynamoClient)
+	if senderItemErr != nil {
+		logger.WithField("Error", senderItemErr).Warn("Failed to get sender connection")
+	}
+	locale := itemLocale(senderItem)
+	if rateLimited(ctx, sess, connectionID, dynamoClient, logger) {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeRateLimited,
+			catalog.Localize(locale, catalog.RateLimited),
+			logger), nil
+	}
+	payload, payloadErr := requestPayload(request, senderItem)
+	if payloadErr != nil {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeMalformedRequest,
+			catalog.Localize(locale, catalog.UnmarshalFailed, payloadErr.Error()),
+			logger), nil
+	}
+
+	// Operation
+	shard := claimShard(ctx,
+		itemAffinityKey(connectionID, senderItem),
+		itemShard(connectionID, senderItem),
+		newDynamoClient(sess),
+		logger)
+	body, _ := json.Marshal(&workItem{
+		ConnectionID: connectionID,
+		Shard:        shard,
+		EndpointURL:  endpointURL,
+		Data:         payload,
+	})
+	_, sendErr := newSQSClient(sess).SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:               aws.String(os.Getenv(envKeyWorkQueueURL)),
+		MessageBody:            aws.String(string(body)),
+		MessageGroupId:         aws.String(shard),
+		MessageDeduplicationId: aws.String(request.RequestContext.RequestID),
+	})
+	if sendErr != nil {
+		return wsError(ctx,
+			request,
+			senderItem,
+			apigwMgmtClient,
+			errorCodeSendFailed,
+			catalog.Localize(locale, catalog.SendFailed, sendErr.Error()),
+			logger), nil
+	}
+	metrics := newMetricsEmitter().withDimension(metricDimensionShard, shard)
+	metrics.add(metricWorkItems, 1)
+	metricsErr := metrics.flush()
+	if metricsErr != nil {
+		logger.WithField("Error", metricsErr).Warn("Failed to publish metrics")
+	}
+	return &wsResponse{
+		StatusCode: 200,
+		Body:       catalog.Localize(locale, catalog.DataSent),
+	}, nil
+}
+
+// processWork is the stateful worker. Every record in a batch belongs to
+// the same shard's message group, so per-shard state can safely live in the
+// warm container. This sample echoes each work item back to its sender,
+// tagged with the shard that processed it. A failed work item is reported as
+// a batch item failure along with the later items in its message group, so
+// SQS retries only them, in order, rather than the items that were already
+// echoed.
+func processWork(ctx context.Context, event awsEvents.SQSEvent) (response *sqsBatchResponse, err error) {
+	// Preconditions
+	logger := contextLogger(ctx)
+	sess := newAWSSession(logger)
+	dynamoClient := newConnectionsClient(sess)
+	ctx, finishInvocation := startInvocation(ctx, "ProcessWork")
+	defer func() {
+		finishInvocation(err)
+	}()
+
+	// Operation
+	response = &sqsBatchResponse{
+		BatchItemFailures: []sqsBatchItemFailure{},
+	}
+	failedGroups := make(map[string]bool)
+	for _, eachRecord := range event.Records {
+		messageGroupID := eachRecord.Attributes["MessageGroupId"]
+		if !failedGroups[messageGroupID] {
+			workErr := processWorkItem(ctx, sess, dynamoClient, eachRecord, logger)
+			if workErr == nil {
+				continue
+			}
+			logger.WithFields(logrus.Fields{
+				"Error":     workErr,
+				"MessageID": eachRecord.MessageId,
+			}).Warn("Failed to process work item")
+			failedGroups[messageGroupID] = true
+		}
+		response.BatchItemFailures = append(response.BatchItemFailures, sqsBatchItemFailure{
+			ItemIdentifier: eachRecord.MessageId,
+		})
+	}
+	return response, nil
+}
+
+// processWorkItem echoes the queued work item back to its sender. Malformed
+// items and items whose sender is gone are discarded.
+func processWorkItem(ctx context.Context,
+	sess *session.Session,
+	dynamoClient dynamodbiface.DynamoDBAPI,
+	record awsEvents.SQSMessage,
+	logger *logrus.Logger) error {
+	var item workItem
+	unmarshalErr := json.Unmarshal([]byte(record.Body), &item)
+	if unmarshalErr != nil {
+		logger.WithField("Body", record.Body).Warn("Discarding malformed work item")
+		return nil
+	}
+	resultData, _ := json.Marshal(map[string]interface{}{
+		"shard": item.Shard,
+		"data":  item.Data,
+	})
+	receiverItem, receiverItemErr := getConnectionItem(item.ConnectionID, dynamoClient)
+	if receiverItemErr != nil {
+		return receiverItemErr
+	}
+	frame, frameErr := itemNegotiation(receiverItem).EncodeFrame(workMessage, resultData)
+	if frameErr != nil {
+		return frameErr
+	}
+	apigwMgmtClient := newManagementClient(sess, item.EndpointURL)
+	_, postErr := apigwMgmtClient.PostToConnectionWithContext(ctx, &apigwManagement.PostToConnectionInput{
+		ConnectionId: aws.String(item.ConnectionID),
+		Data:         frame,
+	})
+	if postErr != nil {
+		if strings.Contains(postErr.Error(), apigwManagement.ErrCodeGoneException) {
+			return nil
+		}
+		return fmt.Errorf("failed to post work result: %s", postErr)
+	}
+	return nil
+}
+
+// workQueueDecorator provisions the FIFO work queue and subscribes the
+// worker to it
+func workQueueDecorator(consumer *sparta.LambdaAWSInfo) sparta.ServiceDecoratorHookHandler {
+	return sparta.ServiceDecoratorHookFunc(func(context map[string]interface{},
+		serviceName string,
+		template *gocf.Template,
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+		template.AddResource(workQueueResourceName, &gocf.SQSQueue{
+			FifoQueue:         gocf.Bool(true),
+			VisibilityTimeout: gocf.Integer(cleanupQueueVisibilityTimeout),
+		})
+		template.AddResource(workMappingResourceName, &sqsEventSourceMapping{
+			EventSourceArn:        gocf.GetAtt(workQueueResourceName, "Arn").String(),
+			FunctionName:          gocf.Ref(consumer.LogicalResourceName()).String(),
+			BatchSize:             workQueueBatchSize,
+			FunctionResponseTypes: []string{"ReportBatchItemFailures"},
+		})
+		return nil
+	})
+}
+
+// annotateWorkerShards publishes the provision-time shard configuration in
+// the lambda environment
+func annotateWorkerShards(lambdaFn *sparta.LambdaAWSInfo) {
+	setEnvironment(lambdaFn, envKeyWorkerShards, gocf.String(strings.Join(workerShards(), ",")))
+}
+
+// annotateWorkProducer lets the lambda queue work and publishes the queue URL
+// in its environment
+func annotateWorkProducer(lambdaFn *sparta.LambdaAWSInfo) {
+	annotateWorkerShards(lambdaFn)
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"sqs:SendMessage"},
+			Resource: gocf.GetAtt(workQueueResourceName, "Arn"),
+		})
+	setEnvironment(lambdaFn, envKeyWorkQueueURL, gocf.Ref(workQueueResourceName).String())
+}
+
+// annotateWorkConsumer lets the worker lambda consume the work queue. The
+// subscription is provisioned by workQueueDecorator, since it reports batch
+// item failures.
+func annotateWorkConsumer(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"sqs:ReceiveMessage",
+				"sqs:DeleteMessage",
+				"sqs:GetQueueAttributes"},
+			Resource: gocf.GetAtt(workQueueResourceName, "Arn"),
+		})
+}
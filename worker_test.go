@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	awsEvents "github.com/aws/aws-lambda-go/events"
+)
+
+// workRecord returns a work queue record for the connection in the shard's
+// message group
+func workRecord(messageID string, connectionID string, shard string) awsEvents.SQSMessage {
+	body, _ := json.Marshal(&workItem{
+		ConnectionID: connectionID,
+		Shard:        shard,
+		EndpointURL:  "https://abc123.execute-api.us-east-1.amazonaws.com/test",
+		Data:         json.RawMessage(`"work"`),
+	})
+	return awsEvents.SQSMessage{
+		MessageId: messageID,
+		Body:      string(body),
+		Attributes: map[string]string{
+			"MessageGroupId": shard,
+		},
+	}
+}
+
+func TestProcessWork(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []awsEvents.SQSMessage
+		gone    []string
+		fail    []string
+		// posts is the number of frames posted to each connection
+		posts    map[string]int
+		failures string
+	}{
+		{name: "success",
+			records: []awsEvents.SQSMessage{
+				workRecord("m-1", "conn-1", "shard-0"),
+				workRecord("m-2", "conn-2", "shard-0"),
+			},
+			posts:    map[string]int{"conn-1": 1, "conn-2": 1},
+			failures: "[]"},
+		{name: "malformed and gone items are discarded",
+			records: []awsEvents.SQSMessage{
+				{MessageId: "m-1", Body: "{"},
+				workRecord("m-2", "conn-1", "shard-0"),
+				workRecord("m-3", "conn-2", "shard-0"),
+			},
+			gone:     []string{"conn-1"},
+			posts:    map[string]int{"conn-1": 0, "conn-2": 1},
+			failures: "[]"},
+		{name: "failure retries the rest of its group",
+			records: []awsEvents.SQSMessage{
+				workRecord("m-1", "conn-1", "shard-0"),
+				workRecord("m-2", "conn-2", "shard-0"),
+				workRecord("m-3", "conn-3", "shard-1"),
+				workRecord("m-4", "conn-1", "shard-0"),
+			},
+			fail:     []string{"conn-2"},
+			posts:    map[string]int{"conn-1": 1, "conn-2": 0, "conn-3": 1},
+			failures: "[m-2 m-4]"},
+	}
+	for _, eachTest := range tests {
+		t.Run(eachTest.name, func(t *testing.T) {
+			mgmt := newMockManagement(eachTest.gone...)
+			for _, eachConnectionID := range eachTest.fail {
+				mgmt.fail[eachConnectionID] = true
+			}
+			useMockClients(t, newMockDynamo("conn-1", "conn-2", "conn-3"), mgmt)
+			response, processErr := processWork(context.Background(),
+				awsEvents.SQSEvent{Records: eachTest.records})
+			if processErr != nil {
+				t.Fatalf("processWork failed: %s", processErr)
+			}
+			var failures []string
+			for _, eachFailure := range response.BatchItemFailures {
+				failures = append(failures, eachFailure.ItemIdentifier)
+			}
+			if fmt.Sprint(failures) != eachTest.failures {
+				t.Errorf("Batch item failures = %v, want %s", failures, eachTest.failures)
+			}
+			for eachConnectionID, eachCount := range eachTest.posts {
+				if count := mgmt.postCount(eachConnectionID); count != eachCount {
+					t.Errorf("Posts to %s = %d, want %d", eachConnectionID, count, eachCount)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-xray-sdk-go/strategy/ctxmissing"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+// envKeyXRayTracing enables active X-Ray tracing. It's read at provision time
+// and propagated to the lambda environments.
+const envKeyXRayTracing = "XRAY_TRACING"
+
+var xrayConfigureOnce sync.Once
+
+// xrayEnabled returns true if XRAY_TRACING is set
+func xrayEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(envKeyXRayTracing))
+	return enabled
+}
+
+// xraySession returns the session with X-Ray instrumentation, so that every
+// AWS call made by its clients is recorded as a subsegment of the
+// invocation's segment. Calls made without a request context, eg by
+// goroutines that outlive the invocation, are logged rather than traced.
+func xraySession(sess *session.Session, logger *logrus.Logger) *session.Session {
+	if !xrayEnabled() {
+		return sess
+	}
+	xrayConfigureOnce.Do(func() {
+		configureErr := xray.Configure(xray.Config{
+			ContextMissingStrategy: ctxmissing.NewDefaultLogErrorStrategy(),
+		})
+		if configureErr != nil {
+			logger.WithField("Error", configureErr).Warn("Failed to configure X-Ray")
+		}
+	})
+	return xray.AWSSession(sess)
+}
+
+// annotateXRay enables active tracing for the lambda and lets it publish
+// trace segments
+func annotateXRay(lambdaFn *sparta.LambdaAWSInfo) {
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"xray:PutTraceSegments",
+				"xray:PutTelemetryRecords"},
+			Resource: "*",
+		})
+	if lambdaFn.Options == nil {
+		lambdaFn.Options = &sparta.LambdaFunctionOptions{}
+	}
+	lambdaFn.Options.TracingConfig = &gocf.LambdaFunctionTracingConfig{
+		Mode: gocf.String("Active"),
+	}
+	setEnvironment(lambdaFn, envKeyXRayTracing, gocf.String("true"))
+}